@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfigFile sets the flags to the values of the YAML or JSON config file at path, whose keys
+// are the names of the flags. Flags that are in set, which were passed on the command line, keep
+// their values, as do flags missing from the file.
+func applyConfigFile(flags *beamFlags, path string, set map[string]bool) error {
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	fileFlags := *flags
+	fileFlags.Parameters = nil
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fileFlags); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if fileFlags.Parameters == nil {
+		fileFlags.Parameters = flags.Parameters
+	}
+
+	got, file := reflect.ValueOf(flags).Elem(), reflect.ValueOf(fileFlags)
+	for i := 0; i < got.NumField(); i++ {
+		name := got.Type().Field(i).Tag.Get("yaml")
+		if name == "-" || set[name] {
+			continue
+		}
+		got.Field(i).Set(file.Field(i))
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	defaults := beamFlags{
+		FHIRStoreEndpoint:         "https://healthcare.googleapis.com/",
+		WindowDuration:            time.Minute,
+		EvaluationTimestampSource: "fixed",
+	}
+	tests := []struct {
+		name   string
+		config string
+		flags  beamFlags
+		set    []string
+		want   beamFlags
+	}{
+		{
+			name: "YAML",
+			config: `
+cql_dir: gs://bucket/cql
+fhir_bundle_dir: gs://bucket/bundles
+fhir_terminology_dir: gs://bucket/terminology
+ndjson_output_dir: gs://bucket/output
+window_duration: 5m
+output_shards: 10
+parameter:
+  - Measure.Threshold=3
+  - "Measure.Measurement Period=Interval[@2024-01-01, @2025-01-01)"
+`,
+			flags: defaults,
+			want: beamFlags{
+				CQLDir:                    "gs://bucket/cql",
+				FHIRBundleDir:             "gs://bucket/bundles",
+				FHIRTerminologyDir:        "gs://bucket/terminology",
+				NDJSONOutputDir:           "gs://bucket/output",
+				FHIRStoreEndpoint:         "https://healthcare.googleapis.com/",
+				WindowDuration:            5 * time.Minute,
+				EvaluationTimestampSource: "fixed",
+				OutputShards:              10,
+				Parameters:                parameterFlags{"Measure.Threshold=3", "Measure.Measurement Period=Interval[@2024-01-01, @2025-01-01)"},
+			},
+		},
+		{
+			name:   "JSON",
+			config: `{"cql_dir": "cql", "fhir_ndjson_dir": "ndjson", "ndjson_output_dir": "output", "return_private_defs": true}`,
+			flags:  defaults,
+			want: beamFlags{
+				CQLDir:                    "cql",
+				FHIRNDJSONDir:             "ndjson",
+				NDJSONOutputDir:           "output",
+				ReturnPrivateDefs:         true,
+				FHIRStoreEndpoint:         "https://healthcare.googleapis.com/",
+				WindowDuration:            time.Minute,
+				EvaluationTimestampSource: "fixed",
+			},
+		},
+		{
+			name:   "Command line flags take precedence",
+			config: "cql_dir: cql\nndjson_output_dir: output\nparameter: [Measure.Threshold=3]\n",
+			flags: beamFlags{
+				NDJSONOutputDir: "other_output",
+				Parameters:      parameterFlags{"Measure.Threshold=4"},
+			},
+			set: []string{"ndjson_output_dir", "parameter"},
+			want: beamFlags{
+				CQLDir:          "cql",
+				NDJSONOutputDir: "other_output",
+				Parameters:      parameterFlags{"Measure.Threshold=4"},
+			},
+		},
+		{
+			name:   "Empty",
+			config: "",
+			flags:  defaults,
+			want:   defaults,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+			}
+			set := make(map[string]bool)
+			for _, name := range tc.set {
+				set[name] = true
+			}
+			got := tc.flags
+			if err := applyConfigFile(&got, path, set); err != nil {
+				t.Fatalf("applyConfigFile() returned an unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("applyConfigFile() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFile_Failure(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantError string
+	}{
+		{
+			name:      "Unknown flag",
+			config:    "cql_directory: cql\n",
+			wantError: "field cql_directory not found",
+		},
+		{
+			name:      "Invalid value",
+			config:    "output_shards: many\n",
+			wantError: "failed to parse config",
+		},
+		{
+			name:      "Invalid duration",
+			config:    "window_duration: often\n",
+			wantError: "failed to parse config",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+			}
+			err := applyConfigFile(&beamFlags{}, path, nil)
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("applyConfigFile() returned error %v, want error containing %q", err, tc.wantError)
+			}
+		})
+	}
+
+	if err := applyConfigFile(&beamFlags{}, "missing.yaml", nil); err == nil || !strings.Contains(err.Error(), "failed to read file missing.yaml") {
+		t.Errorf("applyConfigFile() returned error %v, want failed to read file", err)
+	}
+}
+
+func TestApplyConfigFile_BuildsConfig(t *testing.T) {
+	cqlDir, terminologyDir, fhirBundleDir := directorySetup(t, cqlLibs, valueSets, fhirBundles)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := "cql_dir: " + cqlDir + "\n" +
+		"fhir_bundle_dir: " + fhirBundleDir + "\n" +
+		"fhir_terminology_dir: " + terminologyDir + "\n" +
+		"evaluation_timestamp: 2024-01-01T00:00:00Z\n" +
+		"output_shards: 4\n"
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+	}
+	flags := &beamFlags{NDJSONOutputDir: "output"}
+	if err := applyConfigFile(flags, path, map[string]bool{"ndjson_output_dir": true}); err != nil {
+		t.Fatalf("applyConfigFile() returned an unexpected error: %v", err)
+	}
+	cfg, err := buildPipelineConfig(flags)
+	if err != nil {
+		t.Fatalf("buildPipelineConfig() returned an unexpected error: %v", err)
+	}
+	if cfg.FHIRBundleDir != fhirBundleDir || cfg.NDJSONOutputDir != "output" || cfg.OutputShards != 4 || len(cfg.ValueSets) != len(valueSets) {
+		t.Errorf("buildPipelineConfig() = %+v, want the inputs of the config file and the output of the flags", cfg)
+	}
+}
+
+func TestBeamFlagsConfigKeys(t *testing.T) {
+	// The keys of config files are the names of the flags.
+	typ := reflect.TypeOf(beamFlags{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Tag.Get("yaml")
+		if name == "-" {
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			t.Errorf("beamFlags.%s has config key %q, which is not a flag", typ.Field(i).Name, name)
+		}
+	}
+}
@@ -20,57 +20,192 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
-	log "github.com/golang/glog"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/window"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/x/beamx"
+	log "github.com/golang/glog"
+	"github.com/google/cql"
 	"github.com/google/cql/beam/transforms"
-	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/google/cql/internal/datarequirements"
+	"github.com/google/cql/measure"
+	"github.com/google/cql/result"
 
-	// The following import is required for accessing local files.
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/fileio"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem"
+	// The following imports are required for accessing local and Google Cloud Storage files.
+	_ "github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem/gcs"
 	_ "github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem/local"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/pubsubio"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/textio"
 )
 
-// TODO(b/317813865): Add input and output options as needed, such as FHIR Store or NDJSON inputs
-// and BigQuery outputs.
+// TODO(b/317813865): Add input and output options as needed.
 
 // flags holds the values of the flags largely to assist in easier testing without having to change
 // global variables.
 type beamFlags struct {
-	CQLDir             string
-	FHIRBundleDir      string
-	FHIRTerminologyDir string
-	EvaluationTimestamp string
-	ReturnPrivateDefs   bool
-	NDJSONOutputDir     string
+	// Config is the path of a YAML or JSON file holding the values of the other flags, keyed by
+	// flag name.
+	Config                    string         `yaml:"-"`
+	CQLDir                    string         `yaml:"cql_dir"`
+	FHIRBundleDir             string         `yaml:"fhir_bundle_dir"`
+	MergePatientBundles       bool           `yaml:"merge_patient_bundles"`
+	FHIRNDJSONDir             string         `yaml:"fhir_ndjson_dir"`
+	FHIRStore                 string         `yaml:"fhir_store"`
+	FHIRStoreEndpoint         string         `yaml:"fhir_store_endpoint"`
+	FHIRStoreQuery            string         `yaml:"fhir_store_query"`
+	PubSubTopic               string         `yaml:"pubsub_topic"`
+	PubSubSubscription        string         `yaml:"pubsub_subscription"`
+	WindowDuration            time.Duration  `yaml:"window_duration"`
+	FHIRTerminologyDir        string         `yaml:"fhir_terminology_dir"`
+	EvaluationTimestamp       string         `yaml:"evaluation_timestamp"`
+	EvaluationTimestampSource string         `yaml:"evaluation_timestamp_source"`
+	ReturnPrivateDefs         bool           `yaml:"return_private_defs"`
+	IncludeDefines            string         `yaml:"include_defines"`
+	IncludeDefinesRegex       string         `yaml:"include_defines_regex"`
+	ExcludeDefines            string         `yaml:"exclude_defines"`
+	ExcludeDefinesRegex       string         `yaml:"exclude_defines_regex"`
+	Parameters                parameterFlags `yaml:"parameter"`
+	NDJSONOutputDir           string         `yaml:"ndjson_output_dir"`
+	BigQueryOutputTable       string         `yaml:"bigquery_output_table"`
+	BigQueryErrorsTable       string         `yaml:"bigquery_errors_table"`
+	DeadLetterDir             string         `yaml:"dead_letter_dir"`
+	OutputShards              int            `yaml:"output_shards"`
+	OutputPartition           string         `yaml:"output_partition"`
+	AggregatePopulations      bool           `yaml:"aggregate_populations"`
+	Measure                   string         `yaml:"measure"`
+	ResumeFromDir             string         `yaml:"resume_from_dir"`
+	MaxBundleResources        int            `yaml:"max_bundle_resources"`
+	MaxBundleBytes            int64          `yaml:"max_bundle_bytes"`
+	MaxConcurrentEvals        int            `yaml:"max_concurrent_evals"`
+}
+
+// parameterFlags holds the values of the repeated --parameter flag.
+type parameterFlags []string
+
+func (p *parameterFlags) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *parameterFlags) Set(v string) error {
+	*p = append(*p, v)
+	return nil
 }
 
 var flags beamFlags
 
 func init() {
+	flag.StringVar(&flags.Config, "config", "", "(Optional) Path to a YAML or JSON file holding the values of the other flags, keyed by flag name. Flags passed on the command line take precedence over the file.")
 	flag.StringVar(&flags.CQLDir, "cql_dir", "", "(Required) Directory holding one or more CQL files.")
-	flag.StringVar(&flags.FHIRBundleDir, "fhir_bundle_dir", "", "(Required) Directory holding FHIR Bundle JSON files, which are used to create a retriever for the CQL engine.")
+	flag.StringVar(&flags.FHIRBundleDir, "fhir_bundle_dir", "", "(Required unless --fhir_ndjson_dir, --fhir_store or --pubsub_topic is set) Directory holding FHIR Bundle JSON files, which are used to create a retriever for the CQL engine. Bundles may be compressed (.json.gz, .json.zst) or zipped (.zip).")
+	flag.BoolVar(&flags.MergePatientBundles, "merge_patient_bundles", false, "(Optional) If true the bundles in --fhir_bundle_dir are merged by patient before evaluation, for inputs where the data of a patient is split across several bundles such as bundle-{patient}-part{n}.json.")
+	flag.StringVar(&flags.FHIRNDJSONDir, "fhir_ndjson_dir", "", "(Required unless --fhir_bundle_dir, --fhir_store or --pubsub_topic is set) Directory holding bulk export style NDJSON files with one FHIR resource per line, which are grouped by patient. Files may be compressed (.ndjson.gz, .ndjson.zst) or zipped (.zip).")
+	flag.StringVar(&flags.FHIRStore, "fhir_store", "", "(Required unless --fhir_bundle_dir, --fhir_ndjson_dir or --pubsub_topic is set) A Cloud Healthcare FHIR store to read patients from, in the form projects/{project}/locations/{location}/datasets/{dataset}/fhirStores/{fhirStore}.")
+	flag.StringVar(&flags.FHIRStoreEndpoint, "fhir_store_endpoint", transforms.DefaultHealthcareEndpoint, "(Optional) The Cloud Healthcare API endpoint used with --fhir_store.")
+	flag.StringVar(&flags.FHIRStoreQuery, "fhir_store_query", transforms.FHIRStoreEverything, "(Optional) How the resources of each patient are read from --fhir_store. One of everything, which uses Patient/$everything, or compartment, which only searches the patient compartment for the resource types retrieved by the CQL.")
+	flag.StringVar(&flags.PubSubTopic, "pubsub_topic", "", "(Required unless --fhir_bundle_dir, --fhir_ndjson_dir or --fhir_store is set) A Pub/Sub topic to read FHIR bundle messages from, in the form projects/{project}/topics/{topic}. Runs the pipeline in streaming mode, which is only supported on the Dataflow runner.")
+	flag.StringVar(&flags.PubSubSubscription, "pubsub_subscription", "", "(Optional) The id of a subscription of --pubsub_topic to read from. By default a subscription is created for the pipeline.")
+	flag.DurationVar(&flags.WindowDuration, "window_duration", time.Minute, "(Optional) The duration of the fixed windows that results are written in when reading from --pubsub_topic.")
 	flag.StringVar(&flags.FHIRTerminologyDir, "fhir_terminology_dir", "", "(Optional) Directory holding FHIR Valueset JSONs, which are used to create a terminology provider for the CQL engine.")
 	flag.StringVar(&flags.EvaluationTimestamp, "evaluation_timestamp", "", "(Optional) The timestamp to use for evaluating CQL. If not provided EvaluationTimestamp will default to time.Now() called at the start of the eval request.")
+	flag.StringVar(&flags.EvaluationTimestampSource, "evaluation_timestamp_source", transforms.TimestampFixed, "(Optional) Where the timestamp each patient is evaluated at is taken from. One of fixed, which uses --evaluation_timestamp for every patient, bundle, which uses the timestamp of each FHIR Bundle and falls back to --evaluation_timestamp, or publish_time, which uses the publish time of each --pubsub_topic message.")
 	flag.BoolVar(&flags.ReturnPrivateDefs, "return_private_defs", false, "(Optional) If true will include the output of all private CQL expression definitions. By default only public definitions are outputted.")
-	// TODO b/339070720: Add CQL parameters.
-	flag.StringVar(&flags.NDJSONOutputDir, "ndjson_output_dir", "", "(Required) Output directory that the NDJSON files will be written to.")
+	flag.StringVar(&flags.IncludeDefines, "include_defines", "", "(Optional) A comma separated list of CQL expression definitions to output, either by name or qualified by library name.")
+	flag.StringVar(&flags.IncludeDefinesRegex, "include_defines_regex", "", "(Optional) Only CQL expression definitions whose name or library qualified name matches this regular expression are output. Combined with --include_defines, definitions matching either are output.")
+	flag.StringVar(&flags.ExcludeDefines, "exclude_defines", "", "(Optional) A comma separated list of CQL expression definitions to leave out of the output, either by name or qualified by library name. Takes precedence over the include flags.")
+	flag.StringVar(&flags.ExcludeDefinesRegex, "exclude_defines_regex", "", "(Optional) CQL expression definitions whose name or library qualified name matches this regular expression are left out of the output. Takes precedence over the include flags.")
+	flag.Var(&flags.Parameters, "parameter", "(Optional, repeated) A CQL parameter in the form Library.Name=value, where value is a CQL literal. Example: --parameter=\"Measure.Measurement Period=Interval[@2024-01-01, @2025-01-01)\"")
+	flag.StringVar(&flags.NDJSONOutputDir, "ndjson_output_dir", "", "(Required unless --bigquery_output_table is set) Output directory that the NDJSON files will be written to.")
+	flag.StringVar(&flags.DeadLetterDir, "dead_letter_dir", "", "(Optional) Output directory that the errors of inputs that failed to load, parse, evaluate or write are written to. Defaults to ndjson_output_dir.")
+	flag.IntVar(&flags.OutputShards, "output_shards", 0, "(Optional) The number of NDJSON files the results and errors are each written to, named results-{shard}-of-{shards}.ndjson. By default a single results.ndjson and errors.ndjson are written.")
+	flag.BoolVar(&flags.AggregatePopulations, "aggregate_populations", false, "(Optional) If true writes populations.ndjson to ndjson_output_dir, with the number of patients each Boolean CQL expression definition is true and false for, and the proportion that are true.")
+	flag.StringVar(&flags.Measure, "measure", "", "(Optional) Path to a FHIR Measure JSON file whose populations reference the CQL. A summary MeasureReport of all patients is written as a line of measure_report.ndjson in ndjson_output_dir.")
+	flag.IntVar(&flags.MaxBundleResources, "max_bundle_resources", 0, "(Optional) The largest number of resources a patient bundle may have to be evaluated. Larger bundles are written to the errors instead. By default bundles of any size are evaluated.")
+	flag.Int64Var(&flags.MaxBundleBytes, "max_bundle_bytes", 0, "(Optional) The largest encoded size in bytes a patient bundle may have to be evaluated. Larger bundles are written to the errors instead. By default bundles of any size are evaluated.")
+	flag.IntVar(&flags.MaxConcurrentEvals, "max_concurrent_evals", 0, "(Optional) The largest number of patients evaluated at once in each worker process, which bounds the memory used by evaluation. By default the runner's parallelism is used.")
+	flag.StringVar(&flags.ResumeFromDir, "resume_from_dir", "", "(Optional) The ndjson_output_dir of a previous run of the same job. Patients that already have results there are skipped, so that a job that failed part way can be resumed. Must differ from ndjson_output_dir.")
+	flag.StringVar(&flags.OutputPartition, "output_partition", "", "(Optional) Partitions the sharded output into directories. One of library, which writes the results of each CQL library to library={name}, or status, which writes results to status=success and errors to status=error.")
+	flag.StringVar(&flags.BigQueryOutputTable, "bigquery_output_table", "", "(Required unless --ndjson_output_dir is set) BigQuery table that the results are written to, in the form project.dataset.table. The table is created if it does not exist, with one row per patient and one column per output CQL definition.")
+	flag.StringVar(&flags.BigQueryErrorsTable, "bigquery_errors_table", "", "(Optional) BigQuery table that the errors are written to, in the form project.dataset.table. The table is created if it does not exist.")
 }
 
 // pipelineConfig holds the validated configuration for the pipeline.
 type pipelineConfig struct {
-	// TODO: b/339070720 - Instead of parsing on each worker, if we could serialize the cql.ELM struct
-	// we could parse once before execution and pass it to each worker.
-	CQL                 []string
-	FHIRBundleDir       string
-	ValueSets           []string
+	// CQL, ELM and Parameters are the libraries evaluated if a single CQL directory is read. If
+	// several are read, they are empty and the libraries are in LibrarySets instead.
+	CQL []string
+	// ELM is the CQL parsed once before execution and encoded with cql.ELM.MarshalBinary, so that
+	// workers do not parse the CQL again. If empty the CQL is parsed on each worker.
+	ELM []byte
+	// Exactly one of FHIRBundleDir, FHIRNDJSONDir, FHIRStore or PubSubTopic is set.
+	FHIRBundleDir string
+	FHIRNDJSONDir string
+	// MergePatientBundles merges the bundles read from FHIRBundleDir by patient.
+	MergePatientBundles bool
+	FHIRStore           string
+	FHIRStoreEndpoint   string
+	FHIRStoreQuery      string
+	// PubSubProject and PubSubTopic are the project and id of the Pub/Sub topic read in streaming
+	// mode. PubSubSubscription is the id of the subscription to read, or empty to create one.
+	PubSubProject      string
+	PubSubTopic        string
+	PubSubSubscription string
+	// WindowDuration is the duration of the fixed windows of streaming mode.
+	WindowDuration time.Duration
+	// FHIRStoreResourceTypes are the resource types retrieved by the CQL, which are read from the
+	// FHIR store by compartment queries.
+	FHIRStoreResourceTypes []string
+	ValueSets              []string
+	// Terminology is ValueSets loaded once before execution and encoded with
+	// transforms.EncodeTerminology, which is shipped to the workers instead of ValueSets. If empty
+	// the workers load ValueSets.
+	Terminology []byte
+	// Parameters are passed to the CQL, and are already part of ELM if it is set.
+	Parameters []transforms.Parameter
+	// LibrarySets are the independent sets of libraries evaluated for each patient, if several CQL
+	// directories are read.
+	LibrarySets         []librarySet
 	EvaluationTimestamp time.Time
-	ReturnPrivateDefs bool
-	NDJSONOutputDir   string
+	// EvaluationTimestampSource is where the timestamp of each bundle is taken from, see
+	// transforms.CQLEvalFn. EvaluationTimestamp is used if it is empty or a bundle has no timestamp.
+	EvaluationTimestampSource string
+	ReturnPrivateDefs         bool
+	// The define filters are validated when building the config, but passed to the workers in the
+	// form accepted by result.ParseDefineFilter.
+	IncludeDefines      string
+	IncludeDefinesRegex string
+	ExcludeDefines      string
+	ExcludeDefinesRegex string
+	NDJSONOutputDir     string
+	// DeadLetterDir is the directory the errors are written to, NDJSONOutputDir if empty.
+	DeadLetterDir string
+	// OutputShards and OutputPartition configure sharded output. If both are unset a single results
+	// file and a single errors file are written.
+	OutputShards    int
+	OutputPartition string
+	// BigQueryOutputTable and BigQueryErrorsTable are in the form accepted by
+	// transforms.ParseBigQueryTable.
+	BigQueryOutputTable string
+	BigQueryErrorsTable string
+	// AggregatePopulations writes the counts of the Boolean expression definitions.
+	AggregatePopulations bool
+	// Measure is the JSON of a FHIR Measure resource to write a summary MeasureReport for, or empty
+	// if no report is written.
+	Measure []byte
+	// ResumeFromDir is the output directory of a previous run, whose patients with results are not
+	// evaluated again.
+	ResumeFromDir string
+	// MaxBundleResources, MaxBundleBytes and MaxConcurrentEvals are the guardrails of
+	// transforms.CQLEvalFn. Zero is unlimited.
+	MaxBundleResources int
+	MaxBundleBytes     int64
+	MaxConcurrentEvals int
 }
 
 func buildPipelineConfig(flags *beamFlags) (*pipelineConfig, error) {
@@ -79,53 +214,314 @@ func buildPipelineConfig(flags *beamFlags) (*pipelineConfig, error) {
 	}
 
 	cfg := &pipelineConfig{
-		FHIRBundleDir:     flags.FHIRBundleDir,
-		ReturnPrivateDefs: flags.ReturnPrivateDefs,
-		NDJSONOutputDir:   flags.NDJSONOutputDir,
+		FHIRBundleDir:             flags.FHIRBundleDir,
+		FHIRNDJSONDir:             flags.FHIRNDJSONDir,
+		MergePatientBundles:       flags.MergePatientBundles,
+		FHIRStore:                 flags.FHIRStore,
+		FHIRStoreEndpoint:         flags.FHIRStoreEndpoint,
+		FHIRStoreQuery:            flags.FHIRStoreQuery,
+		PubSubSubscription:        flags.PubSubSubscription,
+		WindowDuration:            flags.WindowDuration,
+		EvaluationTimestampSource: flags.EvaluationTimestampSource,
+		ReturnPrivateDefs:         flags.ReturnPrivateDefs,
+		IncludeDefines:            flags.IncludeDefines,
+		IncludeDefinesRegex:       flags.IncludeDefinesRegex,
+		ExcludeDefines:            flags.ExcludeDefines,
+		ExcludeDefinesRegex:       flags.ExcludeDefinesRegex,
+		NDJSONOutputDir:           flags.NDJSONOutputDir,
+		DeadLetterDir:             flags.DeadLetterDir,
+		OutputShards:              flags.OutputShards,
+		OutputPartition:           flags.OutputPartition,
+		BigQueryOutputTable:       flags.BigQueryOutputTable,
+		BigQueryErrorsTable:       flags.BigQueryErrorsTable,
+		AggregatePopulations:      flags.AggregatePopulations,
+		ResumeFromDir:             flags.ResumeFromDir,
+		MaxBundleResources:        flags.MaxBundleResources,
+		MaxBundleBytes:            flags.MaxBundleBytes,
+		MaxConcurrentEvals:        flags.MaxConcurrentEvals,
+	}
+	if _, err := result.ParseDefineFilter(cfg.IncludeDefines, cfg.IncludeDefinesRegex, cfg.ExcludeDefines, cfg.ExcludeDefinesRegex); err != nil {
+		return nil, err
 	}
 
-		if flags.EvaluationTimestamp != "" {
-			var err error
-			cfg.EvaluationTimestamp, err = time.Parse(time.RFC3339, flags.EvaluationTimestamp)
-			if err != nil {
-				return nil, fmt.Errorf("evaluation_timestamp must be in RFC3339 format: %v", err)
-			}
-		} else {
-			cfg.EvaluationTimestamp = time.Now()
+	if flags.EvaluationTimestamp != "" {
+		var err error
+		cfg.EvaluationTimestamp, err = time.Parse(time.RFC3339, flags.EvaluationTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("evaluation_timestamp must be in RFC3339 format: %v", err)
 		}
+	} else {
+		cfg.EvaluationTimestamp = time.Now()
+	}
 
 	if flags.CQLDir == "" {
 		return nil, fmt.Errorf("cql_dir must be set")
 	}
-	if flags.FHIRBundleDir == "" {
-		return nil, fmt.Errorf("fhir_bundle_dir must be set")
+	var inputs int
+	for _, input := range []string{flags.FHIRBundleDir, flags.FHIRNDJSONDir, flags.FHIRStore, flags.PubSubTopic} {
+		if input != "" {
+			inputs++
+		}
+	}
+	if inputs == 0 {
+		return nil, fmt.Errorf("one of fhir_bundle_dir, fhir_ndjson_dir, fhir_store or pubsub_topic must be set")
+	}
+	if inputs > 1 {
+		return nil, fmt.Errorf("only one of fhir_bundle_dir, fhir_ndjson_dir, fhir_store or pubsub_topic may be set")
+	}
+	if flags.PubSubTopic != "" {
+		var err error
+		cfg.PubSubProject, cfg.PubSubTopic, err = transforms.ParsePubSubTopic(flags.PubSubTopic)
+		if err != nil {
+			return nil, err
+		}
+		if flags.WindowDuration <= 0 {
+			return nil, fmt.Errorf("window_duration must be positive, got %v", flags.WindowDuration)
+		}
+	} else {
+		if flags.PubSubSubscription != "" {
+			return nil, fmt.Errorf("pubsub_subscription requires pubsub_topic")
+		}
+		// Windows only apply to streaming mode.
+		cfg.WindowDuration = 0
+	}
+	switch cfg.EvaluationTimestampSource {
+	case "", transforms.TimestampFixed, transforms.TimestampBundle:
+	case transforms.TimestampPublishTime:
+		if flags.PubSubTopic == "" {
+			return nil, fmt.Errorf("evaluation_timestamp_source %s requires pubsub_topic", transforms.TimestampPublishTime)
+		}
+	default:
+		return nil, fmt.Errorf("evaluation_timestamp_source must be %s, %s or %s, got %q", transforms.TimestampFixed, transforms.TimestampBundle, transforms.TimestampPublishTime, cfg.EvaluationTimestampSource)
+	}
+	if flags.MergePatientBundles && flags.FHIRBundleDir == "" {
+		return nil, fmt.Errorf("merge_patient_bundles requires fhir_bundle_dir")
+	}
+	if flags.FHIRStore != "" {
+		if err := transforms.ValidateFHIRStoreName(flags.FHIRStore); err != nil {
+			return nil, err
+		}
+		if cfg.FHIRStoreQuery == "" {
+			cfg.FHIRStoreQuery = transforms.FHIRStoreEverything
+		}
+		if cfg.FHIRStoreQuery != transforms.FHIRStoreEverything && cfg.FHIRStoreQuery != transforms.FHIRStoreCompartment {
+			return nil, fmt.Errorf("fhir_store_query must be %s or %s, got %q", transforms.FHIRStoreEverything, transforms.FHIRStoreCompartment, cfg.FHIRStoreQuery)
+		}
+	}
+	if flags.NDJSONOutputDir == "" && flags.BigQueryOutputTable == "" {
+		return nil, fmt.Errorf("one of ndjson_output_dir or bigquery_output_table must be set")
+	}
+	for _, table := range []string{flags.BigQueryOutputTable, flags.BigQueryErrorsTable} {
+		if table == "" {
+			continue
+		}
+		if _, _, _, err := transforms.ParseBigQueryTable(table); err != nil {
+			return nil, err
+		}
+	}
+	if (flags.AggregatePopulations || flags.Measure != "") && flags.NDJSONOutputDir == "" {
+		return nil, fmt.Errorf("aggregate_populations and measure require ndjson_output_dir")
+	}
+	if flags.ResumeFromDir != "" {
+		if flags.PubSubTopic != "" {
+			return nil, fmt.Errorf("resume_from_dir can not be used with pubsub_topic")
+		}
+		// The outputs of the resumed job would be overwritten.
+		if strings.TrimSuffix(flags.ResumeFromDir, "/") == strings.TrimSuffix(flags.NDJSONOutputDir, "/") {
+			return nil, fmt.Errorf("resume_from_dir must differ from ndjson_output_dir")
+		}
+	}
+	if flags.MaxBundleResources < 0 || flags.MaxBundleBytes < 0 || flags.MaxConcurrentEvals < 0 {
+		return nil, fmt.Errorf("max_bundle_resources, max_bundle_bytes and max_concurrent_evals must not be negative")
 	}
-	if flags.NDJSONOutputDir == "" {
-		return nil, fmt.Errorf("ndjson_output_dir must be set")
+	if flags.OutputShards < 0 {
+		return nil, fmt.Errorf("output_shards must not be negative, got %d", flags.OutputShards)
+	}
+	if err := transforms.ValidatePartition(flags.OutputPartition); err != nil {
+		return nil, err
 	}
 
 	var err error
-	cfg.CQL, err = readFilesWithSuffix(flags.CQLDir, ".cql")
-	if err != nil {
-		return nil, err
+	dirs := strings.Split(flags.CQLDir, ",")
+	sets := make([]*librarySet, 0, len(dirs))
+	unmatched := make(map[string]int)
+	var resourceTypes []string
+	for _, dir := range dirs {
+		set, elm, setUnmatched, err := readLibrarySet(dir, flags.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range setUnmatched {
+			unmatched[p]++
+		}
+		if cfg.FHIRStoreQuery == transforms.FHIRStoreCompartment {
+			types, err := retrievedResourceTypes(elm)
+			if err != nil {
+				return nil, err
+			}
+			resourceTypes = append(resourceTypes, types...)
+		}
+		sets = append(sets, set)
 	}
-	if len(cfg.CQL) == 0 {
-		return nil, fmt.Errorf("must be at least one CQL file")
+	// Each parameter must name a library in at least one set.
+	for _, param := range flags.Parameters {
+		if unmatched[param] == len(sets) {
+			qualifiedName, _, _ := strings.Cut(param, "=")
+			return nil, fmt.Errorf("parameter %q does not name a library in the CQL", qualifiedName)
+		}
+	}
+	if resourceTypes != nil {
+		slices.Sort(resourceTypes)
+		cfg.FHIRStoreResourceTypes = slices.Compact(resourceTypes)
+	}
+	if len(sets) == 1 {
+		cfg.CQL, cfg.ELM, cfg.Parameters = sets[0].CQL, sets[0].ELM, sets[0].Parameters
+	} else {
+		names := make(map[string]bool)
+		for _, set := range sets {
+			if names[set.Name] {
+				return nil, fmt.Errorf("cql_dir has several directories named %q, which must have unique names", set.Name)
+			}
+			names[set.Name] = true
+			cfg.LibrarySets = append(cfg.LibrarySets, *set)
+		}
+		if flags.Measure != "" {
+			return nil, fmt.Errorf("measure can not be used with several cql_dir directories")
+		}
+		if flags.BigQueryOutputTable != "" {
+			return nil, fmt.Errorf("bigquery_output_table can not be used with several cql_dir directories")
+		}
+	}
+
+	if flags.Measure != "" {
+		cfg.Measure, err = readFile(flags.Measure)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := measure.ParseMeasure(cfg.Measure); err != nil {
+			return nil, fmt.Errorf("failed to parse measure: %w", err)
+		}
 	}
 
 	cfg.ValueSets, err = readFilesWithSuffix(flags.FHIRTerminologyDir, ".json")
 	if err != nil {
 		return nil, err
 	}
+	cfg.Terminology, err = transforms.EncodeTerminology(cfg.ValueSets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load terminology: %w", err)
+	}
 
 	return cfg, nil
 }
 
-// readFilesWithSuffix reads all files from a directory with the given suffix.
+// parseParameters parses --parameter flags in the form Library.Name=value into parameters of the
+// parsed CQL. The library is matched by name, and the version is taken from the parsed library.
+// Parameters that do not name a library of the CQL are returned as unmatched.
+func parseParameters(params []string, elm *cql.ELM) (parsed []transforms.Parameter, unmatched []string, err error) {
+	defs := elm.ResultTypes(true)
+	for _, param := range params {
+		qualifiedName, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("parameter must be in the form Library.Name=value, got %q", param)
+		}
+		var key result.DefKey
+		for libKey := range defs {
+			// Library names may themselves contain dots, so the longest matching library is used.
+			name, ok := strings.CutPrefix(qualifiedName, libKey.Name+".")
+			if ok && len(libKey.Name) > len(key.Library.Name) {
+				key = result.DefKey{Name: name, Library: libKey}
+			}
+		}
+		if key.Name == "" {
+			unmatched = append(unmatched, param)
+			continue
+		}
+		if _, ok := defs[key.Library][key.Name]; !ok {
+			return nil, nil, fmt.Errorf("parameter %q is not defined in library %s", key.Name, key.Library.Name)
+		}
+		parsed = append(parsed, transforms.Parameter{Key: key, Value: value})
+	}
+	return parsed, unmatched, nil
+}
+
+// librarySet is an independent set of CQL libraries, read from one of the directories of
+// --cql_dir, that the pipeline evaluates along with the other sets.
+type librarySet struct {
+	// Name is the base name of the directory, which the results of the set are tagged with.
+	Name       string
+	CQL        []string
+	ELM        []byte
+	Parameters []transforms.Parameter
+}
+
+// readLibrarySet reads and parses the CQL libraries in dir, with the parameters that name one of
+// its libraries. The parameters that do not are returned as unmatched.
+func readLibrarySet(dir string, params []string) (set *librarySet, elm *cql.ELM, unmatched []string, err error) {
+	set = &librarySet{Name: path.Base(strings.TrimSuffix(dir, "/"))}
+	set.CQL, err = readFilesWithSuffix(dir, ".cql")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(set.CQL) == 0 {
+		return nil, nil, nil, fmt.Errorf("must be at least one CQL file")
+	}
+	elm, err = transforms.ParseCQL(context.Background(), set.CQL, nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse CQL: %w", err)
+	}
+	if len(params) > 0 {
+		// The library versions of the parameters are only known once the CQL is parsed, so the CQL is
+		// parsed again with the parameters.
+		set.Parameters, unmatched, err = parseParameters(params, elm)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(set.Parameters) > 0 {
+			elm, err = transforms.ParseCQL(context.Background(), set.CQL, set.Parameters)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to parse CQL parameters: %w", err)
+			}
+		}
+	}
+	set.ELM, err = elm.MarshalBinary()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return set, elm, unmatched, nil
+}
+
+// retrievedResourceTypes returns the FHIR resource types retrieved by the parsed CQL, other than
+// Patient which is always read from the FHIR store.
+func retrievedResourceTypes(elm *cql.ELM) ([]string, error) {
+	reqs, err := elm.DataRequirements()
+	if err != nil {
+		return nil, err
+	}
+	var types []string
+	for _, t := range datarequirements.ResourceTypes(reqs) {
+		if t != "Patient" {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// isRemotePath returns true if the path has a scheme, for example gs://bucket/dir, and is read
+// through a Beam filesystem rather than the local filesystem.
+func isRemotePath(path string) bool {
+	return strings.Contains(path, "://")
+}
+
+// readFilesWithSuffix reads all files from a directory with the given suffix. The directory may be
+// local or on any registered Beam filesystem, such as gs://bucket/dir.
 func readFilesWithSuffix(dir, allowedFileSuffix string) ([]string, error) {
 	if dir == "" {
 		return nil, nil
 	}
+	if isRemotePath(dir) {
+		return readRemoteFilesWithSuffix(context.Background(), dir, allowedFileSuffix)
+	}
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read directory %s: %w", dir, err)
@@ -144,37 +540,256 @@ func readFilesWithSuffix(dir, allowedFileSuffix string) ([]string, error) {
 	return strs, nil
 }
 
+// readFile reads a file, which may be local or on any registered Beam filesystem.
+func readFile(path string) ([]byte, error) {
+	if !isRemotePath(path) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+		}
+		return b, nil
+	}
+	ctx := context.Background()
+	fs, err := filesystem.New(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	defer fs.Close()
+	b, err := filesystem.Read(ctx, fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// readRemoteFilesWithSuffix reads all files with the given suffix from a directory on a Beam
+// filesystem. Files in subdirectories are not read.
+func readRemoteFilesWithSuffix(ctx context.Context, dir, allowedFileSuffix string) ([]string, error) {
+	fs, err := filesystem.New(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+	defer fs.Close()
+	files, err := fs.List(ctx, transforms.JoinPath(dir, "*"+allowedFileSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+	strs := make([]string, 0, len(files))
+	for _, file := range files {
+		bytes, err := filesystem.Read(ctx, fs, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		strs = append(strs, string(bytes))
+	}
+	return strs, nil
+}
+
+// bundleFileGlobs match the files in the FHIR bundle directory that are read. Compressed bundles and
+// zip archives of bundles are decompressed by transforms.FileToBundle.
+var bundleFileGlobs = []string{"*.json", "*.json.gz", "*.json.zst", "*.zip"}
+
 // buildPipeline uses the config to construct the pipeline. Results and errors are returned for
 // tests.
 func buildPipeline(s beam.Scope, cfg *pipelineConfig) (results, errors beam.PCollection) {
-	matches := fileio.MatchFiles(s, filepath.Join(cfg.FHIRBundleDir, "*.json"))
-	files := fileio.ReadMatches(s, matches)
-	bundles, loadErrors := beam.ParDo2(s, transforms.FileToBundle, files)
+	var bundles, loadErrors beam.PCollection
+	switch {
+	case cfg.PubSubTopic != "":
+		msgs := pubsubio.Read(s, cfg.PubSubProject, cfg.PubSubTopic, &pubsubio.ReadOptions{Subscription: cfg.PubSubSubscription, WithAttributes: true})
+		bundles, loadErrors = readMessages(s, cfg, msgs)
+	case cfg.FHIRStore != "":
+		bundles, loadErrors = readFHIRStore(s, cfg)
+	case cfg.FHIRNDJSONDir != "":
+		bundles, loadErrors = readNDJSONDir(s, cfg)
+	default:
+		bundles, loadErrors = readBundleDir(s, cfg)
+	}
+	if cfg.ResumeFromDir != "" {
+		bundles = skipProcessedPatients(s, cfg, bundles)
+	}
+	return evalAndWrite(s, cfg, bundles, loadErrors)
+}
 
-	var evalErrors beam.PCollection
+// evalAndWrite evaluates the CQL for each bundle and writes the results, and the load errors along
+// with the errors of evaluation, to the outputs.
+func evalAndWrite(s beam.Scope, cfg *pipelineConfig, bundles, loadErrors beam.PCollection) (results, errors beam.PCollection) {
+	sets := cfg.LibrarySets
+	if len(sets) == 0 {
+		sets = []librarySet{{CQL: cfg.CQL, ELM: cfg.ELM, Parameters: cfg.Parameters}}
+	}
+	// Each set is evaluated by its own DoFn over the same bundles, so the data is only read once.
+	var setResults, setErrors []beam.PCollection
+	for _, set := range sets {
 		fn := &transforms.CQLEvalFn{
+			CQL:                       set.CQL,
+			ELM:                       set.ELM,
+			Parameters:                set.Parameters,
+			LibrarySet:                set.Name,
+			Terminology:               cfg.Terminology,
+			EvaluationTimestamp:       cfg.EvaluationTimestamp,
+			EvaluationTimestampSource: cfg.EvaluationTimestampSource,
+			ReturnPrivateDefs:         cfg.ReturnPrivateDefs,
+			IncludeDefines:            cfg.IncludeDefines,
+			IncludeDefinesRegex:       cfg.IncludeDefinesRegex,
+			ExcludeDefines:            cfg.ExcludeDefines,
+			ExcludeDefinesRegex:       cfg.ExcludeDefinesRegex,
+			MaxBundleResources:        cfg.MaxBundleResources,
+			MaxBundleBytes:            cfg.MaxBundleBytes,
+			MaxConcurrentEvals:        cfg.MaxConcurrentEvals,
+		}
+		if len(fn.Terminology) == 0 {
+			fn.ValueSets = cfg.ValueSets
+		}
+		r, e := beam.ParDo2(s, fn, bundles)
+		setResults, setErrors = append(setResults, r), append(setErrors, e)
+	}
+	results, evalErrors := setResults[0], setErrors[0]
+	if len(sets) > 1 {
+		results, evalErrors = beam.Flatten(s, setResults...), beam.Flatten(s, setErrors...)
+	}
+
+	deadLetterDir := cfg.DeadLetterDir
+	if deadLetterDir == "" {
+		deadLetterDir = cfg.NDJSONOutputDir
+	}
+	var aggregateErrors []beam.PCollection
+	if cfg.AggregatePopulations {
+		writeAggregate(s, cfg, "populations", transforms.CountPopulations(s, results))
+	}
+	if len(cfg.Measure) > 0 {
+		reports, reportErrors := transforms.SummarizeMeasure(s, cfg.Measure, measure.Config{Date: cfg.EvaluationTimestamp}, results)
+		writeAggregate(s, cfg, "measure_report", reports)
+		aggregateErrors = append(aggregateErrors, reportErrors)
+	}
+	// textio can not write unbounded collections, so streaming mode always writes sharded output.
+	sharded := cfg.OutputShards > 0 || cfg.OutputPartition != "" || cfg.PubSubTopic != ""
+	shards := max(cfg.OutputShards, 1)
+	allErrors := append([]beam.PCollection{loadErrors, evalErrors}, aggregateErrors...)
+	if cfg.NDJSONOutputDir != "" && !sharded {
+		ndjsonRows, writeErrors := beam.ParDo2(s, transforms.NDJSONSink, results)
+		textio.Write(s, transforms.JoinPath(cfg.NDJSONOutputDir, "results.ndjson"), ndjsonRows)
+		allErrors = append(allErrors, writeErrors)
+	} else if cfg.NDJSONOutputDir != "" {
+		ndjsonRows, writeErrors := beam.ParDo2(s, &transforms.PartitionedNDJSONSinkFn{Partition: cfg.OutputPartition}, results)
+		transforms.WriteSharded(s, cfg.NDJSONOutputDir, "results", shards, ndjsonRows)
+		allErrors = append(allErrors, writeErrors)
+	}
+	if cfg.BigQueryOutputTable != "" {
+		allErrors = append(allErrors, beam.ParDo(s, &transforms.BigQueryResultsFn{
 			CQL:                 cfg.CQL,
-			ValueSets:           cfg.ValueSets,
-			EvaluationTimestamp: cfg.EvaluationTimestamp,
+			Table:               cfg.BigQueryOutputTable,
 			ReturnPrivateDefs:   cfg.ReturnPrivateDefs,
-		}
-		results, evalErrors = beam.ParDo2(s, fn, bundles)
+			IncludeDefines:      cfg.IncludeDefines,
+			IncludeDefinesRegex: cfg.IncludeDefinesRegex,
+			ExcludeDefines:      cfg.ExcludeDefines,
+			ExcludeDefinesRegex: cfg.ExcludeDefinesRegex,
+		}, results))
+	}
 
-	ndjsonRows, writeErrors := beam.ParDo2(s, transforms.NDJSONSink, results)
-	// TODO: b/339070720: Shard the output files.
-	textio.Write(s, filepath.Join(cfg.NDJSONOutputDir, "results.ndjson"), ndjsonRows)
+	errors = beam.Flatten(s, allErrors...)
+	if deadLetterDir != "" && !sharded {
+		errorRows := beam.ParDo(s, transforms.ErrorsNDJSONSink, errors)
+		textio.Write(s, transforms.JoinPath(deadLetterDir, "errors.ndjson"), errorRows)
+	} else if deadLetterDir != "" {
+		errorRows := beam.ParDo(s, &transforms.PartitionedErrorsNDJSONSinkFn{Partition: cfg.OutputPartition}, errors)
+		transforms.WriteSharded(s, deadLetterDir, "errors", shards, errorRows)
+	}
+	if cfg.BigQueryErrorsTable != "" {
+		beam.ParDo0(s, &transforms.BigQueryErrorsFn{Table: cfg.BigQueryErrorsTable}, errors)
+	}
+	return results, errors
+}
 
-	errors = beam.Flatten(s, loadErrors, evalErrors, writeErrors)
-	errorRows := beam.ParDo(s, transforms.ErrorsNDJSONSink, errors)
-	textio.Write(s, filepath.Join(cfg.NDJSONOutputDir, "errors.ndjson"), errorRows)
+// writeAggregate writes the rows of an aggregate of all patients to {name}.ndjson in the output
+// directory, or in streaming mode to one file for each window.
+func writeAggregate(s beam.Scope, cfg *pipelineConfig, name string, rows beam.PCollection) {
+	if cfg.PubSubTopic == "" {
+		textio.Write(s, transforms.JoinPath(cfg.NDJSONOutputDir, name+".ndjson"), rows)
+		return
+	}
+	transforms.WriteSharded(s, cfg.NDJSONOutputDir, name, 1, beam.ParDo(s, transforms.Unpartitioned, rows))
+}
 
-	return results, errors
+// resultFileGlobs match the results files of a previous run, including sharded results in
+// partition directories.
+var resultFileGlobs = []string{"results*.ndjson", "*/results*.ndjson"}
+
+// skipProcessedPatients removes the bundles of the patients with results in ResumeFromDir.
+func skipProcessedPatients(s beam.Scope, cfg *pipelineConfig, bundles beam.PCollection) beam.PCollection {
+	var matches []beam.PCollection
+	for _, glob := range resultFileGlobs {
+		matches = append(matches, fileio.MatchFiles(s, transforms.JoinPath(cfg.ResumeFromDir, glob)))
+	}
+	files := fileio.ReadMatches(s, beam.Flatten(s, matches...))
+	processed := beam.ParDo(s, transforms.ResultFileToPatientIDs, files)
+	return transforms.SkipProcessedPatients(s, bundles, processed)
+}
+
+// readBundleDir reads the bundles of the files in the FHIR bundle directory, merging the bundles of
+// each patient if MergePatientBundles is set.
+func readBundleDir(s beam.Scope, cfg *pipelineConfig) (bundles, errors beam.PCollection) {
+	var matches []beam.PCollection
+	for _, glob := range bundleFileGlobs {
+		matches = append(matches, fileio.MatchFiles(s, transforms.JoinPath(cfg.FHIRBundleDir, glob)))
+	}
+	files := fileio.ReadMatches(s, beam.Flatten(s, matches...))
+	bundles, errors = beam.ParDo2(s, transforms.FileToBundle, files)
+	if cfg.MergePatientBundles {
+		bundles = transforms.MergeBundlesByPatient(s, bundles)
+	}
+	return bundles, errors
+}
+
+// ndjsonFileGlobs match the files in the FHIR NDJSON directory that are read.
+var ndjsonFileGlobs = []string{"*.ndjson", "*.ndjson.gz", "*.ndjson.zst", "*.zip"}
+
+// readNDJSONDir reads the resources of the files in the FHIR NDJSON directory, and groups them
+// into one bundle for each patient.
+func readNDJSONDir(s beam.Scope, cfg *pipelineConfig) (bundles, errors beam.PCollection) {
+	var matches []beam.PCollection
+	for _, glob := range ndjsonFileGlobs {
+		matches = append(matches, fileio.MatchFiles(s, transforms.JoinPath(cfg.FHIRNDJSONDir, glob)))
+	}
+	files := fileio.ReadMatches(s, beam.Flatten(s, matches...))
+	resources, errors := beam.ParDo2(s, transforms.NDJSONToResources, files)
+	return transforms.GroupByPatient(s, resources), errors
+}
+
+// readMessages parses the bundles of the Pub/Sub messages into fixed windows of WindowDuration, so
+// that the results of each window are written once the window closes.
+func readMessages(s beam.Scope, cfg *pipelineConfig, msgs beam.PCollection) (bundles, errors beam.PCollection) {
+	msgs = beam.WindowInto(s, window.NewFixedWindows(cfg.WindowDuration), msgs)
+	return beam.ParDo2(s, transforms.MessageToBundle, msgs)
+}
+
+// readFHIRStore reads one bundle for each patient in the FHIR store. The patient ids are listed by
+// a single worker and then reshuffled, so that fetching the patients is spread across workers.
+func readFHIRStore(s beam.Scope, cfg *pipelineConfig) (bundles, errors beam.PCollection) {
+	ids, listErrors := beam.ParDo2(s, &transforms.FHIRStorePatientsFn{
+		FHIRStore: cfg.FHIRStore,
+		Endpoint:  cfg.FHIRStoreEndpoint,
+	}, beam.Impulse(s))
+	bundles, fetchErrors := beam.ParDo2(s, &transforms.FHIRStoreBundleFn{
+		FHIRStore:     cfg.FHIRStore,
+		Endpoint:      cfg.FHIRStoreEndpoint,
+		Query:         cfg.FHIRStoreQuery,
+		ResourceTypes: cfg.FHIRStoreResourceTypes,
+	}, beam.Reshuffle(s, ids))
+	return bundles, beam.Flatten(s, listErrors, fetchErrors)
 }
 
 func main() {
 	flag.Parse()
 	beam.Init()
 
+	if flags.Config != "" {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if err := applyConfigFile(&flags, flags.Config, set); err != nil {
+			log.Exit(err)
+		}
+	}
+
 	cfg, err := buildPipelineConfig(&flags)
 	if err != nil {
 		log.Exit(err)
@@ -15,7 +15,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -26,11 +31,19 @@ import (
 	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
 	crpb "github.com/google/cql/protos/cql_result_go_proto"
+	"github.com/google/cql/beam/transforms"
+	"github.com/google/cql/measure"
+	"github.com/google/cql/result"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem/memfs"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/mtime"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/testing/ptest"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/lithammer/dedent"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
 )
@@ -112,6 +125,8 @@ func TestPipeline(t *testing.T) {
 				&cbpb.BeamError{
 					ErrorMessage: proto.String("failed during CQL evaluation: EvalTest 1.0, could not find ValueSet{urn:example:nosuchvalueset, } resource not loaded"),
 					SourceUri:    proto.String("bundle:bundle1"),
+					Stage:        cbpb.BeamError_EVAL.Enum(),
+					PatientId:    proto.String("1"),
 				},
 			},
 		},
@@ -134,6 +149,676 @@ func TestPipeline(t *testing.T) {
 	}
 }
 
+const testFHIRStore = "projects/p/locations/l/datasets/d/fhirStores/s"
+
+func TestPipeline_FHIRStore(t *testing.T) {
+	base := "/v1/" + testFHIRStore + "/fhir/"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case base + "Patient":
+			w.Write([]byte(`{"resourceType": "Bundle", "type": "searchset", "entry": [{"resource": {"resourceType": "Patient", "id": "1"}}]}`))
+		case base + "Patient/1/$everything":
+			w.Write([]byte(fhirBundles[0]))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &pipelineConfig{
+		CQL: []string{dedent.Dedent(
+			`library EvalTest version '1.0'
+			using FHIR version '4.0.1'
+			valueset "DiabetesVS": 'https://example.com/vs/glucose'
+			define HasDiabetes: exists([Condition: "DiabetesVS"])
+			`,
+		)},
+		ValueSets:           valueSets,
+		FHIRStore:           testFHIRStore,
+		FHIRStoreEndpoint:   server.URL,
+		FHIRStoreQuery:      "everything",
+		NDJSONOutputDir:     t.TempDir(),
+		EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		IncludeDefines:      "HasDiabetes",
+	}
+	wantOutput := []*cbpb.BeamResult{
+		&cbpb.BeamResult{
+			Id:                  proto.String("1"),
+			EvaluationTimestamp: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+			Result: &crpb.Libraries{
+				Libraries: []*crpb.Library{
+					&crpb.Library{
+						Name:    proto.String("EvalTest"),
+						Version: proto.String("1.0"),
+						ExprDefs: map[string]*crpb.Value{
+							"HasDiabetes": &crpb.Value{
+								Value: &crpb.Value_BooleanValue{BooleanValue: true},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	result, errors := buildPipeline(s, cfg)
+	beam.ParDo0(s, diffEvalResults, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, wantOutput)}, beam.SideInput{Input: result})
+	beam.ParDo0(s, diffEvalErrors, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, []*cbpb.BeamError{})}, beam.SideInput{Input: errors})
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPipeline_NDJSON(t *testing.T) {
+	ndjsonDir := t.TempDir()
+	files := map[string]string{
+		"Patient.ndjson": `{"resourceType": "Patient", "id": "1"}
+{"resourceType": "Patient", "id": "2"}
+`,
+		"Condition.ndjson": `{"resourceType": "Condition", "id": "c1", "subject": {"reference": "Patient/1"}, "code": {"coding": [{"system": "https://example.com/system", "code": "54321"}]}}
+{"resourceType": "Condition", "id": "c2", "subject": {"reference": "Patient/2"}, "code": {"coding": [{"system": "https://example.com/system", "code": "12345"}]}}
+{"resourceType": "Condition", "id": "c3", "code": {"coding": [{"system": "https://example.com/system", "code": "54321"}]}}
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(ndjsonDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+		}
+	}
+
+	cfg := &pipelineConfig{
+		CQL: []string{dedent.Dedent(
+			`library EvalTest version '1.0'
+			using FHIR version '4.0.1'
+			valueset "DiabetesVS": 'https://example.com/vs/glucose'
+			define HasDiabetes: exists([Condition: "DiabetesVS"])
+			`,
+		)},
+		ValueSets:           valueSets,
+		FHIRNDJSONDir:       ndjsonDir,
+		NDJSONOutputDir:     t.TempDir(),
+		EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		IncludeDefines:      "HasDiabetes",
+	}
+	result := func(id string, hasDiabetes bool) *cbpb.BeamResult {
+		return &cbpb.BeamResult{
+			Id:                  proto.String(id),
+			EvaluationTimestamp: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+			Result: &crpb.Libraries{
+				Libraries: []*crpb.Library{
+					&crpb.Library{
+						Name:    proto.String("EvalTest"),
+						Version: proto.String("1.0"),
+						ExprDefs: map[string]*crpb.Value{
+							"HasDiabetes": &crpb.Value{
+								Value: &crpb.Value_BooleanValue{BooleanValue: hasDiabetes},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	wantOutput := []*cbpb.BeamResult{result("1", true), result("2", false)}
+	wantError := []*cbpb.BeamError{
+		&cbpb.BeamError{
+			ErrorMessage: proto.String("Condition resource does not reference a patient"),
+			SourceUri:    proto.String(filepath.Join(ndjsonDir, "Condition.ndjson")),
+			Stage:        cbpb.BeamError_PARSE.Enum(),
+			SourceLine:   proto.Int64(3),
+		},
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	results, errors := buildPipeline(s, cfg)
+	beam.ParDo0(s, diffEvalResults, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, wantOutput)}, beam.SideInput{Input: results})
+	beam.ParDo0(s, diffEvalErrors, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, wantError)}, beam.SideInput{Input: errors})
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPipeline_ResumeFromDir(t *testing.T) {
+	bundleDir := t.TempDir()
+	for _, id := range []string{"1", "2"} {
+		bundle := fmt.Sprintf(`{"resourceType": "Bundle", "id": "bundle-%s", "entry": [{"resource": {"resourceType": "Patient", "id": "%s"}}]}`, id, id)
+		if err := os.WriteFile(filepath.Join(bundleDir, "bundle-"+id+".json"), []byte(bundle), 0644); err != nil {
+			t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+		}
+	}
+	// The previous run wrote the results of patient 1 before failing.
+	resumeDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(resumeDir, "library=EvalTest"), 0755); err != nil {
+		t.Fatalf("os.MkdirAll() returned an unexpected error: %v", err)
+	}
+	previous := `{"EvaluationTimestamp":"2023-01-01T00:00:00Z","ID":"1","Result":{}}` + "\n"
+	if err := os.WriteFile(filepath.Join(resumeDir, "library=EvalTest", "results-00000-of-00002.ndjson"), []byte(previous), 0644); err != nil {
+		t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+	}
+	cfg := &pipelineConfig{
+		CQL: []string{dedent.Dedent(
+			`library EvalTest version '1.0'
+			using FHIR version '4.0.1'
+			define HasPatient: exists([Patient])
+			`,
+		)},
+		FHIRBundleDir:       bundleDir,
+		ResumeFromDir:       resumeDir,
+		NDJSONOutputDir:     t.TempDir(),
+		EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		IncludeDefines:      "HasPatient",
+	}
+	wantOutput := []*cbpb.BeamResult{
+		&cbpb.BeamResult{
+			Id:                  proto.String("2"),
+			EvaluationTimestamp: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+			Result: &crpb.Libraries{
+				Libraries: []*crpb.Library{
+					&crpb.Library{
+						Name:     proto.String("EvalTest"),
+						Version:  proto.String("1.0"),
+						ExprDefs: map[string]*crpb.Value{"HasPatient": &crpb.Value{Value: &crpb.Value_BooleanValue{BooleanValue: true}}},
+					},
+				},
+			},
+		},
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	results, errors := buildPipeline(s, cfg)
+	beam.ParDo0(s, diffEvalResults, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, wantOutput)}, beam.SideInput{Input: results})
+	beam.ParDo0(s, diffEvalErrors, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, []*cbpb.BeamError{})}, beam.SideInput{Input: errors})
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPipeline_LibrarySets(t *testing.T) {
+	_, _, bundleDir := directorySetup(t, nil, nil, fhirBundles[:1])
+	cfg, err := buildPipelineConfig(&beamFlags{
+		CQLDir: cqlSetDir(t, "measure_a", "library A version '1.0'\nusing FHIR version '4.0.1'\ndefine HasPatient: exists([Patient])") + "," +
+			cqlSetDir(t, "measure_b", "library B version '1.0'\nusing FHIR version '4.0.1'\ndefine ConditionCount: Count([Condition])"),
+		FHIRBundleDir:       bundleDir,
+		EvaluationTimestamp: "2023-01-01T00:00:00Z",
+		ExcludeDefines:      "BeamMetadata.ID",
+		NDJSONOutputDir:     t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("buildPipelineConfig() returned an unexpected error: %v", err)
+	}
+	result := func(set, lib, def string, v *crpb.Value) *cbpb.BeamResult {
+		return &cbpb.BeamResult{
+			Id:                  proto.String("1"),
+			EvaluationTimestamp: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+			LibrarySet:          proto.String(set),
+			Result: &crpb.Libraries{
+				Libraries: []*crpb.Library{
+					&crpb.Library{Name: proto.String(lib), Version: proto.String("1.0"), ExprDefs: map[string]*crpb.Value{def: v}},
+				},
+			},
+		}
+	}
+	// Each patient has a result for each set of libraries.
+	wantOutput := []*cbpb.BeamResult{
+		result("measure_a", "A", "HasPatient", &crpb.Value{Value: &crpb.Value_BooleanValue{BooleanValue: true}}),
+		result("measure_b", "B", "ConditionCount", &crpb.Value{Value: &crpb.Value_IntegerValue{IntegerValue: 2}}),
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	results, errors := buildPipeline(s, cfg)
+	beam.ParDo0(s, diffEvalResults, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, wantOutput)}, beam.SideInput{Input: results})
+	beam.ParDo0(s, diffEvalErrors, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, []*cbpb.BeamError{})}, beam.SideInput{Input: errors})
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPipeline_MergePatientBundles(t *testing.T) {
+	bundleDir := t.TempDir()
+	files := map[string]string{
+		"bundle-1-part1.json": `{"resourceType": "Bundle", "id": "bundle-1-part1", "entry": [
+			{"resource": {"resourceType": "Patient", "id": "1"}},
+			{"resource": {"resourceType": "Condition", "id": "c1", "subject": {"reference": "Patient/1"}, "code": {"coding": [{"system": "https://example.com/system", "code": "54321"}]}}}
+		]}`,
+		"bundle-1-part2.json": `{"resourceType": "Bundle", "id": "bundle-1-part2", "entry": [
+			{"resource": {"resourceType": "Patient", "id": "1"}},
+			{"resource": {"resourceType": "Condition", "id": "c2", "subject": {"reference": "Patient/1"}, "code": {"coding": [{"system": "https://example.com/system", "code": "12345"}]}}}
+		]}`,
+		"bundle-2.json": `{"resourceType": "Bundle", "id": "bundle-2", "entry": [
+			{"resource": {"resourceType": "Patient", "id": "2"}}
+		]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(bundleDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+		}
+	}
+	cfg := &pipelineConfig{
+		CQL: []string{dedent.Dedent(
+			`library EvalTest version '1.0'
+			using FHIR version '4.0.1'
+			define ConditionCount: Count([Condition])
+			`,
+		)},
+		FHIRBundleDir:       bundleDir,
+		MergePatientBundles: true,
+		NDJSONOutputDir:     t.TempDir(),
+		EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		IncludeDefines:      "ConditionCount",
+	}
+	result := func(id string, conditions int32) *cbpb.BeamResult {
+		return &cbpb.BeamResult{
+			Id:                  proto.String(id),
+			EvaluationTimestamp: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+			Result: &crpb.Libraries{
+				Libraries: []*crpb.Library{
+					&crpb.Library{
+						Name:    proto.String("EvalTest"),
+						Version: proto.String("1.0"),
+						ExprDefs: map[string]*crpb.Value{
+							"ConditionCount": &crpb.Value{
+								Value: &crpb.Value_IntegerValue{IntegerValue: conditions},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	wantOutput := []*cbpb.BeamResult{result("1", 2), result("2", 0)}
+
+	p, s := beam.NewPipelineWithRoot()
+	results, errors := buildPipeline(s, cfg)
+	beam.ParDo0(s, diffEvalResults, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, wantOutput)}, beam.SideInput{Input: results})
+	beam.ParDo0(s, diffEvalErrors, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, []*cbpb.BeamError{})}, beam.SideInput{Input: errors})
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testMeasure = `{
+	"resourceType": "Measure",
+	"url": "https://example.com/Measure/Screening",
+	"library": ["https://example.com/Library/EvalTest|1.0"],
+	"scoring": {"coding": [{"code": "proportion"}]},
+	"group": [{"population": [
+		{"code": {"coding": [{"code": "initial-population"}]}, "criteria": {"expression": "Initial Population"}},
+		{"code": {"coding": [{"code": "denominator"}]}, "criteria": {"expression": "Initial Population"}},
+		{"code": {"coding": [{"code": "numerator"}]}, "criteria": {"expression": "Numerator"}}
+	]}]
+}`
+
+func TestPipeline_Aggregate(t *testing.T) {
+	bundleDir := t.TempDir()
+	for id, conditions := range map[string]int{"1": 2, "2": 0, "3": 1} {
+		var entries []string
+		entries = append(entries, fmt.Sprintf(`{"resource": {"resourceType": "Patient", "id": "%s"}}`, id))
+		for i := 0; i < conditions; i++ {
+			entries = append(entries, fmt.Sprintf(`{"resource": {"resourceType": "Condition", "id": "c%s-%d", "subject": {"reference": "Patient/%s"}}}`, id, i, id))
+		}
+		bundle := fmt.Sprintf(`{"resourceType": "Bundle", "id": "bundle-%s", "entry": [%s]}`, id, strings.Join(entries, ","))
+		if err := os.WriteFile(filepath.Join(bundleDir, "bundle-"+id+".json"), []byte(bundle), 0644); err != nil {
+			t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+		}
+	}
+	outputDir := t.TempDir()
+	cfg := &pipelineConfig{
+		CQL: []string{dedent.Dedent(
+			`library EvalTest version '1.0'
+			using FHIR version '4.0.1'
+			context Patient
+			define "Initial Population": true
+			define Numerator: exists([Condition])
+			define ConditionCount: Count([Condition])
+			`,
+		)},
+		FHIRBundleDir:        bundleDir,
+		NDJSONOutputDir:      outputDir,
+		EvaluationTimestamp:  time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		AggregatePopulations: true,
+		Measure:              []byte(testMeasure),
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	_, errors := buildPipeline(s, cfg)
+	beam.ParDo0(s, diffEvalErrors, beam.Impulse(s), beam.SideInput{Input: beam.CreateList(s, []*cbpb.BeamError{})}, beam.SideInput{Input: errors})
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+
+	populations, err := os.ReadFile(filepath.Join(outputDir, "populations.ndjson"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	var gotCounts []transforms.PopulationCount
+	for _, row := range strings.Split(strings.TrimSpace(string(populations)), "\n") {
+		var c transforms.PopulationCount
+		if err := json.Unmarshal([]byte(row), &c); err != nil {
+			t.Fatalf("json.Unmarshal(%s) returned an unexpected error: %v", row, err)
+		}
+		gotCounts = append(gotCounts, c)
+	}
+	// Only the Boolean definitions are counted.
+	wantCounts := []transforms.PopulationCount{
+		{Library: "EvalTest", Version: "1.0", Define: "Initial Population", True: 3, Proportion: 1},
+		{Library: "EvalTest", Version: "1.0", Define: "Numerator", True: 2, False: 1, Proportion: 2.0 / 3},
+	}
+	sortCounts := cmpopts.SortSlices(func(a, b transforms.PopulationCount) bool { return a.Define < b.Define })
+	if diff := cmp.Diff(wantCounts, gotCounts, sortCounts); diff != "" {
+		t.Errorf("populations.ndjson diff (-want +got):\n%s", diff)
+	}
+
+	report, err := os.ReadFile(filepath.Join(outputDir, "measure_report.ndjson"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	var gotReport measure.MeasureReport
+	if err := json.Unmarshal(report, &gotReport); err != nil {
+		t.Fatalf("json.Unmarshal(%s) returned an unexpected error: %v", report, err)
+	}
+	gotPopulations := make(map[string]int)
+	for _, p := range gotReport.Group[0].Population {
+		gotPopulations[p.Code.Coding[0].Code] = p.Count
+	}
+	wantPopulations := map[string]int{"initial-population": 3, "denominator": 3, "numerator": 2}
+	if gotReport.Type != "summary" || !cmp.Equal(wantPopulations, gotPopulations) {
+		t.Errorf("measure_report.ndjson = %s, want a summary report with populations %v", report, wantPopulations)
+	}
+}
+
+func TestPipeline_Streaming(t *testing.T) {
+	cql := []string{dedent.Dedent(
+		`library EvalTest version '1.0'
+		using FHIR version '4.0.1'
+		valueset "DiabetesVS": 'https://example.com/vs/glucose'
+		define HasDiabetes: exists([Condition: "DiabetesVS"])
+		`)}
+	outputDir := t.TempDir()
+	cfg := &pipelineConfig{
+		CQL:                 cql,
+		ValueSets:           valueSets,
+		PubSubProject:       "p",
+		PubSubTopic:         "bundles",
+		WindowDuration:      time.Minute,
+		NDJSONOutputDir:     outputDir,
+		EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		// Each bundle is evaluated at the publish time of its message.
+		EvaluationTimestampSource: transforms.TimestampPublishTime,
+	}
+	publishTime := time.Date(2024, time.January, 1, 10, 5, 30, 0, time.UTC)
+	msgs := []*pubsubpb.PubsubMessage{
+		{MessageId: "m1", Data: []byte(fhirBundles[0]), PublishTime: timestamppb.New(publishTime)},
+		{MessageId: "m2", Data: []byte(`{"resourceType": "Patient", "id": "1"}`), PublishTime: timestamppb.New(publishTime)},
+	}
+
+	// Pub/Sub can only be read on Dataflow, so the messages are created with their publish times as
+	// event times like pubsubio.Read.
+	p, s := beam.NewPipelineWithRoot()
+	timestamped := beam.ParDo(s, func(msg *pubsubpb.PubsubMessage) (beam.EventTime, *pubsubpb.PubsubMessage) {
+		return mtime.FromTime(msg.GetPublishTime().AsTime()), msg
+	}, beam.CreateList(s, msgs))
+	bundles, loadErrors := readMessages(s, cfg, timestamped)
+	evalAndWrite(s, cfg, bundles, loadErrors)
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"results", "errors"} {
+		pattern := filepath.Join(outputDir, "window=2024-01-01T10:05:00Z", prefix+"-00000-of-00001.ndjson")
+		data, err := os.ReadFile(pattern)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%s) returned an unexpected error: %v", pattern, err)
+		}
+		if rows := strings.Count(string(data), "\n"); rows != 1 {
+			t.Errorf("%s has %d rows, want 1", pattern, rows)
+		}
+		if want := "2024-01-01T10:05:30Z"; prefix == "results" && !strings.Contains(string(data), want) {
+			t.Errorf("%s = %s, want evaluation timestamp %s", pattern, data, want)
+		}
+	}
+}
+
+func TestPipeline_RemoteFilesystem(t *testing.T) {
+	// memfs stands in for remote filesystems such as gs:// in tests.
+	memfs.Write("memfs://remote/cql/eval.cql", []byte(dedent.Dedent(
+		`library EvalTest version '1.0'
+		using FHIR version '4.0.1'
+		valueset "DiabetesVS": 'https://example.com/vs/glucose'
+		define HasDiabetes: exists([Condition: "DiabetesVS"])
+		`)))
+	memfs.Write("memfs://remote/cql/README.md", []byte("not cql"))
+	for i, vs := range valueSets {
+		memfs.Write(fmt.Sprintf("memfs://remote/terminology/vs%d.json", i), []byte(vs))
+	}
+	memfs.Write("memfs://remote/bundles/bundle1.json", []byte(fhirBundles[0]))
+
+	cfg, err := buildPipelineConfig(&beamFlags{
+		CQLDir:              "memfs://remote/cql",
+		FHIRTerminologyDir:  "memfs://remote/terminology/",
+		FHIRBundleDir:       "memfs://remote/bundles",
+		EvaluationTimestamp: "2023-01-01T00:00:00Z",
+		IncludeDefines:      "HasDiabetes",
+		NDJSONOutputDir:     "memfs://remote/output",
+	})
+	if err != nil {
+		t.Fatalf("buildPipelineConfig() returned an unexpected error: %v", err)
+	}
+	if len(cfg.CQL) != 1 || len(cfg.ValueSets) != len(valueSets) {
+		t.Fatalf("buildPipelineConfig() read %d CQL libraries and %d value sets, want 1 and %d", len(cfg.CQL), len(cfg.ValueSets), len(valueSets))
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	buildPipeline(s, cfg)
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	fs, err := filesystem.New(ctx, "memfs://remote/output")
+	if err != nil {
+		t.Fatalf("filesystem.New() returned an unexpected error: %v", err)
+	}
+	got, err := filesystem.Read(ctx, fs, "memfs://remote/output/results.ndjson")
+	if err != nil {
+		t.Fatalf("filesystem.Read() returned an unexpected error: %v", err)
+	}
+	if !strings.Contains(string(got), `"HasDiabetes":{"@type":"System.Boolean","value":true}`) {
+		t.Errorf("results.ndjson = %s, want HasDiabetes true", got)
+	}
+}
+
+func TestPipeline_ShardedOutput(t *testing.T) {
+	_, _, fhirBundleDir := directorySetup(t, cqlLibs, valueSets, fhirBundles)
+	cql := []string{dedent.Dedent(
+		`library EvalTest version '1.0'
+		using FHIR version '4.0.1'
+		valueset "DiabetesVS": 'https://example.com/vs/glucose'
+		define HasDiabetes: exists([Condition: "DiabetesVS"])
+		`)}
+
+	tests := []struct {
+		name      string
+		partition string
+		wantFiles []string
+	}{
+		{
+			name:      "Sharded",
+			wantFiles: []string{"results-0000?-of-00002.ndjson"},
+		},
+		{
+			name:      "Partitioned by library",
+			partition: "library",
+			wantFiles: []string{"library=BeamMetadata/results-*", "library=EvalTest/results-*"},
+		},
+		{
+			name:      "Partitioned by status",
+			partition: "status",
+			wantFiles: []string{"status=success/results-*"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			cfg := &pipelineConfig{
+				CQL:                 cql,
+				ValueSets:           valueSets,
+				FHIRBundleDir:       fhirBundleDir,
+				NDJSONOutputDir:     outputDir,
+				EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+				OutputShards:        2,
+				OutputPartition:     tc.partition,
+			}
+			p, s := beam.NewPipelineWithRoot()
+			buildPipeline(s, cfg)
+			if err := ptest.Run(p); err != nil {
+				t.Fatal(err)
+			}
+
+			var rows int
+			for _, pattern := range tc.wantFiles {
+				files, err := filepath.Glob(filepath.Join(outputDir, pattern))
+				if err != nil || len(files) == 0 {
+					t.Fatalf("no output files match %s: %v", pattern, err)
+				}
+				for _, f := range files {
+					data, err := os.ReadFile(f)
+					if err != nil {
+						t.Fatalf("os.ReadFile(%s) returned an unexpected error: %v", f, err)
+					}
+					rows += strings.Count(string(data), "\n")
+				}
+			}
+			if tc.partition == "" && rows != 1 {
+				t.Errorf("sharded output has %d rows, want 1", rows)
+			}
+			if _, err := os.Stat(filepath.Join(outputDir, "results.ndjson")); err == nil {
+				t.Errorf("results.ndjson was written, want only sharded output")
+			}
+		})
+	}
+}
+
+func TestPipeline_DeadLetter(t *testing.T) {
+	_, _, fhirBundleDir := directorySetup(t, cqlLibs, valueSets, fhirBundles)
+	cql := []string{dedent.Dedent(
+		`library EvalTest version '1.0'
+		using FHIR version '4.0.1'
+		valueset "DiabetesVS": 'urn:example:nosuchvalueset'
+		define HasDiabetes: exists([Condition: "DiabetesVS"])
+		`)}
+	outputDir, deadLetterDir := t.TempDir(), t.TempDir()
+	cfg := &pipelineConfig{
+		CQL:                 cql,
+		ValueSets:           valueSets,
+		FHIRBundleDir:       fhirBundleDir,
+		NDJSONOutputDir:     outputDir,
+		DeadLetterDir:       deadLetterDir,
+		EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	p, s := beam.NewPipelineWithRoot()
+	buildPipeline(s, cfg)
+	if err := ptest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(deadLetterDir, "errors.ndjson"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(errors.ndjson) returned an unexpected error: %v", err)
+	}
+	got := &cbpb.BeamError{}
+	if err := protojson.Unmarshal(bytes.TrimSpace(data), got); err != nil {
+		t.Fatalf("protojson.Unmarshal(%s) returned an unexpected error: %v", data, err)
+	}
+	want := &cbpb.BeamError{
+		ErrorMessage: proto.String("failed during CQL evaluation: EvalTest 1.0, could not find ValueSet{urn:example:nosuchvalueset, } resource not loaded"),
+		SourceUri:    proto.String("bundle:bundle1"),
+		Stage:        cbpb.BeamError_EVAL.Enum(),
+		PatientId:    proto.String("1"),
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("errors.ndjson unexpected differences (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "errors.ndjson")); err == nil {
+		t.Errorf("errors.ndjson was written to ndjson_output_dir, want only dead_letter_dir")
+	}
+}
+
+func TestPipeline_Metrics(t *testing.T) {
+	_, _, fhirBundleDir := directorySetup(t, cqlLibs, valueSets, fhirBundles)
+
+	tests := []struct {
+		name          string
+		valueSet      string
+		wantCounters  map[string]int64
+		wantResources int64
+	}{
+		{
+			name:     "Successful eval",
+			valueSet: "https://example.com/vs/glucose",
+			wantCounters: map[string]int64{
+				"fhir_bundles": 1,
+				"patients":     1,
+			},
+			wantResources: 3,
+		},
+		{
+			name:     "Eval error",
+			valueSet: "urn:example:nosuchvalueset",
+			wantCounters: map[string]int64{
+				"fhir_bundles": 1,
+				"eval_errors":  1,
+				"errors":       1,
+			},
+			wantResources: 3,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &pipelineConfig{
+				CQL: []string{dedent.Dedent(fmt.Sprintf(
+					`library EvalTest version '1.0'
+					using FHIR version '4.0.1'
+					valueset "DiabetesVS": '%s'
+					define HasDiabetes: exists([Condition: "DiabetesVS"])`, tc.valueSet))},
+				ValueSets:           valueSets,
+				FHIRBundleDir:       fhirBundleDir,
+				NDJSONOutputDir:     t.TempDir(),
+				EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+			}
+			p, s := beam.NewPipelineWithRoot()
+			buildPipeline(s, cfg)
+			pr, err := ptest.RunWithMetrics(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotCounters := make(map[string]int64)
+			for _, c := range pr.Metrics().AllMetrics().Counters() {
+				if c.Namespace() == "beam_cql" {
+					gotCounters[c.Name()] += c.Result()
+				}
+			}
+			if diff := cmp.Diff(tc.wantCounters, gotCounters); diff != "" {
+				t.Errorf("counters diff (-want +got):\n%s", diff)
+			}
+
+			gotDists := make(map[string]int64)
+			for _, d := range pr.Metrics().AllMetrics().Distributions() {
+				if d.Namespace() == "beam_cql" {
+					gotDists[d.Name()] += d.Result().Count
+					if d.Name() == "bundle_resources" && d.Result().Sum != tc.wantResources {
+						t.Errorf("bundle_resources sum = %d, want %d", d.Result().Sum, tc.wantResources)
+					}
+				}
+			}
+			if diff := cmp.Diff(map[string]int64{"bundle_resources": 1, "eval_latency_ms": 1}, gotDists); diff != "" {
+				t.Errorf("distribution counts diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func diffEvalResults(_ []byte, iterWant, iterGot func(**cbpb.BeamResult) bool) error {
 	var got, want []*cbpb.BeamResult
 	var v *cbpb.BeamResult
@@ -148,7 +833,7 @@ func diffEvalResults(_ []byte, iterWant, iterGot func(**cbpb.BeamResult) bool) e
 		if a.GetEvaluationTimestamp().GetSeconds() != b.GetEvaluationTimestamp().GetSeconds() {
 			return a.GetEvaluationTimestamp().GetSeconds() < b.GetEvaluationTimestamp().GetSeconds()
 		}
-		return false
+		return a.GetId() < b.GetId()
 	}
 
 	if diff := cmp.Diff(want, got, cmpopts.SortSlices(sortOutputs), protocmp.Transform(), protocmp.SortRepeatedFields(&crpb.Libraries{}, "libraries")); diff != "" {
@@ -175,6 +860,23 @@ func diffEvalErrors(_ []byte, iterWant, iterGot func(**cbpb.BeamError) bool) err
 
 func TestBuildConfig(t *testing.T) {
 	cqlDir, terminologyDir, _ := directorySetup(t, cqlLibs, valueSets, fhirBundles)
+	measureFile := filepath.Join(t.TempDir(), "measure.json")
+	if err := os.WriteFile(measureFile, []byte(testMeasure), 0644); err != nil {
+		t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+	}
+	retrieveCQL := dedent.Dedent(`
+		library Retrieves version '1.0'
+		using FHIR version '4.0.1'
+		define Conditions: [Condition]
+		define Observations: [Observation]`)
+	retrieveCQLDir, _, _ := directorySetup(t, []string{retrieveCQL}, nil, nil)
+	paramCQL := dedent.Dedent(`
+		library org.example.Params version '1.0'
+		parameter Threshold Integer
+		parameter "Measurement Period" Interval<Date>`)
+	paramCQLDir, _, _ := directorySetup(t, []string{paramCQL}, nil, nil)
+	measureADir := cqlSetDir(t, "measure_a", cqlLibs...)
+	measureBDir := cqlSetDir(t, "measure_b", paramCQL)
 
 	tests := []struct {
 		name  string
@@ -200,6 +902,182 @@ func TestBuildConfig(t *testing.T) {
 				NDJSONOutputDir:     "ndjsonOutputDir",
 			},
 		},
+		{
+			name: "with bigquery outputs",
+			flags: &beamFlags{
+				CQLDir:              cqlDir,
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: "2024-01-01T00:00:00Z",
+				BigQueryOutputTable: "project.dataset.results",
+				BigQueryErrorsTable: "project:dataset.errors",
+			},
+			want: &pipelineConfig{
+				CQL:                 cqlLibs,
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				BigQueryOutputTable: "project.dataset.results",
+				BigQueryErrorsTable: "project:dataset.errors",
+			},
+		},
+		{
+			name: "with fhir store compartment queries",
+			flags: &beamFlags{
+				CQLDir:              retrieveCQLDir,
+				FHIRStore:           testFHIRStore,
+				FHIRStoreEndpoint:   "http://localhost",
+				FHIRStoreQuery:      "compartment",
+				EvaluationTimestamp: "2024-01-01T00:00:00Z",
+				NDJSONOutputDir:     "ndjsonOutputDir",
+			},
+			want: &pipelineConfig{
+				CQL:                    []string{retrieveCQL},
+				FHIRStore:              testFHIRStore,
+				FHIRStoreEndpoint:      "http://localhost",
+				FHIRStoreQuery:         "compartment",
+				FHIRStoreResourceTypes: []string{"Condition", "Observation"},
+				EvaluationTimestamp:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				NDJSONOutputDir:        "ndjsonOutputDir",
+			},
+		},
+		{
+			name: "with pubsub topic",
+			flags: &beamFlags{
+				CQLDir:              cqlDir,
+				PubSubTopic:         "projects/p/topics/bundles",
+				PubSubSubscription:  "sub",
+				WindowDuration:      5 * time.Minute,
+				EvaluationTimestamp: "2024-01-01T00:00:00Z",
+				NDJSONOutputDir:     "ndjsonOutputDir",
+			},
+			want: &pipelineConfig{
+				CQL:                 cqlLibs,
+				PubSubProject:       "p",
+				PubSubTopic:         "bundles",
+				PubSubSubscription:  "sub",
+				WindowDuration:      5 * time.Minute,
+				EvaluationTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				NDJSONOutputDir:     "ndjsonOutputDir",
+			},
+		},
+		{
+			name: "with dead letter dir",
+			flags: &beamFlags{
+				CQLDir:              cqlDir,
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: "2024-01-01T00:00:00Z",
+				NDJSONOutputDir:     "ndjsonOutputDir",
+				DeadLetterDir:       "deadLetterDir",
+			},
+			want: &pipelineConfig{
+				CQL:                 cqlLibs,
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				NDJSONOutputDir:     "ndjsonOutputDir",
+				DeadLetterDir:       "deadLetterDir",
+			},
+		},
+		{
+			name: "with several cql dirs",
+			flags: &beamFlags{
+				CQLDir:              measureADir + "," + measureBDir,
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: "2024-01-01T00:00:00Z",
+				Parameters:          parameterFlags{"org.example.Params.Threshold=3"},
+				NDJSONOutputDir:     "ndjsonOutputDir",
+			},
+			want: &pipelineConfig{
+				LibrarySets: []librarySet{
+					{Name: "measure_a", CQL: cqlLibs},
+					{
+						Name: "measure_b",
+						CQL:  []string{paramCQL},
+						Parameters: []transforms.Parameter{
+							{Key: result.DefKey{Name: "Threshold", Library: result.LibKey{Name: "org.example.Params", Version: "1.0"}}, Value: "3"},
+						},
+					},
+				},
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				NDJSONOutputDir:     "ndjsonOutputDir",
+			},
+		},
+		{
+			name: "with guardrails",
+			flags: &beamFlags{
+				CQLDir:              cqlDir,
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: "2024-01-01T00:00:00Z",
+				NDJSONOutputDir:     "ndjsonOutputDir",
+				MaxBundleResources:  10000,
+				MaxBundleBytes:      1 << 30,
+				MaxConcurrentEvals:  4,
+			},
+			want: &pipelineConfig{
+				CQL:                 cqlLibs,
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				NDJSONOutputDir:     "ndjsonOutputDir",
+				MaxBundleResources:  10000,
+				MaxBundleBytes:      1 << 30,
+				MaxConcurrentEvals:  4,
+			},
+		},
+		{
+			name: "with bundle evaluation timestamps",
+			flags: &beamFlags{
+				CQLDir:                    cqlDir,
+				FHIRBundleDir:             "fhirBundleDir",
+				EvaluationTimestamp:       "2024-01-01T00:00:00Z",
+				EvaluationTimestampSource: transforms.TimestampBundle,
+				NDJSONOutputDir:           "ndjsonOutputDir",
+			},
+			want: &pipelineConfig{
+				CQL:                       cqlLibs,
+				FHIRBundleDir:             "fhirBundleDir",
+				EvaluationTimestamp:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				EvaluationTimestampSource: transforms.TimestampBundle,
+				NDJSONOutputDir:           "ndjsonOutputDir",
+			},
+		},
+		{
+			name: "with aggregates",
+			flags: &beamFlags{
+				CQLDir:               cqlDir,
+				FHIRBundleDir:        "fhirBundleDir",
+				EvaluationTimestamp:  "2024-01-01T00:00:00Z",
+				NDJSONOutputDir:      "ndjsonOutputDir",
+				AggregatePopulations: true,
+				Measure:              measureFile,
+			},
+			want: &pipelineConfig{
+				CQL:                  cqlLibs,
+				FHIRBundleDir:        "fhirBundleDir",
+				EvaluationTimestamp:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				NDJSONOutputDir:      "ndjsonOutputDir",
+				AggregatePopulations: true,
+				Measure:              []byte(testMeasure),
+			},
+		},
+		{
+			name: "with parameters",
+			flags: &beamFlags{
+				CQLDir:              paramCQLDir,
+				FHIRBundleDir:       "fhirBundleDir",
+				EvaluationTimestamp: "2024-01-01T00:00:00Z",
+				Parameters:          parameterFlags{"org.example.Params.Threshold=3", "org.example.Params.Measurement Period=Interval[@2024-01-01, @2025-01-01)"},
+				NDJSONOutputDir:     "ndjsonOutputDir",
+			},
+			want: &pipelineConfig{
+				CQL:           []string{paramCQL},
+				FHIRBundleDir: "fhirBundleDir",
+				Parameters: []transforms.Parameter{
+					{Key: result.DefKey{Name: "Threshold", Library: result.LibKey{Name: "org.example.Params", Version: "1.0"}}, Value: "3"},
+					{Key: result.DefKey{Name: "Measurement Period", Library: result.LibKey{Name: "org.example.Params", Version: "1.0"}}, Value: "Interval[@2024-01-01, @2025-01-01)"},
+				},
+				EvaluationTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				NDJSONOutputDir:     "ndjsonOutputDir",
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -207,7 +1085,20 @@ func TestBuildConfig(t *testing.T) {
 			if err != nil {
 				t.Fatalf("buildConfig() failed: %v", err)
 			}
-			if diff := cmp.Diff(got, test.want); diff != "" {
+			if len(got.ELM) == 0 && len(got.LibrarySets) == 0 {
+				t.Errorf("buildConfig() did not encode the parsed CQL")
+			}
+			for _, set := range got.LibrarySets {
+				if len(set.ELM) == 0 {
+					t.Errorf("buildConfig() did not encode the parsed CQL of library set %s", set.Name)
+				}
+			}
+			test.want.Terminology, err = transforms.EncodeTerminology(test.want.ValueSets)
+			if err != nil {
+				t.Fatalf("EncodeTerminology() returned an unexpected error: %v", err)
+			}
+			// The gob encoding of the parsed CQL is not deterministic, so it is checked by the pipeline tests.
+			if diff := cmp.Diff(got, test.want, cmpopts.IgnoreFields(pipelineConfig{}, "ELM"), cmpopts.IgnoreFields(librarySet{}, "ELM")); diff != "" {
 				t.Errorf("buildConfig() unexpected diff (-got +want):\n %s", diff)
 			}
 		})
@@ -216,6 +1107,15 @@ func TestBuildConfig(t *testing.T) {
 
 func TestBuildConfig_Failure(t *testing.T) {
 	cqlDir, _, fhirBundleDir := directorySetup(t, cqlLibs, valueSets, fhirBundles)
+	invalidCQLDir, _, _ := directorySetup(t, []string{"library Invalid define X: 1 +"}, nil, nil)
+	_, invalidTerminologyDir, _ := directorySetup(t, nil, []string{`{"resourceType": "ValueSet", `}, nil)
+	invalidMeasureFile := filepath.Join(t.TempDir(), "measure.json")
+	if err := os.WriteFile(invalidMeasureFile, []byte(`{"resourceType": "Library"}`), 0644); err != nil {
+		t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+	}
+	paramCQLDir, _, _ := directorySetup(t, []string{"library Params version '1.0'\nparameter Threshold Integer\ndefine X: 1"}, nil, nil)
+	measureADir := cqlSetDir(t, "measure_a", cqlLibs...)
+	measureBDir := cqlSetDir(t, "measure_b", "library B version '1.0'\ndefine X: 1")
 
 	tests := []struct {
 		name      string
@@ -228,11 +1128,81 @@ func TestBuildConfig_Failure(t *testing.T) {
 			wantError: "cql_dir must be set",
 		},
 		{
-			name: "fhir_bundle_dir not set",
+			name: "no fhir input set",
 			flags: &beamFlags{
 				CQLDir: cqlDir,
 			},
-			wantError: "fhir_bundle_dir must be set",
+			wantError: "one of fhir_bundle_dir, fhir_ndjson_dir, fhir_store or pubsub_topic must be set",
+		},
+		{
+			name: "fhir_bundle_dir and fhir_store both set",
+			flags: &beamFlags{
+				CQLDir:        cqlDir,
+				FHIRBundleDir: fhirBundleDir,
+				FHIRStore:     testFHIRStore,
+			},
+			wantError: "only one of fhir_bundle_dir, fhir_ndjson_dir, fhir_store or pubsub_topic may be set",
+		},
+		{
+			name: "fhir_bundle_dir and fhir_ndjson_dir both set",
+			flags: &beamFlags{
+				CQLDir:        cqlDir,
+				FHIRBundleDir: fhirBundleDir,
+				FHIRNDJSONDir: fhirBundleDir,
+			},
+			wantError: "only one of fhir_bundle_dir, fhir_ndjson_dir, fhir_store or pubsub_topic may be set",
+		},
+		{
+			name: "invalid pubsub_topic",
+			flags: &beamFlags{
+				CQLDir:         cqlDir,
+				PubSubTopic:    "bundles",
+				WindowDuration: time.Minute,
+			},
+			wantError: "pubsub_topic must be in the form projects/{project}/topics/{topic}",
+		},
+		{
+			name: "non-positive window_duration",
+			flags: &beamFlags{
+				CQLDir:      cqlDir,
+				PubSubTopic: "projects/p/topics/bundles",
+			},
+			wantError: "window_duration must be positive",
+		},
+		{
+			name: "pubsub_subscription without pubsub_topic",
+			flags: &beamFlags{
+				CQLDir:             cqlDir,
+				FHIRBundleDir:      fhirBundleDir,
+				PubSubSubscription: "sub",
+			},
+			wantError: "pubsub_subscription requires pubsub_topic",
+		},
+		{
+			name: "merge_patient_bundles without fhir_bundle_dir",
+			flags: &beamFlags{
+				CQLDir:              cqlDir,
+				FHIRNDJSONDir:       fhirBundleDir,
+				MergePatientBundles: true,
+			},
+			wantError: "merge_patient_bundles requires fhir_bundle_dir",
+		},
+		{
+			name: "invalid fhir_store",
+			flags: &beamFlags{
+				CQLDir:    cqlDir,
+				FHIRStore: "projects/p/fhirStores/s",
+			},
+			wantError: "must be in the form projects/{project}/locations/{location}/datasets/{dataset}/fhirStores/{fhirStore}",
+		},
+		{
+			name: "invalid fhir_store_query",
+			flags: &beamFlags{
+				CQLDir:         cqlDir,
+				FHIRStore:      testFHIRStore,
+				FHIRStoreQuery: "all",
+			},
+			wantError: "fhir_store_query must be everything or compartment",
 		},
 		{
 			name: "ndjson_output_dir not set",
@@ -240,7 +1210,26 @@ func TestBuildConfig_Failure(t *testing.T) {
 				CQLDir:        cqlDir,
 				FHIRBundleDir: fhirBundleDir,
 			},
-			wantError: "ndjson_output_dir must be set",
+			wantError: "one of ndjson_output_dir or bigquery_output_table must be set",
+		},
+		{
+			name: "invalid bigquery_output_table",
+			flags: &beamFlags{
+				CQLDir:              cqlDir,
+				FHIRBundleDir:       fhirBundleDir,
+				BigQueryOutputTable: "dataset.table",
+			},
+			wantError: "must be in the form project.dataset.table",
+		},
+		{
+			name: "aggregate_populations without ndjson_output_dir",
+			flags: &beamFlags{
+				CQLDir:               cqlDir,
+				FHIRBundleDir:        fhirBundleDir,
+				BigQueryOutputTable:  "project.dataset.table",
+				AggregatePopulations: true,
+			},
+			wantError: "aggregate_populations and measure require ndjson_output_dir",
 		},
 		{
 			name: "invalid cql_dir",
@@ -251,6 +1240,194 @@ func TestBuildConfig_Failure(t *testing.T) {
 			},
 			wantError: "failed to read directory baddir",
 		},
+		{
+			name: "invalid CQL",
+			flags: &beamFlags{
+				CQLDir:          invalidCQLDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+			},
+			wantError: "failed to parse CQL",
+		},
+		{
+			name: "invalid terminology",
+			flags: &beamFlags{
+				CQLDir:             cqlDir,
+				FHIRTerminologyDir: invalidTerminologyDir,
+				FHIRBundleDir:      fhirBundleDir,
+				NDJSONOutputDir:    "output",
+			},
+			wantError: "failed to load terminology",
+		},
+		{
+			name: "invalid evaluation_timestamp_source",
+			flags: &beamFlags{
+				CQLDir:                    cqlDir,
+				FHIRBundleDir:             fhirBundleDir,
+				NDJSONOutputDir:           "output",
+				EvaluationTimestampSource: "message",
+			},
+			wantError: "evaluation_timestamp_source must be fixed, bundle or publish_time",
+		},
+		{
+			name: "publish_time without pubsub_topic",
+			flags: &beamFlags{
+				CQLDir:                    cqlDir,
+				FHIRBundleDir:             fhirBundleDir,
+				NDJSONOutputDir:           "output",
+				EvaluationTimestampSource: transforms.TimestampPublishTime,
+			},
+			wantError: "evaluation_timestamp_source publish_time requires pubsub_topic",
+		},
+		{
+			name: "resume_from_dir is ndjson_output_dir",
+			flags: &beamFlags{
+				CQLDir:          cqlDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "gs://bucket/output",
+				ResumeFromDir:   "gs://bucket/output/",
+			},
+			wantError: "resume_from_dir must differ from ndjson_output_dir",
+		},
+		{
+			name: "resume_from_dir with pubsub_topic",
+			flags: &beamFlags{
+				CQLDir:          cqlDir,
+				PubSubTopic:     "projects/p/topics/t",
+				WindowDuration:  time.Minute,
+				NDJSONOutputDir: "output",
+				ResumeFromDir:   "previous",
+			},
+			wantError: "resume_from_dir can not be used with pubsub_topic",
+		},
+		{
+			name: "duplicate cql dir names",
+			flags: &beamFlags{
+				CQLDir:          cqlDir + "," + paramCQLDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+			},
+			wantError: `cql_dir has several directories named "cqlDir"`,
+		},
+		{
+			name: "parameter in no cql dir",
+			flags: &beamFlags{
+				CQLDir:          measureADir + "," + measureBDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				Parameters:      parameterFlags{"Params.Threshold=3"},
+			},
+			wantError: `parameter "Params.Threshold" does not name a library in the CQL`,
+		},
+		{
+			name: "measure with several cql dirs",
+			flags: &beamFlags{
+				CQLDir:          measureADir + "," + measureBDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				Measure:         invalidMeasureFile,
+			},
+			wantError: "measure can not be used with several cql_dir directories",
+		},
+		{
+			name: "bigquery_output_table with several cql dirs",
+			flags: &beamFlags{
+				CQLDir:              measureADir + "," + measureBDir,
+				FHIRBundleDir:       fhirBundleDir,
+				BigQueryOutputTable: "project.dataset.table",
+			},
+			wantError: "bigquery_output_table can not be used with several cql_dir directories",
+		},
+		{
+			name: "negative max_bundle_resources",
+			flags: &beamFlags{
+				CQLDir:             cqlDir,
+				FHIRBundleDir:      fhirBundleDir,
+				NDJSONOutputDir:    "output",
+				MaxBundleResources: -1,
+			},
+			wantError: "max_bundle_resources, max_bundle_bytes and max_concurrent_evals must not be negative",
+		},
+		{
+			name: "measure not found",
+			flags: &beamFlags{
+				CQLDir:          cqlDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				Measure:         "missing.json",
+			},
+			wantError: "failed to read file missing.json",
+		},
+		{
+			name: "invalid measure",
+			flags: &beamFlags{
+				CQLDir:          cqlDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				Measure:         invalidMeasureFile,
+			},
+			wantError: "failed to parse measure",
+		},
+		{
+			name: "parameter without value",
+			flags: &beamFlags{
+				CQLDir:          paramCQLDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				Parameters:      parameterFlags{"Params.Threshold"},
+			},
+			wantError: "parameter must be in the form Library.Name=value",
+		},
+		{
+			name: "parameter of unknown library",
+			flags: &beamFlags{
+				CQLDir:          paramCQLDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				Parameters:      parameterFlags{"Other.Threshold=1"},
+			},
+			wantError: "does not name a library in the CQL",
+		},
+		{
+			name: "undefined parameter",
+			flags: &beamFlags{
+				CQLDir:          paramCQLDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				Parameters:      parameterFlags{"Params.Limit=1"},
+			},
+			wantError: "parameter \"Limit\" is not defined in library Params",
+		},
+		{
+			name: "invalid parameter value",
+			flags: &beamFlags{
+				CQLDir:          paramCQLDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				Parameters:      parameterFlags{"Params.Threshold=1 +"},
+			},
+			wantError: "failed to parse CQL parameters",
+		},
+		{
+			name: "negative output_shards",
+			flags: &beamFlags{
+				CQLDir:          cqlDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				OutputShards:    -1,
+			},
+			wantError: "output_shards must not be negative",
+		},
+		{
+			name: "invalid output_partition",
+			flags: &beamFlags{
+				CQLDir:          cqlDir,
+				FHIRBundleDir:   fhirBundleDir,
+				NDJSONOutputDir: "output",
+				OutputPartition: "patient",
+			},
+			wantError: "output partition must be library or status",
+		},
 		{
 			name: "invalid terminology_dir",
 			flags: &beamFlags{
@@ -261,6 +1438,13 @@ func TestBuildConfig_Failure(t *testing.T) {
 			},
 			wantError: "failed to read directory baddir",
 		},
+		{
+			name: "invalid include_defines_regex",
+			flags: &beamFlags{
+				IncludeDefinesRegex: "(",
+			},
+			wantError: "invalid include regex",
+		},
 		{
 			name: "invalid evaluation timestamp",
 			flags: &beamFlags{
@@ -282,6 +1466,22 @@ func TestBuildConfig_Failure(t *testing.T) {
 	}
 }
 
+// cqlSetDir writes the CQL libraries to a directory with the name, for tests of several library
+// sets.
+func cqlSetDir(t *testing.T, name string, cqlLibs ...string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create directory %s: %v", dir, err)
+	}
+	for i, cql := range cqlLibs {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("cql-%d.cql", i)), []byte(cql), 0644); err != nil {
+			t.Fatalf("Failed to write file %s: %v", filepath.Join(dir, fmt.Sprintf("cql-%d.cql", i)), err)
+		}
+	}
+	return dir
+}
+
 func directorySetup(t *testing.T, cqlLibs []string, valueSets []string, fhirBundles []string) (string, string, string) {
 	t.Helper()
 	tempDir := t.TempDir()
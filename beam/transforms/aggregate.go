@@ -0,0 +1,223 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/google/cql/measure"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	"github.com/google/cql/result"
+	"google.golang.org/protobuf/proto"
+)
+
+var measureReportErrorCount = beam.NewCounter(counterPrefix, "measure_report_errors")
+
+func init() {
+	register.Function3x0(populationCounts)
+	register.Function2x1(mergePopulationCounts)
+	register.Function2x2(formatPopulationCount)
+	register.Emitter2[string, PopulationCount]()
+	register.DoFn4x0[context.Context, *cbpb.BeamResult, func(*measure.MeasureReport), func(*cbpb.BeamError)](&MeasureReportFn{})
+	register.Combiner3[*measure.MeasureReport, *measure.MeasureReport, string](&summaryReportFn{})
+	register.Emitter1[*measure.MeasureReport]()
+	beam.RegisterType(reflect.TypeOf((*PopulationCount)(nil)).Elem())
+	// MeasureReports are encoded as their FHIR JSON.
+	beam.RegisterCoder(reflect.TypeOf((*measure.MeasureReport)(nil)), encodeMeasureReport, decodeMeasureReport)
+}
+
+// PopulationCount is the number of patients for whom a Boolean expression definition evaluated to
+// true and to false. Null results are not counted.
+type PopulationCount struct {
+	// LibrarySet is the set of libraries the definition was evaluated in, if the pipeline evaluates
+	// several sets.
+	LibrarySet string `json:"librarySet,omitempty"`
+	Library    string `json:"library"`
+	Version    string `json:"version"`
+	Define     string `json:"define"`
+	True       int64  `json:"true"`
+	False      int64  `json:"false"`
+	// Proportion is True divided by True plus False. It is only set on output rows.
+	Proportion float64 `json:"proportion"`
+}
+
+// CountPopulations aggregates the Boolean expression definitions of a PCollection<*cbpb.BeamResult>
+// into the number of patients they are true and false for, which is the size of the population
+// they define. It returns a PCollection<string> with one JSON PopulationCount row for each
+// definition.
+func CountPopulations(s beam.Scope, results beam.PCollection) beam.PCollection {
+	s = s.Scope("CountPopulations")
+	counts := beam.CombinePerKey(s, mergePopulationCounts, beam.ParDo(s, populationCounts, results))
+	return beam.ParDo(s, formatPopulationCount, counts)
+}
+
+// populationCounts emits a count for each Boolean expression definition of the result, keyed by
+// its library and name. Results that can not be converted are skipped, since the NDJSON sinks
+// already report them as errors.
+func populationCounts(ctx context.Context, output *cbpb.BeamResult, emit func(string, PopulationCount)) {
+	libs, err := result.LibrariesFromProto(output.GetResult())
+	if err != nil {
+		return
+	}
+	for lib, defs := range libs {
+		for name, v := range defs {
+			b, ok := v.GolangValue().(bool)
+			if !ok {
+				continue
+			}
+			c := PopulationCount{LibrarySet: output.GetLibrarySet(), Library: lib.Name, Version: lib.Version, Define: name}
+			if b {
+				c.True = 1
+			} else {
+				c.False = 1
+			}
+			emit(fmt.Sprintf("%s|%s|%s|%s", c.LibrarySet, lib.Name, lib.Version, name), c)
+		}
+	}
+}
+
+func mergePopulationCounts(a, b PopulationCount) PopulationCount {
+	if a.Define == "" {
+		// a is an empty accumulator.
+		a.LibrarySet, a.Library, a.Version, a.Define = b.LibrarySet, b.Library, b.Version, b.Define
+	}
+	a.True += b.True
+	a.False += b.False
+	return a
+}
+
+func formatPopulationCount(_ string, c PopulationCount) (string, error) {
+	if total := c.True + c.False; total > 0 {
+		c.Proportion = float64(c.True) / float64(total)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// MeasureReportFn is a DoFn that generates the individual FHIR MeasureReport of each result for a
+// FHIR Measure, see measure.IndividualReport.
+type MeasureReportFn struct {
+	// Measure is the JSON of the FHIR Measure resource.
+	Measure []byte
+	// Config configures the reports, such as their measurement period.
+	Config  measure.Config
+	measure *measure.Measure
+}
+
+// Setup parses the Measure.
+func (fn *MeasureReportFn) Setup() error {
+	var err error
+	fn.measure, err = measure.ParseMeasure(fn.Measure)
+	return err
+}
+
+// ProcessElement emits the individual MeasureReport of the result, or a BeamError if the results
+// of the population criteria are not valid.
+func (fn *MeasureReportFn) ProcessElement(ctx context.Context, output *cbpb.BeamResult, emit func(*measure.MeasureReport), emitError func(*cbpb.BeamError)) {
+	emitErr := func(err error) {
+		measureReportErrorCount.Inc(ctx, 1)
+		emitError(&cbpb.BeamError{
+			ErrorMessage: proto.String(err.Error()),
+			Stage:        cbpb.BeamError_EVAL.Enum(),
+			PatientId:    proto.String(output.GetId()),
+		})
+	}
+	libs, err := result.LibrariesFromProto(output.GetResult())
+	if err != nil {
+		emitErr(err)
+		return
+	}
+	r, err := measure.IndividualReport(fn.measure, "Patient/"+output.GetId(), libs, fn.Config)
+	if err != nil {
+		emitErr(err)
+		return
+	}
+	emit(r)
+}
+
+// SummarizeMeasure generates the summary FHIR MeasureReport of a PCollection<*cbpb.BeamResult> for
+// the FHIR Measure. It returns a PCollection<string> with the JSON of the summary MeasureReport,
+// and a PCollection<*cbpb.BeamError> of the results that could not be reported.
+func SummarizeMeasure(s beam.Scope, measureJSON []byte, cfg measure.Config, results beam.PCollection) (reports, errors beam.PCollection) {
+	s = s.Scope("SummarizeMeasure")
+	individual, errors := beam.ParDo2(s, &MeasureReportFn{Measure: measureJSON, Config: cfg}, results)
+	return beam.Combine(s, &summaryReportFn{Measure: measureJSON, Config: cfg}, individual), errors
+}
+
+// summaryReportFn is a CombineFn that aggregates MeasureReports into a summary MeasureReport.
+type summaryReportFn struct {
+	Measure []byte
+	Config  measure.Config
+	measure *measure.Measure
+}
+
+func (fn *summaryReportFn) Setup() error {
+	var err error
+	fn.measure, err = measure.ParseMeasure(fn.Measure)
+	return err
+}
+
+func (fn *summaryReportFn) CreateAccumulator() *measure.MeasureReport {
+	return nil
+}
+
+func (fn *summaryReportFn) AddInput(sum, r *measure.MeasureReport) (*measure.MeasureReport, error) {
+	return fn.MergeAccumulators(sum, r)
+}
+
+func (fn *summaryReportFn) MergeAccumulators(a, b *measure.MeasureReport) (*measure.MeasureReport, error) {
+	var reports []*measure.MeasureReport
+	for _, r := range []*measure.MeasureReport{a, b} {
+		if r != nil {
+			reports = append(reports, r)
+		}
+	}
+	return measure.SummaryReport(fn.measure, reports, fn.Config)
+}
+
+func (fn *summaryReportFn) ExtractOutput(sum *measure.MeasureReport) (string, error) {
+	if sum == nil {
+		// No patients were reported, which is a summary with empty populations.
+		var err error
+		if sum, err = measure.SummaryReport(fn.measure, nil, fn.Config); err != nil {
+			return "", err
+		}
+	}
+	b, err := json.Marshal(sum)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func encodeMeasureReport(r *measure.MeasureReport) ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func decodeMeasureReport(b []byte) (*measure.MeasureReport, error) {
+	var r *measure.MeasureReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
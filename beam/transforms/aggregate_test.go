@@ -0,0 +1,226 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/cql/measure"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	crpb "github.com/google/cql/protos/cql_result_go_proto"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/proto"
+)
+
+const testMeasure = `{
+	"resourceType": "Measure",
+	"url": "https://example.com/Measure/Screening",
+	"library": ["https://example.com/Library/Screening|1.0"],
+	"scoring": {"coding": [{"code": "proportion"}]},
+	"group": [{"population": [
+		{"code": {"coding": [{"code": "initial-population"}]}, "criteria": {"expression": "Initial Population"}},
+		{"code": {"coding": [{"code": "denominator"}]}, "criteria": {"expression": "Denominator"}},
+		{"code": {"coding": [{"code": "numerator"}]}, "criteria": {"expression": "Numerator"}}
+	]}]
+}`
+
+// screeningResult returns the result of a patient in the Screening library.
+func screeningResult(id string, ip, denom bool, numer *bool) *cbpb.BeamResult {
+	boolValue := func(b bool) *crpb.Value {
+		return &crpb.Value{Value: &crpb.Value_BooleanValue{BooleanValue: b}}
+	}
+	defs := map[string]*crpb.Value{
+		"Initial Population": boolValue(ip),
+		"Denominator":        boolValue(denom),
+		"Numerator":          &crpb.Value{},
+		"Age":                &crpb.Value{Value: &crpb.Value_IntegerValue{IntegerValue: 42}},
+	}
+	if numer != nil {
+		defs["Numerator"] = boolValue(*numer)
+	}
+	return &cbpb.BeamResult{
+		Id: proto.String(id),
+		Result: &crpb.Libraries{Libraries: []*crpb.Library{
+			&crpb.Library{Name: proto.String("Screening"), Version: proto.String("1.0"), ExprDefs: defs},
+		}},
+	}
+}
+
+func TestPopulationCounts(t *testing.T) {
+	counts := make(map[string]PopulationCount)
+	for _, r := range []*cbpb.BeamResult{
+		screeningResult("1", true, true, proto.Bool(true)),
+		screeningResult("2", true, true, proto.Bool(false)),
+		screeningResult("3", true, false, nil),
+	} {
+		populationCounts(context.Background(), r, func(k string, c PopulationCount) {
+			counts[k] = mergePopulationCounts(counts[k], c)
+		})
+	}
+
+	want := map[string]PopulationCount{
+		"|Screening|1.0|Initial Population": {Library: "Screening", Version: "1.0", Define: "Initial Population", True: 3},
+		"|Screening|1.0|Denominator":        {Library: "Screening", Version: "1.0", Define: "Denominator", True: 2, False: 1},
+		"|Screening|1.0|Numerator":          {Library: "Screening", Version: "1.0", Define: "Numerator", True: 1, False: 1},
+	}
+	if diff := cmp.Diff(want, counts); diff != "" {
+		t.Errorf("populationCounts() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFormatPopulationCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		count PopulationCount
+		want  PopulationCount
+	}{
+		{
+			name:  "Proportion",
+			count: PopulationCount{Library: "Screening", Version: "1.0", Define: "Numerator", True: 1, False: 3},
+			want:  PopulationCount{Library: "Screening", Version: "1.0", Define: "Numerator", True: 1, False: 3, Proportion: 0.25},
+		},
+		{
+			name:  "Empty population",
+			count: PopulationCount{Library: "Screening", Version: "1.0", Define: "Numerator"},
+			want:  PopulationCount{Library: "Screening", Version: "1.0", Define: "Numerator"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			row, err := formatPopulationCount("", tc.count)
+			if err != nil {
+				t.Fatalf("formatPopulationCount() returned unexpected error: %v", err)
+			}
+			var got PopulationCount
+			if err := json.Unmarshal([]byte(row), &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", row, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("formatPopulationCount() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMeasureReportFn(t *testing.T) {
+	fn := &MeasureReportFn{Measure: []byte(testMeasure)}
+	if err := fn.Setup(); err != nil {
+		t.Fatalf("Setup() returned unexpected error: %v", err)
+	}
+
+	var got []*measure.MeasureReport
+	fn.ProcessElement(context.Background(), screeningResult("1", true, true, proto.Bool(true)),
+		func(r *measure.MeasureReport) { got = append(got, r) },
+		func(e *cbpb.BeamError) { t.Errorf("ProcessElement() emitted unexpected error: %v", e) })
+	if len(got) != 1 || got[0].Subject == nil || got[0].Subject.Reference != "Patient/1" {
+		t.Errorf("ProcessElement() emitted %v, want one report for Patient/1", got)
+	}
+
+	// Results missing the population definitions are reported as errors.
+	var errs []*cbpb.BeamError
+	missing := &cbpb.BeamResult{Id: proto.String("2"), Result: &crpb.Libraries{Libraries: []*crpb.Library{
+		&crpb.Library{Name: proto.String("Screening"), Version: proto.String("1.0")},
+	}}}
+	fn.ProcessElement(context.Background(), missing,
+		func(r *measure.MeasureReport) { t.Errorf("ProcessElement() emitted unexpected report: %v", r) },
+		func(e *cbpb.BeamError) { errs = append(errs, e) })
+	if len(errs) != 1 || errs[0].GetPatientId() != "2" || errs[0].GetStage() != cbpb.BeamError_EVAL {
+		t.Errorf("ProcessElement() emitted errors %v, want one EVAL error for patient 2", errs)
+	}
+}
+
+func TestSummaryReportFn(t *testing.T) {
+	cfg := measure.Config{Date: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	reportFn := &MeasureReportFn{Measure: []byte(testMeasure), Config: cfg}
+	if err := reportFn.Setup(); err != nil {
+		t.Fatalf("MeasureReportFn.Setup() returned unexpected error: %v", err)
+	}
+	var reports []*measure.MeasureReport
+	for _, r := range []*cbpb.BeamResult{
+		screeningResult("1", true, true, proto.Bool(true)),
+		screeningResult("2", true, true, proto.Bool(false)),
+		screeningResult("3", true, false, nil),
+	} {
+		reportFn.ProcessElement(context.Background(), r,
+			func(r *measure.MeasureReport) { reports = append(reports, r) },
+			func(e *cbpb.BeamError) { t.Errorf("MeasureReportFn.ProcessElement() emitted unexpected error: %v", e) })
+	}
+
+	fn := &summaryReportFn{Measure: []byte(testMeasure), Config: cfg}
+	if err := fn.Setup(); err != nil {
+		t.Fatalf("Setup() returned unexpected error: %v", err)
+	}
+	// Combine the reports into two accumulators, as if on different workers, and merge them.
+	a, b := fn.CreateAccumulator(), fn.CreateAccumulator()
+	var err error
+	if a, err = fn.AddInput(a, reports[0]); err != nil {
+		t.Fatalf("AddInput() returned unexpected error: %v", err)
+	}
+	for _, r := range reports[1:] {
+		if b, err = fn.AddInput(b, r); err != nil {
+			t.Fatalf("AddInput() returned unexpected error: %v", err)
+		}
+	}
+	sum, err := fn.MergeAccumulators(a, b)
+	if err != nil {
+		t.Fatalf("MergeAccumulators() returned unexpected error: %v", err)
+	}
+	// The accumulators are encoded between workers.
+	encoded, err := encodeMeasureReport(sum)
+	if err != nil {
+		t.Fatalf("encodeMeasureReport() returned unexpected error: %v", err)
+	}
+	if sum, err = decodeMeasureReport(encoded); err != nil {
+		t.Fatalf("decodeMeasureReport() returned unexpected error: %v", err)
+	}
+	out, err := fn.ExtractOutput(sum)
+	if err != nil {
+		t.Fatalf("ExtractOutput() returned unexpected error: %v", err)
+	}
+
+	var got measure.MeasureReport
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", out, err)
+	}
+	counts := make(map[string]int)
+	for _, p := range got.Group[0].Population {
+		counts[p.Code.Coding[0].Code] = p.Count
+	}
+	want := map[string]int{"initial-population": 3, "denominator": 2, "numerator": 1}
+	if got.Type != "summary" || !cmp.Equal(want, counts) {
+		t.Errorf("ExtractOutput() = %s, want a summary report with populations %v", out, want)
+	}
+}
+
+func TestSummaryReportFn_NoReports(t *testing.T) {
+	fn := &summaryReportFn{Measure: []byte(testMeasure)}
+	if err := fn.Setup(); err != nil {
+		t.Fatalf("Setup() returned unexpected error: %v", err)
+	}
+	out, err := fn.ExtractOutput(fn.CreateAccumulator())
+	if err != nil {
+		t.Fatalf("ExtractOutput() returned unexpected error: %v", err)
+	}
+	var got measure.MeasureReport
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", out, err)
+	}
+	if got.Type != "summary" || got.Measure != "https://example.com/Measure/Screening" {
+		t.Errorf("ExtractOutput() = %s, want an empty summary report of the Screening measure", out)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	bq "cloud.google.com/go/bigquery"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/google/cql"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	"github.com/google/cql/result"
+	"github.com/google/cql/result/bigquery"
+	"github.com/google/cql/types"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var (
+	bigQueryRowCount      = beam.NewCounter(counterPrefix, "bigquery_rows")
+	bigQueryRowErrorCount = beam.NewCounter(counterPrefix, "bigquery_row_errors")
+	bigQueryErrorRowCount = beam.NewCounter(counterPrefix, "bigquery_error_rows")
+)
+
+func init() {
+	register.DoFn3x1[context.Context, *cbpb.BeamResult, func(*cbpb.BeamError), error](&BigQueryResultsFn{})
+	register.DoFn2x1[context.Context, *cbpb.BeamError, error](&BigQueryErrorsFn{})
+}
+
+// ParseBigQueryTable splits a BigQuery table in the form project.dataset.table, or the legacy
+// project:dataset.table, into its parts.
+func ParseBigQueryTable(table string) (project, dataset, tableID string, err error) {
+	parts := strings.Split(strings.Replace(table, ":", ".", 1), ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("BigQuery table %q must be in the form project.dataset.table", table)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// BigQueryResultsFn is a DoFn that writes evaluation results to a BigQuery table, with one row per
+// patient and one column per output CQL definition. The schema is derived from the result types
+// of the parsed CQL by the result/bigquery package, and the table is created if it does not exist.
+// Rows are inserted in batches, and the rest of each bundle in FinishBundle.
+type BigQueryResultsFn struct {
+	// CQL are the libraries evaluated by CQLEvalFn.
+	CQL []string
+	// Table is the BigQuery table, see ParseBigQueryTable.
+	Table string
+	// ReturnPrivateDefs and the define filters must match those of CQLEvalFn, so that there is a
+	// column for every output definition.
+	ReturnPrivateDefs   bool
+	IncludeDefines      string
+	IncludeDefinesRegex string
+	ExcludeDefines      string
+	ExcludeDefinesRegex string
+	// Endpoint is the BigQuery API endpoint, the default endpoint if empty.
+	Endpoint string
+	client   *bq.Client
+	mapping  *bigquery.Mapping
+	writer   *bigquery.Writer
+}
+
+// Setup parses the CQL to derive the table schema, and creates the table if needed.
+func (fn *BigQueryResultsFn) Setup(ctx context.Context) error {
+	project, dataset, table, err := ParseBigQueryTable(fn.Table)
+	if err != nil {
+		return err
+	}
+	filter, err := result.ParseDefineFilter(fn.IncludeDefines, fn.IncludeDefinesRegex, fn.ExcludeDefines, fn.ExcludeDefinesRegex)
+	if err != nil {
+		return err
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		return err
+	}
+	elm, err := cql.Parse(ctx, fn.CQL, cql.ParseConfig{DataModels: [][]byte{fhirDM}})
+	if err != nil {
+		return fmt.Errorf("failed to parse CQL to derive the BigQuery schema: %w", err)
+	}
+	resultTypes := make(map[result.LibKey]map[string]types.IType)
+	for lib, defs := range elm.ResultTypes(fn.ReturnPrivateDefs) {
+		for name, t := range defs {
+			if !filter.Keep(lib, name) {
+				continue
+			}
+			if resultTypes[lib] == nil {
+				resultTypes[lib] = make(map[string]types.IType)
+			}
+			resultTypes[lib][name] = t
+		}
+	}
+	fn.mapping, err = bigquery.NewMapping(resultTypes)
+	if err != nil {
+		return err
+	}
+	fn.client, err = newBigQueryClient(ctx, fn.Endpoint, project)
+	if err != nil {
+		return err
+	}
+	fn.writer, err = bigquery.NewWriter(ctx, fn.client.Dataset(dataset).Table(table), fn.mapping, bigquery.WriterConfig{CreateTable: true})
+	return err
+}
+
+// ProcessElement buffers the row of the result. Results that cannot be converted are emitted as
+// BeamErrors, while failed inserts fail the bundle so that it is retried. Rows use the patient ID
+// as insert ID, so BigQuery deduplicates the rows of retried bundles.
+func (fn *BigQueryResultsFn) ProcessElement(ctx context.Context, res *cbpb.BeamResult, emitError func(*cbpb.BeamError)) error {
+	libs, err := result.LibrariesFromProto(res.GetResult())
+	var row *bigquery.Row
+	if err == nil {
+		row, err = fn.mapping.Row(res.GetId(), libs)
+	}
+	if err != nil {
+		bigQueryRowErrorCount.Inc(ctx, 1)
+		emitError(sinkError(err, res))
+		return nil
+	}
+	bigQueryRowCount.Inc(ctx, 1)
+	return fn.writer.WriteRow(ctx, row)
+}
+
+// FinishBundle inserts the buffered rows.
+func (fn *BigQueryResultsFn) FinishBundle(ctx context.Context) error {
+	return fn.writer.Flush(ctx)
+}
+
+// Teardown closes the BigQuery client.
+func (fn *BigQueryResultsFn) Teardown() error {
+	if fn.client == nil {
+		return nil
+	}
+	return fn.client.Close()
+}
+
+// bigQueryError is the row of a BeamError in the BigQuery errors table.
+type bigQueryError struct {
+	ErrorMessage string       `bigquery:"error_message"`
+	Stage        string       `bigquery:"stage"`
+	SourceURI    string       `bigquery:"source_uri"`
+	SourceLine   bq.NullInt64 `bigquery:"source_line"`
+	PatientID    string       `bigquery:"patient_id"`
+	// Error is the JSON of the BeamError, which holds all of its fields.
+	Error string `bigquery:"error"`
+}
+
+// BigQueryErrorsFn is a DoFn that writes BeamErrors to a BigQuery table, which is created if it
+// does not exist. Rows are inserted in batches, and the rest of each bundle in FinishBundle.
+type BigQueryErrorsFn struct {
+	// Table is the BigQuery table, see ParseBigQueryTable.
+	Table string
+	// Endpoint is the BigQuery API endpoint, the default endpoint if empty.
+	Endpoint string
+	client   *bq.Client
+	inserter *bq.Inserter
+	pending  []*bigQueryError
+}
+
+// Setup creates the table if needed.
+func (fn *BigQueryErrorsFn) Setup(ctx context.Context) error {
+	project, dataset, table, err := ParseBigQueryTable(fn.Table)
+	if err != nil {
+		return err
+	}
+	schema, err := bq.InferSchema(bigQueryError{})
+	if err != nil {
+		return err
+	}
+	fn.client, err = newBigQueryClient(ctx, fn.Endpoint, project)
+	if err != nil {
+		return err
+	}
+	t := fn.client.Dataset(dataset).Table(table)
+	err = t.Create(ctx, &bq.TableMetadata{Schema: schema})
+	var apiErr *googleapi.Error
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict) {
+		return fmt.Errorf("failed to create BigQuery table %s: %w", t.FullyQualifiedName(), err)
+	}
+	fn.inserter = t.Inserter()
+	return nil
+}
+
+// ProcessElement buffers the row of the error.
+func (fn *BigQueryErrorsFn) ProcessElement(ctx context.Context, beamErr *cbpb.BeamError) error {
+	j, err := protojson.Marshal(beamErr)
+	if err != nil {
+		return err
+	}
+	fn.pending = append(fn.pending, &bigQueryError{
+		ErrorMessage: beamErr.GetErrorMessage(),
+		Stage:        beamErr.GetStage().String(),
+		SourceURI:    beamErr.GetSourceUri(),
+		SourceLine:   bq.NullInt64{Int64: beamErr.GetSourceLine(), Valid: beamErr.SourceLine != nil},
+		PatientID:    beamErr.GetPatientId(),
+		Error:        string(j),
+	})
+	if len(fn.pending) >= bigquery.DefaultBatchSize {
+		return fn.FinishBundle(ctx)
+	}
+	return nil
+}
+
+// FinishBundle inserts the buffered rows.
+func (fn *BigQueryErrorsFn) FinishBundle(ctx context.Context) error {
+	if len(fn.pending) == 0 {
+		return nil
+	}
+	rows := fn.pending
+	fn.pending = nil
+	if err := fn.inserter.Put(ctx, rows); err != nil {
+		return fmt.Errorf("failed to insert %d errors into BigQuery: %w", len(rows), err)
+	}
+	bigQueryErrorRowCount.Inc(ctx, int64(len(rows)))
+	return nil
+}
+
+// Teardown closes the BigQuery client.
+func (fn *BigQueryErrorsFn) Teardown() error {
+	if fn.client == nil {
+		return nil
+	}
+	return fn.client.Close()
+}
+
+func newBigQueryClient(ctx context.Context, endpoint, project string) (*bq.Client, error) {
+	if endpoint == "" {
+		return bq.NewClient(ctx, project)
+	}
+	// Endpoints other than the default are only used in tests, which have no credentials.
+	return bq.NewClient(ctx, project, option.WithEndpoint(endpoint), option.WithoutAuthentication())
+}
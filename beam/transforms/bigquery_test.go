@@ -0,0 +1,217 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	crpb "github.com/google/cql/protos/cql_result_go_proto"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/lithammer/dedent"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeBigQuery is a server responding to the table creation and insertAll requests of the tests.
+type fakeBigQuery struct {
+	*httptest.Server
+	mu       sync.Mutex
+	created  []map[string]any
+	inserted []map[string]any
+}
+
+func newFakeBigQuery(t *testing.T) *fakeBigQuery {
+	t.Helper()
+	f := &fakeBigQuery{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/projects/project/datasets/dataset/tables"):
+			var table map[string]any
+			if err := json.Unmarshal(body, &table); err != nil {
+				t.Errorf("failed to parse table creation request: %v", err)
+			}
+			f.created = append(f.created, table)
+			w.Write(body)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/insertAll"):
+			var req struct {
+				Rows []struct {
+					JSON map[string]any `json:"json"`
+				} `json:"rows"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				t.Errorf("failed to parse insertAll request: %v", err)
+			}
+			for _, row := range req.Rows {
+				f.inserted = append(f.inserted, row.JSON)
+			}
+			w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestParseBigQueryTable(t *testing.T) {
+	tests := []struct {
+		table       string
+		wantProject string
+		wantDataset string
+		wantTable   string
+		wantErr     bool
+	}{
+		{table: "project.dataset.table", wantProject: "project", wantDataset: "dataset", wantTable: "table"},
+		{table: "project:dataset.table", wantProject: "project", wantDataset: "dataset", wantTable: "table"},
+		{table: "dataset.table", wantErr: true},
+		{table: "project.dataset.", wantErr: true},
+		{table: "a.b.c.d", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.table, func(t *testing.T) {
+			project, dataset, table, err := ParseBigQueryTable(tc.table)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ParseBigQueryTable(%q) succeeded, want error", tc.table)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseBigQueryTable(%q) returned an unexpected error: %v", tc.table, err)
+			}
+			if project != tc.wantProject || dataset != tc.wantDataset || table != tc.wantTable {
+				t.Errorf("ParseBigQueryTable(%q) = %q, %q, %q, want %q, %q, %q", tc.table, project, dataset, table, tc.wantProject, tc.wantDataset, tc.wantTable)
+			}
+		})
+	}
+}
+
+func TestBigQueryResultsFn(t *testing.T) {
+	server := newFakeBigQuery(t)
+	fn := &BigQueryResultsFn{
+		CQL: []string{dedent.Dedent(`
+			library TESTLIB version '1.0.0'
+			define HasDiabetes: true
+			define Name: 'Bob'
+			define Excluded: 4`)},
+		Table:          "project.dataset.results",
+		ExcludeDefines: "Excluded",
+		Endpoint:       server.URL,
+	}
+	if err := fn.Setup(context.Background()); err != nil {
+		t.Fatalf("Setup() returned an unexpected error: %v", err)
+	}
+	defer fn.Teardown()
+
+	newResult := func(id string, name *crpb.Value) *cbpb.BeamResult {
+		return &cbpb.BeamResult{
+			Id: proto.String(id),
+			Result: &crpb.Libraries{
+				Libraries: []*crpb.Library{
+					&crpb.Library{
+						Name:    proto.String("TESTLIB"),
+						Version: proto.String("1.0.0"),
+						ExprDefs: map[string]*crpb.Value{
+							"HasDiabetes": &crpb.Value{Value: &crpb.Value_BooleanValue{BooleanValue: true}},
+							"Name":        name,
+						},
+					},
+				},
+			},
+		}
+	}
+	var gotErrs []*cbpb.BeamError
+	emitError := func(e *cbpb.BeamError) { gotErrs = append(gotErrs, e) }
+	for _, res := range []*cbpb.BeamResult{
+		newResult("1", &crpb.Value{Value: &crpb.Value_StringValue{StringValue: "Bob"}}),
+		newResult("2", &crpb.Value{Value: &crpb.Value_BooleanValue{BooleanValue: false}}),
+	} {
+		if err := fn.ProcessElement(context.Background(), res, emitError); err != nil {
+			t.Fatalf("ProcessElement(%s) returned an unexpected error: %v", res.GetId(), err)
+		}
+	}
+	if err := fn.FinishBundle(context.Background()); err != nil {
+		t.Fatalf("FinishBundle() returned an unexpected error: %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.created) != 1 {
+		t.Fatalf("Setup() created %d tables, want 1", len(server.created))
+	}
+	var gotColumns []string
+	for _, f := range server.created[0]["schema"].(map[string]any)["fields"].([]any) {
+		gotColumns = append(gotColumns, f.(map[string]any)["name"].(string))
+	}
+	if diff := cmp.Diff([]string{"id", "HasDiabetes", "Name"}, gotColumns, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("created table columns diff (-want +got):\n%s", diff)
+	}
+	wantRows := []map[string]any{{"id": "1", "HasDiabetes": true, "Name": "Bob"}}
+	if diff := cmp.Diff(wantRows, server.inserted); diff != "" {
+		t.Errorf("inserted rows diff (-want +got):\n%s", diff)
+	}
+	if len(gotErrs) != 1 || gotErrs[0].GetPatientId() != "2" || gotErrs[0].GetStage() != cbpb.BeamError_WRITE || !strings.Contains(gotErrs[0].GetErrorMessage(), ".Name: ") {
+		t.Errorf("ProcessElement() returned errors %v, want one WRITE error for Name of patient 2", gotErrs)
+	}
+}
+
+func TestBigQueryErrorsFn(t *testing.T) {
+	server := newFakeBigQuery(t)
+	fn := &BigQueryErrorsFn{Table: "project:dataset.errors", Endpoint: server.URL}
+	if err := fn.Setup(context.Background()); err != nil {
+		t.Fatalf("Setup() returned an unexpected error: %v", err)
+	}
+	defer fn.Teardown()
+
+	beamErr := &cbpb.BeamError{
+		ErrorMessage: proto.String("failed to parse bundle"),
+		SourceUri:    proto.String("file:///bundle.json"),
+		Stage:        cbpb.BeamError_PARSE.Enum(),
+	}
+	if err := fn.ProcessElement(context.Background(), beamErr); err != nil {
+		t.Fatalf("ProcessElement() returned an unexpected error: %v", err)
+	}
+	if err := fn.FinishBundle(context.Background()); err != nil {
+		t.Fatalf("FinishBundle() returned an unexpected error: %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.created) != 1 {
+		t.Errorf("Setup() created %d tables, want 1", len(server.created))
+	}
+	if len(server.inserted) != 1 {
+		t.Fatalf("%d rows were inserted, want 1", len(server.inserted))
+	}
+	got := server.inserted[0]
+	if got["error_message"] != "failed to parse bundle" || got["source_uri"] != "file:///bundle.json" || got["stage"] != "PARSE" {
+		t.Errorf("inserted row = %v, want the error message, source uri and stage of %v", got, beamErr)
+	}
+	if !strings.Contains(got["error"].(string), "failed to parse bundle") {
+		t.Errorf("inserted error column = %v, want the JSON of the BeamError", got["error"])
+	}
+}
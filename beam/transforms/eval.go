@@ -16,19 +16,23 @@ package transforms
 
 import (
 	"context"
+	"fmt"
 	"reflect"
+	"slices"
 	"time"
 
-	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
 	"github.com/google/cql"
+	"github.com/google/cql/internal/datehelpers"
 	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
 	"github.com/google/cql/result"
 	"github.com/google/cql/retriever/local"
 	"github.com/google/cql/terminology"
+	d4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
 	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
-	"github.com/apache/beam/sdks/v2/go/pkg/beam"
-	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
 	"google.golang.org/protobuf/proto"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const counterPrefix = "beam_cql"
@@ -38,10 +42,22 @@ var (
 	bundleErrorCount = beam.NewCounter(counterPrefix, "fhir_bundle_read_errors")
 	eventCount       = beam.NewCounter(counterPrefix, "events")
 	errCount         = beam.NewCounter(counterPrefix, "errors")
+
+	// patientCount counts the patients whose CQL was evaluated successfully.
+	patientCount = beam.NewCounter(counterPrefix, "patients")
+	// The stages of CQLEvalFn that can fail. Each failure also increments errCount.
+	retrieverErrorCount = beam.NewCounter(counterPrefix, "retriever_errors")
+	evalErrorCount      = beam.NewCounter(counterPrefix, "eval_errors")
+	resultErrorCount    = beam.NewCounter(counterPrefix, "result_errors")
+	timestampErrorCount = beam.NewCounter(counterPrefix, "evaluation_timestamp_errors")
+	// bundleResourcesDist is the number of resources in each bundle evaluated.
+	bundleResourcesDist = beam.NewDistribution(counterPrefix, "bundle_resources")
+	// evalLatencyDist is the time in milliseconds taken to evaluate the CQL for each bundle.
+	evalLatencyDist = beam.NewDistribution(counterPrefix, "eval_latency_ms")
 )
 
 func init() {
-	register.DoFn4x1[context.Context, *bpb.Bundle, func(*cbpb.BeamResult), func(*cbpb.BeamError), error](&CQLEvalFn{})
+	register.DoFn5x1[context.Context, beam.EventTime, *bpb.Bundle, func(*cbpb.BeamResult), func(*cbpb.BeamError), error](&CQLEvalFn{})
 	beam.RegisterType(reflect.TypeOf((*cbpb.BeamResult)(nil)))
 	beam.RegisterType(reflect.TypeOf((*cbpb.BeamError)(nil)))
 }
@@ -54,50 +70,171 @@ context Patient
 define ID: Patient.id.value
 `
 
+// The sources of the timestamp each bundle is evaluated at, see
+// CQLEvalFn.EvaluationTimestampSource.
+const (
+	// TimestampFixed evaluates every bundle at CQLEvalFn.EvaluationTimestamp.
+	TimestampFixed = "fixed"
+	// TimestampBundle evaluates each bundle at its Bundle.timestamp, or at
+	// CQLEvalFn.EvaluationTimestamp if the bundle has no timestamp.
+	TimestampBundle = "bundle"
+	// TimestampPublishTime evaluates each bundle at the event time of its element, which for
+	// bundles read from Pub/Sub is the publish time of their message.
+	TimestampPublishTime = "publish_time"
+)
+
+// Parameter is a value passed to a CQL parameter definition.
+type Parameter struct {
+	// Key is the library and name of the parameter definition.
+	Key result.DefKey
+	// Value is a CQL literal, in the form accepted by cql.ParseConfig.Parameters.
+	Value string
+}
+
+// ParseCQL parses the CQL libraries, along with the BeamMetadata library, the way CQLEvalFn
+// evaluates them.
+func ParseCQL(ctx context.Context, cqlLibs []string, params []Parameter) (*cql.ELM, error) {
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		return nil, err
+	}
+	config := cql.ParseConfig{DataModels: [][]byte{fhirDM}}
+	if len(params) > 0 {
+		config.Parameters = make(map[result.DefKey]string, len(params))
+		for _, p := range params {
+			config.Parameters[p.Key] = p.Value
+		}
+	}
+	return cql.Parse(ctx, append(slices.Clone(cqlLibs), BeamMetadata), config)
+}
+
 // CQLEvalFn is a DoFn that parses and evaluates CQL.
 type CQLEvalFn struct {
 	// Only exported fields are serialized.
-	CQL                 []string
+	CQL []string
+	// ELM if set is the CQL already parsed by ParseCQL and encoded with cql.ELM.MarshalBinary, which
+	// is decoded instead of parsing CQL on every worker.
+	ELM []byte
+	// Parameters are passed to the CQL when it is parsed on the workers. They are already part of
+	// ELM if it is set.
+	Parameters []Parameter
+	// Terminology if set is the terminology encoded by EncodeTerminology, which is loaded once per
+	// worker process and used instead of ValueSets.
+	Terminology         []byte
 	ValueSets           []string
 	EvaluationTimestamp time.Time
-	ReturnPrivateDefs   bool
-	elm                 *cql.ELM
-	terminology         terminology.Provider
+	// EvaluationTimestampSource is where the timestamp of each bundle is taken from, one of
+	// TimestampFixed, TimestampBundle or TimestampPublishTime. Empty is TimestampFixed.
+	EvaluationTimestampSource string
+	ReturnPrivateDefs         bool
+	// IncludeDefines, IncludeDefinesRegex, ExcludeDefines and ExcludeDefinesRegex select the
+	// expression definitions that are output, in the form accepted by result.ParseDefineFilter.
+	IncludeDefines      string
+	IncludeDefinesRegex string
+	ExcludeDefines      string
+	ExcludeDefinesRegex string
+	// LibrarySet if set is the name of the set of libraries being evaluated, which the results and
+	// errors are tagged with when a pipeline evaluates several independent sets.
+	LibrarySet string
+	// MaxBundleResources and MaxBundleBytes if set are the largest bundle that is evaluated, by its
+	// number of resources and encoded size. Larger bundles are emitted as errors instead, so that a
+	// pathological patient can not exhaust the memory of a worker.
+	MaxBundleResources int
+	MaxBundleBytes     int64
+	// MaxConcurrentEvals if set limits the number of bundles evaluated at once by all CQLEvalFns in
+	// a worker process.
+	MaxConcurrentEvals int
+
+	elm          *cql.ELM
+	terminology  terminology.Provider
+	evalSlots    chan struct{}
+	defineFilter result.DefineFilter
 }
 
-// Setup parses the CQL and initializes the terminology provider.
+// Setup decodes or parses the CQL and initializes the terminology provider.
 func (fn *CQLEvalFn) Setup() error {
 	var err error
-	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if len(fn.ELM) > 0 {
+		fn.elm = &cql.ELM{}
+		err = fn.elm.UnmarshalBinary(fn.ELM)
+	} else {
+		fn.elm, err = ParseCQL(context.Background(), fn.CQL, fn.Parameters)
+	}
 	if err != nil {
 		return err
 	}
-	fn.elm, err = cql.Parse(context.Background(), append(fn.CQL, BeamMetadata), cql.ParseConfig{DataModels: [][]byte{fhirDM}})
+	if fn.MaxConcurrentEvals > 0 {
+		fn.evalSlots = evalSemaphore(fn.MaxConcurrentEvals)
+	}
+	switch fn.EvaluationTimestampSource {
+	case "", TimestampFixed, TimestampBundle, TimestampPublishTime:
+	default:
+		return fmt.Errorf("invalid evaluation timestamp source %q", fn.EvaluationTimestampSource)
+	}
+	fn.defineFilter, err = result.ParseDefineFilter(fn.IncludeDefines, fn.IncludeDefinesRegex, fn.ExcludeDefines, fn.ExcludeDefinesRegex)
 	if err != nil {
 		return err
 	}
-	fn.terminology, err = terminology.NewInMemoryFHIRProvider(fn.ValueSets)
+	if len(fn.Terminology) > 0 {
+		fn.terminology, err = loadTerminology(fn.Terminology)
+	} else {
+		fn.terminology, err = terminology.NewInMemoryFHIRProvider(fn.ValueSets)
+	}
 	return err
 }
 
-func (fn *CQLEvalFn) ProcessElement(ctx context.Context, bundle *bpb.Bundle, emit func(*cbpb.BeamResult), emitError func(*cbpb.BeamError)) error {
+func (fn *CQLEvalFn) ProcessElement(ctx context.Context, et beam.EventTime, bundle *bpb.Bundle, emit func(*cbpb.BeamResult), emitError func(*cbpb.BeamError)) error {
+	bundleCount.Inc(ctx, 1)
+	bundleResourcesDist.Update(ctx, int64(len(bundle.GetEntry())))
+	emitErr := func(err error, stage cbpb.BeamError_Stage) {
+		beamErr := bundleError(err, stage, bundle)
+		if fn.LibrarySet != "" {
+			beamErr.LibrarySet = proto.String(fn.LibrarySet)
+		}
+		emitError(beamErr)
+	}
+
+	if err := checkBundleSize(bundle, fn.MaxBundleResources, fn.MaxBundleBytes); err != nil {
+		// The bundle is rejected as input, the CQL is never evaluated against it.
+		oversizedBundleCount.Inc(ctx, 1)
+		errCount.Inc(ctx, 1)
+		emitErr(err, cbpb.BeamError_PARSE)
+		return nil
+	}
+
 	retriever, err := local.NewRetrieverFromR4BundleProto(bundle)
 	if err != nil {
+		retrieverErrorCount.Inc(ctx, 1)
 		errCount.Inc(ctx, 1)
-		emitError(&cbpb.BeamError{
-			ErrorMessage: proto.String(err.Error()),
-			SourceUri:    proto.String(sourceURI(bundle)),
-		})
+		emitErr(err, cbpb.BeamError_PARSE)
 		return err
 	}
 
-	res, err := fn.elm.Eval(ctx, retriever, cql.EvalConfig{Terminology: fn.terminology, EvaluationTimestamp: fn.EvaluationTimestamp, ReturnPrivateDefs: fn.ReturnPrivateDefs})
+	evalTimestamp, err := fn.evaluationTimestamp(et, bundle)
+	if err != nil {
+		timestampErrorCount.Inc(ctx, 1)
+		errCount.Inc(ctx, 1)
+		emitErr(err, cbpb.BeamError_PARSE)
+		return nil
+	}
+
+	if fn.evalSlots != nil {
+		select {
+		case fn.evalSlots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	start := time.Now()
+	res, err := fn.elm.Eval(ctx, retriever, cql.EvalConfig{Terminology: fn.terminology, EvaluationTimestamp: evalTimestamp, ReturnPrivateDefs: fn.ReturnPrivateDefs})
+	evalLatencyDist.Update(ctx, time.Since(start).Milliseconds())
+	if fn.evalSlots != nil {
+		<-fn.evalSlots
+	}
 	if err != nil {
+		evalErrorCount.Inc(ctx, 1)
 		errCount.Inc(ctx, 1)
-		emitError(&cbpb.BeamError{
-			ErrorMessage: proto.String(err.Error()),
-			SourceUri:    proto.String(sourceURI(bundle)),
-		})
+		emitErr(err, cbpb.BeamError_EVAL)
 		return nil
 	}
 
@@ -106,34 +243,76 @@ func (fn *CQLEvalFn) ProcessElement(ctx context.Context, bundle *bpb.Bundle, emi
 	if !result.IsNull(p) {
 		patientID, err = result.ToString(p)
 		if err != nil {
+			resultErrorCount.Inc(ctx, 1)
 			errCount.Inc(ctx, 1)
-			emitError(&cbpb.BeamError{
-				ErrorMessage: proto.String(err.Error()),
-				SourceUri:    proto.String(sourceURI(bundle)),
-			})
+			emitErr(err, cbpb.BeamError_EVAL)
 			return nil
 		}
 	}
 
-	pbResult, err := res.Proto()
+	// The filter is applied after reading the ID, since it may drop the BeamMetadata library.
+	pbResult, err := res.Filter(fn.defineFilter).Proto()
 	if err != nil {
+		resultErrorCount.Inc(ctx, 1)
 		errCount.Inc(ctx, 1)
-		emitError(&cbpb.BeamError{
-			ErrorMessage: proto.String(err.Error()),
-			SourceUri:    proto.String(sourceURI(bundle)),
-		})
+		emitErr(err, cbpb.BeamError_EVAL)
 		return nil
 	}
 
 	evalRes := &cbpb.BeamResult{
 		Id:                  proto.String(patientID),
-		EvaluationTimestamp: timestamppb.New(fn.EvaluationTimestamp),
+		EvaluationTimestamp: timestamppb.New(evalTimestamp),
 		Result:              pbResult,
 	}
+	if fn.LibrarySet != "" {
+		evalRes.LibrarySet = proto.String(fn.LibrarySet)
+	}
+	patientCount.Inc(ctx, 1)
 	emit(evalRes)
 	return nil
 }
 
+// evaluationTimestamp returns the timestamp to evaluate the bundle at, according to
+// EvaluationTimestampSource.
+func (fn *CQLEvalFn) evaluationTimestamp(et beam.EventTime, bundle *bpb.Bundle) (time.Time, error) {
+	switch fn.EvaluationTimestampSource {
+	case TimestampBundle:
+		ts := bundle.GetTimestamp()
+		if ts == nil {
+			return fn.EvaluationTimestamp, nil
+		}
+		tz := ts.GetTimezone()
+		if tz == "Z" {
+			tz = "UTC"
+		}
+		t, _, err := datehelpers.ParseFHIRDateTime(&d4pb.DateTime{ValueUs: ts.GetValueUs(), Timezone: tz}, time.UTC)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid Bundle.timestamp: %w", err)
+		}
+		return t, nil
+	case TimestampPublishTime:
+		return et.ToTime().UTC(), nil
+	}
+	return fn.EvaluationTimestamp, nil
+}
+
+// bundleError returns a BeamError for an error processing the bundle, referencing the bundle and
+// its patient so that the failed bundles can be found and replayed.
+func bundleError(err error, stage cbpb.BeamError_Stage, bundle *bpb.Bundle) *cbpb.BeamError {
+	beamErr := &cbpb.BeamError{
+		ErrorMessage: proto.String(err.Error()),
+		SourceUri:    proto.String(sourceURI(bundle)),
+		Stage:        stage.Enum(),
+	}
+	for _, e := range bundle.GetEntry() {
+		if id := e.GetResource().GetPatient().GetId().GetValue(); id != "" {
+			beamErr.PatientId = proto.String(id)
+			break
+		}
+	}
+	return beamErr
+}
+
 func sourceURI(bundle *bpb.Bundle) string {
 	// TODO(b/317813865): Fall back to different source identifiers like the first patient id
 	// if the bundle has no id.
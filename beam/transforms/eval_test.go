@@ -20,8 +20,10 @@ import (
 	"time"
 
 	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/mtime"
 	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
 	crpb "github.com/google/cql/protos/cql_result_go_proto"
+	"github.com/google/cql/result"
 	"github.com/google/fhir/go/fhirversion"
 	"github.com/google/fhir/go/jsonformat"
 	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
@@ -125,6 +127,53 @@ func TestCQLEvalFn(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "Define filters",
+			evalFn: &CQLEvalFn{
+				CQL: []string{dedent.Dedent(
+					`library EvalTest version '1.0'
+					using FHIR version '4.0.1'
+					valueset "HypertensionVS": 'urn:example:hypertension'
+					valueset "DiabetesVS": 'urn:example:diabetes'
+					define HasHypertension: exists([Condition: "HypertensionVS"])
+					define HasDiabetes: exists([Condition: "DiabetesVS"])`)},
+				ValueSets:           valueSets,
+				EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+				IncludeDefinesRegex: "^Has",
+				ExcludeDefines:      "EvalTest.HasDiabetes",
+			},
+			input: parseOrFatal(t, `{
+				"resourceType": "Bundle",
+				"entry": [
+					{
+						"resource": {
+							"resourceType": "Patient",
+							"id": "1"
+						}
+					}
+				 ]
+			}`).GetBundle(),
+			wantResult: []*cbpb.BeamResult{
+				&cbpb.BeamResult{
+					// The ID is read before BeamMetadata is filtered out.
+					Id:                  proto.String("1"),
+					EvaluationTimestamp: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+					Result: &crpb.Libraries{
+						Libraries: []*crpb.Library{
+							&crpb.Library{
+								Name:    proto.String("EvalTest"),
+								Version: proto.String("1.0"),
+								ExprDefs: map[string]*crpb.Value{
+									"HasHypertension": &crpb.Value{
+										Value: &crpb.Value_BooleanValue{BooleanValue: false},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "EvalError from Bad ValueSet",
 			evalFn: &CQLEvalFn{
@@ -162,6 +211,8 @@ func TestCQLEvalFn(t *testing.T) {
 				&cbpb.BeamError{
 					ErrorMessage: proto.String("failed during CQL evaluation: EvalTest 1.0, could not find ValueSet{urn:example:nosuchvalueset, } resource not loaded"),
 					SourceUri:    proto.String("bundle:bundle1"),
+					Stage:        cbpb.BeamError_EVAL.Enum(),
+					PatientId:    proto.String("1"),
 				},
 			},
 		},
@@ -176,7 +227,7 @@ func TestCQLEvalFn(t *testing.T) {
 			if err := test.evalFn.Setup(); err != nil {
 				t.Fatalf("Setup() failed: %v", err)
 			}
-			test.evalFn.ProcessElement(context.Background(), test.input, emitOutput, emitError)
+			test.evalFn.ProcessElement(context.Background(), mtime.ZeroTimestamp, test.input, emitOutput, emitError)
 
 			if diff := cmp.Diff(test.wantResult, gotOutput, protocmp.Transform(), protocmp.SortRepeatedFields(&crpb.Libraries{}, "libraries")); diff != "" {
 				t.Errorf("ProcessElement() returned diff (-want +got):\n%s", diff)
@@ -188,6 +239,164 @@ func TestCQLEvalFn(t *testing.T) {
 	}
 }
 
+func TestCQLEvalFn_ParsedELM(t *testing.T) {
+	elm, err := ParseCQL(context.Background(), []string{dedent.Dedent(
+		`library EvalTest version '1.0'
+		using FHIR version '4.0.1'
+		valueset "HypertensionVS": 'urn:example:hypertension'
+		parameter Threshold Integer
+		define HasHypertension: exists([Condition: "HypertensionVS"])`)},
+		[]Parameter{{Key: result.DefKey{Name: "Threshold", Library: result.LibKey{Name: "EvalTest", Version: "1.0"}}, Value: "2"}})
+	if err != nil {
+		t.Fatalf("ParseCQL() failed: %v", err)
+	}
+	encoded, err := elm.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	fn := &CQLEvalFn{
+		ELM:                 encoded,
+		ValueSets:           valueSets,
+		EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		IncludeDefines:      "HasHypertension,Threshold",
+	}
+	input := parseOrFatal(t, `{
+		"resourceType": "Bundle",
+		"entry": [
+			{"resource": {"resourceType": "Patient", "id": "1"}},
+			{"resource": {"resourceType": "Condition", "id": "1", "code": {"coding": [{"system": "http://example.com", "code": "11111"}]}}}
+		]
+	}`).GetBundle()
+	want := []*cbpb.BeamResult{
+		&cbpb.BeamResult{
+			Id:                  proto.String("1"),
+			EvaluationTimestamp: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+			Result: &crpb.Libraries{
+				Libraries: []*crpb.Library{
+					&crpb.Library{
+						Name:    proto.String("EvalTest"),
+						Version: proto.String("1.0"),
+						ExprDefs: map[string]*crpb.Value{
+							"HasHypertension": &crpb.Value{
+								Value: &crpb.Value_BooleanValue{BooleanValue: true},
+							},
+							"Threshold": &crpb.Value{
+								Value: &crpb.Value_IntegerValue{IntegerValue: 2},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var got []*cbpb.BeamResult
+	var gotErrors []*cbpb.BeamError
+	if err := fn.Setup(); err != nil {
+		t.Fatalf("Setup() failed: %v", err)
+	}
+	fn.ProcessElement(context.Background(), mtime.ZeroTimestamp, input,
+		func(r *cbpb.BeamResult) { got = append(got, r) },
+		func(e *cbpb.BeamError) { gotErrors = append(gotErrors, e) })
+
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("ProcessElement() returned diff (-want +got):\n%s", diff)
+	}
+	if len(gotErrors) > 0 {
+		t.Errorf("ProcessElement() returned unexpected errors: %v", gotErrors)
+	}
+}
+
+func TestCQLEvalFn_EvaluationTimestampSource(t *testing.T) {
+	fixed := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+	publishTime := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	withTimestamp := `{
+		"resourceType": "Bundle",
+		"timestamp": "2022-03-04T05:06:07Z",
+		"entry": [{"resource": {"resourceType": "Patient", "id": "1"}}]
+	}`
+	withoutTimestamp := `{
+		"resourceType": "Bundle",
+		"entry": [{"resource": {"resourceType": "Patient", "id": "1"}}]
+	}`
+	tests := []struct {
+		name   string
+		source string
+		input  string
+		want   time.Time
+	}{
+		{
+			name:  "Default",
+			input: withTimestamp,
+			want:  fixed,
+		},
+		{
+			name:   "Fixed",
+			source: TimestampFixed,
+			input:  withTimestamp,
+			want:   fixed,
+		},
+		{
+			name:   "Bundle",
+			source: TimestampBundle,
+			input:  withTimestamp,
+			want:   time.Date(2022, time.March, 4, 5, 6, 7, 0, time.UTC),
+		},
+		{
+			name:   "Bundle without timestamp",
+			source: TimestampBundle,
+			input:  withoutTimestamp,
+			want:   fixed,
+		},
+		{
+			name:   "Publish time",
+			source: TimestampPublishTime,
+			input:  withTimestamp,
+			want:   publishTime,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := &CQLEvalFn{
+				CQL: []string{dedent.Dedent(
+					`library EvalTest version '1.0'
+					using FHIR version '4.0.1'
+					define After2022: Now() >= @2022-01-01T00:00:00.000Z`)},
+				EvaluationTimestamp:       fixed,
+				EvaluationTimestampSource: tc.source,
+				IncludeDefines:            "After2022",
+			}
+			if err := fn.Setup(); err != nil {
+				t.Fatalf("Setup() failed: %v", err)
+			}
+			var got []*cbpb.BeamResult
+			fn.ProcessElement(context.Background(), mtime.FromTime(publishTime), parseOrFatal(t, tc.input).GetBundle(),
+				func(r *cbpb.BeamResult) { got = append(got, r) },
+				func(e *cbpb.BeamError) { t.Errorf("ProcessElement() returned unexpected error: %v", e) })
+			if len(got) != 1 {
+				t.Fatalf("ProcessElement() emitted %d results, want 1", len(got))
+			}
+			if !got[0].GetEvaluationTimestamp().AsTime().Equal(tc.want) {
+				t.Errorf("ProcessElement() evaluation timestamp = %v, want %v", got[0].GetEvaluationTimestamp().AsTime(), tc.want)
+			}
+			after := got[0].GetResult().GetLibraries()[0].GetExprDefs()["After2022"].GetBooleanValue()
+			if want := tc.want.Year() >= 2022; after != want {
+				t.Errorf("ProcessElement() evaluated Now() >= @2022-01-01 = %v, want %v", after, want)
+			}
+		})
+	}
+}
+
+func TestCQLEvalFn_InvalidEvaluationTimestampSource(t *testing.T) {
+	fn := &CQLEvalFn{
+		CQL:                       []string{"library EvalTest version '1.0'"},
+		EvaluationTimestampSource: "message",
+	}
+	if err := fn.Setup(); err == nil {
+		t.Errorf("Setup() with evaluation timestamp source %q succeeded, want error", fn.EvaluationTimestampSource)
+	}
+}
+
 var valueSets = []string{
 	`{
 		"resourceType": "ValueSet",
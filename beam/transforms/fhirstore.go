@@ -0,0 +1,258 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultHealthcareEndpoint is the Cloud Healthcare API endpoint used when reading from a FHIR
+// store.
+const DefaultHealthcareEndpoint = "https://healthcare.googleapis.com/"
+
+// Ways of fetching the resources of a patient from a FHIR store.
+const (
+	// FHIRStoreEverything fetches all resources of a patient with Patient/{id}/$everything.
+	FHIRStoreEverything = "everything"
+	// FHIRStoreCompartment fetches the patient with Patient/{id}, and then only the resource types
+	// in FHIRStoreBundleFn.ResourceTypes with compartment searches Patient/{id}/{type}.
+	FHIRStoreCompartment = "compartment"
+)
+
+// patientSearchPageSize is the number of patient ids requested per page of the Patient search.
+const patientSearchPageSize = 1000
+
+var fhirStoreNameRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/datasets/[^/]+/fhirStores/[^/]+$`)
+
+var (
+	fhirStorePatientCount = beam.NewCounter(counterPrefix, "fhir_store_patients")
+	fhirStoreErrorCount   = beam.NewCounter(counterPrefix, "fhir_store_read_errors")
+)
+
+func init() {
+	register.DoFn4x0[context.Context, []byte, func(string), func(*cbpb.BeamError)](&FHIRStorePatientsFn{})
+	register.DoFn4x0[context.Context, string, func(*bpb.Bundle), func(*cbpb.BeamError)](&FHIRStoreBundleFn{})
+	beam.RegisterType(reflect.TypeOf((*bpb.Bundle)(nil)))
+}
+
+// ValidateFHIRStoreName returns an error if name is not the resource name of a FHIR store, in the
+// form projects/{project}/locations/{location}/datasets/{dataset}/fhirStores/{fhirStore}.
+func ValidateFHIRStoreName(name string) error {
+	if !fhirStoreNameRegex.MatchString(name) {
+		return fmt.Errorf("FHIR store %q must be in the form projects/{project}/locations/{location}/datasets/{dataset}/fhirStores/{fhirStore}", name)
+	}
+	return nil
+}
+
+// FHIRStorePatientsFn is a DoFn that emits the id of every patient in a Cloud Healthcare FHIR
+// store, by paging through a Patient search. It is applied to a beam.Impulse.
+type FHIRStorePatientsFn struct {
+	// FHIRStore is the resource name of the FHIR store, see ValidateFHIRStoreName.
+	FHIRStore string
+	// Endpoint is the Cloud Healthcare API endpoint, DefaultHealthcareEndpoint if empty.
+	Endpoint string
+	client   *fhirStoreClient
+}
+
+// Setup creates the FHIR store client.
+func (fn *FHIRStorePatientsFn) Setup(ctx context.Context) error {
+	var err error
+	fn.client, err = newFHIRStoreClient(ctx, fn.Endpoint, fn.FHIRStore)
+	return err
+}
+
+// ProcessElement emits the patient ids. Errors are emitted as BeamErrors rather than failing the
+// pipeline, but end the patient search.
+func (fn *FHIRStorePatientsFn) ProcessElement(ctx context.Context, _ []byte, emitID func(string), emitError func(*cbpb.BeamError)) {
+	query := url.Values{"_elements": {"id"}, "_count": {fmt.Sprint(patientSearchPageSize)}}
+	err := fn.client.search(ctx, "Patient?"+query.Encode(), func(e *bpb.Bundle_Entry) {
+		if id := e.GetResource().GetPatient().GetId().GetValue(); id != "" {
+			fhirStorePatientCount.Inc(ctx, 1)
+			emitID(id)
+		}
+	})
+	if err != nil {
+		fhirStoreErrorCount.Inc(ctx, 1)
+		emitError(&cbpb.BeamError{
+			ErrorMessage: proto.String(err.Error()),
+			SourceUri:    proto.String(fn.FHIRStore),
+			Stage:        cbpb.BeamError_LOAD.Enum(),
+		})
+	}
+}
+
+// FHIRStoreBundleFn is a DoFn that fetches the resources of each patient id from a Cloud Healthcare
+// FHIR store, and emits them as a bundle with the patient id as its id.
+type FHIRStoreBundleFn struct {
+	// FHIRStore is the resource name of the FHIR store, see ValidateFHIRStoreName.
+	FHIRStore string
+	// Endpoint is the Cloud Healthcare API endpoint, DefaultHealthcareEndpoint if empty.
+	Endpoint string
+	// Query is FHIRStoreEverything or FHIRStoreCompartment, FHIRStoreEverything if empty.
+	Query string
+	// ResourceTypes are the resource types fetched by FHIRStoreCompartment queries, other than
+	// Patient which is always fetched.
+	ResourceTypes []string
+	client        *fhirStoreClient
+}
+
+// Setup creates the FHIR store client.
+func (fn *FHIRStoreBundleFn) Setup(ctx context.Context) error {
+	if fn.Query != "" && fn.Query != FHIRStoreEverything && fn.Query != FHIRStoreCompartment {
+		return fmt.Errorf("unsupported FHIR store query %q, want %s or %s", fn.Query, FHIRStoreEverything, FHIRStoreCompartment)
+	}
+	var err error
+	fn.client, err = newFHIRStoreClient(ctx, fn.Endpoint, fn.FHIRStore)
+	return err
+}
+
+// ProcessElement emits the bundle of the patient, or a BeamError if any request fails.
+func (fn *FHIRStoreBundleFn) ProcessElement(ctx context.Context, patientID string, emitBundle func(*bpb.Bundle), emitError func(*cbpb.BeamError)) {
+	patient := "Patient/" + url.PathEscape(patientID)
+	bundle := &bpb.Bundle{Id: &dtpb.Id{Value: patientID}}
+	addEntry := func(e *bpb.Bundle_Entry) {
+		bundle.Entry = append(bundle.Entry, &bpb.Bundle_Entry{Resource: e.GetResource()})
+	}
+
+	var err error
+	if fn.Query == FHIRStoreCompartment {
+		err = fn.client.search(ctx, patient, addEntry)
+		for _, t := range fn.ResourceTypes {
+			if err != nil {
+				break
+			}
+			if t == "Patient" {
+				continue
+			}
+			err = fn.client.search(ctx, patient+"/"+t, addEntry)
+		}
+	} else {
+		err = fn.client.search(ctx, patient+"/$everything", addEntry)
+	}
+	if err != nil {
+		fhirStoreErrorCount.Inc(ctx, 1)
+		emitError(&cbpb.BeamError{
+			ErrorMessage: proto.String(err.Error()),
+			SourceUri:    proto.String(fn.FHIRStore + "/fhir/" + patient),
+			Stage:        cbpb.BeamError_LOAD.Enum(),
+			PatientId:    proto.String(patientID),
+		})
+		return
+	}
+	emitBundle(bundle)
+}
+
+// fhirStoreClient makes FHIR requests against a Cloud Healthcare FHIR store.
+type fhirStoreClient struct {
+	http         *http.Client
+	base         string
+	unmarshaller *jsonformat.Unmarshaller
+}
+
+func newFHIRStoreClient(ctx context.Context, endpoint, fhirStore string) (*fhirStoreClient, error) {
+	if err := ValidateFHIRStoreName(fhirStore); err != nil {
+		return nil, err
+	}
+	if endpoint == "" {
+		endpoint = DefaultHealthcareEndpoint
+	}
+	var client *http.Client
+	if endpoint == DefaultHealthcareEndpoint {
+		var err error
+		client, _, err = htransport.NewClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Endpoints other than the default are only used in tests, which have no credentials.
+		client = &http.Client{}
+	}
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	return &fhirStoreClient{
+		http:         client,
+		base:         strings.TrimSuffix(endpoint, "/") + "/v1/" + fhirStore + "/fhir/",
+		unmarshaller: unmarshaller,
+	}, nil
+}
+
+// search requests path, relative to the FHIR base of the store, and calls emit for every entry of
+// the returned resource. Searchset bundles are paged through by following their next links, while
+// any other resource is emitted as a single entry.
+func (c *fhirStoreClient) search(ctx context.Context, path string, emit func(*bpb.Bundle_Entry)) error {
+	next := c.base + path
+	for next != "" {
+		res, err := c.get(ctx, next)
+		if err != nil {
+			return err
+		}
+		b := res.GetBundle()
+		if b == nil {
+			emit(&bpb.Bundle_Entry{Resource: res})
+			return nil
+		}
+		for _, e := range b.GetEntry() {
+			emit(e)
+		}
+		next = ""
+		for _, l := range b.GetLink() {
+			if l.GetRelation().GetValue() == "next" {
+				next = l.GetUrl().GetValue()
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fhirStoreClient) get(ctx context.Context, url string) (*bpb.ContainedResource, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/fhir+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("FHIR store request %s failed with status %s: %s", url, resp.Status, body)
+	}
+	return c.unmarshaller.UnmarshalR4(body)
+}
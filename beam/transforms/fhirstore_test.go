@@ -0,0 +1,197 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/cql/internal/resourcewrapper"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testFHIRStore = "projects/p/locations/l/datasets/d/fhirStores/s"
+
+// newFakeFHIRStore returns a server responding to the FHIR store requests of the tests. Requests
+// for Patient/2 fail.
+func newFakeFHIRStore(t *testing.T) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	base := "/v1/" + testFHIRStore + "/fhir/"
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, base)
+		var body string
+		switch {
+		case path == "Patient" && r.URL.Query().Get("page") == "":
+			if got := r.URL.Query().Get("_elements"); got != "id" {
+				t.Errorf("Patient search _elements = %q, want id", got)
+			}
+			body = `{"resourceType": "Bundle", "type": "searchset",
+				"link": [{"relation": "next", "url": "` + server.URL + base + `Patient?page=2"}],
+				"entry": [{"resource": {"resourceType": "Patient", "id": "1"}}]}`
+		case path == "Patient":
+			body = `{"resourceType": "Bundle", "type": "searchset",
+				"entry": [{"resource": {"resourceType": "Patient", "id": "2"}}]}`
+		case path == "Patient/1/$everything":
+			body = `{"resourceType": "Bundle", "type": "searchset", "entry": [
+				{"resource": {"resourceType": "Patient", "id": "1"}},
+				{"resource": {"resourceType": "Condition", "id": "c1", "subject": {"reference": "Patient/1"}}},
+				{"resource": {"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "bp"}}}]}`
+		case path == "Patient/1":
+			body = `{"resourceType": "Patient", "id": "1"}`
+		case path == "Patient/1/Condition":
+			body = `{"resourceType": "Bundle", "type": "searchset", "entry": [
+				{"resource": {"resourceType": "Condition", "id": "c1", "subject": {"reference": "Patient/1"}}}]}`
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFHIRStorePatientsFn(t *testing.T) {
+	server := newFakeFHIRStore(t)
+	fn := &FHIRStorePatientsFn{FHIRStore: testFHIRStore, Endpoint: server.URL}
+	if err := fn.Setup(context.Background()); err != nil {
+		t.Fatalf("Setup() returned an unexpected error: %v", err)
+	}
+
+	var gotIDs []string
+	var gotErrs []*cbpb.BeamError
+	fn.ProcessElement(context.Background(), nil,
+		func(id string) { gotIDs = append(gotIDs, id) },
+		func(e *cbpb.BeamError) { gotErrs = append(gotErrs, e) })
+
+	if diff := cmp.Diff([]string{"1", "2"}, gotIDs); diff != "" {
+		t.Errorf("ProcessElement() patient ids diff (-want +got):\n%s", diff)
+	}
+	if len(gotErrs) > 0 {
+		t.Errorf("ProcessElement() returned unexpected errors: %v", gotErrs)
+	}
+}
+
+func TestFHIRStoreBundleFn(t *testing.T) {
+	server := newFakeFHIRStore(t)
+	tests := []struct {
+		name          string
+		fn            *FHIRStoreBundleFn
+		patientID     string
+		wantResources []string
+		wantError     string
+	}{
+		{
+			name:          "Everything",
+			fn:            &FHIRStoreBundleFn{FHIRStore: testFHIRStore, Endpoint: server.URL},
+			patientID:     "1",
+			wantResources: []string{"Patient/1", "Condition/c1", "Observation/o1"},
+		},
+		{
+			name: "Compartment",
+			fn: &FHIRStoreBundleFn{
+				FHIRStore:     testFHIRStore,
+				Endpoint:      server.URL,
+				Query:         FHIRStoreCompartment,
+				ResourceTypes: []string{"Condition", "Patient"},
+			},
+			patientID:     "1",
+			wantResources: []string{"Patient/1", "Condition/c1"},
+		},
+		{
+			name:      "Request fails",
+			fn:        &FHIRStoreBundleFn{FHIRStore: testFHIRStore, Endpoint: server.URL},
+			patientID: "2",
+			wantError: "404 Not Found",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.fn.Setup(context.Background()); err != nil {
+				t.Fatalf("Setup() returned an unexpected error: %v", err)
+			}
+			var gotBundles []*bpb.Bundle
+			var gotErrs []*cbpb.BeamError
+			tc.fn.ProcessElement(context.Background(), tc.patientID,
+				func(b *bpb.Bundle) { gotBundles = append(gotBundles, b) },
+				func(e *cbpb.BeamError) { gotErrs = append(gotErrs, e) })
+
+			if tc.wantError != "" {
+				if len(gotErrs) != 1 || !strings.Contains(gotErrs[0].GetErrorMessage(), tc.wantError) {
+					t.Fatalf("ProcessElement() returned errors %v, want one containing %q", gotErrs, tc.wantError)
+				}
+				if want := testFHIRStore + "/fhir/Patient/" + tc.patientID; gotErrs[0].GetSourceUri() != want {
+					t.Errorf("ProcessElement() error source = %q, want %q", gotErrs[0].GetSourceUri(), want)
+				}
+				return
+			}
+			if len(gotErrs) > 0 {
+				t.Fatalf("ProcessElement() returned unexpected errors: %v", gotErrs)
+			}
+			if len(gotBundles) != 1 {
+				t.Fatalf("ProcessElement() emitted %d bundles, want 1", len(gotBundles))
+			}
+			if got := gotBundles[0].GetId().GetValue(); got != tc.patientID {
+				t.Errorf("ProcessElement() bundle id = %q, want %q", got, tc.patientID)
+			}
+			var gotResources []string
+			for _, e := range gotBundles[0].GetEntry() {
+				rw := resourcewrapper.New(e.GetResource())
+				rt, err := rw.ResourceType()
+				if err != nil {
+					t.Fatal(err)
+				}
+				id, err := rw.ResourceID()
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotResources = append(gotResources, rt+"/"+id)
+			}
+			if diff := cmp.Diff(tc.wantResources, gotResources); diff != "" {
+				t.Errorf("ProcessElement() bundle resources diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFHIRStoreSetup_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   interface{ Setup(context.Context) error }
+	}{
+		{
+			name: "Invalid FHIR store name",
+			fn:   &FHIRStorePatientsFn{FHIRStore: "projects/p/fhirStores/s", Endpoint: "http://localhost"},
+		},
+		{
+			name: "Invalid query",
+			fn:   &FHIRStoreBundleFn{FHIRStore: testFHIRStore, Endpoint: "http://localhost", Query: "all"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.fn.Setup(context.Background()); err == nil {
+				t.Errorf("Setup() succeeded, want error")
+			}
+		})
+	}
+}
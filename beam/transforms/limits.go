@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+var oversizedBundleCount = beam.NewCounter(counterPrefix, "oversized_bundles")
+
+// evalSemaphores holds the semaphores limiting the CQL evaluations running at once in this worker
+// process, keyed by the limit. Every CQLEvalFn instance in the process with the same limit shares
+// the semaphore, since the runner may run many DoFn instances in parallel on one worker.
+var evalSemaphores = struct {
+	sync.Mutex
+	sems map[int]chan struct{}
+}{sems: make(map[int]chan struct{})}
+
+// evalSemaphore returns the process wide semaphore allowing limit evaluations at once.
+func evalSemaphore(limit int) chan struct{} {
+	evalSemaphores.Lock()
+	defer evalSemaphores.Unlock()
+	sem, ok := evalSemaphores.sems[limit]
+	if !ok {
+		sem = make(chan struct{}, limit)
+		evalSemaphores.sems[limit] = sem
+	}
+	return sem
+}
+
+// checkBundleSize returns an error if the bundle has more than maxResources resources or is larger
+// than maxBytes when encoded. Limits of zero are not checked.
+func checkBundleSize(bundle *bpb.Bundle, maxResources int, maxBytes int64) error {
+	if maxResources > 0 && len(bundle.GetEntry()) > maxResources {
+		return fmt.Errorf("bundle has %d resources, more than the maximum of %d", len(bundle.GetEntry()), maxResources)
+	}
+	if maxBytes > 0 {
+		if size := int64(proto.Size(bundle)); size > maxBytes {
+			return fmt.Errorf("bundle is %d bytes, more than the maximum of %d", size, maxBytes)
+		}
+	}
+	return nil
+}
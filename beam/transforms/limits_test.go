@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/mtime"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"github.com/lithammer/dedent"
+)
+
+func TestCheckBundleSize(t *testing.T) {
+	bundle := testBundle(t, `{"resourceType": "Bundle", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "1"}},
+		{"resource": {"resourceType": "Condition", "id": "c1", "subject": {"reference": "Patient/1"}}}
+	]}`)
+	tests := []struct {
+		name         string
+		maxResources int
+		maxBytes     int64
+		wantError    string
+	}{
+		{name: "No limits"},
+		{name: "Within limits", maxResources: 2, maxBytes: 1 << 20},
+		{name: "Too many resources", maxResources: 1, wantError: "bundle has 2 resources, more than the maximum of 1"},
+		{name: "Too large", maxBytes: 10, wantError: "more than the maximum of 10"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkBundleSize(bundle, tc.maxResources, tc.maxBytes)
+			if tc.wantError == "" && err != nil {
+				t.Errorf("checkBundleSize() returned unexpected error: %v", err)
+			}
+			if tc.wantError != "" && (err == nil || !strings.Contains(err.Error(), tc.wantError)) {
+				t.Errorf("checkBundleSize() returned error %v, want error containing %q", err, tc.wantError)
+			}
+		})
+	}
+}
+
+func TestEvalSemaphore(t *testing.T) {
+	sem := evalSemaphore(2)
+	if other := evalSemaphore(2); other != sem {
+		t.Errorf("evalSemaphore(2) returned a different semaphore, want the one shared by the process")
+	}
+	if cap(sem) != 2 {
+		t.Errorf("evalSemaphore(2) has capacity %d, want 2", cap(sem))
+	}
+}
+
+func TestCQLEvalFn_Limits(t *testing.T) {
+	fn := &CQLEvalFn{
+		CQL: []string{dedent.Dedent(
+			`library EvalTest version '1.0'
+			using FHIR version '4.0.1'
+			define ConditionCount: Count([Condition])`)},
+		EvaluationTimestamp: time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		MaxBundleResources:  2,
+		MaxConcurrentEvals:  1,
+	}
+	if err := fn.Setup(); err != nil {
+		t.Fatalf("Setup() failed: %v", err)
+	}
+	small := testBundle(t, `{"resourceType": "Bundle", "entry": [{"resource": {"resourceType": "Patient", "id": "1"}}]}`)
+	large := testBundle(t, `{"resourceType": "Bundle", "id": "large", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "2"}},
+		{"resource": {"resourceType": "Condition", "id": "c1", "subject": {"reference": "Patient/2"}}},
+		{"resource": {"resourceType": "Condition", "id": "c2", "subject": {"reference": "Patient/2"}}}
+	]}`)
+
+	var results []*cbpb.BeamResult
+	var errs []*cbpb.BeamError
+	for _, b := range []*bpb.Bundle{small, large} {
+		if err := fn.ProcessElement(context.Background(), mtime.ZeroTimestamp, b,
+			func(r *cbpb.BeamResult) { results = append(results, r) },
+			func(e *cbpb.BeamError) { errs = append(errs, e) }); err != nil {
+			t.Fatalf("ProcessElement() returned unexpected error: %v", err)
+		}
+	}
+	if len(results) != 1 || results[0].GetId() != "1" {
+		t.Errorf("ProcessElement() emitted results %v, want only patient 1", results)
+	}
+	if len(errs) != 1 || errs[0].GetPatientId() != "2" || errs[0].GetStage() != cbpb.BeamError_PARSE || errs[0].GetSourceUri() != "bundle:large" {
+		t.Errorf("ProcessElement() emitted errors %v, want one PARSE error for the bundle of patient 2", errs)
+	}
+	// The evaluation slot is released after each bundle.
+	if n := len(fn.evalSlots); n != 0 {
+		t.Errorf("ProcessElement() left %d evaluations running, want 0", n)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/google/cql/internal/resourcewrapper"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+var mergedBundleCount = beam.NewCounter(counterPrefix, "merged_fhir_bundles")
+
+func init() {
+	register.Function3x0(keyBundleByPatient)
+	register.Function3x1(mergeBundles)
+	register.Emitter1[*bpb.Bundle]()
+	register.Emitter2[string, *bpb.Bundle]()
+	register.Iter1[*bpb.Bundle]()
+}
+
+// MergeBundlesByPatient merges a PCollection<*bpb.Bundle> in which the data of a patient may be
+// split across several bundles, such as bundle-{patient}-part1.json and bundle-{patient}-part2.json,
+// into a PCollection<*bpb.Bundle> with one bundle for each patient. Bundles are keyed by the id of
+// their Patient resource, or if there is none by the patient referenced by their resources.
+// Patients with a single bundle, and bundles without a patient, are passed through unchanged.
+func MergeBundlesByPatient(s beam.Scope, bundles beam.PCollection) beam.PCollection {
+	s = s.Scope("MergeBundlesByPatient")
+	keyed, unkeyed := beam.ParDo2(s, keyBundleByPatient, bundles)
+	merged := beam.ParDo(s, mergeBundles, beam.GroupByKey(s, keyed))
+	return beam.Flatten(s, merged, unkeyed)
+}
+
+// keyBundleByPatient emits the bundle keyed by its patient id, or unkeyed if it has no patient.
+func keyBundleByPatient(bundle *bpb.Bundle, emitKeyed func(string, *bpb.Bundle), emitUnkeyed func(*bpb.Bundle)) {
+	if id := bundlePatientID(bundle); id != "" {
+		emitKeyed(id, bundle)
+		return
+	}
+	emitUnkeyed(bundle)
+}
+
+// bundlePatientID returns the id of the Patient resource in the bundle, or if there is none the id
+// of the first patient referenced by a resource. It returns an empty string if the bundle has no
+// patient.
+func bundlePatientID(bundle *bpb.Bundle) string {
+	for _, e := range bundle.GetEntry() {
+		if id := e.GetResource().GetPatient().GetId().GetValue(); id != "" {
+			return id
+		}
+	}
+	for _, e := range bundle.GetEntry() {
+		if id, err := resourcewrapper.New(e.GetResource()).PatientID(); err == nil && id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// mergeBundles merges the bundles of a patient into a single bundle with the patient id as its id,
+// see patientBundle. Resources with the same type and id, such as the Patient resource repeated in
+// each part, are only included once. A single bundle is returned unchanged.
+func mergeBundles(ctx context.Context, patientID string, bundles func(**bpb.Bundle) bool) *bpb.Bundle {
+	var all []*bpb.Bundle
+	var b *bpb.Bundle
+	for bundles(&b) {
+		all = append(all, b)
+	}
+	if len(all) == 1 {
+		return all[0]
+	}
+
+	mergedBundleCount.Inc(ctx, int64(len(all)))
+	seen := make(map[string]bool)
+	var resources []*bpb.ContainedResource
+	for _, b := range all {
+		for _, e := range b.GetEntry() {
+			r := e.GetResource()
+			if id, _ := resourcewrapper.New(r).ResourceID(); id != "" {
+				ref := resourceRef(r)
+				if seen[ref] {
+					continue
+				}
+				seen[ref] = true
+			}
+			resources = append(resources, r)
+		}
+	}
+	return patientBundle(patientID, resources)
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestKeyBundleByPatient(t *testing.T) {
+	tests := []struct {
+		name    string
+		bundle  string
+		wantKey string
+	}{
+		{
+			name:    "Patient resource",
+			bundle:  `{"resourceType": "Bundle", "id": "b", "entry": [{"resource": {"resourceType": "Patient", "id": "1"}}]}`,
+			wantKey: "1",
+		},
+		{
+			name: "Patient reference",
+			bundle: `{"resourceType": "Bundle", "id": "b", "entry": [
+				{"resource": {"resourceType": "Medication", "id": "m1"}},
+				{"resource": {"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "a"}, "subject": {"reference": "Patient/2"}}}
+			]}`,
+			wantKey: "2",
+		},
+		{
+			name:   "No patient",
+			bundle: `{"resourceType": "Bundle", "id": "b", "entry": [{"resource": {"resourceType": "Medication", "id": "m1"}}]}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotKey string
+			var gotUnkeyed bool
+			keyBundleByPatient(testBundle(t, tc.bundle),
+				func(key string, _ *bpb.Bundle) { gotKey = key },
+				func(*bpb.Bundle) { gotUnkeyed = true })
+
+			if gotKey != tc.wantKey {
+				t.Errorf("keyBundleByPatient() key = %q, want %q", gotKey, tc.wantKey)
+			}
+			if wantUnkeyed := tc.wantKey == ""; gotUnkeyed != wantUnkeyed {
+				t.Errorf("keyBundleByPatient() emitted unkeyed = %v, want %v", gotUnkeyed, wantUnkeyed)
+			}
+		})
+	}
+}
+
+func TestMergeBundles(t *testing.T) {
+	part1 := testBundle(t, `{"resourceType": "Bundle", "id": "bundle-1-part1", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "1"}},
+		{"resource": {"resourceType": "Observation", "id": "o2", "status": "final", "code": {"text": "a"}, "subject": {"reference": "Patient/1"}}}
+	]}`)
+	part2 := testBundle(t, `{"resourceType": "Bundle", "id": "bundle-1-part2", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "1"}},
+		{"resource": {"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "a"}, "subject": {"reference": "Patient/1"}}}
+	]}`)
+
+	tests := []struct {
+		name     string
+		bundles  []*bpb.Bundle
+		wantID   string
+		wantKeys []string
+	}{
+		{
+			name:     "Single bundle",
+			bundles:  []*bpb.Bundle{part1},
+			wantID:   "bundle-1-part1",
+			wantKeys: []string{"Patient/1", "Observation/o2"},
+		},
+		{
+			name:     "Multiple parts",
+			bundles:  []*bpb.Bundle{part2, part1},
+			wantID:   "1",
+			wantKeys: []string{"Observation/o1", "Observation/o2", "Patient/1"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bundles := tc.bundles
+			next := func(b **bpb.Bundle) bool {
+				if len(bundles) == 0 {
+					return false
+				}
+				*b, bundles = bundles[0], bundles[1:]
+				return true
+			}
+
+			got := mergeBundles(context.Background(), "1", next)
+
+			if got.GetId().GetValue() != tc.wantID {
+				t.Errorf("mergeBundles() bundle id = %q, want %q", got.GetId().GetValue(), tc.wantID)
+			}
+			var gotKeys []string
+			for _, e := range got.GetEntry() {
+				gotKeys = append(gotKeys, resourceKey(t, e.GetResource()))
+			}
+			if diff := cmp.Diff(tc.wantKeys, gotKeys); diff != "" {
+				t.Errorf("mergeBundles() entries diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func testBundle(t *testing.T, j string) *bpb.Bundle {
+	t.Helper()
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		t.Fatalf("NewUnmarshaller() returned an unexpected error: %v", err)
+	}
+	r, err := unmarshaller.UnmarshalR4([]byte(j))
+	if err != nil {
+		t.Fatalf("UnmarshalR4(%s) returned an unexpected error: %v", j, err)
+	}
+	return r.GetBundle()
+}
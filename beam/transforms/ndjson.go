@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/fileio"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/google/cql/internal/compression"
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/internal/resourcewrapper"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ndjsonResourceCount      = beam.NewCounter(counterPrefix, "ndjson_resources")
+	ndjsonResourceErrorCount = beam.NewCounter(counterPrefix, "ndjson_resource_read_errors")
+)
+
+func init() {
+	register.Function4x0(NDJSONToResources)
+	register.Function2x1(resourcesToBundle)
+	register.Emitter2[string, *bpb.ContainedResource]()
+	register.Iter1[*bpb.ContainedResource]()
+	beam.RegisterType(reflect.TypeOf((*bpb.ContainedResource)(nil)))
+}
+
+// NDJSONToResources reads a bulk export style NDJSON file with one FHIR R4 resource per line, and
+// emits each resource keyed by the id of the patient it belongs to (see GroupByPatient). Files may
+// be gzip or zstd compressed, or zip archives of NDJSON files. Lines that can not be parsed, and
+// resources that do not belong to a patient, are emitted as BeamErrors referencing the file and
+// line so that they can be fixed and replayed.
+func NDJSONToResources(ctx context.Context, file fileio.ReadableFile, emit func(string, *bpb.ContainedResource), emitError func(*cbpb.BeamError)) {
+	emitErr := func(err error, stage cbpb.BeamError_Stage, source string, line int64) {
+		ndjsonResourceErrorCount.Inc(ctx, 1)
+		beamErr := &cbpb.BeamError{
+			ErrorMessage: proto.String(err.Error()),
+			SourceUri:    proto.String(source),
+			Stage:        stage.Enum(),
+		}
+		if line > 0 {
+			beamErr.SourceLine = proto.Int64(line)
+		}
+		emitError(beamErr)
+	}
+
+	data, err := file.Read(ctx)
+	if err != nil {
+		emitErr(err, cbpb.BeamError_LOAD, file.Metadata.Path, 0)
+		return
+	}
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		emitErr(err, cbpb.BeamError_PARSE, file.Metadata.Path, 0)
+		return
+	}
+	files, err := compression.Decompress(file.Metadata.Path, data)
+	if err != nil {
+		emitErr(err, cbpb.BeamError_LOAD, file.Metadata.Path, 0)
+		return
+	}
+
+	for _, f := range files {
+		source := fileSourceURI(file.Metadata.Path, f)
+		scanner := bufio.NewScanner(bytes.NewReader(f.Data))
+		scanner.Buffer(nil, iohelpers.MaxNDJSONLineSize)
+		var line int64
+		for line = 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			r, err := unmarshaller.UnmarshalR4(scanner.Bytes())
+			if err != nil {
+				emitErr(err, cbpb.BeamError_PARSE, source, line)
+				continue
+			}
+			patientID, err := resourcewrapper.New(r).PatientID()
+			if err != nil {
+				emitErr(err, cbpb.BeamError_PARSE, source, line)
+				continue
+			}
+			ndjsonResourceCount.Inc(ctx, 1)
+			emit(patientID, r)
+		}
+		if err := scanner.Err(); err != nil {
+			// The scanner stops at the line it could not read, so the rest of the file is skipped.
+			emitErr(err, cbpb.BeamError_LOAD, source, line)
+		}
+	}
+}
+
+// GroupByPatient groups a PCollection<KV<string, *bpb.ContainedResource>> of resources keyed by
+// patient id, such as the output of NDJSONToResources, into a PCollection<*bpb.Bundle> with one
+// bundle of all the resources of each patient. The id of each bundle is the patient id.
+func GroupByPatient(s beam.Scope, resources beam.PCollection) beam.PCollection {
+	s = s.Scope("GroupByPatient")
+	return beam.ParDo(s, resourcesToBundle, beam.GroupByKey(s, resources))
+}
+
+// resourcesToBundle returns a bundle of the resources of a patient, see patientBundle.
+func resourcesToBundle(patientID string, resources func(**bpb.ContainedResource) bool) *bpb.Bundle {
+	var rs []*bpb.ContainedResource
+	var r *bpb.ContainedResource
+	for resources(&r) {
+		rs = append(rs, r)
+	}
+	return patientBundle(patientID, rs)
+}
+
+// patientBundle returns a bundle of the resources of a patient with the patient id as its id. The
+// resources are ordered by resource type and id so that the bundle does not depend on the order
+// the resources were grouped in.
+func patientBundle(patientID string, resources []*bpb.ContainedResource) *bpb.Bundle {
+	type keyedEntry struct {
+		key   string
+		entry *bpb.Bundle_Entry
+	}
+	entries := make([]keyedEntry, 0, len(resources))
+	for _, r := range resources {
+		entries = append(entries, keyedEntry{key: resourceRef(r), entry: &bpb.Bundle_Entry{Resource: r}})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	bundle := &bpb.Bundle{Id: &dtpb.Id{Value: patientID}}
+	for _, e := range entries {
+		bundle.Entry = append(bundle.Entry, e.entry)
+	}
+	return bundle
+}
+
+// resourceRef returns the resource type and id of the resource in the form type/id.
+func resourceRef(r *bpb.ContainedResource) string {
+	rw := resourcewrapper.New(r)
+	rt, _ := rw.ResourceType()
+	id, _ := rw.ResourceID()
+	return rt + "/" + id
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/fileio"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testNDJSON = `{"resourceType": "Patient", "id": "1"}
+{"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "a"}, "subject": {"reference": "Patient/1"}}
+
+{"resourceType": "Encounter", "id": "e2", "status": "finished", "class": {"code": "AMB"}, "subject": {"reference": "Patient/2"}}
+`
+
+func TestNDJSONToResources(t *testing.T) {
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write([]byte(testNDJSON))
+	gzw.Close()
+
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	zf, err := zw.Create("dir/resources.ndjson")
+	if err != nil {
+		t.Fatalf("zip Create() returned an unexpected error: %v", err)
+	}
+	zf.Write([]byte(`{"resourceType": "Patient", "id": "1"}` + "\n" + `{"resourceType": "Medication", "id": "m1"}` + "\n"))
+	zw.Close()
+
+	wantKeys := []string{"1/Patient/1", "1/Observation/o1", "2/Encounter/e2"}
+	tests := []struct {
+		name        string
+		fileName    string
+		content     []byte
+		wantKeys    []string
+		wantSources []string
+	}{
+		{
+			name:     "Uncompressed",
+			fileName: "resources.ndjson",
+			content:  []byte(testNDJSON),
+			wantKeys: wantKeys,
+		},
+		{
+			name:     "Gzip",
+			fileName: "resources.ndjson.gz",
+			content:  gz.Bytes(),
+			wantKeys: wantKeys,
+		},
+		{
+			name:        "Invalid line",
+			fileName:    "resources.ndjson",
+			content:     []byte(`{"resourceType": "Patient", "id": "1"}` + "\n" + `{"resourceType": "Patient", "id": ` + "\n"),
+			wantKeys:    []string{"1/Patient/1"},
+			wantSources: []string{"PARSE resources.ndjson:2"},
+		},
+		{
+			name:        "Resource without patient",
+			fileName:    "resources.ndjson",
+			content:     []byte(`{"resourceType": "Medication", "id": "m1"}`),
+			wantSources: []string{"PARSE resources.ndjson:1"},
+		},
+		{
+			name:        "Zip",
+			fileName:    "resources.zip",
+			content:     zb.Bytes(),
+			wantKeys:    []string{"1/Patient/1"},
+			wantSources: []string{"PARSE resources.zip!/dir/resources.ndjson:2"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tc.fileName)
+			if err := os.WriteFile(path, tc.content, 0644); err != nil {
+				t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+			}
+			file := fileio.ReadableFile{Metadata: fileio.FileMetadata{Path: path}}
+
+			var gotKeys, gotSources []string
+			NDJSONToResources(context.Background(), file,
+				func(patientID string, r *bpb.ContainedResource) {
+					gotKeys = append(gotKeys, patientID+"/"+resourceKey(t, r))
+				},
+				func(e *cbpb.BeamError) {
+					source, _ := filepath.Rel(dir, e.GetSourceUri())
+					gotSources = append(gotSources, fmt.Sprintf("%s %s:%d", e.GetStage(), source, e.GetSourceLine()))
+				})
+
+			if diff := cmp.Diff(tc.wantKeys, gotKeys); diff != "" {
+				t.Errorf("NDJSONToResources() resources diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantSources, gotSources); diff != "" {
+				t.Errorf("NDJSONToResources() error sources diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestResourcesToBundle(t *testing.T) {
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		t.Fatalf("NewUnmarshaller() returned an unexpected error: %v", err)
+	}
+	var resources []*bpb.ContainedResource
+	for _, j := range []string{
+		`{"resourceType": "Observation", "id": "o2"}`,
+		`{"resourceType": "Patient", "id": "1"}`,
+		`{"resourceType": "Observation", "id": "o1"}`,
+	} {
+		r, err := unmarshaller.UnmarshalR4([]byte(j))
+		if err != nil {
+			t.Fatalf("UnmarshalR4(%s) returned an unexpected error: %v", j, err)
+		}
+		resources = append(resources, r)
+	}
+	next := func(r **bpb.ContainedResource) bool {
+		if len(resources) == 0 {
+			return false
+		}
+		*r, resources = resources[0], resources[1:]
+		return true
+	}
+
+	bundle := resourcesToBundle("1", next)
+
+	if got := bundle.GetId().GetValue(); got != "1" {
+		t.Errorf("resourcesToBundle() bundle id = %q, want %q", got, "1")
+	}
+	var gotKeys []string
+	for _, e := range bundle.GetEntry() {
+		gotKeys = append(gotKeys, resourceKey(t, e.GetResource()))
+	}
+	wantKeys := []string{"Observation/o1", "Observation/o2", "Patient/1"}
+	if diff := cmp.Diff(wantKeys, gotKeys); diff != "" {
+		t.Errorf("resourcesToBundle() entries diff (-want +got):\n%s", diff)
+	}
+}
+
+func resourceKey(t *testing.T, r *bpb.ContainedResource) string {
+	t.Helper()
+	switch {
+	case r.GetPatient() != nil:
+		return "Patient/" + r.GetPatient().GetId().GetValue()
+	case r.GetObservation() != nil:
+		return "Observation/" + r.GetObservation().GetId().GetValue()
+	case r.GetEncounter() != nil:
+		return "Encounter/" + r.GetEncounter().GetId().GetValue()
+	}
+	t.Fatalf("unexpected resource %v", r)
+	return ""
+}
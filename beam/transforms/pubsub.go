@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var pubSubMessageCount = beam.NewCounter(counterPrefix, "pubsub_messages")
+
+var pubSubTopicRegex = regexp.MustCompile(`^projects/([^/]+)/topics/([^/]+)$`)
+
+func init() {
+	register.Function4x0(MessageToBundle)
+}
+
+// ParsePubSubTopic returns the project and topic id of a Pub/Sub topic in the form
+// projects/{project}/topics/{topic}.
+func ParsePubSubTopic(name string) (project, topic string, err error) {
+	m := pubSubTopicRegex.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", fmt.Errorf("pubsub_topic must be in the form projects/{project}/topics/{topic}, got %q", name)
+	}
+	return m[1], m[2], nil
+}
+
+// MessageToBundle parses a Pub/Sub message holding a FHIR R4 bundle, which may be gzip or zstd
+// compressed or a zip archive of bundles like the files read by FileToBundle. Messages that can
+// not be parsed are emitted as BeamErrors with a source URI of pubsub:{message id}.
+func MessageToBundle(ctx context.Context, msg *pb.PubsubMessage, emitBundle func(*bpb.Bundle), emitError func(*cbpb.BeamError)) {
+	pubSubMessageCount.Inc(ctx, 1)
+	decodeBundles("pubsub:"+msg.GetMessageId(), msg.GetData(), emitBundle, func(err error, stage cbpb.BeamError_Stage, source string) {
+		bundleErrorCount.Inc(ctx, 1)
+		emitError(&cbpb.BeamError{
+			ErrorMessage: proto.String(err.Error()),
+			SourceUri:    proto.String(source),
+			Stage:        stage.Enum(),
+		})
+	})
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"testing"
+
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"github.com/google/go-cmp/cmp"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+func TestMessageToBundle(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantIDs    []string
+		wantErrors []string
+	}{
+		{
+			name:    "Bundle",
+			data:    `{"resourceType": "Bundle", "id": "b1", "entry": []}`,
+			wantIDs: []string{"b1"},
+		},
+		{
+			name:       "Not a bundle",
+			data:       `{"resourceType": "Patient", "id": "1"}`,
+			wantErrors: []string{"PARSE pubsub:m1"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotIDs, gotErrors []string
+			MessageToBundle(context.Background(), &pb.PubsubMessage{MessageId: "m1", Data: []byte(tc.data)},
+				func(b *bpb.Bundle) { gotIDs = append(gotIDs, b.GetId().GetValue()) },
+				func(e *cbpb.BeamError) { gotErrors = append(gotErrors, e.GetStage().String()+" "+e.GetSourceUri()) })
+
+			if diff := cmp.Diff(tc.wantIDs, gotIDs); diff != "" {
+				t.Errorf("MessageToBundle() bundle ids diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantErrors, gotErrors); diff != "" {
+				t.Errorf("MessageToBundle() errors diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParsePubSubTopic(t *testing.T) {
+	project, topic, err := ParsePubSubTopic("projects/p/topics/bundles")
+	if err != nil || project != "p" || topic != "bundles" {
+		t.Errorf("ParsePubSubTopic() = %q, %q, %v, want p, bundles", project, topic, err)
+	}
+	for _, name := range []string{"bundles", "projects/p/subscriptions/s", "projects/p/topics/t/extra"} {
+		if _, _, err := ParsePubSubTopic(name); err == nil {
+			t.Errorf("ParsePubSubTopic(%q) succeeded, want error", name)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/fileio"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	"github.com/google/cql/internal/iohelpers"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+var skippedPatientCount = beam.NewCounter(counterPrefix, "skipped_patients")
+
+func init() {
+	register.Function3x1(ResultFileToPatientIDs)
+	register.Function5x0(skipProcessed)
+	register.Emitter2[string, bool]()
+	register.Iter1[bool]()
+}
+
+// SkipProcessedPatients removes the bundles of patients that already have results from a
+// PCollection<*bpb.Bundle>, so that a job that failed part way can be resumed without evaluating
+// those patients again. processed is a PCollection<KV<string, bool>> of the ids of the patients
+// with results, such as the output of ResultFileToPatientIDs. Bundles are matched to patients by
+// the id of their Patient resource, and bundles without a patient are always kept.
+func SkipProcessedPatients(s beam.Scope, bundles, processed beam.PCollection) beam.PCollection {
+	s = s.Scope("SkipProcessedPatients")
+	keyed, unkeyed := beam.ParDo2(s, keyBundleByPatient, bundles)
+	kept := beam.ParDo(s, skipProcessed, beam.CoGroupByKey(s, keyed, processed))
+	return beam.Flatten(s, kept, unkeyed)
+}
+
+// ResultFileToPatientIDs emits the id of the patient of each row of a results NDJSON file written
+// by NDJSONSink. Rows without an id are skipped. The file failing to be read is returned as an
+// error rather than skipped, since the patients in it would otherwise be evaluated again.
+func ResultFileToPatientIDs(ctx context.Context, file fileio.ReadableFile, emit func(string, bool)) error {
+	data, err := file.Read(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read results %s: %w", file.Metadata.Path, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, iohelpers.MaxNDJSONLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var row struct {
+			ID string
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return fmt.Errorf("failed to parse results %s line %d: %w", file.Metadata.Path, line, err)
+		}
+		if row.ID != "" {
+			emit(row.ID, true)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read results %s: %w", file.Metadata.Path, err)
+	}
+	return nil
+}
+
+// skipProcessed emits the bundles of the patient unless the patient has already been processed.
+func skipProcessed(ctx context.Context, patientID string, bundles func(**bpb.Bundle) bool, processed func(*bool) bool, emit func(*bpb.Bundle)) {
+	var p bool
+	if processed(&p) {
+		skippedPatientCount.Inc(ctx, 1)
+		return
+	}
+	var b *bpb.Bundle
+	for bundles(&b) {
+		emit(b)
+	}
+}
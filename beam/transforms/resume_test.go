@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/fileio"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResultFileToPatientIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results-00000-of-00002.ndjson")
+	rows := `{"EvaluationTimestamp":"2023-01-01T00:00:00Z","ID":"1","Result":{}}
+{"EvaluationTimestamp":"2023-01-01T00:00:00Z","ID":"2","Result":{}}
+
+{"EvaluationTimestamp":"2023-01-01T00:00:00Z","ID":"","Result":{}}
+`
+	if err := os.WriteFile(path, []byte(rows), 0644); err != nil {
+		t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+	}
+
+	var got []string
+	err := ResultFileToPatientIDs(context.Background(), fileio.ReadableFile{Metadata: fileio.FileMetadata{Path: path}},
+		func(id string, _ bool) { got = append(got, id) })
+	if err != nil {
+		t.Fatalf("ResultFileToPatientIDs() returned an unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"1", "2"}, got); diff != "" {
+		t.Errorf("ResultFileToPatientIDs() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestResultFileToPatientIDs_Error(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.ndjson")
+	if err := os.WriteFile(path, []byte("{\"ID\":\"1\"}\nnot json\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+	}
+	err := ResultFileToPatientIDs(context.Background(), fileio.ReadableFile{Metadata: fileio.FileMetadata{Path: path}},
+		func(string, bool) {})
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("ResultFileToPatientIDs() returned error %v, want an error for line 2", err)
+	}
+}
+
+func TestSkipProcessed(t *testing.T) {
+	bundle := testBundle(t, `{"resourceType": "Bundle", "id": "1", "entry": [{"resource": {"resourceType": "Patient", "id": "1"}}]}`)
+	tests := []struct {
+		name      string
+		processed []bool
+		want      int
+	}{
+		{name: "Not processed", want: 1},
+		{name: "Processed", processed: []bool{true}, want: 0},
+		{name: "Processed in several results", processed: []bool{true, true}, want: 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bundles := []*bpb.Bundle{bundle}
+			var got []*bpb.Bundle
+			skipProcessed(context.Background(), "1", iter(bundles), iter(tc.processed), func(b *bpb.Bundle) { got = append(got, b) })
+			if len(got) != tc.want {
+				t.Errorf("skipProcessed() emitted %d bundles, want %d", len(got), tc.want)
+			}
+		})
+	}
+}
+
+// iter returns a Beam iterator over the values.
+func iter[T any](values []T) func(*T) bool {
+	return func(v *T) bool {
+		if len(values) == 0 {
+			return false
+		}
+		*v, values = values[0], values[1:]
+		return true
+	}
+}
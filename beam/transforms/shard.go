@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/window"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/register"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	crpb "github.com/google/cql/protos/cql_result_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// PartitionLibrary writes the results of each CQL library to its own library={name} directory.
+	PartitionLibrary = "library"
+	// PartitionStatus writes results to a status=success directory and errors to a status=error
+	// directory.
+	PartitionStatus = "status"
+)
+
+func init() {
+	register.DoFn4x0[context.Context, *cbpb.BeamResult, func(string, string), func(*cbpb.BeamError)](&PartitionedNDJSONSinkFn{})
+	register.DoFn2x0[*cbpb.BeamError, func(string, string)](&PartitionedErrorsNDJSONSinkFn{})
+	register.DoFn4x0[beam.Window, string, string, func(string, string)](&shardFileFn{})
+	register.DoFn3x1[context.Context, string, func(*string) bool, error](&writeShardFn{})
+	register.Emitter2[string, string]()
+	register.Iter1[string]()
+	register.Function1x2(Unpartitioned)
+}
+
+// ValidatePartition returns an error if partition is not empty, PartitionLibrary or
+// PartitionStatus.
+func ValidatePartition(partition string) error {
+	switch partition {
+	case "", PartitionLibrary, PartitionStatus:
+		return nil
+	}
+	return fmt.Errorf("output partition must be %s or %s, got %q", PartitionLibrary, PartitionStatus, partition)
+}
+
+// JoinPath joins a relative path to a directory. Unlike filepath.Join, the double slash of a
+// scheme such as gs:// is kept.
+func JoinPath(dir, rel string) string {
+	if strings.Contains(dir, "://") {
+		return strings.TrimSuffix(dir, "/") + "/" + rel
+	}
+	return filepath.Join(dir, filepath.FromSlash(rel))
+}
+
+// PartitionedNDJSONSinkFn marshals BeamResults to NDJSON rows like NDJSONSink, keyed by the
+// partition directory the row is written to. With PartitionLibrary each result is split into one
+// row for each of its libraries.
+type PartitionedNDJSONSinkFn struct {
+	// Partition is empty, PartitionLibrary or PartitionStatus.
+	Partition string
+}
+
+func (fn *PartitionedNDJSONSinkFn) ProcessElement(ctx context.Context, output *cbpb.BeamResult, emit func(string, string), emitError func(*cbpb.BeamError)) {
+	var partition string
+	switch fn.Partition {
+	case PartitionStatus:
+		partition = PartitionStatus + "=success"
+	case PartitionLibrary:
+		for _, lib := range output.GetResult().GetLibraries() {
+			libOutput := proto.Clone(output).(*cbpb.BeamResult)
+			libOutput.Result = &crpb.Libraries{Libraries: []*crpb.Library{lib}}
+			NDJSONSink(ctx, libOutput, func(row string) {
+				emit(PartitionLibrary+"="+url.PathEscape(lib.GetName()), row)
+			}, emitError)
+		}
+		return
+	}
+	NDJSONSink(ctx, output, func(row string) { emit(partition, row) }, emitError)
+}
+
+// WriteSharded writes a PCollection<KV<string, string>> of rows keyed by partition directory, as
+// produced by PartitionedNDJSONSinkFn, to shards files in each partition directory of dir. The
+// files are named {prefix}-{shard}-of-{shards}.ndjson, and rows are assigned to shards by hash so
+// that the shards are written in parallel.
+func WriteSharded(s beam.Scope, dir, prefix string, shards int, rows beam.PCollection) {
+	s = s.Scope("WriteSharded")
+	files := beam.ParDo(s, &shardFileFn{Dir: dir, Prefix: prefix, Shards: shards}, rows)
+	beam.ParDo0(s, &writeShardFn{}, beam.GroupByKey(s, files))
+}
+
+// Unpartitioned keys a row by the empty partition, so that a PCollection<string> can be written
+// with WriteSharded.
+func Unpartitioned(row string) (string, string) {
+	return "", row
+}
+
+// shardFileFn keys each row by the file it is written to. Rows in fixed or sliding windows, such as
+// those of streaming pipelines, are written to a window={start} directory for each window.
+type shardFileFn struct {
+	Dir    string
+	Prefix string
+	Shards int
+}
+
+func (fn *shardFileFn) ProcessElement(w beam.Window, partition, row string, emit func(string, string)) {
+	h := fnv.New32a()
+	h.Write([]byte(row))
+	name := fmt.Sprintf("%s-%05d-of-%05d.ndjson", fn.Prefix, int(h.Sum32()%uint32(fn.Shards)), fn.Shards)
+	if partition != "" {
+		name = partition + "/" + name
+	}
+	if iw, ok := w.(window.IntervalWindow); ok {
+		name = "window=" + iw.Start.ToTime().UTC().Format(time.RFC3339) + "/" + name
+	}
+	emit(JoinPath(fn.Dir, name), row)
+}
+
+// writeShardFn writes all the rows of a file.
+type writeShardFn struct{}
+
+func (fn *writeShardFn) ProcessElement(ctx context.Context, filename string, rows func(*string) bool) error {
+	fs, err := filesystem.New(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	fd, err := fs.OpenWrite(ctx, filename)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriterSize(fd, 1<<20)
+	var row string
+	for rows(&row) {
+		// Rows from the NDJSON sinks already end in a newline.
+		if _, err := buf.WriteString(strings.TrimSuffix(row, "\n") + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// PartitionedErrorsNDJSONSinkFn marshals BeamErrors to NDJSON rows like ErrorsNDJSONSink, keyed
+// by the partition directory the row is written to.
+type PartitionedErrorsNDJSONSinkFn struct {
+	// Partition is empty, PartitionLibrary or PartitionStatus. Errors are only partitioned by
+	// PartitionStatus, since they do not belong to a library.
+	Partition string
+}
+
+func (fn *PartitionedErrorsNDJSONSinkFn) ProcessElement(beamErr *cbpb.BeamError, emit func(string, string)) {
+	var partition string
+	if fn.Partition == PartitionStatus {
+		partition = PartitionStatus + "=error"
+	}
+	ErrorsNDJSONSink(beamErr, func(row string) { emit(partition, row) })
+}
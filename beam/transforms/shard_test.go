@@ -0,0 +1,170 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/mtime"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/window"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	crpb "github.com/google/cql/protos/cql_result_go_proto"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/proto"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPartitionedNDJSONSinkFn(t *testing.T) {
+	output := &cbpb.BeamResult{
+		Id:                  proto.String("1"),
+		EvaluationTimestamp: timestamppb.New(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)),
+		Result: &crpb.Libraries{
+			Libraries: []*crpb.Library{
+				&crpb.Library{
+					Name:     proto.String("Lib1"),
+					Version:  proto.String("1.0"),
+					ExprDefs: map[string]*crpb.Value{"A": &crpb.Value{Value: &crpb.Value_BooleanValue{BooleanValue: true}}},
+				},
+				&crpb.Library{
+					Name:     proto.String("Lib 2"),
+					Version:  proto.String("1.0"),
+					ExprDefs: map[string]*crpb.Value{"B": &crpb.Value{Value: &crpb.Value_BooleanValue{BooleanValue: false}}},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		partition      string
+		wantPartitions []string
+	}{
+		{
+			name:           "No partition",
+			wantPartitions: []string{""},
+		},
+		{
+			name:           "Status",
+			partition:      PartitionStatus,
+			wantPartitions: []string{"status=success"},
+		},
+		{
+			name:           "Library",
+			partition:      PartitionLibrary,
+			wantPartitions: []string{"library=Lib%202", "library=Lib1"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rows := make(map[string]string)
+			fn := &PartitionedNDJSONSinkFn{Partition: tc.partition}
+			fn.ProcessElement(context.Background(), output,
+				func(partition, row string) { rows[partition] = row },
+				func(e *cbpb.BeamError) { t.Errorf("ProcessElement() emitted unexpected error: %v", e) })
+
+			var gotPartitions []string
+			for p := range rows {
+				gotPartitions = append(gotPartitions, p)
+			}
+			sort.Strings(gotPartitions)
+			if diff := cmp.Diff(tc.wantPartitions, gotPartitions); diff != "" {
+				t.Errorf("ProcessElement() partitions diff (-want +got):\n%s", diff)
+			}
+			if tc.partition == PartitionLibrary {
+				if row := rows["library=Lib1"]; !strings.Contains(row, `"A"`) || strings.Contains(row, `"B"`) {
+					t.Errorf("ProcessElement() row for Lib1 = %s, want only the results of Lib1", row)
+				}
+			}
+		})
+	}
+}
+
+func TestPartitionedErrorsNDJSONSinkFn(t *testing.T) {
+	for partition, want := range map[string]string{"": "", PartitionLibrary: "", PartitionStatus: "status=error"} {
+		var got []string
+		fn := &PartitionedErrorsNDJSONSinkFn{Partition: partition}
+		fn.ProcessElement(&cbpb.BeamError{ErrorMessage: proto.String("error")}, func(p, row string) { got = append(got, p) })
+		if diff := cmp.Diff([]string{want}, got); diff != "" {
+			t.Errorf("ProcessElement() with partition %q diff (-want +got):\n%s", partition, diff)
+		}
+	}
+}
+
+func TestShardFileFn(t *testing.T) {
+	fn := &shardFileFn{Dir: "gs://bucket/out", Prefix: "results", Shards: 4}
+	files := make(map[string]bool)
+	for _, row := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		fn.ProcessElement(window.GlobalWindow{}, "library=Lib1", row, func(file, _ string) { files[file] = true })
+	}
+	for file := range files {
+		if !strings.HasPrefix(file, "gs://bucket/out/library=Lib1/results-0000") || !strings.HasSuffix(file, "-of-00004.ndjson") {
+			t.Errorf("shardFileFn emitted file %q, want gs://bucket/out/library=Lib1/results-0000{shard}-of-00004.ndjson", file)
+		}
+	}
+	if len(files) < 2 {
+		t.Errorf("shardFileFn wrote %d shards, want rows spread over several shards", len(files))
+	}
+
+	// Rows are assigned to shards deterministically.
+	var first, second string
+	fn.ProcessElement(window.GlobalWindow{}, "", "row", func(file, _ string) { first = file })
+	fn.ProcessElement(window.GlobalWindow{}, "", "row", func(file, _ string) { second = file })
+	if first != second {
+		t.Errorf("shardFileFn assigned the same row to %q and %q", first, second)
+	}
+
+	// Rows in interval windows are written to a directory for each window.
+	start := time.Date(2024, time.January, 1, 10, 5, 0, 0, time.UTC)
+	w := window.IntervalWindow{Start: mtime.FromTime(start), End: mtime.FromTime(start.Add(time.Minute))}
+	var windowed string
+	fn.ProcessElement(w, "", "row", func(file, _ string) { windowed = file })
+	if want := "gs://bucket/out/window=2024-01-01T10:05:00Z/results-"; !strings.HasPrefix(windowed, want) {
+		t.Errorf("shardFileFn emitted file %q for window %v, want prefix %q", windowed, w, want)
+	}
+}
+
+func TestValidatePartition(t *testing.T) {
+	for _, p := range []string{"", PartitionLibrary, PartitionStatus} {
+		if err := ValidatePartition(p); err != nil {
+			t.Errorf("ValidatePartition(%q) returned unexpected error: %v", p, err)
+		}
+	}
+	if err := ValidatePartition("patient"); err == nil {
+		t.Errorf("ValidatePartition(%q) succeeded, want error", "patient")
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	tests := []struct {
+		dir  string
+		name string
+		want string
+	}{
+		{dir: "gs://bucket/dir", name: "*.json", want: "gs://bucket/dir/*.json"},
+		{dir: "gs://bucket/dir/", name: "results.ndjson", want: "gs://bucket/dir/results.ndjson"},
+		{dir: "local/dir/", name: "*.json", want: filepath.Join("local", "dir", "*.json")},
+		{dir: "local/dir", name: "library=Lib1/results.ndjson", want: filepath.Join("local", "dir", "library=Lib1", "results.ndjson")},
+	}
+	for _, tc := range tests {
+		if got := JoinPath(tc.dir, tc.name); got != tc.want {
+			t.Errorf("JoinPath(%q, %q) = %q, want %q", tc.dir, tc.name, got, tc.want)
+		}
+	}
+}
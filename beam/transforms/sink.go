@@ -46,7 +46,7 @@ func NDJSONSink(ctx context.Context, output *cbpb.BeamResult, emitValue func(str
 	libs, err := result.LibrariesFromProto(output.Result)
 	if err != nil {
 		ndjsonSinkToProtoErrorCount.Inc(ctx, 1)
-		emitError(&cbpb.BeamError{ErrorMessage: proto.String(err.Error())})
+		emitError(sinkError(err, output))
 		return
 	}
 
@@ -56,16 +56,34 @@ func NDJSONSink(ctx context.Context, output *cbpb.BeamResult, emitValue func(str
 		"EvaluationTimestamp": evalTime.Format(time.RFC3339),
 		"Result":              libs,
 	}
+	if output.GetLibrarySet() != "" {
+		jMap["LibrarySet"] = output.GetLibrarySet()
+	}
 
 	jResult, err := json.Marshal(jMap)
 	if err != nil {
 		ndjsonSinkToJSONErrorCount.Inc(ctx, 1)
-		emitError(&cbpb.BeamError{ErrorMessage: proto.String(err.Error())})
+		emitError(sinkError(err, output))
 		return
 	}
 	emitValue(fmt.Sprintf("%v\n", string(jResult)))
 }
 
+// sinkError returns a BeamError for a result that could not be written.
+func sinkError(err error, output *cbpb.BeamResult) *cbpb.BeamError {
+	beamErr := &cbpb.BeamError{
+		ErrorMessage: proto.String(err.Error()),
+		Stage:        cbpb.BeamError_WRITE.Enum(),
+	}
+	if output.GetId() != "" {
+		beamErr.PatientId = proto.String(output.GetId())
+	}
+	if output.GetLibrarySet() != "" {
+		beamErr.LibrarySet = proto.String(output.GetLibrarySet())
+	}
+	return beamErr
+}
+
 // ErrorsNDJSONSink writes processing errors to an NDJSON file for troubleshooting.
 func ErrorsNDJSONSink(beamErr *cbpb.BeamError, emitError func(string)) {
 	jsonBytes, err := protojson.Marshal(beamErr)
@@ -79,8 +79,30 @@ func TestNDJSONSink(t *testing.T) {
 				},
 			},
 			wantValueRows: []string{
-				"{\"EvaluationTimestamp\":\"2023-11-01T01:20:30Z\",\"ID\":\"1\",\"Result\":[{\"libName\":\"TESTLIB\",\"libVersion\":\"1.0.0\",\"expressionDefinitions\":{\"HasDiabetes\":{\"@type\":\"System.Boolean\",\"value\":false},\"HasHypertension\":{\"@type\":\"System.Boolean\",\"value\":false}}}]}\n",
-				"{\"EvaluationTimestamp\":\"2023-12-02T01:20:30Z\",\"ID\":\"2\",\"Result\":[{\"libName\":\"TESTLIB\",\"libVersion\":\"1.0.0\",\"expressionDefinitions\":{\"HasDiabetes\":{\"@type\":\"System.Boolean\",\"value\":true},\"HasHypertension\":{\"@type\":\"System.Boolean\",\"value\":true}}}]}\n",
+				"{\"EvaluationTimestamp\":\"2023-11-01T01:20:30Z\",\"ID\":\"1\",\"Result\":[{\"formatVersion\":\"1.1\",\"libName\":\"TESTLIB\",\"libVersion\":\"1.0.0\",\"expressionDefinitions\":{\"HasDiabetes\":{\"@type\":\"System.Boolean\",\"value\":false},\"HasHypertension\":{\"@type\":\"System.Boolean\",\"value\":false}}}]}\n",
+				"{\"EvaluationTimestamp\":\"2023-12-02T01:20:30Z\",\"ID\":\"2\",\"Result\":[{\"formatVersion\":\"1.1\",\"libName\":\"TESTLIB\",\"libVersion\":\"1.0.0\",\"expressionDefinitions\":{\"HasDiabetes\":{\"@type\":\"System.Boolean\",\"value\":true},\"HasHypertension\":{\"@type\":\"System.Boolean\",\"value\":true}}}]}\n",
+			},
+		},
+		{
+			name: "Library set",
+			outputs: []*cbpb.BeamResult{
+				&cbpb.BeamResult{
+					Id:                  proto.String("1"),
+					EvaluationTimestamp: timestamppb.New(time.Date(2023, time.November, 1, 1, 20, 30, 1e8, time.UTC)),
+					LibrarySet:          proto.String("measure_a"),
+					Result: &crpb.Libraries{
+						Libraries: []*crpb.Library{
+							&crpb.Library{
+								Name:     proto.String("TESTLIB"),
+								Version:  proto.String("1.0.0"),
+								ExprDefs: map[string]*crpb.Value{"HasDiabetes": &crpb.Value{Value: &crpb.Value_BooleanValue{BooleanValue: false}}},
+							},
+						},
+					},
+				},
+			},
+			wantValueRows: []string{
+				"{\"EvaluationTimestamp\":\"2023-11-01T01:20:30Z\",\"ID\":\"1\",\"LibrarySet\":\"measure_a\",\"Result\":[{\"formatVersion\":\"1.1\",\"libName\":\"TESTLIB\",\"libVersion\":\"1.0.0\",\"expressionDefinitions\":{\"HasDiabetes\":{\"@type\":\"System.Boolean\",\"value\":false}}}]}\n",
 			},
 		},
 	}
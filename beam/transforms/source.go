@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/google/cql/internal/compression"
 	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
 	"github.com/google/fhir/go/fhirversion"
 	"github.com/google/fhir/go/jsonformat"
@@ -27,35 +28,65 @@ import (
 )
 
 // FileToBundle returns a collection of FHIR R4 bundles and a collection of `ProcessingError` protos
-// for files that could not be parsed into a bundle.
+// for files that could not be parsed into a bundle. Files may be gzip or zstd compressed, or zip
+// archives in which case one bundle is emitted for each file in the archive.
 func FileToBundle(ctx context.Context, file fileio.ReadableFile, emitBundle func(*bpb.Bundle), emitError func(*cbpb.BeamError)) {
-	emitErr := func(err error) {
+	emitErr := func(err error, stage cbpb.BeamError_Stage, source string) {
 		bundleErrorCount.Inc(ctx, 1)
-		emitError(&cbpb.BeamError{ErrorMessage: proto.String(err.Error())})
+		emitError(&cbpb.BeamError{
+			ErrorMessage: proto.String(err.Error()),
+			SourceUri:    proto.String(source),
+			Stage:        stage.Enum(),
+		})
 	}
 
 	data, err := file.Read(ctx)
 	if err != nil {
-		emitErr(err)
+		emitErr(err, cbpb.BeamError_LOAD, file.Metadata.Path)
 		return
 	}
+	decodeBundles(file.Metadata.Path, data, emitBundle, emitErr)
+}
 
+// decodeBundles decompresses data read from path and emits the FHIR R4 bundle in each file it
+// holds. Errors are passed to emitErr with the stage they occurred in and the source URI of the
+// file, see fileSourceURI.
+func decodeBundles(path string, data []byte, emitBundle func(*bpb.Bundle), emitErr func(err error, stage cbpb.BeamError_Stage, source string)) {
 	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
 	if err != nil {
-		emitErr(err)
+		emitErr(err, cbpb.BeamError_PARSE, path)
 		return
 	}
 
-	p, err := unmarshaller.Unmarshal(data)
+	files, err := compression.Decompress(path, data)
 	if err != nil {
-		emitErr(err)
+		emitErr(err, cbpb.BeamError_LOAD, path)
 		return
 	}
 
-	b := p.(*bpb.ContainedResource).GetBundle()
-	if b != nil {
-		emitBundle(b)
-	} else {
-		emitErr(fmt.Errorf("no bundle found in file: %s", file.Metadata.Path))
+	for _, f := range files {
+		source := fileSourceURI(path, f)
+		p, err := unmarshaller.Unmarshal(f.Data)
+		if err != nil {
+			emitErr(err, cbpb.BeamError_PARSE, source)
+			continue
+		}
+
+		b := p.(*bpb.ContainedResource).GetBundle()
+		if b != nil {
+			emitBundle(b)
+		} else {
+			emitErr(fmt.Errorf("no bundle found in file: %s", f.Name), cbpb.BeamError_PARSE, source)
+		}
+	}
+}
+
+// fileSourceURI returns the URI of the decompressed file f read from path, for use as the
+// SourceUri of BeamErrors. Files within a zip archive are referenced as path!/name, where name is
+// the path of the file within the archive, otherwise path itself is returned.
+func fileSourceURI(path string, f compression.File) string {
+	if f.Name == path || f.Name == compression.TrimSuffix(path) {
+		return path
 	}
+	return path + "!/" + f.Name
 }
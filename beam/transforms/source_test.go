@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/fileio"
+	cbpb "github.com/google/cql/protos/cql_beam_go_proto"
+	bpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"github.com/google/go-cmp/cmp"
+
+	// The following import is required for accessing local files.
+	_ "github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem/local"
+)
+
+func TestFileToBundle(t *testing.T) {
+	bundle := func(id string) []byte {
+		return []byte(`{"resourceType": "Bundle", "id": "` + id + `", "entry": []}`)
+	}
+
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write(bundle("gz"))
+	gzw.Close()
+
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	for _, id := range []string{"zip1", "zip2"} {
+		f, err := zw.Create(id + ".json")
+		if err != nil {
+			t.Fatalf("zip Create() returned an unexpected error: %v", err)
+		}
+		f.Write(bundle(id))
+	}
+	zf, err := zw.Create("patient.json")
+	if err != nil {
+		t.Fatalf("zip Create() returned an unexpected error: %v", err)
+	}
+	zf.Write([]byte(`{"resourceType": "Patient", "id": "1"}`))
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		fileName string
+		content  []byte
+		wantIDs  []string
+		// wantErrors are the stage and source of the errors, relative to the test directory.
+		wantErrors []string
+	}{
+		{
+			name:     "Uncompressed",
+			fileName: "bundle.json",
+			content:  bundle("plain"),
+			wantIDs:  []string{"plain"},
+		},
+		{
+			name:     "Gzip",
+			fileName: "bundle.json.gz",
+			content:  gz.Bytes(),
+			wantIDs:  []string{"gz"},
+		},
+		{
+			name:       "Zip",
+			fileName:   "bundles.zip",
+			content:    zb.Bytes(),
+			wantIDs:    []string{"zip1", "zip2"},
+			wantErrors: []string{"PARSE bundles.zip!/patient.json"},
+		},
+		{
+			name:       "Not a bundle",
+			fileName:   "patient.json",
+			content:    []byte(`{"resourceType": "Patient", "id": "1"}`),
+			wantErrors: []string{"PARSE patient.json"},
+		},
+		{
+			name:       "Invalid JSON",
+			fileName:   "bundle.json",
+			content:    []byte(`{"resourceType": "Bundle", `),
+			wantErrors: []string{"PARSE bundle.json"},
+		},
+		{
+			name:       "Corrupt gzip",
+			fileName:   "bundle.json.gz",
+			content:    gz.Bytes()[:12],
+			wantErrors: []string{"LOAD bundle.json.gz"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tc.fileName)
+			if err := os.WriteFile(path, tc.content, 0644); err != nil {
+				t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+			}
+			file := fileio.ReadableFile{Metadata: fileio.FileMetadata{Path: path}}
+
+			var gotIDs, gotErrors []string
+			FileToBundle(context.Background(), file,
+				func(b *bpb.Bundle) { gotIDs = append(gotIDs, b.GetId().GetValue()) },
+				func(e *cbpb.BeamError) {
+					source, _ := filepath.Rel(dir, e.GetSourceUri())
+					gotErrors = append(gotErrors, e.GetStage().String()+" "+source)
+				})
+
+			if diff := cmp.Diff(tc.wantIDs, gotIDs); diff != "" {
+				t.Errorf("FileToBundle() bundle ids diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantErrors, gotErrors); diff != "" {
+				t.Errorf("FileToBundle() errors diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
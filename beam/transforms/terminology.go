@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"sync"
+
+	"github.com/google/cql/terminology"
+)
+
+// terminologyCache holds the terminology providers loaded by this worker process, keyed by the
+// sha256 of their encoding. Every CQLEvalFn instance in the process shares the provider, so the
+// terminology is decoded and indexed once per worker rather than once per DoFn instance.
+var terminologyCache = struct {
+	sync.Mutex
+	providers map[[sha256.Size]byte]*terminology.LocalFHIRProvider
+}{providers: make(map[[sha256.Size]byte]*terminology.LocalFHIRProvider)}
+
+// EncodeTerminology loads the FHIR terminology resources, which may be CodeSystems, ValueSets or
+// Bundles of them, to validate them and returns them compressed for CQLEvalFn.Terminology. Large
+// value set expansions are often much smaller compressed, which keeps them from bloating the
+// serialized pipeline.
+func EncodeTerminology(jsons []string) ([]byte, error) {
+	if _, err := terminology.NewInMemoryFHIRProvider(jsons); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(jsons); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadTerminology returns the terminology provider for terminology encoded by EncodeTerminology,
+// which is shared by all callers in the process.
+func loadTerminology(encoded []byte) (*terminology.LocalFHIRProvider, error) {
+	key := sha256.Sum256(encoded)
+	terminologyCache.Lock()
+	defer terminologyCache.Unlock()
+	if p, ok := terminologyCache.providers[key]; ok {
+		return p, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode terminology: %w", err)
+	}
+	var jsons []string
+	if err := gob.NewDecoder(zr).Decode(&jsons); err != nil {
+		return nil, fmt.Errorf("failed to decode terminology: %w", err)
+	}
+	p, err := terminology.NewInMemoryFHIRProvider(jsons)
+	if err != nil {
+		return nil, err
+	}
+	terminologyCache.providers[key] = p
+	return p, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transforms
+
+import (
+	"testing"
+
+	"github.com/google/cql/terminology"
+)
+
+func TestEncodeTerminology(t *testing.T) {
+	vs := `{"resourceType": "ValueSet", "url": "https://example.com/vs/glucose", "version": "1.0.0",
+		"expansion": {"contains": [{"system": "https://example.com/system", "code": "54321"}]}}`
+	encoded, err := EncodeTerminology([]string{vs})
+	if err != nil {
+		t.Fatalf("EncodeTerminology() returned an unexpected error: %v", err)
+	}
+
+	p, err := loadTerminology(encoded)
+	if err != nil {
+		t.Fatalf("loadTerminology() returned an unexpected error: %v", err)
+	}
+	in, err := p.AnyInValueSet([]terminology.Code{{System: "https://example.com/system", Code: "54321"}}, "https://example.com/vs/glucose", "")
+	if err != nil || !in {
+		t.Errorf("AnyInValueSet() = %v, %v, want true", in, err)
+	}
+
+	again, err := loadTerminology(encoded)
+	if err != nil {
+		t.Fatalf("loadTerminology() returned an unexpected error: %v", err)
+	}
+	if again != p {
+		t.Errorf("loadTerminology() did not reuse the provider loaded for the same terminology")
+	}
+}
+
+func TestEncodeTerminologyError(t *testing.T) {
+	if _, err := EncodeTerminology([]string{`{"resourceType": "ValueSet", `}); err == nil {
+		t.Errorf("EncodeTerminology() succeeded, want error for invalid JSON")
+	}
+	if _, err := loadTerminology([]byte("not gzip")); err == nil {
+		t.Errorf("loadTerminology() succeeded, want error for invalid encoding")
+	}
+}
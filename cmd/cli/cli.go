@@ -16,62 +16,147 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/cql"
+	"github.com/google/cql/internal/compression"
 	"github.com/google/cql/internal/datehelpers"
 	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/internal/resourcewrapper"
+	"github.com/google/cql/measure"
 	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
 	"github.com/google/cql/retriever/local"
 	"github.com/google/cql/terminology"
 	"github.com/google/fhir/go/fhirversion"
 	"github.com/google/fhir/go/jsonformat"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
 	"github.com/google/bulk_fhir_tools/gcs"
 )
 
 type cliConfig struct {
-	CQLDir                     string
-	ExecutionTimestampOverride string
-	FHIRBundleDir              string
-	FHIRTerminologyDir         string
-	FHIRParametersFile         string
-	GCPProject                 string
-	Parameters                 string
-	ReturnPrivateDefs          bool
-	JSONOutputDir              string
-	Version                    bool
+	// Config is the path of a YAML or JSON file holding the values of the other flags, keyed by flag
+	// name. If not set, defaultConfigFile in the working directory is used if it exists.
+	Config                     string         `yaml:"-"`
+	CQLDir                     string         `yaml:"cql_dir"`
+	LibraryVersions            string         `yaml:"library_versions"`
+	ExecutionTimestampOverride string         `yaml:"execution_timestamp_override"`
+	FHIRBundleDir              string         `yaml:"fhir_bundle_dir"`
+	FHIRNDJSONDir              string         `yaml:"fhir_ndjson_dir"`
+	FHIRServerURL              string         `yaml:"fhir_server_url"`
+	FHIRServerBearerToken      string         `yaml:"fhir_server_bearer_token"`
+	FHIRServerGCPAuth          bool           `yaml:"fhir_server_gcp_auth"`
+	PatientIDs                 string         `yaml:"patient_id"`
+	FHIRTerminologyDir         string         `yaml:"fhir_terminology_dir"`
+	FHIRTerminologyManifest    string         `yaml:"fhir_terminology_manifest"`
+	TerminologyServerURL       string         `yaml:"terminology_server_url"`
+	VSACAPIKey                 string         `yaml:"vsac_api_key"`
+	TerminologyCacheDir        string         `yaml:"terminology_cache_dir"`
+	TerminologyCacheTTL        time.Duration  `yaml:"terminology_cache_ttl"`
+	FHIRParametersFile         string         `yaml:"fhir_parameters_file"`
+	LookupCodeDisplays         bool           `yaml:"lookup_code_displays"`
+	SlowTerminologyThreshold   time.Duration  `yaml:"slow_terminology_threshold"`
+	GCPProject                 string         `yaml:"gcp_project"`
+	Parameters                 string         `yaml:"parameters"`
+	Parameter                  parameterFlags `yaml:"parameter"`
+	ParametersFile             string         `yaml:"parameters_file"`
+	ReturnPrivateDefs          bool           `yaml:"return_private_defs"`
+	Defines                    string         `yaml:"defines"`
+	IncludeDefines             string         `yaml:"include_defines"`
+	IncludeDefinesRegex        string         `yaml:"include_defines_regex"`
+	ExcludeDefines             string         `yaml:"exclude_defines"`
+	ExcludeDefinesRegex        string         `yaml:"exclude_defines_regex"`
+	Provenance                 bool           `yaml:"provenance"`
+	FHIRResourceRendering      string         `yaml:"fhir_resource_rendering"`
+	JSONOutputDir              string         `yaml:"json_output_dir"`
+	OutputFormat               string         `yaml:"output_format"`
+	Measure                    string         `yaml:"measure"`
+	Concurrency                int            `yaml:"concurrency"`
+	EmitELM                    bool           `yaml:"emit_elm"`
+	Watch                      bool           `yaml:"watch"`
+	Profile                    bool           `yaml:"profile"`
+	ErrorFormat                string         `yaml:"error_format"`
+	Version                    bool           `yaml:"-"`
 
 	// Should not be set directly by a flag.
 	gcsEndpoint string
+	// jsonOptions is parsed from the flags by mainWrapper.
+	jsonOptions result.JSONOptions
+	// measure and measureConfig generate the MeasureReports of the measurereport output format.
+	// measure is set by mainWrapper from --measure, the measurement period of measureConfig by the
+	// measure subcommand.
+	measure       *measure.Measure
+	measureConfig measure.Config
+	// onResult if set is called with the results of each evaluation, keyed by the name of its output
+	// file. It may be called concurrently.
+	onResult func(fileName string, libs result.Libraries)
+	// profile collects the --profile report, and is set by mainWrapper if --profile is set.
+	profile *profile
 }
 
 func (cfg *cliConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Config, "config", "", "(Optional) A YAML or JSON file holding the values of the other flags, keyed by flag name. Flags passed on the command line take precedence over the file. If not set, "+defaultConfigFile+" in the working directory is used if it exists.")
 	fs.StringVar(&cfg.CQLDir, "cql_dir", "", "(Required) Directory holding 1 or more CQL files.")
+	fs.StringVar(&cfg.LibraryVersions, "library_versions", libraryVersionsAll, "(Optional) How to handle several versions of the same library in --cql_dir. One of all (the default) to use every version, latest to only use the latest version of each library, or error to fail. The versions found and used are printed to stderr.")
 	fs.StringVar(
 		&cfg.ExecutionTimestampOverride,
 		"execution_timestamp_override",
 		"",
 		"(Optional) A DateTime to use for overriding the default execution timestamp of the CQL engine. The value of should match the format of a CQL DateTime. If the value provided doesn't contain a timezone utc the default will be UTC. If not supplied the engine will use the current DateTime. Example: @2024-01-01T00:00:00Z",
 	)
-	fs.StringVar(&cfg.FHIRBundleDir, "fhir_bundle_dir", "", "(Optional) Directory holding FHIR Bundle JSON files.")
+	fs.StringVar(&cfg.FHIRBundleDir, "fhir_bundle_dir", "", "(Optional) Directory holding FHIR Bundle JSON files, or a single FHIR Bundle JSON file. Bundles may be compressed (.json.gz, .json.zst) or zipped (.zip).")
+	fs.StringVar(&cfg.FHIRNDJSONDir, "fhir_ndjson_dir", "", "(Optional) Directory holding bulk export style NDJSON files with one FHIR resource per line, which are grouped by patient and evaluated once for each patient. Files may be compressed (.ndjson.gz, .ndjson.zst) or zipped (.zip). Can not be used with --fhir_bundle_dir.")
+	fs.StringVar(&cfg.FHIRServerURL, "fhir_server_url", "", "(Optional) The FHIR base URL of a FHIR R4 server to evaluate the patients of --patient_id against, for example https://hapi.fhir.org/baseR4. Resources are fetched with compartment searches as the CQL retrieves them. Can not be used with --fhir_bundle_dir or --fhir_ndjson_dir.")
+	fs.StringVar(&cfg.FHIRServerBearerToken, "fhir_server_bearer_token", "", "(Optional) A bearer token sent with every request to --fhir_server_url. If not set the "+fhirServerBearerTokenEnv+" environment variable is used.")
+	fs.BoolVar(&cfg.FHIRServerGCPAuth, "fhir_server_gcp_auth", false, "(Optional) If true, requests to --fhir_server_url are authenticated with Google Application Default Credentials, as needed for a Cloud Healthcare API FHIR store.")
+	fs.StringVar(&cfg.PatientIDs, "patient_id", "", "(Optional) A comma separated list of the ids of the patients on --fhir_server_url to evaluate. Required with --fhir_server_url.")
 	fs.StringVar(&cfg.FHIRTerminologyDir, "fhir_terminology_dir", "", "(Optional) Directory holding FHIR Valueset JSONs.")
+	fs.StringVar(&cfg.FHIRTerminologyManifest, "fhir_terminology_manifest", "", "(Optional) A FHIR Parameters or Library JSON file pinning the ValueSet versions to use. Every ValueSet referenced by the CQL must be pinned or versioned and present in --fhir_terminology_dir, otherwise the CLI fails before evaluation.")
+	fs.StringVar(&cfg.TerminologyServerURL, "terminology_server_url", "", "(Optional) The base URL of a VSAC compatible FHIR terminology server, such as "+terminology.DefaultVSACBaseURL+", from which the ValueSets used by the CQL are expanded as they are needed. Can not be used with --fhir_terminology_dir.")
+	fs.StringVar(&cfg.VSACAPIKey, "vsac_api_key", "", "(Optional) The UMLS API key used to authenticate with --terminology_server_url. If not set the "+vsacAPIKeyEnv+" environment variable is used.")
+	fs.StringVar(&cfg.TerminologyCacheDir, "terminology_cache_dir", "", "(Optional) A local directory in which to cache the ValueSets expanded by --terminology_server_url across runs. Expired entries are used if the server can not be reached.")
+	fs.DurationVar(&cfg.TerminologyCacheTTL, "terminology_cache_ttl", 24*time.Hour, "(Optional) How long entries in --terminology_cache_dir are used before being refreshed from --terminology_server_url. Zero means entries never expire.")
+	fs.DurationVar(&cfg.SlowTerminologyThreshold, "slow_terminology_threshold", 0, "(Optional) If set, every terminology call (such as a ValueSet expansion or membership check) that takes at least this long is logged. Example: --slow_terminology_threshold=100ms")
 	fs.StringVar(&cfg.FHIRParametersFile, "fhir_parameters_file", "", "(Optional) A JSON file holding FHIR Parameters to use during CQL execution. Currently only supports R4.")
 	fs.StringVar(&cfg.Parameters, "parameters", "", "(Optional) A comma separated list of parameters to pass to the CQL execution. Example: --parameters=\"aString='string value',integerValue=2\"")
+	fs.Var(&cfg.Parameter, "parameter", "(Optional, repeated) A parameter to pass to the CQL execution in the form [Library.]Name=value, where value is a CQL literal. Unlike --parameters the value may contain commas. Example: --parameter=\"MyMeasure.Measurement Period=Interval[@2024-01-01, @2025-01-01)\"")
+	fs.StringVar(&cfg.ParametersFile, "parameters_file", "", "(Optional) A JSON file holding an object of parameter names, optionally qualified by library, to CQL literals to pass to the CQL execution. Example: {\"MyMeasure.Measurement Period\": \"Interval[@2024-01-01, @2025-01-01)\"}")
 	fs.StringVar(&cfg.GCPProject, "gcp_project", "", "(Optional) The GCP project to use when reading from or writing to GCS.")
 
 	// Output flags.
 	fs.BoolVar(&cfg.ReturnPrivateDefs, "return_private_defs", false, "(Optional) If true, will include the output of all private CQL expression definitions. By default only public definitions are outputted. This should only be used for debugging purposes.")
+	fs.StringVar(&cfg.Defines, "defines", "", "(Optional) A comma separated list of the CQL expression definitions to evaluate and output, either by name or qualified by library name, where * and ? match any characters. Only these definitions and the definitions they depend on are evaluated. Can not be used with --include_defines or --include_defines_regex. Example: --defines=\"Numerator,MyMeasure.Stratum*\"")
+	fs.StringVar(&cfg.IncludeDefines, "include_defines", "", "(Optional) A comma separated list of CQL expression definitions to output, either by name or qualified by library name. Example: --include_defines=\"Numerator,MyMeasure.Denominator\"")
+	fs.StringVar(&cfg.IncludeDefinesRegex, "include_defines_regex", "", "(Optional) Only CQL expression definitions whose name or library qualified name matches this regular expression are output. Combined with --include_defines, definitions matching either are output.")
+	fs.StringVar(&cfg.ExcludeDefines, "exclude_defines", "", "(Optional) A comma separated list of CQL expression definitions to leave out of the output, either by name or qualified by library name. Takes precedence over the include flags.")
+	fs.StringVar(&cfg.ExcludeDefinesRegex, "exclude_defines_regex", "", "(Optional) CQL expression definitions whose name or library qualified name matches this regular expression are left out of the output. Takes precedence over the include flags.")
+	fs.BoolVar(&cfg.Provenance, "provenance", false, "(Optional) If true, each output includes the FHIR resources (for example Condition/123) that flowed into the value of each CQL expression definition.")
+	fs.StringVar(&cfg.FHIRResourceRendering, "fhir_resource_rendering", "", "(Optional) How FHIR resources returned by CQL expression definitions are rendered in the output. One of proto (the default) for the JSON of the underlying FHIR proto, fhir for FHIR JSON, or reference for only the resource type and id.")
+	fs.BoolVar(&cfg.LookupCodeDisplays, "lookup_code_displays", false, "(Optional) If true, Codes in the output without a display are given their preferred display from the CodeSystems and ValueSets in --fhir_terminology_dir.")
 	fs.StringVar(&cfg.JSONOutputDir, "json_output_dir", "", "(Optional) Directory in which to output each evaluation result as a JSON file. If not supplied will output in the current directory.")
+	fs.StringVar(&cfg.OutputFormat, "output_format", outputFormatJSON, "(Optional) The format of the results written to --json_output_dir. One of json (the default) for one JSON file per evaluated bundle, ndjson for a single results.ndjson file with one line per evaluated bundle, csv for a single results.csv file with one row per expression definition per evaluated bundle, parameters for one FHIR Parameters resource per evaluated bundle, or measurereport for one individual FHIR MeasureReport per evaluated bundle and a summary MeasureReport in measure_report.json.")
+	fs.StringVar(&cfg.Measure, "measure", "", "(Optional) A FHIR Measure JSON file whose populations reference the CQL expression definitions. Required by --output_format=measurereport.")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 1, "(Optional) The number of bundles to evaluate in parallel.")
+	fs.BoolVar(&cfg.Watch, "watch", false, "(Optional) If true, the CLI keeps running and evaluates the CQL again every time a file in --cql_dir is saved, printing the changes to the results of each expression definition. --cql_dir must be a local directory.")
+	fs.BoolVar(&cfg.Profile, "profile", false, "(Optional) If true, a report of the evaluation time and retrieve count of each expression definition, and of the retriever and terminology calls, is printed to stderr after the run. Private definitions are only included if --return_private_defs is set.")
+	fs.StringVar(&cfg.ErrorFormat, "error_format", errorFormatText, errorFormatUsage)
+	fs.BoolVar(&cfg.EmitELM, "emit_elm", false, "(Optional) If true, the CQL is only parsed and the ELM JSON of each library is written to --json_output_dir, without evaluating. Useful for validating and compiling CQL in build pipelines.")
 
 	// See: https://cql.hl7.org/history.html for CQL versions.
 	fs.BoolVar(&cfg.Version, "V", false, "(Optional) Prints the current version of the CQL engine and CQL version.")
@@ -81,10 +166,18 @@ func (cfg *cliConfig) RegisterFlags(fs *flag.FlagSet) {
 	cfg.gcsEndpoint = gcs.DefaultCloudStorageEndpoint
 }
 
-const usageMessage = "The CLI for the golang CQL engine."
+const usageMessage = "The CLI for the golang CQL engine. Run `cli <command> --help` for the " +
+	downloadValueSetsCommand + " (ValueSet download), " + validateCommand + " (CQL validation), " +
+	testCommand + " (golden CQL tests), " + measureCommand + " (MeasureReports), " + explainCommand +
+	" (explaining a result), " + dataRequirementsCommand + " (data requirements), " + depsCommand +
+	" (dependency graphs) and " + fmtCommand + " (CQL formatting) commands."
 
 var errMissingFlag = errors.New("missing required flag")
 
+var errIncompatibleFlags = errors.New("incompatible flags")
+
+var errInvalidFlag = errors.New("invalid flag")
+
 // The config which is populated by the CLI input flags.
 var config cliConfig
 
@@ -97,11 +190,64 @@ func init() {
 	}
 }
 
+// subcommand is a CLI subcommand, selected by the first argument.
+type subcommand struct {
+	name string
+	// run parses the flags of the subcommand from args and runs it, writing its output to w. It sets
+	// errorFormat to the --error_format flag of the subcommand, which the returned error is reported
+	// in.
+	run func(ctx context.Context, args []string, w io.Writer, errorFormat *string) error
+}
+
+var subcommands = []subcommand{
+	{name: validateCommand, run: runValidate},
+	{name: testCommand, run: runTest},
+	{name: fmtCommand, run: runFmt},
+	{name: depsCommand, run: runDeps},
+	{name: explainCommand, run: runExplain},
+	{name: measureCommand, run: func(ctx context.Context, args []string, _ io.Writer, errorFormat *string) error {
+		return runMeasure(ctx, args, errorFormat)
+	}},
+	{name: dataRequirementsCommand, run: runDataRequirements},
+	{name: downloadValueSetsCommand, run: func(ctx context.Context, args []string, _ io.Writer, errorFormat *string) error {
+		return runDownloadValueSets(ctx, args, errorFormat)
+	}},
+}
+
 func main() {
-	flag.Parse()
 	ctx := context.Background()
+	if len(os.Args) > 1 {
+		for _, cmd := range subcommands {
+			if os.Args[1] != cmd.name {
+				continue
+			}
+			errorFormat := errorFormatText
+			if err := cmd.run(ctx, os.Args[2:], os.Stdout, &errorFormat); err != nil {
+				fatal(cmd.name, errorFormat, err)
+			}
+			return
+		}
+	}
+	flag.Parse()
+	if err := loadConfigFile(ctx, &config, flag.CommandLine, "."); err != nil {
+		fatal("", config.ErrorFormat, err)
+	}
+	if config.FHIRServerBearerToken == "" {
+		config.FHIRServerBearerToken = os.Getenv(fhirServerBearerTokenEnv)
+	}
+	if config.VSACAPIKey == "" {
+		config.VSACAPIKey = os.Getenv(vsacAPIKeyEnv)
+	}
+	if config.Watch {
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		if err := watchCQL(ctx, config, os.Stdout); err != nil {
+			fatal("", config.ErrorFormat, err)
+		}
+		return
+	}
 	if err := mainWrapper(ctx, config); err != nil {
-		log.Fatalf("CQL CLI failed with an error: %v", err)
+		fatal("", config.ErrorFormat, err)
 	}
 }
 
@@ -109,6 +255,9 @@ func validateConfig(ctx context.Context, cfg *cliConfig) error {
 	if cfg.CQLDir == "" {
 		return fmt.Errorf("%w --cql_dir", errMissingFlag)
 	}
+	if cfg.Watch && strings.HasPrefix(cfg.CQLDir, "gs://") {
+		return fmt.Errorf("%w --watch requires a local --cql_dir, got %s", errInvalidFlag, cfg.CQLDir)
+	}
 	err := validatePath(ctx, cfg.CQLDir, cfg.GCPProject, cfg.gcsEndpoint, "cql_dir")
 	if err != nil {
 		return err
@@ -119,18 +268,80 @@ func validateConfig(ctx context.Context, cfg *cliConfig) error {
 			return err
 		}
 	}
+	if cfg.FHIRNDJSONDir != "" {
+		if cfg.FHIRBundleDir != "" {
+			return fmt.Errorf("%w --fhir_bundle_dir and --fhir_ndjson_dir, only one source of FHIR data may be set", errIncompatibleFlags)
+		}
+		err := validatePath(ctx, cfg.FHIRNDJSONDir, cfg.GCPProject, cfg.gcsEndpoint, "fhir_ndjson_dir")
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.FHIRServerURL != "" {
+		if cfg.FHIRBundleDir != "" || cfg.FHIRNDJSONDir != "" {
+			return fmt.Errorf("%w --fhir_server_url and --fhir_bundle_dir or --fhir_ndjson_dir, only one source of FHIR data may be set", errIncompatibleFlags)
+		}
+		if len(patientIDs(cfg.PatientIDs)) == 0 {
+			return fmt.Errorf("%w --patient_id, which is required when --fhir_server_url is set", errMissingFlag)
+		}
+		if _, err := url.ParseRequestURI(cfg.FHIRServerURL); err != nil {
+			return fmt.Errorf("%w --fhir_server_url: %v", errInvalidFlag, err)
+		}
+	} else if cfg.PatientIDs != "" {
+		return fmt.Errorf("%w --fhir_server_url, which is required when --patient_id is set", errMissingFlag)
+	}
 	if cfg.FHIRTerminologyDir != "" {
 		err := validatePath(ctx, cfg.FHIRTerminologyDir, cfg.GCPProject, cfg.gcsEndpoint, "fhir_terminology_dir")
 		if err != nil {
 			return err
 		}
 	}
+	if cfg.Defines != "" && (cfg.IncludeDefines != "" || cfg.IncludeDefinesRegex != "") {
+		return fmt.Errorf("%w --defines and --include_defines or --include_defines_regex, since both select the definitions to output", errIncompatibleFlags)
+	}
+	if cfg.TerminologyServerURL != "" {
+		if cfg.FHIRTerminologyDir != "" {
+			return fmt.Errorf("%w --terminology_server_url and --fhir_terminology_dir, only one source of terminology may be set", errIncompatibleFlags)
+		}
+		if cfg.VSACAPIKey == "" {
+			return fmt.Errorf("%w --vsac_api_key (or set the %s environment variable), which is required when --terminology_server_url is set", errMissingFlag, vsacAPIKeyEnv)
+		}
+		if _, err := url.ParseRequestURI(cfg.TerminologyServerURL); err != nil {
+			return fmt.Errorf("%w --terminology_server_url: %v", errInvalidFlag, err)
+		}
+	} else if cfg.TerminologyCacheDir != "" {
+		return fmt.Errorf("%w --terminology_server_url, which is required when --terminology_cache_dir is set", errMissingFlag)
+	}
+	if cfg.FHIRTerminologyManifest != "" && cfg.FHIRTerminologyDir == "" {
+		return fmt.Errorf("%w --fhir_terminology_dir, which is required when --fhir_terminology_manifest is set", errMissingFlag)
+	}
+	if cfg.LookupCodeDisplays && cfg.FHIRTerminologyDir == "" && cfg.TerminologyServerURL == "" {
+		return fmt.Errorf("%w --fhir_terminology_dir or --terminology_server_url, one of which is required when --lookup_code_displays is set", errMissingFlag)
+	}
 	if cfg.JSONOutputDir != "" {
 		err := validatePath(ctx, cfg.JSONOutputDir, cfg.GCPProject, cfg.gcsEndpoint, "json_output_dir")
 		if err != nil {
 			return err
 		}
 	}
+	if err := validateOutputFormat(cfg.OutputFormat); err != nil {
+		return err
+	}
+	if err := validateErrorFormat(cfg.ErrorFormat); err != nil {
+		return err
+	}
+	if err := validateLibraryVersions(cfg.LibraryVersions); err != nil {
+		return err
+	}
+	if cfg.OutputFormat == outputFormatMeasureReport && cfg.Measure == "" {
+		return fmt.Errorf("%w --measure, which is required by --output_format=%s", errMissingFlag, outputFormatMeasureReport)
+	}
+	if cfg.Concurrency < 0 {
+		return fmt.Errorf("%w --concurrency, which must not be negative, got %d", errInvalidFlag, cfg.Concurrency)
+	}
+	if cfg.EmitELM && (cfg.FHIRBundleDir != "" || cfg.FHIRNDJSONDir != "" || cfg.FHIRServerURL != "") {
+		return fmt.Errorf("%w --emit_elm and --fhir_bundle_dir, --fhir_ndjson_dir or --fhir_server_url, since no evaluation takes place with --emit_elm", errIncompatibleFlags)
+	}
 	return nil
 }
 
@@ -185,43 +396,88 @@ func mainWrapper(ctx context.Context, cfg cliConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to read CQL libraries: %w", err)
 	}
+	if cqlLibs, err = resolveLibraryVersions(cqlLibs, cfg.LibraryVersions, os.Stderr); err != nil {
+		return err
+	}
 	fhirDM, err := cql.FHIRDataModel("4.0.1")
 	if err != nil {
 		return fmt.Errorf("failed to create FHIR data model: %w", err)
 	}
 	config := cql.ParseConfig{DataModels: [][]byte{fhirDM}}
-	if cfg.FHIRParametersFile != "" {
-		parametersText, err := iohelpers.ReadFile(ctx, cfg.FHIRParametersFile, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
-		if err != nil {
-			return fmt.Errorf("failed to read FHIR parameters file %s: %w", cfg.FHIRParametersFile, err)
-		}
-		params, err := parseFHIRParameters(parametersText)
-		if err != nil {
-			return fmt.Errorf("failed to parse FHIR parameters file %s: %w", cfg.FHIRParametersFile, err)
-		}
-		config.Parameters = params
-	}
-	if cfg.Parameters != "" {
-		for _, param := range strings.Split(cfg.Parameters, ",") {
-			parts := strings.Split(param, "=")
-			if len(parts) != 2 {
-				return fmt.Errorf("--parameters was passed an invalid input string: %s", param)
-			}
-			config.Parameters[result.DefKey{Name: parts[0]}] = parts[1]
-		}
+	rawParams, err := rawParameters(ctx, &cfg)
+	if err != nil {
+		return err
 	}
 	elm, err := cql.Parse(ctx, cqlLibs, config)
 	if err != nil {
 		return fmt.Errorf("failed to parse CQL: %w", err)
 	}
-	tp, err := maybeGetTerminologyProvider(ctx, cfg.FHIRTerminologyDir, &cfg)
+	if len(rawParams) > 0 {
+		// Parameters are keyed by library version, which is only known once the CQL is parsed, so the
+		// CQL is parsed again with the parameters.
+		if config.Parameters, err = resolveParameters(elm, rawParams); err != nil {
+			return err
+		}
+		if elm, err = cql.Parse(ctx, cqlLibs, config); err != nil {
+			return fmt.Errorf("failed to parse CQL parameters: %w", err)
+		}
+	}
+	if cfg.EmitELM {
+		return outputELM(ctx, elm, cfg.JSONOutputDir, &cfg)
+	}
+	var tp terminology.Provider
+	if cfg.TerminologyServerURL != "" {
+		tp, err = remoteTerminologyProvider(&cfg)
+	} else {
+		tp, err = maybeGetTerminologyProvider(ctx, cfg.FHIRTerminologyDir, &cfg)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get terminology: %w", err)
 	}
+	if cfg.FHIRTerminologyManifest != "" {
+		tp, err = pinTerminology(ctx, tp, elm, cfg.FHIRTerminologyManifest, &cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	includeDefines, includeDefinesRegex := cfg.IncludeDefines, cfg.IncludeDefinesRegex
+	if cfg.Defines != "" {
+		includeDefines, includeDefinesRegex = splitDefineGlobs(cfg.Defines)
+	}
+	defineFilter, err := result.ParseDefineFilter(includeDefines, includeDefinesRegex, cfg.ExcludeDefines, cfg.ExcludeDefinesRegex)
+	if err != nil {
+		return err
+	}
+	if cfg.FHIRResourceRendering != "" {
+		if cfg.jsonOptions.Resources, err = result.ParseResourceRendering(cfg.FHIRResourceRendering); err != nil {
+			return fmt.Errorf("--fhir_resource_rendering: %w", err)
+		}
+	}
+
+	if cfg.Measure != "" {
+		b, err := iohelpers.ReadFile(ctx, cfg.Measure, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+		if err != nil {
+			return fmt.Errorf("failed to read measure %s: %w", cfg.Measure, err)
+		}
+		if cfg.measure, err = measure.ParseMeasure(b); err != nil {
+			return fmt.Errorf("failed to parse measure %s: %w", cfg.Measure, err)
+		}
+	}
 
 	evalConfig := cql.EvalConfig{
-		ReturnPrivateDefs: cfg.ReturnPrivateDefs,
-		Terminology:       tp,
+		ReturnPrivateDefs:        cfg.ReturnPrivateDefs,
+		Terminology:              tp,
+		SlowTerminologyThreshold: cfg.SlowTerminologyThreshold,
+		DefineFilter:             defineFilter,
+		SkipFilteredDefines:      cfg.Defines != "",
+	}
+	if cfg.Profile {
+		if cfg.profile == nil {
+			cfg.profile = newProfile()
+		}
+		evalConfig.DefinitionStats = true
+		evalConfig.Metrics = cfg.profile
 	}
 	if cfg.ExecutionTimestampOverride != "" {
 		t, _, err := datehelpers.ParseDateTime(cfg.ExecutionTimestampOverride, time.UTC)
@@ -229,65 +485,334 @@ func mainWrapper(ctx context.Context, cfg cliConfig) error {
 			return fmt.Errorf("failed to parse execution timestamp override to a valid DateTime value: %w", err)
 		}
 		evalConfig.EvaluationTimestamp = t
+		cfg.measureConfig.Date = t
 	}
 	if err = runCQLWithBundleDir(ctx, elm, cfg.FHIRBundleDir, cfg.JSONOutputDir, evalConfig, &cfg); err != nil {
 		return fmt.Errorf("failed to run CQL: %w", err)
 	}
+	if cfg.Profile {
+		return cfg.profile.report(os.Stderr)
+	}
 	return nil
 }
 
+// bundleFileSuffixes are the suffixes of files in the FHIR bundle directory that are evaluated.
+// Compressed bundles and zip archives of bundles are decompressed before evaluation.
+var bundleFileSuffixes = []string{".json", ".json.gz", ".json.zst", ".zip"}
+
 type cqlResult struct {
-	BundleSource string           `json:"bundleSource,omitempty"`
-	EvalResults  result.Libraries `json:"evalResults"`
+	BundleSource string            `json:"bundleSource,omitempty"`
+	PatientID    string            `json:"patientId,omitempty"`
+	EvalResults  result.Libraries  `json:"evalResults"`
+	Provenance   result.Provenance `json:"provenance,omitempty"`
+
+	// jsonOptions configures the JSON encoding of EvalResults.
+	jsonOptions result.JSONOptions
+}
+
+func (r cqlResult) MarshalJSON() ([]byte, error) {
+	evalResults, err := r.EvalResults.MarshalJSONWithOptions(r.jsonOptions)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		BundleSource string            `json:"bundleSource,omitempty"`
+		PatientID    string            `json:"patientId,omitempty"`
+		EvalResults  json.RawMessage   `json:"evalResults"`
+		Provenance   result.Provenance `json:"provenance,omitempty"`
+	}{
+		BundleSource: r.BundleSource,
+		PatientID:    r.PatientID,
+		EvalResults:  evalResults,
+		Provenance:   r.Provenance,
+	})
 }
 
 func runCQLWithBundleDir(ctx context.Context, elm *cql.ELM, fhirBundleDir string, outputDir string, evalConfig cql.EvalConfig, cfg *cliConfig) error {
-	// If fhirBundleDir is empty run one eval with empty bundle retriever.
-	if fhirBundleDir == "" {
-		r, err := elm.Eval(ctx, &local.Retriever{}, evalConfig)
+	sink := newResultSink(outputDir, cfg)
+	// If no FHIR data is given run one eval with empty bundle retriever.
+	if fhirBundleDir == "" && cfg.FHIRNDJSONDir == "" && cfg.FHIRServerURL == "" {
+		r, err := evalCQL(ctx, elm, &local.Retriever{}, evalConfig, cfg)
 		if err != nil {
 			return err
 		}
-		return outputCQLResults(ctx, outputDir, "results.json", cqlResult{EvalResults: r}, cfg)
-	}
-
-	bundleFilePaths, err := iohelpers.FilesWithSuffix(ctx, fhirBundleDir, ".json", &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
-	if err != nil {
-		return err
-	}
-	if len(bundleFilePaths) == 0 {
-		fmt.Printf("no files found in FHIR bundle directory %s, exiting", fhirBundleDir)
-		return nil
+		if err := sink.write(ctx, 0, "results.json", r); err != nil {
+			return err
+		}
+		return sink.close(ctx)
 	}
 
-	// TODO(b/301659936): implement a concurrent version of this.
-	for _, filePath := range bundleFilePaths {
-		fhirData, err := iohelpers.ReadFile(ctx, filePath, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	// produce sends the bundles to evaluate to jobs, until the context is cancelled.
+	var produce func(ctx context.Context, jobs chan<- bundleJob) error
+	if cfg.FHIRServerURL != "" {
+		serverCfg, err := fhirServerConfig(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		produce = func(ctx context.Context, jobs chan<- bundleJob) error {
+			return sendServerPatients(ctx, serverCfg, patientIDs(cfg.PatientIDs), jobs)
+		}
+	} else if cfg.FHIRNDJSONDir != "" {
+		patients, err := readNDJSONDir(ctx, cfg.FHIRNDJSONDir, cfg)
+		if err != nil {
+			return err
+		}
+		if len(patients) == 0 {
+			fmt.Printf("no resources found in FHIR NDJSON directory %s, exiting", cfg.FHIRNDJSONDir)
+			return nil
+		}
+		produce = func(ctx context.Context, jobs chan<- bundleJob) error {
+			return sendPatientBundles(ctx, patients, jobs)
+		}
+	} else {
+		bundleFilePaths, err := bundleFiles(ctx, fhirBundleDir, cfg)
 		if err != nil {
 			return err
 		}
-		ret, err := local.NewRetrieverFromR4Bundle(fhirData)
+		if len(bundleFilePaths) == 0 {
+			fmt.Printf("no files found in FHIR bundle directory %s, exiting", fhirBundleDir)
+			return nil
+		}
+		produce = func(ctx context.Context, jobs chan<- bundleJob) error {
+			return readBundles(ctx, bundleFilePaths, jobs, cfg)
+		}
+	}
+
+	// Eval should not be called from multiple goroutines on a single ELM, so each worker evaluates
+	// its own copy.
+	workers := max(cfg.Concurrency, 1)
+	elms := []*cql.ELM{elm}
+	if workers > 1 {
+		encoded, err := elm.MarshalBinary()
 		if err != nil {
 			return err
 		}
-		r, err := elm.Eval(ctx, ret, evalConfig)
+		for len(elms) < workers {
+			e := &cql.ELM{}
+			if err := e.UnmarshalBinary(encoded); err != nil {
+				return err
+			}
+			elms = append(elms, e)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	jobs := make(chan bundleJob)
+	var wg sync.WaitGroup
+	for _, workerELM := range elms {
+		wg.Add(1)
+		go func(elm *cql.ELM) {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := evalBundle(ctx, elm, job, sink, evalConfig, cfg); err != nil {
+					fail(err)
+				}
+			}
+		}(workerELM)
+	}
+	if err := produce(ctx, jobs); err != nil {
+		fail(err)
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return sink.close(ctx)
+}
+
+// bundleJob is a single FHIR bundle to evaluate.
+type bundleJob struct {
+	// index is the position of the bundle in the input, which orders combined outputs.
+	index int
+	// source identifies the bundle file in the output, and is empty for patients read from NDJSON.
+	source string
+	// patientID identifies the patient of bundles grouped from NDJSON in the output.
+	patientID string
+	// fileName is the name of the per bundle output file.
+	fileName string
+	// One of the JSON data of a bundle file, a bundle proto or a retriever of the patient's
+	// resources is set.
+	data      []byte
+	bundle    *r4pb.Bundle
+	retriever retriever.Retriever
+}
+
+// bundleFiles returns the bundle files to evaluate, which are either the files in the FHIR bundle
+// directory, or the single bundle file if a file is given instead of a directory.
+func bundleFiles(ctx context.Context, fhirBundlePath string, cfg *cliConfig) ([]string, error) {
+	isFile := false
+	if strings.HasPrefix(fhirBundlePath, "gs://") {
+		isFile = slices.ContainsFunc(bundleFileSuffixes, func(suffix string) bool { return strings.HasSuffix(fhirBundlePath, suffix) })
+	} else if info, err := os.Stat(fhirBundlePath); err == nil {
+		isFile = !info.IsDir()
+	}
+	if isFile {
+		return []string{fhirBundlePath}, nil
+	}
+	return iohelpers.FilesWithSuffixes(ctx, fhirBundlePath, bundleFileSuffixes, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+}
+
+// readBundles reads and decompresses the bundle files, sending each bundle to jobs until the
+// context is cancelled.
+func readBundles(ctx context.Context, bundleFilePaths []string, jobs chan<- bundleJob, cfg *cliConfig) error {
+	index := 0
+	fileNames := make(map[string]bool)
+	for _, filePath := range bundleFilePaths {
+		fhirData, err := iohelpers.ReadFile(ctx, filePath, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
 		if err != nil {
 			return err
 		}
 		_, fileName := filepath.Split(filePath)
-		if err := outputCQLResults(ctx, outputDir, fileName, cqlResult{BundleSource: filePath, EvalResults: r}, cfg); err != nil {
+		bundles, err := compression.Decompress(fileName, fhirData)
+		if err != nil {
 			return err
 		}
+		for _, bundle := range bundles {
+			bundleSource := filePath
+			if len(bundles) > 1 {
+				// Bundles from a zip archive are identified by their path within the archive.
+				bundleSource = filePath + "/" + bundle.Name
+			}
+			job := bundleJob{index: index, source: bundleSource, fileName: uniqueFileName(fileNames, filepath.Base(bundle.Name)), data: bundle.Data}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return nil
+			}
+			index++
+		}
 	}
 	return nil
 }
 
+// uniqueFileName returns name, or if it is already in used name with a -2, -3 and so on suffix
+// before its extension, and adds the returned name to used. Bundles with the same file name, like
+// a/patient.json and b/patient.json in one zip archive, then do not overwrite each other's results.
+func uniqueFileName(used map[string]bool, name string) string {
+	ext := filepath.Ext(name)
+	unique := name
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	used[unique] = true
+	return unique
+}
+
+// evalBundle evaluates the CQL against a single bundle and writes the results to the sink.
+func evalBundle(ctx context.Context, elm *cql.ELM, job bundleJob, sink *resultSink, evalConfig cql.EvalConfig, cfg *cliConfig) error {
+	name := job.source
+	if job.patientID != "" {
+		name = "for patient " + job.patientID
+	}
+	var ret retriever.Retriever
+	var err error
+	if job.retriever != nil {
+		ret = job.retriever
+	} else if job.bundle != nil {
+		ret, err = local.NewRetrieverFromR4BundleProto(job.bundle)
+	} else {
+		ret, err = local.NewRetrieverFromR4Bundle(job.data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read bundle %s: %w", name, err)
+	}
+	r, err := evalCQL(ctx, elm, ret, evalConfig, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate bundle %s: %w", name, err)
+	}
+	r.BundleSource = job.source
+	r.PatientID = job.patientID
+	if r.PatientID == "" {
+		if r.PatientID, err = bundlePatientID(ctx, ret); err != nil {
+			return fmt.Errorf("failed to read the patient of bundle %s: %w", name, err)
+		}
+	}
+	return sink.write(ctx, job.index, job.fileName, r)
+}
+
+// bundlePatientID returns the id of the Patient in the bundle, or an empty string if the bundle
+// does not hold exactly one Patient.
+func bundlePatientID(ctx context.Context, ret retriever.Retriever) (string, error) {
+	patients, err := ret.Retrieve(ctx, "Patient")
+	if err != nil || len(patients) != 1 {
+		return "", err
+	}
+	return resourcewrapper.New(patients[0]).ResourceID()
+}
+
+// evalCQL evaluates the CQL against the retriever, computing the provenance of the results and
+// filling in Code displays from the terminology provider if requested.
+func evalCQL(ctx context.Context, elm *cql.ELM, ret retriever.Retriever, evalConfig cql.EvalConfig, cfg *cliConfig) (cqlResult, error) {
+	r, err := elm.Eval(ctx, ret, evalConfig)
+	if err != nil {
+		return cqlResult{}, err
+	}
+	if cfg.profile != nil {
+		cfg.profile.addResults(r)
+	}
+	res := cqlResult{EvalResults: r, jsonOptions: cfg.jsonOptions}
+	if cfg.Provenance {
+		res.Provenance = r.Provenance()
+	}
+	if cfg.LookupCodeDisplays {
+		if res.EvalResults, err = cql.FillCodeDisplays(r, evalConfig.Terminology); err != nil {
+			return cqlResult{}, err
+		}
+	}
+	return res, nil
+}
+
+// terminologyFileSuffixes are the suffixes of files in the FHIR terminology directory that are
+// loaded. JSON files may hold CodeSystems, ValueSets or Bundles of them.
+var terminologyFileSuffixes = []string{".json", ".tgz", ".tar.gz"}
+
+// splitDefineGlobs splits the comma separated --defines flag into a comma separated list of the
+// plain definition names, and a regular expression matching any of the names with * or ? globs.
+func splitDefineGlobs(defines string) (names, regex string) {
+	var plain, globs []string
+	for _, d := range strings.Split(defines, ",") {
+		d = strings.TrimSpace(d)
+		switch {
+		case d == "":
+		case strings.ContainsAny(d, "*?"):
+			g := regexp.QuoteMeta(d)
+			g = strings.ReplaceAll(g, `\*`, ".*")
+			g = strings.ReplaceAll(g, `\?`, ".")
+			globs = append(globs, g)
+		default:
+			plain = append(plain, d)
+		}
+	}
+	if len(globs) > 0 {
+		regex = "^(?:" + strings.Join(globs, "|") + ")$"
+	}
+	return strings.Join(plain, ","), regex
+}
+
 // maybeGetTerminologyProvider constructs a ValueSet terminology provider if provided with a valid directory.
 func maybeGetTerminologyProvider(ctx context.Context, terminologyDir string, cfg *cliConfig) (terminology.Provider, error) {
 	if terminologyDir == "" {
 		return nil, nil
 	}
-	filePaths, err := iohelpers.FilesWithSuffix(ctx, terminologyDir, ".json", &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	filePaths, err := iohelpers.FilesWithSuffixes(ctx, terminologyDir, terminologyFileSuffixes, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
 	if err != nil {
 		return nil, err
 	}
@@ -298,11 +823,41 @@ func maybeGetTerminologyProvider(ctx context.Context, terminologyDir string, cfg
 		if err != nil {
 			return nil, err
 		}
+		if terminology.IsFHIRPackage(filePath) {
+			jsons, err := terminology.ReadFHIRPackage(bytes.NewReader(b))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read FHIR package %s: %w", filePath, err)
+			}
+			jsonTerminologyData = append(jsonTerminologyData, jsons...)
+			continue
+		}
 		jsonTerminologyData = append(jsonTerminologyData, string(b))
 	}
 	return terminology.NewInMemoryFHIRProvider(jsonTerminologyData)
 }
 
+// pinTerminology wraps the terminology provider to use the ValueSet versions pinned by the
+// manifest file, and checks that every ValueSet referenced by the CQL is available in its pinned
+// version.
+func pinTerminology(ctx context.Context, tp terminology.Provider, elm *cql.ELM, manifestFile string, cfg *cliConfig) (terminology.Provider, error) {
+	b, err := iohelpers.ReadFile(ctx, manifestFile, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read terminology manifest %s: %w", manifestFile, err)
+	}
+	m, err := terminology.ParseManifest(b)
+	if err != nil {
+		return nil, err
+	}
+	var refs []terminology.ValueSetRef
+	for _, vs := range elm.ValueSets() {
+		refs = append(refs, terminology.ValueSetRef{URL: vs.ID, Version: vs.Version})
+	}
+	if err := m.Validate(tp, refs, true); err != nil {
+		return nil, fmt.Errorf("terminology does not match manifest %s: %w", manifestFile, err)
+	}
+	return terminology.NewPinnedProvider(tp, m), nil
+}
+
 // readCQLLibs reads all CQL (files containing the .cql suffix) files from a directory.
 func readCQLLibs(ctx context.Context, dir string, cfg *cliConfig) ([]string, error) {
 	filePaths, err := iohelpers.FilesWithSuffix(ctx, dir, ".cql", &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
@@ -374,11 +929,24 @@ func parseFHIRParameters(parametersBytes []byte) (map[result.DefKey]string, erro
 	return r, nil
 }
 
-func outputCQLResults(ctx context.Context, path, fileName string, results cqlResult, cfg *cliConfig) error {
-	// need to update this for different output types
-	jsonResults, err := json.MarshalIndent(results, "", "  ")
+// outputELM writes the ELM JSON of each named library to the output directory, in a file named
+// after the library and its version.
+func outputELM(ctx context.Context, elm *cql.ELM, outputDir string, cfg *cliConfig) error {
+	libs, err := elm.LibrariesJSON()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to convert CQL to ELM: %w", err)
 	}
-	return iohelpers.WriteFile(ctx, path, fileName, jsonResults, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	for key, b := range libs {
+		if key.IsUnnamed {
+			return errors.New("--emit_elm requires every CQL library to be named")
+		}
+		fileName := key.Name + ".json"
+		if key.Version != "" {
+			fileName = key.Name + "-" + key.Version + ".json"
+		}
+		if err := iohelpers.WriteFile(ctx, outputDir, fileName, b, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -15,6 +15,10 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -27,11 +31,13 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/bulk_fhir_tools/testhelpers"
 	"github.com/google/cql/result"
+	"github.com/google/cql/terminology"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
-	"github.com/google/bulk_fhir_tools/testhelpers"
 )
 
 const testBucketName = "bucketName"
@@ -46,16 +52,18 @@ func TestCLI(t *testing.T) {
 		returnPrivateDefs          bool
 		executionTimestampOverride string
 		wantTestResult             string
+		wantTestMetadata           string
 	}{
 		{
 			name: "Simple CLI call with most flags set",
 			cql: `
 			library TESTLIB
 			define TESTRESULT: true`,
-			fhirBundle:      `{"resourceType": "Bundle", "id": "example", "entry": []}`,
-			fhirTerminology: `{"resourceType": "ValueSet", "id": "https://test/emptyVS", "url": "https://test/emptyVS"}`,
-			fhirParameters:  `{"resourceType": "Parameters", "id": "example", "parameter": []}`,
-			wantTestResult:  `{"@type": "System.Boolean", "value": true}`,
+			fhirBundle:       `{"resourceType": "Bundle", "id": "example", "entry": []}`,
+			fhirTerminology:  `{"resourceType": "ValueSet", "id": "https://test/emptyVS", "url": "https://test/emptyVS"}`,
+			fhirParameters:   `{"resourceType": "Parameters", "id": "example", "parameter": []}`,
+			wantTestResult:   `{"@type": "System.Boolean", "value": true}`,
+			wantTestMetadata: `{"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.Boolean", "libVersion": ""}`,
 		},
 		{
 			name: "ReturnPrivateDefs is set and returned",
@@ -65,6 +73,7 @@ func TestCLI(t *testing.T) {
 			fhirBundle:        `{"resourceType": "Bundle", "id": "example", "entry": []}`,
 			returnPrivateDefs: true,
 			wantTestResult:    `{"@type": "System.Boolean", "value": true}`,
+			wantTestMetadata:  `{"kind": "expressionDefinition", "accessLevel": "PRIVATE", "declaredType": "System.Boolean", "libVersion": ""}`,
 		},
 		{
 			name: "Can override execution timestamp",
@@ -74,6 +83,7 @@ func TestCLI(t *testing.T) {
 			fhirBundle:                 `{"resourceType": "Bundle", "id": "example", "entry": []}`,
 			executionTimestampOverride: "@2018-02-02T15:02:03.000-04:00",
 			wantTestResult:             `{"@type": "System.DateTime","value": "@2018-02-02T15:02:03.000-04:00"}`,
+			wantTestMetadata:           `{"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.DateTime", "libVersion": ""}`,
 		},
 	}
 	for _, tc := range tests {
@@ -136,14 +146,381 @@ func TestCLI(t *testing.T) {
 				"bundleSource": "%s",
 				"evalResults": [
 					{
+						"defineMetadata": {
+							"TESTRESULT": %s
+						},
+						"expressionDefinitions": {
+							"TESTRESULT": %s
+						},
+						"formatVersion": "1.1",
+						"libName": "TESTLIB",
+						"libVersion": ""
+					}
+				]
+			}`, bundleFilePath, tc.wantTestMetadata, tc.wantTestResult))))
+			if diff := cmp.Diff(wantResult, gotResult); diff != "" {
+				t.Errorf("mainWrapper() returned an unexpected diff (-want +got): %v", diff)
+			}
+		})
+	}
+}
+
+func TestCLICompressedBundles(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	using FHIR version '4.0.1'
+	context Patient
+	define TESTRESULT: Patient.id.value`)
+
+	bundle := func(id string) []byte {
+		return []byte(fmt.Sprintf(`{"resourceType": "Bundle", "entry": [{"resource": {"resourceType": "Patient", "id": "%s"}}]}`, id))
+	}
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	if _, err := gzw.Write(bundle("gz")); err != nil {
+		t.Fatalf("gzip Write() returned an unexpected error: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("gzip Close() returned an unexpected error: %v", err)
+	}
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, "gz_bundle.json.gz"), gz.String())
+
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	// Files with the same name in different directories do not overwrite each other's results, and
+	// files that are not bundles are skipped.
+	for _, file := range []struct {
+		name    string
+		content []byte
+	}{
+		{name: "bundles/zip1.json", content: bundle("zip1")},
+		{name: "bundles/zip2.json", content: bundle("zip2")},
+		{name: "other/zip1.json", content: bundle("other")},
+		{name: "bundles/README.md", content: []byte("not a bundle")},
+	} {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			t.Fatalf("zip Create() returned an unexpected error: %v", err)
+		}
+		if _, err := f.Write(file.content); err != nil {
+			t.Fatalf("zip Write() returned an unexpected error: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip Close() returned an unexpected error: %v", err)
+	}
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, "bundles.zip"), zb.String())
+
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		FHIRBundleDir: testDirCfg.FHIRBundleDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+	}
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+
+	wantIDs := map[string]string{"gz_bundle.json": "gz", "zip1.json": "zip1", "zip1-2.json": "other", "zip2.json": "zip2"}
+	gotIDs := map[string]string{}
+	entries, err := os.ReadDir(testDirCfg.JSONOutputDir)
+	if err != nil {
+		t.Fatalf("os.ReadDir() returned an unexpected error: %v", err)
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, e.Name()))
+		if err != nil {
+			t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+		}
+		var res struct {
+			EvalResults []struct {
+				ExpressionDefinitions map[string]struct {
+					Value string `json:"value"`
+				} `json:"expressionDefinitions"`
+			} `json:"evalResults"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+		}
+		gotIDs[e.Name()] = res.EvalResults[0].ExpressionDefinitions["TESTRESULT"].Value
+	}
+	if diff := cmp.Diff(wantIDs, gotIDs); diff != "" {
+		t.Errorf("mainWrapper() returned an unexpected diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLIBatchEvaluation(t *testing.T) {
+	cql := `
+	library TESTLIB
+	using FHIR version '4.0.1'
+	context Patient
+	define TESTRESULT: Patient.id.value`
+	bundle := func(id string) string {
+		return fmt.Sprintf(`{"resourceType": "Bundle", "entry": [{"resource": {"resourceType": "Patient", "id": "%s"}}]}`, id)
+	}
+	var ids []string
+	for i := 0; i < 10; i++ {
+		ids = append(ids, fmt.Sprintf("patient%d", i))
+	}
+
+	tests := []struct {
+		name         string
+		outputFormat string
+		concurrency  int
+		singleFile   bool
+		wantFiles    []string
+		wantIDs      []string
+	}{
+		{
+			name:        "JSON file per bundle",
+			concurrency: 4,
+			wantFiles:   []string{"patient0.json", "patient1.json", "patient2.json", "patient3.json", "patient4.json", "patient5.json", "patient6.json", "patient7.json", "patient8.json", "patient9.json"},
+			wantIDs:     ids,
+		},
+		{
+			name:         "Combined NDJSON",
+			outputFormat: outputFormatNDJSON,
+			concurrency:  4,
+			wantFiles:    []string{"results.ndjson"},
+			wantIDs:      ids,
+		},
+		{
+			name:         "Single bundle file",
+			outputFormat: outputFormatNDJSON,
+			singleFile:   true,
+			wantFiles:    []string{"results.ndjson"},
+			wantIDs:      []string{"patient3"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testDirCfg := defaultCLIConfig(t)
+			writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), cql)
+			for _, id := range ids {
+				writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, id+".json"), bundle(id))
+			}
+			cfg := cliConfig{
+				CQLDir:        testDirCfg.CQLDir,
+				FHIRBundleDir: testDirCfg.FHIRBundleDir,
+				JSONOutputDir: testDirCfg.JSONOutputDir,
+				OutputFormat:  tc.outputFormat,
+				Concurrency:   tc.concurrency,
+			}
+			if tc.singleFile {
+				cfg.FHIRBundleDir = filepath.Join(testDirCfg.FHIRBundleDir, "patient3.json")
+			}
+			if err := mainWrapper(context.Background(), cfg); err != nil {
+				t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+			}
+
+			entries, err := os.ReadDir(testDirCfg.JSONOutputDir)
+			if err != nil {
+				t.Fatalf("os.ReadDir() returned an unexpected error: %v", err)
+			}
+			var gotFiles []string
+			var gotIDs []string
+			for _, e := range entries {
+				gotFiles = append(gotFiles, e.Name())
+				b, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, e.Name()))
+				if err != nil {
+					t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+				}
+				dec := json.NewDecoder(bytes.NewReader(b))
+				for dec.More() {
+					var res struct {
+						EvalResults []struct {
+							ExpressionDefinitions map[string]struct {
+								Value string `json:"value"`
+							} `json:"expressionDefinitions"`
+						} `json:"evalResults"`
+					}
+					if err := dec.Decode(&res); err != nil {
+						t.Fatalf("Decode() returned an unexpected error: %v", err)
+					}
+					gotIDs = append(gotIDs, res.EvalResults[0].ExpressionDefinitions["TESTRESULT"].Value)
+				}
+			}
+			if diff := cmp.Diff(tc.wantFiles, gotFiles); diff != "" {
+				t.Errorf("mainWrapper() wrote unexpected files (-want +got): %v", diff)
+			}
+			// Combined outputs are in input order, regardless of the concurrency.
+			if diff := cmp.Diff(tc.wantIDs, gotIDs); diff != "" {
+				t.Errorf("mainWrapper() returned an unexpected diff (-want +got): %v", diff)
+			}
+		})
+	}
+}
+
+func TestCLIBatchEvaluation_Error(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	define TESTRESULT: true`)
+	for i := 0; i < 5; i++ {
+		writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, fmt.Sprintf("bundle%d.json", i)), `{"resourceType": "Bundle", "entry": []}`)
+	}
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, "invalid.json"), `not a bundle`)
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		FHIRBundleDir: testDirCfg.FHIRBundleDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+		Concurrency:   3,
+	}
+	err := mainWrapper(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "invalid.json") {
+		t.Errorf("mainWrapper() returned error %v, want an error naming invalid.json", err)
+	}
+}
+
+func TestCLITerminologyBundlesAndPackages(t *testing.T) {
+	cql := `
+	library TESTLIB
+	private codesystem CS: 'https://test/cs'
+	private valueset BundleVS: 'https://test/bundle-vs'
+	private valueset PackageVS: 'https://test/package-vs'
+	private code C: '1' from CS
+	define InBundleVS: C in BundleVS
+	define InPackageVS: C in PackageVS`
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), cql)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRTerminologyDir, "bundle.json"), `{
+		"resourceType": "Bundle",
+		"entry": [{"resource": {"resourceType": "ValueSet", "url": "https://test/bundle-vs", "expansion": {"contains": [{"system": "https://test/cs", "code": "1"}]}}}]
+	}`)
+
+	var pkg bytes.Buffer
+	gzw := gzip.NewWriter(&pkg)
+	tw := tar.NewWriter(gzw)
+	vs := `{"resourceType": "ValueSet", "url": "https://test/package-vs", "expansion": {"contains": [{"system": "https://test/cs", "code": "1"}]}}`
+	if err := tw.WriteHeader(&tar.Header{Name: "package/ValueSet-package-vs.json", Mode: 0644, Size: int64(len(vs)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("tar WriteHeader() returned an unexpected error: %v", err)
+	}
+	if _, err := tw.Write([]byte(vs)); err != nil {
+		t.Fatalf("tar Write() returned an unexpected error: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close() returned an unexpected error: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("gzip Close() returned an unexpected error: %v", err)
+	}
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRTerminologyDir, "test.package.tgz"), pkg.String())
+
+	cfg := cliConfig{
+		CQLDir:             testDirCfg.CQLDir,
+		FHIRTerminologyDir: testDirCfg.FHIRTerminologyDir,
+		JSONOutputDir:      testDirCfg.JSONOutputDir,
+	}
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	resultBytes, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "results.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	gotResult := string(normalizeJSON(t, resultBytes))
+	wantResult := string(normalizeJSON(t, []byte(`{
+		"evalResults": [
+			{
+				"defineMetadata": {
+					"InBundleVS": {"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.Boolean", "libVersion": ""},
+					"InPackageVS": {"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.Boolean", "libVersion": ""}
+				},
+				"expressionDefinitions": {
+					"InBundleVS": {"@type": "System.Boolean", "value": true},
+					"InPackageVS": {"@type": "System.Boolean", "value": true}
+				},
+				"formatVersion": "1.1",
+				"libName": "TESTLIB",
+				"libVersion": ""
+			}
+		]
+	}`)))
+	if diff := cmp.Diff(wantResult, gotResult); diff != "" {
+		t.Errorf("mainWrapper() returned an unexpected diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLITerminologyManifest(t *testing.T) {
+	cql := `
+	library TESTLIB
+	private codesystem CS: 'https://test/cs'
+	private valueset VS: 'https://test/vs'
+	private code C: '1' from CS
+	define TESTRESULT: C in VS`
+	valueSets := []string{
+		`{"resourceType": "ValueSet", "url": "https://test/vs", "version": "1.0.0", "expansion": {"contains": [{"system": "https://test/cs", "code": "1"}]}}`,
+		`{"resourceType": "ValueSet", "url": "https://test/vs", "version": "2.0.0", "expansion": {"contains": [{"system": "https://test/cs", "code": "2"}]}}`,
+	}
+
+	tests := []struct {
+		name           string
+		manifest       string
+		wantTestResult string
+		wantErr        error
+	}{
+		{
+			name:           "Pinned version is used instead of latest",
+			manifest:       `{"resourceType": "Parameters", "parameter": [{"name": "valueset-version", "valueCanonical": "https://test/vs|1.0.0"}]}`,
+			wantTestResult: `{"@type": "System.Boolean", "value": true}`,
+		},
+		{
+			name:     "Pinned version not present",
+			manifest: `{"resourceType": "Parameters", "parameter": [{"name": "valueset-version", "valueCanonical": "https://test/vs|3.0.0"}]}`,
+			wantErr:  terminology.ErrResourceNotLoaded,
+		},
+		{
+			name:     "ValueSet not pinned",
+			manifest: `{"resourceType": "Parameters", "parameter": []}`,
+			wantErr:  terminology.ErrVersionNotPinned,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testDirCfg := defaultCLIConfig(t)
+			writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), cql)
+			for i, vs := range valueSets {
+				writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRTerminologyDir, fmt.Sprintf("vs%d.json", i)), vs)
+			}
+			manifestFile := filepath.Join(t.TempDir(), "manifest.json")
+			writeLocalFileWithContent(t, manifestFile, tc.manifest)
+			cfg := cliConfig{
+				CQLDir:                  testDirCfg.CQLDir,
+				FHIRTerminologyDir:      testDirCfg.FHIRTerminologyDir,
+				FHIRTerminologyManifest: manifestFile,
+				JSONOutputDir:           testDirCfg.JSONOutputDir,
+			}
+
+			err := mainWrapper(context.Background(), cfg)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("mainWrapper() returned error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+			}
+			resultBytes, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "results.json"))
+			if err != nil {
+				t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+			}
+			gotResult := string(normalizeJSON(t, resultBytes))
+			wantResult := string(normalizeJSON(t, []byte(fmt.Sprintf(`{
+				"evalResults": [
+					{
+						"defineMetadata": {
+							"TESTRESULT": {"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.Boolean", "libVersion": ""}
+						},
 						"expressionDefinitions": {
 							"TESTRESULT": %s
 						},
+						"formatVersion": "1.1",
 						"libName": "TESTLIB",
 						"libVersion": ""
 					}
 				]
-			}`, bundleFilePath, tc.wantTestResult))))
+			}`, tc.wantTestResult))))
 			if diff := cmp.Diff(wantResult, gotResult); diff != "" {
 				t.Errorf("mainWrapper() returned an unexpected diff (-want +got): %v", diff)
 			}
@@ -151,6 +528,389 @@ func TestCLI(t *testing.T) {
 	}
 }
 
+func TestCLILookupCodeDisplays(t *testing.T) {
+	cql := `
+	library TESTLIB
+	private codesystem CS: 'https://test/cs'
+	private code C: '1' from CS
+	define TESTRESULT: C`
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), cql)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRTerminologyDir, "cs.json"), `{"resourceType": "CodeSystem", "url": "https://test/cs", "version": "1.0.0", "concept": [{"code": "1", "display": "One"}]}`)
+	cfg := cliConfig{
+		CQLDir:             testDirCfg.CQLDir,
+		FHIRTerminologyDir: testDirCfg.FHIRTerminologyDir,
+		LookupCodeDisplays: true,
+		JSONOutputDir:      testDirCfg.JSONOutputDir,
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	resultBytes, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "results.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	gotResult := string(normalizeJSON(t, resultBytes))
+	wantResult := string(normalizeJSON(t, []byte(`{
+		"evalResults": [
+			{
+				"defineMetadata": {
+					"TESTRESULT": {"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.Code", "libVersion": ""}
+				},
+				"expressionDefinitions": {
+					"TESTRESULT": {"@type": "System.Code", "system": "https://test/cs", "code": "1", "display": "One"}
+				},
+				"formatVersion": "1.1",
+				"libName": "TESTLIB",
+				"libVersion": ""
+			}
+		]
+	}`)))
+	if diff := cmp.Diff(wantResult, gotResult); diff != "" {
+		t.Errorf("mainWrapper() returned an unexpected diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLIProvenance(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	using FHIR version '4.0.1'
+	context Patient
+	define TESTRESULT: exists ([Encounter] E where E.status.value = 'finished')`)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, "bundle.json"), `{"resourceType": "Bundle", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "1"}},
+		{"resource": {"resourceType": "Encounter", "id": "finished", "status": "finished"}},
+		{"resource": {"resourceType": "Encounter", "id": "planned", "status": "planned"}}
+	]}`)
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		FHIRBundleDir: testDirCfg.FHIRBundleDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+		Provenance:    true,
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	resultBytes, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "bundle.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	var got struct {
+		Provenance json.RawMessage `json:"provenance"`
+	}
+	if err := json.Unmarshal(resultBytes, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	want := string(normalizeJSON(t, []byte(`[
+		{
+			"expressionDefinitions": {"TESTRESULT": ["Encounter/finished"]},
+			"libName": "TESTLIB",
+			"libVersion": ""
+		}
+	]`)))
+	if diff := cmp.Diff(want, string(normalizeJSON(t, got.Provenance))); diff != "" {
+		t.Errorf("mainWrapper() returned an unexpected provenance diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLIParameters(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB version '1.0.0'
+	parameter "Measurement Period" Interval<Date>
+	parameter Threshold Integer
+	define InPeriod: @2024-06-01 in "Measurement Period"
+	define AboveThreshold: 5 > Threshold`)
+	parametersFile := filepath.Join(t.TempDir(), "parameters.json")
+	writeLocalFileWithContent(t, parametersFile, `{"TESTLIB.Threshold": "3"}`)
+	cfg := cliConfig{
+		CQLDir:         testDirCfg.CQLDir,
+		JSONOutputDir:  testDirCfg.JSONOutputDir,
+		Parameter:      parameterFlags{"TESTLIB.Measurement Period=Interval[@2024-01-01, @2025-01-01)"},
+		ParametersFile: parametersFile,
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	resultBytes, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "results.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	var got struct {
+		EvalResults []struct {
+			ExpressionDefinitions map[string]struct {
+				Value any `json:"value"`
+			} `json:"expressionDefinitions"`
+		} `json:"evalResults"`
+	}
+	if err := json.Unmarshal(resultBytes, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	if len(got.EvalResults) != 1 {
+		t.Fatalf("mainWrapper() returned %d libraries, want 1", len(got.EvalResults))
+	}
+	for _, def := range []string{"InPeriod", "AboveThreshold"} {
+		if v := got.EvalResults[0].ExpressionDefinitions[def].Value; v != true {
+			t.Errorf("mainWrapper() returned %s = %v, want true", def, v)
+		}
+	}
+}
+
+func TestCLIParameters_Undefined(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB version '1.0.0'
+	define Result: true`)
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+		Parameter:     parameterFlags{"TESTLIB.Missing=1"},
+	}
+	if err := mainWrapper(context.Background(), cfg); err == nil {
+		t.Errorf("mainWrapper() succeeded, want error for an undefined parameter")
+	}
+}
+
+func TestCLIEmitELM(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "main.cql"), `
+	library Main version '1.0.0'
+	include Helpers version '2.0.0'
+	define Result: Helpers.One + 1`)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "helpers.cql"), `
+	library Helpers version '2.0.0'
+	define One: 1`)
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+		EmitELM:       true,
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(testDirCfg.JSONOutputDir)
+	if err != nil {
+		t.Fatalf("os.ReadDir() returned an unexpected error: %v", err)
+	}
+	var gotFiles []string
+	for _, e := range entries {
+		gotFiles = append(gotFiles, e.Name())
+	}
+	if diff := cmp.Diff([]string{"Helpers-2.0.0.json", "Main-1.0.0.json"}, gotFiles); diff != "" {
+		t.Errorf("mainWrapper() wrote unexpected files (-want +got): %v", diff)
+	}
+	b, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "Main-1.0.0.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	var got struct {
+		Library struct {
+			Identifier struct {
+				Qualified string `json:"qualified"`
+				Version   string `json:"version"`
+			} `json:"identifier"`
+		} `json:"library"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	if got.Library.Identifier.Qualified != "Main" || got.Library.Identifier.Version != "1.0.0" {
+		t.Errorf("mainWrapper() wrote ELM for library %+v, want Main 1.0.0", got.Library.Identifier)
+	}
+}
+
+func TestCLIEmitELM_ParseError(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "main.cql"), `
+	library Main version '1.0.0'
+	define Result: UnknownFunction(1)`)
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+		EmitELM:       true,
+	}
+	if err := mainWrapper(context.Background(), cfg); err == nil {
+		t.Errorf("mainWrapper() succeeded, want parse error")
+	}
+}
+
+func TestCLIDefineFilters(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	define Numerator: true
+	define Denominator: true
+	define "Stratum 1": 1
+	define "Stratum 2": 2`)
+	cfg := cliConfig{
+		CQLDir:              testDirCfg.CQLDir,
+		JSONOutputDir:       testDirCfg.JSONOutputDir,
+		IncludeDefines:      "Numerator, TESTLIB.Denominator",
+		IncludeDefinesRegex: "^Stratum",
+		ExcludeDefines:      "Denominator",
+		ExcludeDefinesRegex: "2$",
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	resultBytes, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "results.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	var got struct {
+		EvalResults []struct {
+			ExpressionDefinitions map[string]json.RawMessage `json:"expressionDefinitions"`
+		} `json:"evalResults"`
+	}
+	if err := json.Unmarshal(resultBytes, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	var gotDefs []string
+	for _, lib := range got.EvalResults {
+		for name := range lib.ExpressionDefinitions {
+			gotDefs = append(gotDefs, name)
+		}
+	}
+	if diff := cmp.Diff([]string{"Numerator", "Stratum 1"}, gotDefs, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("mainWrapper() output definitions diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLIDefines(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	define private Base: 1
+	define Numerator: Base + 1
+	define "Stratum 1": Base + 2
+	define "Stratum 2": Base + 3
+	define Failing: Message(1, true, 'E1', 'Error', 'Failing should not be evaluated')`)
+	cfg := cliConfig{
+		CQLDir:         testDirCfg.CQLDir,
+		JSONOutputDir:  testDirCfg.JSONOutputDir,
+		Defines:        "Numerator, TESTLIB.Stratum*",
+		ExcludeDefines: "Stratum 2",
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	resultBytes, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "results.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	var got struct {
+		EvalResults []struct {
+			ExpressionDefinitions map[string]json.RawMessage `json:"expressionDefinitions"`
+		} `json:"evalResults"`
+	}
+	if err := json.Unmarshal(resultBytes, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	var gotDefs []string
+	for _, lib := range got.EvalResults {
+		for name := range lib.ExpressionDefinitions {
+			gotDefs = append(gotDefs, name)
+		}
+	}
+	if diff := cmp.Diff([]string{"Numerator", "Stratum 1"}, gotDefs, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("mainWrapper() output definitions diff (-want +got): %v", diff)
+	}
+}
+
+func TestSplitDefineGlobs(t *testing.T) {
+	tests := []struct {
+		defines   string
+		wantNames string
+		wantRegex string
+	}{
+		{defines: "Numerator, Lib.Denominator", wantNames: "Numerator,Lib.Denominator"},
+		{defines: "Stratum*,Lib.Initial Population?", wantRegex: `^(?:Stratum.*|Lib\.Initial Population.)$`},
+		{defines: "Numerator,,Str*", wantNames: "Numerator", wantRegex: `^(?:Str.*)$`},
+	}
+	for _, tc := range tests {
+		gotNames, gotRegex := splitDefineGlobs(tc.defines)
+		if gotNames != tc.wantNames || gotRegex != tc.wantRegex {
+			t.Errorf("splitDefineGlobs(%q) = %q, %q, want %q, %q", tc.defines, gotNames, gotRegex, tc.wantNames, tc.wantRegex)
+		}
+	}
+}
+
+func TestCLIDefineFilters_InvalidRegex(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), "library TESTLIB\ndefine Numerator: true")
+	cfg := cliConfig{
+		CQLDir:              testDirCfg.CQLDir,
+		JSONOutputDir:       testDirCfg.JSONOutputDir,
+		IncludeDefinesRegex: "(",
+	}
+	if err := mainWrapper(context.Background(), cfg); err == nil {
+		t.Errorf("mainWrapper() with an invalid --include_defines_regex succeeded, want error")
+	}
+}
+
+func TestCLIFHIRResourceRendering(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	using FHIR version '4.0.1'
+	context Patient
+	define PatientResource: Patient`)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, "bundle.json"), `{
+		"resourceType": "Bundle",
+		"entry": [{"resource": {"resourceType": "Patient", "id": "123", "gender": "male"}}]
+	}`)
+	cfg := cliConfig{
+		CQLDir:                testDirCfg.CQLDir,
+		FHIRBundleDir:         testDirCfg.FHIRBundleDir,
+		JSONOutputDir:         testDirCfg.JSONOutputDir,
+		FHIRResourceRendering: "reference",
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	resultBytes, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "bundle.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	var got struct {
+		EvalResults []struct {
+			ExpressionDefinitions map[string]json.RawMessage `json:"expressionDefinitions"`
+		} `json:"evalResults"`
+	}
+	if err := json.Unmarshal(resultBytes, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	if len(got.EvalResults) != 1 {
+		t.Fatalf("mainWrapper() output %d libraries, want 1", len(got.EvalResults))
+	}
+	gotPatient := string(normalizeJSON(t, got.EvalResults[0].ExpressionDefinitions["PatientResource"]))
+	wantPatient := string(normalizeJSON(t, []byte(`{"@type": "FHIR.Patient", "value": {"resourceType": "Patient", "id": "123"}}`)))
+	if diff := cmp.Diff(wantPatient, gotPatient); diff != "" {
+		t.Errorf("mainWrapper() PatientResource diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLIFHIRResourceRendering_Invalid(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), "library TESTLIB\ndefine Numerator: true")
+	cfg := cliConfig{
+		CQLDir:                testDirCfg.CQLDir,
+		JSONOutputDir:         testDirCfg.JSONOutputDir,
+		FHIRResourceRendering: "xml",
+	}
+	if err := mainWrapper(context.Background(), cfg); err == nil {
+		t.Errorf("mainWrapper() with an invalid --fhir_resource_rendering succeeded, want error")
+	}
+}
+
 func TestCLIWithGCS(t *testing.T) {
 	cql := `
 	library TESTLIB
@@ -176,12 +936,16 @@ func TestCLIWithGCS(t *testing.T) {
 		"bundleSource": "gs://bucketName/fhir_bundle/test_bundle.json",
 		"evalResults": [
 			{
+				"defineMetadata": {
+					"TESTRESULT": {"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.Boolean", "libVersion": ""}
+				},
 				"expressionDefinitions": {
 					"TESTRESULT": {
         		"@type": "System.Boolean",
         		"value": true
 					}
 				},
+				"formatVersion": "1.1",
 				"libName": "TESTLIB",
 				"libVersion": ""
 			}
@@ -435,6 +1199,166 @@ func TestValidateConfigError(t *testing.T) {
 			},
 			wantErr: fs.ErrNotExist,
 		},
+		{
+			name: "terminologyManifest requires terminologyDir",
+			cfg: cliConfig{
+				CQLDir:                  t.TempDir(),
+				FHIRTerminologyManifest: "manifest.json",
+			},
+			wantErr: errMissingFlag,
+		},
+		{
+			name: "lookupCodeDisplays requires terminologyDir",
+			cfg: cliConfig{
+				CQLDir:             t.TempDir(),
+				LookupCodeDisplays: true,
+			},
+			wantErr: errMissingFlag,
+		},
+		{
+			name: "invalid outputFormat",
+			cfg: cliConfig{
+				CQLDir:       t.TempDir(),
+				OutputFormat: "xml",
+			},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "invalid errorFormat",
+			cfg: cliConfig{
+				CQLDir:      t.TempDir(),
+				ErrorFormat: "xml",
+			},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "invalid libraryVersions",
+			cfg: cliConfig{
+				CQLDir:          t.TempDir(),
+				LibraryVersions: "oldest",
+			},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "measurereport outputFormat requires measure",
+			cfg: cliConfig{
+				CQLDir:       t.TempDir(),
+				OutputFormat: outputFormatMeasureReport,
+			},
+			wantErr: errMissingFlag,
+		},
+		{
+			name: "watch with gcs cql_dir",
+			cfg: cliConfig{
+				CQLDir: "gs://bucket/cql",
+				Watch:  true,
+			},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "negative concurrency",
+			cfg: cliConfig{
+				CQLDir:      t.TempDir(),
+				Concurrency: -1,
+			},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "ndjsonDir invalid path",
+			cfg: cliConfig{
+				CQLDir:        t.TempDir(),
+				FHIRNDJSONDir: "/bad/path",
+			},
+			wantErr: fs.ErrNotExist,
+		},
+		{
+			name: "bundleDir with ndjsonDir",
+			cfg: cliConfig{
+				CQLDir:        t.TempDir(),
+				FHIRBundleDir: t.TempDir(),
+				FHIRNDJSONDir: t.TempDir(),
+			},
+			wantErr: errIncompatibleFlags,
+		},
+		{
+			name: "fhirServerURL with bundleDir",
+			cfg: cliConfig{
+				CQLDir:        t.TempDir(),
+				FHIRBundleDir: t.TempDir(),
+				FHIRServerURL: "https://example.com/fhir",
+				PatientIDs:    "p1",
+			},
+			wantErr: errIncompatibleFlags,
+		},
+		{
+			name: "fhirServerURL without patientID",
+			cfg: cliConfig{
+				CQLDir:        t.TempDir(),
+				FHIRServerURL: "https://example.com/fhir",
+			},
+			wantErr: errMissingFlag,
+		},
+		{
+			name: "patientID without fhirServerURL",
+			cfg: cliConfig{
+				CQLDir:     t.TempDir(),
+				PatientIDs: "p1",
+			},
+			wantErr: errMissingFlag,
+		},
+		{
+			name: "invalid fhirServerURL",
+			cfg: cliConfig{
+				CQLDir:        t.TempDir(),
+				FHIRServerURL: "example",
+				PatientIDs:    "p1",
+			},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "defines with includeDefines",
+			cfg: cliConfig{
+				CQLDir:         t.TempDir(),
+				Defines:        "Numerator",
+				IncludeDefines: "Denominator",
+			},
+			wantErr: errIncompatibleFlags,
+		},
+		{
+			name: "terminologyServerURL with terminologyDir",
+			cfg: cliConfig{
+				CQLDir:               t.TempDir(),
+				FHIRTerminologyDir:   t.TempDir(),
+				TerminologyServerURL: "https://cts.nlm.nih.gov/fhir",
+				VSACAPIKey:           "secret",
+			},
+			wantErr: errIncompatibleFlags,
+		},
+		{
+			name: "terminologyServerURL without API key",
+			cfg: cliConfig{
+				CQLDir:               t.TempDir(),
+				TerminologyServerURL: "https://cts.nlm.nih.gov/fhir",
+			},
+			wantErr: errMissingFlag,
+		},
+		{
+			name: "terminologyCacheDir without terminologyServerURL",
+			cfg: cliConfig{
+				CQLDir:              t.TempDir(),
+				TerminologyCacheDir: t.TempDir(),
+			},
+			wantErr: errMissingFlag,
+		},
+		{
+			name: "emitELM with bundleDir",
+			cfg: cliConfig{
+				CQLDir:        t.TempDir(),
+				FHIRBundleDir: t.TempDir(),
+				EmitELM:       true,
+			},
+			wantErr: errIncompatibleFlags,
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -457,27 +1381,83 @@ func TestParseFlags(t *testing.T) {
 			name: "Simple config with all flags set",
 			args: []string{
 				`--parameters=aString='string value'`,
+				"--parameter=Lib.Period=Interval[@2024-01-01, @2025-01-01)",
+				"--parameter=Threshold=2",
+				"--parameters_file=parameters.json",
+				"--config=cql.yaml",
+				"--library_versions=latest",
 				"--cql_dir=" + testDirs.CQLDir,
 				"--fhir_bundle_dir=" + testDirs.FHIRBundleDir,
 				"--fhir_terminology_dir=" + testDirs.FHIRTerminologyDir,
+				"--fhir_terminology_manifest=manifest.json",
 				"--fhir_parameters_file=" + testDirs.FHIRParametersFile,
+				"--lookup_code_displays",
+				"--provenance",
+				"--defines=Numerator,Stratum*",
+				"--include_defines=Numerator,Denominator",
+				"--include_defines_regex=^Stratum",
+				"--exclude_defines=Denominator",
+				"--exclude_defines_regex=Debug$",
+				"--fhir_resource_rendering=reference",
+				"--slow_terminology_threshold=250ms",
+				"--terminology_server_url=https://cts.nlm.nih.gov/fhir",
+				"--vsac_api_key=secret",
+				"--terminology_cache_dir=cache",
+				"--terminology_cache_ttl=1h",
 				"--json_output_dir=" + testDirs.JSONOutputDir,
+				"--emit_elm",
+				"--watch",
+				"--profile",
+				"--error_format=json",
+				"--output_format=ndjson",
+				"--measure=measure.json",
+				"--concurrency=4",
 			},
 			want: cliConfig{
-				Parameters:         "aString='string value'",
-				CQLDir:             testDirs.CQLDir,
-				FHIRBundleDir:      testDirs.FHIRBundleDir,
-				FHIRTerminologyDir: testDirs.FHIRTerminologyDir,
-				FHIRParametersFile: testDirs.FHIRParametersFile,
-				JSONOutputDir:      testDirs.JSONOutputDir,
-				gcsEndpoint:        "https://storage.googleapis.com/",
+				Parameters:               "aString='string value'",
+				Parameter:                parameterFlags{"Lib.Period=Interval[@2024-01-01, @2025-01-01)", "Threshold=2"},
+				ParametersFile:           "parameters.json",
+				Config:                   "cql.yaml",
+				LibraryVersions:          "latest",
+				CQLDir:                   testDirs.CQLDir,
+				FHIRBundleDir:            testDirs.FHIRBundleDir,
+				FHIRTerminologyDir:       testDirs.FHIRTerminologyDir,
+				FHIRTerminologyManifest:  "manifest.json",
+				FHIRParametersFile:       testDirs.FHIRParametersFile,
+				LookupCodeDisplays:       true,
+				Provenance:               true,
+				Defines:                  "Numerator,Stratum*",
+				IncludeDefines:           "Numerator,Denominator",
+				IncludeDefinesRegex:      "^Stratum",
+				ExcludeDefines:           "Denominator",
+				ExcludeDefinesRegex:      "Debug$",
+				FHIRResourceRendering:    "reference",
+				SlowTerminologyThreshold: 250 * time.Millisecond,
+				TerminologyServerURL:     "https://cts.nlm.nih.gov/fhir",
+				VSACAPIKey:               "secret",
+				TerminologyCacheDir:      "cache",
+				TerminologyCacheTTL:      time.Hour,
+				JSONOutputDir:            testDirs.JSONOutputDir,
+				EmitELM:                  true,
+				Watch:                    true,
+				Profile:                  true,
+				ErrorFormat:              "json",
+				OutputFormat:             "ndjson",
+				Measure:                  "measure.json",
+				Concurrency:              4,
+				gcsEndpoint:              "https://storage.googleapis.com/",
 			},
 		},
 		{
 			name: "No flags set",
 			args: []string{},
 			want: cliConfig{
-				gcsEndpoint: "https://storage.googleapis.com/",
+				OutputFormat:        "json",
+				ErrorFormat:         "text",
+				LibraryVersions:     "all",
+				Concurrency:         1,
+				TerminologyCacheTTL: 24 * time.Hour,
+				gcsEndpoint:         "https://storage.googleapis.com/",
 			},
 		},
 	}
@@ -490,7 +1470,7 @@ func TestParseFlags(t *testing.T) {
 			if err := fs.Parse(tc.args); err != nil {
 				t.Errorf("fs.Parse(%v) returned an unexpected error: %v", tc.args, err)
 			}
-			if diff := cmp.Diff(tc.want, cfg, cmpopts.IgnoreFields(cliConfig{}, "gcsEndpoint")); diff != "" {
+			if diff := cmp.Diff(tc.want, cfg, cmpopts.IgnoreFields(cliConfig{}, "gcsEndpoint", "jsonOptions", "measure", "measureConfig", "onResult", "profile")); diff != "" {
 				t.Errorf("After fs.Parse(%v) got an unexpected diff (-want +got): %v", tc.args, diff)
 			}
 		})
@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/google/cql/internal/iohelpers"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is the config file used if --config is not set, so that a reproducible run
+// configuration can be checked into the repository holding the CQL.
+const defaultConfigFile = "cql.yaml"
+
+// loadConfigFile sets the flags of cfg to the values of its config file. If --config is not set
+// the defaultConfigFile in workDir is used, if it exists. Flags set on fs keep their values.
+func loadConfigFile(ctx context.Context, cfg *cliConfig, fs *flag.FlagSet, workDir string) error {
+	path := cfg.Config
+	if path == "" {
+		path = filepath.Join(workDir, defaultConfigFile)
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return applyConfigFile(ctx, cfg, path, set)
+}
+
+// applyConfigFile sets the flags of cfg to the values of the YAML or JSON config file at path,
+// whose keys are the names of the flags. Flags that are in set, which were passed on the command
+// line, keep their values, as do flags missing from the file. Paths in the file are not relative
+// to the file.
+func applyConfigFile(ctx context.Context, cfg *cliConfig, path string, set map[string]bool) error {
+	data, err := iohelpers.ReadFile(ctx, path, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	fileCfg := *cfg
+	fileCfg.Parameter = nil
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fileCfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w --config, failed to parse %s: %v", errInvalidFlag, path, err)
+	}
+	if fileCfg.Parameter == nil {
+		fileCfg.Parameter = cfg.Parameter
+	}
+
+	got, file := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(fileCfg)
+	for i := 0; i < got.NumField(); i++ {
+		name := got.Type().Field(i).Tag.Get("yaml")
+		// Unexported fields have no config key.
+		if name == "" || name == "-" || set[name] {
+			continue
+		}
+		got.Field(i).Set(file.Field(i))
+	}
+	return nil
+}
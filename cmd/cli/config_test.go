@@ -0,0 +1,228 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	defaults := cliConfig{
+		OutputFormat:        outputFormatJSON,
+		Concurrency:         1,
+		TerminologyCacheTTL: 24 * time.Hour,
+	}
+	tests := []struct {
+		name   string
+		config string
+		cfg    cliConfig
+		set    []string
+		want   cliConfig
+	}{
+		{
+			name: "YAML",
+			config: `
+cql_dir: cql
+fhir_bundle_dir: bundles
+fhir_terminology_dir: terminology
+json_output_dir: output
+output_format: ndjson
+terminology_cache_ttl: 1h
+concurrency: 4
+parameter:
+  - MyMeasure.Threshold=3
+  - "MyMeasure.Measurement Period=Interval[@2024-01-01, @2025-01-01)"
+`,
+			cfg: defaults,
+			want: cliConfig{
+				CQLDir:              "cql",
+				FHIRBundleDir:       "bundles",
+				FHIRTerminologyDir:  "terminology",
+				JSONOutputDir:       "output",
+				OutputFormat:        outputFormatNDJSON,
+				TerminologyCacheTTL: time.Hour,
+				Concurrency:         4,
+				Parameter:           parameterFlags{"MyMeasure.Threshold=3", "MyMeasure.Measurement Period=Interval[@2024-01-01, @2025-01-01)"},
+			},
+		},
+		{
+			name:   "JSON",
+			config: `{"cql_dir": "cql", "fhir_ndjson_dir": "ndjson", "return_private_defs": true}`,
+			cfg:    defaults,
+			want: cliConfig{
+				CQLDir:              "cql",
+				FHIRNDJSONDir:       "ndjson",
+				ReturnPrivateDefs:   true,
+				OutputFormat:        outputFormatJSON,
+				Concurrency:         1,
+				TerminologyCacheTTL: 24 * time.Hour,
+			},
+		},
+		{
+			name:   "Command line flags take precedence",
+			config: "cql_dir: cql\njson_output_dir: output\nparameter: [MyMeasure.Threshold=3]\n",
+			cfg: cliConfig{
+				JSONOutputDir: "other_output",
+				Parameter:     parameterFlags{"MyMeasure.Threshold=4"},
+			},
+			set: []string{"json_output_dir", "parameter"},
+			want: cliConfig{
+				CQLDir:        "cql",
+				JSONOutputDir: "other_output",
+				Parameter:     parameterFlags{"MyMeasure.Threshold=4"},
+			},
+		},
+		{
+			name:   "Empty",
+			config: "",
+			cfg:    defaults,
+			want:   defaults,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), defaultConfigFile)
+			if err := os.WriteFile(path, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+			}
+			set := make(map[string]bool)
+			for _, name := range tc.set {
+				set[name] = true
+			}
+			got := tc.cfg
+			if err := applyConfigFile(context.Background(), &got, path, set); err != nil {
+				t.Fatalf("applyConfigFile() returned an unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(cliConfig{}), cmpopts.IgnoreFields(cliConfig{}, "measureConfig")); diff != "" {
+				t.Errorf("applyConfigFile() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFile_Error(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantError string
+	}{
+		{
+			name:      "Unknown flag",
+			config:    "cql_directory: cql\n",
+			wantError: "field cql_directory not found",
+		},
+		{
+			name:      "Invalid value",
+			config:    "concurrency: many\n",
+			wantError: "failed to parse",
+		},
+		{
+			name:      "Version is not a config key",
+			config:    "V: true\n",
+			wantError: "field V not found",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), defaultConfigFile)
+			writeLocalFileWithContent(t, path, tc.config)
+			err := applyConfigFile(context.Background(), &cliConfig{}, path, nil)
+			if !errors.Is(err, errInvalidFlag) || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("applyConfigFile() returned error %v, want %v containing %q", err, errInvalidFlag, tc.wantError)
+			}
+		})
+	}
+
+	if err := applyConfigFile(context.Background(), &cliConfig{}, "missing.yaml", nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("applyConfigFile() returned error %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	workDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(workDir, defaultConfigFile), "cql_dir: default_cql\noutput_format: ndjson\n")
+	otherConfig := filepath.Join(t.TempDir(), "other.yaml")
+	writeLocalFileWithContent(t, otherConfig, "cql_dir: other_cql\n")
+
+	tests := []struct {
+		name    string
+		args    []string
+		workDir string
+		want    cliConfig
+	}{
+		{
+			name:    "Default config file",
+			args:    []string{"--output_format=csv"},
+			workDir: workDir,
+			want:    cliConfig{CQLDir: "default_cql", OutputFormat: outputFormatCSV},
+		},
+		{
+			name:    "Config flag",
+			args:    []string{"--config=" + otherConfig},
+			workDir: workDir,
+			want:    cliConfig{Config: otherConfig, CQLDir: "other_cql", OutputFormat: outputFormatJSON},
+		},
+		{
+			name:    "No config file",
+			args:    []string{"--cql_dir=cql"},
+			workDir: t.TempDir(),
+			want:    cliConfig{CQLDir: "cql", OutputFormat: outputFormatJSON},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test_flagset", flag.PanicOnError)
+			var cfg cliConfig
+			cfg.RegisterFlags(fs)
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatalf("fs.Parse(%v) returned an unexpected error: %v", tc.args, err)
+			}
+			if err := loadConfigFile(context.Background(), &cfg, fs, tc.workDir); err != nil {
+				t.Fatalf("loadConfigFile() returned an unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, cfg, cmpopts.IgnoreFields(cliConfig{}, "Concurrency", "ErrorFormat", "LibraryVersions", "TerminologyCacheTTL", "gcsEndpoint", "jsonOptions", "measure", "measureConfig", "onResult", "profile")); diff != "" {
+				t.Errorf("loadConfigFile() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCLIConfigKeys(t *testing.T) {
+	// The keys of config files are the names of the flags.
+	fs := flag.NewFlagSet("test_flagset", flag.PanicOnError)
+	var cfg cliConfig
+	cfg.RegisterFlags(fs)
+	typ := reflect.TypeOf(cfg)
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Tag.Get("yaml")
+		if name == "" || name == "-" {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			t.Errorf("cliConfig.%s has config key %q, which is not a flag", typ.Field(i).Name, name)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/cql"
+	"github.com/google/cql/retriever"
+)
+
+// dataRequirementsCommand is the name of the CLI subcommand that outputs the data required by the
+// CQL.
+const dataRequirementsCommand = "data-requirements"
+
+// Output formats of the data-requirements subcommand.
+const (
+	dataRequirementsFormatJSON    = "json"
+	dataRequirementsFormatLibrary = "library"
+	dataRequirementsFormatQueries = "queries"
+)
+
+type dataRequirementsConfig struct {
+	CQLDir       string
+	OutputFormat string
+
+	// Should not be set directly by a flag.
+	gcsEndpoint string
+}
+
+func (cfg *dataRequirementsConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.CQLDir, "cql_dir", "", "(Required) Directory holding 1 or more CQL files.")
+	fs.StringVar(&cfg.OutputFormat, "output_format", dataRequirementsFormatJSON, "(Optional) One of json (the default) for a JSON array of FHIR DataRequirements, library for a FHIR module-definition Library holding the DataRequirements, or queries for one FHIR search query per line that prefetches the required data.")
+
+	cfg.gcsEndpoint = gcs.DefaultCloudStorageEndpoint
+}
+
+// fhirDataRequirement is the JSON representation of a FHIR R4 DataRequirement,
+// https://hl7.org/fhir/R4/metadatatypes.html#DataRequirement.
+type fhirDataRequirement struct {
+	Type       string           `json:"type"`
+	CodeFilter []fhirCodeFilter `json:"codeFilter,omitempty"`
+	DateFilter []fhirDateFilter `json:"dateFilter,omitempty"`
+}
+
+type fhirCodeFilter struct {
+	Path     string `json:"path"`
+	ValueSet string `json:"valueSet,omitempty"`
+}
+
+type fhirDateFilter struct {
+	Path string `json:"path"`
+}
+
+// fhirModuleDefinition is the JSON representation of a FHIR R4 module-definition Library, the
+// result of the FHIR $data-requirements operation.
+type fhirModuleDefinition struct {
+	ResourceType    string                `json:"resourceType"`
+	Status          string                `json:"status"`
+	Type            fhirCodeableConcept   `json:"type"`
+	DataRequirement []fhirDataRequirement `json:"dataRequirement"`
+}
+
+type fhirCodeableConcept struct {
+	Coding []fhirCoding `json:"coding"`
+}
+
+type fhirCoding struct {
+	System string `json:"system"`
+	Code   string `json:"code"`
+}
+
+// runDataRequirements parses the data-requirements subcommand flags from args, runs it and writes
+// the data requirements to w.
+func runDataRequirements(ctx context.Context, args []string, w io.Writer, errorFormat *string) error {
+	fs := flag.NewFlagSet(dataRequirementsCommand, flag.ExitOnError)
+	var cfg dataRequirementsConfig
+	cfg.RegisterFlags(fs)
+	if err := parseSubcommandFlags(fs, args, errorFormat); err != nil {
+		return err
+	}
+	return writeDataRequirements(ctx, cfg, w)
+}
+
+// writeDataRequirements parses the CQL libraries and writes the data they may retrieve during
+// evaluation to w in the configured output format.
+func writeDataRequirements(ctx context.Context, cfg dataRequirementsConfig, w io.Writer) error {
+	if cfg.CQLDir == "" {
+		return fmt.Errorf("%w --cql_dir", errMissingFlag)
+	}
+	switch cfg.OutputFormat {
+	case dataRequirementsFormatJSON, dataRequirementsFormatLibrary, dataRequirementsFormatQueries:
+	default:
+		return fmt.Errorf("%w --output_format must be one of %s, %s or %s, got %q", errInvalidFlag, dataRequirementsFormatJSON, dataRequirementsFormatLibrary, dataRequirementsFormatQueries, cfg.OutputFormat)
+	}
+	cqlLibs, err := readCQLLibs(ctx, cfg.CQLDir, &cliConfig{gcsEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return fmt.Errorf("failed to read CQL libraries: %w", err)
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		return fmt.Errorf("failed to create FHIR data model: %w", err)
+	}
+	elm, err := cql.Parse(ctx, cqlLibs, cql.ParseConfig{DataModels: [][]byte{fhirDM}})
+	if err != nil {
+		return fmt.Errorf("failed to parse CQL: %w", err)
+	}
+	reqs, err := elm.DataRequirements()
+	if err != nil {
+		return err
+	}
+
+	if cfg.OutputFormat == dataRequirementsFormatQueries {
+		for _, q := range prefetchQueries(reqs) {
+			if _, err := fmt.Fprintln(w, q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var out any = fhirDataRequirements(reqs)
+	if cfg.OutputFormat == dataRequirementsFormatLibrary {
+		out = fhirModuleDefinition{
+			ResourceType: "Library",
+			Status:       "active",
+			Type: fhirCodeableConcept{Coding: []fhirCoding{{
+				System: "http://terminology.hl7.org/CodeSystem/library-type",
+				Code:   "module-definition",
+			}}},
+			DataRequirement: fhirDataRequirements(reqs),
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// fhirDataRequirements converts the data requirements to FHIR DataRequirements.
+func fhirDataRequirements(reqs []retriever.DataRequirement) []fhirDataRequirement {
+	out := make([]fhirDataRequirement, 0, len(reqs))
+	for _, r := range reqs {
+		fr := fhirDataRequirement{Type: r.ResourceType}
+		if r.CodeFilter != nil {
+			fr.CodeFilter = []fhirCodeFilter{{Path: r.CodeFilter.Property, ValueSet: valueSetCanonical(r.CodeFilter)}}
+		}
+		if r.DateFilter != nil {
+			fr.DateFilter = []fhirDateFilter{{Path: r.DateFilter.Property}}
+		}
+		out = append(out, fr)
+	}
+	return out
+}
+
+// prefetchQueries returns a FHIR search query for each data requirement. Requirements that filter
+// on a ValueSet use the :in modifier, all others fetch every resource of their type, so a query
+// without a filter makes the filtered queries of the same resource type redundant and replaces
+// them.
+func prefetchQueries(reqs []retriever.DataRequirement) []string {
+	unfiltered := make(map[string]bool)
+	for _, r := range reqs {
+		if r.CodeFilter == nil || r.CodeFilter.ValueSetURL == "" {
+			unfiltered[r.ResourceType] = true
+		}
+	}
+	seen := make(map[string]bool)
+	var queries []string
+	for _, r := range reqs {
+		q := r.ResourceType
+		if !unfiltered[r.ResourceType] {
+			q += "?" + url.QueryEscape(r.CodeFilter.Property+":in") + "=" + url.QueryEscape(valueSetCanonical(r.CodeFilter))
+		}
+		if !seen[q] {
+			seen[q] = true
+			queries = append(queries, q)
+		}
+	}
+	return queries
+}
+
+// valueSetCanonical returns the canonical URL of the ValueSet of the code filter, including the
+// version if there is one.
+func valueSetCanonical(f *retriever.CodeFilter) string {
+	if f.ValueSetVersion == "" {
+		return f.ValueSetURL
+	}
+	return f.ValueSetURL + "|" + f.ValueSetVersion
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestWriteDataRequirements(t *testing.T) {
+	cqlDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(cqlDir, "lib.cql"), dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		using FHIR version '4.0.1'
+		valueset "Office Visit": 'https://test/office-visit' version '2.0'
+		valueset "Diabetes": 'https://test/diabetes'
+		context Patient
+		define Visits: [Encounter: "Office Visit"]
+		define DiabetesConditions: [Condition: "Diabetes"]
+		define AllConditions: [Condition]`))
+
+	tests := []struct {
+		name         string
+		outputFormat string
+		want         string
+	}{
+		{
+			name:         "JSON",
+			outputFormat: dataRequirementsFormatJSON,
+			want: `[
+  {
+    "type": "Condition"
+  },
+  {
+    "type": "Condition",
+    "codeFilter": [
+      {
+        "path": "code",
+        "valueSet": "https://test/diabetes"
+      }
+    ]
+  },
+  {
+    "type": "Encounter",
+    "codeFilter": [
+      {
+        "path": "type",
+        "valueSet": "https://test/office-visit|2.0"
+      }
+    ]
+  },
+  {
+    "type": "Patient"
+  }
+]
+`,
+		},
+		{
+			name:         "Library",
+			outputFormat: dataRequirementsFormatLibrary,
+			want: `{
+  "resourceType": "Library",
+  "status": "active",
+  "type": {
+    "coding": [
+      {
+        "system": "http://terminology.hl7.org/CodeSystem/library-type",
+        "code": "module-definition"
+      }
+    ]
+  },
+  "dataRequirement": [
+    {
+      "type": "Condition"
+    },
+    {
+      "type": "Condition",
+      "codeFilter": [
+        {
+          "path": "code",
+          "valueSet": "https://test/diabetes"
+        }
+      ]
+    },
+    {
+      "type": "Encounter",
+      "codeFilter": [
+        {
+          "path": "type",
+          "valueSet": "https://test/office-visit|2.0"
+        }
+      ]
+    },
+    {
+      "type": "Patient"
+    }
+  ]
+}
+`,
+		},
+		{
+			name:         "Queries",
+			outputFormat: dataRequirementsFormatQueries,
+			want: "Condition\n" +
+				"Encounter?type%3Ain=https%3A%2F%2Ftest%2Foffice-visit%7C2.0\n" +
+				"Patient\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got bytes.Buffer
+			cfg := dataRequirementsConfig{CQLDir: cqlDir, OutputFormat: tc.outputFormat}
+			if err := writeDataRequirements(context.Background(), cfg, &got); err != nil {
+				t.Fatalf("writeDataRequirements() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got.String()); diff != "" {
+				t.Errorf("writeDataRequirements() unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteDataRequirements_Error(t *testing.T) {
+	cqlDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(cqlDir, "lib.cql"), "library TESTLIB define A: B")
+	tests := []struct {
+		name    string
+		cfg     dataRequirementsConfig
+		wantErr error
+	}{
+		{
+			name:    "Missing cql_dir",
+			cfg:     dataRequirementsConfig{OutputFormat: dataRequirementsFormatJSON},
+			wantErr: errMissingFlag,
+		},
+		{
+			name:    "Invalid output format",
+			cfg:     dataRequirementsConfig{CQLDir: cqlDir, OutputFormat: "xml"},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "Invalid CQL",
+			cfg:  dataRequirementsConfig{CQLDir: cqlDir, OutputFormat: dataRequirementsFormatJSON},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := writeDataRequirements(context.Background(), tc.cfg, &bytes.Buffer{})
+			if err == nil {
+				t.Fatalf("writeDataRequirements() succeeded, want error")
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("writeDataRequirements() returned error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/cql"
+	"github.com/google/cql/result"
+)
+
+// depsCommand is the name of the CLI subcommand that outputs the dependency graph of the CQL.
+const depsCommand = "deps"
+
+// Output formats of the deps subcommand.
+const (
+	depsFormatDot  = "dot"
+	depsFormatJSON = "json"
+)
+
+// Graphs output by the deps subcommand.
+const (
+	depsGraphDefinitions = "definitions"
+	depsGraphLibraries   = "libraries"
+)
+
+type depsConfig struct {
+	CQLDir       string
+	OutputFormat string
+	Graph        string
+
+	// Should not be set directly by a flag.
+	gcsEndpoint string
+}
+
+func (cfg *depsConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.CQLDir, "cql_dir", "", "(Required) Directory holding 1 or more CQL files.")
+	fs.StringVar(&cfg.OutputFormat, "output_format", depsFormatDot, "(Optional) One of dot (the default) for a Graphviz DOT digraph, or json for a JSON array with the direct dependencies of each node.")
+	fs.StringVar(&cfg.Graph, "graph", depsGraphDefinitions, "(Optional) One of definitions (the default) for the graph of expression and function definitions and the definitions they reference, or libraries for the graph of libraries and the libraries they include.")
+
+	cfg.gcsEndpoint = gcs.DefaultCloudStorageEndpoint
+}
+
+// depsNode is a node of the dependency graph and the nodes it directly depends on.
+type depsNode struct {
+	Library      string     `json:"library"`
+	Name         string     `json:"name,omitempty"`
+	Dependencies []depsEdge `json:"dependencies"`
+
+	// id uniquely identifies the node in the DOT output, and libID its library.
+	id    string
+	libID string
+}
+
+// depsEdge is the target of an edge of the dependency graph.
+type depsEdge struct {
+	Library string `json:"library"`
+	Name    string `json:"name,omitempty"`
+
+	id string
+}
+
+// runDeps parses the deps subcommand flags from args, runs it and writes the dependency graph to w.
+func runDeps(ctx context.Context, args []string, w io.Writer, errorFormat *string) error {
+	fs := flag.NewFlagSet(depsCommand, flag.ExitOnError)
+	var cfg depsConfig
+	cfg.RegisterFlags(fs)
+	if err := parseSubcommandFlags(fs, args, errorFormat); err != nil {
+		return err
+	}
+	return writeDeps(ctx, cfg, w)
+}
+
+// writeDeps parses the CQL libraries and writes their dependency graph to w in the configured
+// output format.
+func writeDeps(ctx context.Context, cfg depsConfig, w io.Writer) error {
+	if cfg.CQLDir == "" {
+		return fmt.Errorf("%w --cql_dir", errMissingFlag)
+	}
+	if cfg.OutputFormat != depsFormatDot && cfg.OutputFormat != depsFormatJSON {
+		return fmt.Errorf("%w --output_format must be one of %s or %s, got %q", errInvalidFlag, depsFormatDot, depsFormatJSON, cfg.OutputFormat)
+	}
+	if cfg.Graph != depsGraphDefinitions && cfg.Graph != depsGraphLibraries {
+		return fmt.Errorf("%w --graph must be one of %s or %s, got %q", errInvalidFlag, depsGraphDefinitions, depsGraphLibraries, cfg.Graph)
+	}
+	cqlLibs, err := readCQLLibs(ctx, cfg.CQLDir, &cliConfig{gcsEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return fmt.Errorf("failed to read CQL libraries: %w", err)
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		return fmt.Errorf("failed to create FHIR data model: %w", err)
+	}
+	elm, err := cql.Parse(ctx, cqlLibs, cql.ParseConfig{DataModels: [][]byte{fhirDM}})
+	if err != nil {
+		return fmt.Errorf("failed to parse CQL: %w", err)
+	}
+
+	var nodes []depsNode
+	if cfg.Graph == depsGraphLibraries {
+		nodes = libraryNodes(elm.LibraryIncludes())
+	} else {
+		nodes = definitionNodes(elm.DefinitionDependencies())
+	}
+	if cfg.OutputFormat == depsFormatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(nodes)
+	}
+	_, err = io.WriteString(w, depsDot(nodes, cfg.Graph == depsGraphDefinitions))
+	return err
+}
+
+// libraryNodes returns the nodes of the library include graph sorted by library.
+func libraryNodes(includes map[result.LibKey][]result.LibKey) []depsNode {
+	nodes := make([]depsNode, 0, len(includes))
+	for lib, incs := range includes {
+		n := depsNode{Library: lib.String(), Dependencies: []depsEdge{}, id: lib.Key(), libID: lib.Key()}
+		for _, inc := range incs {
+			n.Dependencies = append(n.Dependencies, depsEdge{Library: inc.String(), id: inc.Key()})
+		}
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// definitionNodes returns the nodes of the definition dependency graph sorted by library and name.
+func definitionNodes(deps map[result.DefKey][]result.DefKey) []depsNode {
+	nodes := make([]depsNode, 0, len(deps))
+	for def, refs := range deps {
+		n := depsNode{Library: def.Library.String(), Name: def.Name, Dependencies: []depsEdge{}, id: defNodeID(def), libID: def.Library.Key()}
+		for _, ref := range refs {
+			n.Dependencies = append(n.Dependencies, depsEdge{Library: ref.Library.String(), Name: ref.Name, id: defNodeID(ref)})
+		}
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].libID != nodes[j].libID {
+			return nodes[i].libID < nodes[j].libID
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+func defNodeID(def result.DefKey) string {
+	return def.Library.Key() + "." + def.Name
+}
+
+// depsDot returns the Graphviz DOT digraph of the nodes. If clusterByLibrary is true the nodes are
+// labelled with their name and grouped into a cluster per library, otherwise they are labelled
+// with their library.
+func depsDot(nodes []depsNode, clusterByLibrary bool) string {
+	var sb strings.Builder
+	sb.WriteString("digraph cql {\n")
+	sb.WriteString("  rankdir=LR;\n")
+	sb.WriteString("  node [shape=box];\n")
+	if clusterByLibrary {
+		cluster := -1
+		for i, n := range nodes {
+			if i == 0 || nodes[i-1].libID != n.libID {
+				if cluster >= 0 {
+					sb.WriteString("  }\n")
+				}
+				cluster++
+				fmt.Fprintf(&sb, "  subgraph cluster_%d {\n", cluster)
+				fmt.Fprintf(&sb, "    label=%s;\n", dotQuote(n.Library))
+			}
+			fmt.Fprintf(&sb, "    %s [label=%s];\n", dotQuote(n.id), dotQuote(n.Name))
+		}
+		if cluster >= 0 {
+			sb.WriteString("  }\n")
+		}
+	} else {
+		for _, n := range nodes {
+			fmt.Fprintf(&sb, "  %s [label=%s];\n", dotQuote(n.id), dotQuote(n.Library))
+		}
+	}
+	for _, n := range nodes {
+		for _, d := range n.Dependencies {
+			fmt.Fprintf(&sb, "  %s -> %s;\n", dotQuote(n.id), dotQuote(d.id))
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// dotQuote returns s as a quoted DOT identifier.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
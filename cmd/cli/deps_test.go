@@ -0,0 +1,185 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestWriteDeps(t *testing.T) {
+	cqlDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(cqlDir, "helpers.cql"), dedent.Dedent(`
+		library Helpers version '1.0.0'
+		define function Double(x Integer): x * 2`))
+	writeLocalFileWithContent(t, filepath.Join(cqlDir, "lib.cql"), dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		include Helpers version '1.0.0' called H
+		define Base: 1
+		define "Doubled Base": H.Double(Base)`))
+
+	tests := []struct {
+		name         string
+		outputFormat string
+		graph        string
+		want         string
+	}{
+		{
+			name:         "Definitions DOT",
+			outputFormat: depsFormatDot,
+			graph:        depsGraphDefinitions,
+			want: `digraph cql {
+  rankdir=LR;
+  node [shape=box];
+  subgraph cluster_0 {
+    label="Helpers 1.0.0";
+    "Helpers 1.0.0.Double" [label="Double"];
+  }
+  subgraph cluster_1 {
+    label="TESTLIB 1.0.0";
+    "TESTLIB 1.0.0.Base" [label="Base"];
+    "TESTLIB 1.0.0.Doubled Base" [label="Doubled Base"];
+  }
+  "TESTLIB 1.0.0.Doubled Base" -> "Helpers 1.0.0.Double";
+  "TESTLIB 1.0.0.Doubled Base" -> "TESTLIB 1.0.0.Base";
+}
+`,
+		},
+		{
+			name:         "Libraries DOT",
+			outputFormat: depsFormatDot,
+			graph:        depsGraphLibraries,
+			want: `digraph cql {
+  rankdir=LR;
+  node [shape=box];
+  "Helpers 1.0.0" [label="Helpers 1.0.0"];
+  "TESTLIB 1.0.0" [label="TESTLIB 1.0.0"];
+  "TESTLIB 1.0.0" -> "Helpers 1.0.0";
+}
+`,
+		},
+		{
+			name:         "Definitions JSON",
+			outputFormat: depsFormatJSON,
+			graph:        depsGraphDefinitions,
+			want: `[
+  {
+    "library": "Helpers 1.0.0",
+    "name": "Double",
+    "dependencies": []
+  },
+  {
+    "library": "TESTLIB 1.0.0",
+    "name": "Base",
+    "dependencies": []
+  },
+  {
+    "library": "TESTLIB 1.0.0",
+    "name": "Doubled Base",
+    "dependencies": [
+      {
+        "library": "Helpers 1.0.0",
+        "name": "Double"
+      },
+      {
+        "library": "TESTLIB 1.0.0",
+        "name": "Base"
+      }
+    ]
+  }
+]
+`,
+		},
+		{
+			name:         "Libraries JSON",
+			outputFormat: depsFormatJSON,
+			graph:        depsGraphLibraries,
+			want: `[
+  {
+    "library": "Helpers 1.0.0",
+    "dependencies": []
+  },
+  {
+    "library": "TESTLIB 1.0.0",
+    "dependencies": [
+      {
+        "library": "Helpers 1.0.0"
+      }
+    ]
+  }
+]
+`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got bytes.Buffer
+			cfg := depsConfig{CQLDir: cqlDir, OutputFormat: tc.outputFormat, Graph: tc.graph}
+			if err := writeDeps(context.Background(), cfg, &got); err != nil {
+				t.Fatalf("writeDeps() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got.String()); diff != "" {
+				t.Errorf("writeDeps() unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteDeps_Error(t *testing.T) {
+	cqlDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(cqlDir, "lib.cql"), "library TESTLIB define A: B")
+	tests := []struct {
+		name    string
+		cfg     depsConfig
+		wantErr error
+	}{
+		{
+			name:    "Missing cql_dir",
+			cfg:     depsConfig{OutputFormat: depsFormatDot, Graph: depsGraphDefinitions},
+			wantErr: errMissingFlag,
+		},
+		{
+			name:    "Invalid output format",
+			cfg:     depsConfig{CQLDir: cqlDir, OutputFormat: "svg", Graph: depsGraphDefinitions},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name:    "Invalid graph",
+			cfg:     depsConfig{CQLDir: cqlDir, OutputFormat: depsFormatDot, Graph: "patients"},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "Invalid CQL",
+			cfg:  depsConfig{CQLDir: cqlDir, OutputFormat: depsFormatDot, Graph: depsGraphDefinitions},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := writeDeps(context.Background(), tc.cfg, &bytes.Buffer{})
+			if err == nil {
+				t.Fatalf("writeDeps() succeeded, want error")
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("writeDeps() returned error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+
+	"github.com/google/cql/parser"
+	"github.com/google/cql/result"
+)
+
+// Exit codes of the CLI. Each kind of failure has its own exit code so that CI systems can gate on
+// specific failures, for example failing a build on invalid CQL but retrying on IO errors.
+const (
+	// exitCodeError is returned for failures that are not covered by another exit code, including
+	// failed test cases, validation errors and unformatted CQL files.
+	exitCodeError = 1
+	// exitCodeUsage is returned for missing, invalid or incompatible flags. It matches the exit code
+	// of the flag package for flags that cannot be parsed.
+	exitCodeUsage = 2
+	// exitCodeParse is returned if the CQL or the parameters could not be parsed.
+	exitCodeParse = 3
+	// exitCodeEval is returned if evaluating the CQL failed.
+	exitCodeEval = 4
+	// exitCodeIO is returned if reading or writing a file, or calling a server, failed.
+	exitCodeIO = 5
+)
+
+// Error codes of the JSON error output, one for each exit code.
+const (
+	errorCodeError = "error"
+	errorCodeUsage = "usage"
+	errorCodeParse = "parse"
+	errorCodeEval  = "eval"
+	errorCodeIO    = "io"
+)
+
+// Formats of the errors written to stderr, set by --error_format.
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+// errorFormatUsage is the usage of the --error_format flag of the CLI and of its subcommands.
+const errorFormatUsage = "(Optional) The format of the error written to stderr if the CLI fails. One of text (the default) or json for a JSON object with the kind of failure, its exit code and, if the CQL could not be parsed, the location of each problem in the CQL."
+
+// cliError is the JSON representation of a failure of the CLI, written to stderr if
+// --error_format=json.
+type cliError struct {
+	// Code is the kind of failure, one of usage, parse, eval, io or error.
+	Code     string `json:"code"`
+	ExitCode int    `json:"exitCode"`
+	Command  string `json:"command,omitempty"`
+	Message  string `json:"message"`
+	// Library is the library that failed to evaluate, if known.
+	Library string `json:"library,omitempty"`
+	// Diagnostics locate each problem in the CQL if the CQL or parameters could not be parsed.
+	Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+}
+
+func validateErrorFormat(format string) error {
+	if format == "" || format == errorFormatText || format == errorFormatJSON {
+		return nil
+	}
+	return fmt.Errorf("%w --error_format, which must be one of %s or %s, got %q", errInvalidFlag, errorFormatText, errorFormatJSON, format)
+}
+
+// classifyError returns the error code and exit code of err.
+func classifyError(err error) (string, int) {
+	var libErrs *parser.LibraryErrors
+	var paramErrs *parser.ParameterErrors
+	var pathErr *fs.PathError
+	var netErr net.Error
+	var engineErr result.EngineError
+	errors.As(err, &engineErr)
+	switch {
+	case errors.Is(err, errMissingFlag), errors.Is(err, errInvalidFlag), errors.Is(err, errIncompatibleFlags):
+		return errorCodeUsage, exitCodeUsage
+	case errors.As(err, &libErrs), errors.As(err, &paramErrs),
+		engineErr.ErrType == result.ErrLibraryParsing, engineErr.ErrType == result.ErrParameterParsing:
+		return errorCodeParse, exitCodeParse
+	// IO errors are checked before evaluation errors, since a retriever or terminology server
+	// failure during evaluation is an IO failure rather than a problem with the CQL.
+	case errors.As(err, &pathErr), errors.As(err, &netErr):
+		return errorCodeIO, exitCodeIO
+	case engineErr.ErrType == result.ErrEvaluationError:
+		return errorCodeEval, exitCodeEval
+	}
+	return errorCodeError, exitCodeError
+}
+
+// parseSubcommandFlags registers --error_format in fs and parses the flags of a subcommand from
+// args. errorFormat is set as soon as the flags are parsed, so that the failures of the subcommand
+// are reported in the requested format. An invalid --error_format is reported as text.
+func parseSubcommandFlags(fs *flag.FlagSet, args []string, errorFormat *string) error {
+	fs.StringVar(errorFormat, "error_format", errorFormatText, errorFormatUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := validateErrorFormat(*errorFormat); err != nil {
+		*errorFormat = errorFormatText
+		return err
+	}
+	return nil
+}
+
+// reportError writes err to w in the error format and returns the exit code of the failure.
+// command is the name of the subcommand that failed, or empty for the evaluation of the CQL.
+func reportError(w io.Writer, command, errorFormat string, err error) int {
+	code, exitCode := classifyError(err)
+	if errorFormat != errorFormatJSON {
+		name := "CQL CLI"
+		if command != "" {
+			name += " " + command
+		}
+		log.New(w, "", log.LstdFlags).Printf("%s failed with an error: %v", name, err)
+		return exitCode
+	}
+
+	out := cliError{Code: code, ExitCode: exitCode, Command: command, Message: err.Error()}
+	if code == errorCodeParse {
+		report := &validationReport{}
+		addParseDiagnostics(report, err)
+		out.Diagnostics = report.Diagnostics
+	}
+	var engineErr result.EngineError
+	if code == errorCodeEval && errors.As(err, &engineErr) {
+		out.Library = engineErr.Resource
+	}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("failed to write error %v: %v", out, err)
+	}
+	return exitCode
+}
+
+// fatal reports err to stderr in the error format and exits with the exit code of the failure.
+func fatal(command, errorFormat string, err error) {
+	os.Exit(reportError(os.Stderr, command, errorFormat, err))
+}
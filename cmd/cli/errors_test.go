@@ -0,0 +1,225 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/cql"
+	"github.com/google/cql/result"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClassifyError(t *testing.T) {
+	_, parseErr := cql.Parse(context.Background(), []string{"library TESTLIB define A: B"}, cql.ParseConfig{})
+	if parseErr == nil {
+		t.Fatalf("cql.Parse() succeeded, want error")
+	}
+	_, statErr := os.Stat("/bad/path")
+	tests := []struct {
+		name         string
+		err          error
+		wantCode     string
+		wantExitCode int
+	}{
+		{
+			name:         "Flag",
+			err:          fmt.Errorf("%w --cql_dir", errMissingFlag),
+			wantCode:     errorCodeUsage,
+			wantExitCode: exitCodeUsage,
+		},
+		{
+			name:         "Parsing",
+			err:          fmt.Errorf("failed to parse CQL: %w", parseErr),
+			wantCode:     errorCodeParse,
+			wantExitCode: exitCodeParse,
+		},
+		{
+			name:         "Evaluation",
+			err:          fmt.Errorf("failed to run CQL: %w", result.NewEngineError("TESTLIB", result.ErrEvaluationError, errors.New("division failed"))),
+			wantCode:     errorCodeEval,
+			wantExitCode: exitCodeEval,
+		},
+		{
+			name:         "File",
+			err:          fmt.Errorf("failed to read CQL libraries: %w", statErr),
+			wantCode:     errorCodeIO,
+			wantExitCode: exitCodeIO,
+		},
+		{
+			name:         "Server during evaluation",
+			err:          result.NewEngineError("TESTLIB", result.ErrEvaluationError, &url.Error{Op: "Get", URL: "https://fhir.test", Err: errors.New("connection refused")}),
+			wantCode:     errorCodeIO,
+			wantExitCode: exitCodeIO,
+		},
+		{
+			name:         "Other",
+			err:          errTestsFailed,
+			wantCode:     errorCodeError,
+			wantExitCode: exitCodeError,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, exitCode := classifyError(tc.err)
+			if code != tc.wantCode || exitCode != tc.wantExitCode {
+				t.Errorf("classifyError(%v) = %s, %d, want %s, %d", tc.err, code, exitCode, tc.wantCode, tc.wantExitCode)
+			}
+		})
+	}
+}
+
+func TestReportError_JSON(t *testing.T) {
+	_, parseErr := cql.Parse(context.Background(), []string{"library TESTLIB version '1.0.0'\ndefine A: B"}, cql.ParseConfig{})
+	if parseErr == nil {
+		t.Fatalf("cql.Parse() succeeded, want error")
+	}
+	tests := []struct {
+		name         string
+		command      string
+		err          error
+		want         cliError
+		wantExitCode int
+	}{
+		{
+			name: "Parsing",
+			err:  fmt.Errorf("failed to parse CQL: %w", parseErr),
+			want: cliError{
+				Code:     errorCodeParse,
+				ExitCode: exitCodeParse,
+				Message:  fmt.Errorf("failed to parse CQL: %w", parseErr).Error(),
+				Diagnostics: []diagnostic{{
+					Severity: severityError,
+					Check:    checkParse,
+					Library:  "TESTLIB 1.0.0",
+					Line:     2,
+					Column:   10,
+					Message:  "could not resolve the local reference to B",
+				}},
+			},
+			wantExitCode: exitCodeParse,
+		},
+		{
+			name: "Evaluation",
+			err:  result.NewEngineError("TESTLIB 1.0.0", result.ErrEvaluationError, errors.New("division failed")),
+			want: cliError{
+				Code:     errorCodeEval,
+				ExitCode: exitCodeEval,
+				Message:  "failed during CQL evaluation: TESTLIB 1.0.0, division failed",
+				Library:  "TESTLIB 1.0.0",
+			},
+			wantExitCode: exitCodeEval,
+		},
+		{
+			name:    "Subcommand",
+			command: testCommand,
+			err:     errTestsFailed,
+			want: cliError{
+				Code:     errorCodeError,
+				ExitCode: exitCodeError,
+				Command:  testCommand,
+				Message:  "test cases failed",
+			},
+			wantExitCode: exitCodeError,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if got := reportError(&buf, tc.command, errorFormatJSON, tc.err); got != tc.wantExitCode {
+				t.Errorf("reportError() = %d, want %d", got, tc.wantExitCode)
+			}
+			var got cliError
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", buf.String(), err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("reportError() unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReportError_Text(t *testing.T) {
+	var buf bytes.Buffer
+	err := fmt.Errorf("%w --cql_dir", errMissingFlag)
+	if got := reportError(&buf, "", errorFormatText, err); got != exitCodeUsage {
+		t.Errorf("reportError() = %d, want %d", got, exitCodeUsage)
+	}
+	if want := "CQL CLI failed with an error: missing required flag --cql_dir\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("reportError() wrote %q, want suffix %q", buf.String(), want)
+	}
+}
+
+func TestSubcommands_ErrorFormat(t *testing.T) {
+	seen := map[string]bool{}
+	for _, cmd := range subcommands {
+		if seen[cmd.name] {
+			t.Errorf("subcommand %q is registered more than once", cmd.name)
+		}
+		seen[cmd.name] = true
+	}
+	for _, name := range []string{validateCommand, testCommand, fmtCommand, depsCommand, explainCommand, measureCommand, dataRequirementsCommand, downloadValueSetsCommand} {
+		if !seen[name] {
+			t.Errorf("subcommand %q is not registered", name)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		args            []string
+		wantErr         error
+		wantErrorFormat string
+	}{
+		{
+			name:            "json",
+			args:            []string{"--error_format=json"},
+			wantErr:         errMissingFlag,
+			wantErrorFormat: errorFormatJSON,
+		},
+		{
+			name:            "default",
+			args:            []string{},
+			wantErr:         errMissingFlag,
+			wantErrorFormat: errorFormatText,
+		},
+		{
+			name:            "invalid",
+			args:            []string{"--error_format=xml"},
+			wantErr:         errInvalidFlag,
+			wantErrorFormat: errorFormatText,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			errorFormat := errorFormatText
+			err := runValidate(context.Background(), tc.args, &bytes.Buffer{}, &errorFormat)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("runValidate(%v) returned error %v, want %v", tc.args, err, tc.wantErr)
+			}
+			if errorFormat != tc.wantErrorFormat {
+				t.Errorf("runValidate(%v) set error format %q, want %q", tc.args, errorFormat, tc.wantErrorFormat)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/cql"
+	"github.com/google/cql/internal/compression"
+	"github.com/google/cql/internal/datehelpers"
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/local"
+)
+
+// explainCommand is the name of the CLI subcommand that prints the evaluation tree of a single
+// expression definition.
+const explainCommand = "explain"
+
+// Limits that keep the evaluation tree printed by the explain subcommand readable.
+const (
+	// explainMaxSource is the number of characters of CQL source printed for each sub-expression.
+	explainMaxSource = 60
+	// explainMaxValues is the number of values printed for a sub-expression that was evaluated more
+	// than once, for example once per row of a query.
+	explainMaxValues = 3
+	// explainMaxListElements is the number of elements printed for each List.
+	explainMaxListElements = 5
+)
+
+type explainConfig struct {
+	CQLDir             string
+	FHIRBundle         string
+	FHIRTerminologyDir string
+	Define             string
+	Library            string
+	Parameter          parameterFlags
+
+	// Should not be set directly by a flag.
+	gcsEndpoint string
+}
+
+func (cfg *explainConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.CQLDir, "cql_dir", "", "(Required) Directory holding 1 or more CQL files.")
+	fs.StringVar(&cfg.FHIRBundle, "fhir_bundle", "", "(Optional) A FHIR bundle JSON file, which may be compressed, holding the data of the patient to explain the result of.")
+	fs.StringVar(&cfg.FHIRTerminologyDir, "fhir_terminology_dir", "", "(Optional) Directory holding FHIR Valueset JSONs.")
+	fs.StringVar(&cfg.Define, "define", "", "(Required) The name of the expression definition to explain. Private definitions can be explained.")
+	fs.StringVar(&cfg.Library, "library", "", "(Optional) The name of the library of --define. Required if more than one library defines it.")
+	fs.Var(&cfg.Parameter, "parameter", "(Optional, repeated) A parameter to pass to the CQL execution in the form [Library.]Name=value, where value is a CQL literal.")
+
+	cfg.gcsEndpoint = gcs.DefaultCloudStorageEndpoint
+}
+
+// runExplain parses the explain subcommand flags from args, runs it and writes the evaluation tree
+// to w.
+func runExplain(ctx context.Context, args []string, w io.Writer, errorFormat *string) error {
+	fs := flag.NewFlagSet(explainCommand, flag.ExitOnError)
+	var cfg explainConfig
+	cfg.RegisterFlags(fs)
+	if err := parseSubcommandFlags(fs, args, errorFormat); err != nil {
+		return err
+	}
+	return explain(ctx, cfg, w)
+}
+
+// explain evaluates the expression definition in debug mode, and writes the value of every
+// sub-expression evaluated for it to w as a tree that follows the structure of the CQL source.
+// Referenced expression definitions are shown with their value, run explain on them to see why
+// they have that value.
+func explain(ctx context.Context, cfg explainConfig, w io.Writer) error {
+	if cfg.CQLDir == "" {
+		return fmt.Errorf("%w --cql_dir", errMissingFlag)
+	}
+	if cfg.Define == "" {
+		return fmt.Errorf("%w --define", errMissingFlag)
+	}
+	cliCfg := &cliConfig{Parameter: cfg.Parameter, gcsEndpoint: cfg.gcsEndpoint}
+	cqlLibs, err := readCQLLibs(ctx, cfg.CQLDir, cliCfg)
+	if err != nil {
+		return fmt.Errorf("failed to read CQL libraries: %w", err)
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		return fmt.Errorf("failed to create FHIR data model: %w", err)
+	}
+	parseCfg := cql.ParseConfig{DataModels: [][]byte{fhirDM}}
+	elm, err := cql.Parse(ctx, cqlLibs, parseCfg)
+	if err != nil {
+		return fmt.Errorf("failed to parse CQL: %w", err)
+	}
+	rawParams, err := rawParameters(ctx, cliCfg)
+	if err != nil {
+		return err
+	}
+	if len(rawParams) > 0 {
+		if parseCfg.Parameters, err = resolveParameters(elm, rawParams); err != nil {
+			return err
+		}
+		if elm, err = cql.Parse(ctx, cqlLibs, parseCfg); err != nil {
+			return fmt.Errorf("failed to parse CQL parameters: %w", err)
+		}
+	}
+	tp, err := maybeGetTerminologyProvider(ctx, cfg.FHIRTerminologyDir, cliCfg)
+	if err != nil {
+		return fmt.Errorf("failed to get terminology: %w", err)
+	}
+	var ret retriever.Retriever
+	if cfg.FHIRBundle != "" {
+		if ret, err = explainRetriever(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
+	define := cfg.Define
+	if cfg.Library != "" {
+		define = cfg.Library + "." + cfg.Define
+	}
+	filter, err := result.ParseDefineFilter(define, "", "", "")
+	if err != nil {
+		return err
+	}
+	res, err := elm.Eval(ctx, ret, cql.EvalConfig{
+		Terminology:         tp,
+		ReturnPrivateDefs:   true,
+		Debug:               true,
+		DefineFilter:        filter,
+		SkipFilteredDefines: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to evaluate CQL: %w", err)
+	}
+
+	var found []result.LibKey
+	for k, defs := range res {
+		if _, ok := defs[cfg.Define]; ok {
+			found = append(found, k)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return fmt.Errorf("%w --define: no expression definition %q found", errInvalidFlag, define)
+	case len(found) > 1:
+		sort.Slice(found, func(i, j int) bool { return found[i].Key() < found[j].Key() })
+		names := make([]string, 0, len(found))
+		for _, k := range found {
+			names = append(names, k.Name)
+		}
+		return fmt.Errorf("%w --define: %q is defined in libraries %s, set --library", errInvalidFlag, cfg.Define, strings.Join(names, ", "))
+	}
+	v := res[found[0]][cfg.Define]
+	steps, _ := v.DebugTrace()
+	return writeExplainTree(w, found[0], cfg.Define, v, steps, librarySources(cqlLibs))
+}
+
+// explainRetriever returns a retriever for the bundle of the explain subcommand.
+func explainRetriever(ctx context.Context, cfg explainConfig) (retriever.Retriever, error) {
+	data, err := iohelpers.ReadFile(ctx, cfg.FHIRBundle, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return nil, err
+	}
+	files, err := compression.Decompress(cfg.FHIRBundle, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("%w --fhir_bundle must hold a single bundle, found %d in %s", errInvalidFlag, len(files), cfg.FHIRBundle)
+	}
+	ret, err := local.NewRetrieverFromR4Bundle(files[0].Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle %s: %w", cfg.FHIRBundle, err)
+	}
+	return ret, nil
+}
+
+// libraryHeader matches the library declaration of a CQL library.
+var libraryHeader = regexp.MustCompile(`(?m)^\s*library\s+("[^"]+"|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// librarySources returns the source of each named CQL library keyed by the library name.
+func librarySources(cqlLibs []string) map[string][]string {
+	sources := make(map[string][]string, len(cqlLibs))
+	for _, lib := range cqlLibs {
+		m := libraryHeader.FindStringSubmatch(lib)
+		if m == nil {
+			continue
+		}
+		sources[strings.Trim(m[1], `"`)] = strings.Split(strings.ReplaceAll(lib, "\r\n", "\n"), "\n")
+	}
+	return sources
+}
+
+// explainNode is a sub-expression in the evaluation tree of an expression definition.
+type explainNode struct {
+	loc      result.Locator
+	values   []result.Value
+	children []*explainNode
+}
+
+// contains returns true if the source range of the node encloses loc.
+func (n *explainNode) contains(loc result.Locator) bool {
+	return n.loc.Library == loc.Library &&
+		!locatorBefore(loc.StartLine, loc.StartCol, n.loc.StartLine, n.loc.StartCol) &&
+		!locatorBefore(n.loc.EndLine, n.loc.EndCol, loc.EndLine, loc.EndCol)
+}
+
+func locatorBefore(line1, col1, line2, col2 int) bool {
+	return line1 < line2 || (line1 == line2 && col1 < col2)
+}
+
+// explainTree returns the evaluation tree of a debug trace. The last step of a trace is the body of
+// the expression definition, and the other sub-expressions are nested by their source ranges.
+// Sub-expressions outside the body, such as the bodies of called functions, are left out.
+func explainTree(steps []result.DebugStep) *explainNode {
+	if len(steps) == 0 {
+		return nil
+	}
+	root := &explainNode{loc: steps[len(steps)-1].Locator}
+	nodes := map[result.Locator]*explainNode{root.loc: root}
+	for _, s := range steps {
+		if !root.contains(s.Locator) {
+			continue
+		}
+		n, ok := nodes[s.Locator]
+		if !ok {
+			n = &explainNode{loc: s.Locator}
+			nodes[s.Locator] = n
+		}
+		n.values = append(n.values, s.Value)
+	}
+
+	sorted := make([]*explainNode, 0, len(nodes))
+	for _, n := range nodes {
+		if n != root {
+			sorted = append(sorted, n)
+		}
+	}
+	// Outer sub-expressions come before the sub-expressions they enclose.
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].loc, sorted[j].loc
+		if a.StartLine != b.StartLine || a.StartCol != b.StartCol {
+			return locatorBefore(a.StartLine, a.StartCol, b.StartLine, b.StartCol)
+		}
+		return locatorBefore(b.EndLine, b.EndCol, a.EndLine, a.EndCol)
+	})
+	stack := []*explainNode{root}
+	for _, n := range sorted {
+		for len(stack) > 1 && !stack[len(stack)-1].contains(n.loc) {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+		parent.children = append(parent.children, n)
+		stack = append(stack, n)
+	}
+	return root
+}
+
+// writeExplainTree writes the value of the expression definition followed by its evaluation tree,
+// one sub-expression per line indented by its depth.
+func writeExplainTree(w io.Writer, lib result.LibKey, define string, v result.Value, steps []result.DebugStep, sources map[string][]string) error {
+	if _, err := fmt.Fprintf(w, "%s.%s = %s\n", lib.Name, define, formatExplainValue(v)); err != nil {
+		return err
+	}
+	var write func(n *explainNode, depth int) error
+	write = func(n *explainNode, depth int) error {
+		if _, err := fmt.Fprintf(w, "%s%s = %s\n", strings.Repeat("  ", depth), explainSource(n.loc, sources), formatExplainValues(n.values)); err != nil {
+			return err
+		}
+		for _, c := range n.children {
+			if err := write(c, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if root := explainTree(steps); root != nil {
+		return write(root, 1)
+	}
+	return nil
+}
+
+// explainSource returns the CQL source of the locator on a single line, shortened to
+// explainMaxSource characters. If the source is not known the locator itself is returned.
+func explainSource(loc result.Locator, sources map[string][]string) string {
+	lines := sources[loc.Library.Name]
+	if loc.StartLine < 1 || loc.EndLine > len(lines) || loc.StartLine > loc.EndLine {
+		return loc.String()
+	}
+	var parts []string
+	for l := loc.StartLine; l <= loc.EndLine; l++ {
+		line := lines[l-1]
+		start, end := 0, len(line)
+		if l == loc.StartLine {
+			start = min(max(loc.StartCol-1, 0), len(line))
+		}
+		if l == loc.EndLine {
+			end = min(max(loc.EndCol, start), len(line))
+		}
+		parts = append(parts, line[start:end])
+	}
+	src := strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+	if r := []rune(src); len(r) > explainMaxSource {
+		src = string(r[:explainMaxSource-3]) + "..."
+	}
+	return src
+}
+
+// formatExplainValues formats the values of a sub-expression. Sub-expressions evaluated more than
+// once, such as the where clause of a query, list the first values and the number of evaluations.
+func formatExplainValues(vals []result.Value) string {
+	if len(vals) == 1 {
+		return formatExplainValue(vals[0])
+	}
+	formatted := make([]string, 0, explainMaxValues)
+	for _, v := range vals[:min(len(vals), explainMaxValues)] {
+		formatted = append(formatted, formatExplainValue(v))
+	}
+	s := strings.Join(formatted, ", ")
+	if len(vals) > explainMaxValues {
+		s += ", ..."
+	}
+	return fmt.Sprintf("%s (%d evaluations)", s, len(vals))
+}
+
+// formatExplainValue formats a value in a compact CQL like syntax. FHIR resources are shown as
+// references, and long Lists are shortened.
+func formatExplainValue(v result.Value) string {
+	if ref, ok := v.ResourceRef(); ok {
+		return ref.String()
+	}
+	var s string
+	var err error
+	switch gv := v.GolangValue().(type) {
+	case nil:
+		return "null"
+	case string:
+		return "'" + gv + "'"
+	case bool, int32:
+		return fmt.Sprint(gv)
+	case int64:
+		return fmt.Sprintf("%dL", gv)
+	case float64:
+		d := strconv.FormatFloat(gv, 'f', -1, 64)
+		if !strings.ContainsAny(d, ".NI") {
+			d += ".0"
+		}
+		return d
+	case result.Quantity:
+		return fmt.Sprintf("%v '%s'", gv.Value, gv.Unit)
+	case result.Interval:
+		low, high := "(", ")"
+		if gv.LowInclusive {
+			low = "["
+		}
+		if gv.HighInclusive {
+			high = "]"
+		}
+		return "Interval" + low + formatExplainValue(gv.Low) + ", " + formatExplainValue(gv.High) + high
+	case result.List:
+		elems := make([]string, 0, min(len(gv.Value), explainMaxListElements)+1)
+		for _, e := range gv.Value[:min(len(gv.Value), explainMaxListElements)] {
+			elems = append(elems, formatExplainValue(e))
+		}
+		if len(gv.Value) > explainMaxListElements {
+			elems = append(elems, fmt.Sprintf("... %d more", len(gv.Value)-explainMaxListElements))
+		}
+		return "{" + strings.Join(elems, ", ") + "}"
+	case result.Date:
+		s, err = datehelpers.DateString(gv.Date, gv.Precision)
+	case result.DateTime:
+		s, err = datehelpers.DateTimeString(gv.Date, gv.Precision)
+	case result.Time:
+		s, err = datehelpers.TimeString(gv.Date, gv.Precision)
+	default:
+		var b []byte
+		b, err = json.Marshal(v)
+		s = string(b)
+	}
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return s
+}
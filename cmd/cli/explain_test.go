@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExplain(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `library TESTLIB
+using FHIR version '4.0.1'
+context Patient
+define private Finished: [Encounter] E where E.status.value = 'finished'
+define Numerator:
+  exists Finished
+    and Count([Encounter]) > 2`)
+	bundle := filepath.Join(testDirCfg.FHIRBundleDir, "bundle.json")
+	writeLocalFileWithContent(t, bundle, `{"resourceType": "Bundle", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "1"}},
+		{"resource": {"resourceType": "Encounter", "id": "finished", "status": "finished"}},
+		{"resource": {"resourceType": "Encounter", "id": "planned", "status": "planned"}}
+	]}`)
+
+	tests := []struct {
+		name   string
+		define string
+		want   string
+	}{
+		{
+			name:   "Referenced definitions are leaves",
+			define: "Numerator",
+			want: `TESTLIB.Numerator = false
+  exists Finished and Count([Encounter]) > 2 = false
+    exists Finished = true
+      Finished = {Encounter/finished}
+    Count([Encounter]) > 2 = false
+      Count([Encounter]) = 2
+        [Encounter] = {Encounter/finished, Encounter/planned}
+      2 = 2
+`,
+		},
+		{
+			name:   "Query rows",
+			define: "Finished",
+			want: `TESTLIB.Finished = {Encounter/finished}
+  [Encounter] E where E.status.value = 'finished' = {Encounter/finished}
+    [Encounter] = {Encounter/finished, Encounter/planned}
+    E.status.value = 'finished' = true, false (2 evaluations)
+      E.status.value = 'finished', 'planned' (2 evaluations)
+        E.status = {"@type":"FHIR.EncounterStatus","value":{"value":"FINISHED"}}, {"@type":"FHIR.EncounterStatus","value":{"value":"PLANNED"}} (2 evaluations)
+          E = Encounter/finished, Encounter/planned (2 evaluations)
+      'finished' = 'finished', 'finished' (2 evaluations)
+`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got bytes.Buffer
+			cfg := explainConfig{CQLDir: testDirCfg.CQLDir, FHIRBundle: bundle, Define: tc.define}
+			if err := explain(context.Background(), cfg, &got); err != nil {
+				t.Fatalf("explain() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got.String()); diff != "" {
+				t.Errorf("explain() unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExplain_Error(t *testing.T) {
+	cqlDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(cqlDir, "a.cql"), "library A\ndefine X: 1")
+	writeLocalFileWithContent(t, filepath.Join(cqlDir, "b.cql"), "library B\ndefine X: 2")
+	tests := []struct {
+		name    string
+		cfg     explainConfig
+		wantErr error
+	}{
+		{
+			name:    "Missing define",
+			cfg:     explainConfig{CQLDir: cqlDir},
+			wantErr: errMissingFlag,
+		},
+		{
+			name:    "Unknown define",
+			cfg:     explainConfig{CQLDir: cqlDir, Define: "Y"},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name:    "Define in more than one library",
+			cfg:     explainConfig{CQLDir: cqlDir, Define: "X"},
+			wantErr: errInvalidFlag,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := explain(context.Background(), tc.cfg, &bytes.Buffer{})
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("explain() returned error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	var got bytes.Buffer
+	if err := explain(context.Background(), explainConfig{CQLDir: cqlDir, Define: "X", Library: "B"}, &got); err != nil {
+		t.Fatalf("explain() with --library returned unexpected error: %v", err)
+	}
+	if want := "B.X = 2\n  2 = 2\n"; got.String() != want {
+		t.Errorf("explain() with --library = %q, want %q", got.String(), want)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/google/cql/retriever/fhirserver"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// fhirServerBearerTokenEnv is the environment variable from which the FHIR server bearer token is
+// read if --fhir_server_bearer_token is not set.
+const fhirServerBearerTokenEnv = "FHIR_SERVER_BEARER_TOKEN"
+
+// patientIDs returns the ids of the comma separated --patient_id flag.
+func patientIDs(flag string) []string {
+	var ids []string
+	for _, id := range strings.Split(flag, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// fhirServerConfig returns the config of the connection to the FHIR server set by the flags.
+func fhirServerConfig(ctx context.Context, cfg *cliConfig) (fhirserver.Config, error) {
+	serverCfg := fhirserver.Config{BaseURL: cfg.FHIRServerURL, BearerToken: cfg.FHIRServerBearerToken}
+	if cfg.FHIRServerGCPAuth {
+		client, _, err := htransport.NewClient(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+		if err != nil {
+			return fhirserver.Config{}, err
+		}
+		serverCfg.Client = client
+	} else {
+		serverCfg.Client = &http.Client{}
+	}
+	return serverCfg, nil
+}
+
+// sendServerPatients sends a job for each patient on the FHIR server to jobs, until the context is
+// cancelled. Resources are fetched from the server as the CQL retrieves them. The results of each
+// patient are output to a file named after the patient id.
+func sendServerPatients(ctx context.Context, serverCfg fhirserver.Config, ids []string, jobs chan<- bundleJob) error {
+	for i, id := range ids {
+		if err := validatePatientID(id); err != nil {
+			return err
+		}
+		ret, err := fhirserver.New(serverCfg, id)
+		if err != nil {
+			return err
+		}
+		job := bundleJob{index: i, patientID: id, fileName: id + ".json", retriever: ret}
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/cql/retriever/fhirserver"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCLIFHIRServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer secret" {
+			http.Error(w, `{"resourceType": "OperationOutcome"}`, http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/fhir/Patient/p1", "/fhir/Patient/p2":
+			fmt.Fprintf(w, `{"resourceType": "Patient", "id": "%s"}`, filepath.Base(req.URL.Path))
+		case "/fhir/Patient/p1/Encounter":
+			fmt.Fprint(w, `{"resourceType": "Bundle", "type": "searchset", "entry": [
+				{"resource": {"resourceType": "Encounter", "id": "e1"}},
+				{"resource": {"resourceType": "Encounter", "id": "e2"}}
+			]}`)
+		case "/fhir/Patient/p2/Encounter":
+			fmt.Fprint(w, `{"resourceType": "Bundle", "type": "searchset"}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	using FHIR version '4.0.1'
+	context Patient
+	define PatientID: Patient.id.value
+	define EncounterCount: Count([Encounter])`)
+	cfg := cliConfig{
+		CQLDir:                testDirCfg.CQLDir,
+		JSONOutputDir:         testDirCfg.JSONOutputDir,
+		FHIRServerURL:         server.URL + "/fhir",
+		FHIRServerBearerToken: "secret",
+		PatientIDs:            "p1, p2",
+		OutputFormat:          outputFormatJSON,
+		Concurrency:           2,
+	}
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+
+	wantCounts := map[string]float64{"p1": 2, "p2": 0}
+	for id, wantCount := range wantCounts {
+		b, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, id+".json"))
+		if err != nil {
+			t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+		}
+		var res struct {
+			EvalResults []struct {
+				ExpressionDefinitions map[string]struct {
+					Value any `json:"value"`
+				} `json:"expressionDefinitions"`
+			} `json:"evalResults"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+		}
+		got := res.EvalResults
+		if len(got) != 1 {
+			t.Fatalf("%s.json has %d library results, want 1", id, len(got))
+		}
+		defs := got[0].ExpressionDefinitions
+		gotDefs := map[string]any{"PatientID": defs["PatientID"].Value, "EncounterCount": defs["EncounterCount"].Value}
+		wantDefs := map[string]any{"PatientID": id, "EncounterCount": wantCount}
+		if diff := cmp.Diff(wantDefs, gotDefs); diff != "" {
+			t.Errorf("%s.json results diff (-want +got):\n%s", id, diff)
+		}
+	}
+}
+
+func TestCLIFHIRServer_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"resourceType": "OperationOutcome"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	using FHIR version '4.0.1'
+	context Patient
+	define PatientID: Patient.id.value`)
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+		FHIRServerURL: server.URL,
+		PatientIDs:    "p1",
+		OutputFormat:  outputFormatJSON,
+		Concurrency:   1,
+	}
+	if err := mainWrapper(context.Background(), cfg); err == nil {
+		t.Errorf("mainWrapper() succeeded, want error for an unauthorized FHIR server")
+	}
+}
+
+func TestSendServerPatients_InvalidID(t *testing.T) {
+	jobs := make(chan bundleJob, 1)
+	err := sendServerPatients(context.Background(), fhirserver.Config{BaseURL: "http://localhost"}, []string{"../../x"}, jobs)
+	if err == nil || !strings.Contains(err.Error(), "not a valid FHIR id") {
+		t.Errorf("sendServerPatients() returned error %v, want an invalid id error", err)
+	}
+}
+
+func TestPatientIDs(t *testing.T) {
+	if diff := cmp.Diff([]string{"p1", "p2"}, patientIDs(" p1,,p2 ")); diff != "" {
+		t.Errorf("patientIDs() diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/cql/formatter"
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/kylelemons/godebug/diff"
+)
+
+// fmtCommand is the name of the CLI subcommand that formats CQL files.
+const fmtCommand = "fmt"
+
+// errNotFormatted is returned by the fmt subcommand if a CQL file is not formatted and --write is
+// not set.
+var errNotFormatted = errors.New("CQL files are not formatted, run with --write to format them")
+
+type fmtConfig struct {
+	CQLDir string
+	Write  bool
+	Diff   bool
+
+	// Should not be set directly by a flag.
+	gcsEndpoint string
+}
+
+func (cfg *fmtConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.CQLDir, "cql_dir", "", "(Required) Directory holding 1 or more CQL files.")
+	fs.BoolVar(&cfg.Write, "write", false, "(Optional) If true, CQL files that are not formatted are overwritten with the formatted CQL.")
+	fs.BoolVar(&cfg.Diff, "diff", false, "(Optional) If true, the diff between each CQL file that is not formatted and the formatted CQL is printed.")
+
+	cfg.gcsEndpoint = gcs.DefaultCloudStorageEndpoint
+}
+
+// runFmt parses the fmt subcommand flags from args and runs it, writing its output to w.
+func runFmt(ctx context.Context, args []string, w io.Writer, errorFormat *string) error {
+	fs := flag.NewFlagSet(fmtCommand, flag.ExitOnError)
+	var cfg fmtConfig
+	cfg.RegisterFlags(fs)
+	if err := parseSubcommandFlags(fs, args, errorFormat); err != nil {
+		return err
+	}
+	return formatCQLFiles(ctx, cfg, w)
+}
+
+// formatCQLFiles formats the CQL files in the CQL directory. The name of each file that is not
+// formatted is written to w, followed by its diff if --diff is set. Unless --write is set, which
+// overwrites the files, errNotFormatted is returned if any file is not formatted, so that the
+// command can be used to check formatting in CI.
+func formatCQLFiles(ctx context.Context, cfg fmtConfig, w io.Writer) error {
+	if cfg.CQLDir == "" {
+		return fmt.Errorf("%w --cql_dir", errMissingFlag)
+	}
+	ioCfg := &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint}
+	filePaths, err := iohelpers.FilesWithSuffix(ctx, cfg.CQLDir, ".cql", ioCfg)
+	if err != nil {
+		return err
+	}
+	unformatted := false
+	for _, filePath := range filePaths {
+		src, err := iohelpers.ReadFile(ctx, filePath, ioCfg)
+		if err != nil {
+			return fmt.Errorf("failed to read CQL file %s: %w", filePath, err)
+		}
+		formatted, err := formatter.Format(string(src))
+		if err != nil {
+			return fmt.Errorf("failed to format CQL file %s: %w", filePath, err)
+		}
+		if formatted == string(src) {
+			continue
+		}
+		unformatted = true
+		fmt.Fprintln(w, filePath)
+		if cfg.Diff {
+			fmt.Fprintln(w, diff.Diff(string(src), formatted))
+		}
+		if cfg.Write {
+			if err := iohelpers.WriteFile(ctx, cfg.CQLDir, path.Base(filePath), []byte(formatted), ioCfg); err != nil {
+				return fmt.Errorf("failed to write CQL file %s: %w", filePath, err)
+			}
+		}
+	}
+	if unformatted && !cfg.Write {
+		return errNotFormatted
+	}
+	return nil
+}
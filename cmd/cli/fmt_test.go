@@ -0,0 +1,98 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatCQLFiles(t *testing.T) {
+	const (
+		unformatted = "library A  \ndefine X: 1"
+		formatted   = "library B\n\ndefine X: 1\n"
+	)
+	tests := []struct {
+		name      string
+		cfg       fmtConfig
+		wantErr   error
+		wantOut   []string
+		wantFileA string
+	}{
+		{
+			name:      "Check",
+			wantErr:   errNotFormatted,
+			wantOut:   []string{"a.cql"},
+			wantFileA: unformatted,
+		},
+		{
+			name:      "Diff",
+			cfg:       fmtConfig{Diff: true},
+			wantErr:   errNotFormatted,
+			wantOut:   []string{"a.cql", "-library A  ", "+library A", " define X: 1"},
+			wantFileA: unformatted,
+		},
+		{
+			name:      "Write",
+			cfg:       fmtConfig{Write: true},
+			wantOut:   []string{"a.cql"},
+			wantFileA: "library A\n\ndefine X: 1\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeLocalFileWithContent(t, filepath.Join(dir, "a.cql"), unformatted)
+			writeLocalFileWithContent(t, filepath.Join(dir, "b.cql"), formatted)
+			tc.cfg.CQLDir = dir
+
+			var out bytes.Buffer
+			if err := formatCQLFiles(context.Background(), tc.cfg, &out); !errors.Is(err, tc.wantErr) {
+				t.Errorf("formatCQLFiles() returned error %v, want %v", err, tc.wantErr)
+			}
+			for _, want := range tc.wantOut {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("formatCQLFiles() output %q, want it to contain %q", out.String(), want)
+				}
+			}
+			if strings.Contains(out.String(), "b.cql") {
+				t.Errorf("formatCQLFiles() output %q, want the formatted b.cql to not be listed", out.String())
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "a.cql"))
+			if err != nil {
+				t.Fatalf("os.ReadFile() returned unexpected error: %v", err)
+			}
+			if string(got) != tc.wantFileA {
+				t.Errorf("a.cql = %q, want %q", got, tc.wantFileA)
+			}
+		})
+	}
+}
+
+func TestFormatCQLFiles_Error(t *testing.T) {
+	if err := formatCQLFiles(context.Background(), fmtConfig{}, &bytes.Buffer{}); !errors.Is(err, errMissingFlag) {
+		t.Errorf("formatCQLFiles() returned error %v, want %v", err, errMissingFlag)
+	}
+	dir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(dir, "a.cql"), "library A\ndefine X: 'unterminated\n")
+	if err := formatCQLFiles(context.Background(), fmtConfig{CQLDir: dir}, &bytes.Buffer{}); err == nil {
+		t.Errorf("formatCQLFiles() with an unterminated string succeeded, want error")
+	}
+}
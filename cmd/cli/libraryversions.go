@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/cql/internal/editing"
+)
+
+// Policies for choosing between several versions of the same library in --cql_dir, set by
+// --library_versions.
+const (
+	// libraryVersionsAll parses and evaluates every version. Includes without a version use the
+	// latest version.
+	libraryVersionsAll = "all"
+	// libraryVersionsLatest only uses the latest version of each library.
+	libraryVersionsLatest = "latest"
+	// libraryVersionsError fails if a library has more than one version.
+	libraryVersionsError = "error"
+)
+
+var libraryVersionPolicies = []string{libraryVersionsAll, libraryVersionsLatest, libraryVersionsError}
+
+func validateLibraryVersions(policy string) error {
+	if policy == "" {
+		return nil
+	}
+	for _, p := range libraryVersionPolicies {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w --library_versions, which must be one of %s, got %q", errInvalidFlag, strings.Join(libraryVersionPolicies, ", "), policy)
+}
+
+// resolveLibraryVersions returns the CQL libraries to parse under the version policy. For each
+// library with more than one version the versions found and the versions used are reported to w.
+// Unnamed libraries are always used.
+func resolveLibraryVersions(cqlLibs []string, policy string, w io.Writer) ([]string, error) {
+	// versions holds the index in cqlLibs of each version of each named library.
+	versions := make(map[string]map[string]int)
+	for i, lib := range cqlLibs {
+		decl, ok := editing.LibraryDeclaration(lib)
+		if !ok {
+			continue
+		}
+		if versions[decl.Name] == nil {
+			versions[decl.Name] = make(map[string]int)
+		}
+		versions[decl.Name][decl.Version] = i
+	}
+
+	skip := make(map[int]bool)
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(versions[name]) < 2 {
+			continue
+		}
+		vs := make([]string, 0, len(versions[name]))
+		for v := range versions[name] {
+			vs = append(vs, v)
+		}
+		sort.Slice(vs, func(i, j int) bool { return compareVersions(vs[i], vs[j]) < 0 })
+		switch policy {
+		case libraryVersionsError:
+			return nil, fmt.Errorf("library %s has versions %s in --cql_dir, set --library_versions=%s to use the latest or remove all but one", name, formatVersions(vs), libraryVersionsLatest)
+		case libraryVersionsLatest:
+			for _, v := range vs[:len(vs)-1] {
+				skip[versions[name][v]] = true
+			}
+			fmt.Fprintf(w, "library %s has versions %s, using %s\n", name, formatVersions(vs), formatVersions(vs[len(vs)-1:]))
+		default:
+			fmt.Fprintf(w, "library %s has versions %s, using all of them, includes without a version use %s\n", name, formatVersions(vs), formatVersions(vs[len(vs)-1:]))
+		}
+	}
+
+	resolved := make([]string, 0, len(cqlLibs))
+	for i, lib := range cqlLibs {
+		if !skip[i] {
+			resolved = append(resolved, lib)
+		}
+	}
+	return resolved, nil
+}
+
+// compareVersions compares library versions, returning -1, 0 or 1. Versions are compared segment
+// by segment, where segments are separated by dots or dashes, numerically if both segments are
+// numbers so that 10.0.0 is later than 9.0.0. An empty version is earlier than any other.
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' })
+	}
+	as, bs := split(a), split(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		if aErr == nil && bErr == nil {
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func formatVersions(vs []string) string {
+	quoted := make([]string, 0, len(vs))
+	for _, v := range vs {
+		if v == "" {
+			quoted = append(quoted, "(no version)")
+			continue
+		}
+		quoted = append(quoted, "'"+v+"'")
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestResolveLibraryVersions(t *testing.T) {
+	v9 := "library Helpers version '9.0.0'\ndefine Version: 9"
+	v10 := "/* The current release,\nlibrary Helpers version '8.0.0' is no longer supported. */\nlibrary Helpers version '10.0.0'\ndefine Version: 10"
+	measure := "library \"My Measure\" version '1.0.0'\ninclude Helpers called H\ndefine Version: H.Version"
+	unnamed := "define Unnamed: 1"
+	cqlLibs := []string{v9, v10, measure, unnamed}
+
+	tests := []struct {
+		name       string
+		policy     string
+		want       []string
+		wantReport string
+	}{
+		{
+			name:       "All",
+			policy:     libraryVersionsAll,
+			want:       cqlLibs,
+			wantReport: "library Helpers has versions '9.0.0', '10.0.0', using all of them, includes without a version use '10.0.0'\n",
+		},
+		{
+			name:       "Latest",
+			policy:     libraryVersionsLatest,
+			want:       []string{v10, measure, unnamed},
+			wantReport: "library Helpers has versions '9.0.0', '10.0.0', using '10.0.0'\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var report bytes.Buffer
+			got, err := resolveLibraryVersions(cqlLibs, tc.policy, &report)
+			if err != nil {
+				t.Fatalf("resolveLibraryVersions() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("resolveLibraryVersions() unexpected diff (-want +got):\n%s", diff)
+			}
+			if report.String() != tc.wantReport {
+				t.Errorf("resolveLibraryVersions() reported %q, want %q", report.String(), tc.wantReport)
+			}
+		})
+	}
+
+	_, err := resolveLibraryVersions(cqlLibs, libraryVersionsError, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "library Helpers has versions '9.0.0', '10.0.0'") {
+		t.Errorf("resolveLibraryVersions() returned error %v, want an error listing the versions of Helpers", err)
+	}
+
+	var report bytes.Buffer
+	single := []string{v10, measure}
+	got, err := resolveLibraryVersions(single, libraryVersionsError, &report)
+	if err != nil {
+		t.Fatalf("resolveLibraryVersions() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(single, got); diff != "" || report.Len() != 0 {
+		t.Errorf("resolveLibraryVersions() = %v and reported %q, want the libraries unchanged and no report", got, report.String())
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "1.0.0", b: "1.0.0", want: 0},
+		{a: "9.0.0", b: "10.0.0", want: -1},
+		{a: "1.0.10", b: "1.0.9", want: 1},
+		{a: "1.0", b: "1.0.1", want: -1},
+		{a: "", b: "0.0.1", want: -1},
+		{a: "1.0.0-alpha", b: "1.0.0-beta", want: -1},
+	}
+	for _, tc := range tests {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestCLI_LibraryVersionsLatest(t *testing.T) {
+	cfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(cfg.CQLDir, "helpers_9.cql"), dedent.Dedent(`
+		library Helpers version '9.0.0'
+		define Version: 9`))
+	writeLocalFileWithContent(t, filepath.Join(cfg.CQLDir, "helpers_10.cql"), dedent.Dedent(`
+		library Helpers version '10.0.0'
+		define Version: 10`))
+	cfg.FHIRBundleDir = ""
+	cfg.FHIRTerminologyDir = ""
+	cfg.FHIRParametersFile = ""
+	cfg.LibraryVersions = libraryVersionsLatest
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned unexpected error: %v", err)
+	}
+	got := string(readOutputFile(t, cfg, "results.json"))
+	if !strings.Contains(got, `"libVersion": "10.0.0"`) || strings.Contains(got, `"libVersion": "9.0.0"`) {
+		t.Errorf("mainWrapper() wrote %s, want only the results of Helpers 10.0.0", got)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/measure"
+)
+
+// measureCommand is the name of the CLI subcommand that evaluates a FHIR Measure and generates
+// MeasureReports.
+const measureCommand = "measure"
+
+type measureCommandConfig struct {
+	Measure            string
+	CQLDir             string
+	FHIRBundleDir      string
+	FHIRNDJSONDir      string
+	FHIRTerminologyDir string
+	JSONOutputDir      string
+	PeriodStart        string
+	PeriodEnd          string
+	Parameter          parameterFlags
+	Concurrency        int
+
+	// Should not be set directly by a flag.
+	gcsEndpoint string
+}
+
+func (cfg *measureCommandConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Measure, "measure", "", "(Required) A FHIR Measure JSON file whose population and stratifier criteria reference CQL expression definitions.")
+	fs.StringVar(&cfg.CQLDir, "cql_dir", "", "(Required) Directory holding 1 or more CQL files, including the Measure's library.")
+	fs.StringVar(&cfg.FHIRBundleDir, "fhir_bundle_dir", "", "(Optional) Directory holding FHIR Bundle JSON files, or a single FHIR Bundle JSON file, with one patient per bundle. One of --fhir_bundle_dir or --fhir_ndjson_dir is required.")
+	fs.StringVar(&cfg.FHIRNDJSONDir, "fhir_ndjson_dir", "", "(Optional) Directory holding bulk export style NDJSON files, which are grouped by patient. One of --fhir_bundle_dir or --fhir_ndjson_dir is required.")
+	fs.StringVar(&cfg.FHIRTerminologyDir, "fhir_terminology_dir", "", "(Optional) Directory holding FHIR Valueset JSONs.")
+	fs.StringVar(&cfg.JSONOutputDir, "json_output_dir", "", "(Required) Directory in which to write an individual MeasureReport for each patient and the summary MeasureReport measure_report.json.")
+	fs.StringVar(&cfg.PeriodStart, "period_start", "", "(Optional) The start of the measurement period as a FHIR date, for example 2024-01-01. Sets the period of the MeasureReports. The Measurement Period parameter of the CQL is set with --parameter.")
+	fs.StringVar(&cfg.PeriodEnd, "period_end", "", "(Optional) The end of the measurement period as a FHIR date, for example 2024-12-31.")
+	fs.Var(&cfg.Parameter, "parameter", "(Optional, repeated) A parameter to pass to the CQL execution in the form [Library.]Name=value, where value is a CQL literal. Example: --parameter=\"Measurement Period=Interval[@2024-01-01, @2025-01-01)\"")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 1, "(Optional) The number of patients to evaluate in parallel.")
+
+	cfg.gcsEndpoint = gcs.DefaultCloudStorageEndpoint
+}
+
+// runMeasure parses the measure subcommand flags from args and runs it.
+func runMeasure(ctx context.Context, args []string, errorFormat *string) error {
+	fs := flag.NewFlagSet(measureCommand, flag.ExitOnError)
+	var cfg measureCommandConfig
+	cfg.RegisterFlags(fs)
+	if err := parseSubcommandFlags(fs, args, errorFormat); err != nil {
+		return err
+	}
+	cliCfg, err := measureCLIConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	return mainWrapper(ctx, cliCfg)
+}
+
+// measureCLIConfig returns the configuration of a CLI run that evaluates the criteria of the
+// Measure for every patient and writes the individual and summary MeasureReports.
+func measureCLIConfig(ctx context.Context, cfg measureCommandConfig) (cliConfig, error) {
+	if cfg.Measure == "" {
+		return cliConfig{}, fmt.Errorf("%w --measure", errMissingFlag)
+	}
+	if cfg.JSONOutputDir == "" {
+		return cliConfig{}, fmt.Errorf("%w --json_output_dir", errMissingFlag)
+	}
+	if cfg.FHIRBundleDir == "" && cfg.FHIRNDJSONDir == "" {
+		return cliConfig{}, fmt.Errorf("%w --fhir_bundle_dir or --fhir_ndjson_dir", errMissingFlag)
+	}
+	for _, d := range []struct{ flag, value string }{{"period_start", cfg.PeriodStart}, {"period_end", cfg.PeriodEnd}} {
+		if d.value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, d.value); err != nil {
+			return cliConfig{}, fmt.Errorf("%w --%s must be a date such as 2024-01-01, got %q", errInvalidFlag, d.flag, d.value)
+		}
+	}
+	if cfg.PeriodStart != "" && cfg.PeriodEnd != "" && cfg.PeriodEnd < cfg.PeriodStart {
+		return cliConfig{}, fmt.Errorf("%w --period_end %s is before --period_start %s", errInvalidFlag, cfg.PeriodEnd, cfg.PeriodStart)
+	}
+
+	b, err := iohelpers.ReadFile(ctx, cfg.Measure, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return cliConfig{}, fmt.Errorf("failed to read measure %s: %w", cfg.Measure, err)
+	}
+	m, err := measure.ParseMeasure(b)
+	if err != nil {
+		return cliConfig{}, fmt.Errorf("failed to parse measure %s: %w", cfg.Measure, err)
+	}
+
+	cliCfg := cliConfig{
+		CQLDir:             cfg.CQLDir,
+		FHIRBundleDir:      cfg.FHIRBundleDir,
+		FHIRNDJSONDir:      cfg.FHIRNDJSONDir,
+		FHIRTerminologyDir: cfg.FHIRTerminologyDir,
+		JSONOutputDir:      cfg.JSONOutputDir,
+		Parameter:          cfg.Parameter,
+		Concurrency:        cfg.Concurrency,
+		Measure:            cfg.Measure,
+		OutputFormat:       outputFormatMeasureReport,
+		Defines:            measureDefines(m),
+		measureConfig:      measure.Config{PeriodStart: cfg.PeriodStart, PeriodEnd: cfg.PeriodEnd},
+		gcsEndpoint:        cfg.gcsEndpoint,
+	}
+	return cliCfg, nil
+}
+
+// measureDefines returns the --defines flag that restricts evaluation to the criteria of the
+// Measure. If a criteria name can not be expressed in the flag, everything is evaluated.
+func measureDefines(m *measure.Measure) string {
+	names := m.CriteriaExpressions()
+	for _, n := range names {
+		if strings.ContainsAny(n, ",*?") {
+			return ""
+		}
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMeasureCommand(t *testing.T) {
+	inputs := writeOutputTestInputs(t, outputFormatMeasureReport)
+	// Failing is not a criteria of the Measure, so it must not be evaluated.
+	writeLocalFileWithContent(t, filepath.Join(inputs.CQLDir, "screening.cql"), outputTestCQL+`
+define Failing: Message(1, true, 'E1', 'Error', 'Failing should not be evaluated')`)
+	cfg := measureCommandConfig{
+		Measure:       inputs.Measure,
+		CQLDir:        inputs.CQLDir,
+		FHIRBundleDir: inputs.FHIRBundleDir,
+		JSONOutputDir: inputs.JSONOutputDir,
+		PeriodStart:   "2024-01-01",
+		PeriodEnd:     "2024-12-31",
+	}
+
+	cliCfg, err := measureCLIConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("measureCLIConfig() returned an unexpected error: %v", err)
+	}
+	if err := mainWrapper(context.Background(), cliCfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	var summary struct {
+		Type   string `json:"type"`
+		Period struct {
+			Start string `json:"start"`
+			End   string `json:"end"`
+		} `json:"period"`
+		Group []struct {
+			Population []struct {
+				Count int `json:"count"`
+			} `json:"population"`
+		} `json:"group"`
+	}
+	if err := json.Unmarshal(readOutputFile(t, inputs, "measure_report.json"), &summary); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	if summary.Type != "summary" || summary.Period.Start != "2024-01-01" || summary.Period.End != "2024-12-31" {
+		t.Errorf("measure summary MeasureReport = %+v, want a summary report for the period 2024-01-01 to 2024-12-31", summary)
+	}
+	var counts []int
+	for _, p := range summary.Group[0].Population {
+		counts = append(counts, p.Count)
+	}
+	if diff := cmp.Diff([]int{3, 3, 1}, counts); diff != "" {
+		t.Errorf("measure summary population counts diff (-want +got): %v", diff)
+	}
+	// An individual MeasureReport is written for each patient.
+	readOutputFile(t, inputs, "p1.json")
+}
+
+func TestMeasureCLIConfig_Error(t *testing.T) {
+	inputs := writeOutputTestInputs(t, outputFormatMeasureReport)
+	valid := measureCommandConfig{
+		Measure:       inputs.Measure,
+		CQLDir:        inputs.CQLDir,
+		FHIRBundleDir: inputs.FHIRBundleDir,
+		JSONOutputDir: inputs.JSONOutputDir,
+	}
+	tests := []struct {
+		name    string
+		modify  func(cfg *measureCommandConfig)
+		wantErr error
+	}{
+		{
+			name:    "Missing measure",
+			modify:  func(cfg *measureCommandConfig) { cfg.Measure = "" },
+			wantErr: errMissingFlag,
+		},
+		{
+			name:    "Missing output dir",
+			modify:  func(cfg *measureCommandConfig) { cfg.JSONOutputDir = "" },
+			wantErr: errMissingFlag,
+		},
+		{
+			name:    "Missing FHIR data",
+			modify:  func(cfg *measureCommandConfig) { cfg.FHIRBundleDir = "" },
+			wantErr: errMissingFlag,
+		},
+		{
+			name:    "Invalid period",
+			modify:  func(cfg *measureCommandConfig) { cfg.PeriodStart = "2024" },
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "Period end before start",
+			modify: func(cfg *measureCommandConfig) {
+				cfg.PeriodStart = "2024-12-31"
+				cfg.PeriodEnd = "2024-01-01"
+			},
+			wantErr: errInvalidFlag,
+		},
+		{
+			name: "Invalid measure",
+			modify: func(cfg *measureCommandConfig) {
+				cfg.Measure = filepath.Join(t.TempDir(), "measure.json")
+				writeLocalFileWithContent(t, cfg.Measure, `{"resourceType": "Library"}`)
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := valid
+			tc.modify(&cfg)
+			_, err := measureCLIConfig(context.Background(), cfg)
+			if err == nil {
+				t.Fatalf("measureCLIConfig() succeeded, want error")
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("measureCLIConfig() returned error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
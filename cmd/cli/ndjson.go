@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/google/cql/internal/compression"
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/internal/resourcewrapper"
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// ndjsonFileSuffixes are the suffixes of files in the FHIR NDJSON directory that are read.
+var ndjsonFileSuffixes = []string{".ndjson", ".ndjson.gz", ".ndjson.zst", ".zip"}
+
+// patientIDPattern is the FHIR id grammar. Patient ids name the output files, so ids outside of it
+// (such as "../x") are rejected rather than written outside of the output directory.
+var patientIDPattern = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+
+// validatePatientID returns an error if the patient id is not a valid FHIR id.
+func validatePatientID(id string) error {
+	if !patientIDPattern.MatchString(id) {
+		return fmt.Errorf("patient id %q is not a valid FHIR id", id)
+	}
+	return nil
+}
+
+// patientResources are the resources of a single patient read from NDJSON files.
+type patientResources struct {
+	patientID string
+	resources []*r4pb.ContainedResource
+}
+
+// readNDJSONDir reads the bulk export style NDJSON files in the directory, which hold one FHIR R4
+// resource per line, and groups the resources by the patient they belong to. Patients are returned
+// sorted by id, each with their resources in the order they were read. Resources that can not be
+// parsed, do not belong to a patient or belong to a patient with an invalid id fail the read,
+// naming the file and line of the resource.
+func readNDJSONDir(ctx context.Context, dir string, cfg *cliConfig) ([]patientResources, error) {
+	filePaths, err := iohelpers.FilesWithSuffixes(ctx, dir, ndjsonFileSuffixes, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return nil, err
+	}
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+
+	byPatient := make(map[string][]*r4pb.ContainedResource)
+	for _, filePath := range filePaths {
+		data, err := iohelpers.ReadFile(ctx, filePath, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+		if err != nil {
+			return nil, err
+		}
+		_, fileName := filepath.Split(filePath)
+		files, err := compression.Decompress(fileName, data)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			source := filePath
+			if len(files) > 1 {
+				// Files from a zip archive are identified by their path within the archive.
+				source = filePath + "/" + f.Name
+			}
+			scanner := bufio.NewScanner(bytes.NewReader(f.Data))
+			scanner.Buffer(nil, iohelpers.MaxNDJSONLineSize)
+			line := 1
+			for ; scanner.Scan(); line++ {
+				if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+					continue
+				}
+				r, err := unmarshaller.UnmarshalR4(scanner.Bytes())
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse resource at %s:%d: %w", source, line, err)
+				}
+				patientID, err := resourcewrapper.New(r).PatientID()
+				if err != nil {
+					return nil, fmt.Errorf("failed to find the patient of the resource at %s:%d: %w", source, line, err)
+				}
+				if err := validatePatientID(patientID); err != nil {
+					return nil, fmt.Errorf("invalid resource at %s:%d: %w", source, line, err)
+				}
+				byPatient[patientID] = append(byPatient[patientID], r)
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("failed to read %s:%d: %w", source, line, err)
+			}
+		}
+	}
+
+	patients := make([]patientResources, 0, len(byPatient))
+	for id, resources := range byPatient {
+		patients = append(patients, patientResources{patientID: id, resources: resources})
+	}
+	sort.Slice(patients, func(i, j int) bool { return patients[i].patientID < patients[j].patientID })
+	return patients, nil
+}
+
+// sendPatientBundles sends a bundle of the resources of each patient to jobs, until the context is
+// cancelled. The results of each patient are output to a file named after the patient id.
+func sendPatientBundles(ctx context.Context, patients []patientResources, jobs chan<- bundleJob) error {
+	for i, p := range patients {
+		bundle := &r4pb.Bundle{}
+		for _, r := range p.resources {
+			bundle.Entry = append(bundle.Entry, &r4pb.Bundle_Entry{Resource: r})
+		}
+		job := bundleJob{index: i, patientID: p.patientID, fileName: p.patientID + ".json", bundle: bundle}
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
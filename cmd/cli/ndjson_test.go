@@ -0,0 +1,140 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCLINDJSON(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	using FHIR version '4.0.1'
+	context Patient
+	define PatientID: Patient.id.value
+	define EncounterCount: Count([Encounter])`)
+	ndjsonDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(ndjsonDir, "Patient.ndjson"), strings.Join([]string{
+		`{"resourceType": "Patient", "id": "p1"}`,
+		``,
+		`{"resourceType": "Patient", "id": "p2"}`,
+	}, "\n"))
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	encounters := strings.Join([]string{
+		`{"resourceType": "Encounter", "id": "e1", "subject": {"reference": "Patient/p1"}}`,
+		`{"resourceType": "Encounter", "id": "e2", "subject": {"reference": "Patient/p1"}}`,
+		`{"resourceType": "Encounter", "id": "e3", "subject": {"reference": "Patient/p2"}}`,
+	}, "\n")
+	if _, err := gzw.Write([]byte(encounters)); err != nil {
+		t.Fatalf("gzip Write() returned an unexpected error: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("gzip Close() returned an unexpected error: %v", err)
+	}
+	writeLocalFileWithContent(t, filepath.Join(ndjsonDir, "Encounter.ndjson.gz"), gz.String())
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		FHIRNDJSONDir: ndjsonDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+		OutputFormat:  outputFormatNDJSON,
+		Concurrency:   2,
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(testDirCfg.JSONOutputDir, "results.ndjson"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	type patientResult struct {
+		PatientID string
+		Result    string
+		Count     float64
+	}
+	var got []patientResult
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var res struct {
+			PatientID   string `json:"patientId"`
+			EvalResults []struct {
+				ExpressionDefinitions map[string]struct {
+					Value any `json:"value"`
+				} `json:"expressionDefinitions"`
+			} `json:"evalResults"`
+		}
+		if err := dec.Decode(&res); err != nil {
+			t.Fatalf("Decode() returned an unexpected error: %v", err)
+		}
+		defs := res.EvalResults[0].ExpressionDefinitions
+		got = append(got, patientResult{
+			PatientID: res.PatientID,
+			Result:    defs["PatientID"].Value.(string),
+			Count:     defs["EncounterCount"].Value.(float64),
+		})
+	}
+	want := []patientResult{
+		{PatientID: "p1", Result: "p1", Count: 2},
+		{PatientID: "p2", Result: "p2", Count: 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mainWrapper() returned an unexpected diff (-want +got): %v", diff)
+	}
+}
+
+func TestReadNDJSONDirError(t *testing.T) {
+	tests := []struct {
+		name    string
+		ndjson  string
+		wantErr string
+	}{
+		{
+			name:    "Invalid resource",
+			ndjson:  "{\"resourceType\": \"Patient\", \"id\": \"p1\"}\nnot json",
+			wantErr: "Patient.ndjson:2",
+		},
+		{
+			name:    "Resource without patient",
+			ndjson:  `{"resourceType": "Medication", "id": "m1"}`,
+			wantErr: "Patient.ndjson:1",
+		},
+		{
+			name:    "Patient id outside of the output directory",
+			ndjson:  `{"resourceType": "Patient", "id": "../../x"}`,
+			wantErr: "Patient.ndjson:1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeLocalFileWithContent(t, filepath.Join(dir, "Patient.ndjson"), tc.ndjson)
+			_, err := readNDJSONDir(context.Background(), dir, &cliConfig{})
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("readNDJSONDir() returned error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
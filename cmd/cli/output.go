@@ -0,0 +1,222 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/measure"
+	"github.com/google/cql/result"
+	"github.com/google/cql/result/tabular"
+)
+
+// The formats in which the CLI can output results, selected by --output_format.
+const (
+	// outputFormatJSON writes one indented JSON file per evaluated bundle.
+	outputFormatJSON = "json"
+	// outputFormatNDJSON writes a single results.ndjson file with one line per evaluated bundle.
+	outputFormatNDJSON = "ndjson"
+	// outputFormatCSV writes a single results.csv file with one row per expression definition per
+	// evaluated bundle.
+	outputFormatCSV = "csv"
+	// outputFormatParameters writes one FHIR Parameters resource per evaluated bundle.
+	outputFormatParameters = "parameters"
+	// outputFormatMeasureReport writes one individual FHIR MeasureReport per evaluated bundle, and a
+	// summary MeasureReport of all of them to measure_report.json.
+	outputFormatMeasureReport = "measurereport"
+)
+
+var outputFormats = []string{outputFormatJSON, outputFormatNDJSON, outputFormatCSV, outputFormatParameters, outputFormatMeasureReport}
+
+// resultSink writes the results of each evaluation in the configured output format. It is safe for
+// concurrent use, and combined outputs are ordered by the index of each result, regardless of the
+// order in which they were written.
+type resultSink struct {
+	outputDir string
+	cfg       *cliConfig
+
+	mu sync.Mutex
+	// results and reports hold the results and individual MeasureReports of combined outputs by
+	// index until the sink is closed.
+	results map[int]cqlResult
+	reports map[int]*measure.MeasureReport
+}
+
+func newResultSink(outputDir string, cfg *cliConfig) *resultSink {
+	return &resultSink{
+		outputDir: outputDir,
+		cfg:       cfg,
+		results:   make(map[int]cqlResult),
+		reports:   make(map[int]*measure.MeasureReport),
+	}
+}
+
+// write outputs the result with the given index. fileName is the name of the output file for
+// formats that write a file per result.
+func (s *resultSink) write(ctx context.Context, index int, fileName string, r cqlResult) error {
+	if s.cfg.onResult != nil {
+		s.cfg.onResult(fileName, r.EvalResults)
+	}
+	switch s.cfg.OutputFormat {
+	case outputFormatNDJSON, outputFormatCSV:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.results[index] = r
+		return nil
+	case outputFormatParameters:
+		params, err := parametersJSON(r.EvalResults)
+		if err != nil {
+			return fmt.Errorf("failed to convert results to FHIR Parameters: %w", err)
+		}
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, params, "", "  "); err != nil {
+			return err
+		}
+		return s.writeFile(ctx, fileName, indented.Bytes())
+	case outputFormatMeasureReport:
+		if r.PatientID == "" {
+			return fmt.Errorf("the %s output format requires a Patient in each bundle, found none in %s", outputFormatMeasureReport, r.BundleSource)
+		}
+		report, err := measure.IndividualReport(s.cfg.measure, "Patient/"+r.PatientID, r.EvalResults, s.cfg.measureConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create MeasureReport for patient %s: %w", r.PatientID, err)
+		}
+		s.mu.Lock()
+		s.reports[index] = report
+		s.mu.Unlock()
+		return s.writeJSONFile(ctx, fileName, report)
+	default:
+		return s.writeJSONFile(ctx, fileName, r)
+	}
+}
+
+// close writes any combined outputs.
+func (s *resultSink) close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.cfg.OutputFormat {
+	case outputFormatNDJSON:
+		var buf bytes.Buffer
+		for _, i := range sortedIndexes(s.results) {
+			row, err := json.Marshal(s.results[i])
+			if err != nil {
+				return err
+			}
+			buf.Write(row)
+			buf.WriteByte('\n')
+		}
+		return s.writeFile(ctx, "results.ndjson", buf.Bytes())
+	case outputFormatCSV:
+		var buf bytes.Buffer
+		w, err := tabular.NewWriter(&buf, tabular.Config{Columns: []tabular.Column{tabular.ColumnID, tabular.ColumnLibrary, tabular.ColumnLibraryVersion, tabular.ColumnDefine, tabular.ColumnValue, tabular.ColumnType}})
+		if err != nil {
+			return err
+		}
+		for _, i := range sortedIndexes(s.results) {
+			r := s.results[i]
+			id := r.PatientID
+			if id == "" {
+				id = r.BundleSource
+			}
+			if err := w.Write(id, r.EvalResults); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return s.writeFile(ctx, "results.csv", buf.Bytes())
+	case outputFormatMeasureReport:
+		reports := make([]*measure.MeasureReport, 0, len(s.reports))
+		for _, i := range sortedIndexes(s.reports) {
+			reports = append(reports, s.reports[i])
+		}
+		summary, err := measure.SummaryReport(s.cfg.measure, reports, s.cfg.measureConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create summary MeasureReport: %w", err)
+		}
+		return s.writeJSONFile(ctx, "measure_report.json", summary)
+	}
+	return nil
+}
+
+func (s *resultSink) writeJSONFile(ctx context.Context, fileName string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.writeFile(ctx, fileName, b)
+}
+
+func (s *resultSink) writeFile(ctx context.Context, fileName string, b []byte) error {
+	return iohelpers.WriteFile(ctx, s.outputDir, fileName, b, &iohelpers.IOConfig{GCSEndpoint: s.cfg.gcsEndpoint})
+}
+
+// parametersJSON returns the results as a single FHIR Parameters resource. If more than one library
+// has results, the parameter names are qualified by the library name, for example
+// MyMeasure.Numerator.
+func parametersJSON(libs result.Libraries) ([]byte, error) {
+	withResults := 0
+	for _, defs := range libs {
+		if len(defs) > 0 {
+			withResults++
+		}
+	}
+	if withResults <= 1 {
+		for _, defs := range libs {
+			if len(defs) > 0 {
+				return result.ParametersJSON(defs)
+			}
+		}
+		return result.ParametersJSON(nil)
+	}
+	qualified := make(map[string]result.Value)
+	for lib, defs := range libs {
+		for name, v := range defs {
+			qualified[lib.Name+"."+name] = v
+		}
+	}
+	return result.ParametersJSON(qualified)
+}
+
+// sortedIndexes returns the keys of m in increasing order.
+func sortedIndexes[V any](m map[int]V) []int {
+	indexes := make([]int, 0, len(m))
+	for i := range m {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// validateOutputFormat returns an error if the output format is not supported.
+func validateOutputFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	for _, f := range outputFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w --output_format, which must be one of %s, got %q", errInvalidFlag, strings.Join(outputFormats, ", "), format)
+}
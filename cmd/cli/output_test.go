@@ -0,0 +1,218 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/cql/result"
+	"github.com/google/go-cmp/cmp"
+)
+
+const outputTestCQL = `
+library Screening version '1.0.0'
+using FHIR version '4.0.1'
+context Patient
+define "Initial Population": true
+define Denominator: true
+define Numerator: exists ([Encounter])`
+
+const outputTestMeasure = `{
+	"resourceType": "Measure",
+	"url": "https://example.com/Measure/Screening",
+	"scoring": {"coding": [{"code": "proportion"}]},
+	"group": [{"population": [
+		{"code": {"coding": [{"code": "initial-population"}]}, "criteria": {"expression": "Initial Population"}},
+		{"code": {"coding": [{"code": "denominator"}]}, "criteria": {"expression": "Denominator"}},
+		{"code": {"coding": [{"code": "numerator"}]}, "criteria": {"expression": "Numerator"}}
+	]}]
+}`
+
+// writeOutputTestInputs writes the CQL, and a bundle for each of three patients of which only p1
+// has an Encounter, returning the config to evaluate them.
+func writeOutputTestInputs(t *testing.T, outputFormat string) cliConfig {
+	t.Helper()
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "screening.cql"), outputTestCQL)
+	for _, id := range []string{"p1", "p2", "p3"} {
+		entries := fmt.Sprintf(`{"resource": {"resourceType": "Patient", "id": "%s"}}`, id)
+		if id == "p1" {
+			entries += `, {"resource": {"resourceType": "Encounter", "id": "e1"}}`
+		}
+		writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, id+".json"), `{"resourceType": "Bundle", "entry": [`+entries+`]}`)
+	}
+	measureFile := filepath.Join(t.TempDir(), "measure.json")
+	writeLocalFileWithContent(t, measureFile, outputTestMeasure)
+	return cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		FHIRBundleDir: testDirCfg.FHIRBundleDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+		OutputFormat:  outputFormat,
+		Measure:       measureFile,
+		Concurrency:   2,
+	}
+}
+
+func readOutputFile(t *testing.T, cfg cliConfig, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(cfg.JSONOutputDir, name))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned an unexpected error: %v", err)
+	}
+	return b
+}
+
+func TestCLIOutputFormatCSV(t *testing.T) {
+	cfg := writeOutputTestInputs(t, outputFormatCSV)
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	want := strings.Join([]string{
+		"id,library,library_version,define,value,type",
+		"p1,Screening,1.0.0,Denominator,true,System.Boolean",
+		"p1,Screening,1.0.0,Initial Population,true,System.Boolean",
+		"p1,Screening,1.0.0,Numerator,true,System.Boolean",
+		"p2,Screening,1.0.0,Denominator,true,System.Boolean",
+		"p2,Screening,1.0.0,Initial Population,true,System.Boolean",
+		"p2,Screening,1.0.0,Numerator,false,System.Boolean",
+		"p3,Screening,1.0.0,Denominator,true,System.Boolean",
+		"p3,Screening,1.0.0,Initial Population,true,System.Boolean",
+		"p3,Screening,1.0.0,Numerator,false,System.Boolean",
+	}, "\n") + "\n"
+	if diff := cmp.Diff(want, string(readOutputFile(t, cfg, "results.csv"))); diff != "" {
+		t.Errorf("mainWrapper() results.csv diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLIOutputFormatParameters(t *testing.T) {
+	cfg := writeOutputTestInputs(t, outputFormatParameters)
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	want := `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{"name": "Denominator", "valueBoolean": true},
+			{"name": "Initial Population", "valueBoolean": true},
+			{"name": "Numerator", "valueBoolean": false}
+		]
+	}`
+	got := readOutputFile(t, cfg, "p2.json")
+	if diff := cmp.Diff(string(normalizeJSON(t, []byte(want))), string(normalizeJSON(t, got))); diff != "" {
+		t.Errorf("mainWrapper() p2.json diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLIOutputFormatMeasureReport(t *testing.T) {
+	cfg := writeOutputTestInputs(t, outputFormatMeasureReport)
+	cfg.ExecutionTimestampOverride = "@2024-01-01T00:00:00Z"
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+
+	type report struct {
+		Type    string `json:"type"`
+		Subject *struct {
+			Reference string `json:"reference"`
+		} `json:"subject"`
+		Date  string `json:"date"`
+		Group []struct {
+			Population []struct {
+				Count int `json:"count"`
+			} `json:"population"`
+			MeasureScore *struct {
+				Value float64 `json:"value"`
+			} `json:"measureScore"`
+		} `json:"group"`
+	}
+	var individual report
+	if err := json.Unmarshal(readOutputFile(t, cfg, "p1.json"), &individual); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	if individual.Type != "individual" || individual.Subject == nil || individual.Subject.Reference != "Patient/p1" {
+		t.Errorf("mainWrapper() individual MeasureReport = %+v, want an individual report for Patient/p1", individual)
+	}
+
+	var summary report
+	if err := json.Unmarshal(readOutputFile(t, cfg, "measure_report.json"), &summary); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	if summary.Type != "summary" || !strings.HasPrefix(summary.Date, "2024-01-01") {
+		t.Errorf("mainWrapper() summary MeasureReport = %+v, want a summary report dated 2024-01-01", summary)
+	}
+	var counts []int
+	for _, p := range summary.Group[0].Population {
+		counts = append(counts, p.Count)
+	}
+	if diff := cmp.Diff([]int{3, 3, 1}, counts); diff != "" {
+		t.Errorf("mainWrapper() summary population counts diff (-want +got): %v", diff)
+	}
+}
+
+func TestCLIOutputFormatMeasureReport_NoPatient(t *testing.T) {
+	cfg := writeOutputTestInputs(t, outputFormatMeasureReport)
+	writeLocalFileWithContent(t, filepath.Join(cfg.FHIRBundleDir, "no_patient.json"), `{"resourceType": "Bundle", "entry": []}`)
+	if err := mainWrapper(context.Background(), cfg); err == nil {
+		t.Errorf("mainWrapper() succeeded, want error for a bundle without a Patient")
+	}
+}
+
+func TestParametersJSON(t *testing.T) {
+	trueValue := newOrFatal(t, true)
+	tests := []struct {
+		name string
+		libs result.Libraries
+		want string
+	}{
+		{
+			name: "Single library",
+			libs: result.Libraries{
+				result.LibKey{Name: "Lib"}:     {"A": trueValue},
+				result.LibKey{Name: "Helpers"}: {},
+			},
+			want: `{"resourceType": "Parameters", "parameter": [{"name": "A", "valueBoolean": true}]}`,
+		},
+		{
+			name: "Several libraries are qualified",
+			libs: result.Libraries{
+				result.LibKey{Name: "Lib"}:   {"A": trueValue},
+				result.LibKey{Name: "Other"}: {"A": trueValue},
+			},
+			want: `{"resourceType": "Parameters", "parameter": [{"name": "Lib.A", "valueBoolean": true}, {"name": "Other.A", "valueBoolean": true}]}`,
+		},
+		{
+			name: "No results",
+			libs: result.Libraries{},
+			want: `{"resourceType": "Parameters"}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parametersJSON(tc.libs)
+			if err != nil {
+				t.Fatalf("parametersJSON() returned an unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(string(normalizeJSON(t, []byte(tc.want))), string(normalizeJSON(t, got))); diff != "" {
+				t.Errorf("parametersJSON() diff (-want +got): %v", diff)
+			}
+		})
+	}
+}
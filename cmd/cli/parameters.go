@@ -0,0 +1,153 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/cql"
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/result"
+)
+
+// parameterFlags holds the values of the repeated --parameter flag.
+type parameterFlags []string
+
+func (p *parameterFlags) String() string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(*p, ",")
+}
+
+func (p *parameterFlags) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
+// rawParameters collects the CQL parameters passed by the parameter flags, keyed by their name as
+// passed, which is either the parameter name or the name qualified by the library name. Parameters
+// are taken in increasing order of precedence from --fhir_parameters_file, --parameters_file,
+// --parameters and --parameter.
+func rawParameters(ctx context.Context, cfg *cliConfig) (map[string]string, error) {
+	raw := make(map[string]string)
+	if cfg.FHIRParametersFile != "" {
+		parametersText, err := iohelpers.ReadFile(ctx, cfg.FHIRParametersFile, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FHIR parameters file %s: %w", cfg.FHIRParametersFile, err)
+		}
+		params, err := parseFHIRParameters(parametersText)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse FHIR parameters file %s: %w", cfg.FHIRParametersFile, err)
+		}
+		for k, v := range params {
+			raw[k.Name] = v
+		}
+	}
+	if cfg.ParametersFile != "" {
+		b, err := iohelpers.ReadFile(ctx, cfg.ParametersFile, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read parameters file %s: %w", cfg.ParametersFile, err)
+		}
+		var params map[string]string
+		if err := json.Unmarshal(b, &params); err != nil {
+			return nil, fmt.Errorf("failed to parse parameters file %s, want a JSON object of parameter names to CQL literals: %w", cfg.ParametersFile, err)
+		}
+		for k, v := range params {
+			raw[k] = v
+		}
+	}
+	if cfg.Parameters != "" {
+		for _, param := range strings.Split(cfg.Parameters, ",") {
+			parts := strings.Split(param, "=")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("--parameters was passed an invalid input string: %s", param)
+			}
+			raw[parts[0]] = parts[1]
+		}
+	}
+	for _, param := range cfg.Parameter {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return nil, fmt.Errorf("--parameter must be in the form [Library.]Name=value, got %q", param)
+		}
+		raw[name] = value
+	}
+	return raw, nil
+}
+
+// resolveParameters keys the raw parameters by the library parameter they set in the parsed CQL. A
+// name qualified by a library name sets the parameter of that library, while an unqualified name
+// sets the parameter of that name in every library defining it.
+func resolveParameters(elm *cql.ELM, raw map[string]string) (map[result.DefKey]string, error) {
+	defs := elm.ResultTypes(true)
+	libKeys := make([]result.LibKey, 0, len(defs))
+	for k := range defs {
+		libKeys = append(libKeys, k)
+	}
+	sort.Slice(libKeys, func(i, j int) bool { return libKeys[i].Key() < libKeys[j].Key() })
+
+	// Unqualified names are resolved first, so a qualified name takes precedence for its library.
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if q1, q2 := qualifiedLibrary(names[i], libKeys) != nil, qualifiedLibrary(names[j], libKeys) != nil; q1 != q2 {
+			return q2
+		}
+		return names[i] < names[j]
+	})
+
+	params := make(map[result.DefKey]string, len(raw))
+	for _, name := range names {
+		if lib := qualifiedLibrary(name, libKeys); lib != nil {
+			key := result.DefKey{Name: strings.TrimPrefix(name, lib.Name+"."), Library: *lib}
+			if _, ok := defs[key.Library][key.Name]; !ok {
+				return nil, fmt.Errorf("parameter %q is not defined in library %s", key.Name, key.Library)
+			}
+			params[key] = raw[name]
+			continue
+		}
+		found := false
+		for _, lib := range libKeys {
+			if _, ok := defs[lib][name]; ok {
+				params[result.DefKey{Name: name, Library: lib}] = raw[name]
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("parameter %q is not defined in any CQL library", name)
+		}
+	}
+	return params, nil
+}
+
+// qualifiedLibrary returns the library that the name is qualified by, or nil if the name is not
+// qualified by a library. Library names may themselves contain dots, so the longest matching
+// library is used.
+func qualifiedLibrary(name string, libKeys []result.LibKey) *result.LibKey {
+	var match *result.LibKey
+	for i, lib := range libKeys {
+		if strings.HasPrefix(name, lib.Name+".") && (match == nil || len(lib.Name) > len(match.Name)) {
+			match = &libKeys[i]
+		}
+	}
+	return match
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/cql"
+	"github.com/google/cql/result"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRawParameters(t *testing.T) {
+	dir := t.TempDir()
+	fhirParametersFile := filepath.Join(dir, "fhir_parameters.json")
+	writeLocalFileWithContent(t, fhirParametersFile, `{"resourceType": "Parameters", "parameter": [
+		{"name": "A", "valueInteger": 1},
+		{"name": "B", "valueInteger": 1}
+	]}`)
+	parametersFile := filepath.Join(dir, "parameters.json")
+	writeLocalFileWithContent(t, parametersFile, `{"B": "2", "C": "2", "Lib.Period": "Interval[@2024-01-01, @2025-01-01)"}`)
+	cfg := &cliConfig{
+		FHIRParametersFile: fhirParametersFile,
+		ParametersFile:     parametersFile,
+		Parameters:         "C=3,D=3",
+		Parameter:          parameterFlags{"D=4", "E='a, b'"},
+	}
+
+	got, err := rawParameters(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("rawParameters() returned unexpected error: %v", err)
+	}
+	want := map[string]string{
+		"A":          "1",
+		"B":          "2",
+		"C":          "3",
+		"D":          "4",
+		"E":          "'a, b'",
+		"Lib.Period": "Interval[@2024-01-01, @2025-01-01)",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("rawParameters() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRawParametersError(t *testing.T) {
+	dir := t.TempDir()
+	invalidFile := filepath.Join(dir, "parameters.json")
+	writeLocalFileWithContent(t, invalidFile, `["not", "an", "object"]`)
+	tests := []struct {
+		name string
+		cfg  *cliConfig
+	}{
+		{name: "Parameter without value", cfg: &cliConfig{Parameter: parameterFlags{"Period"}}},
+		{name: "Invalid parameters file", cfg: &cliConfig{ParametersFile: invalidFile}},
+		{name: "Missing parameters file", cfg: &cliConfig{ParametersFile: filepath.Join(dir, "missing.json")}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := rawParameters(context.Background(), tc.cfg); err == nil {
+				t.Errorf("rawParameters() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestResolveParameters(t *testing.T) {
+	elm, err := cql.Parse(context.Background(), []string{
+		`library Lib version '1.0'
+		parameter Period Interval<Date>
+		parameter Threshold Integer`,
+		`library Lib.Other version '2.0'
+		parameter Threshold Integer`,
+	}, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("cql.Parse() returned unexpected error: %v", err)
+	}
+	lib := result.LibKey{Name: "Lib", Version: "1.0"}
+	other := result.LibKey{Name: "Lib.Other", Version: "2.0"}
+
+	tests := []struct {
+		name    string
+		raw     map[string]string
+		want    map[result.DefKey]string
+		wantErr bool
+	}{
+		{
+			name: "Qualified",
+			raw:  map[string]string{"Lib.Period": "Interval[@2024-01-01, @2025-01-01)"},
+			want: map[result.DefKey]string{{Name: "Period", Library: lib}: "Interval[@2024-01-01, @2025-01-01)"},
+		},
+		{
+			name: "Unqualified sets every library",
+			raw:  map[string]string{"Threshold": "1"},
+			want: map[result.DefKey]string{{Name: "Threshold", Library: lib}: "1", {Name: "Threshold", Library: other}: "1"},
+		},
+		{
+			name: "Qualified takes precedence",
+			raw:  map[string]string{"Threshold": "1", "Lib.Other.Threshold": "2"},
+			want: map[result.DefKey]string{{Name: "Threshold", Library: lib}: "1", {Name: "Threshold", Library: other}: "2"},
+		},
+		{
+			name:    "Undefined in library",
+			raw:     map[string]string{"Lib.Other.Period": "1"},
+			wantErr: true,
+		},
+		{
+			name:    "Undefined in every library",
+			raw:     map[string]string{"Missing": "1"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveParameters(elm, tc.raw)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("resolveParameters() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveParameters() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("resolveParameters() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/cql/metrics"
+	"github.com/google/cql/result"
+	retinstrumented "github.com/google/cql/retriever/instrumented"
+	terminstrumented "github.com/google/cql/terminology/instrumented"
+)
+
+// profile collects the evaluation timings of each expression definition, and the retriever and
+// terminology calls made across all evaluations of a run. It implements metrics.Recorder and is
+// safe for concurrent use.
+type profile struct {
+	mu          sync.Mutex
+	evals       int
+	defs        map[result.DefKey]*defProfile
+	retrieves   map[string]*callProfile
+	terminology map[terminologyCall]*callProfile
+}
+
+type defProfile struct {
+	evals     int
+	total     time.Duration
+	max       time.Duration
+	retrieves int
+}
+
+type callProfile struct {
+	calls     int64
+	errors    int64
+	resources int64
+	latencyMs float64
+}
+
+type terminologyCall struct {
+	operation, url string
+}
+
+func newProfile() *profile {
+	return &profile{
+		defs:        make(map[result.DefKey]*defProfile),
+		retrieves:   make(map[string]*callProfile),
+		terminology: make(map[terminologyCall]*callProfile),
+	}
+}
+
+// addResults records the evaluation stats of the expression definitions of a single evaluation.
+func (p *profile) addResults(libs result.Libraries) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evals++
+	for lib, defs := range libs.EvalStats() {
+		for name, s := range defs {
+			k := result.DefKey{Library: lib, Name: name}
+			d, ok := p.defs[k]
+			if !ok {
+				d = &defProfile{}
+				p.defs[k] = d
+			}
+			d.evals++
+			d.total += s.WallTime
+			d.max = max(d.max, s.WallTime)
+			d.retrieves += s.Retrieves
+		}
+	}
+}
+
+// Count implements metrics.Recorder.
+func (p *profile) Count(name string, labels metrics.Labels, delta int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch name {
+	case retinstrumented.RetrieveCount:
+		p.retrieve(labels).calls += delta
+	case retinstrumented.RetrieveErrorCount:
+		p.retrieve(labels).errors += delta
+	case retinstrumented.RetrieveResourceCount:
+		p.retrieve(labels).resources += delta
+	case terminstrumented.CallCount:
+		p.terminologyCall(labels).calls += delta
+	case terminstrumented.CallErrorCount:
+		p.terminologyCall(labels).errors += delta
+	}
+}
+
+// Observe implements metrics.Recorder.
+func (p *profile) Observe(name string, labels metrics.Labels, value float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch name {
+	case retinstrumented.RetrieveLatencyMillis:
+		p.retrieve(labels).latencyMs += value
+	case terminstrumented.CallLatencyMillis:
+		p.terminologyCall(labels).latencyMs += value
+	}
+}
+
+func (p *profile) retrieve(labels metrics.Labels) *callProfile {
+	k := labels[retinstrumented.ResourceTypeLabel]
+	c, ok := p.retrieves[k]
+	if !ok {
+		c = &callProfile{}
+		p.retrieves[k] = c
+	}
+	return c
+}
+
+func (p *profile) terminologyCall(labels metrics.Labels) *callProfile {
+	k := terminologyCall{operation: labels[terminstrumented.OperationLabel], url: labels[terminstrumented.URLLabel]}
+	c, ok := p.terminology[k]
+	if !ok {
+		c = &callProfile{}
+		p.terminology[k] = c
+	}
+	return c
+}
+
+// report writes the profile as tables to w. Expression definitions are sorted by their total
+// evaluation time, slowest first.
+func (p *profile) report(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Profile of %d evaluation(s)\n\n", p.evals)
+	fmt.Fprintln(tw, "DEFINITION\tEVALS\tTOTAL\tMEAN\tMAX\tRETRIEVES")
+	defKeys := make([]result.DefKey, 0, len(p.defs))
+	for k := range p.defs {
+		defKeys = append(defKeys, k)
+	}
+	sort.Slice(defKeys, func(i, j int) bool {
+		a, b := p.defs[defKeys[i]], p.defs[defKeys[j]]
+		if a.total != b.total {
+			return a.total > b.total
+		}
+		if defKeys[i].Library.Key() != defKeys[j].Library.Key() {
+			return defKeys[i].Library.Key() < defKeys[j].Library.Key()
+		}
+		return defKeys[i].Name < defKeys[j].Name
+	})
+	for _, k := range defKeys {
+		d := p.defs[k]
+		fmt.Fprintf(tw, "%s.%s\t%d\t%v\t%v\t%v\t%d\n", k.Library.Name, k.Name, d.evals, d.total, d.total/time.Duration(d.evals), d.max, d.retrieves)
+	}
+
+	if len(p.retrieves) > 0 {
+		fmt.Fprintln(tw, "\nRESOURCE TYPE\tRETRIEVES\tERRORS\tRESOURCES\tLATENCY")
+		types := make([]string, 0, len(p.retrieves))
+		for t := range p.retrieves {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			c := p.retrieves[t]
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%v\n", t, c.calls, c.errors, c.resources, millis(c.latencyMs))
+		}
+	}
+
+	if len(p.terminology) > 0 {
+		fmt.Fprintln(tw, "\nTERMINOLOGY OPERATION\tURL\tCALLS\tERRORS\tLATENCY")
+		calls := make([]terminologyCall, 0, len(p.terminology))
+		for c := range p.terminology {
+			calls = append(calls, c)
+		}
+		sort.Slice(calls, func(i, j int) bool {
+			if calls[i].operation != calls[j].operation {
+				return calls[i].operation < calls[j].operation
+			}
+			return calls[i].url < calls[j].url
+		})
+		for _, k := range calls {
+			c := p.terminology[k]
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%v\n", k.operation, k.url, c.calls, c.errors, millis(c.latencyMs))
+		}
+	}
+	return tw.Flush()
+}
+
+func millis(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Microsecond)
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/cql/metrics"
+	"github.com/google/cql/result"
+	retinstrumented "github.com/google/cql/retriever/instrumented"
+	terminstrumented "github.com/google/cql/terminology/instrumented"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCLIProfile(t *testing.T) {
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "test_code.cql"), `
+	library TESTLIB
+	using FHIR version '4.0.1'
+	codesystem CS: 'https://test/cs'
+	valueset VS: 'https://test/vs'
+	code C: '1' from CS
+	context Patient
+	define Encounters: [Encounter]
+	define InVS: C in VS`)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRTerminologyDir, "vs.json"), `{
+		"resourceType": "ValueSet", "url": "https://test/vs", "expansion": {"contains": [{"system": "https://test/cs", "code": "1"}]}
+	}`)
+	for _, name := range []string{"bundle1.json", "bundle2.json"} {
+		writeLocalFileWithContent(t, filepath.Join(testDirCfg.FHIRBundleDir, name), `{"resourceType": "Bundle", "entry": [
+			{"resource": {"resourceType": "Patient", "id": "1"}},
+			{"resource": {"resourceType": "Encounter", "id": "1"}}
+		]}`)
+	}
+	p := newProfile()
+	cfg := cliConfig{
+		CQLDir:             testDirCfg.CQLDir,
+		FHIRBundleDir:      testDirCfg.FHIRBundleDir,
+		FHIRTerminologyDir: testDirCfg.FHIRTerminologyDir,
+		JSONOutputDir:      testDirCfg.JSONOutputDir,
+		Profile:            true,
+		profile:            p,
+	}
+
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned an unexpected error: %v", err)
+	}
+	if p.evals != 2 {
+		t.Errorf("profile evals = %d, want 2", p.evals)
+	}
+	encounters := p.defs[result.DefKey{Library: result.LibKey{Name: "TESTLIB"}, Name: "Encounters"}]
+	if encounters == nil || encounters.evals != 2 || encounters.retrieves != 2 {
+		t.Errorf("profile of Encounters = %+v, want 2 evals and 2 retrieves", encounters)
+	}
+	if c := p.retrieves["Encounter"]; c == nil || c.calls != 2 || c.resources != 2 {
+		t.Errorf("profile of Encounter retrieves = %+v, want 2 calls returning 2 resources", c)
+	}
+	if c := p.terminology[terminologyCall{operation: "AnyInValueSet", url: "https://test/vs"}]; c == nil || c.calls != 2 {
+		t.Errorf("profile of AnyInValueSet calls = %+v, want 2 calls", c)
+	}
+}
+
+func TestProfileReport(t *testing.T) {
+	lib := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	p := newProfile()
+	for _, d := range []time.Duration{time.Millisecond, 3 * time.Millisecond} {
+		p.addResults(result.Libraries{lib: {
+			"Fast": result.Value{}.WithEvalStats(result.EvalStats{WallTime: d / 2}),
+			"Slow": result.Value{}.WithEvalStats(result.EvalStats{WallTime: 2 * d, Retrieves: 1}),
+		}})
+	}
+	retrieveLabels := metrics.Labels{retinstrumented.ResourceTypeLabel: "Encounter"}
+	p.Count(retinstrumented.RetrieveCount, retrieveLabels, 2)
+	p.Count(retinstrumented.RetrieveResourceCount, retrieveLabels, 5)
+	p.Observe(retinstrumented.RetrieveLatencyMillis, retrieveLabels, 1.5)
+	termLabels := metrics.Labels{terminstrumented.OperationLabel: "AnyInValueSet", terminstrumented.URLLabel: "https://test/vs"}
+	p.Count(terminstrumented.CallCount, termLabels, 2)
+	p.Count(terminstrumented.CallErrorCount, termLabels, 1)
+	p.Observe(terminstrumented.CallLatencyMillis, termLabels, 0.25)
+
+	var got bytes.Buffer
+	if err := p.report(&got); err != nil {
+		t.Fatalf("report() returned an unexpected error: %v", err)
+	}
+	want := strings.Join([]string{
+		"Profile of 2 evaluation(s)",
+		"",
+		"DEFINITION    EVALS  TOTAL  MEAN  MAX    RETRIEVES",
+		"TESTLIB.Slow  2      8ms    4ms   6ms    2",
+		"TESTLIB.Fast  2      2ms    1ms   1.5ms  0",
+		"",
+		"RESOURCE TYPE  RETRIEVES  ERRORS  RESOURCES  LATENCY",
+		"Encounter      2          0       5          1.5ms",
+		"",
+		"TERMINOLOGY OPERATION  URL              CALLS  ERRORS  LATENCY",
+		"AnyInValueSet          https://test/vs  2      1       250µs",
+		"",
+	}, "\n")
+	if diff := cmp.Diff(want, got.String()); diff != "" {
+		t.Errorf("report() unexpected diff (-want +got):\n%s", diff)
+	}
+}
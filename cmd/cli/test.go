@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/cql/cqltest"
+)
+
+// testCommand is the name of the CLI subcommand that runs golden CQL test cases.
+const testCommand = "test"
+
+// errTestsFailed is returned by the test subcommand if any test case failed.
+var errTestsFailed = errors.New("test cases failed")
+
+type testConfig struct {
+	TestDir string
+	Update  bool
+}
+
+func (cfg *testConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.TestDir, "test_dir", "", "(Required) Directory that is searched recursively for test case files. A test case is a YAML file, or a JSON file with a cql key, in the format of the cqltest package.")
+	fs.BoolVar(&cfg.Update, "update", false, "(Optional) If true, the expected results of every test case are rewritten with the current results instead of being checked.")
+}
+
+// runTest parses the test subcommand flags from args, runs the test cases and writes a report to
+// w.
+func runTest(ctx context.Context, args []string, w io.Writer, errorFormat *string) error {
+	fs := flag.NewFlagSet(testCommand, flag.ExitOnError)
+	var cfg testConfig
+	cfg.RegisterFlags(fs)
+	if err := parseSubcommandFlags(fs, args, errorFormat); err != nil {
+		return err
+	}
+	return runTestCases(ctx, cfg, w)
+}
+
+// runTestCases runs every test case file under the test directory and writes a line for each to
+// w, followed by the diff of every failing test case. It returns errTestsFailed if any test case
+// failed to load, evaluate or match its expected results.
+func runTestCases(ctx context.Context, cfg testConfig, w io.Writer) error {
+	if cfg.TestDir == "" {
+		return fmt.Errorf("%w --test_dir", errMissingFlag)
+	}
+	paths, err := findTestCases(cfg.TestDir)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no test case files found in %s", cfg.TestDir)
+	}
+
+	var passed, failed, updated int
+	for _, p := range paths {
+		rel, err := filepath.Rel(cfg.TestDir, p)
+		if err != nil {
+			rel = p
+		}
+		name, detail, err := runTestCase(ctx, p, cfg.Update)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(w, "FAIL    %s (%s)\n", name, rel)
+			fmt.Fprintf(w, "        %v\n", err)
+		case cfg.Update:
+			updated++
+			fmt.Fprintf(w, "UPDATED %s (%s)\n", name, rel)
+		case detail != "":
+			failed++
+			fmt.Fprintf(w, "FAIL    %s (%s)\n", name, rel)
+			for _, line := range strings.Split(strings.TrimSuffix(detail, "\n"), "\n") {
+				fmt.Fprintf(w, "        %s\n", line)
+			}
+		default:
+			passed++
+			fmt.Fprintf(w, "PASS    %s (%s)\n", name, rel)
+		}
+	}
+
+	if cfg.Update {
+		fmt.Fprintf(w, "\n%d updated, %d failed\n", updated, failed)
+	} else {
+		fmt.Fprintf(w, "\n%d passed, %d failed\n", passed, failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", errTestsFailed, failed, len(paths))
+	}
+	return nil
+}
+
+// runTestCase loads and evaluates the test case file. If update is true the expected results are
+// rewritten, otherwise the diff against the expected results is returned. The returned name falls
+// back to the file name if the test case can not be loaded.
+func runTestCase(ctx context.Context, path string, update bool) (name, diff string, err error) {
+	name = filepath.Base(path)
+	c, err := cqltest.Load(path)
+	if err != nil {
+		return name, "", err
+	}
+	name = c.Name
+	results, err := c.Eval(ctx)
+	if err != nil {
+		return name, "", fmt.Errorf("failed to evaluate: %w", err)
+	}
+	if update {
+		return name, "", c.Update(results)
+	}
+	diff, err = c.Diff(results)
+	return name, diff, err
+}
+
+// findTestCases returns the sorted paths of the test case files under dir. Every YAML file is a
+// test case. JSON files are only test cases if they hold an object with a cql key, so that FHIR
+// bundles and ValueSets can be kept next to the test cases that use them.
+func findTestCases(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".yaml", ".yml":
+			paths = append(paths, p)
+		case ".json":
+			ok, err := isJSONTestCase(p)
+			if err != nil {
+				return err
+			}
+			if ok {
+				paths = append(paths, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// isJSONTestCase returns true if the JSON file holds an object with a cql key. Files that are not
+// valid JSON objects are not test cases.
+func isJSONTestCase(path string) (bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return false, nil
+	}
+	_, ok := m["cql"]
+	return ok, nil
+}
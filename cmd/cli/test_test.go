@@ -0,0 +1,127 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRunTestCases(t *testing.T) {
+	dir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(dir, "lib.cql"), `
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	context Patient
+	define EncounterCount: Count([Encounter])`)
+	writeLocalFileWithContent(t, filepath.Join(dir, "bundle.json"), `{"resourceType": "Bundle", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "1"}},
+		{"resource": {"resourceType": "Encounter", "id": "1"}}
+	]}`)
+	writeLocalFileWithContent(t, filepath.Join(dir, "pass.yaml"), `
+name: One encounter
+cql: [lib.cql]
+bundle: bundle.json
+want:
+  TESTLIB:
+    EncounterCount: {"@type": "System.Integer", "value": 1}
+`)
+	if err := os.Mkdir(filepath.Join(dir, "cases"), 0755); err != nil {
+		t.Fatalf("os.Mkdir() returned an unexpected error: %v", err)
+	}
+	writeLocalFileWithContent(t, filepath.Join(dir, "cases", "fail.json"), `{
+	"name": "Wrong count",
+	"cql": ["../lib.cql"],
+	"bundle": "../bundle.json",
+	"want": {"TESTLIB": {"EncounterCount": {"@type": "System.Integer", "value": 2}}}
+}`)
+
+	var got bytes.Buffer
+	err := runTestCases(context.Background(), testConfig{TestDir: dir}, &got)
+	if !errors.Is(err, errTestsFailed) {
+		t.Errorf("runTestCases() returned error %v, want %v", err, errTestsFailed)
+	}
+	// The diff of a failing test case comes from cmp, which randomizes its whitespace, so only the
+	// report lines are checked.
+	for _, want := range []string{
+		"FAIL    Wrong count (cases/fail.json)\n        TESTLIB.EncounterCount (-want +got):\n",
+		"\nPASS    One encounter (pass.yaml)\n\n1 passed, 1 failed\n",
+	} {
+		if !strings.Contains(got.String(), want) {
+			t.Errorf("runTestCases() output = %q, want it to contain %q", got.String(), want)
+		}
+	}
+
+	got.Reset()
+	if err := runTestCases(context.Background(), testConfig{TestDir: dir, Update: true}, &got); err != nil {
+		t.Fatalf("runTestCases(update) returned unexpected error: %v", err)
+	}
+	want := `UPDATED Wrong count (cases/fail.json)
+UPDATED One encounter (pass.yaml)
+
+2 updated, 0 failed
+`
+	if diff := cmp.Diff(want, got.String()); diff != "" {
+		t.Errorf("runTestCases(update) unexpected output diff (-want +got):\n%s", diff)
+	}
+
+	got.Reset()
+	if err := runTestCases(context.Background(), testConfig{TestDir: dir}, &got); err != nil {
+		t.Errorf("runTestCases() after update returned unexpected error: %v\n%s", err, got.String())
+	}
+}
+
+func TestRunTestCases_Error(t *testing.T) {
+	invalidCaseDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(invalidCaseDir, "case.yaml"), "name: no cql\n")
+	tests := []struct {
+		name    string
+		cfg     testConfig
+		wantErr error
+	}{
+		{
+			name:    "Missing test_dir",
+			cfg:     testConfig{},
+			wantErr: errMissingFlag,
+		},
+		{
+			name: "No test cases",
+			cfg:  testConfig{TestDir: t.TempDir()},
+		},
+		{
+			name:    "Invalid test case",
+			cfg:     testConfig{TestDir: invalidCaseDir},
+			wantErr: errTestsFailed,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := runTestCases(context.Background(), tc.cfg, &bytes.Buffer{})
+			if err == nil {
+				t.Fatalf("runTestCases() succeeded, want error")
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("runTestCases() returned error %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
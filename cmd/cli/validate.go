@@ -0,0 +1,260 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/cql"
+	"github.com/google/cql/internal/compression"
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/parser"
+)
+
+// validateCommand is the name of the CLI subcommand that checks CQL without evaluating it.
+const validateCommand = "validate"
+
+// errValidationFailed is returned by the validate subcommand if any diagnostic is an error.
+var errValidationFailed = errors.New("validation failed")
+
+// Severities of the diagnostics reported by the validate subcommand.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+// Checks run by the validate subcommand.
+const (
+	checkParse            = "parse"
+	checkLint             = "lint"
+	checkTerminology      = "terminology"
+	checkDataRequirements = "data-requirements"
+)
+
+type validateCQLConfig struct {
+	CQLDir             string
+	FHIRBundle         string
+	FHIRTerminologyDir string
+
+	// Should not be set directly by a flag.
+	gcsEndpoint string
+}
+
+func (cfg *validateCQLConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.CQLDir, "cql_dir", "", "(Required) Directory holding 1 or more CQL files.")
+	fs.StringVar(&cfg.FHIRBundle, "fhir_bundle", "", "(Optional) A FHIR bundle JSON file. If set, every resource type retrieved by the CQL is checked to be present in the bundle.")
+	fs.StringVar(&cfg.FHIRTerminologyDir, "fhir_terminology_dir", "", "(Optional) Directory holding FHIR ValueSet and CodeSystem JSONs. If set, every ValueSet and CodeSystem referenced by the CQL is checked to be available.")
+
+	cfg.gcsEndpoint = gcs.DefaultCloudStorageEndpoint
+}
+
+// diagnostic is a single problem found by the validate subcommand.
+type diagnostic struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Library  string `json:"library,omitempty"`
+	// Line and Column are the 1-based line and 0-based column of the problem in the CQL source, if
+	// known.
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// validationReport holds the diagnostics of the validate subcommand.
+type validationReport struct {
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+func (r *validationReport) add(d diagnostic) {
+	r.Diagnostics = append(r.Diagnostics, d)
+}
+
+// hasErrors returns true if any diagnostic is an error.
+func (r *validationReport) hasErrors() bool {
+	return slices.ContainsFunc(r.Diagnostics, func(d diagnostic) bool { return d.Severity == severityError })
+}
+
+// runValidate parses the validate subcommand flags from args, runs it and writes the report to w.
+func runValidate(ctx context.Context, args []string, w io.Writer, errorFormat *string) error {
+	fs := flag.NewFlagSet(validateCommand, flag.ExitOnError)
+	var cfg validateCQLConfig
+	cfg.RegisterFlags(fs)
+	if err := parseSubcommandFlags(fs, args, errorFormat); err != nil {
+		return err
+	}
+	report, err := validateCQL(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if report.hasErrors() {
+		return errValidationFailed
+	}
+	return nil
+}
+
+// validateCQL parses the CQL libraries, lints them and checks the terminology and data they
+// require, without evaluating them. Problems with the CQL are reported as diagnostics, the
+// returned error is only set if the checks could not be run.
+func validateCQL(ctx context.Context, cfg validateCQLConfig) (*validationReport, error) {
+	if cfg.CQLDir == "" {
+		return nil, fmt.Errorf("%w --cql_dir", errMissingFlag)
+	}
+	cliCfg := &cliConfig{gcsEndpoint: cfg.gcsEndpoint}
+	cqlLibs, err := readCQLLibs(ctx, cfg.CQLDir, cliCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CQL libraries: %w", err)
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create FHIR data model: %w", err)
+	}
+
+	report := &validationReport{Diagnostics: []diagnostic{}}
+	elm, err := cql.Parse(ctx, cqlLibs, cql.ParseConfig{DataModels: [][]byte{fhirDM}})
+	if err != nil {
+		// The remaining checks need parsed CQL.
+		addParseDiagnostics(report, err)
+		return report, nil
+	}
+
+	for _, k := range elm.UnusedPrivateDefs() {
+		report.add(diagnostic{
+			Severity: severityWarning,
+			Check:    checkLint,
+			Library:  k.Library.String(),
+			Message:  fmt.Sprintf("private definition %q is never used", k.Name),
+		})
+	}
+
+	if cfg.FHIRTerminologyDir != "" {
+		tp, err := maybeGetTerminologyProvider(ctx, cfg.FHIRTerminologyDir, cliCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get terminology: %w", err)
+		}
+		preflight, err := elm.TerminologyPreflight(tp)
+		if err != nil {
+			return nil, err
+		}
+		for _, issue := range preflight.Issues {
+			report.add(diagnostic{Severity: severityError, Check: checkTerminology, Message: issue.String()})
+		}
+	} else if len(elm.ValueSets()) > 0 {
+		report.add(diagnostic{Severity: severityInfo, Check: checkTerminology, Message: "the CQL references ValueSets, set --fhir_terminology_dir to check they are available"})
+	}
+
+	if cfg.FHIRBundle != "" {
+		present, err := bundleResourceTypes(ctx, cfg.FHIRBundle, cliCfg)
+		if err != nil {
+			return nil, err
+		}
+		reqs, err := elm.DataRequirements()
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		for _, req := range reqs {
+			if present[req.ResourceType] || seen[req.ResourceType] {
+				continue
+			}
+			seen[req.ResourceType] = true
+			report.add(diagnostic{
+				Severity: severityWarning,
+				Check:    checkDataRequirements,
+				Message:  fmt.Sprintf("the CQL retrieves %s resources, but there are none in %s", req.ResourceType, cfg.FHIRBundle),
+			})
+		}
+	}
+	return report, nil
+}
+
+// addParseDiagnostics adds a diagnostic for each parsing error in err.
+func addParseDiagnostics(report *validationReport, err error) {
+	var libErrs *parser.LibraryErrors
+	var paramErrs *parser.ParameterErrors
+	switch {
+	case errors.As(err, &libErrs):
+		addParsingErrors(report, libErrs.LibKey.String(), "", libErrs.Errors)
+	case errors.As(err, &paramErrs):
+		addParsingErrors(report, paramErrs.DefKey.Library.String(), fmt.Sprintf("parameter %q: ", paramErrs.DefKey.Name), paramErrs.Errors)
+	default:
+		report.add(diagnostic{Severity: severityError, Check: checkParse, Message: err.Error()})
+	}
+}
+
+// addParsingErrors adds a diagnostic for each of the parsing errors of the library, prefixing
+// their messages with prefix.
+func addParsingErrors(report *validationReport, library, prefix string, errs []*parser.ParsingError) {
+	for _, pe := range errs {
+		msg := prefix + pe.Message
+		if pe.Cause != nil {
+			msg += ": " + pe.Cause.Error()
+		}
+		severity := strings.ToLower(string(pe.Severity))
+		if severity == "" {
+			severity = severityError
+		}
+		report.add(diagnostic{
+			Severity: severity,
+			Check:    checkParse,
+			Library:  library,
+			Line:     pe.Line,
+			Column:   pe.Column,
+			Message:  msg,
+		})
+	}
+}
+
+// bundleResourceTypes returns the resource types of the entries of the FHIR bundle file.
+func bundleResourceTypes(ctx context.Context, bundleFile string, cfg *cliConfig) (map[string]bool, error) {
+	data, err := iohelpers.ReadFile(ctx, bundleFile, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return nil, err
+	}
+	files, err := compression.Decompress(bundleFile, data)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]bool)
+	for _, f := range files {
+		var bundle struct {
+			Entry []struct {
+				Resource struct {
+					ResourceType string `json:"resourceType"`
+				} `json:"resource"`
+			} `json:"entry"`
+		}
+		if err := json.Unmarshal(f.Data, &bundle); err != nil {
+			return nil, fmt.Errorf("failed to parse FHIR bundle %s: %w", f.Name, err)
+		}
+		for _, e := range bundle.Entry {
+			types[e.Resource.ResourceType] = true
+		}
+	}
+	return types, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/lithammer/dedent"
+)
+
+func TestValidateCQL(t *testing.T) {
+	cqlDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(cqlDir, "lib.cql"), dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		using FHIR version '4.0.1'
+		valueset "Office Visit": 'urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001'
+		valueset "Missing": 'urn:oid:1.2.3'
+		context Patient
+		define private Unused: 1
+		define Visits: [Encounter: "Office Visit"]
+		define Conditions: [Condition: "Missing"]`))
+	terminologyDir := t.TempDir()
+	writeLocalFileWithContent(t, filepath.Join(terminologyDir, "vs.json"), `{
+		"resourceType": "ValueSet",
+		"url": "urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001",
+		"expansion": {"contains": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99201"}]}
+	}`)
+	bundle := filepath.Join(t.TempDir(), "bundle.json")
+	writeLocalFileWithContent(t, bundle, `{"resourceType": "Bundle", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "p1"}},
+		{"resource": {"resourceType": "Encounter", "id": "e1"}}
+	]}`)
+
+	report, err := validateCQL(context.Background(), validateCQLConfig{CQLDir: cqlDir, FHIRBundle: bundle, FHIRTerminologyDir: terminologyDir})
+	if err != nil {
+		t.Fatalf("validateCQL() returned unexpected error: %v", err)
+	}
+	want := []diagnostic{
+		{Severity: severityWarning, Check: checkLint, Library: "TESTLIB 1.0.0", Message: `private definition "Unused" is never used`},
+		{Severity: severityError, Check: checkTerminology, Message: "missing ValueSet{urn:oid:1.2.3, }"},
+		{Severity: severityWarning, Check: checkDataRequirements, Message: "the CQL retrieves Condition resources, but there are none in " + bundle},
+	}
+	if diff := cmp.Diff(want, report.Diagnostics, cmpopts.IgnoreFields(diagnostic{}, "Message"), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("validateCQL() diagnostics diff (-want +got):\n%s", diff)
+	}
+	if !report.hasErrors() {
+		t.Errorf("validateCQL() report has no errors, want the missing ValueSet to be an error")
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cql     string
+		wantErr error
+		want    []diagnostic
+	}{
+		{
+			name: "Valid",
+			cql: dedent.Dedent(`
+				library TESTLIB version '1.0.0'
+				define A: 1`),
+			want: []diagnostic{},
+		},
+		{
+			name: "Parse error",
+			cql: dedent.Dedent(`
+				library TESTLIB version '1.0.0'
+				define A: B`),
+			wantErr: errValidationFailed,
+			want: []diagnostic{
+				{Severity: severityError, Check: checkParse, Library: "TESTLIB 1.0.0", Line: 3, Column: 10},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cqlDir := t.TempDir()
+			writeLocalFileWithContent(t, filepath.Join(cqlDir, "lib.cql"), tc.cql)
+			var out bytes.Buffer
+			errorFormat := errorFormatText
+			err := runValidate(context.Background(), []string{"--cql_dir=" + cqlDir}, &out, &errorFormat)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("runValidate() returned error %v, want %v", err, tc.wantErr)
+			}
+			var got validationReport
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", out.String(), err)
+			}
+			if diff := cmp.Diff(tc.want, got.Diagnostics, cmpopts.IgnoreFields(diagnostic{}, "Message")); diff != "" {
+				t.Errorf("runValidate() diagnostics diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateCQL_MissingCQLDir(t *testing.T) {
+	if _, err := validateCQL(context.Background(), validateCQLConfig{}); !errors.Is(err, errMissingFlag) {
+		t.Errorf("validateCQL() returned error %v, want %v", err, errMissingFlag)
+	}
+}
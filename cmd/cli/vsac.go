@@ -0,0 +1,151 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/cql"
+	"github.com/google/cql/internal/iohelpers"
+	"github.com/google/cql/terminology"
+)
+
+// downloadValueSetsCommand is the name of the CLI subcommand that snapshots the ValueSets
+// referenced by CQL libraries from VSAC.
+const downloadValueSetsCommand = "download_valuesets"
+
+// vsacAPIKeyEnv is the environment variable from which the UMLS API key is read if
+// --vsac_api_key is not set.
+const vsacAPIKeyEnv = "UMLS_API_KEY"
+
+type downloadValueSetsConfig struct {
+	CQLDir      string
+	OutputDir   string
+	VSACAPIKey  string
+	VSACBaseURL string
+	CacheDir    string
+	CacheTTL    time.Duration
+
+	// Should not be set directly by a flag.
+	gcsEndpoint string
+}
+
+func (cfg *downloadValueSetsConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.CQLDir, "cql_dir", "", "(Required) Directory holding 1 or more CQL files.")
+	fs.StringVar(&cfg.OutputDir, "output_dir", "", "(Required) Directory in which to write one FHIR ValueSet JSON file per ValueSet. The directory can be passed to --fhir_terminology_dir.")
+	fs.StringVar(&cfg.VSACAPIKey, "vsac_api_key", "", "(Optional) The UMLS API key used to authenticate with VSAC. If not set the "+vsacAPIKeyEnv+" environment variable is used.")
+	fs.StringVar(&cfg.VSACBaseURL, "vsac_base_url", terminology.DefaultVSACBaseURL, "(Optional) The base URL of the VSAC FHIR service.")
+	fs.StringVar(&cfg.CacheDir, "terminology_cache_dir", "", "(Optional) A local directory in which to cache VSAC responses across runs. Expired entries are used if VSAC can not be reached.")
+	fs.DurationVar(&cfg.CacheTTL, "terminology_cache_ttl", 24*time.Hour, "(Optional) How long entries in --terminology_cache_dir are used before being refreshed from VSAC. Zero means entries never expire.")
+
+	cfg.gcsEndpoint = gcs.DefaultCloudStorageEndpoint
+}
+
+// runDownloadValueSets parses the download_valuesets subcommand flags from args and runs it.
+func runDownloadValueSets(ctx context.Context, args []string, errorFormat *string) error {
+	fs := flag.NewFlagSet(downloadValueSetsCommand, flag.ExitOnError)
+	var cfg downloadValueSetsConfig
+	cfg.RegisterFlags(fs)
+	if err := parseSubcommandFlags(fs, args, errorFormat); err != nil {
+		return err
+	}
+	if cfg.VSACAPIKey == "" {
+		cfg.VSACAPIKey = os.Getenv(vsacAPIKeyEnv)
+	}
+	return downloadValueSets(ctx, cfg)
+}
+
+// downloadValueSets fetches every ValueSet declared in the CQL libraries from VSAC and writes them
+// to the output directory.
+func downloadValueSets(ctx context.Context, cfg downloadValueSetsConfig) error {
+	if cfg.CQLDir == "" {
+		return fmt.Errorf("%w --cql_dir", errMissingFlag)
+	}
+	if cfg.OutputDir == "" {
+		return fmt.Errorf("%w --output_dir", errMissingFlag)
+	}
+	if cfg.VSACAPIKey == "" {
+		return fmt.Errorf("%w --vsac_api_key (or set the %s environment variable)", errMissingFlag, vsacAPIKeyEnv)
+	}
+
+	cqlLibs, err := readCQLLibs(ctx, cfg.CQLDir, &cliConfig{gcsEndpoint: cfg.gcsEndpoint})
+	if err != nil {
+		return fmt.Errorf("failed to read CQL libraries: %w", err)
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		return fmt.Errorf("failed to create FHIR data model: %w", err)
+	}
+	elm, err := cql.Parse(ctx, cqlLibs, cql.ParseConfig{DataModels: [][]byte{fhirDM}})
+	if err != nil {
+		return fmt.Errorf("failed to parse CQL: %w", err)
+	}
+
+	vsacCfg := terminology.VSACConfig{APIKey: cfg.VSACAPIKey, BaseURL: cfg.VSACBaseURL}
+	if cfg.CacheDir != "" {
+		vsacCfg.Cache, err = terminology.NewDiskCache(cfg.CacheDir, cfg.CacheTTL)
+		if err != nil {
+			return err
+		}
+	}
+	vsac, err := terminology.NewVSACProvider(vsacCfg)
+	if err != nil {
+		return err
+	}
+	for _, vs := range elm.ValueSets() {
+		b, err := vsac.FetchCachedValueSet(vs.ID, vs.Version)
+		if err != nil {
+			return err
+		}
+		fileName := valueSetFileName(vs.ID, vs.Version)
+		if err := iohelpers.WriteFile(ctx, cfg.OutputDir, fileName, b, &iohelpers.IOConfig{GCSEndpoint: cfg.gcsEndpoint}); err != nil {
+			return fmt.Errorf("failed to write ValueSet %s: %w", vs.ID, err)
+		}
+		fmt.Printf("downloaded ValueSet %s to %s\n", vs.ID, fileName)
+	}
+	return nil
+}
+
+// remoteTerminologyProvider returns a terminology provider that expands ValueSets from
+// --terminology_server_url as they are used, caching them in --terminology_cache_dir if set.
+func remoteTerminologyProvider(cfg *cliConfig) (terminology.Provider, error) {
+	vsacCfg := terminology.VSACConfig{APIKey: cfg.VSACAPIKey, BaseURL: cfg.TerminologyServerURL}
+	if cfg.TerminologyCacheDir != "" {
+		cache, err := terminology.NewDiskCache(cfg.TerminologyCacheDir, cfg.TerminologyCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		vsacCfg.Cache = cache
+	}
+	return terminology.NewVSACProvider(vsacCfg)
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9.\-]+`)
+
+// valueSetFileName returns a file name for a ValueSet snapshot that is unique for each url and
+// version.
+func valueSetFileName(url, version string) string {
+	name := unsafeFileNameChars.ReplaceAllString(url, "_")
+	if version != "" {
+		name += "_" + unsafeFileNameChars.ReplaceAllString(version, "_")
+	}
+	return name + ".json"
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/cql/terminology"
+	"github.com/lithammer/dedent"
+)
+
+func TestDownloadValueSets(t *testing.T) {
+	vsac := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pass, _ := r.BasicAuth(); pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/ValueSet/2.16.840.1.113883.3.464.1003.101.12.1001/$expand" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{
+			"resourceType": "ValueSet",
+			"url": "http://cts.nlm.nih.gov/fhir/ValueSet/2.16.840.1.113883.3.464.1003.101.12.1001",
+			"version": "20240101",
+			"expansion": {"contains": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99201"}]}
+		}`))
+	}))
+	defer vsac.Close()
+
+	cfg := downloadValueSetsConfig{
+		CQLDir:      t.TempDir(),
+		OutputDir:   t.TempDir(),
+		VSACAPIKey:  "secret",
+		VSACBaseURL: vsac.URL,
+	}
+	writeLocalFileWithContent(t, filepath.Join(cfg.CQLDir, "lib.cql"), dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		using FHIR version '4.0.1'
+		valueset "Office Visit": 'urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001'
+		define Visits: [Encounter: "Office Visit"]`))
+
+	cfg.CacheDir = t.TempDir()
+	if err := downloadValueSets(context.Background(), cfg); err != nil {
+		t.Fatalf("downloadValueSets() returned unexpected error: %v", err)
+	}
+	// The second download is served from the cache, even with VSAC offline.
+	vsac.Close()
+	if err := downloadValueSets(context.Background(), cfg); err != nil {
+		t.Fatalf("downloadValueSets() with a populated cache returned unexpected error: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(cfg.OutputDir, "urn_oid_2.16.840.1.113883.3.464.1003.101.12.1001.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned unexpected error: %v", err)
+	}
+	tp, err := terminology.NewInMemoryFHIRProvider([]string{string(b)})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() returned unexpected error: %v", err)
+	}
+	in, err := tp.AnyInValueSet([]terminology.Code{{System: "http://www.ama-assn.org/go/cpt", Code: "99201"}}, "urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001", "")
+	if err != nil {
+		t.Fatalf("AnyInValueSet() returned unexpected error: %v", err)
+	}
+	if !in {
+		t.Errorf("AnyInValueSet() on the downloaded snapshot = false, want true")
+	}
+}
+
+func TestDownloadValueSetsError(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  downloadValueSetsConfig
+	}{
+		{
+			name: "Missing CQL dir",
+			cfg:  downloadValueSetsConfig{OutputDir: "out", VSACAPIKey: "secret"},
+		},
+		{
+			name: "Missing output dir",
+			cfg:  downloadValueSetsConfig{CQLDir: "cql", VSACAPIKey: "secret"},
+		},
+		{
+			name: "Missing API key",
+			cfg:  downloadValueSetsConfig{CQLDir: "cql", OutputDir: "out"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := downloadValueSets(context.Background(), tc.cfg)
+			if !errors.Is(err, errMissingFlag) {
+				t.Errorf("downloadValueSets() returned error %v, want %v", err, errMissingFlag)
+			}
+		})
+	}
+}
+
+func TestValueSetFileName(t *testing.T) {
+	tests := []struct {
+		url, version, want string
+	}{
+		{"urn:oid:1.2.3", "", "urn_oid_1.2.3.json"},
+		{"https://example.com/fhir/ValueSet/abc", "2.0.0", "https_example.com_fhir_ValueSet_abc_2.0.0.json"},
+	}
+	for _, tc := range tests {
+		if got := valueSetFileName(tc.url, tc.version); got != tc.want {
+			t.Errorf("valueSetFileName(%q, %q) = %q, want %q", tc.url, tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestCLITerminologyServer(t *testing.T) {
+	vsac := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pass, _ := r.BasicAuth(); pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/ValueSet/2.16.840.1.113883.3.464.1003.101.12.1001/$expand" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{
+			"resourceType": "ValueSet",
+			"url": "http://cts.nlm.nih.gov/fhir/ValueSet/2.16.840.1.113883.3.464.1003.101.12.1001",
+			"version": "20240101",
+			"expansion": {"contains": [{"system": "http://www.ama-assn.org/go/cpt", "code": "99201"}]}
+		}`))
+	}))
+	defer vsac.Close()
+
+	testDirCfg := defaultCLIConfig(t)
+	writeLocalFileWithContent(t, filepath.Join(testDirCfg.CQLDir, "lib.cql"), dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		using FHIR version '4.0.1'
+		valueset "Office Visit": 'urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001'
+		context Patient
+		define InValueSet: Code { system: 'http://www.ama-assn.org/go/cpt', code: '99201' } in "Office Visit"`))
+	cfg := cliConfig{
+		CQLDir:               testDirCfg.CQLDir,
+		JSONOutputDir:        testDirCfg.JSONOutputDir,
+		TerminologyServerURL: vsac.URL,
+		VSACAPIKey:           "secret",
+		TerminologyCacheDir:  t.TempDir(),
+		OutputFormat:         outputFormatJSON,
+		Concurrency:          1,
+	}
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() returned unexpected error: %v", err)
+	}
+	// The second run is served from the cache, even with the terminology server offline.
+	vsac.Close()
+	if err := mainWrapper(context.Background(), cfg); err != nil {
+		t.Fatalf("mainWrapper() with a populated cache returned unexpected error: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(cfg.JSONOutputDir, "results.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile() returned unexpected error: %v", err)
+	}
+	var res struct {
+		EvalResults []struct {
+			ExpressionDefinitions map[string]struct {
+				Value bool `json:"value"`
+			} `json:"expressionDefinitions"`
+		} `json:"evalResults"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("json.Unmarshal() returned unexpected error: %v", err)
+	}
+	if len(res.EvalResults) != 1 || !res.EvalResults[0].ExpressionDefinitions["InValueSet"].Value {
+		t.Errorf("mainWrapper() wrote %s, want InValueSet to be true", b)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cql/result"
+	"github.com/google/cql/result/diff"
+)
+
+// watchInterval is how often the CQL directory is checked for changes in watch mode.
+var watchInterval = 500 * time.Millisecond
+
+// watchCQL evaluates the CQL every time a CQL file in the CQL directory changes, until the context
+// is cancelled. After each evaluation the changes to the results since the previous successful
+// evaluation are written to w. Errors, such as CQL that does not parse, are written to w and do not
+// stop watching.
+func watchCQL(ctx context.Context, cfg cliConfig, w io.Writer) error {
+	if err := validateConfig(ctx, &cfg); err != nil {
+		return err
+	}
+	var prev map[string]result.Libraries
+	var lastState string
+	for {
+		state, err := cqlDirState(cfg.CQLDir)
+		if err != nil {
+			return err
+		}
+		if state != lastState {
+			lastState = state
+			start := time.Now()
+			results, err := evalForWatch(ctx, cfg)
+			took := time.Since(start).Round(time.Millisecond)
+			if err != nil {
+				fmt.Fprintf(w, "[%s] evaluation failed after %v: %v\n", start.Format(time.TimeOnly), took, err)
+			} else {
+				fmt.Fprintf(w, "[%s] evaluated %d result(s) in %v\n", start.Format(time.TimeOnly), len(results), took)
+				if prev != nil {
+					fmt.Fprint(w, watchReport(prev, results))
+				}
+				prev = results
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchInterval):
+		}
+	}
+}
+
+// evalForWatch runs the CLI once and returns the results, keyed by the name of their output file.
+func evalForWatch(ctx context.Context, cfg cliConfig) (map[string]result.Libraries, error) {
+	var mu sync.Mutex
+	results := make(map[string]result.Libraries)
+	cfg.onResult = func(fileName string, libs result.Libraries) {
+		mu.Lock()
+		defer mu.Unlock()
+		results[fileName] = libs
+	}
+	if err := mainWrapper(ctx, cfg); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// watchReport returns the changes between the previous and current results of each output file.
+// Library versions are ignored, so that bumping the version of a library does not report every
+// result as changed.
+func watchReport(prev, cur map[string]result.Libraries) string {
+	var names []string
+	for name := range cur {
+		names = append(names, name)
+	}
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		diffs := diff.Compare(prev[name], cur[name], diff.Options{IgnoreLibraryVersions: true})
+		if len(diffs) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s:\n", name)
+		for _, line := range strings.Split(strings.TrimSuffix(diff.Report(diffs), "\n"), "\n") {
+			fmt.Fprintf(&sb, "  %s\n", line)
+		}
+	}
+	if sb.Len() == 0 {
+		return "no changes to the results\n"
+	}
+	return sb.String()
+}
+
+// cqlDirState returns a string that changes whenever a CQL file in the directory is added, removed
+// or saved.
+func cqlDirState(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".cql") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "%s %d %d\n", filepath.Join(dir, e.Name()), info.Size(), info.ModTime().UnixNano())
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/cql/result"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWatchCQL(t *testing.T) {
+	defer func(d time.Duration) { watchInterval = d }(watchInterval)
+	watchInterval = 10 * time.Millisecond
+
+	testDirCfg := defaultCLIConfig(t)
+	cqlFile := filepath.Join(testDirCfg.CQLDir, "test_code.cql")
+	writeLocalFileWithContent(t, cqlFile, `
+	library TESTLIB version '1.0.0'
+	define Numerator: 1
+	define Unchanged: 'same'`)
+	cfg := cliConfig{
+		CQLDir:        testDirCfg.CQLDir,
+		JSONOutputDir: testDirCfg.JSONOutputDir,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &syncBuffer{}
+	done := make(chan error)
+	go func() { done <- watchCQL(ctx, cfg, w) }()
+
+	waitForOutput(t, w, "evaluated 1 result(s)")
+	writeLocalFileWithContent(t, cqlFile, `
+	library TESTLIB version '1.0.1'
+	define Numerator: 2
+	define Unchanged: 'same'`)
+	touch(t, cqlFile)
+	waitForOutput(t, w, "1 difference(s).")
+	writeLocalFileWithContent(t, cqlFile, `library TESTLIB define Numerator: `)
+	touch(t, cqlFile)
+	waitForOutput(t, w, "evaluation failed")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("watchCQL() returned an unexpected error: %v", err)
+	}
+	want := "results.json:\n  TESTLIB 1.0.1\n    ~ Numerator: 1 -> 2\n  1 difference(s).\n"
+	if !strings.Contains(w.String(), want) {
+		t.Errorf("watchCQL() output = %q, want it to contain %q", w.String(), want)
+	}
+}
+
+func TestWatchCQL_Error(t *testing.T) {
+	cfg := cliConfig{CQLDir: "gs://bucket/cql", Watch: true}
+	if err := watchCQL(context.Background(), cfg, &bytes.Buffer{}); err == nil {
+		t.Errorf("watchCQL() succeeded, want error")
+	}
+}
+
+func TestWatchReport(t *testing.T) {
+	libKey := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	libs := func(v int32) result.Libraries {
+		return result.Libraries{libKey: {"Numerator": newOrFatal(t, v)}}
+	}
+	tests := []struct {
+		name string
+		prev map[string]result.Libraries
+		cur  map[string]result.Libraries
+		want string
+	}{
+		{
+			name: "no changes",
+			prev: map[string]result.Libraries{"a.json": libs(1)},
+			cur:  map[string]result.Libraries{"a.json": libs(1)},
+			want: "no changes to the results\n",
+		},
+		{
+			name: "changed and removed results",
+			prev: map[string]result.Libraries{"a.json": libs(1), "b.json": libs(1)},
+			cur:  map[string]result.Libraries{"a.json": libs(2)},
+			want: "a.json:\n  TESTLIB 1.0.0\n    ~ Numerator: 1 -> 2\n  1 difference(s).\n" +
+				"b.json:\n  TESTLIB 1.0.0\n    - Numerator: 1\n  1 difference(s).\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, watchReport(tc.prev, tc.cur)); diff != "" {
+				t.Errorf("watchReport() unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe to write and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitForOutput(t *testing.T, w *syncBuffer, want string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(w.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for output %q, got %q", want, w.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// touch moves the modification time of the file forward, so that a change is detected even on file
+// systems with a coarse modification time.
+func touch(t *testing.T, path string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat() returned an unexpected error: %v", err)
+	}
+	mt := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, mt, mt); err != nil {
+		t.Fatalf("os.Chtimes() returned an unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/google/cql"
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/model"
+	"github.com/google/cql/parser"
+	"github.com/google/cql/result"
+)
+
+// fhirHelpersName is the name of the FHIRHelpers library, which is provided by the engine if it is
+// not in the workspace.
+const fhirHelpersName = "FHIRHelpers"
+
+// includeStatement matches the include statements of a CQL library, capturing the included name.
+var includeStatement = regexp.MustCompile(`(?m)^[ \t]*include\s+` + identifier)
+
+// analysis is the result of parsing a document together with the libraries it includes.
+type analysis struct {
+	// docs are the documents that were parsed, starting with the analysed document and followed by
+	// the workspace libraries it includes, directly or indirectly.
+	docs []*document
+	// sources are the sources that were parsed, which are the text of the docs followed by the
+	// FHIRHelpers of the engine if the workspace does not have it.
+	sources []string
+	// libs and locators are the parsed libraries and the location of their expressions. They are nil
+	// if parsing failed with err.
+	libs     []*model.Library
+	locators map[model.IExpression]result.Locator
+	err      error
+}
+
+// analyze parses the document along with the libraries of the workspace that it includes. The
+// workspace is keyed by URI, and may include the document.
+func analyze(ctx context.Context, doc *document, workspace map[string]*document) *analysis {
+	a := &analysis{docs: includedDocuments(doc, workspace)}
+	hasHelpers := false
+	for _, d := range a.docs {
+		a.sources = append(a.sources, d.text)
+		if key, ok := editing.LibraryDeclaration(d.text); ok && key.Name == fhirHelpersName {
+			hasHelpers = true
+		}
+	}
+	fhirDM, fhirHelpers, err := cql.FHIRDataModelAndHelpersLib("4.0.1")
+	if err != nil {
+		a.err = err
+		return a
+	}
+	if !hasHelpers {
+		a.sources = append(a.sources, fhirHelpers)
+	}
+	p, err := parser.New(ctx, [][]byte{fhirDM})
+	if err != nil {
+		a.err = err
+		return a
+	}
+	a.libs, a.err = p.Libraries(ctx, a.sources, parser.Config{})
+	if a.err == nil {
+		a.locators = p.Locators()
+	}
+	return a
+}
+
+// includedDocuments returns the document followed by the documents of the workspace that it
+// includes, directly or indirectly. Includes are resolved by name, so every version of an included
+// library is returned, and the parser picks the version asked for.
+func includedDocuments(doc *document, workspace map[string]*document) []*document {
+	byName := map[string][]*document{}
+	for _, d := range workspace {
+		if d.uri == doc.uri {
+			continue
+		}
+		if key, ok := editing.LibraryDeclaration(d.text); ok {
+			byName[key.Name] = append(byName[key.Name], d)
+		}
+	}
+	docs := []*document{doc}
+	seen := map[string]bool{}
+	for i := 0; i < len(docs); i++ {
+		for _, m := range includeStatement.FindAllStringSubmatch(blankComments(docs[i].text), -1) {
+			name := unquoteIdentifier(m[1])
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			docs = append(docs, byName[name]...)
+		}
+	}
+	return docs
+}
+
+// document returns the parsed document of the library, or nil if the library is not one of the
+// documents, like the FHIRHelpers of the engine.
+func (a *analysis) document(key result.LibKey) *document {
+	i := editing.SourceIndex(a.sources, key)
+	if i < 0 || i >= len(a.docs) {
+		return nil
+	}
+	return a.docs[i]
+}
+
+// library returns the parsed library of the document, or nil.
+func (a *analysis) library(doc *document) *model.Library {
+	for _, lib := range a.libs {
+		if a.document(result.LibKeyFromModel(lib.Identifier)) == doc {
+			return lib
+		}
+	}
+	return nil
+}
+
+// includedLibrary returns the library that lib includes under the local name, or nil.
+func (a *analysis) includedLibrary(lib *model.Library, local string) *model.Library {
+	for _, inc := range lib.Includes {
+		if inc.Identifier.Local != local {
+			continue
+		}
+		for _, l := range a.libs {
+			if l.Identifier != nil && l.Identifier.Qualified == inc.Identifier.Qualified && l.Identifier.Version == inc.Identifier.Version {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+// expressionAt returns the innermost parsed expression of the library at the position of the
+// document, or nil.
+func (a *analysis) expressionAt(doc *document, lib *model.Library, pos position) model.IExpression {
+	key := result.LibKeyFromModel(lib.Identifier)
+	col := doc.runeColumn(pos) + 1
+	at := result.Locator{Library: key, StartLine: pos.Line + 1, StartCol: col, EndLine: pos.Line + 1, EndCol: col}
+	var best model.IExpression
+	var bestLoc result.Locator
+	for m, loc := range a.locators {
+		if !loc.Contains(at) {
+			continue
+		}
+		if best == nil || bestLoc.Compare(loc) < 0 || (bestLoc == loc && preferExpression(m, best)) {
+			best, bestLoc = m, loc
+		}
+	}
+	return best
+}
+
+// preferExpression breaks ties between expressions with the same location, preferring references
+// since they say more about the code at the position, so that the result does not depend on map
+// order.
+func preferExpression(m, other model.IExpression) bool {
+	_, mRef := referenceOf(m)
+	_, otherRef := referenceOf(other)
+	if mRef != otherRef {
+		return mRef
+	}
+	return strings.Compare(typeOf(m), typeOf(other)) < 0
+}
+
+// reference is a reference from an expression to a declaration of a library.
+type reference struct {
+	kind string
+	name string
+	// library is the local name of the included library the declaration is in, or empty for the
+	// library of the expression.
+	library string
+}
+
+// referenceOf returns the declaration referenced by the expression, or false if the expression is
+// not a reference to a declaration.
+func referenceOf(m model.IExpression) (reference, bool) {
+	switch r := m.(type) {
+	case *model.ExpressionRef:
+		return reference{kind: kindDefine, name: r.Name, library: r.LibraryName}, true
+	case *model.FunctionRef:
+		return reference{kind: kindFunction, name: r.Name, library: r.LibraryName}, true
+	case *model.ParameterRef:
+		return reference{kind: kindParameter, name: r.Name, library: r.LibraryName}, true
+	case *model.ValuesetRef:
+		return reference{kind: kindValueset, name: r.Name, library: r.LibraryName}, true
+	case *model.CodeSystemRef:
+		return reference{kind: kindCodeSystem, name: r.Name, library: r.LibraryName}, true
+	case *model.CodeRef:
+		return reference{kind: kindCode, name: r.Name, library: r.LibraryName}, true
+	case *model.ConceptRef:
+		return reference{kind: kindConcept, name: r.Name, library: r.LibraryName}, true
+	}
+	return reference{}, false
+}
+
+// typeOf returns the name of the type of the expression.
+func typeOf(m model.IExpression) string {
+	return editing.TypeName(m.GetResultType())
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of declarations.
+const (
+	kindLibrary    = "library"
+	kindInclude    = "include"
+	kindParameter  = "parameter"
+	kindCodeSystem = "codesystem"
+	kindValueset   = "valueset"
+	kindCode       = "code"
+	kindConcept    = "concept"
+	kindDefine     = "define"
+	kindFunction   = "function"
+	// kindContext declarations only end the previous declaration, they are not symbols.
+	kindContext = "context"
+)
+
+// declaration is a statement of a CQL library that declares a name, located in its document.
+type declaration struct {
+	kind string
+	// name is the declared name without quotes. For includes it is the qualified name of the library.
+	name string
+	// local is the name the included library is referred to by, for includes.
+	local string
+	// nameRange is the range of the name, and fullRange the range of the whole statement.
+	nameRange rng
+	fullRange rng
+}
+
+// identifier matches a CQL identifier, which may be quoted.
+const identifier = "(\"(?:[^\"\\\\]|\\\\.)*\"|`(?:[^`\\\\]|\\\\.)*`|[A-Za-z_][A-Za-z0-9_]*)"
+
+// accessModifier matches an optional public or private modifier.
+const accessModifier = `(?:(?:public|private)\s+)?`
+
+// declarationPatterns match the start of each kind of declaration. The first group is the kind
+// keyword and the second the name.
+var declarationPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?m)^[ \t]*(library)\s+` + identifier),
+	regexp.MustCompile(`(?m)^[ \t]*(include)\s+` + identifier + `(?:\s+version\s+'[^']*')?(?:\s+called\s+` + identifier + `)?`),
+	regexp.MustCompile(`(?m)^[ \t]*` + accessModifier + `(parameter|codesystem|valueset|code|concept)\s+` + identifier),
+	regexp.MustCompile(`(?m)^[ \t]*define\s+` + accessModifier + `(?:fluent\s+)?(function)\s+` + identifier),
+	regexp.MustCompile(`(?m)^[ \t]*(define)\s+` + accessModifier + identifier),
+	regexp.MustCompile(`(?m)^[ \t]*(context)\s+` + identifier),
+}
+
+// declarations returns the declarations of the document in the order they appear. The statements
+// are found textually, so that they are also found in libraries that do not parse.
+func declarations(doc *document) []declaration {
+	text := blankComments(doc.text)
+	type match struct {
+		start int
+		decl  declaration
+	}
+	var matches []match
+	for _, re := range declarationPatterns {
+		for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+			kind := text[m[2]:m[3]]
+			if raw := text[m[4]:m[5]]; kind == kindDefine && (raw == "function" || raw == "fluent") {
+				// Matched by the function pattern.
+				continue
+			}
+			d := declaration{
+				kind:      kind,
+				name:      unquoteIdentifier(text[m[4]:m[5]]),
+				nameRange: rng{Start: doc.positionAt(m[4]), End: doc.positionAt(m[5])},
+			}
+			if kind == kindInclude {
+				d.local = d.name
+				if m[6] >= 0 {
+					d.local = unquoteIdentifier(text[m[6]:m[7]])
+				}
+			}
+			matches = append(matches, match{start: m[0], decl: d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].start < matches[j].start })
+
+	var decls []declaration
+	for i, m := range matches {
+		end := len(text)
+		if i+1 < len(matches) {
+			end = matches[i+1].start
+		}
+		body := strings.TrimRight(text[m.start:end], " \t\r\n")
+		start := m.start + len(body) - len(strings.TrimLeft(body, " \t"))
+		m.decl.fullRange = rng{Start: doc.positionAt(start), End: doc.positionAt(m.start + len(body))}
+		if m.decl.kind != kindContext {
+			decls = append(decls, m.decl)
+		}
+	}
+	return decls
+}
+
+// findDeclarations returns the declarations of the kind and name.
+func findDeclarations(decls []declaration, kind, name string) []declaration {
+	var found []declaration
+	for _, d := range decls {
+		if d.kind == kind && d.name == name {
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+// declarationAt returns the declaration whose name is at the position, or false.
+func declarationAt(decls []declaration, pos position) (declaration, bool) {
+	for _, d := range decls {
+		if contains(d.nameRange, pos) {
+			return d, true
+		}
+	}
+	return declaration{}, false
+}
+
+// contains returns true if the position is within the range, including its end.
+func contains(r rng, pos position) bool {
+	afterStart := pos.Line > r.Start.Line || (pos.Line == r.Start.Line && pos.Character >= r.Start.Character)
+	beforeEnd := pos.Line < r.End.Line || (pos.Line == r.End.Line && pos.Character <= r.End.Character)
+	return afterStart && beforeEnd
+}
+
+func unquoteIdentifier(name string) string {
+	if len(name) >= 2 && (name[0] == '"' || name[0] == '`') {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
+
+// blankComments returns the text with the comments replaced by spaces, keeping the line breaks so
+// that offsets in the result are offsets in the text.
+func blankComments(text string) string {
+	b := []byte(text)
+	for i := 0; i < len(b); i++ {
+		switch {
+		case b[i] == '\'' || b[i] == '"' || b[i] == '`':
+			// Skip over the string or quoted identifier.
+			q := b[i]
+			for i++; i < len(b) && b[i] != q; i++ {
+				if b[i] == '\\' {
+					i++
+				}
+			}
+		case b[i] == '/' && i+1 < len(b) && b[i+1] == '/':
+			for ; i < len(b) && b[i] != '\n'; i++ {
+				b[i] = ' '
+			}
+		case b[i] == '/' && i+1 < len(b) && b[i+1] == '*':
+			end := strings.Index(string(b[i+2:]), "*/")
+			stop := len(b)
+			if end >= 0 {
+				stop = i + 2 + end + 2
+			}
+			for ; i < stop; i++ {
+				if b[i] != '\n' {
+					b[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+	return string(b)
+}
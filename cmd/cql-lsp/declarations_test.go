@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDeclarations(t *testing.T) {
+	text := `library "My Library" version '1'
+include Helpers version '1.0' called H
+include Other
+// define Commented: 1
+/* define AlsoCommented: 2 */
+public parameter "Measurement Period" Interval<DateTime>
+private codesystem LOINC: 'http://loinc.org'
+valueset Glucose: 'https://example.com/vs/glucose' // define Trailing: 3
+code Hb: '718-7' from LOINC
+concept HbConcept: { Hb }
+context Patient
+define private "Has Glucose":
+  exists [Observation: Glucose]
+
+define public fluent function Twice(x Integer):
+  x * 2
+define function "Say 'hi'"(): 'define Inside: 4'
+`
+	got := declarations(newDocument("file:///x.cql", text))
+	type short struct {
+		Kind, Name, Local string
+		Line, Char        int
+		EndLine, EndChar  int
+	}
+	var gotShort []short
+	for _, d := range got {
+		gotShort = append(gotShort, short{d.kind, d.name, d.local, d.nameRange.Start.Line, d.nameRange.Start.Character, d.fullRange.End.Line, d.fullRange.End.Character})
+	}
+	want := []short{
+		{Kind: kindLibrary, Name: "My Library", Line: 0, Char: 8, EndLine: 0, EndChar: 32},
+		{Kind: kindInclude, Name: "Helpers", Local: "H", Line: 1, Char: 8, EndLine: 1, EndChar: 38},
+		{Kind: kindInclude, Name: "Other", Local: "Other", Line: 2, Char: 8, EndLine: 2, EndChar: 13},
+		{Kind: kindParameter, Name: "Measurement Period", Line: 5, Char: 17, EndLine: 5, EndChar: 56},
+		{Kind: kindCodeSystem, Name: "LOINC", Line: 6, Char: 19, EndLine: 6, EndChar: 44},
+		{Kind: kindValueset, Name: "Glucose", Line: 7, Char: 9, EndLine: 7, EndChar: 50},
+		{Kind: kindCode, Name: "Hb", Line: 8, Char: 5, EndLine: 8, EndChar: 27},
+		{Kind: kindConcept, Name: "HbConcept", Line: 9, Char: 8, EndLine: 9, EndChar: 25},
+		{Kind: kindDefine, Name: "Has Glucose", Line: 11, Char: 15, EndLine: 12, EndChar: 31},
+		{Kind: kindFunction, Name: "Twice", Line: 14, Char: 30, EndLine: 15, EndChar: 7},
+		{Kind: kindFunction, Name: "Say 'hi'", Line: 16, Char: 16, EndLine: 16, EndChar: 48},
+	}
+	if diff := cmp.Diff(want, gotShort); diff != "" {
+		t.Errorf("declarations() returned a diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestBlankComments(t *testing.T) {
+	text := "define X: 'a // b' // c\n/* d\ne */ define \"/*\": 1"
+	want := "define X: 'a // b'     \n    \n     define \"/*\": 1"
+	if got := blankComments(text); got != want {
+		t.Errorf("blankComments(%q) = %q, want %q", text, got, want)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/cql/parser"
+)
+
+// diagnosticSource is the source of the diagnostics shown by the editor.
+const diagnosticSource = "cql"
+
+// severities maps the severities of parsing errors to LSP diagnostic severities.
+var severities = map[parser.ErrorSeverity]int{
+	parser.ErrorSeverityError:   severityError,
+	parser.ErrorSeverityWarning: severityWarning,
+	parser.ErrorSeverityInfo:    severityInformation,
+}
+
+// diagnosticsOf returns the problems found in the document when it was parsed. Errors in the
+// libraries the document includes are reported on the include statement of the library, or on the
+// first line if the library is included indirectly, since the editor shows them in the document of
+// that library when it is opened.
+func diagnosticsOf(a *analysis, doc *document) []diagnostic {
+	diags := []diagnostic{}
+	if a.err == nil {
+		return diags
+	}
+	firstLine := rng{End: position{Character: utf16Len(doc.line(0))}}
+	var libErrs *parser.LibraryErrors
+	if !errors.As(a.err, &libErrs) {
+		return append(diags, diagnostic{Range: firstLine, Severity: severityError, Source: diagnosticSource, Message: a.err.Error()})
+	}
+
+	if a.document(libErrs.LibKey) != doc {
+		r := firstLine
+		for _, d := range declarations(doc) {
+			if d.kind == kindInclude && d.name == libErrs.LibKey.Name {
+				r = d.nameRange
+			}
+		}
+		msg := fmt.Sprintf("included library %s does not parse", libErrs.LibKey.String())
+		if len(libErrs.Errors) > 0 {
+			msg += fmt.Sprintf(", the first of %d errors is at %v", len(libErrs.Errors), libErrs.Errors[0])
+		}
+		return append(diags, diagnostic{Range: r, Severity: severityError, Source: diagnosticSource, Message: msg})
+	}
+
+	for _, pe := range libErrs.Errors {
+		msg := pe.Message
+		if pe.Cause != nil {
+			msg += ": " + pe.Cause.Error()
+		}
+		// Errors that fail parsing are errors unless the parser marks them otherwise.
+		severity, ok := severities[pe.Severity]
+		if !ok {
+			severity = severityError
+		}
+		// Internal errors may not have a line.
+		pos := doc.positionOfRune(max(pe.Line, 1), pe.Column)
+		diags = append(diags, diagnostic{Range: doc.wordRange(pos), Severity: severity, Source: diagnosticSource, Message: msg})
+	}
+	return diags
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// document is the text of a CQL library, either open in the editor or read from the workspace.
+type document struct {
+	uri  string
+	text string
+	// lineStarts are the byte offsets of the start of each line.
+	lineStarts []int
+}
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri, text: text, lineStarts: []int{0}}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			d.lineStarts = append(d.lineStarts, i+1)
+		}
+	}
+	return d
+}
+
+// line returns the text of the 0-based line without its line ending, or "" if there is no such
+// line.
+func (d *document) line(line int) string {
+	if line < 0 || line >= len(d.lineStarts) {
+		return ""
+	}
+	end := len(d.text)
+	if line+1 < len(d.lineStarts) {
+		end = d.lineStarts[line+1] - 1
+	}
+	return strings.TrimSuffix(d.text[d.lineStarts[line]:end], "\r")
+}
+
+// positionAt returns the position of the byte offset in the text.
+func (d *document) positionAt(offset int) position {
+	offset = max(0, min(offset, len(d.text)))
+	line := sort.Search(len(d.lineStarts), func(i int) bool { return d.lineStarts[i] > offset }) - 1
+	return position{Line: line, Character: utf16Len(d.text[d.lineStarts[line]:offset])}
+}
+
+// end returns the position at the end of the text.
+func (d *document) end() position {
+	return d.positionAt(len(d.text))
+}
+
+// byteColumn returns the byte offset in its line of the position, which counts UTF-16 code units.
+func (d *document) byteColumn(pos position) int {
+	line := d.line(pos.Line)
+	col := 0
+	for i, r := range line {
+		if col >= pos.Character {
+			return i
+		}
+		col += utf16RuneLen(r)
+	}
+	return len(line)
+}
+
+// runeColumn returns the offset in code points in its line of the position. The CQL parser counts
+// columns in code points.
+func (d *document) runeColumn(pos position) int {
+	return utf8.RuneCountInString(d.line(pos.Line)[:d.byteColumn(pos)])
+}
+
+// positionOfRune returns the position of the 1-based line and 0-based code point column reported by
+// the CQL parser.
+func (d *document) positionOfRune(line, column int) position {
+	text := d.line(line - 1)
+	chars := 0
+	for _, r := range text {
+		if column <= 0 {
+			break
+		}
+		chars += utf16RuneLen(r)
+		column--
+	}
+	return position{Line: line - 1, Character: chars}
+}
+
+// wordRange returns the range of the identifier starting at the position, or a range covering the
+// single character at the position if there is no identifier.
+func (d *document) wordRange(pos position) rng {
+	rest := d.line(pos.Line)[d.byteColumn(pos):]
+	n := 0
+	for _, r := range rest {
+		if r != '_' && !isLetterOrDigit(r) {
+			break
+		}
+		n += utf16RuneLen(r)
+	}
+	if n == 0 && rest != "" {
+		r, _ := utf8.DecodeRuneInString(rest)
+		n = utf16RuneLen(r)
+	}
+	return rng{Start: pos, End: position{Line: pos.Line, Character: pos.Character + n}}
+}
+
+func isLetterOrDigit(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16RuneLen(r)
+	}
+	return n
+}
+
+// utf16RuneLen returns the number of UTF-16 code units of the rune, which the LSP counts
+// characters in.
+func utf16RuneLen(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// uriToPath returns the file path of a file URI.
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("only file URIs are supported, got %q", uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// pathToURI returns the file URI of a file path.
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDocumentPositions(t *testing.T) {
+	// 😀 is two UTF-16 code units, four bytes and one code point.
+	doc := newDocument("file:///x.cql", "define A: 1\r\ndefine \"😀\": 'é'\n")
+
+	if got := doc.line(0); got != "define A: 1" {
+		t.Errorf("line(0) = %q, want %q", got, "define A: 1")
+	}
+	if got := doc.line(3); got != "" {
+		t.Errorf("line(3) = %q, want an empty line", got)
+	}
+	if got, want := doc.end(), (position{Line: 2}); got != want {
+		t.Errorf("end() = %v, want %v", got, want)
+	}
+	if got, want := doc.positionAt(len("define A: 1\r\ndefine \"😀")), (position{Line: 1, Character: 10}); got != want {
+		t.Errorf("positionAt() = %v, want %v", got, want)
+	}
+
+	pos := position{Line: 1, Character: 11}
+	if got, want := doc.byteColumn(pos), len(`define "😀"`); got != want {
+		t.Errorf("byteColumn(%v) = %d, want %d", pos, got, want)
+	}
+	if got, want := doc.runeColumn(pos), len(`define "`)+2; got != want {
+		t.Errorf("runeColumn(%v) = %d, want %d", pos, got, want)
+	}
+	if got := doc.positionOfRune(2, 10); got != pos {
+		t.Errorf("positionOfRune(2, 10) = %v, want %v", got, pos)
+	}
+	if got, want := doc.wordRange(position{Line: 0, Character: 7}), (rng{Start: position{Character: 7}, End: position{Character: 8}}); got != want {
+		t.Errorf("wordRange() = %v, want %v", got, want)
+	}
+	if got, want := doc.wordRange(position{Line: 1, Character: 8}), (rng{Start: position{Line: 1, Character: 8}, End: position{Line: 1, Character: 10}}); got != want {
+		t.Errorf("wordRange() of a non identifier = %v, want %v", got, want)
+	}
+}
+
+func TestURIs(t *testing.T) {
+	path := "/work/my libs/Main.cql"
+	uri := pathToURI(path)
+	if uri != "file:///work/my%20libs/Main.cql" {
+		t.Errorf("pathToURI(%q) = %q, want %q", path, uri, "file:///work/my%20libs/Main.cql")
+	}
+	got, err := uriToPath(uri)
+	if err != nil {
+		t.Fatalf("uriToPath(%q) returned an unexpected error: %v", uri, err)
+	}
+	if got != path {
+		t.Errorf("uriToPath(%q) = %q, want %q", uri, got, path)
+	}
+	if _, err := uriToPath("untitled:Untitled-1"); err == nil {
+		t.Errorf("uriToPath() of an untitled document succeeded, want an error")
+	}
+}
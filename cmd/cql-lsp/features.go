@@ -0,0 +1,356 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/cql/formatter"
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+)
+
+// hoverAt returns the hover at the position of the document, which shows the inferred type of the
+// innermost expression at the position, or the declaration it references. Nil is returned if there
+// is nothing to show, for example because the document does not parse.
+func hoverAt(a *analysis, doc *document, pos position) *hover {
+	lib := a.library(doc)
+	if lib == nil {
+		return nil
+	}
+	if d, ok := declarationAt(declarations(doc), pos); ok {
+		text := describeDeclaration(a, lib, d)
+		if text == "" {
+			return nil
+		}
+		return &hover{Contents: cqlMarkdown(text), Range: &d.nameRange}
+	}
+
+	m := a.expressionAt(doc, lib, pos)
+	if m == nil {
+		return nil
+	}
+	var text string
+	switch e := m.(type) {
+	case *model.AliasRef:
+		text = fmt.Sprintf("alias %s: %s", editing.QuoteIdentifier(e.Name), typeOf(m))
+	case *model.QueryLetRef:
+		text = fmt.Sprintf("let %s: %s", editing.QuoteIdentifier(e.Name), typeOf(m))
+	case *model.OperandRef:
+		text = fmt.Sprintf("operand %s: %s", editing.QuoteIdentifier(e.Name), typeOf(m))
+	}
+	if ref, ok := referenceOf(m); ok {
+		if target := a.referencedLibrary(lib, ref); target != nil {
+			text = describe(target, ref.kind, ref.name)
+		}
+	}
+	if text == "" {
+		text = typeOf(m)
+	}
+	r := locatorRange(doc, a.locators[m])
+	return &hover{Contents: cqlMarkdown(text), Range: &r}
+}
+
+// definitionAt returns the location of the declaration referenced at the position of the document,
+// which may be in an included library. Functions may have several declarations, one per overload.
+func definitionAt(a *analysis, doc *document, pos position) []location {
+	lib := a.library(doc)
+	if lib == nil {
+		return nil
+	}
+	if d, ok := declarationAt(declarations(doc), pos); ok {
+		if d.kind != kindInclude {
+			return nil
+		}
+		target := a.includedLibrary(lib, d.local)
+		if target == nil {
+			return nil
+		}
+		return declarationLocations(a, target, kindLibrary, target.Identifier.Qualified)
+	}
+
+	ref, ok := referenceOf(a.expressionAt(doc, lib, pos))
+	if !ok {
+		return nil
+	}
+	target := a.referencedLibrary(lib, ref)
+	if target == nil {
+		return nil
+	}
+	return declarationLocations(a, target, ref.kind, ref.name)
+}
+
+// declarationLocations returns the locations of the declarations of the kind and name in the
+// document of the library.
+func declarationLocations(a *analysis, lib *model.Library, kind, name string) []location {
+	doc := a.document(result.LibKeyFromModel(lib.Identifier))
+	if doc == nil {
+		return nil
+	}
+	var locs []location
+	for _, d := range findDeclarations(declarations(doc), kind, name) {
+		locs = append(locs, location{URI: doc.uri, Range: d.nameRange})
+	}
+	return locs
+}
+
+// referencedLibrary returns the library of the declaration the reference is to.
+func (a *analysis) referencedLibrary(lib *model.Library, ref reference) *model.Library {
+	if ref.library == "" {
+		return lib
+	}
+	return a.includedLibrary(lib, ref.library)
+}
+
+// symbolKinds maps the kinds of declarations to LSP symbol kinds.
+var symbolKinds = map[string]int{
+	kindLibrary:    symbolModule,
+	kindInclude:    symbolNamespace,
+	kindParameter:  symbolProperty,
+	kindCodeSystem: symbolConstant,
+	kindValueset:   symbolConstant,
+	kindCode:       symbolConstant,
+	kindConcept:    symbolConstant,
+	kindDefine:     symbolVariable,
+	kindFunction:   symbolFunction,
+}
+
+// documentSymbols returns the declarations of the document. If the document parses, they are
+// detailed with their types.
+func documentSymbols(a *analysis, doc *document) []documentSymbol {
+	lib := a.library(doc)
+	// overloads counts the functions declared so far by name, to match declarations to overloads.
+	overloads := map[string]int{}
+	symbols := []documentSymbol{}
+	for _, d := range declarations(doc) {
+		s := documentSymbol{
+			Name:           d.name,
+			Kind:           symbolKinds[d.kind],
+			Range:          d.fullRange,
+			SelectionRange: d.nameRange,
+		}
+		if d.kind == kindInclude && d.local != d.name {
+			s.Detail = "called " + d.local
+		}
+		if lib != nil {
+			switch d.kind {
+			case kindParameter:
+				for _, p := range lib.Parameters {
+					if p.Name == d.name {
+						s.Detail = editing.TypeName(p.GetResultType())
+					}
+				}
+			case kindDefine:
+				if def := expressionDef(lib, d.name); def != nil {
+					s.Detail = editing.TypeName(def.GetResultType())
+				}
+			case kindFunction:
+				if fs := functionDefs(lib, d.name); overloads[d.name] < len(fs) {
+					s.Detail = signature(fs[overloads[d.name]])
+				}
+				overloads[d.name]++
+			}
+		}
+		symbols = append(symbols, s)
+	}
+	return symbols
+}
+
+// completionKinds maps the kinds of completions of the editing package to LSP completion kinds.
+var completionKinds = map[string]int{
+	"property":   completionProperty,
+	"define":     completionVariable,
+	"parameter":  completionVariable,
+	"function":   completionFunction,
+	"operator":   completionFunction,
+	"valueset":   completionConstant,
+	"codesystem": completionConstant,
+	"code":       completionConstant,
+	"concept":    completionConstant,
+	"library":    completionModule,
+}
+
+// completionsAt returns the completions at the position of the document. Each completion replaces
+// the partial identifier before the position.
+func completionsAt(ctx context.Context, a *analysis, doc *document, pos position) (*completionList, error) {
+	// The editing package adds the FHIRHelpers of the engine.
+	var sources []string
+	for i, d := range a.docs {
+		if key, ok := editing.LibraryDeclaration(d.text); i > 0 && ok && key.Name == fhirHelpersName {
+			continue
+		}
+		sources = append(sources, d.text)
+	}
+	list, err := editing.Complete(ctx, sources, 0, pos.Line+1, doc.byteColumn(pos))
+	if err != nil {
+		return nil, err
+	}
+	start := position{Line: pos.Line, Character: pos.Character - utf16Len(list.Prefix)}
+	items := make([]completionItem, 0, len(list.Completions))
+	for _, c := range list.Completions {
+		items = append(items, completionItem{
+			Label:    c.Label,
+			Kind:     completionKinds[c.Kind],
+			Detail:   c.Detail,
+			TextEdit: &textEdit{Range: rng{Start: start, End: pos}, NewText: c.Label},
+		})
+	}
+	return &completionList{Items: items}, nil
+}
+
+// formatDocument returns the edits that format the document, which replace the whole text if it
+// is not already formatted.
+func formatDocument(doc *document) ([]textEdit, error) {
+	formatted, err := formatter.Format(doc.text)
+	if err != nil {
+		return nil, err
+	}
+	if formatted == doc.text {
+		return []textEdit{}, nil
+	}
+	return []textEdit{{Range: rng{End: doc.end()}, NewText: formatted}}, nil
+}
+
+// describeDeclaration returns the CQL declaring d with its types, or an empty string.
+func describeDeclaration(a *analysis, lib *model.Library, d declaration) string {
+	switch d.kind {
+	case kindLibrary:
+		return libraryStatement(lib.Identifier)
+	case kindInclude:
+		if target := a.includedLibrary(lib, d.local); target != nil {
+			return libraryStatement(target.Identifier)
+		}
+		return ""
+	}
+	return describe(lib, d.kind, d.name)
+}
+
+// describe returns the CQL declaring the name of the kind in the library with its types, or an
+// empty string if the library does not declare it. Every overload of a function is returned.
+func describe(lib *model.Library, kind, name string) string {
+	qname := editing.QuoteIdentifier(name)
+	switch kind {
+	case kindParameter:
+		for _, p := range lib.Parameters {
+			if p.Name == name {
+				return fmt.Sprintf("parameter %s %s", qname, editing.TypeName(p.GetResultType()))
+			}
+		}
+	case kindCodeSystem:
+		for _, cs := range lib.CodeSystems {
+			if cs.Name == name {
+				return fmt.Sprintf("codesystem %s: '%s'", qname, cs.ID)
+			}
+		}
+	case kindValueset:
+		for _, vs := range lib.Valuesets {
+			if vs.Name == name {
+				return fmt.Sprintf("valueset %s: '%s'", qname, vs.ID)
+			}
+		}
+	case kindCode:
+		for _, c := range lib.Codes {
+			if c.Name == name {
+				if c.CodeSystem != nil {
+					return fmt.Sprintf("code %s: '%s' from %s", qname, c.Code, editing.QuoteIdentifier(c.CodeSystem.Name))
+				}
+				return fmt.Sprintf("code %s: '%s'", qname, c.Code)
+			}
+		}
+	case kindConcept:
+		for _, c := range lib.Concepts {
+			if c.Name == name {
+				return fmt.Sprintf("concept %s: Concept", qname)
+			}
+		}
+	case kindDefine:
+		if def := expressionDef(lib, name); def != nil {
+			return fmt.Sprintf("define %s: %s", qname, editing.TypeName(def.GetResultType()))
+		}
+	case kindFunction:
+		var overloads []string
+		for _, f := range functionDefs(lib, name) {
+			overloads = append(overloads, fmt.Sprintf("define function %s%s", qname, signature(f)))
+		}
+		return strings.Join(overloads, "\n")
+	}
+	return ""
+}
+
+// libraryStatement returns the library statement of the identifier.
+func libraryStatement(id *model.LibraryIdentifier) string {
+	if id == nil {
+		return ""
+	}
+	s := "library " + editing.QuoteIdentifier(id.Qualified)
+	if id.Version != "" {
+		s += fmt.Sprintf(" version '%s'", id.Version)
+	}
+	return s
+}
+
+// expressionDef returns the expression definition of the name in the library, or nil.
+func expressionDef(lib *model.Library, name string) *model.ExpressionDef {
+	if lib.Statements == nil {
+		return nil
+	}
+	for _, d := range lib.Statements.Defs {
+		if def, ok := d.(*model.ExpressionDef); ok && def.Name == name {
+			return def
+		}
+	}
+	return nil
+}
+
+// functionDefs returns the overloads of the function of the name in the library, in the order they
+// are declared.
+func functionDefs(lib *model.Library, name string) []*model.FunctionDef {
+	if lib.Statements == nil {
+		return nil
+	}
+	var fs []*model.FunctionDef
+	for _, d := range lib.Statements.Defs {
+		if f, ok := d.(*model.FunctionDef); ok && f.Name == name {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+// signature returns the operands and return type of the function, like "(O Observation) returns
+// Boolean".
+func signature(f *model.FunctionDef) string {
+	operands := make([]string, 0, len(f.Operands))
+	for _, o := range f.Operands {
+		operands = append(operands, editing.QuoteIdentifier(o.Name)+" "+editing.TypeName(o.GetResultType()))
+	}
+	return fmt.Sprintf("(%s) returns %s", strings.Join(operands, ", "), editing.TypeName(f.GetResultType()))
+}
+
+// locatorRange returns the range in the document of the expression at the locator.
+func locatorRange(doc *document, loc result.Locator) rng {
+	return rng{
+		Start: doc.positionOfRune(loc.StartLine, loc.StartCol-1),
+		End:   doc.positionOfRune(loc.EndLine, loc.EndCol),
+	}
+}
+
+// cqlMarkdown returns markdown showing the text as a CQL code block.
+func cqlMarkdown(text string) markupContent {
+	return markupContent{Kind: "markdown", Value: "```cql\n" + text + "\n```"}
+}
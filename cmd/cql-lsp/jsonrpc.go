@@ -0,0 +1,165 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC error codes used by the server, from the JSON-RPC and LSP specifications.
+const (
+	codeParseError           = -32700
+	codeInvalidRequest       = -32600
+	codeMethodNotFound       = -32601
+	codeInvalidParams        = -32602
+	codeServerNotInitialized = -32002
+	codeRequestFailed        = -32803
+)
+
+// request is an incoming JSON-RPC request, or a notification if it has no ID.
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// isNotification returns true if the client does not expect a response to the request.
+func (r *request) isNotification() bool {
+	return len(r.ID) == 0
+}
+
+// response is the response to a request. Exactly one of result and error is sent, so the two are
+// marshalled by different types.
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+type errorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *rpcError       `json:"error"`
+}
+
+// notification is a message sent by the server that the client does not respond to.
+type notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// rpcError is a JSON-RPC error, which is sent to the client if returned by a method handler.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// errorf returns an rpcError with the code and a formatted message.
+func errorf(code int, format string, a ...any) *rpcError {
+	return &rpcError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// conn reads and writes JSON-RPC messages framed by the Content-Length header of the base protocol
+// of the LSP.
+type conn struct {
+	in *bufio.Reader
+	// mu guards out, since notifications may be written while a response is being written.
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newConn(in io.Reader, out io.Writer) *conn {
+	return &conn{in: bufio.NewReader(in), out: out}
+}
+
+// read returns the next request or notification. io.EOF is returned once the input is closed.
+func (c *conn) read() (*request, error) {
+	body, err := c.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	req := &request{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, errorf(codeParseError, "invalid JSON-RPC message: %v", err)
+	}
+	return req, nil
+}
+
+// readMessage returns the content of the next message.
+func (c *conn) readMessage() ([]byte, error) {
+	header, err := textproto.NewReader(c.in).ReadMIMEHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(header) == 0 {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("invalid message header: %w", err)
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(header.Get("Content-Length")))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.in, body); err != nil {
+		return nil, fmt.Errorf("failed to read a message of %d bytes: %w", length, err)
+	}
+	return body, nil
+}
+
+// write sends a message.
+func (c *conn) write(msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.out, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = c.out.Write(body)
+	return err
+}
+
+// reply sends the response to the request with the ID, which is an error response if err is not
+// nil.
+func (c *conn) reply(id json.RawMessage, result any, err error) error {
+	if err == nil {
+		return c.write(&response{JSONRPC: "2.0", ID: id, Result: result})
+	}
+	var rpcErr *rpcError
+	if !errors.As(err, &rpcErr) {
+		rpcErr = &rpcError{Code: codeRequestFailed, Message: err.Error()}
+	}
+	return c.write(&errorResponse{JSONRPC: "2.0", ID: id, Error: rpcErr})
+}
+
+// notify sends a notification.
+func (c *conn) notify(method string, params any) error {
+	return c.write(&notification{JSONRPC: "2.0", Method: method, Params: params})
+}
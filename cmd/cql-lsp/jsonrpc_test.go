@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestConn_Read(t *testing.T) {
+	in := "Content-Length: 40\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n" +
+		`{"jsonrpc":"2.0","id":1,"method":"test"}` +
+		"Content-Length: 9\r\n\r\n{invalid}" +
+		"Content-Length: 33\r\n\r\n" + `{"jsonrpc":"2.0","method":"note"}`
+	c := newConn(strings.NewReader(in), io.Discard)
+
+	req, err := c.read()
+	if err != nil {
+		t.Fatalf("read() returned an unexpected error: %v", err)
+	}
+	if req.Method != "test" || string(req.ID) != "1" || req.isNotification() {
+		t.Errorf("read() = %+v, want request 1 of method test", req)
+	}
+	var rpcErr *rpcError
+	if _, err := c.read(); !errors.As(err, &rpcErr) || rpcErr.Code != codeParseError {
+		t.Errorf("read() of invalid JSON returned %v, want a parse error", err)
+	}
+	req, err = c.read()
+	if err != nil {
+		t.Fatalf("read() returned an unexpected error: %v", err)
+	}
+	if req.Method != "note" || !req.isNotification() {
+		t.Errorf("read() = %+v, want notification note", req)
+	}
+	if _, err := c.read(); err != io.EOF {
+		t.Errorf("read() at the end returned %v, want io.EOF", err)
+	}
+}
+
+func TestConn_ReadInvalidHeader(t *testing.T) {
+	c := newConn(strings.NewReader("Content-Length: many\r\n\r\n{}"), io.Discard)
+	if _, err := c.read(); err == nil || err == io.EOF {
+		t.Errorf("read() with an invalid Content-Length returned %v, want an error", err)
+	}
+}
+
+func TestConn_Reply(t *testing.T) {
+	tests := []struct {
+		name   string
+		result any
+		err    error
+		want   string
+	}{
+		{
+			name: "Null result",
+			want: `{"jsonrpc":"2.0","id":7,"result":null}`,
+		},
+		{
+			name:   "Result",
+			result: []int{1},
+			want:   `{"jsonrpc":"2.0","id":7,"result":[1]}`,
+		},
+		{
+			name: "RPC error",
+			err:  errorf(codeInvalidParams, "bad %s", "params"),
+			want: `{"jsonrpc":"2.0","id":7,"error":{"code":-32602,"message":"bad params"}}`,
+		},
+		{
+			name: "Other error",
+			err:  errors.New("failed"),
+			want: `{"jsonrpc":"2.0","id":7,"error":{"code":-32803,"message":"failed"}}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := newConn(strings.NewReader(""), &out).reply(json.RawMessage("7"), tc.result, tc.err); err != nil {
+				t.Fatalf("reply() returned an unexpected error: %v", err)
+			}
+			want := "Content-Length: " + itoa(len(tc.want)) + "\r\n\r\n" + tc.want
+			if out.String() != want {
+				t.Errorf("reply() wrote %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func itoa(n int) string {
+	b, _ := json.Marshal(n)
+	return string(b)
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cql-lsp is a Language Server Protocol server for CQL, built on the parser of the engine. It
+// offers diagnostics, hover with the inferred types of expressions, go-to-definition across included
+// libraries, document symbols, completion and formatting to editors like VS Code. The server speaks
+// JSON-RPC over stdin and stdout.
+package main
+
+import (
+	"context"
+	"os"
+
+	"flag"
+	log "github.com/golang/glog"
+)
+
+func main() {
+	// stdout carries the protocol, so logs must only go to stderr, which editors show in their output
+	// panels.
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+	if err := newServer(os.Stdin, os.Stdout).run(context.Background()); err != nil {
+		log.Exitf("cql-lsp failed with an error: %v", err)
+	}
+}
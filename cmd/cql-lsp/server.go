@@ -0,0 +1,319 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// server is a CQL language server. Messages are handled one at a time in the order they are
+// received, so that edits are always applied before the requests that follow them.
+type server struct {
+	conn *conn
+	// roots are the directories of the workspace folders, which are searched for included libraries.
+	roots        []string
+	initialized  bool
+	shuttingDown bool
+	// open holds the documents open in the editor, keyed by URI.
+	open map[string]*document
+	// analyses caches the analysis of open documents, keyed by URI. Since documents include each
+	// other, the cache is cleared whenever any document changes.
+	analyses map[string]*analysis
+}
+
+func newServer(in io.Reader, out io.Writer) *server {
+	return &server{
+		conn:     newConn(in, out),
+		open:     map[string]*document{},
+		analyses: map[string]*analysis{},
+	}
+}
+
+// errExitWithoutShutdown is returned by run if the client asks the server to exit without first
+// asking it to shut down, in which case the server should exit with an error code.
+var errExitWithoutShutdown = errors.New("exit notification received before a shutdown request")
+
+// run serves the messages of the client until the client asks the server to exit, or closes the
+// connection.
+func (s *server) run(ctx context.Context) error {
+	for {
+		req, err := s.conn.read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var rpcErr *rpcError
+		if errors.As(err, &rpcErr) {
+			// The message was framed correctly, so the connection can carry on.
+			if err := s.conn.reply(json.RawMessage("null"), nil, rpcErr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if req.Method == "exit" {
+			if !s.shuttingDown {
+				return errExitWithoutShutdown
+			}
+			return nil
+		}
+		result, err := s.handle(ctx, req)
+		if req.isNotification() {
+			if err != nil {
+				log.Warningf("failed to handle %s: %v", req.Method, err)
+			}
+			continue
+		}
+		if err := s.conn.reply(req.ID, result, err); err != nil {
+			return err
+		}
+	}
+}
+
+// handle dispatches the request to the handler of its method.
+func (s *server) handle(ctx context.Context, req *request) (any, error) {
+	if req.Method == "initialize" {
+		return s.initialize(req.Params)
+	}
+	if !s.initialized {
+		return nil, errorf(codeServerNotInitialized, "%s received before initialize", req.Method)
+	}
+	if s.shuttingDown {
+		return nil, errorf(codeInvalidRequest, "%s received after shutdown", req.Method)
+	}
+
+	switch req.Method {
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shuttingDown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		params := &didOpenTextDocumentParams{}
+		if err := unmarshalParams(req.Params, params); err != nil {
+			return nil, err
+		}
+		s.setDocument(newDocument(params.TextDocument.URI, params.TextDocument.Text))
+		return nil, s.publishDiagnostics(ctx, params.TextDocument.URI)
+	case "textDocument/didChange":
+		params := &didChangeTextDocumentParams{}
+		if err := unmarshalParams(req.Params, params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		// With full document sync the last change holds the whole text.
+		text := params.ContentChanges[len(params.ContentChanges)-1].Text
+		s.setDocument(newDocument(params.TextDocument.URI, text))
+		return nil, s.publishDiagnostics(ctx, params.TextDocument.URI)
+	case "textDocument/didSave":
+		// Saving a library may fix or break the documents that include it.
+		s.analyses = map[string]*analysis{}
+		for uri := range s.open {
+			if err := s.publishDiagnostics(ctx, uri); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		params := &didCloseTextDocumentParams{}
+		if err := unmarshalParams(req.Params, params); err != nil {
+			return nil, err
+		}
+		delete(s.open, params.TextDocument.URI)
+		s.analyses = map[string]*analysis{}
+		return nil, s.conn.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []diagnostic{}})
+	case "textDocument/hover":
+		return withPosition(ctx, s, req.Params, func(a *analysis, doc *document, pos position) (any, error) {
+			return hoverAt(a, doc, pos), nil
+		})
+	case "textDocument/definition":
+		return withPosition(ctx, s, req.Params, func(a *analysis, doc *document, pos position) (any, error) {
+			return definitionAt(a, doc, pos), nil
+		})
+	case "textDocument/completion":
+		return withPosition(ctx, s, req.Params, func(a *analysis, doc *document, pos position) (any, error) {
+			return completionsAt(ctx, a, doc, pos)
+		})
+	case "textDocument/documentSymbol":
+		params := &documentSymbolParams{}
+		if err := unmarshalParams(req.Params, params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		return documentSymbols(s.analysis(ctx, doc), doc), nil
+	case "textDocument/formatting":
+		params := &documentFormattingParams{}
+		if err := unmarshalParams(req.Params, params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		return formatDocument(doc)
+	}
+	if req.isNotification() {
+		// Notifications the server does not handle, like $/cancelRequest, may be ignored.
+		return nil, nil
+	}
+	return nil, errorf(codeMethodNotFound, "method %s is not supported", req.Method)
+}
+
+// initialize records the workspace folders and responds with the capabilities of the server.
+func (s *server) initialize(raw json.RawMessage) (any, error) {
+	if s.initialized {
+		return nil, errorf(codeInvalidRequest, "initialize received twice")
+	}
+	params := &initializeParams{}
+	if err := unmarshalParams(raw, params); err != nil {
+		return nil, err
+	}
+	uris := []string{params.RootURI}
+	if len(params.WorkspaceFolders) > 0 {
+		uris = nil
+		for _, f := range params.WorkspaceFolders {
+			uris = append(uris, f.URI)
+		}
+	}
+	for _, uri := range uris {
+		if uri == "" {
+			continue
+		}
+		path, err := uriToPath(uri)
+		if err != nil {
+			log.Warningf("ignoring workspace folder: %v", err)
+			continue
+		}
+		s.roots = append(s.roots, path)
+	}
+	s.initialized = true
+
+	return &initializeResult{
+		Capabilities: serverCapabilities{
+			TextDocumentSync:           textDocumentSyncOptions{OpenClose: true, Change: syncFull, Save: true},
+			HoverProvider:              true,
+			DefinitionProvider:         true,
+			DocumentSymbolProvider:     true,
+			CompletionProvider:         completionOptions{TriggerCharacters: []string{"."}},
+			DocumentFormattingProvider: true,
+		},
+		ServerInfo: serverInfo{Name: "cql-lsp"},
+	}, nil
+}
+
+// withPosition decodes the text document and position of the params, and calls f with the
+// analysis of the document.
+func withPosition(ctx context.Context, s *server, raw json.RawMessage, f func(*analysis, *document, position) (any, error)) (any, error) {
+	params := &textDocumentPositionParams{}
+	if err := unmarshalParams(raw, params); err != nil {
+		return nil, err
+	}
+	doc, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	return f(s.analysis(ctx, doc), doc, params.Position)
+}
+
+func unmarshalParams(raw json.RawMessage, v any) error {
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errorf(codeInvalidParams, "invalid params: %v", err)
+	}
+	return nil
+}
+
+// setDocument records the new text of an open document.
+func (s *server) setDocument(doc *document) {
+	s.open[doc.uri] = doc
+	s.analyses = map[string]*analysis{}
+}
+
+// document returns the open document of the URI.
+func (s *server) document(uri string) (*document, error) {
+	doc, ok := s.open[uri]
+	if !ok {
+		return nil, errorf(codeInvalidParams, "document %s is not open", uri)
+	}
+	return doc, nil
+}
+
+// analysis returns the analysis of the open document.
+func (s *server) analysis(ctx context.Context, doc *document) *analysis {
+	if a, ok := s.analyses[doc.uri]; ok {
+		return a
+	}
+	a := analyze(ctx, doc, s.workspace())
+	s.analyses[doc.uri] = a
+	return a
+}
+
+// publishDiagnostics sends the diagnostics of the open document to the client.
+func (s *server) publishDiagnostics(ctx context.Context, uri string) error {
+	doc, err := s.document(uri)
+	if err != nil {
+		return err
+	}
+	return s.conn.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{URI: uri, Diagnostics: diagnosticsOf(s.analysis(ctx, doc), doc)})
+}
+
+// workspace returns the CQL libraries of the workspace keyed by URI, which are the .cql files in
+// the workspace folders and the open documents. Open documents take the place of their files, since
+// they may have unsaved edits.
+func (s *server) workspace() map[string]*document {
+	docs := map[string]*document{}
+	for _, root := range s.roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if d.IsDir() || filepath.Ext(path) != ".cql" {
+				return nil
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			uri := pathToURI(path)
+			docs[uri] = newDocument(uri, string(b))
+			return nil
+		})
+		if err != nil {
+			log.Warningf("failed to read the CQL libraries of %s: %v", root, err)
+		}
+	}
+	for uri, doc := range s.open {
+		docs[uri] = doc
+	}
+	return docs
+}
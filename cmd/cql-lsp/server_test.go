@@ -0,0 +1,482 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testClient drives a server through its stdin and stdout, like an editor would.
+type testClient struct {
+	t      *testing.T
+	conn   *conn
+	nextID int
+	// messages receives the messages sent by the server.
+	messages chan map[string]json.RawMessage
+	// done receives the error returned by the run of the server.
+	done chan error
+}
+
+// newTestClient starts a server and initializes it with the workspace folder root, which may be
+// empty.
+func newTestClient(t *testing.T, root string) *testClient {
+	t.Helper()
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	c := &testClient{
+		t:        t,
+		conn:     newConn(clientIn, clientOut),
+		messages: make(chan map[string]json.RawMessage, 100),
+		done:     make(chan error, 1),
+	}
+	go func() {
+		err := newServer(serverIn, serverOut).run(context.Background())
+		serverOut.Close()
+		c.done <- err
+	}()
+	go func() {
+		for {
+			body, err := c.conn.readMessage()
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			msg := map[string]json.RawMessage{}
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Errorf("server sent invalid JSON %q: %v", body, err)
+			}
+			c.messages <- msg
+		}
+	}()
+	t.Cleanup(func() { clientOut.Close() })
+
+	rootURI := ""
+	if root != "" {
+		rootURI = pathToURI(root)
+	}
+	c.request("initialize", map[string]any{"rootUri": rootURI}, nil)
+	c.notify("initialized", map[string]any{})
+	return c
+}
+
+// notify sends a notification to the server.
+func (c *testClient) notify(method string, params any) {
+	c.t.Helper()
+	if err := c.conn.notify(method, params); err != nil {
+		c.t.Fatalf("failed to send %s: %v", method, err)
+	}
+}
+
+// request sends a request to the server and decodes the result of the response into result. The
+// error of the response is returned.
+func (c *testClient) request(method string, params any, result any) *rpcError {
+	c.t.Helper()
+	c.nextID++
+	id, err := json.Marshal(c.nextID)
+	if err != nil {
+		c.t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	if err := c.conn.write(&request{JSONRPC: "2.0", ID: id, Method: method, Params: mustMarshal(c.t, params)}); err != nil {
+		c.t.Fatalf("failed to send %s: %v", method, err)
+	}
+	msg := c.next(func(msg map[string]json.RawMessage) bool { return string(msg["id"]) == string(id) })
+	if raw, ok := msg["error"]; ok {
+		rpcErr := &rpcError{}
+		if err := json.Unmarshal(raw, rpcErr); err != nil {
+			c.t.Fatalf("invalid error %s: %v", raw, err)
+		}
+		return rpcErr
+	}
+	if result != nil {
+		if err := json.Unmarshal(msg["result"], result); err != nil {
+			c.t.Fatalf("invalid result %s of %s: %v", msg["result"], method, err)
+		}
+	}
+	return nil
+}
+
+// diagnostics returns the next diagnostics published for the URI.
+func (c *testClient) diagnostics(uri string) []diagnostic {
+	c.t.Helper()
+	msg := c.next(func(msg map[string]json.RawMessage) bool {
+		return string(msg["method"]) == `"textDocument/publishDiagnostics"` && strings.Contains(string(msg["params"]), `"uri":"`+uri+`"`)
+	})
+	params := &publishDiagnosticsParams{}
+	if err := json.Unmarshal(msg["params"], params); err != nil {
+		c.t.Fatalf("invalid diagnostics %s: %v", msg["params"], err)
+	}
+	return params.Diagnostics
+}
+
+// next returns the next message sent by the server that matches, skipping the others.
+func (c *testClient) next(match func(map[string]json.RawMessage) bool) map[string]json.RawMessage {
+	c.t.Helper()
+	timeout := time.After(time.Minute)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatal("the server closed the connection")
+			}
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			c.t.Fatal("timed out waiting for a message from the server")
+		}
+	}
+}
+
+// open opens a document and returns its diagnostics.
+func (c *testClient) open(uri, text string) []diagnostic {
+	c.t.Helper()
+	c.notify("textDocument/didOpen", &didOpenTextDocumentParams{TextDocument: textDocumentItem{URI: uri, LanguageID: "cql", Version: 1, Text: text}})
+	return c.diagnostics(uri)
+}
+
+func mustMarshal(t *testing.T, v any) json.RawMessage {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	return b
+}
+
+func positionParams(uri string, line, character int) *textDocumentPositionParams {
+	return &textDocumentPositionParams{TextDocument: textDocumentIdentifier{URI: uri}, Position: position{Line: line, Character: character}}
+}
+
+func TestServer_Lifecycle(t *testing.T) {
+	c := newTestClient(t, "")
+	if err := c.request("textDocument/unknown", map[string]any{}, nil); err == nil || err.Code != codeMethodNotFound {
+		t.Errorf("unknown method returned error %v, want code %d", err, codeMethodNotFound)
+	}
+	if err := c.request("textDocument/hover", positionParams("file:///closed.cql", 0, 0), nil); err == nil || err.Code != codeInvalidParams {
+		t.Errorf("hover of a closed document returned error %v, want code %d", err, codeInvalidParams)
+	}
+	if err := c.request("shutdown", nil, nil); err != nil {
+		t.Fatalf("shutdown returned an unexpected error: %v", err)
+	}
+	if err := c.request("textDocument/hover", positionParams("file:///closed.cql", 0, 0), nil); err == nil || err.Code != codeInvalidRequest {
+		t.Errorf("request after shutdown returned error %v, want code %d", err, codeInvalidRequest)
+	}
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		t.Errorf("run() returned an unexpected error: %v", err)
+	}
+}
+
+func TestServer_Initialize(t *testing.T) {
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- newServer(serverIn, serverOut).run(context.Background()) }()
+	c := newConn(clientIn, clientOut)
+
+	for _, tc := range []struct {
+		method   string
+		wantBody string
+	}{
+		{method: "textDocument/hover", wantBody: `"code":-32002`},
+		{method: "initialize", wantBody: `"documentFormattingProvider":true`},
+	} {
+		if err := c.write(&request{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: tc.method, Params: json.RawMessage("{}")}); err != nil {
+			t.Fatalf("write() returned an unexpected error: %v", err)
+		}
+		body, err := c.readMessage()
+		if err != nil {
+			t.Fatalf("readMessage() returned an unexpected error: %v", err)
+		}
+		if !strings.Contains(string(body), tc.wantBody) {
+			t.Errorf("%s returned %s, want it to contain %s", tc.method, body, tc.wantBody)
+		}
+	}
+
+	if err := c.notify("exit", nil); err != nil {
+		t.Fatalf("notify() returned an unexpected error: %v", err)
+	}
+	if err := <-done; err != errExitWithoutShutdown {
+		t.Errorf("run() returned %v, want %v", err, errExitWithoutShutdown)
+	}
+}
+
+func TestServer_Diagnostics(t *testing.T) {
+	c := newTestClient(t, "")
+	uri := "file:///work/Main.cql"
+	got := c.open(uri, "library Main version '1'\ndefine X: 1 +\ndefine Y: 2")
+	if len(got) == 0 {
+		t.Fatalf("diagnostics of invalid CQL are empty, want errors")
+	}
+	if got[0].Severity != severityError || got[0].Range.Start.Line != 2 {
+		t.Errorf("diagnostics = %+v, want an error on line 2", got)
+	}
+
+	c.notify("textDocument/didChange", &didChangeTextDocumentParams{
+		TextDocument:   textDocumentIdentifier{URI: uri},
+		ContentChanges: []textDocumentContentChangeEvent{{Text: "library Main version '1'\ndefine X: 1 + 1\ndefine Y: 2"}},
+	})
+	if got := c.diagnostics(uri); len(got) != 0 {
+		t.Errorf("diagnostics after the fix = %+v, want none", got)
+	}
+
+	c.notify("textDocument/didClose", &didCloseTextDocumentParams{TextDocument: textDocumentIdentifier{URI: uri}})
+	if got := c.diagnostics(uri); len(got) != 0 {
+		t.Errorf("diagnostics after close = %+v, want none", got)
+	}
+}
+
+func TestServer_DiagnosticsOfIncludedLibrary(t *testing.T) {
+	c := newTestClient(t, "")
+	c.open("file:///work/Helpers.cql", "library Helpers version '1'\ndefine One: 1 +")
+	got := c.open("file:///work/Main.cql", "library Main version '1'\ninclude Helpers version '1' called H\ndefine X: H.One")
+	want := []diagnostic{{
+		Range:    rng{Start: position{Line: 1, Character: 8}, End: position{Line: 1, Character: 15}},
+		Severity: severityError,
+		Source:   diagnosticSource,
+	}}
+	if diff := cmp.Diff(want, got, cmp.FilterPath(func(p cmp.Path) bool { return p.Last().String() == ".Message" }, cmp.Ignore())); diff != "" {
+		t.Errorf("diagnostics returned a diff (-want +got):\n%s", diff)
+	}
+	if len(got) == 1 && !strings.Contains(got[0].Message, "Helpers") {
+		t.Errorf("diagnostic message %q, want it to name the included library", got[0].Message)
+	}
+}
+
+// writeWorkspace writes the files to a new directory and returns it.
+func writeWorkspace(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("os.MkdirAll() returned an unexpected error: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatalf("os.WriteFile() returned an unexpected error: %v", err)
+		}
+	}
+	return dir
+}
+
+const helpersCQL = `library Helpers version '1.0'
+
+// The number one.
+define One: 1
+
+define function Double(x Integer): x * 2
+`
+
+const mainCQL = `library Main version '1'
+using FHIR version '4.0.1'
+include Helpers version '1.0' called H
+valueset "Glucose": 'https://example.com/vs/glucose'
+parameter Threshold Integer default 3
+context Patient
+define Two: H.Double(H.One)
+define "Glucose Readings": [Observation: "Glucose"] O where O.status = 'final'
+define Big: Two > Threshold
+`
+
+func TestServer_Hover(t *testing.T) {
+	root := writeWorkspace(t, map[string]string{"lib/Helpers.cql": helpersCQL})
+	c := newTestClient(t, root)
+	uri := pathToURI(filepath.Join(root, "Main.cql"))
+	if got := c.open(uri, mainCQL); len(got) != 0 {
+		t.Fatalf("diagnostics = %+v, want none", got)
+	}
+
+	tests := []struct {
+		name      string
+		line      int
+		character int
+		want      string
+	}{
+		{name: "Function of an included library", line: 6, character: 14, want: "define function Double(x System.Integer) returns System.Integer"},
+		{name: "Definition of an included library", line: 6, character: 24, want: "define One: System.Integer"},
+		{name: "Local definition", line: 8, character: 12, want: "define Two: System.Integer"},
+		{name: "Parameter", line: 8, character: 20, want: "parameter Threshold System.Integer"},
+		{name: "Valueset", line: 7, character: 42, want: "valueset Glucose: 'https://example.com/vs/glucose'"},
+		{name: "Query alias", line: 7, character: 60, want: "alias O: FHIR.Observation"},
+		{name: "Inferred type of an expression", line: 7, character: 30, want: "List<FHIR.Observation>"},
+		{name: "Declared name", line: 8, character: 8, want: "define Big: System.Boolean"},
+		{name: "Include", line: 2, character: 10, want: "library Helpers version '1.0'"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *hover
+			if err := c.request("textDocument/hover", positionParams(uri, tc.line, tc.character), &got); err != nil {
+				t.Fatalf("hover returned an unexpected error: %v", err)
+			}
+			want := "```cql\n" + tc.want + "\n```"
+			if got == nil || got.Contents.Value != want {
+				t.Errorf("hover = %+v, want %q", got, want)
+			}
+		})
+	}
+
+	var got *hover
+	if err := c.request("textDocument/hover", positionParams(uri, 5, 0), &got); err != nil {
+		t.Fatalf("hover returned an unexpected error: %v", err)
+	}
+	if got != nil {
+		t.Errorf("hover of a context statement = %+v, want nil", got)
+	}
+}
+
+func TestServer_Definition(t *testing.T) {
+	root := writeWorkspace(t, map[string]string{"lib/Helpers.cql": helpersCQL})
+	c := newTestClient(t, root)
+	uri := pathToURI(filepath.Join(root, "Main.cql"))
+	helpersURI := pathToURI(filepath.Join(root, "lib", "Helpers.cql"))
+	c.open(uri, mainCQL)
+
+	tests := []struct {
+		name      string
+		line      int
+		character int
+		want      []location
+	}{
+		{
+			name: "Function in an included library",
+			line: 6, character: 14,
+			want: []location{{URI: helpersURI, Range: rng{Start: position{Line: 5, Character: 16}, End: position{Line: 5, Character: 22}}}},
+		},
+		{
+			name: "Definition in an included library",
+			line: 6, character: 24,
+			want: []location{{URI: helpersURI, Range: rng{Start: position{Line: 3, Character: 7}, End: position{Line: 3, Character: 10}}}},
+		},
+		{
+			name: "Local quoted definition",
+			line: 7, character: 42,
+			want: []location{{URI: uri, Range: rng{Start: position{Line: 3, Character: 9}, End: position{Line: 3, Character: 18}}}},
+		},
+		{
+			name: "Include",
+			line: 2, character: 10,
+			want: []location{{URI: helpersURI, Range: rng{Start: position{Line: 0, Character: 8}, End: position{Line: 0, Character: 15}}}},
+		},
+		{
+			name: "Literal",
+			line: 4, character: 37,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []location
+			if err := c.request("textDocument/definition", positionParams(uri, tc.line, tc.character), &got); err != nil {
+				t.Fatalf("definition returned an unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("definition returned a diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServer_DocumentSymbols(t *testing.T) {
+	root := writeWorkspace(t, map[string]string{"lib/Helpers.cql": helpersCQL})
+	c := newTestClient(t, root)
+	uri := pathToURI(filepath.Join(root, "lib", "Helpers.cql"))
+	c.open(uri, helpersCQL)
+
+	var got []documentSymbol
+	if err := c.request("textDocument/documentSymbol", &documentSymbolParams{TextDocument: textDocumentIdentifier{URI: uri}}, &got); err != nil {
+		t.Fatalf("documentSymbol returned an unexpected error: %v", err)
+	}
+	want := []documentSymbol{
+		{
+			Name:           "Helpers",
+			Kind:           symbolModule,
+			Range:          rng{End: position{Line: 0, Character: 29}},
+			SelectionRange: rng{Start: position{Line: 0, Character: 8}, End: position{Line: 0, Character: 15}},
+		},
+		{
+			Name:           "One",
+			Detail:         "System.Integer",
+			Kind:           symbolVariable,
+			Range:          rng{Start: position{Line: 3}, End: position{Line: 3, Character: 13}},
+			SelectionRange: rng{Start: position{Line: 3, Character: 7}, End: position{Line: 3, Character: 10}},
+		},
+		{
+			Name:           "Double",
+			Detail:         "(x System.Integer) returns System.Integer",
+			Kind:           symbolFunction,
+			Range:          rng{Start: position{Line: 5}, End: position{Line: 5, Character: 40}},
+			SelectionRange: rng{Start: position{Line: 5, Character: 16}, End: position{Line: 5, Character: 22}},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("documentSymbol returned a diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestServer_Completion(t *testing.T) {
+	root := writeWorkspace(t, map[string]string{"lib/Helpers.cql": helpersCQL})
+	c := newTestClient(t, root)
+	uri := pathToURI(filepath.Join(root, "Main.cql"))
+	c.open(uri, mainCQL+"define Three: H.Do")
+
+	var got completionList
+	if err := c.request("textDocument/completion", positionParams(uri, 9, 18), &got); err != nil {
+		t.Fatalf("completion returned an unexpected error: %v", err)
+	}
+	want := []completionItem{{
+		Label:    "Double",
+		Kind:     completionFunction,
+		Detail:   "(x System.Integer) returns System.Integer",
+		TextEdit: &textEdit{Range: rng{Start: position{Line: 9, Character: 16}, End: position{Line: 9, Character: 18}}, NewText: "Double"},
+	}}
+	if diff := cmp.Diff(want, got.Items); diff != "" {
+		t.Errorf("completion returned a diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestServer_Formatting(t *testing.T) {
+	c := newTestClient(t, "")
+	uri := "file:///work/Main.cql"
+	c.open(uri, "library Main version '1'   \ndefine X: 1\ndefine Y: 2")
+
+	var got []textEdit
+	if err := c.request("textDocument/formatting", &documentFormattingParams{TextDocument: textDocumentIdentifier{URI: uri}}, &got); err != nil {
+		t.Fatalf("formatting returned an unexpected error: %v", err)
+	}
+	want := []textEdit{{
+		Range:   rng{End: position{Line: 2, Character: 11}},
+		NewText: "library Main version '1'\n\ndefine X: 1\n\ndefine Y: 2\n",
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("formatting returned a diff (-want +got):\n%s", diff)
+	}
+
+	c.notify("textDocument/didChange", &didChangeTextDocumentParams{
+		TextDocument:   textDocumentIdentifier{URI: uri},
+		ContentChanges: []textDocumentContentChangeEvent{{Text: "define X: 'unterminated"}},
+	})
+	c.diagnostics(uri)
+	if err := c.request("textDocument/formatting", &documentFormattingParams{TextDocument: textDocumentIdentifier{URI: uri}}, nil); err == nil || err.Code != codeRequestFailed {
+		t.Errorf("formatting CQL that does not tokenize returned error %v, want code %d", err, codeRequestFailed)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/fhirserver"
+	"github.com/google/cql/retriever/local"
+	"github.com/google/cql/terminology"
+)
+
+// endpoint is a FHIR Endpoint resource, passed as the dataEndpoint or terminologyEndpoint
+// parameter of an operation.
+type endpoint struct {
+	ResourceType string   `json:"resourceType"`
+	Address      string   `json:"address"`
+	Header       []string `json:"header"`
+}
+
+// endpointParameter returns the Endpoint resource of the parameter with the given name, or nil if
+// there is no such parameter. The address of the endpoint must be allowed by --allowed_endpoints.
+func (s *server) endpointParameter(params *parameters, name string) (*endpoint, error) {
+	p, err := params.single(name)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	if p.Resource == nil {
+		return nil, fmt.Errorf("parameter %s must be an Endpoint resource", name)
+	}
+	var ep endpoint
+	if err := json.Unmarshal(p.Resource, &ep); err != nil {
+		return nil, fmt.Errorf("parameter %s: %w", name, err)
+	}
+	if ep.ResourceType != "Endpoint" {
+		return nil, fmt.Errorf("parameter %s must be an Endpoint resource, got resourceType %q", name, ep.ResourceType)
+	}
+	u, err := url.Parse(ep.Address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("parameter %s must have an http or https address, got %q", name, ep.Address)
+	}
+	if !s.endpointAllowed(ep.Address) {
+		return nil, fmt.Errorf("the %s %s is not allowed by this server", name, ep.Address)
+	}
+	for _, h := range ep.Header {
+		if k, _, ok := strings.Cut(h, ":"); !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("parameter %s has an invalid header %q, want Name: value", name, h)
+		}
+	}
+	return &ep, nil
+}
+
+// endpointAllowed returns true if the address is under one of the allowed endpoint prefixes. The
+// scheme and host of the address must equal those of the prefix, and the path of the prefix must
+// be a prefix of the path segments of the address, so that https://fhir.example.org does not allow
+// https://fhir.example.org.evil.com or https://fhir.example.org@evil.com.
+func (s *server) endpointAllowed(address string) bool {
+	u, err := url.Parse(address)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range s.cfg.AllowedEndpoints {
+		if prefix == "*" {
+			return true
+		}
+		p, err := url.Parse(prefix)
+		if err != nil || !strings.EqualFold(u.Scheme, p.Scheme) || !strings.EqualFold(u.Host, p.Host) {
+			continue
+		}
+		dir := strings.TrimSuffix(p.Path, "/")
+		if u.Path == dir || strings.HasPrefix(u.Path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// client returns an HTTP client that sends the headers of the endpoint with every request to the
+// host of the endpoint. Redirects are only followed to allowed endpoints.
+func (s *server) client(ep *endpoint) *http.Client {
+	header := make(http.Header)
+	for _, h := range ep.Header {
+		k, v, _ := strings.Cut(h, ":")
+		header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	c := *s.cfg.EndpointClient
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// The address was validated by endpointParameter.
+	u, _ := url.Parse(ep.Address)
+	c.Transport = headerTransport{header: header, host: u.Host, base: base}
+	checkRedirect := c.CheckRedirect
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !s.endpointAllowed(req.URL.String()) {
+			return fmt.Errorf("the redirect to %s is not allowed by this server", req.URL.Redacted())
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &c
+}
+
+// headerTransport adds headers to every request to host. Requests redirected to other hosts are
+// sent without them, since they may hold credentials.
+type headerTransport struct {
+	header http.Header
+	host   string
+	base   http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Host, t.host) {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for k, vs := range t.header {
+		req.Header[k] = vs
+	}
+	return t.base.RoundTrip(req)
+}
+
+// retriever returns the retriever for the data of the operation. The data parameter is a Bundle of
+// the subject's resources, while the dataEndpoint parameter is a FHIR server from which the
+// resources of the subject are fetched as the CQL retrieves them. If neither is given the retriever
+// is nil, and CQL that retrieves data fails to evaluate.
+func (s *server) retriever(params *parameters, subject string) (retriever.Retriever, error) {
+	data, err := params.single("data")
+	if err != nil {
+		return nil, err
+	}
+	ep, err := s.endpointParameter(params, "dataEndpoint")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case data != nil && ep != nil:
+		return nil, fmt.Errorf("only one of the data and dataEndpoint parameters may be given")
+	case data != nil:
+		if data.Resource == nil {
+			return nil, fmt.Errorf("parameter data must be a Bundle resource")
+		}
+		var b struct {
+			ResourceType string `json:"resourceType"`
+		}
+		if err := json.Unmarshal(data.Resource, &b); err != nil || b.ResourceType != "Bundle" {
+			return nil, fmt.Errorf("parameter data must be a Bundle resource")
+		}
+		ret, err := local.NewRetrieverFromR4Bundle(data.Resource)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the data Bundle: %w", err)
+		}
+		return ret, nil
+	case ep != nil:
+		id, err := patientID(subject)
+		if err != nil {
+			return nil, err
+		}
+		ret, err := fhirserver.New(fhirserver.Config{BaseURL: ep.Address, Client: s.client(ep)}, id)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	return nil, nil
+}
+
+// patientID returns the id of the Patient subject of an operation, given as Patient/{id} or {id}.
+func patientID(subject string) (string, error) {
+	if subject == "" {
+		return "", fmt.Errorf("the subject parameter is required with a dataEndpoint")
+	}
+	typ, id, ok := strings.Cut(subject, "/")
+	if !ok {
+		return subject, nil
+	}
+	if typ != "Patient" || id == "" || strings.Contains(id, "/") {
+		return "", fmt.Errorf("the subject must be a Patient, as Patient/{id}, got %q", subject)
+	}
+	return id, nil
+}
+
+// terminology returns the terminology provider for the operation. If the terminologyEndpoint
+// parameter is given, the ValueSets the CQL declares are expanded by the endpoint, otherwise the
+// ValueSets of --valueset_dir are used.
+func (s *server) terminology(ctx context.Context, params *parameters, valueSets []result.ValueSet) (terminology.Provider, error) {
+	ep, err := s.endpointParameter(params, "terminologyEndpoint")
+	if err != nil {
+		return nil, err
+	}
+	if ep == nil {
+		if s.terminologyProvider == nil {
+			return nil, nil
+		}
+		return s.terminologyProvider, nil
+	}
+	cfg := terminology.ExpandConfig{BaseURL: ep.Address, HTTPClient: s.client(ep), MaxResponseBytes: maxEndpointResponseBytes}
+	jsons := make([]string, 0, len(valueSets))
+	for _, vs := range valueSets {
+		b, err := terminology.FetchExpandedValueSet(ctx, cfg, vs.ID, vs.Version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand with the terminologyEndpoint: %w", err)
+		}
+		jsons = append(jsons, string(b))
+	}
+	return terminology.NewInMemoryFHIRProvider(jsons)
+}
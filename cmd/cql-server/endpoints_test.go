@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEndpointAllowed(t *testing.T) {
+	s := &server{cfg: config{AllowedEndpoints: []string{"https://fhir.example.org", "https://tx.example.org/fhir/"}}}
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{address: "https://fhir.example.org", want: true},
+		{address: "https://fhir.example.org/Patient/1", want: true},
+		{address: "https://FHIR.example.org/", want: true},
+		{address: "https://tx.example.org/fhir", want: true},
+		{address: "https://tx.example.org/fhir/ValueSet", want: true},
+		{address: "http://fhir.example.org", want: false},
+		{address: "https://fhir.example.org.evil.com/", want: false},
+		{address: "https://fhir.example.org@evil.com/", want: false},
+		{address: "https://fhir.example.org:8443/", want: false},
+		{address: "https://tx.example.org/fhir-admin", want: false},
+		{address: "https://tx.example.org/", want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.address, func(t *testing.T) {
+			if got := s.endpointAllowed(tc.address); got != tc.want {
+				t.Errorf("endpointAllowed(%q) = %v, want %v", tc.address, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClient_Redirect(t *testing.T) {
+	var gotAuth []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotAuth = append(gotAuth, req.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"resourceType": "Patient", "id": "1"}`)
+	}))
+	defer other.Close()
+	fhir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, other.URL+req.URL.Path, http.StatusFound)
+	}))
+	defer fhir.Close()
+	ep := &endpoint{Address: fhir.URL, Header: []string{"Authorization: Bearer secret"}}
+
+	t.Run("Not allowed", func(t *testing.T) {
+		gotAuth = nil
+		s := &server{cfg: config{AllowedEndpoints: []string{fhir.URL}, EndpointClient: &http.Client{}}}
+		_, err := s.client(ep).Get(fhir.URL + "/Patient/1")
+		if err == nil || !strings.Contains(err.Error(), "is not allowed by this server") {
+			t.Errorf("Get() returned error %v, want the redirect to be refused", err)
+		}
+		if len(gotAuth) != 0 {
+			t.Errorf("the redirect target got %d requests, want none", len(gotAuth))
+		}
+	})
+	t.Run("Allowed without headers", func(t *testing.T) {
+		gotAuth = nil
+		s := &server{cfg: config{AllowedEndpoints: []string{"*"}, EndpointClient: &http.Client{}}}
+		resp, err := s.client(ep).Get(fhir.URL + "/Patient/1")
+		if err != nil {
+			t.Fatalf("Get() returned unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if len(gotAuth) != 1 || gotAuth[0] != "" {
+			t.Errorf("the redirect target got Authorization headers %q, want one request without it", gotAuth)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cql-server is an HTTP server implementing the $cql and Library/$evaluate FHIR operations from
+// Using CQL with FHIR (https://hl7.org/fhir/uv/cql/), for evaluating CQL as a service. Operations
+// take a FHIR Parameters resource, with the data to evaluate against as a Bundle or a FHIR server
+// Endpoint, and return their results as a FHIR Parameters resource. Unlike cqlplay, which is an
+// experimental playground, cql-server only serves the operations and the libraries it was started
+// with.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"flag"
+	log "github.com/golang/glog"
+)
+
+var (
+	addr               = flag.String("addr", ":8080", "(Optional) The host:port to listen on.")
+	cqlDir             = flag.String("cql_dir", "", "(Optional) The directory of the CQL libraries to serve. Libraries are evaluated with Library/{name}/$evaluate, and may be included in $cql expressions with the library parameter.")
+	valueSetDir        = flag.String("valueset_dir", "", "(Optional) The directory of the FHIR ValueSets used by requests without a terminologyEndpoint parameter.")
+	allowedEndpoints   = flag.String("allowed_endpoints", "", "(Optional) Comma separated URL prefixes of the dataEndpoint and terminologyEndpoint addresses the server may connect to, for example https://fhir.example.org/. Use * to allow any address. By default requests may not use endpoints.")
+	tlsCert            = flag.String("tls_cert", "", "(Optional) Path to a PEM TLS certificate. If set along with --tls_key the server is served over HTTPS.")
+	tlsKey             = flag.String("tls_key", "", "(Optional) Path to the PEM private key of --tls_cert.")
+	maxConcurrentEvals = flag.Int("max_concurrent_evals", runtime.NumCPU(), "(Optional) The number of evaluations that may run at once. Defaults to the number of CPUs.")
+	evalTimeout        = flag.Duration("eval_timeout", time.Minute, "(Optional) How long a request may take, including the time it waits for other evaluations and fetches data from endpoints.")
+	maxRequestBytes    = flag.Int64("max_request_bytes", 50<<20, "(Optional) The largest request body the server accepts, in bytes.")
+)
+
+func main() {
+	flag.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := serve(ctx); err != nil {
+		log.Exitf("cql-server failed with an error: %v", err)
+	}
+}
+
+func serve(ctx context.Context) error {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("--tls_cert and --tls_key must be set together")
+	}
+	var allowed []string
+	for _, prefix := range strings.Split(*allowedEndpoints, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			allowed = append(allowed, prefix)
+		}
+	}
+	s, err := newServer(ctx, config{
+		CQLDir:             *cqlDir,
+		ValueSetDir:        *valueSetDir,
+		EvalTimeout:        *evalTimeout,
+		MaxConcurrentEvals: *maxConcurrentEvals,
+		MaxRequestBytes:    *maxRequestBytes,
+		AllowedEndpoints:   allowed,
+	})
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Addr: *addr, Handler: s.handler(), ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, 1)
+	go func() {
+		log.Infof("serving %d CQL libraries on %s", len(s.libraries), *addr)
+		if *tlsCert != "" {
+			errs <- server.ListenAndServeTLS(*tlsCert, *tlsKey)
+			return
+		}
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	// Requests in flight are given the evaluation timeout to finish.
+	log.Infof("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *evalTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// parameters is a FHIR Parameters resource, the input and output of the FHIR operations.
+type parameters struct {
+	ResourceType string       `json:"resourceType"`
+	Parameter    []*parameter `json:"parameter"`
+}
+
+// parameter is a single parameter of a FHIR Parameters resource. The value[x] of the parameter is
+// kept as the name of its type, for example Date for valueDate, and its raw JSON.
+type parameter struct {
+	Name      string
+	Part      []*parameter
+	Resource  json.RawMessage
+	ValueType string
+	Value     json.RawMessage
+}
+
+// UnmarshalJSON decodes the parameter, finding its value[x] element.
+func (p *parameter) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		switch {
+		case k == "name":
+			if err := json.Unmarshal(v, &p.Name); err != nil {
+				return fmt.Errorf("parameter name: %w", err)
+			}
+		case k == "part":
+			if err := json.Unmarshal(v, &p.Part); err != nil {
+				return fmt.Errorf("parts of parameter %s: %w", p.Name, err)
+			}
+		case k == "resource":
+			p.Resource = v
+		case strings.HasPrefix(k, "value") && len(k) > len("value"):
+			if p.ValueType != "" {
+				return fmt.Errorf("parameter has both value%s and %s", p.ValueType, k)
+			}
+			p.ValueType = strings.TrimPrefix(k, "value")
+			p.Value = v
+		}
+	}
+	return nil
+}
+
+// parseParameters decodes a FHIR Parameters resource. An empty body is an empty Parameters
+// resource.
+func parseParameters(body []byte) (*parameters, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return &parameters{ResourceType: "Parameters"}, nil
+	}
+	var p parameters
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("the request body is not a FHIR Parameters resource: %w", err)
+	}
+	if p.ResourceType != "Parameters" {
+		return nil, fmt.Errorf("the request body must be a FHIR Parameters resource, got resourceType %q", p.ResourceType)
+	}
+	for _, param := range p.Parameter {
+		if param == nil || param.Name == "" {
+			return nil, fmt.Errorf("every parameter of the Parameters resource must have a name")
+		}
+	}
+	return &p, nil
+}
+
+// all returns the parameters with the given name, in order.
+func (p *parameters) all(name string) []*parameter {
+	var ps []*parameter
+	for _, param := range p.Parameter {
+		if param.Name == name {
+			ps = append(ps, param)
+		}
+	}
+	return ps
+}
+
+// single returns the parameter with the given name, nil if there is none, or an error if there is
+// more than one.
+func (p *parameters) single(name string) (*parameter, error) {
+	ps := p.all(name)
+	switch len(ps) {
+	case 0:
+		return nil, nil
+	case 1:
+		return ps[0], nil
+	}
+	return nil, fmt.Errorf("parameter %s may only be given once, got %d", name, len(ps))
+}
+
+// stringValue returns the value of the parameter with the given name if it is a string like
+// primitive, or "" if there is no such parameter.
+func (p *parameters) stringValue(name string) (string, error) {
+	param, err := p.single(name)
+	if err != nil || param == nil {
+		return "", err
+	}
+	return param.stringValue()
+}
+
+// stringValue returns the value of the parameter if it is a string like primitive.
+func (p *parameter) stringValue() (string, error) {
+	if !stringTypes[p.ValueType] {
+		return "", fmt.Errorf("parameter %s must have a string value, got value%s", p.Name, p.ValueType)
+	}
+	var s string
+	if err := json.Unmarshal(p.Value, &s); err != nil {
+		return "", fmt.Errorf("parameter %s: %w", p.Name, err)
+	}
+	return s, nil
+}
+
+// part returns the part of the parameter with the given name, or nil.
+func (p *parameter) part(name string) *parameter {
+	for _, part := range p.Part {
+		if part != nil && part.Name == name {
+			return part
+		}
+	}
+	return nil
+}
+
+// stringTypes are the FHIR primitive types whose JSON representation is a string, and that map to
+// a CQL String.
+var stringTypes = map[string]bool{
+	"String":    true,
+	"Code":      true,
+	"Id":        true,
+	"Markdown":  true,
+	"Uri":       true,
+	"Url":       true,
+	"Canonical": true,
+	"Oid":       true,
+	"Uuid":      true,
+}
+
+var (
+	fhirDate     = regexp.MustCompile(`^[0-9]{4}(-[0-9]{2}(-[0-9]{2})?)?$`)
+	fhirDateTime = regexp.MustCompile(`^[0-9]{4}(-[0-9]{2}(-[0-9]{2}(T[0-9]{2}:[0-9]{2}(:[0-9]{2}(\.[0-9]+)?)?(Z|[+-][0-9]{2}:[0-9]{2})?)?)?)?$`)
+	fhirTime     = regexp.MustCompile(`^[0-9]{2}:[0-9]{2}(:[0-9]{2}(\.[0-9]+)?)?$`)
+	fhirDecimal  = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+	fhirInteger  = regexp.MustCompile(`^-?[0-9]+$`)
+)
+
+// cqlParameters converts the parts of the parameters parameter of an operation to CQL literals,
+// keyed by the name of the CQL parameter. Parameters repeated with the same name become a List.
+func cqlParameters(p *parameter) (map[string]string, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if p.Resource != nil {
+		// The parameters may be given as a nested Parameters resource.
+		nested, err := parseParameters(p.Resource)
+		if err != nil {
+			return nil, err
+		}
+		p = &parameter{Name: p.Name, Part: nested.Parameter}
+	}
+	values := make(map[string][]string)
+	var names []string
+	for _, part := range p.Part {
+		if part == nil {
+			continue
+		}
+		lit, err := cqlLiteral(part)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := values[part.Name]; !ok {
+			names = append(names, part.Name)
+		}
+		values[part.Name] = append(values[part.Name], lit)
+	}
+	sort.Strings(names)
+	lits := make(map[string]string, len(names))
+	for _, name := range names {
+		if vs := values[name]; len(vs) == 1 {
+			lits[name] = vs[0]
+		} else {
+			lits[name] = "{" + strings.Join(vs, ", ") + "}"
+		}
+	}
+	return lits, nil
+}
+
+// cqlLiteral converts the value[x] of a FHIR parameter to a CQL literal, following the mapping of
+// FHIR types to CQL types from Using CQL with FHIR.
+func cqlLiteral(p *parameter) (string, error) {
+	if p.ValueType == "" {
+		return "", fmt.Errorf("parameter %s must have a value[x]", p.Name)
+	}
+	var lit string
+	var err error
+	switch t := p.ValueType; {
+	case stringTypes[t]:
+		var s string
+		if err = json.Unmarshal(p.Value, &s); err == nil {
+			lit = cqlString(s)
+		}
+	case t == "Boolean":
+		var b bool
+		if err = json.Unmarshal(p.Value, &b); err == nil {
+			lit = fmt.Sprint(b)
+		}
+	case t == "Integer" || t == "PositiveInt" || t == "UnsignedInt":
+		lit, err = jsonNumber(p.Value, fhirInteger)
+	case t == "Decimal":
+		lit, err = cqlDecimal(p.Value)
+	case t == "Date":
+		lit, err = cqlDate(p.Value)
+	case t == "DateTime" || t == "Instant":
+		lit, err = cqlDateTime(p.Value)
+	case t == "Time":
+		var s string
+		if err = json.Unmarshal(p.Value, &s); err == nil {
+			if !fhirTime.MatchString(s) {
+				err = fmt.Errorf("invalid time %q", s)
+			}
+			lit = "@T" + s
+		}
+	case t == "Quantity":
+		var q quantity
+		if err = json.Unmarshal(p.Value, &q); err == nil {
+			lit, err = q.literal()
+		}
+	case t == "Period":
+		var period struct {
+			Start json.RawMessage `json:"start"`
+			End   json.RawMessage `json:"end"`
+		}
+		if err = json.Unmarshal(p.Value, &period); err == nil {
+			lit, err = cqlInterval(period.Start, period.End, cqlDateTime)
+		}
+	case t == "Range":
+		var r struct {
+			Low  json.RawMessage `json:"low"`
+			High json.RawMessage `json:"high"`
+		}
+		if err = json.Unmarshal(p.Value, &r); err == nil {
+			lit, err = cqlInterval(r.Low, r.High, func(b json.RawMessage) (string, error) {
+				var q quantity
+				if err := json.Unmarshal(b, &q); err != nil {
+					return "", err
+				}
+				return q.literal()
+			})
+		}
+	default:
+		return "", fmt.Errorf("parameter %s has unsupported type %s, the supported types are the primitive types, Quantity, Period and Range", p.Name, t)
+	}
+	if err != nil {
+		return "", fmt.Errorf("parameter %s has an invalid value%s: %w", p.Name, p.ValueType, err)
+	}
+	return lit, nil
+}
+
+// cqlString returns s as a CQL string literal.
+func cqlString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return "'" + r.Replace(s) + "'"
+}
+
+// jsonNumber returns the JSON number b if it matches re.
+func jsonNumber(b json.RawMessage, re *regexp.Regexp) (string, error) {
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return "", err
+	}
+	if !re.MatchString(n.String()) {
+		return "", fmt.Errorf("unsupported number %s", n)
+	}
+	return n.String(), nil
+}
+
+// cqlDecimal returns the JSON number b as a CQL Decimal literal. Whole numbers get a fractional part
+// so that they are not parsed as CQL Integers.
+func cqlDecimal(b json.RawMessage) (string, error) {
+	s, err := jsonNumber(b, fhirDecimal)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s, nil
+}
+
+func cqlDate(b json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return "", err
+	}
+	if !fhirDate.MatchString(s) {
+		return "", fmt.Errorf("invalid date %q", s)
+	}
+	return "@" + s, nil
+}
+
+// cqlDateTime returns the FHIR dateTime b as a CQL DateTime literal. DateTimes without a time
+// component are written with a trailing T, which distinguishes them from CQL Dates.
+func cqlDateTime(b json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return "", err
+	}
+	if !fhirDateTime.MatchString(s) {
+		return "", fmt.Errorf("invalid dateTime %q", s)
+	}
+	if !strings.Contains(s, "T") {
+		s += "T"
+	}
+	return "@" + s, nil
+}
+
+// cqlInterval returns a closed CQL Interval of the boundaries, converted by point. A missing
+// boundary is null.
+func cqlInterval(low, high json.RawMessage, point func(json.RawMessage) (string, error)) (string, error) {
+	bounds := make([]string, 2)
+	for i, b := range []json.RawMessage{low, high} {
+		if b == nil {
+			bounds[i] = "null"
+			continue
+		}
+		lit, err := point(b)
+		if err != nil {
+			return "", err
+		}
+		bounds[i] = lit
+	}
+	return fmt.Sprintf("Interval[%s, %s]", bounds[0], bounds[1]), nil
+}
+
+// quantity is a FHIR Quantity.
+type quantity struct {
+	Value  json.RawMessage `json:"value"`
+	Unit   string          `json:"unit"`
+	System string          `json:"system"`
+	Code   string          `json:"code"`
+}
+
+// literal returns the quantity as a CQL Quantity literal. The UCUM code is preferred over the
+// human readable unit, and quantities without a unit get the UCUM unit '1'.
+func (q quantity) literal() (string, error) {
+	if q.Value == nil {
+		return "", fmt.Errorf("a Quantity must have a value")
+	}
+	v, err := jsonNumber(q.Value, fhirDecimal)
+	if err != nil {
+		return "", err
+	}
+	unit := q.Unit
+	if q.Code != "" && (q.System == "" || q.System == "http://unitsofmeasure.org") {
+		unit = q.Code
+	}
+	if unit == "" {
+		unit = "1"
+	}
+	return v + " " + cqlString(unit), nil
+}
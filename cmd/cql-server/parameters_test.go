@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCQLLiteral(t *testing.T) {
+	tests := []struct {
+		param string
+		want  string
+	}{
+		{`{"name": "p", "valueString": "it's a \\ test"}`, `'it\'s a \\ test'`},
+		{`{"name": "p", "valueCode": "active"}`, `'active'`},
+		{`{"name": "p", "valueBoolean": true}`, `true`},
+		{`{"name": "p", "valueInteger": -4}`, `-4`},
+		{`{"name": "p", "valuePositiveInt": 4}`, `4`},
+		{`{"name": "p", "valueDecimal": 4}`, `4.0`},
+		{`{"name": "p", "valueDecimal": 4.25}`, `4.25`},
+		{`{"name": "p", "valueDate": "2024-03"}`, `@2024-03`},
+		{`{"name": "p", "valueDateTime": "2024-03-01"}`, `@2024-03-01T`},
+		{`{"name": "p", "valueDateTime": "2024-03-01T10:30:00+01:00"}`, `@2024-03-01T10:30:00+01:00`},
+		{`{"name": "p", "valueInstant": "2024-03-01T10:30:00.123Z"}`, `@2024-03-01T10:30:00.123Z`},
+		{`{"name": "p", "valueTime": "10:30"}`, `@T10:30`},
+		{`{"name": "p", "valueQuantity": {"value": 5, "unit": "milligram", "system": "http://unitsofmeasure.org", "code": "mg"}}`, `5 'mg'`},
+		{`{"name": "p", "valueQuantity": {"value": 5, "unit": "tablets"}}`, `5 'tablets'`},
+		{`{"name": "p", "valueQuantity": {"value": 5}}`, `5 '1'`},
+		{`{"name": "p", "valuePeriod": {"start": "2024-01-01", "end": "2024-12-31T23:59:59Z"}}`, `Interval[@2024-01-01T, @2024-12-31T23:59:59Z]`},
+		{`{"name": "p", "valuePeriod": {"start": "2024-01-01"}}`, `Interval[@2024-01-01T, null]`},
+		{`{"name": "p", "valueRange": {"low": {"value": 1, "code": "kg"}, "high": {"value": 2.5, "code": "kg"}}}`, `Interval[1 'kg', 2.5 'kg']`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.param, func(t *testing.T) {
+			var p parameter
+			if err := json.Unmarshal([]byte(tc.param), &p); err != nil {
+				t.Fatal(err)
+			}
+			got, err := cqlLiteral(&p)
+			if err != nil {
+				t.Fatalf("cqlLiteral(%s) returned unexpected error: %v", tc.param, err)
+			}
+			if got != tc.want {
+				t.Errorf("cqlLiteral(%s) = %s, want %s", tc.param, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCQLLiteral_Errors(t *testing.T) {
+	tests := []struct {
+		param   string
+		wantErr string
+	}{
+		{`{"name": "p"}`, "parameter p must have a value[x]"},
+		{`{"name": "p", "valueCoding": {"code": "a"}}`, "parameter p has unsupported type Coding"},
+		{`{"name": "p", "valueDate": "2024-01-01') or true or ('"}`, `invalid date`},
+		{`{"name": "p", "valueDateTime": "yesterday"}`, `invalid dateTime "yesterday"`},
+		{`{"name": "p", "valueInteger": 1.5}`, "unsupported number 1.5"},
+		{`{"name": "p", "valueDecimal": 1e5}`, "unsupported number 1e5"},
+		{`{"name": "p", "valueQuantity": {"unit": "mg"}}`, "a Quantity must have a value"},
+		{`{"name": "p", "valueBoolean": "yes"}`, "parameter p has an invalid valueBoolean"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.param, func(t *testing.T) {
+			var p parameter
+			if err := json.Unmarshal([]byte(tc.param), &p); err != nil {
+				t.Fatal(err)
+			}
+			_, err := cqlLiteral(&p)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("cqlLiteral(%s) returned error %v, want it to contain %q", tc.param, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCQLParameters(t *testing.T) {
+	params, err := parseParameters([]byte(`{"resourceType": "Parameters", "parameter": [{"name": "parameters", "part": [
+		{"name": "Codes", "valueString": "a"},
+		{"name": "Threshold", "valueInteger": 3},
+		{"name": "Codes", "valueString": "b"}
+	]}]}`))
+	if err != nil {
+		t.Fatalf("parseParameters() returned unexpected error: %v", err)
+	}
+	p, err := params.single("parameters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := cqlParameters(p)
+	if err != nil {
+		t.Fatalf("cqlParameters() returned unexpected error: %v", err)
+	}
+	want := map[string]string{"Codes": "{'a', 'b'}", "Threshold": "3"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("cqlParameters() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseParameters_Errors(t *testing.T) {
+	tests := []struct {
+		body    string
+		wantErr string
+	}{
+		{`[]`, "the request body is not a FHIR Parameters resource"},
+		{`{"resourceType": "Bundle"}`, `must be a FHIR Parameters resource, got resourceType "Bundle"`},
+		{`{"resourceType": "Parameters", "parameter": [{"valueString": "a"}]}`, "every parameter of the Parameters resource must have a name"},
+		{`{"resourceType": "Parameters", "parameter": [{"name": "a", "valueString": "a", "valueInteger": 1}]}`, "parameter has both value"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.body, func(t *testing.T) {
+			_, err := parseParameters([]byte(tc.body))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("parseParameters(%s) returned error %v, want it to contain %q", tc.body, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,568 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/cql"
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/result"
+	"github.com/google/cql/terminology"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// fhirVersion is the version of FHIR the server supports.
+	fhirVersion = "4.0.1"
+	// expressionLibrary is the name of the library the expression of a $cql request is evaluated in.
+	expressionLibrary = "CQLOperation"
+	// returnDefine is the name of the definition holding the expression of a $cql request, which is
+	// also the name of the parameter of the result.
+	returnDefine = "return"
+	// maxEndpointResponseBytes limits the size of responses read from terminology endpoints.
+	maxEndpointResponseBytes = 100 << 20
+)
+
+// config configures the server.
+type config struct {
+	// CQLDir is the directory of the CQL libraries that can be evaluated with Library/$evaluate and
+	// included in $cql expressions.
+	CQLDir string
+	// ValueSetDir is the directory of the ValueSets used when a request has no terminologyEndpoint.
+	ValueSetDir string
+	// EvalTimeout limits how long a request may take, including the time it waits for other
+	// evaluations to finish.
+	EvalTimeout time.Duration
+	// MaxConcurrentEvals is the number of evaluations that may run at once.
+	MaxConcurrentEvals int
+	// MaxRequestBytes is the largest request body the server accepts.
+	MaxRequestBytes int64
+	// AllowedEndpoints are the prefixes of the dataEndpoint and terminologyEndpoint addresses the
+	// server may connect to. "*" allows any address.
+	AllowedEndpoints []string
+	// EndpointClient is used for requests to data and terminology endpoints.
+	EndpointClient *http.Client
+}
+
+// server implements the $cql and Library/$evaluate operations from Using CQL with FHIR:
+// https://hl7.org/fhir/uv/cql/OperationDefinition-cql-cql.html
+// https://hl7.org/fhir/uv/cql/OperationDefinition-cql-library-evaluate.html
+type server struct {
+	cfg                 config
+	dataModel           []byte
+	sources             []string
+	libraries           []result.LibKey
+	terminologyProvider *terminology.LocalFHIRProvider
+	evals               chan struct{}
+}
+
+// newServer loads and validates the CQL libraries and ValueSets of the config.
+func newServer(ctx context.Context, cfg config) (*server, error) {
+	if cfg.EvalTimeout <= 0 {
+		return nil, fmt.Errorf("the evaluation timeout must be positive, got %v", cfg.EvalTimeout)
+	}
+	if cfg.MaxConcurrentEvals < 1 {
+		return nil, fmt.Errorf("the number of concurrent evaluations must be at least 1, got %d", cfg.MaxConcurrentEvals)
+	}
+	if cfg.MaxRequestBytes <= 0 {
+		return nil, fmt.Errorf("the maximum request size must be positive, got %d", cfg.MaxRequestBytes)
+	}
+	for _, prefix := range cfg.AllowedEndpoints {
+		if u, err := url.Parse(prefix); prefix != "*" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			return nil, fmt.Errorf("the allowed endpoint %q must be an http or https URL or *", prefix)
+		}
+	}
+	if cfg.EndpointClient == nil {
+		cfg.EndpointClient = &http.Client{Timeout: cfg.EvalTimeout}
+	}
+	dataModel, fhirHelpers, err := cql.FHIRDataModelAndHelpersLib(fhirVersion)
+	if err != nil {
+		return nil, err
+	}
+	s := &server{cfg: cfg, dataModel: dataModel, evals: make(chan struct{}, cfg.MaxConcurrentEvals)}
+
+	if cfg.CQLDir != "" {
+		if err := s.loadLibraries(cfg.CQLDir); err != nil {
+			return nil, err
+		}
+	}
+	if editing.SourceIndex(s.sources, result.LibKey{Name: "FHIRHelpers", Version: fhirVersion}) == -1 {
+		s.sources = append(s.sources, fhirHelpers)
+	}
+	// Parsing the libraries up front reports errors in them at startup rather than on every request.
+	if _, err := cql.Parse(ctx, s.sources, cql.ParseConfig{DataModels: [][]byte{s.dataModel}}); err != nil {
+		return nil, fmt.Errorf("failed to parse the CQL libraries: %w", err)
+	}
+
+	if cfg.ValueSetDir != "" {
+		s.terminologyProvider, err = terminology.NewLocalFHIRProvider(cfg.ValueSetDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the ValueSets in %s: %w", cfg.ValueSetDir, err)
+		}
+	}
+	return s, nil
+}
+
+// loadLibraries reads the .cql files in dir and its subdirectories. Every library must be named,
+// since the operations refer to libraries by name.
+func (s *server) loadLibraries(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".cql" {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key, ok := editing.LibraryDeclaration(string(b))
+		if !ok {
+			return fmt.Errorf("%s has no library declaration, every library served must be named", path)
+		}
+		s.sources = append(s.sources, string(b))
+		s.libraries = append(s.libraries, key)
+		return nil
+	})
+}
+
+// handler returns the HTTP handler of the server.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /$cql", s.handleCQL)
+	mux.HandleFunc("POST /Library/$evaluate", s.handleEvaluate)
+	mux.HandleFunc("POST /Library/{id}/$evaluate", s.handleEvaluate)
+	mux.HandleFunc("GET /metadata", s.handleMetadata)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	return mux
+}
+
+// handleCQL implements the $cql operation, which evaluates a CQL expression. Libraries given by
+// the library parameter are included in the expression under their name.
+func (s *server) handleCQL(w http.ResponseWriter, req *http.Request) {
+	params, ok := s.readParameters(w, req)
+	if !ok {
+		return
+	}
+	expr, err := params.stringValue("expression")
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return
+	}
+	if strings.TrimSpace(expr) == "" {
+		sendOutcome(w, invalid(errors.New("the expression parameter is required")))
+		return
+	}
+	subject, err := params.stringValue("subject")
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return
+	}
+	includes, err := s.includes(params)
+	if err != nil {
+		sendOutcome(w, err)
+		return
+	}
+	p, err := params.single("parameters")
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return
+	}
+	lits, err := cqlParameters(p)
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return
+	}
+
+	key := result.LibKey{Name: expressionLibrary, Version: "1.0.0"}
+	src := expressionSource(key, expr, includes, lits)
+	s.evaluate(w, req, evaluation{
+		params:  params,
+		sources: append(append([]string(nil), s.sources...), src),
+		library: key,
+		defines: []string{returnDefine},
+		subject: subject,
+	})
+}
+
+// include is a library included in the expression of a $cql request.
+type include struct {
+	key   result.LibKey
+	alias string
+}
+
+// includes returns the libraries of the library parameters of a $cql request. Each has a url part
+// with the canonical URL or name of the library, and an optional name part with the alias.
+func (s *server) includes(params *parameters) ([]include, error) {
+	var includes []include
+	for _, p := range params.all("library") {
+		u := p.part("url")
+		if u == nil {
+			return nil, invalid(errors.New("every library parameter must have a url part"))
+		}
+		canonical, err := u.stringValue()
+		if err != nil {
+			return nil, invalid(err)
+		}
+		key, err := s.resolveLibrary(canonical)
+		if err != nil {
+			return nil, err
+		}
+		inc := include{key: key, alias: key.Name}
+		if n := p.part("name"); n != nil {
+			if inc.alias, err = n.stringValue(); err != nil {
+				return nil, invalid(err)
+			}
+		}
+		includes = append(includes, inc)
+	}
+	return includes, nil
+}
+
+// expressionSource returns the CQL library in which the expression of a $cql request is evaluated.
+// Parameters are declared with their value as the default, so that their type is that of the value.
+func expressionSource(key result.LibKey, expr string, includes []include, params map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "library %s version '%s'\n", key.Name, key.Version)
+	fmt.Fprintf(&b, "using FHIR version '%s'\n", fhirVersion)
+	fmt.Fprintf(&b, "include FHIRHelpers version '%s' called FHIRHelpers\n", fhirVersion)
+	for _, inc := range includes {
+		fmt.Fprintf(&b, "include %s", editing.QuoteIdentifier(inc.key.Name))
+		if inc.key.Version != "" {
+			fmt.Fprintf(&b, " version %s", cqlString(inc.key.Version))
+		}
+		fmt.Fprintf(&b, " called %s\n", editing.QuoteIdentifier(inc.alias))
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "parameter %s default %s\n", editing.QuoteIdentifier(name), params[name])
+	}
+	fmt.Fprintf(&b, "context Patient\n")
+	fmt.Fprintf(&b, "define \"%s\":\n%s\n", returnDefine, expr)
+	return b.String()
+}
+
+// handleEvaluate implements the Library/$evaluate operation, which evaluates the expression
+// definitions of a library. The library is given by its name as the id in the path, or by the url
+// parameter.
+func (s *server) handleEvaluate(w http.ResponseWriter, req *http.Request) {
+	params, ok := s.readParameters(w, req)
+	if !ok {
+		return
+	}
+	canonical, err := params.stringValue("url")
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return
+	}
+	if id := req.PathValue("id"); id != "" {
+		if canonical != "" && libraryName(canonical) != id {
+			sendOutcome(w, invalid(fmt.Errorf("the url parameter %s does not match the library %s of the path", canonical, id)))
+			return
+		}
+		if canonical == "" {
+			canonical = id
+		}
+	}
+	if canonical == "" {
+		sendOutcome(w, invalid(errors.New("the library to evaluate must be given as Library/{id}/$evaluate or by the url parameter")))
+		return
+	}
+	key, err := s.resolveLibrary(canonical)
+	if err != nil {
+		sendOutcome(w, err)
+		return
+	}
+	subject, err := params.stringValue("subject")
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return
+	}
+	var defines []string
+	for _, p := range params.all("expression") {
+		name, err := p.stringValue()
+		if err != nil {
+			sendOutcome(w, invalid(err))
+			return
+		}
+		defines = append(defines, name)
+	}
+	p, err := params.single("parameters")
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return
+	}
+	lits, err := cqlParameters(p)
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return
+	}
+	cqlParams := make(map[result.DefKey]string, len(lits))
+	for name, lit := range lits {
+		cqlParams[result.DefKey{Name: name, Library: key}] = lit
+	}
+
+	s.evaluate(w, req, evaluation{
+		params:     params,
+		sources:    s.sources,
+		cqlParams:  cqlParams,
+		library:    key,
+		defines:    defines,
+		subject:    subject,
+		allDefines: len(defines) == 0,
+	})
+}
+
+// resolveLibrary returns the served library of a canonical URL, like
+// http://example.org/Library/Name|1.0.0, or of a name with an optional version, like Name|1.0.0.
+// If no version is given the library must only be served in one version.
+func (s *server) resolveLibrary(canonical string) (result.LibKey, error) {
+	name := libraryName(canonical)
+	_, version, _ := strings.Cut(canonical, "|")
+	var matches []result.LibKey
+	for _, key := range s.libraries {
+		if key.Name == name && (version == "" || key.Version == version) {
+			matches = append(matches, key)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return result.LibKey{}, notFound(fmt.Errorf("library %s is not served", canonical))
+	case 1:
+		return matches[0], nil
+	}
+	return result.LibKey{}, invalid(fmt.Errorf("library %s is served in several versions, give one as %s|{version}", canonical, canonical))
+}
+
+// libraryName returns the name of the library of a canonical URL, which is its last path segment.
+func libraryName(canonical string) string {
+	name, _, _ := strings.Cut(canonical, "|")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// evaluation is a request to evaluate the definitions of a library.
+type evaluation struct {
+	params    *parameters
+	sources   []string
+	cqlParams map[result.DefKey]string
+	library   result.LibKey
+	// defines are the names of the definitions of the library to return. If allDefines is true all
+	// public definitions are returned instead.
+	defines    []string
+	allDefines bool
+	subject    string
+}
+
+// evaluate runs the evaluation and sends its results as a FHIR Parameters resource.
+func (s *server) evaluate(w http.ResponseWriter, req *http.Request, e evaluation) {
+	ctx, cancel := context.WithTimeout(req.Context(), s.cfg.EvalTimeout)
+	defer cancel()
+	select {
+	case s.evals <- struct{}{}:
+	case <-ctx.Done():
+		sendOutcome(w, &operationError{status: http.StatusServiceUnavailable, code: "transient", err: fmt.Errorf("timed out after %v waiting for other evaluations", s.cfg.EvalTimeout)})
+		return
+	}
+
+	type evalResult struct {
+		body []byte
+		err  error
+	}
+	done := make(chan evalResult, 1)
+	go func() {
+		// The slot is only released once the evaluation finishes, even if the request timed out, so
+		// that abandoned evaluations still count towards the limit.
+		defer func() { <-s.evals }()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("evaluation of %s panicked: %v", e.library, r)
+				done <- evalResult{err: fmt.Errorf("internal error: %v", r)}
+			}
+		}()
+		body, err := s.run(ctx, e)
+		done <- evalResult{body, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			sendOutcome(w, r.err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Write(r.body)
+	case <-ctx.Done():
+		sendOutcome(w, &operationError{status: http.StatusGatewayTimeout, code: "timeout", err: fmt.Errorf("the evaluation did not finish within %v", s.cfg.EvalTimeout)})
+	}
+}
+
+// run parses and evaluates the CQL, and returns the results of the requested definitions.
+func (s *server) run(ctx context.Context, e evaluation) ([]byte, error) {
+	elm, err := cql.Parse(ctx, e.sources, cql.ParseConfig{DataModels: [][]byte{s.dataModel}, Parameters: e.cqlParams})
+	if err != nil {
+		return nil, invalid(err)
+	}
+	defs := elm.ResultTypes(false)[e.library]
+	allDefs := elm.ResultTypes(true)[e.library]
+	for k := range e.cqlParams {
+		if _, ok := allDefs[k.Name]; !ok {
+			return nil, invalid(fmt.Errorf("parameter %q is not defined in library %s", k.Name, e.library))
+		}
+	}
+	if e.allDefines {
+		for name := range defs {
+			e.defines = append(e.defines, name)
+		}
+	}
+	filter := result.DefineFilter{}
+	for _, name := range e.defines {
+		if _, ok := defs[name]; !ok {
+			return nil, invalid(fmt.Errorf("expression %q is not a public definition of library %s", name, e.library))
+		}
+		filter.IncludeNames = append(filter.IncludeNames, e.library.Name+"."+name)
+	}
+	if len(filter.IncludeNames) == 0 {
+		// The library has no public definitions, so there is nothing to evaluate.
+		return result.ParametersJSON(nil)
+	}
+
+	ret, err := s.retriever(e.params, e.subject)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	tp, err := s.terminology(ctx, e.params, elm.ValueSets())
+	if err != nil {
+		return nil, invalid(err)
+	}
+	res, err := elm.Eval(ctx, ret, cql.EvalConfig{Terminology: tp, DefineFilter: filter, SkipFilteredDefines: true})
+	if err != nil {
+		return nil, &operationError{status: http.StatusUnprocessableEntity, code: "processing", err: err}
+	}
+	return result.ParametersJSON(res[e.library])
+}
+
+// readParameters reads the FHIR Parameters resource of the request body. If it fails it sends an
+// OperationOutcome and returns false.
+func (s *server) readParameters(w http.ResponseWriter, req *http.Request) (*parameters, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, s.cfg.MaxRequestBytes))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			sendOutcome(w, &operationError{status: http.StatusRequestEntityTooLarge, code: "too-costly", err: fmt.Errorf("the request is larger than the limit of %d bytes", maxErr.Limit)})
+			return nil, false
+		}
+		sendOutcome(w, err)
+		return nil, false
+	}
+	params, err := parseParameters(body)
+	if err != nil {
+		sendOutcome(w, invalid(err))
+		return nil, false
+	}
+	return params, true
+}
+
+// handleMetadata returns the CapabilityStatement of the server, listing the operations it
+// supports.
+func (s *server) handleMetadata(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/fhir+json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"resourceType": "CapabilityStatement",
+		"status":       "active",
+		"kind":         "instance",
+		"fhirVersion":  fhirVersion,
+		"format":       []string{"json"},
+		"rest": []map[string]any{{
+			"mode": "server",
+			"resource": []map[string]any{{
+				"type": "Library",
+				"operation": []map[string]string{{
+					"name":       "evaluate",
+					"definition": "http://hl7.org/fhir/uv/cql/OperationDefinition/cql-library-evaluate",
+				}},
+			}},
+			"operation": []map[string]string{{
+				"name":       "cql",
+				"definition": "http://hl7.org/fhir/uv/cql/OperationDefinition/cql-cql",
+			}},
+		}},
+	})
+}
+
+// operationError is an error with the HTTP status and OperationOutcome issue code it is sent with.
+type operationError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *operationError) Error() string { return e.err.Error() }
+
+func (e *operationError) Unwrap() error { return e.err }
+
+func invalid(err error) error {
+	return &operationError{status: http.StatusBadRequest, code: "invalid", err: err}
+}
+
+func notFound(err error) error {
+	return &operationError{status: http.StatusNotFound, code: "not-found", err: err}
+}
+
+// sendOutcome sends the error as a FHIR OperationOutcome. Errors that are not operationErrors are
+// internal errors.
+func sendOutcome(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, "exception"
+	var opErr *operationError
+	if errors.As(err, &opErr) {
+		status, code = opErr.status, opErr.code
+	}
+	if status == http.StatusInternalServerError {
+		log.Errorf("internal error: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"resourceType": "OperationOutcome",
+		"issue": []map[string]string{{
+			"severity":    "error",
+			"code":        code,
+			"diagnostics": err.Error(),
+		}},
+	})
+}
@@ -0,0 +1,513 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const measureLib = `library Measure version '1.0.0'
+using FHIR version '4.0.1'
+include FHIRHelpers version '4.0.1' called FHIRHelpers
+
+valueset "Diabetes": 'http://example.org/ValueSet/diabetes'
+
+parameter "Threshold" Integer default 3
+parameter "Label" String default 'none'
+
+context Patient
+
+define "Patient Gender": Patient.gender.value
+define "Condition Count": Count([Condition])
+define "Over Threshold": "Condition Count" > "Threshold"
+define "Has Diabetes": exists [Condition: "Diabetes"]
+define "Label Text": "Label"
+define private "Hidden": 1
+define function Double(x Integer): x * 2
+`
+
+const bundle = `{
+  "resourceType": "Bundle",
+  "type": "collection",
+  "entry": [
+    {"resource": {"resourceType": "Patient", "id": "1", "gender": "female"}},
+    {"resource": {"resourceType": "Condition", "id": "c1", "subject": {"reference": "Patient/1"}, "code": {"coding": [{"system": "http://snomed.info/sct", "code": "44054006"}]}}},
+    {"resource": {"resourceType": "Condition", "id": "c2", "subject": {"reference": "Patient/1"}, "code": {"coding": [{"system": "http://snomed.info/sct", "code": "1234"}]}}}
+  ]
+}`
+
+const diabetesValueSet = `{
+  "resourceType": "ValueSet",
+  "id": "diabetes",
+  "url": "http://example.org/ValueSet/diabetes",
+  "expansion": {"contains": [{"system": "http://snomed.info/sct", "code": "44054006"}]}
+}`
+
+// newTestServer returns a test HTTP server serving the measure library.
+func newTestServer(t *testing.T, cfg config) (*server, *httptest.Server) {
+	t.Helper()
+	cqlDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(cqlDir, "measure.cql"), []byte(measureLib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(vsDir, "diabetes.json"), []byte(diabetesValueSet), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.CQLDir = cqlDir
+	cfg.ValueSetDir = vsDir
+	if cfg.EvalTimeout == 0 {
+		cfg.EvalTimeout = time.Minute
+	}
+	if cfg.MaxConcurrentEvals == 0 {
+		cfg.MaxConcurrentEvals = 2
+	}
+	if cfg.MaxRequestBytes == 0 {
+		cfg.MaxRequestBytes = 1 << 20
+	}
+	s, err := newServer(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("newServer() returned unexpected error: %v", err)
+	}
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// post sends the FHIR Parameters to the path and returns the status and decoded response.
+func post(t *testing.T, ts *httptest.Server, path, body string) (int, map[string]any) {
+	t.Helper()
+	resp, err := http.Post(ts.URL+path, "application/fhir+json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode the response of %s: %v", path, err)
+	}
+	return resp.StatusCode, got
+}
+
+// parametersJSON returns a FHIR Parameters resource with the given parameters.
+func parametersJSON(params ...string) string {
+	return fmt.Sprintf(`{"resourceType": "Parameters", "parameter": [%s]}`, strings.Join(params, ","))
+}
+
+// decode decodes JSON for comparison with responses.
+func decode(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []string
+		want   string
+	}{
+		{
+			name:   "expression",
+			params: []string{`{"name": "expression", "valueString": "1 + 1"}`},
+			want:   `{"resourceType": "Parameters", "parameter": [{"name": "return", "valueInteger": 2}]}`,
+		},
+		{
+			name: "parameters",
+			params: []string{
+				`{"name": "expression", "valueString": "Name + ' ' + ToString(Size is Decimal)"}`,
+				`{"name": "parameters", "part": [{"name": "Name", "valueString": "O'Brien"}, {"name": "Size", "valueDecimal": 2}]}`,
+			},
+			want: `{"resourceType": "Parameters", "parameter": [{"name": "return", "valueString": "O'Brien true"}]}`,
+		},
+		{
+			name: "list result",
+			params: []string{
+				`{"name": "expression", "valueString": "{1, 2}"}`,
+			},
+			want: `{"resourceType": "Parameters", "parameter": [{"name": "return", "valueInteger": 1}, {"name": "return", "valueInteger": 2}]}`,
+		},
+		{
+			name: "library and data",
+			params: []string{
+				`{"name": "expression", "valueString": "M.\"Condition Count\" + M.Double(1)"}`,
+				`{"name": "library", "part": [{"name": "url", "valueCanonical": "http://example.org/Library/Measure|1.0.0"}, {"name": "name", "valueString": "M"}]}`,
+				`{"name": "data", "resource": ` + bundle + `}`,
+			},
+			want: `{"resourceType": "Parameters", "parameter": [{"name": "return", "valueInteger": 4}]}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, ts := newTestServer(t, config{})
+			status, got := post(t, ts, "/$cql", parametersJSON(tc.params...))
+			if status != http.StatusOK {
+				t.Fatalf("POST /$cql returned status %d, want 200: %v", status, got)
+			}
+			if diff := cmp.Diff(decode(t, tc.want), got); diff != "" {
+				t.Errorf("POST /$cql returned unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		params []string
+		want   string
+	}{
+		{
+			name:   "by id",
+			path:   "/Library/Measure/$evaluate",
+			params: []string{`{"name": "data", "resource": ` + bundle + `}`},
+			want: `{"resourceType": "Parameters", "parameter": [
+				{"name": "Condition Count", "valueInteger": 2},
+				{"name": "Diabetes", "valueCanonical": "http://example.org/ValueSet/diabetes"},
+				{"name": "Has Diabetes", "valueBoolean": true},
+				{"name": "Label", "valueString": "none"},
+				{"name": "Label Text", "valueString": "none"},
+				{"name": "Over Threshold", "valueBoolean": false},
+				{"name": "Patient Gender", "valueString": "female"},
+				{"name": "Threshold", "valueInteger": 3}
+			]}`,
+		},
+		{
+			name: "by url with expressions and parameters",
+			path: "/Library/$evaluate",
+			params: []string{
+				`{"name": "url", "valueCanonical": "http://example.org/Library/Measure"}`,
+				`{"name": "expression", "valueString": "Over Threshold"}`,
+				`{"name": "expression", "valueString": "Label Text"}`,
+				`{"name": "parameters", "resource": {"resourceType": "Parameters", "parameter": [{"name": "Threshold", "valueInteger": 1}, {"name": "Label", "valueString": "a label"}]}}`,
+				`{"name": "data", "resource": ` + bundle + `}`,
+			},
+			want: `{"resourceType": "Parameters", "parameter": [
+				{"name": "Label Text", "valueString": "a label"},
+				{"name": "Over Threshold", "valueBoolean": true}
+			]}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, ts := newTestServer(t, config{})
+			status, got := post(t, ts, tc.path, parametersJSON(tc.params...))
+			if status != http.StatusOK {
+				t.Fatalf("POST %s returned status %d, want 200: %v", tc.path, status, got)
+			}
+			if diff := cmp.Diff(decode(t, tc.want), got); diff != "" {
+				t.Errorf("POST %s returned unexpected diff (-want +got):\n%s", tc.path, diff)
+			}
+		})
+	}
+}
+
+func TestOperations_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantDiag   string
+	}{
+		{
+			name:       "not Parameters",
+			path:       "/$cql",
+			body:       `{"resourceType": "Patient"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid",
+			wantDiag:   "must be a FHIR Parameters resource",
+		},
+		{
+			name:       "missing expression",
+			path:       "/$cql",
+			body:       parametersJSON(),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid",
+			wantDiag:   "the expression parameter is required",
+		},
+		{
+			name:       "invalid CQL",
+			path:       "/$cql",
+			body:       parametersJSON(`{"name": "expression", "valueString": "1 +"}`),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid",
+		},
+		{
+			name:       "unknown library",
+			path:       "/Library/Missing/$evaluate",
+			body:       parametersJSON(),
+			wantStatus: http.StatusNotFound,
+			wantCode:   "not-found",
+			wantDiag:   "library Missing is not served",
+		},
+		{
+			name:       "no library",
+			path:       "/Library/$evaluate",
+			body:       parametersJSON(),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid",
+			wantDiag:   "the library to evaluate must be given",
+		},
+		{
+			name:       "unknown expression",
+			path:       "/Library/Measure/$evaluate",
+			body:       parametersJSON(`{"name": "expression", "valueString": "Hidden"}`),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid",
+			wantDiag:   `expression "Hidden" is not a public definition of library Measure 1.0.0`,
+		},
+		{
+			name:       "unknown parameter",
+			path:       "/Library/Measure/$evaluate",
+			body:       parametersJSON(`{"name": "parameters", "part": [{"name": "Missing", "valueInteger": 1}]}`),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid",
+			wantDiag:   `parameter "Missing" is not defined in library Measure 1.0.0`,
+		},
+		{
+			name:       "unsupported parameter type",
+			path:       "/Library/Measure/$evaluate",
+			body:       parametersJSON(`{"name": "parameters", "part": [{"name": "Threshold", "valueCoding": {"code": "1"}}]}`),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid",
+			wantDiag:   "parameter Threshold has unsupported type Coding",
+		},
+		{
+			name:       "endpoint not allowed",
+			path:       "/Library/Measure/$evaluate",
+			body:       parametersJSON(`{"name": "subject", "valueString": "Patient/1"}`, `{"name": "dataEndpoint", "resource": {"resourceType": "Endpoint", "address": "http://fhir.example.org"}}`),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid",
+			wantDiag:   "the dataEndpoint http://fhir.example.org is not allowed by this server",
+		},
+		{
+			name:       "data without retrieves",
+			path:       "/Library/Measure/$evaluate",
+			body:       parametersJSON(`{"name": "expression", "valueString": "Condition Count"}`),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   "processing",
+		},
+		{
+			name:       "too large",
+			path:       "/$cql",
+			body:       parametersJSON(`{"name": "expression", "valueString": "'` + strings.Repeat("a", 2<<20) + `'"}`),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantCode:   "too-costly",
+			wantDiag:   "the request is larger than the limit of 1048576 bytes",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, ts := newTestServer(t, config{})
+			status, got := post(t, ts, tc.path, tc.body)
+			if status != tc.wantStatus {
+				t.Errorf("POST %s returned status %d, want %d: %v", tc.path, status, tc.wantStatus, got)
+			}
+			issue := outcomeIssue(t, got)
+			if issue["code"] != tc.wantCode {
+				t.Errorf("POST %s returned issue code %v, want %v", tc.path, issue["code"], tc.wantCode)
+			}
+			if diag, _ := issue["diagnostics"].(string); !strings.Contains(diag, tc.wantDiag) {
+				t.Errorf("POST %s returned diagnostics %q, want it to contain %q", tc.path, diag, tc.wantDiag)
+			}
+		})
+	}
+}
+
+// outcomeIssue returns the single issue of an OperationOutcome.
+func outcomeIssue(t *testing.T, outcome map[string]any) map[string]any {
+	t.Helper()
+	if outcome["resourceType"] != "OperationOutcome" {
+		t.Fatalf("got resourceType %v, want OperationOutcome", outcome["resourceType"])
+	}
+	issues, _ := outcome["issue"].([]any)
+	if len(issues) != 1 {
+		t.Fatalf("got %d issues, want 1", len(issues))
+	}
+	issue, _ := issues[0].(map[string]any)
+	return issue
+}
+
+func TestEvaluate_DataEndpoint(t *testing.T) {
+	fhir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("FHIR server got Authorization %q, want Bearer secret", got)
+		}
+		switch req.URL.Path {
+		case "/Patient/1":
+			fmt.Fprint(w, `{"resourceType": "Patient", "id": "1", "gender": "male"}`)
+		case "/Patient/1/Condition":
+			fmt.Fprint(w, `{"resourceType": "Bundle", "type": "searchset", "entry": [{"resource": {"resourceType": "Condition", "id": "c1", "subject": {"reference": "Patient/1"}}}]}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer fhir.Close()
+	_, ts := newTestServer(t, config{AllowedEndpoints: []string{fhir.URL}})
+
+	status, got := post(t, ts, "/Library/Measure/$evaluate", parametersJSON(
+		`{"name": "subject", "valueString": "Patient/1"}`,
+		`{"name": "expression", "valueString": "Patient Gender"}`,
+		`{"name": "expression", "valueString": "Condition Count"}`,
+		`{"name": "dataEndpoint", "resource": {"resourceType": "Endpoint", "address": "`+fhir.URL+`", "header": ["Authorization: Bearer secret"]}}`,
+	))
+	if status != http.StatusOK {
+		t.Fatalf("POST returned status %d, want 200: %v", status, got)
+	}
+	want := `{"resourceType": "Parameters", "parameter": [
+		{"name": "Condition Count", "valueInteger": 1},
+		{"name": "Patient Gender", "valueString": "male"}
+	]}`
+	if diff := cmp.Diff(decode(t, want), got); diff != "" {
+		t.Errorf("POST returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestEvaluate_TerminologyEndpoint(t *testing.T) {
+	var expanded []string
+	tx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ValueSet/$expand" {
+			http.NotFound(w, req)
+			return
+		}
+		expanded = append(expanded, req.URL.Query().Get("url"))
+		// The expansion has none of the codes of the bundle, unlike the ValueSet of --valueset_dir.
+		fmt.Fprint(w, `{"resourceType": "ValueSet", "url": "urn:oid:1.2.3", "expansion": {"total": 1, "contains": [{"system": "http://snomed.info/sct", "code": "9999"}]}}`)
+	}))
+	defer tx.Close()
+	_, ts := newTestServer(t, config{AllowedEndpoints: []string{"*"}})
+
+	status, got := post(t, ts, "/Library/Measure/$evaluate", parametersJSON(
+		`{"name": "expression", "valueString": "Has Diabetes"}`,
+		`{"name": "data", "resource": `+bundle+`}`,
+		`{"name": "terminologyEndpoint", "resource": {"resourceType": "Endpoint", "address": "`+tx.URL+`"}}`,
+	))
+	if status != http.StatusOK {
+		t.Fatalf("POST returned status %d, want 200: %v", status, got)
+	}
+	want := `{"resourceType": "Parameters", "parameter": [{"name": "Has Diabetes", "valueBoolean": false}]}`
+	if diff := cmp.Diff(decode(t, want), got); diff != "" {
+		t.Errorf("POST returned unexpected diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"http://example.org/ValueSet/diabetes"}, expanded); diff != "" {
+		t.Errorf("terminology server expanded unexpected ValueSets (-want +got):\n%s", diff)
+	}
+}
+
+func TestEvaluate_Busy(t *testing.T) {
+	s, ts := newTestServer(t, config{MaxConcurrentEvals: 1, EvalTimeout: 100 * time.Millisecond})
+	// Fill the only evaluation slot, as if another evaluation was running.
+	s.evals <- struct{}{}
+	defer func() { <-s.evals }()
+
+	status, got := post(t, ts, "/$cql", parametersJSON(`{"name": "expression", "valueString": "1"}`))
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("POST returned status %d, want 503: %v", status, got)
+	}
+	if issue := outcomeIssue(t, got); issue["code"] != "transient" {
+		t.Errorf("POST returned issue code %v, want transient", issue["code"])
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	_, ts := newTestServer(t, config{})
+	resp, err := http.Get(ts.URL + "/metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		ResourceType string `json:"resourceType"`
+		Rest         []struct {
+			Operation []struct {
+				Name string `json:"name"`
+			} `json:"operation"`
+		} `json:"rest"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ResourceType != "CapabilityStatement" || len(got.Rest) != 1 || len(got.Rest[0].Operation) != 1 || got.Rest[0].Operation[0].Name != "cql" {
+		t.Errorf("GET /metadata returned %+v, want a CapabilityStatement with the cql operation", got)
+	}
+}
+
+func TestNewServer_Errors(t *testing.T) {
+	unnamed := t.TempDir()
+	if err := os.WriteFile(filepath.Join(unnamed, "a.cql"), []byte("define X: 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalidCQL := t.TempDir()
+	if err := os.WriteFile(filepath.Join(invalidCQL, "a.cql"), []byte("library A\ndefine X: 1 +"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	valid := config{EvalTimeout: time.Second, MaxConcurrentEvals: 1, MaxRequestBytes: 1}
+	tests := []struct {
+		name    string
+		cfg     func(config) config
+		wantErr string
+	}{
+		{
+			name:    "zero timeout",
+			cfg:     func(c config) config { c.EvalTimeout = 0; return c },
+			wantErr: "the evaluation timeout must be positive",
+		},
+		{
+			name:    "no concurrent evaluations",
+			cfg:     func(c config) config { c.MaxConcurrentEvals = 0; return c },
+			wantErr: "the number of concurrent evaluations must be at least 1",
+		},
+		{
+			name:    "allowed endpoint without host",
+			cfg:     func(c config) config { c.AllowedEndpoints = []string{"fhir.example.org"}; return c },
+			wantErr: "must be an http or https URL",
+		},
+		{
+			name:    "unnamed library",
+			cfg:     func(c config) config { c.CQLDir = unnamed; return c },
+			wantErr: "has no library declaration",
+		},
+		{
+			name:    "invalid library",
+			cfg:     func(c config) config { c.CQLDir = invalidCQL; return c },
+			wantErr: "failed to parse the CQL libraries",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newServer(context.Background(), tc.cfg(valid))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("newServer() returned error %v, want it to contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/result"
+)
+
+type compareRequest struct {
+	evalCQLRequest
+	// BaselineCQL is the version of the main CQL to compare against. The libraries, data, parameters
+	// and terminology of the request are shared by both versions.
+	BaselineCQL string `json:"baselineCql"`
+}
+
+// Statuses of a defineDiff.
+const (
+	defineUnchanged = "unchanged"
+	defineChanged   = "changed"
+	defineAdded     = "added"
+	defineRemoved   = "removed"
+)
+
+// defineDiff compares the result of an expression definition between the two versions of the CQL.
+type defineDiff struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Baseline and Current are the results of the definition, and are unset if the version has no
+	// such definition.
+	Baseline *result.Value `json:"baseline,omitempty"`
+	Current  *result.Value `json:"current,omitempty"`
+}
+
+type compareResponse struct {
+	BaselineLibrary string `json:"baselineLibrary"`
+	CurrentLibrary  string `json:"currentLibrary"`
+	// Defines are sorted by name.
+	Defines []defineDiff `json:"defines"`
+}
+
+// handleCompare evaluates the main CQL and a baseline version of it against the same data, and
+// responds with how the result of each expression definition changed.
+func handleCompare(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	compareReq := &compareRequest{}
+	if err := json.Unmarshal(body, compareReq); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if compareReq.BaselineCQL == "" {
+		sendError(w, fmt.Errorf("no baseline CQL to compare against"), http.StatusBadRequest)
+		return
+	}
+	baselineReq := compareReq.evalCQLRequest
+	baselineReq.CQL = compareReq.BaselineCQL
+
+	baselineLib, baseline, ok := evalMainLibrary(req.Context(), w, &baselineReq, "baseline")
+	if !ok {
+		return
+	}
+	currentLib, current, ok := evalMainLibrary(req.Context(), w, &compareReq.evalCQLRequest, "current")
+	if !ok {
+		return
+	}
+	sendJSON(w, compareResponse{
+		BaselineLibrary: baselineLib.String(),
+		CurrentLibrary:  currentLib.String(),
+		Defines:         diffDefines(baseline, current),
+	})
+}
+
+// evalMainLibrary evaluates the request and returns the expression definitions of its main CQL,
+// including private ones. If parsing or evaluation fails the error is sent to w and false is
+// returned. The version names the CQL in errors.
+func evalMainLibrary(ctx context.Context, w http.ResponseWriter, r *evalCQLRequest, version string) (result.LibKey, map[string]result.Value, bool) {
+	elm, ok := parseRequest(ctx, w, r)
+	if !ok {
+		return result.LibKey{}, nil, false
+	}
+	ret, err := r.retriever()
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return result.LibKey{}, nil, false
+	}
+	config, err := r.evalConfig()
+	if err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return result.LibKey{}, nil, false
+	}
+	config.ReturnPrivateDefs = true
+	results, err := elm.Eval(ctx, ret, config)
+	if err != nil {
+		sendError(w, fmt.Errorf("failed to eval the %s CQL: %w", version, err), http.StatusInternalServerError)
+		return result.LibKey{}, nil, false
+	}
+	return mainLibraryDefines(r.sources(), results)
+}
+
+// mainLibraryDefines returns the expression definitions of the library of the first source.
+func mainLibraryDefines(sources []string, results result.Libraries) (result.LibKey, map[string]result.Value, bool) {
+	for key, defs := range results {
+		if editing.SourceIndex(sources, key) != 0 {
+			continue
+		}
+		exprs := make(map[string]result.Value, len(defs))
+		for name, v := range defs {
+			if meta, ok := v.DefMetadata(); ok && meta.Kind == result.ExpressionDefinition {
+				exprs[name] = v
+			}
+		}
+		return key, exprs, true
+	}
+	// The main CQL has no definitions that produce results.
+	return result.LibKey{}, map[string]result.Value{}, true
+}
+
+// diffDefines compares the results of the expression definitions of two versions of a library.
+func diffDefines(baseline, current map[string]result.Value) []defineDiff {
+	diffs := []defineDiff{}
+	for name, b := range baseline {
+		d := defineDiff{Name: name, Status: defineRemoved, Baseline: &b}
+		if c, ok := current[name]; ok {
+			d.Current = &c
+			d.Status = defineChanged
+			if b.Equal(c) {
+				d.Status = defineUnchanged
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	for name, c := range current {
+		if _, ok := baseline[name]; !ok {
+			diffs = append(diffs, defineDiff{Name: name, Status: defineAdded, Current: &c})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(&compareRequest{
+		evalCQLRequest: evalCQLRequest{
+			CQL: strings.Join([]string{
+				"library Measure version '2.0'",
+				"parameter Threshold Integer default 10",
+				"define Same: 1",
+				"define Changed: Threshold + 1",
+				"define private Added: 'new'",
+			}, "\n"),
+			Parameters: map[string]string{"Threshold": "5"},
+		},
+		BaselineCQL: strings.Join([]string{
+			"library Measure version '1.0'",
+			"parameter Threshold Integer default 10",
+			"define Same: 1",
+			"define Changed: Threshold",
+			"define Removed: true",
+		}, "\n"),
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/compare", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/compare) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST to /compare returned status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var got struct {
+		BaselineLibrary string
+		CurrentLibrary  string
+		Defines         []struct {
+			Name     string
+			Status   string
+			Baseline *struct{ Value any }
+			Current  *struct{ Value any }
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding the /compare response returned an unexpected error: %v", err)
+	}
+	if got.BaselineLibrary != "Measure 1.0" || got.CurrentLibrary != "Measure 2.0" {
+		t.Errorf("POST to /compare compared libraries %q and %q, want Measure 1.0 and Measure 2.0", got.BaselineLibrary, got.CurrentLibrary)
+	}
+
+	type summary struct {
+		name, status      string
+		baseline, current any
+	}
+	want := []summary{
+		{name: "Added", status: defineAdded, current: "new"},
+		// The parameters apply to both versions.
+		{name: "Changed", status: defineChanged, baseline: 5.0, current: 6.0},
+		{name: "Removed", status: defineRemoved, baseline: true},
+		{name: "Same", status: defineUnchanged, baseline: 1.0, current: 1.0},
+	}
+	if len(got.Defines) != len(want) {
+		t.Fatalf("POST to /compare returned %d defines, want %d: %+v", len(got.Defines), len(want), got.Defines)
+	}
+	for i, d := range got.Defines {
+		s := summary{name: d.Name, status: d.Status}
+		if d.Baseline != nil {
+			s.baseline = d.Baseline.Value
+		}
+		if d.Current != nil {
+			s.current = d.Current.Value
+		}
+		if s != want[i] {
+			t.Errorf("POST to /compare returned define %+v, want %+v", s, want[i])
+		}
+	}
+}
+
+func TestCompare_Error(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "No baseline",
+			body:       `{"cql": "define X: 1"}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "no baseline CQL",
+		},
+		{
+			name:       "Baseline does not parse",
+			body:       `{"cql": "define X: 1", "baselineCql": "define X: ("}`,
+			wantStatus: http.StatusBadRequest,
+			wantError:  "failed to parse",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL+"/compare", "application/json", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("http.Post(/compare) returned an unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+			}
+			if resp.StatusCode != tc.wantStatus || !strings.Contains(string(got), tc.wantError) {
+				t.Errorf("POST to /compare returned %d %s, want %d containing %q", resp.StatusCode, got, tc.wantStatus, tc.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/cql/internal/editing"
+)
+
+type completeRequest struct {
+	evalCQLRequest
+	// Source is the index of the tab the cursor is in, 0 for the main CQL.
+	Source int `json:"source"`
+	// Line and Column are the 1-based line and 0-based column of the cursor.
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// handleComplete responds with the identifiers, valueset names, model properties and operators that
+// may be written at the cursor. The CQL is parsed to find the declarations in scope. If the CQL
+// does not parse, for example because the line at the cursor is being typed, it is parsed again
+// without that line.
+func handleComplete(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	completeReq := &completeRequest{}
+	if err := json.Unmarshal(body, completeReq); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	sources := completeReq.sources()
+	if completeReq.Source < 0 || completeReq.Source >= len(sources) {
+		sendError(w, fmt.Errorf("source %d is out of range", completeReq.Source), http.StatusBadRequest)
+		return
+	}
+	lines := strings.Split(sources[completeReq.Source], "\n")
+	if completeReq.Line < 1 || completeReq.Line > len(lines) {
+		sendError(w, fmt.Errorf("line %d is out of range", completeReq.Line), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := editing.Complete(req.Context(), sources, completeReq.Source, completeReq.Line, completeReq.Column)
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	sendJSON(w, resp)
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestComplete_Error(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(&completeRequest{evalCQLRequest: evalCQLRequest{CQL: "define X: 1"}, Source: 1, Line: 1})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/complete", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/complete) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST to /complete returned status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/google/cql/internal/editing"
+)
+
+// coveredExpression is how many times an expression of the CQL was evaluated.
+type coveredExpression struct {
+	// Source is the index of the tab in the sources of the evalCQLRequest the expression is in.
+	Source int `json:"source"`
+	// Locator is the 1-based position of the expression in the source, with an inclusive end.
+	StartLine int `json:"startLine"`
+	StartCol  int `json:"startCol"`
+	EndLine   int `json:"endLine"`
+	EndCol    int `json:"endCol"`
+	// Evaluations is zero if the expression was never reached.
+	Evaluations int `json:"evaluations"`
+}
+
+type coverageResponse struct {
+	// Covered is the number of expressions that were evaluated at least once, out of Total.
+	Covered int `json:"covered"`
+	Total   int `json:"total"`
+	// Expressions are sorted by source and position, with enclosing expressions first.
+	Expressions []coveredExpression `json:"expressions"`
+}
+
+// handleCoverage evaluates the CQL in debug mode, and responds with how many times each expression
+// in the definitions of the request's libraries was evaluated.
+func handleCoverage(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	coverageReq := &evalCQLRequest{}
+	if err := json.Unmarshal(body, coverageReq); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	elm, ok := parseRequest(req.Context(), w, coverageReq)
+	if !ok {
+		return
+	}
+	ret, err := coverageReq.retriever()
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	config, err := coverageReq.evalConfig()
+	if err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	config.ReturnPrivateDefs = true
+	config.Debug = true
+	results, err := elm.Eval(req.Context(), ret, config)
+	if err != nil {
+		sendError(w, fmt.Errorf("failed to eval: %w", err), http.StatusInternalServerError)
+		return
+	}
+	coverage, err := elm.Coverage(results)
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	sources := coverageReq.sources()
+	resp := coverageResponse{Expressions: []coveredExpression{}}
+	for _, c := range coverage {
+		lib := c.Locator.Library
+		source := editing.SourceIndex(sources, lib)
+		if source < 0 {
+			// Skip libraries that are not in the request, like FHIRHelpers.
+			continue
+		}
+		resp.Expressions = append(resp.Expressions, coveredExpression{
+			Source:      source,
+			StartLine:   c.Locator.StartLine,
+			StartCol:    c.Locator.StartCol,
+			EndLine:     c.Locator.EndLine,
+			EndCol:      c.Locator.EndCol,
+			Evaluations: c.Evaluations,
+		})
+		resp.Total++
+		if c.Evaluations > 0 {
+			resp.Covered++
+		}
+	}
+	// The coverage is sorted by library name, which may not be the order of the sources.
+	slices.SortStableFunc(resp.Expressions, func(a, b coveredExpression) int {
+		return cmp.Compare(a.Source, b.Source)
+	})
+	sendJSON(w, resp)
+}
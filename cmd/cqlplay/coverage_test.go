@@ -0,0 +1,90 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCoverage(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(&evalCQLRequest{
+		CQL: strings.Join([]string{
+			"library Main version '1.0'",
+			"include Helpers version '1.0' called Helpers",
+			"define Branch: if Helpers.Flag then 1 else 2",
+		}, "\n"),
+		Libraries: []string{"library Helpers version '1.0'\ndefine Flag: true"},
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/coverage", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/coverage) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST to /coverage returned status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var got coverageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding the /coverage response returned an unexpected error: %v", err)
+	}
+	want := coverageResponse{
+		Covered: 4,
+		Total:   5,
+		Expressions: []coveredExpression{
+			{Source: 0, StartLine: 3, StartCol: 16, EndLine: 3, EndCol: 44, Evaluations: 1},
+			{Source: 0, StartLine: 3, StartCol: 19, EndLine: 3, EndCol: 30, Evaluations: 1},
+			{Source: 0, StartLine: 3, StartCol: 37, EndLine: 3, EndCol: 37, Evaluations: 1},
+			{Source: 0, StartLine: 3, StartCol: 44, EndLine: 3, EndCol: 44, Evaluations: 0},
+			{Source: 1, StartLine: 2, StartCol: 14, EndLine: 2, EndCol: 17, Evaluations: 1},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("POST to /coverage returned a diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCoverage_Error(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/coverage", "application/json", strings.NewReader(`{"cql": "define X: ("}`))
+	if err != nil {
+		t.Fatalf("http.Post(/coverage) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST to /coverage returned status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
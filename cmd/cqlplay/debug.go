@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/result"
+)
+
+type debugRequest struct {
+	evalCQLRequest
+	// Define is the name of the expression definition in the main CQL to debug.
+	Define string `json:"define"`
+}
+
+// debugStep holds the values of one sub-expression of the debugged definition.
+type debugStep struct {
+	// Source is the index of the tab in the sources of the evalCQLRequest the sub-expression is in,
+	// or -1 if it is in a library that is not in the request, like FHIRHelpers.
+	Source  int    `json:"source"`
+	Library string `json:"library"`
+	// Locator is the 1-based position of the sub-expression in the source, with an inclusive end.
+	StartLine int `json:"startLine"`
+	StartCol  int `json:"startCol"`
+	EndLine   int `json:"endLine"`
+	EndCol    int `json:"endCol"`
+	// Values holds the value of each evaluation of the sub-expression, in evaluation order.
+	Values []result.Value `json:"values"`
+}
+
+type debugResponse struct {
+	Library string       `json:"library"`
+	Define  string       `json:"define"`
+	Value   result.Value `json:"value"`
+	Steps   []debugStep  `json:"steps"`
+}
+
+// handleDebug evaluates a single expression definition of the main CQL in debug mode, and responds
+// with the values of each of its sub-expressions keyed by their source locators.
+func handleDebug(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	debugReq := &debugRequest{}
+	if err := json.Unmarshal(body, debugReq); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if debugReq.Define == "" {
+		sendError(w, fmt.Errorf("no define to debug"), http.StatusBadRequest)
+		return
+	}
+
+	elm, ok := parseRequest(req.Context(), w, &debugReq.evalCQLRequest)
+	if !ok {
+		return
+	}
+	ret, err := debugReq.retriever()
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	config, err := debugReq.evalConfig()
+	if err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	config.ReturnPrivateDefs = true
+	config.Debug = true
+	config.DefineFilter = result.DefineFilter{IncludeNames: []string{debugReq.Define}}
+	config.SkipFilteredDefines = true
+	results, err := elm.Eval(req.Context(), ret, config)
+	if err != nil {
+		sendError(w, fmt.Errorf("failed to eval: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	sources := debugReq.sources()
+	for key, defs := range results {
+		v, ok := defs[debugReq.Define]
+		if !ok || editing.SourceIndex(sources, key) != 0 {
+			continue
+		}
+		trace, _ := v.DebugTrace()
+		sendJSON(w, debugResponse{
+			Library: key.String(),
+			Define:  debugReq.Define,
+			Value:   v,
+			Steps:   debugSteps(sources, trace),
+		})
+		return
+	}
+	sendError(w, fmt.Errorf("no expression definition %q in the main CQL", debugReq.Define), http.StatusBadRequest)
+}
+
+// debugSteps groups the trace by locator, ordered by the first evaluation of each locator.
+func debugSteps(sources []string, trace []result.DebugStep) []debugStep {
+	byLoc := result.ByLocator(trace)
+	steps := make([]debugStep, 0, len(byLoc))
+	seen := make(map[result.Locator]bool, len(byLoc))
+	for _, s := range trace {
+		if seen[s.Locator] {
+			continue
+		}
+		seen[s.Locator] = true
+		lib := s.Locator.Library
+		steps = append(steps, debugStep{
+			Source:    editing.SourceIndex(sources, lib),
+			Library:   lib.String(),
+			StartLine: s.Locator.StartLine,
+			StartCol:  s.Locator.StartCol,
+			EndLine:   s.Locator.EndLine,
+			EndCol:    s.Locator.EndCol,
+			Values:    byLoc[s.Locator],
+		})
+	}
+	return steps
+}
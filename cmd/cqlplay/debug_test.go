@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDebug(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(&debugRequest{
+		evalCQLRequest: evalCQLRequest{CQL: "library Explore version '1.2.3'\n" +
+			"define function Double(X Integer): X * 2\n" +
+			"define Nums: {1, 2}\n" +
+			"define Doubled: Nums N return Double(N)"},
+		Define: "Doubled",
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/debug", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/debug) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST to /debug returned status %d, want %d: %s", resp.StatusCode, http.StatusOK, data)
+	}
+
+	var got struct {
+		Library string `json:"library"`
+		Steps   []struct {
+			Source    int   `json:"source"`
+			StartLine int   `json:"startLine"`
+			StartCol  int   `json:"startCol"`
+			EndLine   int   `json:"endLine"`
+			EndCol    int   `json:"endCol"`
+			Values    []any `json:"values"`
+		} `json:"steps"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	if got.Library != "Explore 1.2.3" {
+		t.Errorf("POST to /debug returned library %q, want %q", got.Library, "Explore 1.2.3")
+	}
+	// The body of Double is evaluated once per row of the query.
+	found := false
+	for _, s := range got.Steps {
+		if s.StartLine != 2 || s.StartCol != 36 || s.EndLine != 2 || s.EndCol != 40 {
+			continue
+		}
+		found = true
+		if s.Source != 0 {
+			t.Errorf("POST to /debug returned source %d for the body of Double, want 0", s.Source)
+		}
+		if diff := cmp.Diff([]any{
+			map[string]any{"@type": "System.Integer", "value": 2.0},
+			map[string]any{"@type": "System.Integer", "value": 4.0},
+		}, s.Values); diff != "" {
+			t.Errorf("POST to /debug returned values of the body of Double with a diff (-want +got):\n%s", diff)
+		}
+	}
+	if !found {
+		t.Errorf("POST to /debug returned no step for the body of Double, got: %s", data)
+	}
+}
+
+func TestDebug_Error(t *testing.T) {
+	tests := []struct {
+		name   string
+		define string
+	}{
+		{name: "No define", define: ""},
+		{name: "Unknown define", define: "Missing"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := serverHandler()
+			if err != nil {
+				t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+			}
+			server := httptest.NewServer(h)
+			defer server.Close()
+
+			body, err := json.Marshal(&debugRequest{
+				evalCQLRequest: evalCQLRequest{CQL: "library Explore version '1.2.3'\ndefine result: 1"},
+				Define:         tc.define,
+			})
+			if err != nil {
+				t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+			}
+			resp, err := http.Post(server.URL+"/debug", "application/json", strings.NewReader(string(body)))
+			if err != nil {
+				t.Fatalf("http.Post(/debug) returned an unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("POST to /debug returned status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
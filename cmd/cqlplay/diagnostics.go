@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/cql"
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/parser"
+)
+
+// diagnostic is a problem in the CQL of one of the editor tabs.
+type diagnostic struct {
+	// Source is the index of the tab in the sources of the evalCQLRequest, 0 for the main CQL, or -1
+	// if the tab is not known.
+	Source  int    `json:"source"`
+	Library string `json:"library"`
+	// Line and Column are the 1-based line and 0-based column of the problem.
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+	// Severity is the severity of the problem, for example "Error" or "Warning".
+	Severity string `json:"severity,omitempty"`
+}
+
+type diagnosticsResponse struct {
+	Error       string       `json:"error"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+// parseDiagnostics returns a diagnostic for each parsing error in err, or nil if err does not hold
+// parsing errors.
+func parseDiagnostics(sources []string, err error) []diagnostic {
+	var libErrs *parser.LibraryErrors
+	if !errors.As(err, &libErrs) {
+		return nil
+	}
+	source := editing.SourceIndex(sources, libErrs.LibKey)
+	diags := make([]diagnostic, 0, len(libErrs.Errors))
+	for _, pe := range libErrs.Errors {
+		msg := pe.Message
+		if pe.Cause != nil {
+			msg += ": " + pe.Cause.Error()
+		}
+		// Errors that fail parsing are errors unless the parser marks them otherwise.
+		severity := pe.Severity
+		if severity == "" {
+			severity = parser.ErrorSeverityError
+		}
+		diags = append(diags, diagnostic{
+			Source:   source,
+			Library:  libErrs.LibKey.String(),
+			Line:     pe.Line,
+			Column:   pe.Column,
+			Message:  msg,
+			Severity: string(severity),
+		})
+	}
+	return diags
+}
+
+// sendParseError sends the parsing errors in err as JSON diagnostics keyed to the editor tabs, or
+// as a plain error if err does not hold parsing errors.
+func sendParseError(w http.ResponseWriter, sources []string, err error) {
+	diags := parseDiagnostics(sources, err)
+	if diags == nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	b, mErr := json.MarshalIndent(diagnosticsResponse{Error: err.Error(), Diagnostics: diags}, "", "  ")
+	if mErr != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(b)
+}
+
+// handleDiagnostics parses the CQL of the request without evaluating it, and responds with the
+// parsing errors so the editor can show them while the user types. Unlike /eval_cql, CQL that fails
+// to parse is not an error of the request, so the response status is 200 with the diagnostics.
+func handleDiagnostics(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	diagReq := &evalCQLRequest{}
+	if err := json.Unmarshal(body, diagReq); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	fhirHelpers, err := cql.FHIRHelpersLib("4.0.1")
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	sources := diagReq.sources()
+	resp := diagnosticsResponse{Diagnostics: []diagnostic{}}
+	if _, err := cql.Parse(req.Context(), append(sources, fhirHelpers), cql.ParseConfig{DataModels: [][]byte{fhirDM}}); err != nil {
+		resp.Error = fmt.Sprintf("failed to parse: %v", err)
+		if diags := parseDiagnostics(sources, err); diags != nil {
+			resp.Diagnostics = diags
+		}
+	}
+	sendJSON(w, resp)
+}
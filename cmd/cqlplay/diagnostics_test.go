@@ -0,0 +1,207 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestEvalCQL_Libraries(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(evalCQLRequest{
+		CQL: dedent.Dedent(`
+			library Explore version '1.2.3'
+			include Helpers version '1.0.0' called H
+			define result: H.Double(2)`),
+		Libraries: []string{dedent.Dedent(`
+			library Helpers version '1.0.0'
+			define function Double(x Integer): x * 2`)},
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/eval_cql) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(got), `"value": 4`) {
+		t.Errorf("POST to /eval_cql returned %d %s, want the result of the included function", resp.StatusCode, got)
+	}
+}
+
+func TestEvalCQL_ParseDiagnostics(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		req  evalCQLRequest
+		want []diagnostic
+	}{
+		{
+			name: "Error in main CQL",
+			req: evalCQLRequest{
+				CQL: "library Explore version '1.2.3'\ndefine result: Missing",
+			},
+			want: []diagnostic{{
+				Source:   0,
+				Library:  "Explore 1.2.3",
+				Line:     2,
+				Column:   15,
+				Message:  "could not resolve the local reference to Missing",
+				Severity: "Error",
+			}},
+		},
+		{
+			name: "Error in library tab",
+			req: evalCQLRequest{
+				CQL: "library Explore version '1.2.3'\ninclude Helpers version '1.0.0' called H\ndefine result: 1",
+				Libraries: []string{
+					"library Other version '1.0.0'\ndefine other: 1",
+					"library Helpers version '1.0.0'\ndefine helper: Missing",
+				},
+			},
+			want: []diagnostic{{
+				Source:   2,
+				Library:  "Helpers 1.0.0",
+				Line:     2,
+				Column:   15,
+				Message:  "could not resolve the local reference to Missing",
+				Severity: "Error",
+			}},
+		},
+		{
+			name: "Unnamed library",
+			req: evalCQLRequest{
+				CQL: "define result: Missing",
+			},
+			want: []diagnostic{{
+				Source:   0,
+				Library:  "Unnamed Library",
+				Line:     1,
+				Column:   15,
+				Message:  "could not resolve the local reference to Missing",
+				Severity: "Error",
+			}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.req)
+			if err != nil {
+				t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+			}
+			resp, err := http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader(string(body)))
+			if err != nil {
+				t.Fatalf("http.Post(/eval_cql) returned an unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("POST to /eval_cql returned status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+			var got diagnosticsResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("decoding the /eval_cql response returned an unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got.Diagnostics); diff != "" {
+				t.Errorf("POST to /eval_cql returned a diff in diagnostics (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		req       evalCQLRequest
+		want      []diagnostic
+		wantError bool
+	}{
+		{
+			name: "Valid CQL",
+			req:  evalCQLRequest{CQL: "library Explore version '1.2.3'\ndefine result: 1"},
+			want: []diagnostic{},
+		},
+		{
+			name: "Invalid CQL",
+			req:  evalCQLRequest{CQL: "library Explore version '1.2.3'\ndefine result: Missing"},
+			want: []diagnostic{{
+				Source:   0,
+				Library:  "Explore 1.2.3",
+				Line:     2,
+				Column:   15,
+				Message:  "could not resolve the local reference to Missing",
+				Severity: "Error",
+			}},
+			wantError: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.req)
+			if err != nil {
+				t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+			}
+			resp, err := http.Post(server.URL+"/diagnostics", "application/json", strings.NewReader(string(body)))
+			if err != nil {
+				t.Fatalf("http.Post(/diagnostics) returned an unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("POST to /diagnostics returned status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			var got diagnosticsResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("decoding the /diagnostics response returned an unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got.Diagnostics); diff != "" {
+				t.Errorf("POST to /diagnostics returned a diff in diagnostics (-want +got):\n%s", diff)
+			}
+			if gotError := got.Error != ""; gotError != tc.wantError {
+				t.Errorf("POST to /diagnostics returned error %q, want an error: %v", got.Error, tc.wantError)
+			}
+		})
+	}
+}
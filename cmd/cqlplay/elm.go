@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/google/cql/internal/editing"
+)
+
+// elmLibrary is the ELM of one of the editor tabs.
+type elmLibrary struct {
+	// Source is the index of the tab in the sources of the evalCQLRequest, 0 for the main CQL.
+	Source  int             `json:"source"`
+	Library string          `json:"library"`
+	ELM     json.RawMessage `json:"elm"`
+}
+
+type elmResponse struct {
+	Libraries []elmLibrary `json:"libraries"`
+}
+
+// handleELM responds with the ELM styled JSON of each library in the request, so users can see how
+// their CQL was interpreted. Libraries that are not in the request, like FHIRHelpers, are left out.
+func handleELM(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	elmReq := &evalCQLRequest{}
+	if err := json.Unmarshal(body, elmReq); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	elm, ok := parseRequest(req.Context(), w, elmReq)
+	if !ok {
+		return
+	}
+	libs, err := elm.LibrariesJSON()
+	if err != nil {
+		sendError(w, fmt.Errorf("failed to encode ELM: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	sources := elmReq.sources()
+	resp := elmResponse{Libraries: []elmLibrary{}}
+	for key, b := range libs {
+		source := editing.SourceIndex(sources, key)
+		if source < 0 {
+			continue
+		}
+		resp.Libraries = append(resp.Libraries, elmLibrary{Source: source, Library: key.String(), ELM: b})
+	}
+	sort.Slice(resp.Libraries, func(i, j int) bool { return resp.Libraries[i].Source < resp.Libraries[j].Source })
+	sendJSON(w, resp)
+}
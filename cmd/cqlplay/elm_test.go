@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestELM(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(&evalCQLRequest{
+		CQL:       "library Explore version '1.2.3'\ninclude Helpers version '1.0' called Helpers\ndefine result: Helpers.One + 1",
+		Libraries: []string{"library Helpers version '1.0'\ndefine One: 1"},
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/elm", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/elm) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST to /elm returned status %d, want %d: %s", resp.StatusCode, http.StatusOK, data)
+	}
+
+	var got struct {
+		Libraries []struct {
+			Source  int    `json:"source"`
+			Library string `json:"library"`
+			ELM     struct {
+				Library struct {
+					Statements struct {
+						Defs []struct {
+							Name       string `json:"name"`
+							Expression struct {
+								Type string `json:"type"`
+							} `json:"expression"`
+						} `json:"defs"`
+					} `json:"statements"`
+				} `json:"library"`
+			} `json:"elm"`
+		} `json:"libraries"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	var gotLibs []string
+	for _, l := range got.Libraries {
+		gotLibs = append(gotLibs, l.Library)
+	}
+	if diff := cmp.Diff([]string{"Explore 1.2.3", "Helpers 1.0"}, gotLibs); diff != "" {
+		t.Fatalf("POST to /elm returned libraries with a diff (-want +got):\n%s", diff)
+	}
+	if got.Libraries[1].Source != 1 {
+		t.Errorf("POST to /elm returned source %d for Helpers, want 1", got.Libraries[1].Source)
+	}
+	defs := got.Libraries[0].ELM.Library.Statements.Defs
+	if len(defs) != 1 || defs[0].Name != "result" || defs[0].Expression.Type != "Add" {
+		t.Errorf("POST to /elm returned defs %+v, want result holding an Add", defs)
+	}
+}
+
+func TestELM_ParseError(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(&evalCQLRequest{CQL: "library Explore version '1.2.3'\ndefine result: 1 +"})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/elm", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/elm) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST to /elm returned status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
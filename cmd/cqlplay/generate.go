@@ -0,0 +1,286 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/cql"
+	"github.com/google/cql/internal/modelinfo"
+	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/local"
+	"github.com/google/cql/terminology"
+	"github.com/google/cql/types"
+)
+
+// measurementPeriodName is the parameter the sample data dates are generated within.
+const measurementPeriodName = "Measurement Period"
+
+// patientID is the id of the Patient in generated sample data.
+const patientID = "1"
+
+// fhirDateTimeLayout formats FHIR dateTimes with an explicit offset, which the engine requires
+// instead of Z.
+const fhirDateTimeLayout = "2006-01-02T15:04:05-07:00"
+
+// dateProperties are the properties, in order of preference, that are set to a date inside the
+// measurement period on generated resources.
+var dateProperties = []string{"period", "effective", "onset", "performed", "occurrence", "authoredOn", "recordedDate", "issued", "date"}
+
+// handleGenerateData responds with a FHIR Bundle that satisfies the data requirements of the CQL in
+// the request. Resources are given codes from the ValueSets they are retrieved by and dates inside
+// the Measurement Period parameter, so that the retrieves of the CQL return data.
+func handleGenerateData(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	genReq := &evalCQLRequest{}
+	if err := json.Unmarshal(body, genReq); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	elm, ok := parseRequest(req.Context(), w, genReq)
+	if !ok {
+		return
+	}
+	reqs, err := elm.DataRequirements()
+	if err != nil {
+		sendError(w, fmt.Errorf("failed to compute data requirements: %w", err), http.StatusInternalServerError)
+		return
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	mi, err := modelinfo.New([][]byte{fhirDM})
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := mi.SetUsing(modelinfo.Key{Name: "FHIR", Version: "4.0.1"}); err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	tp, err := genReq.terminologyProvider()
+	if err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	low, high := measurementPeriod(req.Context(), elm, time.Now())
+	bundle, err := sampleBundle(reqs, mi, tp, low, high)
+	if err != nil {
+		sendError(w, fmt.Errorf("failed to generate sample data: %w", err), http.StatusInternalServerError)
+		return
+	}
+	sendJSON(w, bundle)
+}
+
+// measurementPeriod returns the bounds of the Measurement Period parameter of the parsed CQL. If
+// there is no such parameter, or it has no default, the calendar year of now is returned.
+func measurementPeriod(ctx context.Context, elm *cql.ELM, now time.Time) (time.Time, time.Time) {
+	yearStart := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	low, high := yearStart, yearStart.AddDate(1, 0, 0)
+
+	results, err := elm.Eval(ctx, &local.Retriever{}, cql.EvalConfig{
+		Terminology:         tp,
+		DefineFilter:        result.DefineFilter{IncludeNames: []string{measurementPeriodName}},
+		SkipFilteredDefines: true,
+	})
+	if err != nil {
+		return low, high
+	}
+	for _, lib := range results {
+		v, ok := lib[measurementPeriodName]
+		if !ok {
+			continue
+		}
+		interval, ok := v.GolangValue().(result.Interval)
+		if !ok {
+			continue
+		}
+		l, lok := toTime(interval.Low)
+		h, hok := toTime(interval.High)
+		if lok && hok && !h.Before(l) {
+			return l, h
+		}
+	}
+	return low, high
+}
+
+func toTime(v result.Value) (time.Time, bool) {
+	switch t := v.GolangValue().(type) {
+	case result.DateTime:
+		return t.Date, true
+	case result.Date:
+		return t.Date, true
+	}
+	return time.Time{}, false
+}
+
+// sampleBundle builds a transaction Bundle with a Patient and one resource for each non Patient
+// data requirement. Properties are typed according to the FHIR model info in mi.
+func sampleBundle(reqs []retriever.DataRequirement, mi *modelinfo.ModelInfos, tp terminology.Provider, low, high time.Time) (map[string]any, error) {
+	when := low.Add(high.Sub(low) / 2)
+	entries := []any{entry(map[string]any{
+		"resourceType": "Patient",
+		"id":           patientID,
+		"birthDate":    low.AddDate(-40, 0, 0).Format("2006-01-02"),
+		"gender":       "female",
+	})}
+
+	for i, r := range reqs {
+		if r.ResourceType == "Patient" {
+			continue
+		}
+		resource := map[string]any{
+			"resourceType": r.ResourceType,
+			"id":           fmt.Sprintf("%d", i+1),
+		}
+		parent := &types.Named{TypeName: "FHIR." + r.ResourceType}
+		for _, prop := range []string{"subject", "patient"} {
+			if _, err := mi.PropertyTypeSpecifier(parent, prop); err == nil {
+				resource[prop] = map[string]any{"reference": "Patient/" + patientID}
+				break
+			}
+		}
+		if r.CodeFilter != nil && r.CodeFilter.ValueSetURL != "" {
+			if code := firstCode(tp, r.CodeFilter.ValueSetURL, r.CodeFilter.ValueSetVersion); code != nil {
+				typ, err := mi.PropertyTypeSpecifier(parent, r.CodeFilter.Property)
+				if err != nil {
+					return nil, err
+				}
+				if key, val, ok := codeValue(r.CodeFilter.Property, typ, code); ok {
+					resource[key] = val
+				}
+			}
+		}
+		for _, prop := range dateProperties {
+			typ, err := mi.PropertyTypeSpecifier(parent, prop)
+			if err != nil {
+				continue
+			}
+			if key, val, ok := dateValue(prop, typ, when); ok {
+				resource[key] = val
+				break
+			}
+		}
+		entries = append(entries, entry(resource))
+	}
+
+	return map[string]any{
+		"resourceType": "Bundle",
+		"type":         "transaction",
+		"entry":        entries,
+	}, nil
+}
+
+func entry(resource map[string]any) map[string]any {
+	return map[string]any{"resource": resource}
+}
+
+// firstCode returns the first code, ordered by system and code, in the expansion of the ValueSet.
+// Nil is returned if the ValueSet is not loaded in the terminology provider or is empty.
+func firstCode(tp terminology.Provider, url, version string) *terminology.Code {
+	codes, err := tp.ExpandValueSet(url, version)
+	if err != nil || len(codes) == 0 {
+		return nil
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if codes[i].System != codes[j].System {
+			return codes[i].System < codes[j].System
+		}
+		return codes[i].Code < codes[j].Code
+	})
+	return codes[0]
+}
+
+// codeValue returns the JSON key and value setting a property of type typ to code.
+func codeValue(name string, typ types.IType, code *terminology.Code) (string, any, bool) {
+	coding := map[string]any{"system": code.System, "code": code.Code}
+	if code.Display != "" {
+		coding["display"] = code.Display
+	}
+	switch t := typ.(type) {
+	case *types.Named:
+		switch t.TypeName {
+		case "FHIR.CodeableConcept":
+			return name, map[string]any{"coding": []any{coding}}, true
+		case "FHIR.Coding":
+			return name, coding, true
+		}
+	case *types.List:
+		if key, val, ok := codeValue(name, t.ElementType, code); ok {
+			return key, []any{val}, true
+		}
+	case *types.Choice:
+		for _, c := range t.ChoiceTypes {
+			if key, val, ok := codeValue(name, c, code); ok {
+				return key + choiceSuffix(c), val, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// dateValue returns the JSON key and value setting a property of type typ to t.
+func dateValue(name string, typ types.IType, t time.Time) (string, any, bool) {
+	switch ty := typ.(type) {
+	case *types.Named:
+		switch ty.TypeName {
+		case "FHIR.dateTime", "FHIR.instant":
+			return name, t.Format(fhirDateTimeLayout), true
+		case "FHIR.date":
+			return name, t.Format("2006-01-02"), true
+		case "FHIR.Period":
+			return name, map[string]any{
+				"start": t.Format(fhirDateTimeLayout),
+				"end":   t.Add(time.Hour).Format(fhirDateTimeLayout),
+			}, true
+		}
+	case *types.Choice:
+		for _, c := range ty.ChoiceTypes {
+			if key, val, ok := dateValue(name, c, t); ok {
+				return key + choiceSuffix(c), val, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// choiceSuffix returns the suffix of a FHIR choice property for typ, for example
+// effective[x] is set as effectiveDateTime.
+func choiceSuffix(typ types.IType) string {
+	n, ok := typ.(*types.Named)
+	if !ok {
+		return ""
+	}
+	s := strings.TrimPrefix(n.TypeName, "FHIR.")
+	if s == "" {
+		return ""
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestGenerateData(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	cql := dedent.Dedent(`
+		library Explore version '1.2.3'
+		using FHIR version '4.0.1'
+		include FHIRHelpers version '4.0.1' called FHIRHelpers
+		valueset "Glucose": 'https://example.com/vs/glucose'
+		parameter "Measurement Period" Interval<DateTime> default Interval[@2024-01-01T00:00:00Z, @2025-01-01T00:00:00Z)
+		context Patient
+		define "Glucose Readings": [Observation: "Glucose"] O where O.effective in "Measurement Period"
+		define Encounters: [Encounter]`)
+	body, err := json.Marshal(&evalCQLRequest{CQL: cql})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/generate_data", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/generate_data) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST to /generate_data returned status %d, want %d: %s", resp.StatusCode, http.StatusOK, data)
+	}
+
+	var bundle struct {
+		Entry []struct {
+			Resource map[string]any `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+	}
+	byType := map[string]map[string]any{}
+	for _, e := range bundle.Entry {
+		byType[e.Resource["resourceType"].(string)] = e.Resource
+	}
+	var gotTypes []string
+	for _, e := range bundle.Entry {
+		gotTypes = append(gotTypes, e.Resource["resourceType"].(string))
+	}
+	if diff := cmp.Diff([]string{"Patient", "Encounter", "Observation"}, gotTypes); diff != "" {
+		t.Errorf("generated resource types returned a diff (-want +got):\n%s", diff)
+	}
+
+	obs := byType["Observation"]
+	wantCode := map[string]any{"coding": []any{map[string]any{
+		"system":  "https://example.com/cs/diagnosis",
+		"code":    "gluc",
+		"display": "Glucose In Blood",
+	}}}
+	if diff := cmp.Diff(wantCode, obs["code"]); diff != "" {
+		t.Errorf("generated Observation.code returned a diff (-want +got):\n%s", diff)
+	}
+	if got, want := obs["effectiveDateTime"], "2024-07-02T00:00:00+00:00"; got != want {
+		t.Errorf("generated Observation.effectiveDateTime = %v, want %v", got, want)
+	}
+	if diff := cmp.Diff(map[string]any{"reference": "Patient/1"}, obs["subject"]); diff != "" {
+		t.Errorf("generated Observation.subject returned a diff (-want +got):\n%s", diff)
+	}
+	if got, want := byType["Encounter"]["period"].(map[string]any)["start"], "2024-07-02T00:00:00+00:00"; got != want {
+		t.Errorf("generated Encounter.period.start = %v, want %v", got, want)
+	}
+
+	// Evaluating the generated data should return the generated resources.
+	body, err = json.Marshal(&evalCQLRequest{CQL: cql, Data: string(data)})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err = http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/eval_cql) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	results, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+	}
+	if !strings.Contains(string(results), `"@type": "FHIR.Observation"`) {
+		t.Errorf("evaluating the generated data did not retrieve the Observation, got: %s", results)
+	}
+}
+
+func TestMeasurementPeriod_Default(t *testing.T) {
+	if _, err := serverHandler(); err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	r := httptest.NewRecorder()
+	elm, ok := parseRequest(context.Background(), r, &evalCQLRequest{CQL: "library Explore version '1.2.3'\ndefine result: 1"})
+	if !ok {
+		t.Fatalf("parseRequest() failed: %s", r.Body.String())
+	}
+	now := time.Date(2023, time.March, 4, 0, 0, 0, 0, time.UTC)
+	low, high := measurementPeriod(context.Background(), elm, now)
+	if want := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC); !low.Equal(want) {
+		t.Errorf("measurementPeriod() low = %v, want %v", low, want)
+	}
+	if want := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC); !high.Equal(want) {
+		t.Errorf("measurementPeriod() high = %v, want %v", high, want)
+	}
+}
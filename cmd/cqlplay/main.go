@@ -12,23 +12,31 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// cqlplay is an experimental	Go program that serves our CQL playground on localhost:8080. This is
+// cqlplay is an experimental	Go program that serves our CQL playground, by default on localhost:8080. This is
 // NOT meant to be run in production, but is a useful tool for playing with and testing our CQL
 // engine.
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
-	"flag"
 	log "github.com/golang/glog"
 	"github.com/google/cql"
+	"github.com/google/cql/internal/datehelpers"
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/fhirserver"
 	"github.com/google/cql/retriever/local"
 	"github.com/google/cql/terminology"
 )
@@ -39,25 +47,19 @@ var staticAssets embed.FS
 //go:embed testdata/terminology/*.json
 var terminologyDir embed.FS
 
-func main() {
-	flag.Parse()
-	if err := serve(); err != nil {
-		log.Fatalf("cqlplay failed with an error: %v", err)
-	}
-
-}
-
 // tp is a shared terminology provider. This must be thread safe.
 var tp *terminology.LocalFHIRProvider
 
-func serve() error {
-	mux, err := serverHandler()
-	if err != nil {
-		return err
-	}
-	fmt.Println("serving on port 8080, try http://localhost:8080")
-	return http.ListenAndServe("localhost:8080", mux)
-}
+// maxRequestBytes is the largest request body the endpoints accept.
+var maxRequestBytes int64 = 5e6
+
+// fhirServerClient is used for requests to the FHIR servers set in requests.
+var fhirServerClient = &http.Client{Timeout: 30 * time.Second}
+
+// allowedFHIRServers are the URL prefixes of the FHIR servers that requests may point the
+// playground at, set by --allowed_endpoints. * allows any server. By default none are allowed, so
+// that requests can not make the playground connect to internal addresses.
+var allowedFHIRServers []string
 
 func serverHandler() (http.Handler, error) {
 	var err error
@@ -77,16 +79,31 @@ func serverHandler() (http.Handler, error) {
 
 	// eval_cql is the evaluation endpoint for CQL.
 	mux.HandleFunc("/eval_cql", handleEvalCQL)
+	// share creates and resolves permalinks to the state of the playground.
+	mux.HandleFunc("/share", handleShare)
+	// generate_data creates sample data satisfying the data requirements of the CQL.
+	mux.HandleFunc("/generate_data", handleGenerateData)
+	// elm returns the parsed model of the CQL as ELM styled JSON.
+	mux.HandleFunc("/elm", handleELM)
+	// debug evaluates one definition and returns the value of each of its sub-expressions.
+	mux.HandleFunc("/debug", handleDebug)
+	// complete returns the completions at a cursor position in the CQL.
+	mux.HandleFunc("/complete", handleComplete)
+	// diagnostics parses the CQL without evaluating it and returns the parsing errors.
+	mux.HandleFunc("/diagnostics", handleDiagnostics)
+	// parameters returns the parameters declared by the main CQL.
+	mux.HandleFunc("/parameters", handleParameters)
+	// coverage returns how many times each expression of the CQL was evaluated.
+	mux.HandleFunc("/coverage", handleCoverage)
+	// compare diffs the results of the main CQL against a baseline version of it.
+	mux.HandleFunc("/compare", handleCompare)
 
 	return mux, nil
 }
 
 func handleEvalCQL(w http.ResponseWriter, req *http.Request) {
-	// 5MB limit for body size:
-	bodyR := io.LimitReader(req.Body, 5e6)
-	inputCQL, err := io.ReadAll(bodyR)
-	if err != nil {
-		sendError(w, err, http.StatusInternalServerError)
+	inputCQL, ok := readBody(w, req)
+	if !ok {
 		return
 	}
 	evalCQLReq := &evalCQLRequest{}
@@ -96,34 +113,24 @@ func handleEvalCQL(w http.ResponseWriter, req *http.Request) {
 	}
 	log.Infof("Request: %+v", evalCQLReq)
 
-	fhirDM, err := cql.FHIRDataModel("4.0.1")
-	if err != nil {
-		sendError(w, err, http.StatusInternalServerError)
+	elm, ok := parseRequest(req.Context(), w, evalCQLReq)
+	if !ok {
 		return
 	}
-	fhirHelpers, err := cql.FHIRHelpersLib("4.0.1")
+
+	ret, err := evalCQLReq.retriever()
 	if err != nil {
 		sendError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	elm, err := cql.Parse(req.Context(), []string{evalCQLReq.CQL, fhirHelpers}, cql.ParseConfig{DataModels: [][]byte{fhirDM}})
+	config, err := evalCQLReq.evalConfig()
 	if err != nil {
-		sendError(w, fmt.Errorf("failed to parse: %w", err), http.StatusInternalServerError)
+		sendError(w, err, http.StatusBadRequest)
 		return
 	}
-
-	var ret *local.Retriever
-	if evalCQLReq.Data != "" {
-		ret, err = local.NewRetrieverFromR4Bundle([]byte(evalCQLReq.Data))
-		if err != nil {
-			sendError(w, fmt.Errorf("unable to load patient bundle: %w", err), http.StatusInternalServerError)
-			return
-		}
-	}
-
 	start := time.Now()
-	results, err := elm.Eval(req.Context(), ret, cql.EvalConfig{Terminology: tp})
+	results, err := elm.Eval(req.Context(), ret, config)
 	if err != nil {
 		sendError(w, fmt.Errorf("failed to eval: %w", err), http.StatusInternalServerError)
 		return
@@ -140,18 +147,202 @@ func handleEvalCQL(w http.ResponseWriter, req *http.Request) {
 	w.Write(resJSON)
 }
 
+// parseRequest parses the CQL of the request along with FHIRHelpers. If parsing fails the error is
+// sent to w and false is returned.
+func parseRequest(ctx context.Context, w http.ResponseWriter, r *evalCQLRequest) (*cql.ELM, bool) {
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	fhirHelpers, err := cql.FHIRHelpersLib("4.0.1")
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	params, err := r.parameters()
+	if err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+	sources := r.sources()
+	elm, err := cql.Parse(ctx, append(sources, fhirHelpers), cql.ParseConfig{DataModels: [][]byte{fhirDM}, Parameters: params})
+	if err != nil {
+		sendParseError(w, sources, fmt.Errorf("failed to parse: %w", err))
+		return nil, false
+	}
+	return elm, true
+}
+
+// readBody reads the body of the request, up to maxRequestBytes. If the body can not be read, or
+// is too large, an error is sent and ok is false.
+func readBody(w http.ResponseWriter, req *http.Request) (body []byte, ok bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRequestBytes))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		sendError(w, fmt.Errorf("the request is larger than the limit of %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	return body, true
+}
+
 func sendError(w http.ResponseWriter, err error, code int) {
 	log.Errorf("%v", err)
-	w.Write([]byte("Error: " + err.Error())) // be careful in the future, may not always want to send full error strings to the client
+	// The status code must be written before the body, or it is ignored.
 	w.WriteHeader(code)
+	w.Write([]byte("Error: " + err.Error())) // be careful in the future, may not always want to send full error strings to the client
 }
 
 type evalCQLRequest struct {
-	CQL  string `json:"cql"`
-	Data string `json:"data"`
+	CQL string `json:"cql"`
+	// Libraries are the sources of additional CQL libraries, which may be included by CQL.
+	Libraries []string `json:"libraries,omitempty"`
+	Data      string   `json:"data"`
+	// EvaluationTimestamp optionally overrides the time of evaluation used by Now() and Today(), as a
+	// CQL DateTime like @2024-01-01T00:00:00.0Z.
+	EvaluationTimestamp string `json:"evaluationTimestamp,omitempty"`
+	// Parameters optionally override the parameters of the main CQL, keyed by parameter name. The
+	// values are CQL literals like Interval[@2024-01-01, @2025-01-01).
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Terminology optionally holds a FHIR ValueSet, CodeSystem or ConceptMap, or a Bundle of them,
+	// which is used alongside the built in terminology.
+	Terminology string `json:"terminology,omitempty"`
+	// FHIRServer optionally points the playground at a patient on a FHIR server, whose resources are
+	// used instead of Data.
+	FHIRServer *fhirServerRequest `json:"fhirServer,omitempty"`
+}
+
+// fhirServerRequest identifies a patient on a FHIR server.
+type fhirServerRequest struct {
+	// URL is the FHIR base URL of the server, for example https://hapi.fhir.org/baseR4.
+	URL       string `json:"url"`
+	PatientID string `json:"patientId"`
+	// BearerToken is optionally sent as the Authorization header of requests to the server. It is
+	// never included in share links.
+	BearerToken string `json:"bearerToken,omitempty"`
+}
+
+// sources returns the CQL source of each editor tab, starting with the main CQL.
+func (r *evalCQLRequest) sources() []string {
+	return append([]string{r.CQL}, r.Libraries...)
+}
+
+// parameters returns the parameters of the request keyed by the main CQL library.
+func (r *evalCQLRequest) parameters() (map[result.DefKey]string, error) {
+	if len(r.Parameters) == 0 {
+		return nil, nil
+	}
+	lib, ok := editing.LibraryDeclaration(r.CQL)
+	if !ok {
+		return nil, fmt.Errorf("parameters can only be set for a named library")
+	}
+	params := make(map[result.DefKey]string, len(r.Parameters))
+	for name, value := range r.Parameters {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		params[result.DefKey{Name: name, Library: lib}] = value
+	}
+	return params, nil
+}
+
+// evalConfig returns the configuration to evaluate the request with.
+func (r *evalCQLRequest) evalConfig() (cql.EvalConfig, error) {
+	tp, err := r.terminologyProvider()
+	if err != nil {
+		return cql.EvalConfig{}, err
+	}
+	config := cql.EvalConfig{Terminology: tp}
+	if ts := strings.TrimSpace(r.EvaluationTimestamp); ts != "" {
+		if !strings.HasPrefix(ts, "@") {
+			ts = "@" + ts
+		}
+		t, _, err := datehelpers.ParseDateTime(ts, time.UTC)
+		if err != nil {
+			return cql.EvalConfig{}, fmt.Errorf("invalid evaluation timestamp %q: %w", r.EvaluationTimestamp, err)
+		}
+		config.EvaluationTimestamp = t
+	}
+	return config, nil
+}
+
+// terminologyProvider returns the shared terminology provider, extended with the terminology of
+// the request if it has any.
+func (r *evalCQLRequest) terminologyProvider() (*terminology.LocalFHIRProvider, error) {
+	if strings.TrimSpace(r.Terminology) == "" {
+		return tp, nil
+	}
+	resources, err := builtinTerminology()
+	if err != nil {
+		return nil, err
+	}
+	p, err := terminology.NewInMemoryFHIRProvider(append(resources, r.Terminology))
+	if err != nil {
+		return nil, fmt.Errorf("invalid terminology: %w", err)
+	}
+	return p, nil
+}
+
+// retriever returns a retriever over the patient on the FHIR server of the request if there is
+// one, and otherwise over the data of the request, which may be empty.
+func (r *evalCQLRequest) retriever() (retriever.Retriever, error) {
+	if r.FHIRServer != nil && r.FHIRServer.URL != "" {
+		u, err := url.Parse(r.FHIRServer.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("the FHIR server must have an http or https URL, got %q", r.FHIRServer.URL)
+		}
+		if !fhirServerAllowed(r.FHIRServer.URL) {
+			return nil, fmt.Errorf("the FHIR server %s is not allowed by this playground, see --allowed_endpoints", r.FHIRServer.URL)
+		}
+		cfg := fhirserver.Config{
+			BaseURL:     r.FHIRServer.URL,
+			Client:      fhirServerClient,
+			BearerToken: r.FHIRServer.BearerToken,
+		}
+		ret, err := fhirserver.New(cfg, r.FHIRServer.PatientID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to the FHIR server: %w", err)
+		}
+		return ret, nil
+	}
+	if r.Data == "" {
+		return nil, nil
+	}
+	ret, err := local.NewRetrieverFromR4Bundle([]byte(r.Data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load patient bundle: %w", err)
+	}
+	return ret, nil
+}
+
+// fhirServerAllowed returns true if the URL starts with one of the allowed FHIR server prefixes.
+func fhirServerAllowed(address string) bool {
+	for _, prefix := range allowedFHIRServers {
+		if prefix == "*" || strings.HasPrefix(address, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 func getTerminologyProvider() (*terminology.LocalFHIRProvider, error) {
+	valuesets, err := builtinTerminology()
+	if err != nil {
+		return nil, err
+	}
+	tp, err := terminology.NewInMemoryFHIRProvider(valuesets)
+	if err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
+
+// builtinTerminology returns the JSON of the terminology resources embedded in the playground.
+func builtinTerminology() ([]string, error) {
 	entries, err := terminologyDir.ReadDir("testdata/terminology")
 	if err != nil {
 		return nil, err
@@ -165,9 +356,5 @@ func getTerminologyProvider() (*terminology.LocalFHIRProvider, error) {
 		}
 		valuesets = append(valuesets, string(eData))
 	}
-	tp, err := terminology.NewInMemoryFHIRProvider(valuesets)
-	if err != nil {
-		return nil, err
-	}
-	return tp, nil
+	return valuesets, nil
 }
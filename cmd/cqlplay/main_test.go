@@ -42,8 +42,12 @@ func TestServerHandler(t *testing.T) {
 			define result: 1+1`),
 			wantOutput: `[
 				{
+					"formatVersion": "1.1",
 					"libName": "Explore",
 					"libVersion": "1.2.3",
+					"defineMetadata": {
+						"result": {"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.Integer", "libVersion": "1.2.3"}
+					},
 					"expressionDefinitions": {
 						"result": {
 								"@type": "System.Integer",
@@ -75,8 +79,12 @@ func TestServerHandler(t *testing.T) {
 			}`,
 			wantOutput: `[
 				{
+					"formatVersion": "1.1",
 					"libName": "Explore",
 					"libVersion": "1.2.3",
+					"defineMetadata": {
+						"result": {"kind": "expressionDefinition", "accessLevel": "PUBLIC", "declaredType": "System.String", "libVersion": "1.2.3"}
+					},
 					"expressionDefinitions": {
 						"result": {
 								"@type": "System.String",
@@ -115,6 +123,198 @@ func TestServerHandler(t *testing.T) {
 	}
 }
 
+func TestEvalCQL_Terminology(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	valueSet := `{
+		"resourceType": "ValueSet",
+		"url": "https://example.com/vs/custom",
+		"version": "1.0.0",
+		"expansion": {"contains": [{"system": "https://example.com/cs", "code": "abc"}]}
+	}`
+	cql := dedent.Dedent(`
+	library Explore version '1.2.3'
+	valueset "Custom": 'https://example.com/vs/custom'
+	valueset "Glucose": 'https://example.com/vs/glucose'
+	define InCustom: Code { system: 'https://example.com/cs', code: 'abc' } in "Custom"
+	define InBuiltin: Code { system: 'https://example.com/cs/diagnosis', code: 'gluc' } in "Glucose"`)
+
+	tests := []struct {
+		name        string
+		terminology string
+		wantStatus  int
+		// wantTrue are the defines that must evaluate to true, or the error message if the status is
+		// not OK.
+		wantTrue []string
+	}{
+		{
+			name:        "Custom and built in terminology",
+			terminology: valueSet,
+			wantStatus:  http.StatusOK,
+			wantTrue:    []string{"InCustom", "InBuiltin"},
+		},
+		{
+			name:        "Bundle",
+			terminology: fmt.Sprintf(`{"resourceType": "Bundle", "entry": [{"resource": %s}]}`, valueSet),
+			wantStatus:  http.StatusOK,
+			wantTrue:    []string{"InCustom"},
+		},
+		{
+			name:        "Invalid terminology",
+			terminology: "not json",
+			wantStatus:  http.StatusBadRequest,
+			wantTrue:    []string{"invalid terminology"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(&evalCQLRequest{CQL: cql, Terminology: tc.terminology})
+			if err != nil {
+				t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+			}
+			resp, err := http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader(string(body)))
+			if err != nil {
+				t.Fatalf("http.Post(/eval_cql) returned an unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("POST to /eval_cql returned status %d, want %d: %s", resp.StatusCode, tc.wantStatus, got)
+			}
+			if resp.StatusCode != http.StatusOK {
+				for _, want := range tc.wantTrue {
+					if !strings.Contains(string(got), want) {
+						t.Errorf("POST to /eval_cql returned %s, want it to contain %q", got, want)
+					}
+				}
+				return
+			}
+			var libs []struct {
+				ExpressionDefinitions map[string]struct {
+					Value any `json:"value"`
+				} `json:"expressionDefinitions"`
+			}
+			if err := json.Unmarshal(got, &libs); err != nil {
+				t.Fatalf("json.Unmarshal() returned an unexpected error: %v", err)
+			}
+			for _, name := range tc.wantTrue {
+				if v := libs[0].ExpressionDefinitions[name].Value; v != true {
+					t.Errorf("POST to /eval_cql evaluated %s to %v, want true", name, v)
+				}
+			}
+		})
+	}
+}
+
+func TestEvalCQL_FHIRServer(t *testing.T) {
+	fhirServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer secret" {
+			http.Error(w, `{"resourceType": "OperationOutcome"}`, http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/fhir/Patient/p1":
+			fmt.Fprint(w, `{"resourceType": "Patient", "id": "p1", "gender": "female"}`)
+		case "/fhir/Patient/p1/Observation":
+			fmt.Fprint(w, `{"resourceType": "Bundle", "type": "searchset", "entry": [
+				{"resource": {"resourceType": "Observation", "id": "o1", "status": "final", "code": {"text": "a"}}},
+				{"resource": {"resourceType": "Observation", "id": "o2", "status": "final", "code": {"text": "b"}}}
+			]}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer fhirServer.Close()
+	allowedFHIRServers = []string{fhirServer.URL + "/"}
+	defer func() { allowedFHIRServers = nil }()
+
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	cql := dedent.Dedent(`
+	library Explore version '1.2.3'
+	using FHIR version '4.0.1'
+	context Patient
+	define Gender: Patient.gender.value
+	define Observations: Count([Observation])`)
+
+	tests := []struct {
+		name       string
+		server     fhirServerRequest
+		wantStatus int
+		wantOutput []string
+	}{
+		{
+			name:       "Patient on the server",
+			server:     fhirServerRequest{URL: fhirServer.URL + "/fhir", PatientID: "p1", BearerToken: "secret"},
+			wantStatus: http.StatusOK,
+			wantOutput: []string{`"value": "female"`, `"value": 2`},
+		},
+		{
+			name:       "Unknown patient",
+			server:     fhirServerRequest{URL: fhirServer.URL + "/fhir", PatientID: "p2", BearerToken: "secret"},
+			wantStatus: http.StatusInternalServerError,
+			wantOutput: []string{"404 Not Found"},
+		},
+		{
+			name:       "Missing patient id",
+			server:     fhirServerRequest{URL: fhirServer.URL + "/fhir"},
+			wantStatus: http.StatusInternalServerError,
+			wantOutput: []string{"a patient id is required"},
+		},
+		{
+			name:       "Server not allowed",
+			server:     fhirServerRequest{URL: "http://169.254.169.254/fhir", PatientID: "p1"},
+			wantStatus: http.StatusInternalServerError,
+			wantOutput: []string{"is not allowed by this playground"},
+		},
+		{
+			name:       "Not an http URL",
+			server:     fhirServerRequest{URL: "file:///etc/passwd", PatientID: "p1"},
+			wantStatus: http.StatusInternalServerError,
+			wantOutput: []string{"must have an http or https URL"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// The data is ignored in favor of the FHIR server.
+			body, err := json.Marshal(&evalCQLRequest{CQL: cql, Data: "not a bundle", FHIRServer: &tc.server})
+			if err != nil {
+				t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+			}
+			resp, err := http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader(string(body)))
+			if err != nil {
+				t.Fatalf("http.Post(/eval_cql) returned an unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("POST to /eval_cql returned status %d, want %d: %s", resp.StatusCode, tc.wantStatus, got)
+			}
+			for _, want := range tc.wantOutput {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("POST to /eval_cql returned %s, want it to contain %s", got, want)
+				}
+			}
+		})
+	}
+}
+
 // TODO: b/301659936 - Add tests that build and run the largetest examples in the CQL repo.
 
 func normalizeJSON(t *testing.T, s string) []byte {
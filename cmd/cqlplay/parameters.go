@@ -0,0 +1,110 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/cql"
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/model"
+	"github.com/google/cql/parser"
+	"github.com/google/cql/result"
+)
+
+// parameterInfo describes a parameter of the main CQL that can be set in the parameters panel.
+type parameterInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Default is the CQL source of the default value, or empty if there is none.
+	Default string `json:"default,omitempty"`
+}
+
+type parametersResponse struct {
+	Parameters []parameterInfo `json:"parameters"`
+}
+
+// handleParameters responds with the parameters declared by the main CQL, in declaration order.
+func handleParameters(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req)
+	if !ok {
+		return
+	}
+	paramsReq := &evalCQLRequest{}
+	if err := json.Unmarshal(body, paramsReq); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	fhirHelpers, err := cql.FHIRHelpersLib("4.0.1")
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	p, err := parser.New(req.Context(), [][]byte{fhirDM})
+	if err != nil {
+		sendError(w, err, http.StatusInternalServerError)
+		return
+	}
+	sources := paramsReq.sources()
+	libs, err := p.Libraries(req.Context(), append(sources, fhirHelpers), parser.Config{})
+	if err != nil {
+		sendParseError(w, sources, fmt.Errorf("failed to parse: %w", err))
+		return
+	}
+
+	resp := parametersResponse{Parameters: []parameterInfo{}}
+	for _, lib := range libs {
+		key := result.LibKeyFromModel(lib.Identifier)
+		if editing.SourceIndex(sources, key) != 0 {
+			continue
+		}
+		for _, param := range lib.Parameters {
+			resp.Parameters = append(resp.Parameters, parameterInfo{
+				Name:    param.Name,
+				Type:    editing.TypeName(param.GetResultType()),
+				Default: sourceText(paramsReq.CQL, p.Locators(), param.Default),
+			})
+		}
+	}
+	sendJSON(w, resp)
+}
+
+// sourceText returns the CQL source of the expression, or empty if it has no locator.
+func sourceText(src string, locators map[model.IExpression]result.Locator, expr model.IExpression) string {
+	if expr == nil {
+		return ""
+	}
+	loc, ok := locators[expr]
+	if !ok {
+		return ""
+	}
+	lines := strings.Split(src, "\n")
+	if loc.StartLine < 1 || loc.EndLine > len(lines) || loc.StartLine > loc.EndLine {
+		return ""
+	}
+	lines = lines[loc.StartLine-1 : loc.EndLine]
+	last := lines[len(lines)-1]
+	lines[len(lines)-1] = last[:min(loc.EndCol, len(last))]
+	lines[0] = lines[0][min(max(loc.StartCol-1, 0), len(lines[0])):]
+	return strings.Join(lines, "\n")
+}
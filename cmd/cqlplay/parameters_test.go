@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParameters(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(&evalCQLRequest{
+		CQL: strings.Join([]string{
+			"library Explore version '1.2.3'",
+			"parameter \"Measurement Period\" Interval<DateTime>",
+			"  default Interval[@2024-01-01T00:00:00.0Z, @2025-01-01T00:00:00.0Z)",
+			"parameter Threshold Integer",
+			"define result: Threshold",
+		}, "\n"),
+		Libraries: []string{"library Helpers version '1.0'\nparameter Other Integer"},
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/parameters", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/parameters) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	var got parametersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding the /parameters response returned an unexpected error: %v", err)
+	}
+	want := parametersResponse{Parameters: []parameterInfo{
+		{
+			Name:    "Measurement Period",
+			Type:    "Interval<System.DateTime>",
+			Default: "Interval[@2024-01-01T00:00:00.0Z, @2025-01-01T00:00:00.0Z)",
+		},
+		{Name: "Threshold", Type: "System.Integer"},
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("POST to /parameters returned a diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestEvalCQL_ParametersAndTimestamp(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		req        evalCQLRequest
+		wantStatus int
+		wantOutput []string
+	}{
+		{
+			name: "Overrides",
+			req: evalCQLRequest{
+				CQL:                 "library Explore version '1.2.3'\nparameter Threshold Integer default 1\ndefine T: Threshold\ndefine D: Today()",
+				Parameters:          map[string]string{"Threshold": "5"},
+				EvaluationTimestamp: "@2024-03-04T05:06:07.0Z",
+			},
+			wantStatus: http.StatusOK,
+			wantOutput: []string{`"value": 5`, `"value": "@2024-03-04"`},
+		},
+		{
+			name: "Empty parameter keeps the default",
+			req: evalCQLRequest{
+				CQL:        "library Explore version '1.2.3'\nparameter Threshold Integer default 1\ndefine T: Threshold",
+				Parameters: map[string]string{"Threshold": ""},
+			},
+			wantStatus: http.StatusOK,
+			wantOutput: []string{`"value": 1`},
+		},
+		{
+			name: "Invalid timestamp",
+			req: evalCQLRequest{
+				CQL:                 "library Explore version '1.2.3'\ndefine T: 1",
+				EvaluationTimestamp: "yesterday",
+			},
+			wantStatus: http.StatusBadRequest,
+			wantOutput: []string{"invalid evaluation timestamp"},
+		},
+		{
+			name: "Parameters of an unnamed library",
+			req: evalCQLRequest{
+				CQL:        "parameter Threshold Integer default 1\ndefine T: Threshold",
+				Parameters: map[string]string{"Threshold": "5"},
+			},
+			wantStatus: http.StatusBadRequest,
+			wantOutput: []string{"named library"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(tc.req)
+			if err != nil {
+				t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+			}
+			resp, err := http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader(string(body)))
+			if err != nil {
+				t.Fatalf("http.Post(/eval_cql) returned an unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("POST to /eval_cql returned status %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			for _, want := range tc.wantOutput {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("POST to /eval_cql returned %s, want it to contain %s", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// queuedEndpoints are the endpoints that evaluate CQL, and so go through the evalQueue. The other
+// endpoints only parse the CQL and are cheap enough to serve directly.
+var queuedEndpoints = map[string]bool{
+	"/eval_cql":      true,
+	"/generate_data": true,
+	"/debug":         true,
+	"/coverage":      true,
+	"/compare":       true,
+}
+
+// evalQueue bounds how many evaluations run at once and how long each may take, so that one huge
+// bundle can not wedge the whole playground. Requests wait for one of the workers in a bounded
+// queue, and are rejected with 429 Too Many Requests when the queue is full. Requests that do not
+// finish within the timeout are answered with 504 Gateway Timeout.
+//
+// The engine can not be interrupted, so an evaluation that times out keeps its worker until it
+// finishes. This keeps abandoned evaluations counted towards the limits.
+type evalQueue struct {
+	// workers holds a token for each running evaluation.
+	workers chan struct{}
+	// pending holds a token for each running or waiting evaluation.
+	pending chan struct{}
+	timeout time.Duration
+	// retryAfter is sent in the Retry-After header of 429 responses.
+	retryAfter time.Duration
+}
+
+// newEvalQueue returns an evalQueue that runs up to workers evaluations at once, with up to queued
+// more waiting, each of which must finish within timeout.
+func newEvalQueue(workers, queued int, timeout time.Duration) (*evalQueue, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("the number of concurrent evaluations must be at least 1, got %d", workers)
+	}
+	if queued < 0 {
+		return nil, fmt.Errorf("the number of queued evaluations must not be negative, got %d", queued)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("the evaluation timeout must be positive, got %v", timeout)
+	}
+	return &evalQueue{
+		workers:    make(chan struct{}, workers),
+		pending:    make(chan struct{}, workers+queued),
+		timeout:    timeout,
+		retryAfter: 5 * time.Second,
+	}, nil
+}
+
+// wrap returns a handler that sends the requests to the queuedEndpoints of h through the queue,
+// and serves the others directly.
+func (q *evalQueue) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !queuedEndpoints[req.URL.Path] {
+			h.ServeHTTP(w, req)
+			return
+		}
+		q.serve(h, w, req)
+	})
+}
+
+func (q *evalQueue) serve(h http.Handler, w http.ResponseWriter, req *http.Request) {
+	select {
+	case q.pending <- struct{}{}:
+	default:
+		w.Header().Set("Retry-After", strconv.Itoa(int(q.retryAfter.Seconds())))
+		sendError(w, errors.New("the playground is busy with other evaluations, try again in a few seconds"), http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), q.timeout)
+	defer cancel()
+	select {
+	case q.workers <- struct{}{}:
+	case <-ctx.Done():
+		<-q.pending
+		sendError(w, fmt.Errorf("timed out after %v waiting for other evaluations to finish, try again later", q.timeout), http.StatusGatewayTimeout)
+		return
+	}
+
+	// The handler writes to a recorder rather than w, since w can not be used once the request
+	// times out and this returns.
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("panic while serving %s: %v", req.URL.Path, r)
+				rec = httptest.NewRecorder()
+				rec.WriteHeader(http.StatusInternalServerError)
+				rec.WriteString("Error: internal error while evaluating")
+			}
+			<-q.workers
+			<-q.pending
+			close(done)
+		}()
+		h.ServeHTTP(rec, req.WithContext(ctx))
+	}()
+
+	select {
+	case <-done:
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	case <-ctx.Done():
+		sendError(w, fmt.Errorf("the evaluation did not finish within %v, try a smaller bundle or simpler CQL", q.timeout), http.StatusGatewayTimeout)
+	}
+}
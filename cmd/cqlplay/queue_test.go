@@ -0,0 +1,204 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvalQueue(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/eval_cql", func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Header().Set("X-Test", "evaluated")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	})
+	mux.HandleFunc("/elm", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("elm"))
+	})
+	q, err := newEvalQueue(1, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("newEvalQueue() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(q.wrap(mux))
+	defer server.Close()
+
+	type response struct {
+		status int
+		header http.Header
+		body   string
+	}
+	post := func(path string) response {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Errorf("http.Post(%s) returned an unexpected error: %v", path, err)
+			return response{}
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("io.ReadAll() returned an unexpected error: %v", err)
+		}
+		return response{status: resp.StatusCode, header: resp.Header, body: string(b)}
+	}
+
+	// The first request runs and the second waits in the queue.
+	responses := make(chan response, 2)
+	go func() { responses <- post("/eval_cql") }()
+	<-started
+	go func() { responses <- post("/eval_cql") }()
+	waitFor(t, func() bool { return len(q.pending) == 2 })
+
+	busy := post("/eval_cql")
+	if busy.status != http.StatusTooManyRequests {
+		t.Errorf("request to a full queue returned status %d, want %d", busy.status, http.StatusTooManyRequests)
+	}
+	if got := busy.header.Get("Retry-After"); got != "5" {
+		t.Errorf("request to a full queue returned Retry-After %q, want %q", got, "5")
+	}
+	if elm := post("/elm"); elm.status != http.StatusOK || elm.body != "elm" {
+		t.Errorf("request to an endpoint that is not queued returned %d %q, want %d %q", elm.status, elm.body, http.StatusOK, "elm")
+	}
+
+	close(release)
+	for range 2 {
+		got := <-responses
+		if got.status != http.StatusCreated || got.body != "done" || got.header.Get("X-Test") != "evaluated" {
+			t.Errorf("queued request returned %d %q with X-Test %q, want %d %q with X-Test %q", got.status, got.body, got.header.Get("X-Test"), http.StatusCreated, "done", "evaluated")
+		}
+	}
+	waitFor(t, func() bool { return len(q.pending) == 0 && len(q.workers) == 0 })
+}
+
+func TestEvalQueue_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/eval_cql", func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	})
+	q, err := newEvalQueue(1, 1, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("newEvalQueue() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(q.wrap(mux))
+	defer server.Close()
+
+	for _, want := range []string{"did not finish within", "waiting for other evaluations"} {
+		resp, err := http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("http.Post() returned an unexpected error: %v", err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+		}
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("slow request returned status %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+		}
+		if !strings.Contains(string(b), want) {
+			t.Errorf("slow request returned %q, want it to contain %q", string(b), want)
+		}
+	}
+	// The abandoned evaluation still holds its worker.
+	if got := len(q.workers); got != 1 {
+		t.Errorf("after the timeout %d workers are busy, want 1", got)
+	}
+}
+
+func TestEvalQueue_Panic(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/eval_cql", func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	})
+	q, err := newEvalQueue(1, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("newEvalQueue() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(q.wrap(mux))
+	defer server.Close()
+
+	for range 2 {
+		resp, err := http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("http.Post() returned an unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("panicking request returned status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestNewEvalQueue_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		queued  int
+		timeout time.Duration
+	}{
+		{name: "No workers", workers: 0, queued: 1, timeout: time.Second},
+		{name: "Negative queue", workers: 1, queued: -1, timeout: time.Second},
+		{name: "No timeout", workers: 1, queued: 1, timeout: 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newEvalQueue(tc.workers, tc.queued, tc.timeout); err == nil {
+				t.Errorf("newEvalQueue(%d, %d, %v) succeeded, want an error", tc.workers, tc.queued, tc.timeout)
+			}
+		})
+	}
+}
+
+func TestReadBody_TooLarge(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body := `{"cql": "library Explore version '1.2.3'\ndefine X: '` + strings.Repeat("a", int(maxRequestBytes)) + `'"}`
+	resp, err := http.Post(server.URL+"/eval_cql", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.Post() returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized request returned status %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// waitFor polls cond until it is true, failing the test if it takes too long.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
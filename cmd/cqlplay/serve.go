@@ -0,0 +1,164 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !js || !wasm
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"flag"
+	log "github.com/golang/glog"
+)
+
+// authTokenEnv is the environment variable from which the auth token is read if --auth_token is
+// not set.
+const authTokenEnv = "CQLPLAY_AUTH_TOKEN"
+
+var (
+	addr               = flag.String("addr", "localhost:8080", "(Optional) The host:port to listen on. Use :8080 to listen on all interfaces, for a shared instance.")
+	tlsCert            = flag.String("tls_cert", "", "(Optional) Path to a PEM TLS certificate. If set along with --tls_key the playground is served over HTTPS.")
+	tlsKey             = flag.String("tls_key", "", "(Optional) Path to the PEM private key of --tls_cert.")
+	authToken          = flag.String("auth_token", "", "(Optional) If set, requests to the playground's endpoints must send this token in an Authorization: Bearer header. The static pages are still served without it. If not set, the token is read from the "+authTokenEnv+" environment variable.")
+	maxConcurrentEvals = flag.Int("max_concurrent_evals", runtime.NumCPU(), "(Optional) The number of evaluations that may run at once. Defaults to the number of CPUs.")
+	maxQueuedEvals     = flag.Int("max_queued_evals", 16, "(Optional) The number of evaluations that may wait for a running one to finish. Requests beyond that are rejected with 429 Too Many Requests.")
+	evalTimeout        = flag.Duration("eval_timeout", 30*time.Second, "(Optional) How long an evaluation, including the time it waits in the queue, may take before the request fails with 504 Gateway Timeout.")
+	maxRequestSize     = flag.Int64("max_request_bytes", maxRequestBytes, "(Optional) The largest request body the playground accepts, in bytes.")
+	allowedEndpoints   = flag.String("allowed_endpoints", "", "(Optional) Comma separated URL prefixes of the FHIR servers requests may point the playground at, for example https://fhir.example.org/. Use * to allow any server. By default requests may not use FHIR servers.")
+)
+
+func main() {
+	flag.Parse()
+	if err := serve(); err != nil {
+		log.Fatalf("cqlplay failed with an error: %v", err)
+	}
+
+}
+
+func serve() error {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("--tls_cert and --tls_key must be set together")
+	}
+	token := *authToken
+	if token == "" {
+		token = os.Getenv(authTokenEnv)
+	}
+
+	if *maxRequestSize <= 0 {
+		return fmt.Errorf("--max_request_bytes must be positive, got %d", *maxRequestSize)
+	}
+	maxRequestBytes = *maxRequestSize
+	for _, prefix := range strings.Split(*allowedEndpoints, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			allowedFHIRServers = append(allowedFHIRServers, prefix)
+		}
+	}
+	queue, err := newEvalQueue(*maxConcurrentEvals, *maxQueuedEvals, *evalTimeout)
+	if err != nil {
+		return err
+	}
+
+	mux, err := serverHandler()
+	if err != nil {
+		return err
+	}
+	mux = queue.wrap(mux)
+	if token != "" {
+		mux, err = withAuthToken(mux, token)
+		if err != nil {
+			return err
+		}
+	} else if !isLoopback(*addr) {
+		log.Warningf("serving on %s without --auth_token, anyone who can reach it can evaluate CQL", *addr)
+	}
+
+	server := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	scheme := "http"
+	if *tlsCert != "" {
+		scheme = "https"
+	}
+	fmt.Printf("serving on %s, try %s://%s\n", *addr, scheme, browseAddr(*addr))
+	if *tlsCert != "" {
+		return server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	}
+	return server.ListenAndServe()
+}
+
+// withAuthToken wraps h so that requests to the endpoints of the playground are rejected unless
+// they send token as a bearer token. The static assets are served to anyone, so that the page can
+// load and ask for the token.
+func withAuthToken(h http.Handler, token string) (http.Handler, error) {
+	staticFS, err := fs.Sub(staticAssets, "static")
+	if err != nil {
+		return nil, err
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isStaticAsset(staticFS, req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			sendError(w, errors.New("a valid auth token is required"), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	}), nil
+}
+
+// isStaticAsset returns true if the request is for a file of the static assets.
+func isStaticAsset(staticFS fs.FS, req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if name == "" {
+		return true
+	}
+	info, err := fs.Stat(staticFS, name)
+	return err == nil && !info.IsDir()
+}
+
+// isLoopback returns true if addr only listens on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// browseAddr returns the address to browse to for a server listening on addr.
+func browseAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
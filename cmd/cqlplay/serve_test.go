@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !js || !wasm
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithAuthToken(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	h, err = withAuthToken(h, "secret")
+	if err != nil {
+		t.Fatalf("withAuthToken() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body := `{"cql": "library Explore version '1.2.3'\ndefine X: 1"}`
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		auth       string
+		wantStatus int
+	}{
+		{
+			name:       "Index page without token",
+			method:     http.MethodGet,
+			path:       "/",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Static asset without token",
+			method:     http.MethodGet,
+			path:       "/cqlPlay.js",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Eval without token",
+			method:     http.MethodPost,
+			path:       "/eval_cql",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Eval with wrong token",
+			method:     http.MethodPost,
+			path:       "/eval_cql",
+			auth:       "Bearer wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Eval with token",
+			method:     http.MethodPost,
+			path:       "/eval_cql",
+			auth:       "Bearer secret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Share lookup without token",
+			method:     http.MethodGet,
+			path:       "/share?id=abc",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("http.NewRequest() returned an unexpected error: %v", err)
+			}
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s returned an unexpected error: %v", tc.method, tc.path, err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("%s %s returned status %d, want %d", tc.method, tc.path, resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "localhost:8080", want: true},
+		{addr: "127.0.0.1:8080", want: true},
+		{addr: "[::1]:8080", want: true},
+		{addr: ":8080", want: false},
+		{addr: "0.0.0.0:8080", want: false},
+		{addr: "playground.example.com:443", want: false},
+	}
+	for _, tc := range tests {
+		if got := isLoopback(tc.addr); got != tc.want {
+			t.Errorf("isLoopback(%q) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestBrowseAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: ":8080", want: "localhost:8080"},
+		{addr: "localhost:8080", want: "localhost:8080"},
+		{addr: "playground.example.com:443", want: "playground.example.com:443"},
+	}
+	for _, tc := range tests {
+		if got := browseAddr(tc.addr); got != tc.want {
+			t.Errorf("browseAddr(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
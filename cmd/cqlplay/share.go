@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxSnippetSize is the largest decoded snippet accepted, which protects against snippets that
+// decompress to a huge size.
+const maxSnippetSize = 5e6
+
+// encodeSnippet encodes the request as a compact, URL safe snippet id. The id holds the whole
+// request, so no state is kept on the server and links keep working after restarts.
+func encodeSnippet(req *evalCQLRequest) (string, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(b); err != nil {
+		return "", err
+	}
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeSnippet decodes a snippet id created by encodeSnippet.
+func decodeSnippet(id string) (*evalCQLRequest, error) {
+	compressed, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snippet id: %w", err)
+	}
+	fr := flate.NewReader(bytes.NewReader(compressed))
+	defer fr.Close()
+	b, err := io.ReadAll(io.LimitReader(fr, maxSnippetSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid snippet id: %w", err)
+	}
+	if len(b) > maxSnippetSize {
+		return nil, fmt.Errorf("snippet is larger than %d bytes", int(maxSnippetSize))
+	}
+	req := &evalCQLRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		return nil, fmt.Errorf("invalid snippet: %w", err)
+	}
+	return req, nil
+}
+
+// handleShare encodes the posted playground state into a snippet id, or decodes the snippet id of
+// a GET request back into the playground state.
+func handleShare(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		snippet, err := decodeSnippet(req.URL.Query().Get("id"))
+		if err != nil {
+			sendError(w, err, http.StatusBadRequest)
+			return
+		}
+		sendJSON(w, snippet)
+	case http.MethodPost:
+		body, ok := readBody(w, req)
+		if !ok {
+			return
+		}
+		snippet := &evalCQLRequest{}
+		if err := json.Unmarshal(body, snippet); err != nil {
+			sendError(w, err, http.StatusBadRequest)
+			return
+		}
+		if snippet.FHIRServer != nil {
+			snippet.FHIRServer.BearerToken = ""
+		}
+		id, err := encodeSnippet(snippet)
+		if err != nil {
+			sendError(w, err, http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, shareResponse{ID: id})
+	default:
+		sendError(w, fmt.Errorf("unsupported method %s", req.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+type shareResponse struct {
+	ID string `json:"id"`
+}
+
+func sendJSON(w http.ResponseWriter, v any) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		sendError(w, fmt.Errorf("unable to marshal response: %w", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
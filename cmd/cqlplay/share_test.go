@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestShare(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	want := &evalCQLRequest{
+		CQL:  "library Explore version '1.2.3'\ndefine result: 1+1",
+		Data: `{"resourceType": "Bundle", "type": "transaction"}`,
+	}
+	body, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/share", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/share) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	var shared shareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&shared); err != nil {
+		t.Fatalf("decoding the /share response returned an unexpected error: %v", err)
+	}
+	if strings.ContainsAny(shared.ID, "+/=") {
+		t.Errorf("POST to /share returned id %q, want a URL safe id", shared.ID)
+	}
+
+	resp, err = http.Get(server.URL + "/share?id=" + url.QueryEscape(shared.ID))
+	if err != nil {
+		t.Fatalf("http.Get(/share) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	got := &evalCQLRequest{}
+	if err := json.NewDecoder(resp.Body).Decode(got); err != nil {
+		t.Fatalf("decoding the /share response returned an unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GET /share returned a diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestShare_DropsBearerToken(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body, err := json.Marshal(&evalCQLRequest{
+		CQL:        "library Explore version '1.2.3'",
+		FHIRServer: &fhirServerRequest{URL: "https://example.com/fhir", PatientID: "p1", BearerToken: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() returned an unexpected error: %v", err)
+	}
+	resp, err := http.Post(server.URL+"/share", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("http.Post(/share) returned an unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	var shared shareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&shared); err != nil {
+		t.Fatalf("decoding the /share response returned an unexpected error: %v", err)
+	}
+
+	got, err := decodeSnippet(shared.ID)
+	if err != nil {
+		t.Fatalf("decodeSnippet() returned an unexpected error: %v", err)
+	}
+	want := &fhirServerRequest{URL: "https://example.com/fhir", PatientID: "p1"}
+	if diff := cmp.Diff(want, got.FHIRServer); diff != "" {
+		t.Errorf("shared FHIR server returned a diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestShare_Error(t *testing.T) {
+	h, err := serverHandler()
+	if err != nil {
+		t.Fatalf("serverHandler() returned an unexpected error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		id         string
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "Not base64",
+			id:         "not a snippet!",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid snippet id",
+		},
+		{
+			name:       "Not compressed",
+			id:         "bm90IGNvbXByZXNzZWQ",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid snippet id",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + "/share?id=" + url.QueryEscape(tc.id))
+			if err != nil {
+				t.Fatalf("http.Get(/share) returned an unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll() returned an unexpected error: %v", err)
+			}
+			if resp.StatusCode != tc.wantStatus || !strings.Contains(string(body), tc.wantError) {
+				t.Errorf("GET /share?id=%s returned %d %s, want %d with an error containing %q", tc.id, resp.StatusCode, body, tc.wantStatus, tc.wantError)
+			}
+		})
+	}
+}
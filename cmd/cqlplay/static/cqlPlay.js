@@ -24,7 +24,9 @@
  * the engine.
  */
 
+import {renderResults} from './resultsView.js';
 import {syntheticPatient} from './syntheticPatient.js';
+import {loadWasm, newRequest, setAuthToken} from './wasmClient.js';
 
 // These are globals that are bound to the onchange event of the code inputs
 // and syntax highlighted outputs. They are seeded with initial data for the
@@ -37,8 +39,31 @@ include FHIRHelpers version '4.0.1' called FHIRHelpers
 
 context Patient`;
 
+// libraries holds the source of each additional library tab, which may be
+// included by the main CQL.
+let libraries = [];
+
 let data = syntheticPatient;
 
+// evaluationTimestamp overrides the time of evaluation if set, and parameters
+// override the parameters of the main CQL, keyed by name.
+let evaluationTimestamp = '';
+let parameters = {};
+
+// terminology holds FHIR terminology resources used alongside the built in
+// terminology of the playground.
+let terminology = '';
+
+// baseline is another version of the main CQL, whose results are compared to
+// those of the main CQL.
+let baseline = '';
+
+// fhirServer points the playground at a patient on a FHIR server instead of
+// the data if set. The bearer token for the server is kept separately in
+// fhirServerToken, since it is never saved or shared.
+let fhirServer = null;
+let fhirServerToken = '';
+
 let results = '';
 
 // Helper functions:
@@ -50,6 +75,23 @@ let results = '';
 function updateInputs() {
   document.getElementById('cqlInput').value = code;
   document.getElementById('dataInput').value = data;
+  document.getElementById('terminologyInput').value = terminology;
+  document.getElementById('baselineInput').value = baseline;
+  document.getElementById('evaluationTimestamp').value = evaluationTimestamp;
+  document.getElementById('fhirServerSource').checked = fhirServer != null;
+  document.getElementById('bundleSource').checked = fhirServer == null;
+  document.getElementById('fhirServerURL').value = fhirServer ? fhirServer.url : '';
+  document.getElementById('fhirServerPatientID').value =
+      fhirServer ? fhirServer.patientId : '';
+  showDataSource();
+  for (let tab of document.querySelectorAll('.libraryTab')) {
+    tab.remove();
+  }
+  let sources = libraries;
+  libraries = [];
+  for (let source of sources) {
+    addLibraryTab(source);
+  }
 }
 
 /**
@@ -60,9 +102,55 @@ function bindInputsOnChange() {
   document.getElementById('cqlInput').onchange = function(e) {
     code = e.target.value;
   };
-  document.getElementById('dataInput').onchange = function(e) {
+  // The data and terminology are updated as they are typed, so that autosave
+  // does not miss edits made right before the page is closed.
+  document.getElementById('dataInput').oninput = function(e) {
     data = e.target.value;
   };
+  document.getElementById('terminologyInput').oninput = function(e) {
+    terminology = e.target.value;
+  };
+  document.getElementById('baselineInput').oninput = function(e) {
+    baseline = e.target.value;
+  };
+  document.getElementById('evaluationTimestamp').oninput = function(e) {
+    evaluationTimestamp = e.target.value;
+  };
+  document.getElementById('bundleSource').onchange = function(e) {
+    fhirServer = null;
+    showDataSource();
+  };
+  document.getElementById('fhirServerSource').onchange = function(e) {
+    fhirServer = {
+      'url': document.getElementById('fhirServerURL').value,
+      'patientId': document.getElementById('fhirServerPatientID').value,
+    };
+    showDataSource();
+  };
+  document.getElementById('fhirServerURL').oninput = function(e) {
+    if (fhirServer) {
+      fhirServer.url = e.target.value;
+    }
+  };
+  document.getElementById('fhirServerPatientID').oninput = function(e) {
+    if (fhirServer) {
+      fhirServer.patientId = e.target.value;
+    }
+  };
+  document.getElementById('fhirServerToken').oninput = function(e) {
+    fhirServerToken = e.target.value;
+  };
+}
+
+/**
+ * showDataSource shows the bundle editor or the FHIR server inputs, depending
+ * on where the data comes from.
+ */
+function showDataSource() {
+  document.getElementById('bundleInputs').style.display =
+      fhirServer ? 'none' : 'block';
+  document.getElementById('fhirServerInputs').style.display =
+      fhirServer ? 'table' : 'none';
 }
 
 /**
@@ -73,14 +161,125 @@ function bindButtonActions() {
   document.getElementById('submit').addEventListener('click', function(e) {
     runCQL();
   });
+  document.getElementById('showCoverage')
+      .addEventListener('change', function(e) {
+        if (e.target.checked) {
+          loadCoverage();
+        } else {
+          document.getElementById('coverageSummary').textContent = '';
+          clearCoverage();
+        }
+      });
+  document.getElementById('share').addEventListener('click', function(e) {
+    share();
+  });
+  document.getElementById('exportWorkspace')
+      .addEventListener('click', function(e) {
+        exportWorkspace();
+      });
+  document.getElementById('importWorkspace')
+      .addEventListener('click', function(e) {
+        document.getElementById('workspaceFile').click();
+      });
+  document.getElementById('workspaceFile')
+      .addEventListener('change', function(e) {
+        importWorkspace(e.target.files[0]);
+        e.target.value = '';
+      });
+  document.getElementById('generateData').addEventListener('click', function(e) {
+    generateData();
+  });
+  document.getElementById('inspectELM').addEventListener('click', function(e) {
+    inspectELM();
+  });
+  document.getElementById('debugDefine').addEventListener('click', function(e) {
+    debugDefine();
+  });
+  // While the debugger is open, clicking a define in the CQL debugs it.
+  document.getElementById('cqlInput').addEventListener('click', function(e) {
+    if (document.getElementById('debugPane').open) {
+      debugDefine();
+    }
+  });
   document.getElementById('cqlTabButton')
       .addEventListener('click', function(e) {
-        showCQLTab();
+        showTab('cqlEntry', 'cqlTabButton');
       });
   document.getElementById('dataTabButton')
       .addEventListener('click', function(e) {
-        showDataTab();
+        showTab('dataEntry', 'dataTabButton');
+      });
+  document.getElementById('tableViewButton')
+      .addEventListener('click', function(e) {
+        showResultsView(true);
+      });
+  document.getElementById('jsonViewButton')
+      .addEventListener('click', function(e) {
+        showResultsView(false);
+      });
+  document.getElementById('parametersTabButton')
+      .addEventListener('click', function(e) {
+        showTab('parametersEntry', 'parametersTabButton');
+        loadParameters();
+      });
+  document.getElementById('terminologyTabButton')
+      .addEventListener('click', function(e) {
+        showTab('terminologyEntry', 'terminologyTabButton');
+      });
+  document.getElementById('baselineTabButton')
+      .addEventListener('click', function(e) {
+        showTab('baselineEntry', 'baselineTabButton');
+      });
+  document.getElementById('copyToBaseline')
+      .addEventListener('click', function(e) {
+        baseline = code;
+        document.getElementById('baselineInput').value = baseline;
       });
+  document.getElementById('compare').addEventListener('click', function(e) {
+    compareResults();
+  });
+  document.getElementById('addLibraryButton')
+      .addEventListener('click', function(e) {
+        addLibraryTab(`library Helpers version '1.0.0'\n`);
+      });
+}
+
+/**
+ * addLibraryTab adds an editor tab for an additional library with the given
+ * source, and shows it.
+ */
+function addLibraryTab(source) {
+  let index = libraries.length;
+  libraries.push(source);
+
+  let button = document.createElement('button');
+  button.id = 'libraryTabButton' + index;
+  button.className = 'libraryTab';
+  button.textContent = 'Library ' + (index + 1);
+  button.addEventListener('click', function(e) {
+    showTab('libraryEntry' + index, button.id);
+  });
+  let tabholder = document.getElementById('addLibraryButton').parentNode;
+  tabholder.insertBefore(button, document.getElementById('dataTabButton'));
+
+  let entry = document.createElement('div');
+  entry.id = 'libraryEntry' + index;
+  entry.className = 'tabContent libraryTab';
+  entry.innerHTML = `<h3>Library Editor</h3>
+    <div class="codeInputContainer">
+      <code-input lang="cql" placeholder="Type a CQL library here"
+          class="codeInput" id="libraryInput${index}"></code-input>
+    </div>
+    <pre class="diagnostics" id="diagnostics${index + 1}"></pre>`;
+  let dataEntry = document.getElementById('dataEntry');
+  dataEntry.parentNode.insertBefore(entry, dataEntry);
+
+  let input = document.getElementById('libraryInput' + index);
+  input.value = source;
+  input.onchange = function(e) {
+    libraries[index] = e.target.value;
+  };
+  showTab(entry.id, button.id);
 }
 
 /**
@@ -88,39 +287,885 @@ function bindButtonActions() {
  * the results box.
  */
 function runCQL() {
-  let xhr = new XMLHttpRequest();
+  let xhr = newRequest();
   xhr.onreadystatechange = function() {
     if (xhr.readyState == XMLHttpRequest.DONE) {
+      showDiagnostics(xhr);
       document.getElementById('results').innerHTML = xhr.responseText;
       Prism.highlightAll();
       results = xhr.responseText;
+      let view = document.getElementById('resultsView');
+      if (xhr.status != 200) {
+        view.replaceChildren();
+        showResultsView(false);
+        return;
+      }
+      renderResults(view, JSON.parse(xhr.responseText));
+      if (document.getElementById('showCoverage').checked) {
+        loadCoverage();
+      }
     }
   };
   xhr.open('POST', '/eval_cql', true);
   xhr.setRequestHeader('Content-Type', 'text/json');
-  xhr.send(JSON.stringify({'cql': code, 'data': data}));
+  xhr.send(JSON.stringify(request()));
+}
+
+/**
+ * showResultsView shows the results as tables and a timeline if table is true,
+ * and as raw JSON otherwise.
+ */
+function showResultsView(table) {
+  document.getElementById('resultsView').style.display = table ? 'block' : 'none';
+  document.getElementById('resultsJSON').style.display = table ? 'none' : 'block';
+  document.getElementById('tableViewButton').classList.toggle('active', table);
+  document.getElementById('jsonViewButton').classList.toggle('active', !table);
+}
+
+/**
+ * request returns the body of the /eval_cql request for the current inputs.
+ */
+function request() {
+  let body = workspace();
+  // The baseline is only sent to /compare.
+  delete body.baselineCql;
+  if (fhirServer) {
+    body.fhirServer = Object.assign({'bearerToken': fhirServerToken}, fhirServer);
+  }
+  return body;
+}
+
+/**
+ * workspace returns the current inputs with the same fields as the body of an
+ * /eval_cql request, but without the FHIR server bearer token and with the
+ * baseline CQL, to be saved or shared.
+ */
+function workspace() {
+  return {
+    'cql': code,
+    'libraries': libraries,
+    'data': data,
+    'evaluationTimestamp': evaluationTimestamp,
+    'parameters': parameters,
+    'terminology': terminology,
+    'fhirServer': fhirServer,
+    'baselineCql': baseline,
+  };
+}
+
+/**
+ * showDiagnostics shows the parse diagnostics of an /eval_cql response below
+ * the editor of the tab they belong to, and marks the tabs with errors.
+ */
+function showDiagnostics(xhr) {
+  if (xhr.status != 400 ||
+      !xhr.getResponseHeader('Content-Type')?.startsWith('application/json')) {
+    renderDiagnostics([]);
+    return;
+  }
+  renderDiagnostics(JSON.parse(xhr.responseText).diagnostics);
+}
+
+/**
+ * renderDiagnostics shows the diagnostics below the editor of the tab they
+ * belong to, underlines them in the editor, and marks the tabs with errors.
+ */
+function renderDiagnostics(diagnostics) {
+  for (let el of document.querySelectorAll('.diagnostics')) {
+    el.textContent = '';
+  }
+  for (let el of document.querySelectorAll('.tabholder button')) {
+    el.classList.remove('hasErrors');
+  }
+  let sources = [code, ...libraries];
+  let bySource = sources.map(() => []);
+  for (let d of diagnostics) {
+    let source = Math.max(d.source, 0);
+    bySource[source].push(d);
+    let el = document.getElementById('diagnostics' + source);
+    el.textContent += `${d.line}:${d.column} ${d.message}\n`;
+    let button = source > 0 ?
+        document.getElementById('libraryTabButton' + (source - 1)) :
+        document.getElementById('cqlTabButton');
+    button.classList.add('hasErrors');
+  }
+  sources.forEach(function(source, i) {
+    showSquiggles(sourceEditor(i), source, bySource[i]);
+  });
+}
+
+/**
+ * editorOverlay returns the overlay of a CQL editor with the given class name,
+ * creating it if needed. Overlays are transparent copies of the editor text
+ * laid over the editor, on which the text can be marked up. Null is returned if
+ * the editor has not been set up yet.
+ */
+function editorOverlay(editor, className) {
+  let textarea = editor && editor.querySelector('textarea');
+  let pre = editor && editor.querySelector('pre:not(.overlay)');
+  if (!textarea || !pre) {
+    return null;
+  }
+  let overlay = editor.querySelector('pre.' + className);
+  if (!overlay) {
+    overlay = pre.cloneNode(false);
+    overlay.removeAttribute('id');
+    overlay.classList.add('overlay', className);
+    overlay.setAttribute('aria-hidden', 'true');
+    editor.appendChild(overlay);
+    textarea.addEventListener('scroll', function(e) {
+      overlay.scrollTop = textarea.scrollTop;
+      overlay.scrollLeft = textarea.scrollLeft;
+    });
+  }
+  return overlay;
+}
+
+/**
+ * showSquiggles underlines the diagnostics in a CQL editor.
+ */
+function showSquiggles(editor, source, diagnostics) {
+  let overlay = editorOverlay(editor, 'squiggles');
+  if (!overlay) {
+    return;
+  }
+  overlay.replaceChildren();
+  let byLine = new Map();
+  for (let d of diagnostics) {
+    byLine.set(d.line, [...(byLine.get(d.line) || []), d]);
+  }
+  source.split('\n').forEach(function(line, i) {
+    let col = 0;
+    let diags = (byLine.get(i + 1) || []).sort((a, b) => a.column - b.column);
+    for (let d of diags) {
+      if (d.column < col) {
+        continue;
+      }
+      overlay.appendChild(document.createTextNode(line.substring(col, d.column)));
+      let word = line.substring(d.column).match(/^(\w+|\S)/);
+      let squiggle = document.createElement('span');
+      squiggle.className = 'squiggle';
+      squiggle.textContent = word ? word[0] : ' ';
+      overlay.appendChild(squiggle);
+      col = d.column + squiggle.textContent.length;
+    }
+    overlay.appendChild(document.createTextNode(line.substring(col) + '\n'));
+  });
+}
+
+/**
+ * loadCoverage evaluates the CQL in debug mode, and highlights in each CQL
+ * editor the expressions that were evaluated and those never reached.
+ */
+function loadCoverage() {
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE) {
+      return;
+    }
+    let summary = document.getElementById('coverageSummary');
+    if (xhr.status != 200) {
+      summary.textContent = '';
+      clearCoverage();
+      return;
+    }
+    let coverage = JSON.parse(xhr.responseText);
+    summary.textContent =
+        `${coverage.covered} of ${coverage.total} expressions evaluated`;
+    [code, ...libraries].forEach(function(source, i) {
+      showCoverage(
+          sourceEditor(i), source,
+          coverage.expressions.filter((e) => e.source == i));
+    });
+  };
+  xhr.open('POST', '/coverage', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  xhr.send(JSON.stringify(request()));
+}
+
+/**
+ * showCoverage highlights the covered expressions of a CQL editor. Each
+ * character takes the color of the innermost expression it is in, so an
+ * unreached branch stands out within an evaluated expression.
+ */
+function showCoverage(editor, source, expressions) {
+  let overlay = editorOverlay(editor, 'coverage');
+  if (!overlay) {
+    return;
+  }
+  overlay.replaceChildren();
+  let lines = source.split('\n');
+  let marks = lines.map((line) => new Array(line.length).fill(''));
+  // Expressions are sorted with enclosing expressions first, so inner ones
+  // overwrite the marks of the expressions they are in.
+  for (let e of expressions) {
+    let mark = e.evaluations > 0 ? 'covered' : 'uncovered';
+    for (let l = e.startLine; l <= e.endLine && l <= lines.length; l++) {
+      let from = l == e.startLine ? e.startCol - 1 : 0;
+      let to = l == e.endLine ? e.endCol : lines[l - 1].length;
+      marks[l - 1].fill(mark, from, to);
+    }
+  }
+  lines.forEach(function(line, l) {
+    let col = 0;
+    while (col < line.length) {
+      let end = col;
+      while (end < line.length && marks[l][end] == marks[l][col]) {
+        end++;
+      }
+      let span = document.createElement('span');
+      span.className = marks[l][col];
+      span.textContent = line.substring(col, end);
+      overlay.appendChild(span);
+      col = end;
+    }
+    overlay.appendChild(document.createTextNode('\n'));
+  });
+}
+
+/**
+ * clearCoverage removes the coverage highlighting of the given CQL editor, or
+ * of all CQL editors if none is given.
+ */
+function clearCoverage(editor) {
+  let editors = editor ? [editor] : document.querySelectorAll('code-input');
+  for (let e of editors) {
+    let overlay = e.querySelector('pre.coverage');
+    if (overlay) {
+      overlay.replaceChildren();
+    }
+  }
+}
+
+/**
+ * sourceEditor returns the editor of the CQL source at the given index, 0 for
+ * the main CQL.
+ */
+function sourceEditor(source) {
+  return document.getElementById(
+      source == 0 ? 'cqlInput' : 'libraryInput' + (source - 1));
+}
+
+// diagnosticsTimer delays checking the CQL until the user pauses typing.
+let diagnosticsTimer = null;
+
+/**
+ * checkDiagnostics parses the current CQL without evaluating it, and shows the
+ * parse errors while the user types.
+ */
+function checkDiagnostics() {
+  clearTimeout(diagnosticsTimer);
+  diagnosticsTimer = setTimeout(function() {
+    let xhr = newRequest();
+    xhr.onreadystatechange = function() {
+      if (xhr.readyState == XMLHttpRequest.DONE && xhr.status == 200) {
+        renderDiagnostics(JSON.parse(xhr.responseText).diagnostics);
+      }
+    };
+    xhr.open('POST', '/diagnostics', true);
+    xhr.setRequestHeader('Content-Type', 'application/json');
+    xhr.send(JSON.stringify(request()));
+  }, 500);
+}
+
+/**
+ * share saves the current CQL and data to a permalink, which is shown to the
+ * user and set as the URL of the page.
+ */
+function share() {
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE) {
+      return;
+    }
+    let shareLink = document.getElementById('shareLink');
+    if (xhr.status != 200) {
+      shareLink.value = xhr.responseText;
+    } else {
+      window.location.hash = 's=' + JSON.parse(xhr.responseText).id;
+      shareLink.value = window.location.href;
+    }
+    shareLink.style.display = 'inline';
+    shareLink.select();
+  };
+  xhr.open('POST', '/share', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  xhr.send(JSON.stringify(workspace()));
+}
+
+/**
+ * generateData replaces the data with a bundle generated to satisfy the data
+ * requirements of the current CQL.
+ */
+function generateData() {
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE) {
+      return;
+    }
+    showDiagnostics(xhr);
+    if (xhr.status != 200) {
+      document.getElementById('results').innerHTML = xhr.responseText;
+      return;
+    }
+    data = JSON.stringify(JSON.parse(xhr.responseText), null, 2);
+    document.getElementById('dataInput').value = data;
+    showTab('dataEntry', 'dataTabButton');
+  };
+  xhr.open('POST', '/generate_data', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  xhr.send(JSON.stringify(request()));
+}
+
+/**
+ * compareResults evaluates the main CQL and the baseline version of it against
+ * the same data, and shows how the result of each define changed.
+ */
+function compareResults() {
+  let pane = document.getElementById('comparePane');
+  let output = document.getElementById('compareOutput');
+  pane.open = true;
+  if (!baseline) {
+    output.textContent =
+        'Set a baseline version of the CQL in the Baseline tab to compare against.';
+    return;
+  }
+  output.textContent = 'Comparing...';
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE) {
+      return;
+    }
+    if (xhr.status != 200) {
+      output.textContent = xhr.responseText;
+      return;
+    }
+    let comparison = JSON.parse(xhr.responseText);
+    let changed = comparison.defines.filter((d) => d.status != 'unchanged');
+    let summary = document.createElement('p');
+    summary.textContent = `${comparison.baselineLibrary || 'Baseline'} → ` +
+        `${comparison.currentLibrary || 'Current'}: ${changed.length} of ` +
+        `${comparison.defines.length} defines changed.`;
+    let table = document.createElement('table');
+    table.className = 'compareTable';
+    let header = table.createTHead().insertRow();
+    for (let name of ['Define', 'Status', 'Baseline', 'Current']) {
+      let th = document.createElement('th');
+      th.textContent = name;
+      header.appendChild(th);
+    }
+    // Changes are listed first, since they are what a review is about.
+    let defines = [...changed,
+                   ...comparison.defines.filter((d) => d.status == 'unchanged')];
+    let body = table.createTBody();
+    for (let d of defines) {
+      let row = body.insertRow();
+      row.className = d.status;
+      row.insertCell().textContent = d.name;
+      row.insertCell().textContent = d.status;
+      for (let value of [d.baseline, d.current]) {
+        let pre = document.createElement('pre');
+        pre.textContent =
+            value === undefined ? '' : JSON.stringify(value, null, 2);
+        row.insertCell().appendChild(pre);
+      }
+    }
+    output.replaceChildren(summary, table);
+  };
+  xhr.open('POST', '/compare', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  xhr.send(JSON.stringify(Object.assign(request(), {'baselineCql': baseline})));
+}
+
+/**
+ * inspectELM shows the parsed ELM of each library in the ELM pane as a
+ * collapsible tree.
+ */
+function inspectELM() {
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE) {
+      return;
+    }
+    showDiagnostics(xhr);
+    let tree = document.getElementById('elmTree');
+    tree.replaceChildren();
+    if (xhr.status != 200) {
+      tree.textContent = xhr.responseText;
+    } else {
+      for (let lib of JSON.parse(xhr.responseText).libraries) {
+        let node = elmNode(lib.library, lib.elm.library);
+        node.open = true;
+        tree.appendChild(node);
+      }
+    }
+    document.getElementById('elmPane').open = true;
+  };
+  xhr.open('POST', '/elm', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  xhr.send(JSON.stringify(request()));
+}
+
+/**
+ * elmNode returns the tree view of an ELM value. Objects and arrays are
+ * collapsible and labelled by their ELM type, other values are shown inline.
+ */
+function elmNode(name, value) {
+  if (value === null || typeof value != 'object') {
+    let leaf = document.createElement('div');
+    leaf.className = 'elmLeaf';
+    leaf.textContent = `${name}: ${JSON.stringify(value)}`;
+    return leaf;
+  }
+  let node = document.createElement('details');
+  let summary = document.createElement('summary');
+  summary.textContent = name + ' ';
+  let type = document.createElement('span');
+  type.className = 'elmType';
+  type.textContent = Array.isArray(value) ? `[${value.length}]` :
+                                            (value.type || '');
+  if (typeof value.name == 'string') {
+    type.textContent += ` ${value.name}`;
+  }
+  summary.appendChild(type);
+  node.appendChild(summary);
+  for (let [key, child] of Object.entries(value)) {
+    if (key == 'type') {
+      continue;
+    }
+    node.appendChild(elmNode(key, child));
+  }
+  return node;
+}
+
+// defineDeclaration matches the declaration of an expression definition,
+// capturing its name.
+const defineDeclaration =
+    /^\s*define\s+(?:(?:public|private)\s+)?(?!function\b|fluent\b)("[^"]+"|[A-Za-z_]\w*)\s*:/;
+
+/**
+ * defineAtCursor returns the name of the expression definition the cursor of
+ * the CQL editor is in, or null.
+ */
+function defineAtCursor() {
+  let textarea = document.querySelector('#cqlInput textarea');
+  let pos = textarea ? textarea.selectionStart : 0;
+  let lines = code.substring(0, pos).split('\n');
+  lines[lines.length - 1] = code.split('\n')[lines.length - 1];
+  for (let i = lines.length - 1; i >= 0; i--) {
+    if (!/^\s*define\b/.test(lines[i])) {
+      continue;
+    }
+    // The cursor may be in a function, which cannot be debugged on its own.
+    let match = lines[i].match(defineDeclaration);
+    return match ? match[1].replace(/^"|"$/g, '') : null;
+  }
+  return null;
+}
+
+/**
+ * debugDefine evaluates the define at the cursor in debug mode, and shows the
+ * values of each of its sub-expressions in the debugger pane. Hovering a
+ * sub-expression shows the value of every evaluation of it.
+ */
+function debugDefine() {
+  let output = document.getElementById('debugOutput');
+  document.getElementById('debugPane').open = true;
+  let define = defineAtCursor();
+  if (!define) {
+    output.textContent = 'Place the cursor in a define of the CQL tab to debug it.';
+    return;
+  }
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE) {
+      return;
+    }
+    showDiagnostics(xhr);
+    output.replaceChildren();
+    if (xhr.status != 200) {
+      output.textContent = xhr.responseText;
+      return;
+    }
+    let debug = JSON.parse(xhr.responseText);
+    let sources = [code, ...libraries];
+    let header = document.createElement('h4');
+    header.textContent =
+        `${debug.library} ${debug.define} = ${JSON.stringify(debug.value)}`;
+    output.appendChild(header);
+    for (let step of debug.steps) {
+      output.appendChild(debugStepNode(sources[step.source], step));
+    }
+  };
+  xhr.open('POST', '/debug', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  let body = request();
+  body.define = define;
+  xhr.send(JSON.stringify(body));
+}
+
+/**
+ * debugStepNode returns the row of the debugger showing a sub-expression and
+ * its last value. All of its values are shown on hover.
+ */
+function debugStepNode(source, step) {
+  let row = document.createElement('div');
+  row.className = 'debugStep';
+  let loc = `${step.startLine}:${step.startCol}-${step.endLine}:${step.endCol}`;
+  let text = source === undefined ? step.library :
+                                     sourceSnippet(source, step);
+  row.textContent = `${loc.padEnd(14)} ${text.replace(/\s+/g, ' ')} `;
+  let value = document.createElement('span');
+  value.className = 'debugValue';
+  let last = step.values[step.values.length - 1];
+  value.textContent = '= ' + JSON.stringify(last) +
+      (step.values.length > 1 ? ` (${step.values.length} evaluations)` : '');
+  row.appendChild(value);
+  row.title = step.values.map((v) => JSON.stringify(v, null, 2)).join('\n');
+  return row;
+}
+
+/**
+ * sourceSnippet returns the text of source at the locator of step. Lines and
+ * columns are 1-based and the end column is inclusive.
+ */
+function sourceSnippet(source, step) {
+  let lines = source.split('\n').slice(step.startLine - 1, step.endLine);
+  if (lines.length == 0) {
+    return '';
+  }
+  lines[lines.length - 1] = lines[lines.length - 1].substring(0, step.endCol);
+  lines[0] = lines[0].substring(step.startCol - 1);
+  return lines.join('\n');
+}
+
+/**
+ * bindCompletion shows completions for the CQL editors when Ctrl+Space is
+ * pressed, and handles the keys that pick a completion.
+ */
+function bindCompletion() {
+  document.addEventListener('keydown', function(e) {
+    let editor = e.target.closest && e.target.closest('code-input');
+    if (!editor || editor.getAttribute('lang') != 'cql' ||
+        editorSource(editor) < 0) {
+      return;
+    }
+    let popup = document.getElementById('completions');
+    if (popup.style.display == 'block') {
+      let items = popup.querySelectorAll('.completion');
+      let selected = popup.querySelector('.completion.selected');
+      let index = Array.prototype.indexOf.call(items, selected);
+      if (e.key == 'ArrowDown' || e.key == 'ArrowUp') {
+        e.preventDefault();
+        index = (index + (e.key == 'ArrowDown' ? 1 : -1) + items.length) %
+            items.length;
+        selected.classList.remove('selected');
+        items[index].classList.add('selected');
+        items[index].scrollIntoView({block: 'nearest'});
+        return;
+      }
+      if ((e.key == 'Enter' || e.key == 'Tab') && selected) {
+        e.preventDefault();
+        selected.click();
+        return;
+      }
+      hideCompletions();
+    }
+    if (e.ctrlKey && e.key == ' ') {
+      e.preventDefault();
+      showCompletions(e.target, editorSource(editor));
+    }
+  }, true);
+  document.addEventListener('click', function(e) {
+    if (!e.target.closest('#completions')) {
+      hideCompletions();
+    }
+  });
 }
 
 /**
- * showDataTab shows the data tab and hides the CQL tab.
+ * bindLiveDiagnostics checks the CQL for parse errors as the user types in any
+ * of the CQL editors.
  */
-function showDataTab() {
-  document.getElementById('cqlEntry').style.display = 'none';
-  document.getElementById('dataEntry').style.display = 'block';
+function bindLiveDiagnostics() {
+  document.addEventListener('input', function(e) {
+    let editor = e.target.closest && e.target.closest('code-input');
+    if (!editor || editor.getAttribute('lang') != 'cql' ||
+        editorSource(editor) < 0) {
+      return;
+    }
+    setSource(editorSource(editor), e.target.value);
+    // Coverage is of the last run, so it no longer matches the edited CQL.
+    clearCoverage(editor);
+    checkDiagnostics();
+  });
+}
 
-  document.getElementById('dataTabButton').className += 'active';
-  document.getElementById('cqlTabButton').className = '';
+/**
+ * editorSource returns the index of the CQL source edited by the editor, 0 for
+ * the main CQL, or -1 if the editor is not of a source of the request, like
+ * the baseline editor.
+ */
+function editorSource(editor) {
+  if (editor.id == 'cqlInput') {
+    return 0;
+  }
+  let match = editor.id.match(/^libraryInput(\d+)$/);
+  return match ? Number(match[1]) + 1 : -1;
 }
 
 /**
- * showCQLTab shows the CQL tab and hides the data tab.
+ * setSource updates the CQL source at the given index from its editor.
  */
-function showCQLTab() {
-  document.getElementById('cqlEntry').style.display = 'block';
-  document.getElementById('dataEntry').style.display = 'none';
+function setSource(source, value) {
+  if (source == 0) {
+    code = value;
+  } else {
+    libraries[source - 1] = value;
+  }
+}
 
-  document.getElementById('cqlTabButton').className += 'active';
-  document.getElementById('dataTabButton').className = '';
+/**
+ * showCompletions requests the completions at the cursor of the textarea of a
+ * CQL editor, and shows them in a popup below the cursor line.
+ */
+function showCompletions(textarea, source) {
+  setSource(source, textarea.value);
+  let lines = textarea.value.substring(0, textarea.selectionStart).split('\n');
+  let body = request();
+  body.source = source;
+  body.line = lines.length;
+  body.column = lines[lines.length - 1].length;
+
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE || xhr.status != 200) {
+      return;
+    }
+    let resp = JSON.parse(xhr.responseText);
+    let popup = document.getElementById('completions');
+    popup.replaceChildren();
+    for (let c of resp.completions) {
+      let item = document.createElement('div');
+      item.className = 'completion';
+      item.textContent = c.label + ' ';
+      let detail = document.createElement('span');
+      detail.className = 'completionDetail';
+      detail.textContent = c.kind + ' ' + c.detail.split('\n')[0];
+      item.appendChild(detail);
+      item.title = c.detail;
+      item.addEventListener('click', function(e) {
+        let end = textarea.selectionStart;
+        textarea.setRangeText(c.label, end - resp.prefix.length, end, 'end');
+        textarea.dispatchEvent(new Event('input', {bubbles: true}));
+        setSource(source, textarea.value);
+        hideCompletions();
+        textarea.focus();
+      });
+      popup.appendChild(item);
+    }
+    if (resp.completions.length == 0) {
+      return;
+    }
+    popup.firstChild.classList.add('selected');
+    let rect = textarea.getBoundingClientRect();
+    let lineHeight = parseFloat(getComputedStyle(textarea).lineHeight) || 18;
+    popup.style.left = (rect.left + window.scrollX) + 'px';
+    popup.style.top = (rect.top + window.scrollY +
+                       Math.min(lines.length * lineHeight, rect.height)) +
+        'px';
+    popup.style.display = 'block';
+  };
+  xhr.open('POST', '/complete', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  xhr.send(JSON.stringify(body));
+}
+
+/**
+ * hideCompletions hides the completion popup.
+ */
+function hideCompletions() {
+  document.getElementById('completions').style.display = 'none';
+}
+
+/**
+ * loadParameters lists the parameters of the main CQL in the parameters tab,
+ * with an input to override each of them. Empty inputs keep the default.
+ */
+function loadParameters() {
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE || xhr.status != 200) {
+      return;
+    }
+    let table = document.getElementById('parametersTable');
+    table.replaceChildren();
+    for (let param of JSON.parse(xhr.responseText).parameters) {
+      let row = table.insertRow();
+      row.insertCell().textContent = param.name;
+      row.insertCell().textContent = param.type;
+      let input = document.createElement('input');
+      input.className = 'parameterInput';
+      input.type = 'text';
+      input.placeholder = param.default || 'null';
+      input.value = parameters[param.name] || '';
+      input.onchange = function(e) {
+        if (e.target.value) {
+          parameters[param.name] = e.target.value;
+        } else {
+          delete parameters[param.name];
+        }
+      };
+      row.insertCell().appendChild(input);
+    }
+  };
+  xhr.open('POST', '/parameters', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  xhr.send(JSON.stringify(request()));
+}
+
+/**
+ * loadSharedSnippet loads the CQL and data of the permalink in the URL of the
+ * page, if there is one.
+ */
+function loadSharedSnippet() {
+  let match = window.location.hash.match(/^#s=(.+)$/);
+  if (!match) {
+    return;
+  }
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE) {
+      return;
+    }
+    if (xhr.status != 200) {
+      document.getElementById('results').innerHTML = xhr.responseText;
+      return;
+    }
+    setWorkspace(JSON.parse(xhr.responseText));
+    updateInputs();
+  };
+  xhr.open('GET', '/share?id=' + encodeURIComponent(match[1]), true);
+  xhr.send();
+}
+
+// workspaceKey is the localStorage key the workspace is autosaved to.
+const workspaceKey = 'cqlplay.workspace';
+
+let autosaveTimer = null;
+
+/**
+ * setWorkspace sets the CQL, libraries, data, FHIR server, terminology and
+ * parameters from a workspace, which has the same fields as the body of an
+ * /eval_cql request. The inputs must be updated afterwards with updateInputs.
+ */
+function setWorkspace(workspace) {
+  code = workspace.cql || '';
+  libraries = workspace.libraries || [];
+  data = workspace.data || '';
+  evaluationTimestamp = workspace.evaluationTimestamp || '';
+  parameters = workspace.parameters || {};
+  terminology = workspace.terminology || '';
+  baseline = workspace.baselineCql || '';
+  fhirServer = null;
+  if (workspace.fhirServer) {
+    fhirServer = {
+      'url': workspace.fhirServer.url || '',
+      'patientId': workspace.fhirServer.patientId || '',
+    };
+  }
+}
+
+/**
+ * exportWorkspace downloads the whole workspace as a single JSON file.
+ */
+function exportWorkspace() {
+  let blob = new Blob(
+      [JSON.stringify(workspace(), null, 2)], {type: 'application/json'});
+  let link = document.createElement('a');
+  link.href = URL.createObjectURL(blob);
+  link.download = 'cqlplay-workspace.json';
+  link.click();
+  URL.revokeObjectURL(link.href);
+}
+
+/**
+ * importWorkspace replaces the workspace with the one in a JSON file exported
+ * by exportWorkspace.
+ */
+function importWorkspace(file) {
+  if (!file) {
+    return;
+  }
+  file.text().then(function(text) {
+    let imported;
+    try {
+      imported = JSON.parse(text);
+    } catch (err) {
+      imported = null;
+    }
+    if (!imported || typeof imported.cql != 'string') {
+      document.getElementById('results').textContent =
+          'Error: ' + file.name + ' is not a workspace file';
+      showResultsView(false);
+      return;
+    }
+    setWorkspace(imported);
+    updateInputs();
+    saveWorkspace();
+  });
+}
+
+/**
+ * bindAutosave saves the workspace to localStorage shortly after each edit, so
+ * that work is not lost when the page is refreshed.
+ */
+function bindAutosave() {
+  let schedule = function() {
+    clearTimeout(autosaveTimer);
+    autosaveTimer = setTimeout(saveWorkspace, 1000);
+  };
+  document.addEventListener('input', schedule);
+  document.addEventListener('change', schedule);
+  window.addEventListener('beforeunload', saveWorkspace);
+}
+
+/**
+ * saveWorkspace saves the workspace to localStorage.
+ */
+function saveWorkspace() {
+  try {
+    localStorage.setItem(workspaceKey, JSON.stringify(workspace()));
+  } catch (err) {
+    // localStorage may be disabled or full, in which case nothing is saved.
+  }
+}
+
+/**
+ * restoreWorkspace restores the workspace autosaved to localStorage, if there
+ * is one. The inputs must be updated afterwards with updateInputs.
+ */
+function restoreWorkspace() {
+  try {
+    let saved = localStorage.getItem(workspaceKey);
+    if (saved) {
+      setWorkspace(JSON.parse(saved));
+    }
+  } catch (err) {
+    // Keep the default workspace if the saved one cannot be read.
+  }
+}
+
+/**
+ * showTab shows the tab content with the given id and hides all others.
+ */
+function showTab(contentId, buttonId) {
+  for (let el of document.querySelectorAll('.tabContent')) {
+    el.style.display = el.id == contentId ? 'block' : 'none';
+  }
+  for (let el of document.querySelectorAll('.tabholder button')) {
+    el.classList.toggle('active', el.id == buttonId);
+  }
 }
 
 /**
@@ -155,12 +1200,59 @@ function setupPrism() {
  */
 function main() {
   setupPrism();
+  restoreWorkspace();
   updateInputs();
   bindInputsOnChange();
   bindButtonActions();
+  bindCompletion();
+  bindLiveDiagnostics();
+  bindAutosave();
+
+  showTab('cqlEntry', 'cqlTabButton');
+
+  // The shared snippet is loaded once it is known whether requests are handled
+  // in the browser or by the server.
+  loadWasm()
+      .catch(function(err) {
+        console.error(err);
+        return false;
+      })
+      .then(function(inBrowser) {
+        if (inBrowser) {
+          document.getElementById('evalMode').textContent =
+              'CQL is evaluated in your browser, no data leaves this page.';
+          loadSharedSnippet();
+        } else {
+          checkAuthToken(loadSharedSnippet);
+        }
+      });
+}
 
-  // Initially hide dataEntry tab:
-  document.getElementById('dataEntry').style.display = 'none';
+/**
+ * checkAuthToken asks for the auth token until the server accepts it, if the
+ * server requires one, and then calls done.
+ */
+function checkAuthToken(done) {
+  let xhr = newRequest();
+  xhr.onreadystatechange = function() {
+    if (xhr.readyState != XMLHttpRequest.DONE) {
+      return;
+    }
+    if (xhr.status != 401) {
+      done();
+      return;
+    }
+    let token = window.prompt('This playground requires an auth token:');
+    if (token == null) {
+      done();
+      return;
+    }
+    setAuthToken(token);
+    checkAuthToken(done);
+  };
+  xhr.open('POST', '/diagnostics', true);
+  xhr.setRequestHeader('Content-Type', 'application/json');
+  xhr.send(JSON.stringify({'cql': ''}));
 }
 
 main();  // All code actually executed when the script is loaded by the HTML.
\ No newline at end of file
@@ -0,0 +1,293 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview resultsView.js renders the results of /eval_cql for review:
+ * lists of FHIR resources as sortable tables, and dates and intervals on a
+ * timeline. Everything else is shown as JSON.
+ */
+
+/**
+ * renderResults replaces the content of container with a view of the results,
+ * which are the parsed JSON response of /eval_cql.
+ */
+export function renderResults(container, results) {
+  container.replaceChildren();
+  for (let lib of results) {
+    let section = document.createElement('div');
+    section.className = 'resultLibrary';
+    let header = document.createElement('h4');
+    header.textContent = `${lib.libName} ${lib.libVersion || ''}`;
+    section.appendChild(header);
+
+    let defs = lib.expressionDefinitions || {};
+    let temporal = [];
+    for (let [name, value] of Object.entries(defs)) {
+      let spans = temporalSpans(value);
+      if (spans.length > 0) {
+        temporal.push({name: name, spans: spans});
+        continue;
+      }
+      let def = document.createElement('div');
+      def.className = 'resultDefinition';
+      let title = document.createElement('h5');
+      title.textContent = name;
+      def.appendChild(title);
+      def.appendChild(valueView(value));
+      section.appendChild(def);
+    }
+    if (temporal.length > 0) {
+      let title = document.createElement('h5');
+      title.textContent = 'Timeline';
+      section.appendChild(title);
+      section.appendChild(timeline(temporal));
+    }
+    container.appendChild(section);
+  }
+}
+
+/**
+ * valueView returns the view of a single result: a table for lists of
+ * resources, and JSON otherwise.
+ */
+function valueView(value) {
+  if (Array.isArray(value) && value.length > 0 && value.every(isResource)) {
+    return resourceTable(value.map(
+        (v) => ({'type': v['@type'].replace(/^FHIR\./, ''), ...v.value})));
+  }
+  let pre = document.createElement('pre');
+  pre.className = 'resultJSON';
+  pre.textContent = JSON.stringify(value, null, 2);
+  return pre;
+}
+
+/**
+ * isResource returns true for FHIR resources and other FHIR elements, which are
+ * results of the form {"@type": "FHIR.Observation", "value": {...}}.
+ */
+function isResource(v) {
+  return v !== null && typeof v == 'object' &&
+      typeof v['@type'] == 'string' && v['@type'].startsWith('FHIR.') &&
+      v.value !== null && typeof v.value == 'object' &&
+      !Array.isArray(v.value);
+}
+
+// skippedColumns are resource fields that are not useful in a table.
+const skippedColumns = new Set(['meta', 'text', 'contained', 'extension', 'modifierExtension']);
+
+/**
+ * resourceTable returns a table with a row per resource and a column per
+ * field. Clicking a column header sorts by it.
+ */
+function resourceTable(resources) {
+  let columns = [];
+  for (let r of resources) {
+    for (let key of Object.keys(r)) {
+      if (!skippedColumns.has(key) && !columns.includes(key)) {
+        columns.push(key);
+      }
+    }
+  }
+  let rows = resources.map((r) => columns.map((c) => summarize(r[c])));
+
+  let table = document.createElement('table');
+  table.className = 'resultTable';
+  let head = table.createTHead().insertRow();
+  let body = table.createTBody();
+  let sortColumn = -1;
+  let ascending = true;
+  let fill = function() {
+    body.replaceChildren();
+    for (let row of rows) {
+      let tr = body.insertRow();
+      for (let cell of row) {
+        tr.insertCell().textContent = cell;
+      }
+    }
+  };
+  columns.forEach(function(column, i) {
+    let th = document.createElement('th');
+    th.textContent = column;
+    th.addEventListener('click', function(e) {
+      ascending = sortColumn == i ? !ascending : true;
+      sortColumn = i;
+      rows.sort((a, b) => a[i].localeCompare(b[i], undefined, {numeric: true}) *
+                   (ascending ? 1 : -1));
+      for (let el of head.children) {
+        el.classList.remove('sortedAscending', 'sortedDescending');
+      }
+      th.classList.add(ascending ? 'sortedAscending' : 'sortedDescending');
+      fill();
+    });
+    head.appendChild(th);
+  });
+  fill();
+  return table;
+}
+
+/**
+ * summarize returns a short text for a FHIR element in the JSON form of the
+ * FHIR protos, for example the display of a CodeableConcept or the bounds of a
+ * Period.
+ */
+function summarize(v) {
+  if (v === undefined || v === null) {
+    return '';
+  }
+  if (typeof v != 'object') {
+    return String(v);
+  }
+  if (Array.isArray(v)) {
+    return v.map(summarize).join(', ');
+  }
+  let keys = Object.keys(v);
+  if (keys.length == 1) {
+    // Primitives, choice types and references hold a single field.
+    return summarize(v[keys[0]]);
+  }
+  if (v.valueUs !== undefined) {
+    let iso = new Date(Number(v.valueUs) / 1000).toISOString();
+    return v.precision == 'DAY' ? iso.substring(0, 10) :
+        v.precision == 'MONTH' ? iso.substring(0, 7) :
+        v.precision == 'YEAR'  ? iso.substring(0, 4) :
+                                 iso;
+  }
+  if (v.value !== undefined) {
+    return `${summarize(v.value)}${v.unit ? ' ' + summarize(v.unit) : ''}`;
+  }
+  if (v.coding !== undefined || v.text !== undefined) {
+    return v.text ? summarize(v.text) : summarize(v.coding);
+  }
+  if (v.code !== undefined && (v.system !== undefined || v.display !== undefined)) {
+    return summarize(v.display || v.code);
+  }
+  if (v.start !== undefined || v.end !== undefined) {
+    return `${summarize(v.start)} - ${summarize(v.end)}`;
+  }
+  return keys.map((k) => `${k}: ${summarize(v[k])}`).join('; ');
+}
+
+/**
+ * temporalSpans returns the dates and intervals in a result as spans of
+ * milliseconds, or an empty list if the result is not temporal. A date is a
+ * span with equal start and end.
+ */
+function temporalSpans(value) {
+  let values = Array.isArray(value) ? value : [value];
+  let spans = [];
+  for (let v of values) {
+    if (v === null || typeof v != 'object') {
+      return [];
+    }
+    let point = temporalPoint(v);
+    if (point !== null) {
+      spans.push({start: point, end: point, label: v.value});
+      continue;
+    }
+    if (v.low === undefined && v.high === undefined) {
+      return [];
+    }
+    let low = v.low ? temporalPoint(v.low) : null;
+    let high = v.high ? temporalPoint(v.high) : null;
+    if (low === null && high === null) {
+      return [];
+    }
+    spans.push({
+      start: low === null ? high : low,
+      end: high === null ? low : high,
+      label: `${v.lowClosed ? '[' : '('}${v.low?.value ?? ''}, ` +
+          `${v.high?.value ?? ''}${v.highClosed ? ']' : ')'}`,
+    });
+  }
+  return spans;
+}
+
+/**
+ * temporalPoint returns the milliseconds of a CQL Date or DateTime result, or
+ * null if it is not one.
+ */
+function temporalPoint(v) {
+  if (v === null || typeof v != 'object' ||
+      (v['@type'] != 'System.Date' && v['@type'] != 'System.DateTime') ||
+      typeof v.value != 'string') {
+    return null;
+  }
+  let ms = Date.parse(v.value.replace(/^@/, ''));
+  return isNaN(ms) ? null : ms;
+}
+
+/**
+ * timeline returns an SVG with a row per definition, drawing dates as points
+ * and intervals as bars on a shared time axis. Hovering shows the values.
+ */
+function timeline(rows) {
+  const ns = 'http://www.w3.org/2000/svg';
+  const labelWidth = 200;
+  const width = 900;
+  const rowHeight = 24;
+  let min = Infinity;
+  let max = -Infinity;
+  for (let row of rows) {
+    for (let s of row.spans) {
+      min = Math.min(min, s.start);
+      max = Math.max(max, s.end);
+    }
+  }
+  if (max == min) {
+    max = min + 24 * 60 * 60 * 1000;
+  }
+  let x = (ms) => labelWidth + (ms - min) / (max - min) * (width - labelWidth - 10);
+
+  let svg = document.createElementNS(ns, 'svg');
+  svg.setAttribute('class', 'timeline');
+  svg.setAttribute('width', width);
+  svg.setAttribute('height', (rows.length + 1) * rowHeight);
+  let text = function(content, tx, ty, anchor) {
+    let t = document.createElementNS(ns, 'text');
+    t.setAttribute('x', tx);
+    t.setAttribute('y', ty);
+    t.setAttribute('text-anchor', anchor);
+    t.textContent = content;
+    svg.appendChild(t);
+  };
+  rows.forEach(function(row, i) {
+    let y = i * rowHeight + rowHeight / 2;
+    text(row.name, labelWidth - 8, y + 4, 'end');
+    for (let s of row.spans) {
+      let shape;
+      if (s.start == s.end) {
+        shape = document.createElementNS(ns, 'circle');
+        shape.setAttribute('cx', x(s.start));
+        shape.setAttribute('cy', y);
+        shape.setAttribute('r', 5);
+      } else {
+        shape = document.createElementNS(ns, 'rect');
+        shape.setAttribute('x', x(s.start));
+        shape.setAttribute('y', y - 6);
+        shape.setAttribute('width', Math.max(x(s.end) - x(s.start), 2));
+        shape.setAttribute('height', 12);
+      }
+      let title = document.createElementNS(ns, 'title');
+      title.textContent = `${row.name}: ${s.label}`;
+      shape.appendChild(title);
+      svg.appendChild(shape);
+    }
+  });
+  let axisY = rows.length * rowHeight + rowHeight / 2;
+  text(new Date(min).toISOString().substring(0, 10), labelWidth, axisY + 4, 'start');
+  text(new Date(max).toISOString().substring(0, 10), width - 10, axisY + 4, 'end');
+  return svg;
+}
@@ -0,0 +1,153 @@
+/**
+ * Copyright 2024 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// When cqlplay.wasm, the playground built for js/wasm, is hosted next to the
+// page, the CQL is parsed and evaluated in the browser instead of on a server.
+// WasmRequest mimics the parts of XMLHttpRequest the playground uses, so that
+// requests are handled the same way in both modes.
+
+let wasmLoaded = false;
+
+/**
+ * loadWasm loads and starts cqlplay.wasm if it is hosted next to the page. It
+ * resolves to whether requests are now handled in the browser.
+ */
+export async function loadWasm() {
+  let resp;
+  try {
+    resp = await fetch('cqlplay.wasm');
+  } catch (err) {
+    return false;
+  }
+  if (!resp.ok) {
+    return false;
+  }
+  await loadScript('wasm_exec.js');
+  const go = new Go();
+  const {instance} =
+      await WebAssembly.instantiate(await resp.arrayBuffer(), go.importObject);
+  go.run(instance);
+  wasmLoaded = true;
+  return true;
+}
+
+/**
+ * newRequest returns a request to the playground, which is handled in the
+ * browser if cqlplay.wasm is loaded and by the server otherwise. Requests to
+ * the server carry the auth token set with setAuthToken, if any.
+ */
+export function newRequest() {
+  if (wasmLoaded) {
+    return new WasmRequest();
+  }
+  let xhr = new XMLHttpRequest();
+  let open = xhr.open;
+  xhr.open = function(...args) {
+    open.apply(xhr, args);
+    let token = authToken();
+    if (token) {
+      xhr.setRequestHeader('Authorization', 'Bearer ' + token);
+    }
+  };
+  return xhr;
+}
+
+// authTokenKey is the localStorage key of the token for servers run with
+// --auth_token.
+const authTokenKey = 'cqlplay.authToken';
+
+// sessionToken is the token set on this page, which is used even if it could
+// not be saved to localStorage.
+let sessionToken = null;
+
+/**
+ * setAuthToken sets the token sent to servers run with --auth_token, and
+ * remembers it in localStorage.
+ */
+export function setAuthToken(token) {
+  try {
+    localStorage.setItem(authTokenKey, token);
+  } catch (err) {
+    // The token is only kept for this page if localStorage is disabled.
+  }
+  sessionToken = token;
+}
+
+/**
+ * authToken returns the token sent to the server, or null if there is none.
+ */
+function authToken() {
+  if (sessionToken != null) {
+    return sessionToken;
+  }
+  try {
+    return localStorage.getItem(authTokenKey);
+  } catch (err) {
+    return null;
+  }
+}
+
+/**
+ * WasmRequest is a request handled by cqlplay.wasm, with the subset of the
+ * XMLHttpRequest interface used by the playground.
+ */
+class WasmRequest {
+  constructor() {
+    this.readyState = XMLHttpRequest.UNSENT;
+    this.status = 0;
+    this.responseText = '';
+    this.onreadystatechange = null;
+  }
+
+  open(method, url) {
+    this.method = method;
+    this.url = url;
+    this.readyState = XMLHttpRequest.OPENED;
+  }
+
+  setRequestHeader(name, value) {}
+
+  send(body) {
+    globalThis.cqlplayHandle(this.method, this.url, body || '')
+        .then((resp) => {
+          this.status = resp.status;
+          this.responseText = resp.body;
+        })
+        .catch((err) => {
+          this.status = 500;
+          this.responseText = 'Error: ' + err.message;
+        })
+        .finally(() => {
+          this.readyState = XMLHttpRequest.DONE;
+          if (this.onreadystatechange) {
+            this.onreadystatechange();
+          }
+        });
+  }
+}
+
+/**
+ * loadScript loads a classic script, resolving once it has run.
+ */
+function loadScript(src) {
+  return new Promise((resolve, reject) => {
+    let script = document.createElement('script');
+    script.src = src;
+    script.onload = resolve;
+    script.onerror = () => reject(new Error('failed to load ' + src));
+    document.head.appendChild(script);
+  });
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build js && wasm
+
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall/js"
+
+	log "github.com/golang/glog"
+)
+
+// main serves the playground inside the browser when cqlplay is built for js/wasm. Instead of
+// listening on a port it registers a cqlplayHandle(method, url, body) function with JavaScript,
+// which runs the same handlers as the server and returns a Promise of the {status, body} of the
+// response. This lets the playground be hosted as static files, with no data leaving the browser.
+func main() {
+	// There is no filesystem to write logs to in the browser.
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+	// Requests to FHIR servers are made by the browser itself, so they can only reach what the user
+	// can already reach.
+	allowedFHIRServers = []string{"*"}
+	h, err := serverHandler()
+	if err != nil {
+		log.Fatalf("cqlplay failed with an error: %v", err)
+	}
+
+	js.Global().Set("cqlplayHandle", js.FuncOf(func(this js.Value, args []js.Value) any {
+		method, url, body := args[0].String(), args[1].String(), args[2].String()
+		return newPromise(func() (any, error) {
+			return handle(h, method, url, body)
+		})
+	}))
+	select {}
+}
+
+// handle runs the request through the handler and returns the response as a JavaScript object.
+func handle(h http.Handler, method, url, body string) (any, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	resp := rec.Result()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"status": resp.StatusCode, "body": string(b)}, nil
+}
+
+// newPromise returns a JavaScript Promise of the result of f. f runs in a new goroutine, since
+// functions called from JavaScript must not block on other JavaScript callbacks, like the fetches
+// made by net/http.
+func newPromise(f func() (any, error)) js.Value {
+	return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+		go func() {
+			v, err := f()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(v)
+		}()
+		return nil
+	}))
+}
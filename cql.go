@@ -17,17 +17,26 @@ package cql
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
+	"github.com/google/cql/internal/datarequirements"
 	"github.com/google/cql/internal/embeddata"
 	"github.com/google/cql/internal/modelinfo"
 	"github.com/google/cql/interpreter"
+	"github.com/google/cql/metrics"
 	"github.com/google/cql/model"
+	"github.com/google/cql/optimizer"
 	"github.com/google/cql/parser"
 	"github.com/google/cql/result"
 	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/instrumented"
+	"github.com/google/cql/retriever/prefetch"
 	"github.com/google/cql/terminology"
+	terminstrumented "github.com/google/cql/terminology/instrumented"
+	"github.com/google/cql/types"
 )
 
 // ParseConfig configures the parsing of CQL to our internal ELM like data structure.
@@ -44,6 +53,14 @@ type ParseConfig struct {
 	// Interval[@2013-01-01T00:00:00.0, @2014-01-01T00:00:00.0) or {1, 2}. Parameters are optional and
 	// could be nil.
 	Parameters map[result.DefKey]string
+
+	// Optimizations if set runs the optimizer on the parsed libraries, so that they evaluate faster.
+	// The passes fold constant expressions, remove the definitions that the outputs of the config do
+	// not depend on and extract repeated sub-expressions into their own definitions, see the
+	// optimizer package for details. Since the optimized libraries are evaluated, debug traces,
+	// coverage and the ELM JSON reflect the optimized libraries rather than the CQL source.
+	// Optimizations are optional and could be nil.
+	Optimizations *optimizer.Config
 }
 
 // Parse parses CQL libraries into our internal ELM like data structure, which can then be
@@ -58,15 +75,23 @@ func Parse(ctx context.Context, libs []string, config ParseConfig) (*ELM, error)
 	if err != nil {
 		return nil, err
 	}
+	locators := p.Locators()
 	parsedParams, err := p.Parameters(ctx, config.Parameters, parser.Config{})
 	if err != nil {
 		return nil, err
 	}
+	if config.Optimizations != nil {
+		if err := optimizer.Optimize(ctx, parsedLibs, *config.Optimizations); err != nil {
+			return nil, result.NewEngineError("", result.ErrLibraryParsing, err)
+		}
+	}
 
 	return &ELM{
 		dataModels:   p.DataModel(),
+		dataModelXML: config.DataModels,
 		parsedParams: parsedParams,
 		parsedLibs:   parsedLibs,
+		locators:     locators,
 	}, nil
 }
 
@@ -86,6 +111,51 @@ type EvalConfig struct {
 	// ReturnPrivateDefs if true will return all private definitions in result.Libraries. By default
 	// only public definitions are returned.
 	ReturnPrivateDefs bool
+
+	// PrefetchRetrieves if true will analyze the data requirements of the parsed CQL and fetch all
+	// required resource types from the retriever in parallel before evaluation begins, instead of
+	// retrieving them one at a time during evaluation. This is useful for retrievers with high
+	// latency, such as those backed by a remote FHIR server.
+	PrefetchRetrieves bool
+
+	// Metrics if set will receive operational metrics for the evaluation, such as per resource type
+	// retrieve counts, payload sizes and latencies, and per operation terminology call counts and
+	// latencies. See the instrumented retriever and terminology packages for the names of the
+	// reported metrics. Metrics is optional and can be left nil.
+	Metrics metrics.Recorder
+
+	// SlowTerminologyThreshold if set logs every terminology call that takes at least this long,
+	// which helps diagnose CQL that is slow because of terminology.
+	SlowTerminologyThreshold time.Duration
+
+	// DefinitionStats if true records the wall time and retrieve count of each expression
+	// definition, which helps find the expensive expressions in a measure. The stats are available
+	// from result.Value.EvalStats and result.Libraries.EvalStats.
+	DefinitionStats bool
+
+	// Debug if true records the value of every sub-expression evaluated for each expression
+	// definition, keyed by the location of the sub-expression in the CQL source. The trace is
+	// available from result.Value.DebugTrace and result.Libraries.DebugTraces, and powers step
+	// debugging and explaining results. Debug mode retains every intermediate value, so it is slow and
+	// memory hungry on large data.
+	Debug bool
+
+	// DefineFilter if set selects which expression definitions are returned in result.Libraries,
+	// by name or regular expression. Every definition is still evaluated, since the kept definitions
+	// may depend on the dropped ones, unless SkipFilteredDefines is true. Private definitions are
+	// only returned if ReturnPrivateDefs is also true.
+	DefineFilter result.DefineFilter
+
+	// SkipFilteredDefines if true only evaluates the expression definitions kept by DefineFilter and
+	// the definitions they depend on. This makes evaluating a few definitions of a large library
+	// much faster.
+	SkipFilteredDefines bool
+
+	// DisableCompilation if true interprets the parsed CQL instead of evaluating it compiled. By
+	// default the parsed CQL is compiled to Go closures on the first call to Eval, which makes every
+	// following evaluation, like evaluating a measure for each patient of a population, cheaper.
+	// Debug mode always interprets.
+	DisableCompilation bool
 }
 
 // Eval executes the parsed CQL against the retriever. The retriever is the interface through which
@@ -93,31 +163,292 @@ type EvalConfig struct {
 // list of patients, Eval can be called once for each patient with a retriever initialized to
 // retrieve data for that patient. To connect to a particular data source you will need to implement
 // the retriever.Retriever interface, or use one of the included retrievers. See the retriever
-// package for more details. The retriever can be nil if the CQL does not fetch external data. Eval
-// should not be called from multiple goroutines on a single *ELM.
+// package for more details. The retriever can be nil if the CQL does not fetch external data. Each
+// expression definition is evaluated at most once per call, and expressions that reference it reuse
+// its value, so definitions shared by several others are not recomputed. Eval must not be called
+// from multiple goroutines at the same time on a single *ELM, since calls reuse the compiled
+// program and other state of the ELM. To evaluate in parallel give each goroutine its own *ELM, for
+// example a copy made with MarshalBinary and UnmarshalBinary.
 // Errors returned by Eval will always be a result.EngineError.
 func (e *ELM) Eval(ctx context.Context, retriever retriever.Retriever, config EvalConfig) (result.Libraries, error) {
 	evalTS := config.EvaluationTimestamp
 	if config.EvaluationTimestamp.IsZero() {
 		evalTS = time.Now()
 	}
+	if config.Metrics != nil && retriever != nil {
+		retriever = instrumented.New(retriever, config.Metrics)
+	}
+	tp := config.Terminology
+	if (config.Metrics != nil || config.SlowTerminologyThreshold > 0) && tp != nil {
+		tp = terminstrumented.New(tp, config.Metrics, terminstrumented.Config{SlowCallThreshold: config.SlowTerminologyThreshold})
+	}
+	if config.PrefetchRetrieves && retriever != nil {
+		reqs, err := e.DataRequirements()
+		if err != nil {
+			return nil, result.NewEngineError("", result.ErrEvaluationError, err)
+		}
+		retriever, err = prefetch.New(ctx, retriever, datarequirements.ResourceTypes(reqs))
+		if err != nil {
+			return nil, result.NewEngineError("", result.ErrEvaluationError, err)
+		}
+	}
 	c := interpreter.Config{
 		DataModels:          e.dataModels,
 		Parameters:          e.parsedParams,
 		Retriever:           retriever,
-		Terminology:         config.Terminology,
+		Terminology:         tp,
 		EvaluationTimestamp: evalTS,
 		ReturnPrivateDefs:   config.ReturnPrivateDefs,
+		DefinitionStats:     config.DefinitionStats,
+	}
+	if config.Debug {
+		c.DebugLocators = e.locators
 	}
+	if config.SkipFilteredDefines && !config.DefineFilter.IsZero() {
+		c.KeepDefinition = config.DefineFilter.Keep
+	}
+
+	var res result.Libraries
+	var err error
+	if config.Debug || config.DisableCompilation {
+		res, err = interpreter.Eval(ctx, e.parsedLibs, c)
+	} else {
+		res, err = e.evalCompiled(ctx, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Filter(config.DefineFilter), nil
+}
 
-	return interpreter.Eval(ctx, e.parsedLibs, c)
+// evalCompiled evaluates the parsed CQL with a compiled program. The program is compiled by the
+// first call and reused by the following ones, which is safe since Eval is not called concurrently.
+func (e *ELM) evalCompiled(ctx context.Context, c interpreter.Config) (result.Libraries, error) {
+	if e.program == nil {
+		p, err := interpreter.Compile(e.parsedLibs, e.dataModels)
+		if err != nil {
+			return nil, result.NewEngineError("", result.ErrEvaluationError, err)
+		}
+		e.program = p
+	}
+	return e.program.Eval(ctx, c)
+}
+
+// Coverage returns how many times each located expression in the expression and function
+// definitions of the parsed CQL was evaluated, given the results of Eval with EvalConfig.Debug set.
+// Expressions that were never reached, like the branch of an if that was not taken, have zero
+// evaluations. Only the definitions in the results are counted, so set EvalConfig.ReturnPrivateDefs
+// and leave the DefineFilter unset to cover all of the CQL. The coverage is sorted by library and
+// then by position in the CQL source.
+func (e *ELM) Coverage(results result.Libraries) ([]result.ExpressionCoverage, error) {
+	evaluations := make(map[result.Locator]int)
+	for libKey, defs := range results {
+		for name, v := range defs {
+			if meta, ok := v.DefMetadata(); !ok || meta.Kind != result.ExpressionDefinition {
+				continue
+			}
+			trace, ok := v.DebugTrace()
+			if !ok {
+				return nil, fmt.Errorf("%s.%s has no debug trace, Eval must be called with EvalConfig.Debug to compute coverage", libKey, name)
+			}
+			for _, step := range trace {
+				evaluations[step.Locator]++
+			}
+		}
+	}
+
+	// Only expressions within the body of a definition are covered, which leaves out expressions
+	// like parameter defaults that are not part of any debug trace.
+	var bodies []result.Locator
+	for _, lib := range e.parsedLibs {
+		if lib.Statements == nil {
+			continue
+		}
+		for _, def := range lib.Statements.Defs {
+			if loc, ok := e.locators[def.GetExpression()]; ok {
+				bodies = append(bodies, loc)
+			}
+		}
+	}
+	var coverage []result.ExpressionCoverage
+	for _, loc := range e.locators {
+		for _, body := range bodies {
+			if body.Contains(loc) {
+				coverage = append(coverage, result.ExpressionCoverage{Locator: loc, Evaluations: evaluations[loc]})
+				break
+			}
+		}
+	}
+	slices.SortFunc(coverage, func(a, b result.ExpressionCoverage) int {
+		return a.Locator.Compare(b.Locator)
+	})
+	return coverage, nil
+}
+
+// DataRequirements returns the data the parsed CQL may request from a retriever during evaluation,
+// one entry for each distinct resource type and code filter. Every definition in the parsed
+// libraries is analyzed, so this may be a superset of what a single evaluation retrieves.
+func (e *ELM) DataRequirements() ([]retriever.DataRequirement, error) {
+	if e.dataRequirements == nil {
+		reqs, err := datarequirements.FromLibraries(e.parsedLibs)
+		if err != nil {
+			return nil, err
+		}
+		e.dataRequirements = reqs
+	}
+	return e.dataRequirements, nil
+}
+
+// ValueSets returns the sorted, deduplicated ValueSets declared in the parsed libraries. This is
+// useful for snapshotting the terminology needed to evaluate the CQL.
+func (e *ELM) ValueSets() []result.ValueSet {
+	return datarequirements.ValueSets(e.parsedLibs)
+}
+
+// UnusedPrivateDefs returns the private expression and function definitions in the parsed
+// libraries that no other definition references. They can never affect the results, so they are
+// usually left over from editing the CQL.
+func (e *ELM) UnusedPrivateDefs() []result.DefKey {
+	return datarequirements.UnusedPrivateDefs(e.parsedLibs)
+}
+
+// DefinitionDependencies returns the expression and function definitions directly referenced by
+// each expression and function definition in the parsed libraries. Overloads of a function share a
+// single key. This is useful for visualizing the CQL and for analyzing the impact of a change.
+func (e *ELM) DefinitionDependencies() map[result.DefKey][]result.DefKey {
+	return datarequirements.Dependencies(e.parsedLibs)
+}
+
+// LibraryIncludes returns the libraries directly included by each named library in the parsed
+// libraries.
+func (e *ELM) LibraryIncludes() map[result.LibKey][]result.LibKey {
+	return datarequirements.Includes(e.parsedLibs)
+}
+
+// ResultTypes returns the static result type of every definition that Eval returns results for,
+// keyed by library and definition name. This includes parameters, terminology declarations and
+// expression definitions, but not functions. Private definitions are only included if
+// includePrivate is true, matching EvalConfig.ReturnPrivateDefs. Result types are useful for
+// deriving typed output schemas before any results exist.
+func (e *ELM) ResultTypes(includePrivate bool) map[result.LibKey]map[string]types.IType {
+	rts := make(map[result.LibKey]map[string]types.IType)
+	for _, lib := range e.parsedLibs {
+		if lib.Identifier == nil {
+			// Definitions in unnamed libraries are private.
+			continue
+		}
+		key := result.LibKeyFromModel(lib.Identifier)
+		defs := make(map[string]types.IType)
+		add := func(name string, access model.AccessLevel, t types.IType) {
+			if access == model.Public || includePrivate {
+				defs[name] = t
+			}
+		}
+		for _, p := range lib.Parameters {
+			add(p.Name, p.AccessLevel, p.GetResultType())
+		}
+		for _, cs := range lib.CodeSystems {
+			add(cs.Name, cs.AccessLevel, types.CodeSystem)
+		}
+		for _, vs := range lib.Valuesets {
+			add(vs.Name, vs.AccessLevel, types.ValueSet)
+		}
+		for _, c := range lib.Codes {
+			add(c.Name, c.AccessLevel, types.Code)
+		}
+		for _, c := range lib.Concepts {
+			add(c.Name, c.AccessLevel, types.Concept)
+		}
+		if lib.Statements != nil {
+			for _, d := range lib.Statements.Defs {
+				if ed, ok := d.(*model.ExpressionDef); ok {
+					add(ed.Name, ed.AccessLevel, ed.GetResultType())
+				}
+			}
+		}
+		rts[key] = defs
+	}
+	return rts
+}
+
+// TerminologyPreflight cross-references every ValueSet and CodeSystem declared in the parsed
+// libraries against the terminology provider, and reports those that are missing, empty or not
+// available in the declared version. Run it before evaluation to catch terminology problems early.
+func (e *ELM) TerminologyPreflight(tp terminology.Provider) (*terminology.PreflightReport, error) {
+	if tp == nil {
+		return nil, fmt.Errorf("a terminology provider is required for the terminology preflight")
+	}
+	var vss []terminology.ValueSetRef
+	for _, vs := range datarequirements.ValueSets(e.parsedLibs) {
+		vss = append(vss, terminology.ValueSetRef{URL: vs.ID, Version: vs.Version})
+	}
+	var css []terminology.CodeSystemRef
+	for _, cs := range datarequirements.CodeSystems(e.parsedLibs) {
+		css = append(css, terminology.CodeSystemRef{URL: cs.ID, Version: cs.Version})
+	}
+	return terminology.Preflight(tp, vss, css), nil
+}
+
+// FillCodeDisplays returns a copy of the results in which Codes without a display are given their
+// preferred display from the terminology provider, so results can be rendered with human readable
+// names. Codes unknown to the provider are left unchanged. Displays are never overwritten, and
+// Codes within FHIR resources are not modified.
+func FillCodeDisplays(libs result.Libraries, tp terminology.Provider) (result.Libraries, error) {
+	if tp == nil {
+		return nil, fmt.Errorf("a terminology provider is required to look up code displays")
+	}
+	type lookupKey struct{ system, code string }
+	displays := make(map[lookupKey]string)
+	fill := func(c result.Code) (result.Code, error) {
+		if c.Display != "" || c.System == "" {
+			return c, nil
+		}
+		k := lookupKey{c.System, c.Code}
+		display, ok := displays[k]
+		if !ok {
+			details, err := tp.Lookup(c.System, c.Code)
+			switch {
+			case errors.Is(err, terminology.ErrCodeNotFound), errors.Is(err, terminology.ErrResourceNotLoaded), errors.Is(err, terminology.ErrUnsupported):
+			case err != nil:
+				return result.Code{}, err
+			default:
+				display = details.Display
+			}
+			displays[k] = display
+		}
+		c.Display = display
+		return c, nil
+	}
+
+	filled := make(result.Libraries, len(libs))
+	for libKey, defs := range libs {
+		filled[libKey] = make(map[string]result.Value, len(defs))
+		for name, v := range defs {
+			fv, err := result.MapCodes(v, fill)
+			if err != nil {
+				return nil, err
+			}
+			filled[libKey][name] = fv
+		}
+	}
+	return filled, nil
 }
 
 // ELM is the parsed CQL, ready to be evaluated.
 type ELM struct {
-	dataModels   *modelinfo.ModelInfos
+	dataModels *modelinfo.ModelInfos
+	// dataModelXML is the model info xml the data models were parsed from, kept for MarshalBinary.
+	dataModelXML [][]byte
 	parsedParams map[result.DefKey]model.IExpression
 	parsedLibs   []*model.Library
+	// locators holds the source location of each parsed expression, for debug mode.
+	locators map[model.IExpression]result.Locator
+
+	// dataRequirements is lazily computed by DataRequirements().
+	dataRequirements []retriever.DataRequirement
+
+	// program is lazily compiled by evalCompiled.
+	program *interpreter.Program
 }
 
 // FHIRDataModelAndHelpersLib returns the model info xml file for a FHIR data model and the
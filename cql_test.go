@@ -16,21 +16,33 @@ package cql_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/cql"
+	"github.com/google/cql/metrics"
 	"github.com/google/cql/model"
+	"github.com/google/cql/optimizer"
 	"github.com/google/cql/parser"
 	"github.com/google/cql/result"
 	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/instrumented"
+	"github.com/google/cql/retriever/local"
+	"github.com/google/cql/terminology"
+	terminstrumented "github.com/google/cql/terminology/instrumented"
 	"github.com/google/cql/tests/enginetests"
 	"github.com/google/cql/types"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/lithammer/dedent"
 	"google.golang.org/protobuf/testing/protocmp"
+
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
 )
 
 // CQL Engine tests are for testing the top level CQL Engine API. For detailed testing see the tests
@@ -91,6 +103,28 @@ func TestCQL(t *testing.T) {
 				}),
 			},
 		},
+		{
+			name: "Query with Prefetched Retrieves",
+			cql: []string{dedent.Dedent(`
+			library TESTLIB version '1.0.0'
+			using FHIR version '4.0.1'
+			include FHIRHelpers version '4.0.1'
+			context Patient
+			define TESTRESULT: [Encounter] E`),
+				fhirHelpers(t),
+			},
+			parserConfig: cql.ParseConfig{
+				DataModels: [][]byte{fhirDataModel(t)},
+			},
+			retriever:  enginetests.BuildRetriever(t),
+			evalConfig: cql.EvalConfig{PrefetchRetrieves: true},
+			wantResult: newOrFatal(t, result.List{Value: []result.Value{
+				newOrFatal(t, result.Named{Value: enginetests.RetrieveFHIRResource(t, "Encounter", "1"), RuntimeType: &types.Named{TypeName: "FHIR.Encounter"}}),
+				newOrFatal(t, result.Named{Value: enginetests.RetrieveFHIRResource(t, "Encounter", "2"), RuntimeType: &types.Named{TypeName: "FHIR.Encounter"}}),
+			},
+				StaticType: &types.List{ElementType: &types.Named{TypeName: "FHIR.Encounter"}},
+			}),
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -362,6 +396,954 @@ func TestCQL_MultipleEvals(t *testing.T) {
 	}
 }
 
+func TestCQL_Metrics(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	context Patient
+	define Encounters: [Encounter]
+	define MoreEncounters: [Encounter] E where E.status = 'finished'`),
+		fhirHelpers(t),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{DataModels: [][]byte{fhirDataModel(t)}})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	rec := metrics.NewInMemory()
+	if _, err := elm.Eval(context.Background(), enginetests.BuildRetriever(t), cql.EvalConfig{Metrics: rec}); err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	labels := metrics.Labels{instrumented.ResourceTypeLabel: "Encounter"}
+	// Both definitions retrieve [Encounter], which is only executed once per evaluation.
+	if got := rec.Counter(instrumented.RetrieveCount, labels); got != 1 {
+		t.Errorf("Counter(%s) = %d, want 1", instrumented.RetrieveCount, got)
+	}
+
+	rec = metrics.NewInMemory()
+	if _, err := elm.Eval(context.Background(), enginetests.BuildRetriever(t), cql.EvalConfig{Metrics: rec, PrefetchRetrieves: true}); err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	if got := rec.Counter(instrumented.RetrieveCount, labels); got != 1 {
+		t.Errorf("Counter(%s) with prefetching = %d, want 1", instrumented.RetrieveCount, got)
+	}
+}
+
+func TestCQL_Provenance(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	context Patient
+	define Encounters: [Encounter]
+	define HasAmendedObservation: exists ([Observation] O where O.status = 'amended')
+	define AmendedAgain: HasAmendedObservation and HasAmendedObservation
+	define BirthDate: Patient.birthDate
+	define Literal: 1 + 1`),
+		fhirHelpers(t),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{DataModels: [][]byte{fhirDataModel(t)}})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	results, err := elm.Eval(context.Background(), enginetests.BuildRetriever(t), cql.EvalConfig{})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+
+	want := map[string][]result.ResourceRef{
+		"Encounters":            {{ResourceType: "Encounter", ID: "1"}, {ResourceType: "Encounter", ID: "2"}},
+		"HasAmendedObservation": {{ResourceType: "Observation", ID: "1"}},
+		"AmendedAgain":          {{ResourceType: "Observation", ID: "1"}},
+		"BirthDate":             {{ResourceType: "Patient", ID: "1"}},
+		"Literal":               {},
+	}
+	got := results.Provenance()[result.LibKey{Name: "TESTLIB", Version: "1.0.0"}]
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Provenance() diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_DefinitionsEvaluatedOnce(t *testing.T) {
+	// Numerator and Denominator both depend on Initial Population, whose retrieve filters on a code
+	// and so is not shared by the retrieve cache. It must only be retrieved once.
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	codesystem "Example": 'https://example.com/cs/diagnosis'
+	code "Glucose": 'gluc' from "Example"
+	context Patient
+	define "Initial Population": [Observation: "Glucose"]
+	define Denominator: "Initial Population" O where O.status = 'final'
+	define Numerator: Denominator O where exists "Initial Population"
+	define Result: Count(Numerator) + Count(Denominator) + Count("Initial Population")`),
+		fhirHelpers(t),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{DataModels: [][]byte{fhirDataModel(t)}})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	rec := metrics.NewInMemory()
+	if _, err := elm.Eval(context.Background(), enginetests.BuildRetriever(t), cql.EvalConfig{Metrics: rec}); err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	labels := metrics.Labels{instrumented.ResourceTypeLabel: "Observation"}
+	if got := rec.Counter(instrumented.RetrieveCount, labels); got != 1 {
+		t.Errorf("Counter(%s) = %d, want 1", instrumented.RetrieveCount, got)
+	}
+}
+
+func TestCQL_DefinitionStats(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	parameter Threshold Integer default 1
+	context Patient
+	define Encounters: [Encounter]
+	define EncountersAndObservations: Count([Encounter]) + Count([Observation])
+	define EncounterCount: Count(Encounters)`),
+		fhirHelpers(t),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{DataModels: [][]byte{fhirDataModel(t)}})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	results, err := elm.Eval(context.Background(), enginetests.BuildRetriever(t), cql.EvalConfig{})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	if got := results.EvalStats(); len(got) != 0 {
+		t.Errorf("EvalStats() without DefinitionStats = %v, want none", got)
+	}
+
+	results, err = elm.Eval(context.Background(), enginetests.BuildRetriever(t), cql.EvalConfig{DefinitionStats: true})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	stats := results.EvalStats()[result.LibKey{Name: "TESTLIB", Version: "1.0.0"}]
+	wantRetrieves := map[string]int{
+		"Encounters": 1,
+		// [Encounter] was already retrieved by Encounters, so only [Observation] is retrieved.
+		"EncountersAndObservations": 1,
+		// Encounters is evaluated before EncounterCount, so referencing it does not retrieve again.
+		"EncounterCount": 0,
+	}
+	gotRetrieves := make(map[string]int)
+	for name, s := range stats {
+		gotRetrieves[name] = s.Retrieves
+		if s.WallTime <= 0 {
+			t.Errorf("EvalStats()[%s].WallTime = %v, want > 0", name, s.WallTime)
+		}
+	}
+	if diff := cmp.Diff(wantRetrieves, gotRetrieves); diff != "" {
+		t.Errorf("EvalStats() retrieves diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_DefineMetadata(t *testing.T) {
+	cqlSource := dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	parameter Threshold Integer default 1
+	codesystem CS: 'https://example.com/cs'
+	private code C: '1' from CS
+	define private Numbers: {1, 2, 3}
+	define Big: Numbers N where N > Threshold`)
+	elm, err := cql.Parse(context.Background(), []string{cqlSource}, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	results, err := elm.Eval(context.Background(), nil, cql.EvalConfig{ReturnPrivateDefs: true})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+
+	lib := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	want := map[string]result.DefMetadata{
+		"Threshold": {Kind: result.ParameterDefinition, AccessLevel: model.Public, DeclaredType: types.Integer, Library: lib},
+		"CS":        {Kind: result.CodeSystemDefinition, AccessLevel: model.Public, DeclaredType: types.CodeSystem, Library: lib},
+		"C":         {Kind: result.CodeDefinition, AccessLevel: model.Private, DeclaredType: types.Code, Library: lib},
+		"Numbers":   {Kind: result.ExpressionDefinition, AccessLevel: model.Private, DeclaredType: &types.List{ElementType: types.Integer}, Library: lib},
+		"Big":       {Kind: result.ExpressionDefinition, AccessLevel: model.Public, DeclaredType: &types.List{ElementType: types.Integer}, Library: lib},
+	}
+	got := make(map[string]result.DefMetadata)
+	for name, v := range results[lib] {
+		m, ok := v.DefMetadata()
+		if !ok {
+			t.Errorf("DefMetadata() for %s returned !ok, want ok", name)
+			continue
+		}
+		got[name] = m
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("DefMetadata() diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_Debug(t *testing.T) {
+	cqlSource := "library TESTLIB version '1.0.0'\n" +
+		"define function Double(X Integer): X * 2\n" +
+		"define Nums: {1, 2}\n" +
+		"define Doubled: Nums N return Double(N)"
+	elm, err := cql.Parse(context.Background(), []string{cqlSource}, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	results, err := elm.Eval(context.Background(), nil, cql.EvalConfig{})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	if got := results.DebugTraces(); len(got) != 0 {
+		t.Errorf("DebugTraces() without Debug = %v, want none", got)
+	}
+
+	results, err = elm.Eval(context.Background(), nil, cql.EvalConfig{Debug: true})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	lib := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	trace, ok := results[lib]["Doubled"].DebugTrace()
+	if !ok {
+		t.Fatalf("DebugTrace() for Doubled returned !ok, want ok")
+	}
+	byLocator := result.ByLocator(trace)
+
+	// The body of Double is evaluated once per row of the query.
+	body := result.Locator{Library: lib, StartLine: 2, StartCol: 36, EndLine: 2, EndCol: 40}
+	want := []result.Value{newOrFatal(t, 2), newOrFatal(t, 4)}
+	if diff := cmp.Diff(want, byLocator[body]); diff != "" {
+		t.Errorf("DebugTrace() values of the function body diff (-want +got)\n%v", diff)
+	}
+	// The whole expression of the definition is the last step.
+	whole := result.Locator{Library: lib, StartLine: 4, StartCol: 17, EndLine: 4, EndCol: 39}
+	if got := trace[len(trace)-1]; got.Locator != whole || !got.Value.Equal(results[lib]["Doubled"]) {
+		t.Errorf("last DebugStep = %v %v, want %v %v", got.Locator, got.Value, whole, results[lib]["Doubled"])
+	}
+}
+
+func TestCQL_Coverage(t *testing.T) {
+	cqlSource := "library TESTLIB version '1.0.0'\n" +
+		"parameter P Integer default 1 + 1\n" +
+		"define function Double(X Integer): X * 2\n" +
+		"define Nums: {1, 2}\n" +
+		"define Doubled: Nums N return Double(N)\n" +
+		"define Branch: if true then 1 else 2"
+	elm, err := cql.Parse(context.Background(), []string{cqlSource}, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	results, err := elm.Eval(context.Background(), nil, cql.EvalConfig{})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	if _, err := elm.Coverage(results); err == nil {
+		t.Errorf("Coverage() of results without Debug succeeded, want error")
+	}
+
+	results, err = elm.Eval(context.Background(), nil, cql.EvalConfig{Debug: true})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	coverage, err := elm.Coverage(results)
+	if err != nil {
+		t.Fatalf("Coverage() returned unexpected error: %v", err)
+	}
+	got := make(map[string]int, len(coverage))
+	for _, c := range coverage {
+		got[c.Locator.String()] = c.Evaluations
+	}
+	want := map[string]int{
+		// The body of Double and its operands are evaluated once per row of the query.
+		"3:36-3:40": 2,
+		"3:36-3:36": 2,
+		"3:40-3:40": 2,
+		// Nums.
+		"4:14-4:19": 1,
+		"4:15-4:15": 1,
+		"4:18-4:18": 1,
+		// The else branch of Branch is never reached.
+		"6:16-6:36": 1,
+		"6:19-6:22": 1,
+		"6:29-6:29": 1,
+		"6:36-6:36": 0,
+	}
+	for loc, wantEvals := range want {
+		if gotEvals, ok := got[loc]; !ok || gotEvals != wantEvals {
+			t.Errorf("Coverage() of %s = %d (found %v), want %d", loc, gotEvals, ok, wantEvals)
+		}
+	}
+	for loc := range got {
+		if strings.HasPrefix(loc, "2:") {
+			t.Errorf("Coverage() included %s of the parameter default, want only definition bodies", loc)
+		}
+	}
+	for i := 1; i < len(coverage); i++ {
+		if coverage[i-1].Locator.Compare(coverage[i].Locator) > 0 {
+			t.Errorf("Coverage() is not sorted, %v is before %v", coverage[i-1].Locator, coverage[i].Locator)
+		}
+	}
+}
+
+func TestCQL_DefineFilter(t *testing.T) {
+	cqlSource := dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	define private Base: 1
+	define Numerator: Base + 1
+	define "Stratum 1": Base + 2
+	define Debug: Base`)
+	elm, err := cql.Parse(context.Background(), []string{cqlSource}, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	filter, err := result.ParseDefineFilter("Numerator,Base", "^Stratum", "", "Debug")
+	if err != nil {
+		t.Fatalf("ParseDefineFilter returned unexpected error: %v", err)
+	}
+
+	got, err := elm.Eval(context.Background(), nil, cql.EvalConfig{DefineFilter: filter})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	// Base is included by name, but is private so it is not returned.
+	want := result.Libraries{
+		result.LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]result.Value{
+			"Numerator": newOrFatal(t, 2),
+			"Stratum 1": newOrFatal(t, 3),
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Eval with DefineFilter diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_SkipFilteredDefines(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library Helpers version '1.0.0'
+	define Offset: 10
+	define Unused: Message(1, true, 'E1', 'Error', 'Unused should not be evaluated')`),
+		dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	include Helpers version '1.0.0' called H
+	define private Base: 1
+	define function AddBase(x Integer): x + Base
+	define Numerator: AddBase(H.Offset)
+	define Failing: Message(1, true, 'E2', 'Error', 'Failing should not be evaluated')`)}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	filter, err := result.ParseDefineFilter("TESTLIB.Numerator", "", "", "")
+	if err != nil {
+		t.Fatalf("ParseDefineFilter returned unexpected error: %v", err)
+	}
+
+	got, err := elm.Eval(context.Background(), nil, cql.EvalConfig{DefineFilter: filter, SkipFilteredDefines: true})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	// Unused and Failing are skipped, Offset and Base are evaluated but filtered from the results.
+	want := result.Libraries{
+		result.LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]result.Value{
+			"Numerator": newOrFatal(t, 11),
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Eval with SkipFilteredDefines diff (-want +got)\n%v", diff)
+	}
+
+	if _, err := elm.Eval(context.Background(), nil, cql.EvalConfig{DefineFilter: filter}); err == nil {
+		t.Errorf("Eval without SkipFilteredDefines succeeded, want the error of Failing")
+	}
+}
+
+func TestCQL_Optimizations(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	define Numerator: (2 + 3) * 2
+	define Failing: Message(1, true, 'E2', 'Error', 'Failing should have been removed')`)}
+	filter, err := result.ParseDefineFilter("Numerator", "", "", "")
+	if err != nil {
+		t.Fatalf("ParseDefineFilter returned unexpected error: %v", err)
+	}
+	dumpDir := t.TempDir()
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{
+		Optimizations: &optimizer.Config{Outputs: filter, DumpDir: dumpDir},
+	})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	got, err := elm.Eval(context.Background(), nil, cql.EvalConfig{})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	want := result.Libraries{
+		result.LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]result.Value{
+			"Numerator": newOrFatal(t, 10),
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Eval of optimized ELM diff (-want +got)\n%v", diff)
+	}
+
+	before, err := os.ReadFile(filepath.Join(dumpDir, "TESTLIB-1.0.0.before.json"))
+	if err != nil {
+		t.Fatalf("Reading the dump before optimizing returned unexpected error: %v", err)
+	}
+	after, err := os.ReadFile(filepath.Join(dumpDir, "TESTLIB-1.0.0.after.json"))
+	if err != nil {
+		t.Fatalf("Reading the dump after optimizing returned unexpected error: %v", err)
+	}
+	if !strings.Contains(string(before), "Failing") || strings.Contains(string(after), "Failing") {
+		t.Errorf("Dumps before and after optimizing = %s and %s, want Failing to be removed", before, after)
+	}
+}
+
+func TestCQL_Compilation(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	context Patient
+	define Observations: [Observation] O where O.status = 'final'
+	define ObservationCount: Count(Observations) * 2 + 1
+	define Names: Patient.name N return Combine(N.given, ' ')
+	define Old: AgeInYearsAt(@2024-01-01) > 18`),
+		fhirHelpers(t),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{DataModels: [][]byte{fhirDataModel(t)}})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	config := cql.EvalConfig{EvaluationTimestamp: time.Date(2024, time.July, 1, 0, 0, 0, 0, time.UTC)}
+	want, err := elm.Eval(context.Background(), enginetests.BuildRetriever(t), cql.EvalConfig{
+		EvaluationTimestamp: config.EvaluationTimestamp,
+		DisableCompilation:  true,
+	})
+	if err != nil {
+		t.Fatalf("Eval without compilation returned unexpected error: %v", err)
+	}
+
+	// The first Eval compiles the ELM and the next ones reuse the compiled program.
+	for n := 0; n < 2; n++ {
+		got, err := elm.Eval(context.Background(), enginetests.BuildRetriever(t), config)
+		if err != nil {
+			t.Fatalf("Eval returned unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+			t.Errorf("Eval with compilation diff (-without +with)\n%v", diff)
+		}
+	}
+}
+
+// filterRecorder is a retriever.FilteredRetriever that records the filters it is called with, and
+// ignores them.
+type filterRecorder struct {
+	retriever.Retriever
+	filters map[string][]retriever.Filter
+}
+
+func (f *filterRecorder) RetrieveFiltered(ctx context.Context, resourceType string, filter retriever.Filter) ([]*r4pb.ContainedResource, error) {
+	f.filters[resourceType] = append(f.filters[resourceType], filter)
+	return f.Retrieve(ctx, resourceType)
+}
+
+func TestCQL_PredicatePushdown(t *testing.T) {
+	cqlSource := func(glucoseRetrieve string) string {
+		return dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		using FHIR version '4.0.1'
+		include FHIRHelpers version '4.0.1'
+		valueset "Glucose": 'https://example.com/vs/glucose'
+		parameter "Measurement Period" Interval<DateTime> default Interval[@2018-11-14T00:00:00.000Z, @2018-11-16T00:00:00.000Z)
+		context Patient
+		define GlucoseInPeriod: ` + glucoseRetrieve + ` and O.effective in "Measurement Period"
+		define InPeriod: [Observation] O where O.effective in "Measurement Period"`)
+	}
+	tp, err := terminology.NewLocalFHIRProvider("tests/enginetests/testdata/terminology")
+	if err != nil {
+		t.Fatalf("NewLocalFHIRProvider returned unexpected error: %v", err)
+	}
+	eval := func(cqlSource string, config cql.ParseConfig) (result.Libraries, map[string][]retriever.Filter) {
+		t.Helper()
+		config.DataModels = [][]byte{fhirDataModel(t)}
+		elm, err := cql.Parse(context.Background(), []string{cqlSource, fhirHelpers(t)}, config)
+		if err != nil {
+			t.Fatalf("Parse returned unexpected error: %v", err)
+		}
+		r := &filterRecorder{Retriever: enginetests.BuildRetriever(t), filters: make(map[string][]retriever.Filter)}
+		results, err := elm.Eval(context.Background(), r, cql.EvalConfig{Terminology: tp})
+		if err != nil {
+			t.Fatalf("Eval returned unexpected error: %v", err)
+		}
+		return results, r.filters
+	}
+
+	// The where clause constraint on the code is pushed into the retrieve, so must give the same
+	// results as filtering in the retrieve.
+	want, _ := eval(cqlSource(`[Observation: "Glucose"] O where true`), cql.ParseConfig{})
+	got, filters := eval(cqlSource(`[Observation] O where O.code in "Glucose"`), cql.ParseConfig{
+		Optimizations: &optimizer.Config{Passes: []optimizer.Pass{optimizer.PredicatePushdown}},
+	})
+	key := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	if diff := cmp.Diff(want.Provenance()[key], got.Provenance()[key]); diff != "" {
+		t.Errorf("Provenance() with predicate pushdown diff (-want +got)\n%v", diff)
+	}
+	wantIDs := map[string][]result.ResourceRef{
+		"Glucose":            {},
+		"Measurement Period": {},
+		"GlucoseInPeriod":    {{ResourceType: "Observation", ID: "2"}},
+		"InPeriod":           {{ResourceType: "Observation", ID: "2"}, {ResourceType: "Observation", ID: "3"}},
+	}
+	if diff := cmp.Diff(wantIDs, got.Provenance()[key]); diff != "" {
+		t.Errorf("Provenance() diff (-want +got)\n%v", diff)
+	}
+
+	start := time.Date(2018, 11, 14, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2018, 11, 16, 0, 0, 0, int(time.Millisecond), time.UTC)
+	dateFilter := &retriever.DateFilter{Property: "effective", Start: start, End: end}
+	wantFilters := map[string][]retriever.Filter{
+		"Observation": {
+			{
+				CodeFilter: &retriever.CodeFilter{Property: "code", ValueSetURL: "https://example.com/vs/glucose"},
+				DateFilter: dateFilter,
+			},
+			{DateFilter: dateFilter},
+		},
+		"Patient": {{}},
+	}
+	if diff := cmp.Diff(wantFilters, filters, cmpopts.EquateApproxTime(0)); diff != "" {
+		t.Errorf("RetrieveFiltered() filters diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_PredicatePushdown_DateRangeError(t *testing.T) {
+	// The date range fails to evaluate, but the where clause it is pushed down from is never
+	// evaluated since the patient has no Observations.
+	cqlSource := dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	context Patient
+	define InRange: [Observation] O where O.effective in Interval[@2018-11-14T00:00:00.000Z, singleton from {@2018-11-16T00:00:00.000Z, @2018-11-17T00:00:00.000Z}]`)
+	elm, err := cql.Parse(context.Background(), []string{cqlSource, fhirHelpers(t)}, cql.ParseConfig{
+		DataModels:    [][]byte{fhirDataModel(t)},
+		Optimizations: &optimizer.Config{Passes: []optimizer.Pass{optimizer.PredicatePushdown}},
+	})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	ret, err := local.NewRetrieverFromR4Bundle([]byte(`{"resourceType": "Bundle", "type": "collection", "entry": [{"resource": {"resourceType": "Patient", "id": "1"}}]}`))
+	if err != nil {
+		t.Fatalf("NewRetrieverFromR4Bundle returned unexpected error: %v", err)
+	}
+	r := &filterRecorder{Retriever: ret, filters: make(map[string][]retriever.Filter)}
+	results, err := elm.Eval(context.Background(), r, cql.EvalConfig{})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	key := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	if got := results[key]["InRange"].GolangValue().(result.List).Value; len(got) != 0 {
+		t.Errorf("Eval() InRange = %v, want an empty list", got)
+	}
+	if diff := cmp.Diff([]retriever.Filter{{}}, r.filters["Observation"]); diff != "" {
+		t.Errorf("RetrieveFiltered() Observation filters diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_TerminologyMetrics(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	codesystem CS: 'https://example.com/cs'
+	valueset VS: 'https://example.com/vs'
+	code One: '1' from CS
+	code Two: '2' from CS
+	define InVS: One in VS
+	define AlsoInVS: Two in VS`),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	tp, err := terminology.NewInMemoryFHIRProvider([]string{
+		`{"resourceType": "ValueSet", "url": "https://example.com/vs", "version": "1.0.0", "expansion": {"contains": [{"system": "https://example.com/cs", "code": "1"}]}}`,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider returned unexpected error: %v", err)
+	}
+
+	rec := metrics.NewInMemory()
+	if _, err := elm.Eval(context.Background(), nil, cql.EvalConfig{Terminology: tp, Metrics: rec}); err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	// Membership is checked by the provider, without expanding the ValueSet.
+	tests := []struct {
+		operation string
+		want      int64
+	}{
+		{operation: "AnyInValueSet", want: 2},
+		{operation: "ExpandValueSet", want: 0},
+	}
+	for _, tc := range tests {
+		labels := metrics.Labels{terminstrumented.OperationLabel: tc.operation, terminstrumented.URLLabel: "https://example.com/vs"}
+		if got := rec.Counter(terminstrumented.CallCount, labels); got != tc.want {
+			t.Errorf("Counter(%s, %v) = %d, want %d", terminstrumented.CallCount, labels, got, tc.want)
+		}
+	}
+}
+
+func TestCQL_MarshalBinary(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	parameter "Measurement Period" Interval<DateTime>
+	context Patient
+	define Encounters: [Encounter] E where E.status = 'finished' sort by start of period
+	define InPeriod: @2022-06-01T00:00:00.000Z in "Measurement Period"
+	define function Double(a Integer): a * 2
+	define Doubled: Double(Count(Encounters))`),
+		fhirHelpers(t),
+	}
+	parserConfig := cql.ParseConfig{
+		DataModels: [][]byte{fhirDataModel(t)},
+		Parameters: map[result.DefKey]string{
+			result.DefKey{Name: "Measurement Period", Library: result.LibKey{Name: "TESTLIB", Version: "1.0.0"}}: "Interval[@2022-01-01T00:00:00.000Z, @2023-01-01T00:00:00.000Z)",
+		},
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, parserConfig)
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	data, err := elm.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary returned unexpected error: %v", err)
+	}
+	decoded := &cql.ELM{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary returned unexpected error: %v", err)
+	}
+
+	evalConfig := cql.EvalConfig{EvaluationTimestamp: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	want, err := elm.Eval(context.Background(), enginetests.BuildRetriever(t), evalConfig)
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	got, err := decoded.Eval(context.Background(), enginetests.BuildRetriever(t), evalConfig)
+	if err != nil {
+		t.Fatalf("Eval of the decoded ELM returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("Eval of the decoded ELM diff (-want +got)\n%v", diff)
+	}
+	if diff := cmp.Diff(elm.ValueSets(), decoded.ValueSets()); diff != "" {
+		t.Errorf("ValueSets of the decoded ELM diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_UnmarshalBinaryError(t *testing.T) {
+	if err := (&cql.ELM{}).UnmarshalBinary([]byte("not ELM")); err == nil {
+		t.Errorf("UnmarshalBinary() succeeded, want error")
+	}
+}
+
+func TestCQL_LibrariesJSON(t *testing.T) {
+	cqlSources := []string{
+		dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		define Three: 1 + 2`),
+		dedent.Dedent(`
+		define Unnamed: true`),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	libs, err := elm.LibrariesJSON()
+	if err != nil {
+		t.Fatalf("LibrariesJSON returned unexpected error: %v", err)
+	}
+	if len(libs) != 2 {
+		t.Errorf("LibrariesJSON returned %d libraries, want 2", len(libs))
+	}
+	got, ok := libs[result.LibKey{Name: "TESTLIB", Version: "1.0.0"}]
+	if !ok {
+		t.Fatalf("LibrariesJSON() = %v, want an entry for TESTLIB 1.0.0", libs)
+	}
+	var lib struct {
+		Library struct {
+			Identifier struct {
+				Qualified string `json:"qualified"`
+			} `json:"identifier"`
+			Statements struct {
+				Defs []struct {
+					Type       string `json:"type"`
+					Name       string `json:"name"`
+					Expression struct {
+						Type string `json:"type"`
+					} `json:"expression"`
+				} `json:"defs"`
+			} `json:"statements"`
+		} `json:"library"`
+	}
+	if err := json.Unmarshal(got, &lib); err != nil {
+		t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", got, err)
+	}
+	if lib.Library.Identifier.Qualified != "TESTLIB" {
+		t.Errorf("LibrariesJSON() identifier = %q, want TESTLIB", lib.Library.Identifier.Qualified)
+	}
+	defs := lib.Library.Statements.Defs
+	if len(defs) != 1 || defs[0].Name != "Three" || defs[0].Type != "ExpressionDef" || defs[0].Expression.Type != "Add" {
+		t.Errorf("LibrariesJSON() defs = %+v, want the ExpressionDef Three holding an Add", defs)
+	}
+}
+
+func TestCQL_DataRequirements(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	valueset "Glucose": 'https://example.com/glucose_valueset' version '1.0.0'
+	context Patient
+	define Encounters: [Encounter]
+	define MoreEncounters: [Encounter] E where E.status = 'finished'
+	define Observations: [Observation: "Glucose"]`),
+		fhirHelpers(t),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{DataModels: [][]byte{fhirDataModel(t)}})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	got, err := elm.DataRequirements()
+	if err != nil {
+		t.Fatalf("DataRequirements returned unexpected error: %v", err)
+	}
+	want := []retriever.DataRequirement{
+		{ResourceType: "Encounter"},
+		{ResourceType: "Observation", CodeFilter: &retriever.CodeFilter{Property: "code", ValueSetURL: "https://example.com/glucose_valueset", ValueSetVersion: "1.0.0"}},
+		{ResourceType: "Patient"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("DataRequirements diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_UnusedPrivateDefs(t *testing.T) {
+	cqlSource := dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	define private Base: 1
+	define private Unused: 2
+	define Numerator: Base + 1`)
+	elm, err := cql.Parse(context.Background(), []string{cqlSource}, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	want := []result.DefKey{{Name: "Unused", Library: result.LibKey{Name: "TESTLIB", Version: "1.0.0"}}}
+	if diff := cmp.Diff(want, elm.UnusedPrivateDefs()); diff != "" {
+		t.Errorf("UnusedPrivateDefs() diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_DefinitionDependencies(t *testing.T) {
+	cqlSources := []string{
+		dedent.Dedent(`
+		library Helpers version '1.0.0'
+		define function Double(x Integer): x * 2`),
+		dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		include Helpers version '1.0.0' called H
+		define Base: 1
+		define Numerator: H.Double(Base)`),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	helpers := result.LibKey{Name: "Helpers", Version: "1.0.0"}
+	testlib := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	wantDeps := map[result.DefKey][]result.DefKey{
+		{Name: "Double", Library: helpers}:    {},
+		{Name: "Base", Library: testlib}:      {},
+		{Name: "Numerator", Library: testlib}: {{Name: "Double", Library: helpers}, {Name: "Base", Library: testlib}},
+	}
+	if diff := cmp.Diff(wantDeps, elm.DefinitionDependencies()); diff != "" {
+		t.Errorf("DefinitionDependencies() diff (-want +got)\n%v", diff)
+	}
+	wantIncludes := map[result.LibKey][]result.LibKey{helpers: {}, testlib: {helpers}}
+	if diff := cmp.Diff(wantIncludes, elm.LibraryIncludes()); diff != "" {
+		t.Errorf("LibraryIncludes() diff (-want +got)\n%v", diff)
+	}
+}
+
+func TestCQL_ResultTypes(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	parameter "Measurement Period" Interval<Date>
+	valueset "Glucose": 'https://example.com/glucose_valueset'
+	define Count: 4
+	define private Name: 'name'
+	define Dates: { @2024-01-01 }
+	define function Double(x Integer): x * 2`),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+
+	libKey := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	tests := []struct {
+		name           string
+		includePrivate bool
+		want           map[result.LibKey]map[string]types.IType
+	}{
+		{
+			name: "Public",
+			want: map[result.LibKey]map[string]types.IType{libKey: {
+				"Measurement Period": &types.Interval{PointType: types.Date},
+				"Glucose":            types.ValueSet,
+				"Count":              types.Integer,
+				"Dates":              &types.List{ElementType: types.Date},
+			}},
+		},
+		{
+			name:           "Public and private",
+			includePrivate: true,
+			want: map[result.LibKey]map[string]types.IType{libKey: {
+				"Measurement Period": &types.Interval{PointType: types.Date},
+				"Glucose":            types.ValueSet,
+				"Count":              types.Integer,
+				"Name":               types.String,
+				"Dates":              &types.List{ElementType: types.Date},
+			}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := elm.ResultTypes(tc.includePrivate)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ResultTypes(%v) diff (-want +got)\n%v", tc.includePrivate, diff)
+			}
+		})
+	}
+}
+
+func TestCQL_TerminologyPreflight(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	codesystem "Loaded": 'https://example.com/cs' version '1.0.0'
+	codesystem "Missing": 'https://example.com/missing_cs'
+	valueset "Glucose": 'https://example.com/glucose_valueset' version '1.0.0'
+	valueset "Old Glucose": 'https://example.com/glucose_valueset' version '0.1.0'
+	valueset "Empty": 'https://example.com/empty_valueset'
+	define TESTRESULT: true`),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	tp, err := terminology.NewInMemoryFHIRProvider([]string{
+		`{"resourceType": "ValueSet", "url": "https://example.com/glucose_valueset", "version": "1.0.0", "expansion": {"contains": [{"system": "https://example.com/cs", "code": "gluc"}]}}`,
+		`{"resourceType": "ValueSet", "url": "https://example.com/empty_valueset", "version": "1.0.0"}`,
+		`{"resourceType": "CodeSystem", "url": "https://example.com/cs", "version": "1.0.0", "concept": [{"code": "gluc"}]}`,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider returned unexpected error: %v", err)
+	}
+
+	got, err := elm.TerminologyPreflight(tp)
+	if err != nil {
+		t.Fatalf("TerminologyPreflight returned unexpected error: %v", err)
+	}
+	want := &terminology.PreflightReport{
+		ValueSetsChecked:   3,
+		CodeSystemsChecked: 2,
+		Issues: []terminology.PreflightIssue{
+			{Kind: terminology.IssueEmpty, ResourceType: "ValueSet", URL: "https://example.com/empty_valueset"},
+			{Kind: terminology.IssueVersionMismatch, ResourceType: "ValueSet", URL: "https://example.com/glucose_valueset", Version: "0.1.0"},
+			{Kind: terminology.IssueMissing, ResourceType: "CodeSystem", URL: "https://example.com/missing_cs"},
+		},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(terminology.PreflightIssue{}, "Detail")); diff != "" {
+		t.Errorf("TerminologyPreflight diff (-want +got)\n%v", diff)
+	}
+	if got.OK() || got.Err() == nil {
+		t.Errorf("TerminologyPreflight report OK() = true, want false")
+	}
+}
+
+func TestFillCodeDisplays(t *testing.T) {
+	cqlSources := []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	codesystem CS: 'https://example.com/cs'
+	code Gluc: 'gluc' from CS
+	code WithDisplay: 'gluc' from CS display 'Custom'
+	code Unknown: 'unknown' from CS
+	concept GlucConcept: { Gluc }
+	define TESTRESULT: { Gluc, WithDisplay, Unknown }
+	define TESTCONCEPT: GlucConcept`),
+	}
+	elm, err := cql.Parse(context.Background(), cqlSources, cql.ParseConfig{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	tp, err := terminology.NewInMemoryFHIRProvider([]string{
+		`{"resourceType": "CodeSystem", "url": "https://example.com/cs", "version": "1.0.0", "concept": [{"code": "gluc", "display": "Glucose"}]}`,
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider returned unexpected error: %v", err)
+	}
+	results, err := elm.Eval(context.Background(), nil, cql.EvalConfig{Terminology: tp})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+
+	got, err := cql.FillCodeDisplays(results, tp)
+	if err != nil {
+		t.Fatalf("FillCodeDisplays returned unexpected error: %v", err)
+	}
+	libKey := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	gotCodes, err := result.ToSlice(got[libKey]["TESTRESULT"])
+	if err != nil {
+		t.Fatalf("ToSlice returned unexpected error: %v", err)
+	}
+	var gotDisplays []string
+	for _, v := range gotCodes {
+		c, err := result.ToCode(v)
+		if err != nil {
+			t.Fatalf("ToCode returned unexpected error: %v", err)
+		}
+		gotDisplays = append(gotDisplays, c.Display)
+	}
+	if diff := cmp.Diff([]string{"Glucose", "Custom", ""}, gotDisplays); diff != "" {
+		t.Errorf("FillCodeDisplays displays diff (-want +got)\n%v", diff)
+	}
+	concept, err := result.ToConcept(got[libKey]["TESTCONCEPT"])
+	if err != nil {
+		t.Fatalf("ToConcept returned unexpected error: %v", err)
+	}
+	if concept.Codes[0].Display != "Glucose" {
+		t.Errorf("FillCodeDisplays concept code display = %q, want %q", concept.Codes[0].Display, "Glucose")
+	}
+
+	// The original results are unchanged.
+	orig, err := result.ToSlice(results[libKey]["TESTRESULT"])
+	if err != nil {
+		t.Fatalf("ToSlice returned unexpected error: %v", err)
+	}
+	if c, _ := result.ToCode(orig[0]); c.Display != "" {
+		t.Errorf("FillCodeDisplays modified the input results, got display %q", c.Display)
+	}
+}
+
 func fhirDataModel(t testing.TB) []byte {
 	t.Helper()
 	fdm, err := cql.FHIRDataModel("4.0.1")
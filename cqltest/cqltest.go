@@ -0,0 +1,391 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cqltest is a golden test harness for CQL libraries. A test case is a YAML or JSON file
+// that declares the CQL to evaluate, the FHIR bundle to evaluate it against and the expected value
+// of each expression definition. The harness parses and evaluates the CQL and diffs the results
+// against the expected values. Run integrates test cases with go test:
+//
+//	func TestMeasure(t *testing.T) {
+//		cqltest.Run(t, "testdata/*.yaml")
+//	}
+//
+// Running go test with -update_golden rewrites the expected values of each test case with the
+// current results.
+package cqltest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/cql"
+	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/local"
+	"github.com/google/cql/terminology"
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+var updateGolden = flag.Bool("update_golden", false, "If true, cqltest.Run rewrites the expected values of each test case with the current results instead of diffing them.")
+
+// defaultFHIRVersion is the FHIR version used when a test case does not set one.
+const defaultFHIRVersion = "4.0.1"
+
+// fhirHelpersLibName is the name of the FHIRHelpers library included in every test case.
+const fhirHelpersLibName = "FHIRHelpers"
+
+// ErrInvalidCase is returned when a test case file can not be loaded.
+var ErrInvalidCase = errors.New("invalid test case")
+
+// Case is a golden test case. Paths are relative to the directory of the test case file.
+type Case struct {
+	// Name of the test case. Defaults to the test case file name without the extension.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Description is an optional longer text description of the test case.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// CQL are the paths to the CQL libraries to evaluate. FHIRHelpers is always included.
+	CQL []string `json:"cql" yaml:"cql"`
+	// Bundle is the optional path to the FHIR R4 bundle the CQL is evaluated against.
+	Bundle string `json:"bundle,omitempty" yaml:"bundle,omitempty"`
+	// ValueSets are the optional paths to FHIR ValueSet JSON files used for terminology.
+	ValueSets []string `json:"valueSets,omitempty" yaml:"valueSets,omitempty"`
+	// Parameters are the optional values passed to CQL parameters.
+	Parameters []Parameter `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	// EvaluationTimestamp is the time the CQL is evaluated at. Defaults to the zero time rather
+	// than time.Now() so that results are reproducible.
+	EvaluationTimestamp time.Time `json:"evaluationTimestamp,omitempty" yaml:"evaluationTimestamp,omitempty"`
+	// FHIRVersion is the version of the FHIR data model. Defaults to 4.0.1.
+	FHIRVersion string `json:"fhirVersion,omitempty" yaml:"fhirVersion,omitempty"`
+	// ReturnPrivateDefs if true also evaluates and checks private definitions.
+	ReturnPrivateDefs bool `json:"returnPrivateDefs,omitempty" yaml:"returnPrivateDefs,omitempty"`
+	// Want maps library name to expression definition name to the expected value in the result JSON
+	// format, for example {"@type": "System.Integer", "value": 1}. Only the listed definitions are
+	// checked.
+	Want map[string]map[string]any `json:"want,omitempty" yaml:"want,omitempty"`
+
+	// path is the path of the test case file.
+	path string
+	// node is the YAML document of the test case file, used to preserve comments on update.
+	node *yaml.Node
+}
+
+// Parameter is the value of a CQL parameter passed to a test case.
+type Parameter struct {
+	// Library is the name of the library defining the parameter.
+	Library string `json:"library" yaml:"library"`
+	// Version is the version of the library defining the parameter.
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	// Name is the name of the parameter.
+	Name string `json:"name" yaml:"name"`
+	// Value is a CQL literal, see cql.ParseConfig.Parameters.
+	Value string `json:"value" yaml:"value"`
+}
+
+// Load reads a test case file. Files with a .json extension are read as JSON, all others as YAML.
+func Load(path string) (*Case, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Case{path: path}
+	if isJSON(path) {
+		err = json.Unmarshal(b, c)
+	} else {
+		c.node = &yaml.Node{}
+		if err = yaml.Unmarshal(b, c.node); err == nil {
+			err = c.node.Decode(c)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidCase, path, err)
+	}
+	if c.Name == "" {
+		c.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if len(c.CQL) == 0 {
+		return nil, fmt.Errorf("%w %s: no cql files", ErrInvalidCase, path)
+	}
+	return c, nil
+}
+
+// Eval parses and evaluates the CQL of the test case.
+func (c *Case) Eval(ctx context.Context) (result.Libraries, error) {
+	fhirVersion := c.FHIRVersion
+	if fhirVersion == "" {
+		fhirVersion = defaultFHIRVersion
+	}
+	fhirDM, fhirHelpers, err := cql.FHIRDataModelAndHelpersLib(fhirVersion)
+	if err != nil {
+		return nil, err
+	}
+	libs := []string{fhirHelpers}
+	for _, p := range c.CQL {
+		b, err := os.ReadFile(c.resolve(p))
+		if err != nil {
+			return nil, err
+		}
+		libs = append(libs, string(b))
+	}
+	params := make(map[result.DefKey]string, len(c.Parameters))
+	for _, p := range c.Parameters {
+		params[result.DefKey{Name: p.Name, Library: result.LibKey{Name: p.Library, Version: p.Version}}] = p.Value
+	}
+	elm, err := cql.Parse(ctx, libs, cql.ParseConfig{DataModels: [][]byte{fhirDM}, Parameters: params})
+	if err != nil {
+		return nil, err
+	}
+
+	var r retriever.Retriever
+	if c.Bundle != "" {
+		b, err := os.ReadFile(c.resolve(c.Bundle))
+		if err != nil {
+			return nil, err
+		}
+		if r, err = local.NewRetrieverFromR4Bundle(b); err != nil {
+			return nil, err
+		}
+	}
+	var tp terminology.Provider
+	if len(c.ValueSets) > 0 {
+		valuesets := make([]string, 0, len(c.ValueSets))
+		for _, p := range c.ValueSets {
+			b, err := os.ReadFile(c.resolve(p))
+			if err != nil {
+				return nil, err
+			}
+			valuesets = append(valuesets, string(b))
+		}
+		if tp, err = terminology.NewInMemoryFHIRProvider(valuesets); err != nil {
+			return nil, err
+		}
+	}
+	return elm.Eval(ctx, r, cql.EvalConfig{
+		Terminology:         tp,
+		EvaluationTimestamp: c.EvaluationTimestamp,
+		ReturnPrivateDefs:   c.ReturnPrivateDefs,
+	})
+}
+
+// Diff returns a human readable diff between the expected values of the test case and results,
+// or an empty string if every expected value matches. Definitions in results that are not in Want
+// are ignored.
+func (c *Case) Diff(results result.Libraries) (string, error) {
+	got, err := goldenValues(results)
+	if err != nil {
+		return "", err
+	}
+	var diffs []string
+	for _, libName := range sortedKeys(c.Want) {
+		for _, defName := range sortedKeys(c.Want[libName]) {
+			want, err := normalize(c.Want[libName][defName])
+			if err != nil {
+				return "", err
+			}
+			gotVal, ok := got[libName][defName]
+			if !ok {
+				diffs = append(diffs, fmt.Sprintf("%s.%s: missing from results", libName, defName))
+				continue
+			}
+			if diff := cmp.Diff(want, gotVal); diff != "" {
+				diffs = append(diffs, fmt.Sprintf("%s.%s (-want +got):\n%s", libName, defName, diff))
+			}
+		}
+	}
+	return strings.Join(diffs, "\n"), nil
+}
+
+// Update sets the expected values of the test case to results and rewrites the test case file.
+// Other fields of the test case file are kept as is, including comments in YAML test case files.
+func (c *Case) Update(results result.Libraries) error {
+	got, err := goldenValues(results)
+	if err != nil {
+		return err
+	}
+	delete(got, fhirHelpersLibName)
+	c.Want = got
+
+	var b []byte
+	switch {
+	case isJSON(c.path):
+		b, err = updateJSON(c.path, got)
+	case c.node != nil && len(c.node.Content) > 0:
+		if err = setWant(c.node.Content[0], got); err == nil {
+			b, err = encodeYAML(c.node)
+		}
+	default:
+		b, err = encodeYAML(c)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, b, 0644)
+}
+
+// Run loads every test case file matching the glob pattern and runs each as a subtest of t. If
+// the -update_golden flag is set the test case files are updated with the current results instead.
+func Run(t *testing.T, pattern string) {
+	t.Helper()
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatalf("cqltest.Run(%q) invalid pattern: %v", pattern, err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("cqltest.Run(%q) matched no test case files", pattern)
+	}
+	for _, p := range paths {
+		c, err := Load(p)
+		if err != nil {
+			t.Errorf("cqltest.Load(%q) returned unexpected error: %v", p, err)
+			continue
+		}
+		t.Run(c.Name, func(t *testing.T) {
+			runCase(t, c, *updateGolden)
+		})
+	}
+}
+
+func runCase(t testing.TB, c *Case, update bool) {
+	t.Helper()
+	results, err := c.Eval(context.Background())
+	if err != nil {
+		t.Fatalf("Test case %s (%s) failed to evaluate: %v", c.Name, c.path, err)
+	}
+	if update {
+		if err := c.Update(results); err != nil {
+			t.Fatalf("Test case %s (%s) failed to update: %v", c.Name, c.path, err)
+		}
+		return
+	}
+	diff, err := c.Diff(results)
+	if err != nil {
+		t.Fatalf("Test case %s (%s) failed to diff: %v", c.Name, c.path, err)
+	}
+	if diff != "" {
+		t.Errorf("Test case %s (%s) failed. %s\nRerun with -update_golden to accept the current results.\n%s", c.Name, c.path, c.Description, diff)
+	}
+}
+
+func (c *Case) resolve(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(c.path), p)
+}
+
+// goldenValues returns the normalized result JSON of each expression definition keyed by library
+// name and definition name.
+func goldenValues(results result.Libraries) (map[string]map[string]any, error) {
+	r := make(map[string]map[string]any, len(results))
+	for k, defs := range results {
+		vals := make(map[string]any, len(defs))
+		for name, v := range defs {
+			n, err := normalize(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", k.Name, name, err)
+			}
+			vals[name] = n
+		}
+		r[k.Name] = vals
+	}
+	return r, nil
+}
+
+// normalize round trips v through JSON so that values decoded from YAML or JSON test case files
+// compare equal to results, for example integers decoded from YAML as int and from JSON as float64.
+func normalize(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var n any
+	if err := json.Unmarshal(b, &n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// updateJSON returns the JSON test case file at path with the want key replaced by want. Other
+// keys are kept as is.
+func updateJSON(path string, want map[string]map[string]any) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m["want"], err = json.Marshal(want); err != nil {
+		return nil, err
+	}
+	if b, err = json.MarshalIndent(m, "", "  "); err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// setWant replaces or adds the want key of the YAML mapping node m.
+func setWant(m *yaml.Node, want map[string]map[string]any) error {
+	if m.Kind != yaml.MappingNode {
+		return fmt.Errorf("%w: test case is not a YAML mapping", ErrInvalidCase)
+	}
+	v := &yaml.Node{}
+	if err := v.Encode(want); err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "want" {
+			m.Content[i+1] = v
+			return nil
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "want"}, v)
+	return nil
+}
+
+func encodeYAML(v any) ([]byte, error) {
+	var sb strings.Builder
+	e := yaml.NewEncoder(&sb)
+	e.SetIndent(2)
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(sb.String()), nil
+}
+
+func isJSON(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
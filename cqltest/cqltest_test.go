@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cqltest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRun(t *testing.T) {
+	Run(t, "testdata/cases/*.yaml")
+	Run(t, "testdata/cases/*.json")
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name:    "No CQL",
+			file:    "case.yaml",
+			content: "name: no cql\n",
+		},
+		{
+			name:    "Invalid YAML",
+			file:    "case.yaml",
+			content: "cql: [unterminated\n",
+		},
+		{
+			name:    "Invalid JSON",
+			file:    "case.json",
+			content: `{"cql": "not a list"}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), tc.file)
+			if err := os.WriteFile(p, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(p); !errors.Is(err, ErrInvalidCase) {
+				t.Errorf("Load() returned error %v, want %v", err, ErrInvalidCase)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	c, err := Load("testdata/cases/male_with_diabetes.yaml")
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	results, err := c.Eval(context.Background())
+	if err != nil {
+		t.Fatalf("Eval() returned unexpected error: %v", err)
+	}
+	c.Want = map[string]map[string]any{
+		"Example": {
+			"Is Male":   map[string]any{"@type": "System.Boolean", "value": false},
+			"Not A Def": map[string]any{"@type": "System.Boolean", "value": true},
+		},
+	}
+	diff, err := c.Diff(results)
+	if err != nil {
+		t.Fatalf("Diff() returned unexpected error: %v", err)
+	}
+	for _, want := range []string{"Example.Is Male (-want +got)", "Example.Not A Def: missing from results"} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("Diff() = %q, want it to contain %q", diff, want)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{name: "YAML", file: "cases/male_with_diabetes.yaml"},
+		{name: "JSON", file: "cases/default_parameters.json"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "cases"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []string{"example.cql", "bundle.json", "valueset-diabetes.json", tc.file} {
+				b, err := os.ReadFile(filepath.Join("testdata", f))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, f), b, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p := filepath.Join(dir, tc.file)
+			c, err := Load(p)
+			if err != nil {
+				t.Fatalf("Load() returned unexpected error: %v", err)
+			}
+			wantValues := c.Want
+			c.Want = nil
+
+			runCase(t, c, true)
+
+			updated, err := Load(p)
+			if err != nil {
+				t.Fatalf("Load() of the updated test case returned unexpected error: %v", err)
+			}
+			// Every define of the test case was written, not only the ones originally listed.
+			for _, name := range []string{"Is Male", "Has Diabetes", "Threshold Plus One"} {
+				if _, ok := updated.Want["Example"][name]; !ok {
+					t.Errorf("Update() did not write define Example.%s", name)
+				}
+			}
+			if _, ok := updated.Want[fhirHelpersLibName]; ok {
+				t.Errorf("Update() wrote results for %s, want them omitted", fhirHelpersLibName)
+			}
+			for name, want := range wantValues["Example"] {
+				wantN, err := normalize(want)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotN, err := normalize(updated.Want["Example"][name])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(wantN, gotN); diff != "" {
+					t.Errorf("Update() wrote unexpected value for %s (-want +got):\n%s", name, diff)
+				}
+			}
+			runCase(t, updated, false)
+		})
+	}
+}
+
+func TestUpdate_PreservesYAMLComments(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "case.yaml")
+	cqlPath, err := filepath.Abs("testdata/example.cql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundlePath, err := filepath.Abs("testdata/bundle.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valueSetPath, err := filepath.Abs("testdata/valueset-diabetes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "# Leading comment.\nname: comments\ncql:\n  - " + cqlPath + " # The library under test.\nbundle: " + bundlePath + "\nvalueSets: [" + valueSetPath + "]\n"
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(p)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	runCase(t, c, true)
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Leading comment.", "# The library under test.", "want:"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Update() wrote %q, want it to contain %q", b, want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package formatter formats CQL source into a consistent layout. Only whitespace between tokens is
+// changed, so formatting never changes the meaning of the CQL, and string literals and comments are
+// preserved.
+package formatter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/google/cql/internal/embeddata/third_party/cqframework/cql"
+)
+
+// Format returns the formatted CQL source. The formatted source:
+//   - uses \n line endings and ends with a single newline,
+//   - has no trailing whitespace and no leading blank lines,
+//   - has at most one blank line in a row,
+//   - has a blank line before every top level define, unless it directly follows a comment.
+//
+// Indentation and whitespace within a line are kept as written. An error is returned if the source
+// can not be tokenized, for example because of an unterminated string.
+func Format(src string) (string, error) {
+	lex := cql.NewCqlLexer(antlr.NewInputStream(src))
+	el := &errorListener{}
+	lex.RemoveErrorListeners()
+	lex.AddErrorListener(el)
+	tokens := lex.GetAllTokens()
+	if el.err != nil {
+		return "", el.err
+	}
+
+	var b strings.Builder
+	// ws is the whitespace since the previous non whitespace token.
+	var ws string
+	var prev antlr.Token
+	for _, tok := range tokens {
+		if tok.GetTokenType() == cql.CqlLexerWS {
+			ws += tok.GetText()
+			continue
+		}
+		if prev != nil {
+			b.WriteString(separator(ws, prev, tok))
+		}
+		b.WriteString(tokenText(tok))
+		ws = ""
+		prev = tok
+	}
+	if prev != nil {
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// IsFormatted returns true if the CQL source is already formatted.
+func IsFormatted(src string) (bool, error) {
+	formatted, err := Format(src)
+	if err != nil {
+		return false, err
+	}
+	return formatted == src, nil
+}
+
+// separator returns the formatted whitespace ws between the tokens prev and next.
+func separator(ws string, prev, next antlr.Token) string {
+	ws = strings.ReplaceAll(ws, "\r\n", "\n")
+	ws = strings.ReplaceAll(ws, "\r", "\n")
+	newlines := strings.Count(ws, "\n")
+	if newlines == 0 {
+		return ws
+	}
+	indent := ws[strings.LastIndex(ws, "\n")+1:]
+	newlines = min(newlines, 2)
+	if indent == "" && next.GetText() == "define" && !isComment(prev) {
+		newlines = 2
+	}
+	return strings.Repeat("\n", newlines) + indent
+}
+
+// tokenText returns the text of the token, with trailing whitespace removed from each line of
+// comments.
+func tokenText(tok antlr.Token) string {
+	if !isComment(tok) {
+		return tok.GetText()
+	}
+	lines := strings.Split(strings.ReplaceAll(tok.GetText(), "\r\n", "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isComment(tok antlr.Token) bool {
+	return tok.GetTokenType() == cql.CqlLexerCOMMENT || tok.GetTokenType() == cql.CqlLexerLINE_COMMENT
+}
+
+// errorListener records the first syntax error reported by the lexer.
+type errorListener struct {
+	*antlr.DefaultErrorListener
+	err error
+}
+
+func (l *errorListener) SyntaxError(_ antlr.Recognizer, _ any, line, column int, msg string, _ antlr.RecognitionException) {
+	if l.err == nil {
+		l.err = fmt.Errorf("%d-%d %s", line, column, msg)
+	}
+}
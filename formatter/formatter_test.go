@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "Trailing whitespace and final newline",
+			src:  "library TESTLIB  \t\ndefine A: 1   ",
+			want: "library TESTLIB\n\ndefine A: 1\n",
+		},
+		{
+			name: "Leading and repeated blank lines",
+			src:  "\n\n\nlibrary TESTLIB\n\n\n\nusing FHIR version '4.0.1'\n",
+			want: "library TESTLIB\n\nusing FHIR version '4.0.1'\n",
+		},
+		{
+			name: "CRLF line endings",
+			src:  "library TESTLIB\r\n\r\ndefine A: 1\r\n",
+			want: "library TESTLIB\n\ndefine A: 1\n",
+		},
+		{
+			name: "Blank line before top level defines",
+			src:  "library TESTLIB\ncontext Patient\ndefine A: 1\ndefine function F(x Integer): x\n",
+			want: "library TESTLIB\ncontext Patient\n\ndefine A: 1\n\ndefine function F(x Integer): x\n",
+		},
+		{
+			name: "Defines documented by comments",
+			src:  "library TESTLIB\n// A is one.   \ndefine A: 1\n/* B is two.  \n*/\ndefine B: 2\n",
+			want: "library TESTLIB\n// A is one.\ndefine A: 1\n/* B is two.\n*/\ndefine B: 2\n",
+		},
+		{
+			name: "Indentation and strings are kept",
+			src:  "library TESTLIB\n\ndefine A:\n  'a  \n  b'   +\n    'c'\n",
+			want: "library TESTLIB\n\ndefine A:\n  'a  \n  b'   +\n    'c'\n",
+		},
+		{
+			name: "Empty",
+			src:  " \n\n",
+			want: "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Format(tc.src)
+			if err != nil {
+				t.Fatalf("Format() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Format(%q) diff (-want +got):\n%s", tc.src, diff)
+			}
+			// Formatting is idempotent.
+			if ok, err := IsFormatted(got); err != nil || !ok {
+				t.Errorf("IsFormatted(%q) = %v, %v, want true", got, ok, err)
+			}
+		})
+	}
+}
+
+func TestFormat_Error(t *testing.T) {
+	if _, err := Format("library TESTLIB\ndefine A: 'unterminated\n"); err == nil {
+		t.Errorf("Format() with an unterminated string succeeded, want error")
+	}
+}
@@ -3,6 +3,8 @@ module github.com/google/cql
 go 1.22
 
 require (
+        cloud.google.com/go v0.112.1
+        cloud.google.com/go/bigquery v1.60.0
         github.com/antlr4-go/antlr/v4 v4.13.0
         github.com/apache/beam/sdks/v2 v2.56.0
         github.com/golang/glog v1.2.1
@@ -10,25 +12,31 @@ require (
         github.com/google/fhir/go v0.7.4
         github.com/google/fhir/go/protopath v0.7.4
         github.com/google/go-cmp v0.6.0
+        github.com/klauspost/compress v1.17.9
         github.com/kylelemons/godebug v1.1.0
         github.com/lithammer/dedent v1.1.0
+        github.com/parquet-go/parquet-go v0.23.0
         github.com/pborman/uuid v1.2.1
+        github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
         google.golang.org/genproto v0.0.0-20240311173647-c811ad7063a7
-        google.golang.org/protobuf v1.34.1
+        google.golang.org/protobuf v1.34.2
         gopkg.in/gyuho/goraph.v2 v2.0.0-20160328020532-d460590d53a9
+        gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
         bitbucket.org/creachadair/stringset v0.0.14 // indirect
-        cloud.google.com/go v0.112.1 // indirect
         cloud.google.com/go/compute v1.25.1 // indirect
         cloud.google.com/go/compute/metadata v0.2.3 // indirect
         cloud.google.com/go/iam v1.1.7 // indirect
         cloud.google.com/go/logging v1.9.0 // indirect
         cloud.google.com/go/longrunning v0.5.6 // indirect
         cloud.google.com/go/profiler v0.4.0 // indirect
+        cloud.google.com/go/pubsub v1.37.0 // indirect
         cloud.google.com/go/storage v1.39.1 // indirect
         github.com/Microsoft/go-winio v0.6.1 // indirect
+        github.com/andybalholm/brotli v1.1.0 // indirect
+        github.com/apache/arrow/go/v14 v14.0.2 // indirect
         github.com/distribution/reference v0.5.0 // indirect
         github.com/docker/docker v25.0.5+incompatible // indirect
         github.com/docker/go-connections v0.5.0 // indirect
@@ -37,9 +45,11 @@ require (
         github.com/felixge/httpsnoop v1.0.4 // indirect
         github.com/go-logr/logr v1.4.1 // indirect
         github.com/go-logr/stdr v1.2.2 // indirect
+        github.com/goccy/go-json v0.10.2 // indirect
         github.com/gogo/protobuf v1.3.2 // indirect
         github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
         github.com/golang/protobuf v1.5.4 // indirect
+        github.com/google/flatbuffers v23.5.26+incompatible // indirect
         github.com/google/pprof v0.0.0-20230602150820-91b7bce49751 // indirect
         github.com/google/s2a-go v0.1.7 // indirect
         github.com/google/uuid v1.6.0 // indirect
@@ -47,13 +57,20 @@ require (
         github.com/googleapis/gax-go/v2 v2.12.3 // indirect
         github.com/gyuho/goraph v0.0.0-20220410190906-ad625acf7ae3 // indirect
         github.com/json-iterator/go v1.1.12 // indirect
+        github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+        github.com/mattn/go-runewidth v0.0.15 // indirect
         github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
         github.com/modern-go/reflect2 v1.0.2 // indirect
         github.com/nxadm/tail v1.4.11 // indirect
+        github.com/olekukonko/tablewriter v0.0.5 // indirect
         github.com/opencontainers/go-digest v1.0.0 // indirect
         github.com/opencontainers/image-spec v1.1.0-rc5 // indirect
+        github.com/pierrec/lz4/v4 v4.1.21 // indirect
         github.com/pkg/errors v0.9.1 // indirect
+        github.com/rivo/uniseg v0.4.7 // indirect
+        github.com/segmentio/encoding v0.4.0 // indirect
         github.com/serenize/snaker v0.0.0-20201027110005-a7ad2135616e // indirect
+        github.com/zeebo/xxh3 v1.0.2 // indirect
         go.opencensus.io v0.24.0 // indirect
         go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.49.0 // indirect
         go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.49.0 // indirect
@@ -68,10 +85,11 @@ require (
         golang.org/x/net v0.25.0 // indirect
         golang.org/x/oauth2 v0.18.0 // indirect
         golang.org/x/sync v0.6.0 // indirect
-        golang.org/x/sys v0.20.0 // indirect
+        golang.org/x/sys v0.21.0 // indirect
         golang.org/x/text v0.15.0 // indirect
         golang.org/x/time v0.5.0 // indirect
         golang.org/x/tools v0.18.0 // indirect
+        golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028 // indirect
         google.golang.org/api v0.171.0 // indirect
         google.golang.org/appengine v1.6.8 // indirect
         google.golang.org/genproto/googleapis/api v0.0.0-20240520151616-dc85e6b867a5 // indirect
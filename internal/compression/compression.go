@@ -0,0 +1,174 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compression transparently decompresses gzip, zstd and zip encoded inputs. Bulk FHIR
+// exports are almost always compressed, so all file readers in the engine should pass their input
+// through Decompress.
+package compression
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Suffixes are the file suffixes of the compression formats supported by Decompress.
+var Suffixes = []string{".gz", ".zst", ".zip"}
+
+// MaxDecompressedSize is the largest total size in bytes of the data Decompress inflates from a
+// single input, so that a small compressed input, like a zip bomb, can not exhaust memory.
+var MaxDecompressedSize int64 = 1 << 30
+
+// ErrTooLarge is returned by Decompress if the decompressed data is larger than
+// MaxDecompressedSize.
+var ErrTooLarge = errors.New("decompressed data is too large")
+
+// zipSuffixes are the suffixes of the files within a zip archive that Decompress returns, optionally
+// followed by a compression suffix. Other files, like a README or manifest, are skipped.
+var zipSuffixes = []string{".json", ".ndjson"}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// File is a single decompressed file.
+type File struct {
+	// Name is the name of the file with any compression suffix removed. For files within a zip
+	// archive it is the path of the file within the archive.
+	Name string
+	Data []byte
+}
+
+// Decompress detects the compression format of data from its leading magic bytes and returns the
+// decompressed files. Gzip and zstd inputs return a single file. Zip archives return one file for
+// each .json or .ndjson file in the archive, each of which is decompressed recursively, and
+// nested zip archives. Uncompressed data is returned as is. name is only used to name the returned
+// files. If more than MaxDecompressedSize bytes would be inflated ErrTooLarge is returned.
+func Decompress(name string, data []byte) ([]File, error) {
+	remaining := MaxDecompressedSize
+	return decompress(name, data, &remaining)
+}
+
+// decompress is Decompress, where remaining is the number of bytes that may still be inflated.
+func decompress(name string, data []byte, remaining *int64) ([]File, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip file %s: %w", name, err)
+		}
+		defer r.Close()
+		return readAll(TrimSuffix(name), r, remaining)
+	case bytes.HasPrefix(data, zstdMagic):
+		r, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd file %s: %w", name, err)
+		}
+		defer r.Close()
+		return readAll(TrimSuffix(name), r, remaining)
+	case bytes.HasPrefix(data, zipMagic):
+		return unzip(name, data, remaining)
+	}
+	return []File{{Name: name, Data: data}}, nil
+}
+
+// TrimSuffix removes a compression suffix from name, for example bundle.json.gz becomes
+// bundle.json.
+func TrimSuffix(name string) string {
+	for _, s := range Suffixes {
+		if strings.HasSuffix(name, s) {
+			return strings.TrimSuffix(name, s)
+		}
+	}
+	return name
+}
+
+// HasSuffix returns true if name ends with suffix, optionally followed by a gzip or zstd
+// compression suffix. For example both bundle.json and bundle.json.gz have the suffix .json.
+func HasSuffix(name, suffix string) bool {
+	return strings.HasSuffix(TrimSuffix(name), suffix)
+}
+
+func readAll(name string, r io.Reader, remaining *int64) ([]File, error) {
+	data, err := read(name, r, remaining)
+	if err != nil {
+		return nil, err
+	}
+	// Handle nested compression such as a gzipped zip archive.
+	return decompress(name, data, remaining)
+}
+
+// read reads all of r, failing with ErrTooLarge if it holds more than remaining bytes.
+func read(name string, r io.Reader, remaining *int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, *remaining+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress file %s: %w", name, err)
+	}
+	if int64(len(data)) > *remaining {
+		return nil, fmt.Errorf("failed to decompress file %s: %w, the limit is %d bytes", name, ErrTooLarge, MaxDecompressedSize)
+	}
+	*remaining -= int64(len(data))
+	return data, nil
+}
+
+func unzip(name string, data []byte, remaining *int64) ([]File, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zip archive %s: %w", name, err)
+	}
+	var files []File
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || strings.HasPrefix(path.Base(zf.Name), ".") || !zipEntryWanted(zf.Name) {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s in zip archive %s: %w", zf.Name, name, err)
+		}
+		b, err := read(zf.Name, rc, remaining)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in zip archive %s: %w", zf.Name, name, err)
+		}
+		fs, err := decompress(zf.Name, b, remaining)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fs...)
+	}
+	return files, nil
+}
+
+// zipEntryWanted returns true if the file named name within a zip archive is returned by
+// Decompress.
+func zipEntryWanted(name string) bool {
+	if strings.HasSuffix(name, ".zip") {
+		return true
+	}
+	for _, s := range zipSuffixes {
+		if HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compression
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		data  []byte
+		want  []File
+	}{
+		{
+			name:  "Uncompressed",
+			input: "bundle.json",
+			data:  []byte(`{"a": 1}`),
+			want:  []File{{Name: "bundle.json", Data: []byte(`{"a": 1}`)}},
+		},
+		{
+			name:  "Gzip",
+			input: "bundle.json.gz",
+			data:  gzipBytes(t, []byte(`{"a": 1}`)),
+			want:  []File{{Name: "bundle.json", Data: []byte(`{"a": 1}`)}},
+		},
+		{
+			name:  "Zstd",
+			input: "bundle.json.zst",
+			data:  zstdBytes(t, []byte(`{"a": 1}`)),
+			want:  []File{{Name: "bundle.json", Data: []byte(`{"a": 1}`)}},
+		},
+		{
+			name:  "Zip with nested gzip",
+			input: "bundles.zip",
+			data: zipBytes(t, []File{
+				{Name: "a.json", Data: []byte(`{"a": 1}`)},
+				{Name: "dir/b.json.gz", Data: gzipBytes(t, []byte(`{"b": 2}`))},
+				{Name: "dir/.DS_Store", Data: []byte("ignored")},
+				{Name: "README.md", Data: []byte("ignored")},
+				{Name: "manifest.txt.gz", Data: gzipBytes(t, []byte("ignored"))},
+				{Name: "c.ndjson", Data: []byte(`{"c": 3}`)},
+				{Name: "empty_dir/"},
+			}),
+			want: []File{
+				{Name: "a.json", Data: []byte(`{"a": 1}`)},
+				{Name: "dir/b.json", Data: []byte(`{"b": 2}`)},
+				{Name: "c.ndjson", Data: []byte(`{"c": 3}`)},
+			},
+		},
+		{
+			name:  "Nested zip",
+			input: "bundles.zip",
+			data:  zipBytes(t, []File{{Name: "inner.zip", Data: zipBytes(t, []File{{Name: "a.json", Data: []byte(`{"a": 1}`)}})}}),
+			want:  []File{{Name: "a.json", Data: []byte(`{"a": 1}`)}},
+		},
+		{
+			name:  "Gzipped zip",
+			input: "bundles.zip.gz",
+			data:  gzipBytes(t, zipBytes(t, []File{{Name: "a.json", Data: []byte(`{"a": 1}`)}})),
+			want:  []File{{Name: "a.json", Data: []byte(`{"a": 1}`)}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Decompress(tc.input, tc.data)
+			if err != nil {
+				t.Fatalf("Decompress() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Decompress() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDecompress_Error(t *testing.T) {
+	// Valid gzip magic bytes followed by garbage.
+	if _, err := Decompress("bad.gz", []byte{0x1f, 0x8b, 0x00, 0x01}); err == nil {
+		t.Errorf("Decompress() succeeded, want error")
+	}
+}
+
+func TestDecompress_TooLarge(t *testing.T) {
+	defer func(max int64) { MaxDecompressedSize = max }(MaxDecompressedSize)
+	MaxDecompressedSize = 100
+	big := bytes.Repeat([]byte("a"), 60)
+
+	tests := []struct {
+		name  string
+		input string
+		data  []byte
+	}{
+		{
+			name:  "Gzip",
+			input: "bundle.json.gz",
+			data:  gzipBytes(t, bytes.Repeat([]byte("a"), 101)),
+		},
+		{
+			// Each file is under the limit, but together they are over it.
+			name:  "Zip",
+			input: "bundles.zip",
+			data:  zipBytes(t, []File{{Name: "a.json", Data: big}, {Name: "b.json", Data: big}}),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Decompress(tc.input, tc.data); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("Decompress() returned error %v, want %v", err, ErrTooLarge)
+			}
+		})
+	}
+	if _, err := Decompress("bundle.json.gz", gzipBytes(t, bytes.Repeat([]byte("a"), 100))); err != nil {
+		t.Errorf("Decompress() of exactly MaxDecompressedSize bytes returned unexpected error: %v", err)
+	}
+}
+
+func TestHasSuffix(t *testing.T) {
+	tests := []struct {
+		name   string
+		suffix string
+		want   bool
+	}{
+		{name: "bundle.json", suffix: ".json", want: true},
+		{name: "bundle.json.gz", suffix: ".json", want: true},
+		{name: "bundle.ndjson.zst", suffix: ".ndjson", want: true},
+		{name: "bundle.txt.gz", suffix: ".json", want: false},
+	}
+	for _, tc := range tests {
+		if got := HasSuffix(tc.name, tc.suffix); got != tc.want {
+			t.Errorf("HasSuffix(%q, %q) = %v, want %v", tc.name, tc.suffix, got, tc.want)
+		}
+	}
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	return w.EncodeAll(data, nil)
+}
+
+// zipBytes returns a zip archive of the files. Names ending in / are added as directories.
+func zipBytes(t *testing.T, files []File) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, file := range files {
+		f, err := w.Create(file.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(file.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,368 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package datarequirements statically analyzes parsed CQL to determine which data the CQL engine
+// will request from a retriever during evaluation.
+package datarequirements
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
+)
+
+// FromLibraries returns the deduplicated data requirements of all retrieves in the libraries. The
+// requirements are sorted by resource type and then by code filter. Every definition is analyzed,
+// even if it is never referenced, so the result may be a superset of what an evaluation retrieves.
+func FromLibraries(libs []*model.Library) ([]retriever.DataRequirement, error) {
+	a := &analyzer{libs: make(map[result.LibKey]*model.Library, len(libs))}
+	for _, lib := range libs {
+		if lib.Identifier != nil {
+			a.libs[result.LibKeyFromModel(lib.Identifier)] = lib
+		}
+	}
+
+	seen := make(map[string]bool)
+	var reqs []retriever.DataRequirement
+	for _, lib := range libs {
+		var err error
+		model.Walk(lib, func(e model.IExpression) bool {
+			if err != nil {
+				return false
+			}
+			r, ok := e.(*model.Retrieve)
+			if !ok {
+				return true
+			}
+			var req retriever.DataRequirement
+			req, err = a.requirement(lib, r)
+			if err != nil {
+				return false
+			}
+			if k := key(req); !seen[k] {
+				seen[k] = true
+				reqs = append(reqs, req)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(reqs, func(i, j int) bool { return key(reqs[i]) < key(reqs[j]) })
+	return reqs, nil
+}
+
+// ResourceTypes returns the sorted, deduplicated FHIR resource types of the data requirements.
+func ResourceTypes(reqs []retriever.DataRequirement) []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, r := range reqs {
+		if !seen[r.ResourceType] {
+			seen[r.ResourceType] = true
+			types = append(types, r.ResourceType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ValueSets returns the sorted, deduplicated ValueSets declared by the libraries, whether or not they
+// are referenced by a retrieve.
+func ValueSets(libs []*model.Library) []result.ValueSet {
+	seen := make(map[string]bool)
+	var vss []result.ValueSet
+	for _, lib := range libs {
+		for _, vs := range lib.Valuesets {
+			if k := vs.ID + "|" + vs.Version; !seen[k] {
+				seen[k] = true
+				vss = append(vss, result.ValueSet{ID: vs.ID, Version: vs.Version})
+			}
+		}
+	}
+	sort.Slice(vss, func(i, j int) bool {
+		if vss[i].ID != vss[j].ID {
+			return vss[i].ID < vss[j].ID
+		}
+		return vss[i].Version < vss[j].Version
+	})
+	return vss
+}
+
+// CodeSystems returns the sorted, deduplicated CodeSystems declared by the libraries.
+func CodeSystems(libs []*model.Library) []result.CodeSystem {
+	seen := make(map[string]bool)
+	var css []result.CodeSystem
+	for _, lib := range libs {
+		for _, cs := range lib.CodeSystems {
+			if k := cs.ID + "|" + cs.Version; !seen[k] {
+				seen[k] = true
+				css = append(css, result.CodeSystem{ID: cs.ID, Version: cs.Version})
+			}
+		}
+	}
+	sort.Slice(css, func(i, j int) bool {
+		if css[i].ID != css[j].ID {
+			return css[i].ID < css[j].ID
+		}
+		return css[i].Version < css[j].Version
+	})
+	return css
+}
+
+// Dependencies returns the expression and function definitions directly referenced by each
+// expression and function definition of the libraries, sorted by library and name. Every
+// definition is a key, even if it references nothing. Function overloads are not distinguished,
+// all overloads of a function share a key.
+func Dependencies(libs []*model.Library) map[result.DefKey][]result.DefKey {
+	deps := make(map[result.DefKey][]result.DefKey)
+	for _, lib := range libs {
+		if lib.Statements == nil {
+			continue
+		}
+		key := result.LibKeyFromModel(lib.Identifier)
+		includes := make(map[string]result.LibKey)
+		for _, inc := range lib.Includes {
+			includes[inc.Identifier.Local] = result.LibKeyFromModel(inc.Identifier)
+		}
+		for _, d := range lib.Statements.Defs {
+			k := result.DefKey{Name: d.GetName(), Library: key}
+			refs := deps[k]
+			if refs == nil {
+				refs = []result.DefKey{}
+			}
+			ref := func(libraryName, name string) {
+				refLib := key
+				if libraryName != "" {
+					refLib = includes[libraryName]
+				}
+				if r := (result.DefKey{Name: name, Library: refLib}); !slices.Contains(refs, r) {
+					refs = append(refs, r)
+				}
+			}
+			model.Walk(d, func(e model.IExpression) bool {
+				switch r := e.(type) {
+				case *model.ExpressionRef:
+					ref(r.LibraryName, r.Name)
+				case *model.FunctionRef:
+					ref(r.LibraryName, r.Name)
+				}
+				return true
+			})
+			sortDefKeys(refs)
+			deps[k] = refs
+		}
+	}
+	return deps
+}
+
+// Includes returns the libraries directly included by each of the libraries, sorted by key. Every
+// named library is a key, even if it includes nothing.
+func Includes(libs []*model.Library) map[result.LibKey][]result.LibKey {
+	includes := make(map[result.LibKey][]result.LibKey)
+	for _, lib := range libs {
+		if lib.Identifier == nil {
+			continue
+		}
+		incs := []result.LibKey{}
+		for _, inc := range lib.Includes {
+			if k := result.LibKeyFromModel(inc.Identifier); !slices.Contains(incs, k) {
+				incs = append(incs, k)
+			}
+		}
+		sort.Slice(incs, func(i, j int) bool { return incs[i].Key() < incs[j].Key() })
+		includes[result.LibKeyFromModel(lib.Identifier)] = incs
+	}
+	return includes
+}
+
+// RequiredDefinitions returns the keys of the expression definitions in libs for which keep returns
+// true, together with the keys of every expression and function definition they reference,
+// directly or through other definitions. Function overloads are not distinguished, a reference to
+// a function requires every function with that name.
+func RequiredDefinitions(libs []*model.Library, keep func(result.LibKey, string) bool) map[result.DefKey]bool {
+	type libDefs struct {
+		// includes maps the local identifiers of the included libraries to their keys.
+		includes map[string]result.LibKey
+		defs     map[string][]model.IExpressionDef
+	}
+	byLib := make(map[result.LibKey]libDefs, len(libs))
+	required := make(map[result.DefKey]bool)
+	var queue []result.DefKey
+	require := func(k result.DefKey) {
+		if !required[k] {
+			required[k] = true
+			queue = append(queue, k)
+		}
+	}
+
+	for _, lib := range libs {
+		key := result.LibKeyFromModel(lib.Identifier)
+		ld := libDefs{includes: make(map[string]result.LibKey), defs: make(map[string][]model.IExpressionDef)}
+		for _, inc := range lib.Includes {
+			ld.includes[inc.Identifier.Local] = result.LibKeyFromModel(inc.Identifier)
+		}
+		if lib.Statements != nil {
+			for _, d := range lib.Statements.Defs {
+				ld.defs[d.GetName()] = append(ld.defs[d.GetName()], d)
+				if _, ok := d.(*model.ExpressionDef); ok && keep(key, d.GetName()) {
+					require(result.DefKey{Name: d.GetName(), Library: key})
+				}
+			}
+		}
+		byLib[key] = ld
+	}
+
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		ld := byLib[k.Library]
+		ref := func(libraryName, name string) {
+			lib := k.Library
+			if libraryName != "" {
+				lib = ld.includes[libraryName]
+			}
+			require(result.DefKey{Name: name, Library: lib})
+		}
+		for _, d := range ld.defs[k.Name] {
+			model.Walk(d, func(e model.IExpression) bool {
+				switch r := e.(type) {
+				case *model.ExpressionRef:
+					ref(r.LibraryName, r.Name)
+				case *model.FunctionRef:
+					ref(r.LibraryName, r.Name)
+				}
+				return true
+			})
+		}
+	}
+	return required
+}
+
+// UnusedPrivateDefs returns the private expression and function definitions of the libraries that
+// are not referenced by any other definition, sorted by library and name. They can never affect
+// the results of an evaluation.
+func UnusedPrivateDefs(libs []*model.Library) []result.DefKey {
+	used := make(map[result.DefKey]bool)
+	for _, refs := range Dependencies(libs) {
+		for _, r := range refs {
+			used[r] = true
+		}
+	}
+
+	var unused []result.DefKey
+	for _, lib := range libs {
+		if lib.Statements == nil {
+			continue
+		}
+		key := result.LibKeyFromModel(lib.Identifier)
+		for _, d := range lib.Statements.Defs {
+			// The parser adds a private definition for each context, such as Patient, which is used
+			// implicitly.
+			if d.GetName() == d.GetContext() {
+				continue
+			}
+			k := result.DefKey{Name: d.GetName(), Library: key}
+			if d.GetAccessLevel() == model.Private && !used[k] && !slices.Contains(unused, k) {
+				unused = append(unused, k)
+			}
+		}
+	}
+	sortDefKeys(unused)
+	return unused
+}
+
+func sortDefKeys(keys []result.DefKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Library.Key() != keys[j].Library.Key() {
+			return keys[i].Library.Key() < keys[j].Library.Key()
+		}
+		return keys[i].Name < keys[j].Name
+	})
+}
+
+type analyzer struct {
+	libs map[result.LibKey]*model.Library
+}
+
+func (a *analyzer) requirement(lib *model.Library, r *model.Retrieve) (retriever.DataRequirement, error) {
+	req := retriever.DataRequirement{ResourceType: resourceType(r.DataType)}
+	if r.DateProperty != "" {
+		req.DateFilter = &retriever.DateFilter{Property: r.DateProperty}
+	}
+	if r.Codes == nil {
+		return req, nil
+	}
+	req.CodeFilter = &retriever.CodeFilter{Property: r.CodeProperty}
+	vr, ok := r.Codes.(*model.ValuesetRef)
+	if !ok {
+		return req, nil
+	}
+	vs, err := a.valueset(lib, vr)
+	if err != nil {
+		return retriever.DataRequirement{}, err
+	}
+	req.CodeFilter.ValueSetURL = vs.ID
+	req.CodeFilter.ValueSetVersion = vs.Version
+	return req, nil
+}
+
+// valueset resolves a reference to a ValuesetDef in the current or an included library.
+func (a *analyzer) valueset(lib *model.Library, vr *model.ValuesetRef) (*model.ValuesetDef, error) {
+	target := lib
+	if vr.LibraryName != "" {
+		target = nil
+		for _, inc := range lib.Includes {
+			if inc.Identifier != nil && inc.Identifier.Local == vr.LibraryName {
+				target = a.libs[result.LibKeyFromModel(inc.Identifier)]
+				break
+			}
+		}
+		if target == nil {
+			return nil, fmt.Errorf("could not resolve included library %q for valueset %q", vr.LibraryName, vr.Name)
+		}
+	}
+	for _, vs := range target.Valuesets {
+		if vs.Name == vr.Name {
+			return vs, nil
+		}
+	}
+	return nil, fmt.Errorf("could not resolve valueset %q", vr.Name)
+}
+
+// resourceType strips the model namespace from a retrieve data type, for example
+// "{http://hl7.org/fhir}Observation" becomes "Observation".
+func resourceType(dataType string) string {
+	if i := strings.LastIndex(dataType, "}"); i >= 0 {
+		return dataType[i+1:]
+	}
+	return dataType
+}
+
+func key(r retriever.DataRequirement) string {
+	k := r.ResourceType
+	if r.CodeFilter != nil {
+		k = strings.Join([]string{k, r.CodeFilter.Property, r.CodeFilter.ValueSetURL, r.CodeFilter.ValueSetVersion}, "|")
+	}
+	if r.DateFilter != nil {
+		k += "|date|" + r.DateFilter.Property
+	}
+	return k
+}
@@ -0,0 +1,271 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datarequirements
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/cql/internal/embeddata"
+	"github.com/google/cql/model"
+	"github.com/google/cql/parser"
+	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestFromLibraries(t *testing.T) {
+	tests := []struct {
+		name string
+		cql  []string
+		want []retriever.DataRequirement
+	}{
+		{
+			name: "No retrieves",
+			cql: []string{dedent.Dedent(`
+			library TESTLIB version '1.0.0'
+			define Foo: 1`)},
+			want: nil,
+		},
+		{
+			name: "Deduplicates and sorts retrieves",
+			cql: []string{dedent.Dedent(`
+			library TESTLIB version '1.0.0'
+			using FHIR version '4.0.1'
+			define Obs: [Observation]
+			define Enc: [Encounter]
+			define Enc2: exists [Encounter]`)},
+			want: []retriever.DataRequirement{
+				{ResourceType: "Encounter"},
+				{ResourceType: "Observation"},
+			},
+		},
+		{
+			name: "Valueset from included library",
+			cql: []string{
+				dedent.Dedent(`
+				library Terminology version '1.0.0'
+				valueset "Glucose": 'https://example.com/glucose' version '2.0.0'`),
+				dedent.Dedent(`
+				library TESTLIB version '1.0.0'
+				using FHIR version '4.0.1'
+				include Terminology version '1.0.0' called Term
+				define Obs: [Observation: Term."Glucose"]
+				define function Func(): [Condition: Term."Glucose"]`),
+			},
+			want: []retriever.DataRequirement{
+				{ResourceType: "Condition", CodeFilter: &retriever.CodeFilter{Property: "code", ValueSetURL: "https://example.com/glucose", ValueSetVersion: "2.0.0"}},
+				{ResourceType: "Observation", CodeFilter: &retriever.CodeFilter{Property: "code", ValueSetURL: "https://example.com/glucose", ValueSetVersion: "2.0.0"}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			libs := parseLibs(t, tc.cql)
+			got, err := FromLibraries(libs)
+			if err != nil {
+				t.Fatalf("FromLibraries() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("FromLibraries() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFromLibraries_DateFilter(t *testing.T) {
+	libs := parseLibs(t, []string{dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	define Obs: [Observation]
+	define Filtered: [Observation]`)})
+	// Date filters are set by the optimizer's predicate pushdown, not the parser.
+	model.Walk(libs[0].Statements.Defs[1], func(e model.IExpression) bool {
+		if r, ok := e.(*model.Retrieve); ok {
+			r.DateProperty = "effective"
+		}
+		return true
+	})
+	got, err := FromLibraries(libs)
+	if err != nil {
+		t.Fatalf("FromLibraries() returned unexpected error: %v", err)
+	}
+	want := []retriever.DataRequirement{
+		{ResourceType: "Observation"},
+		{ResourceType: "Observation", DateFilter: &retriever.DateFilter{Property: "effective"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("FromLibraries() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestResourceTypes(t *testing.T) {
+	reqs := []retriever.DataRequirement{
+		{ResourceType: "Observation", CodeFilter: &retriever.CodeFilter{Property: "code"}},
+		{ResourceType: "Encounter"},
+		{ResourceType: "Observation"},
+	}
+	want := []string{"Encounter", "Observation"}
+	if diff := cmp.Diff(want, ResourceTypes(reqs)); diff != "" {
+		t.Errorf("ResourceTypes() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestValueSets(t *testing.T) {
+	libs := parseLibs(t, []string{
+		dedent.Dedent(`
+		library Terminology version '1.0.0'
+		valueset "Glucose": 'https://example.com/glucose' version '2.0.0'
+		valueset "Diabetes": 'urn:oid:2.16.840.1.113883.3.464.1003.103.12.1001'`),
+		dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		include Terminology version '1.0.0' called Term
+		valueset "Glucose": 'https://example.com/glucose' version '2.0.0'
+		valueset "Glucose Old": 'https://example.com/glucose' version '1.0.0'`),
+	})
+	want := []result.ValueSet{
+		{ID: "https://example.com/glucose", Version: "1.0.0"},
+		{ID: "https://example.com/glucose", Version: "2.0.0"},
+		{ID: "urn:oid:2.16.840.1.113883.3.464.1003.103.12.1001"},
+	}
+	if diff := cmp.Diff(want, ValueSets(libs)); diff != "" {
+		t.Errorf("ValueSets() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCodeSystems(t *testing.T) {
+	libs := parseLibs(t, []string{
+		dedent.Dedent(`
+		library Terminology version '1.0.0'
+		codesystem "LOINC": 'http://loinc.org'`),
+		dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		include Terminology version '1.0.0' called Term
+		codesystem "LOINC": 'http://loinc.org'
+		codesystem "SNOMED": 'http://snomed.info/sct' version '2024'`),
+	})
+	want := []result.CodeSystem{
+		{ID: "http://loinc.org"},
+		{ID: "http://snomed.info/sct", Version: "2024"},
+	}
+	if diff := cmp.Diff(want, CodeSystems(libs)); diff != "" {
+		t.Errorf("CodeSystems() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestUnusedPrivateDefs(t *testing.T) {
+	libs := parseLibs(t, []string{
+		dedent.Dedent(`
+		library Helpers version '1.0.0'
+		define private Offset: 10
+		define private Unused: 1
+		define function AddOffset(x Integer): x + Offset`),
+		dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		using FHIR version '4.0.1'
+		include Helpers version '1.0.0' called H
+		context Patient
+		define private Base: 1
+		define private function Double(x Integer): x * 2
+		define private function Triple(x Integer): x * 3
+		define Numerator: Double(H.AddOffset(Base))`),
+	})
+	want := []result.DefKey{
+		{Name: "Unused", Library: result.LibKey{Name: "Helpers", Version: "1.0.0"}},
+		{Name: "Triple", Library: result.LibKey{Name: "TESTLIB", Version: "1.0.0"}},
+	}
+	if diff := cmp.Diff(want, UnusedPrivateDefs(libs)); diff != "" {
+		t.Errorf("UnusedPrivateDefs() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRequiredDefinitions(t *testing.T) {
+	libs := parseLibs(t, []string{
+		dedent.Dedent(`
+		library Helpers version '1.0.0'
+		define Offset: 10
+		define Unused: 1`),
+		dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		include Helpers version '1.0.0' called H
+		define private Base: 1
+		define function AddBase(x Integer): x + Base
+		define Numerator: AddBase(H.Offset)
+		define Denominator: 2`),
+	})
+	helpers := result.LibKey{Name: "Helpers", Version: "1.0.0"}
+	testlib := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	want := map[result.DefKey]bool{
+		{Name: "Numerator", Library: testlib}: true,
+		{Name: "AddBase", Library: testlib}:   true,
+		{Name: "Base", Library: testlib}:      true,
+		{Name: "Offset", Library: helpers}:    true,
+	}
+	got := RequiredDefinitions(libs, func(lib result.LibKey, name string) bool { return name == "Numerator" })
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RequiredDefinitions() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDependenciesAndIncludes(t *testing.T) {
+	libs := parseLibs(t, []string{
+		dedent.Dedent(`
+		library Helpers version '1.0.0'
+		define private Offset: 10
+		define function AddOffset(x Integer): x + Offset
+		define function AddOffset(x Decimal): x + Offset`),
+		dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		include Helpers version '1.0.0' called H
+		define Base: 1
+		define Numerator: H.AddOffset(Base) + H.AddOffset(Base + 1)`),
+	})
+	helpers := result.LibKey{Name: "Helpers", Version: "1.0.0"}
+	testlib := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	wantDeps := map[result.DefKey][]result.DefKey{
+		{Name: "Offset", Library: helpers}:    {},
+		{Name: "AddOffset", Library: helpers}: {{Name: "Offset", Library: helpers}},
+		{Name: "Base", Library: testlib}:      {},
+		{Name: "Numerator", Library: testlib}: {{Name: "AddOffset", Library: helpers}, {Name: "Base", Library: testlib}},
+	}
+	if diff := cmp.Diff(wantDeps, Dependencies(libs)); diff != "" {
+		t.Errorf("Dependencies() diff (-want +got):\n%s", diff)
+	}
+	wantIncludes := map[result.LibKey][]result.LibKey{
+		helpers: {},
+		testlib: {helpers},
+	}
+	if diff := cmp.Diff(wantIncludes, Includes(libs)); diff != "" {
+		t.Errorf("Includes() diff (-want +got):\n%s", diff)
+	}
+}
+
+func parseLibs(t *testing.T, cql []string) []*model.Library {
+	t.Helper()
+	fhirMI, err := embeddata.ModelInfos.ReadFile("third_party/cqframework/fhir-modelinfo-4.0.1.xml")
+	if err != nil {
+		t.Fatalf("internal error - could not read fhir-modelinfo-4.0.1.xml: %v", err)
+	}
+	p, err := parser.New(context.Background(), [][]byte{fhirMI})
+	if err != nil {
+		t.Fatalf("parser.New() returned unexpected error: %v", err)
+	}
+	libs, err := p.Libraries(context.Background(), cql, parser.Config{})
+	if err != nil {
+		t.Fatalf("Libraries() returned unexpected error: %v", err)
+	}
+	return libs
+}
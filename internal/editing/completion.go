@@ -0,0 +1,321 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package editing implements features for editing CQL that are shared by the playground and the
+// language server, like completion.
+package editing
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/cql"
+	"github.com/google/cql/internal/modelinfo"
+	"github.com/google/cql/model"
+	"github.com/google/cql/parser"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+)
+
+// Completion is a suggestion for the text at the cursor.
+type Completion struct {
+	// Label is the text that replaces the prefix.
+	Label string `json:"label"`
+	// Kind is what the completion is, for example "define", "property" or "operator".
+	Kind string `json:"kind"`
+	// Detail is the type of the completion, or the signatures of a function.
+	Detail string `json:"detail,omitempty"`
+}
+
+// CompletionList holds the completions at a cursor position.
+type CompletionList struct {
+	// Prefix is the partial identifier before the cursor that the completions replace.
+	Prefix      string       `json:"prefix"`
+	Completions []Completion `json:"completions"`
+}
+
+var (
+	// completionPrefix matches the partial identifier at the end of the text before the cursor.
+	completionPrefix = regexp.MustCompile(`(?:"[^"]*|[A-Za-z_][A-Za-z0-9_]*)$`)
+	// completionQualifier matches the qualifier of a member access at the end of the text before the
+	// prefix, for example the alias O in "O.".
+	completionQualifier = regexp.MustCompile(`("[^"]+"|[A-Za-z_][A-Za-z0-9_]*)\.$`)
+)
+
+// completionKinds orders the kinds of completions.
+var completionKinds = []string{"property", "define", "parameter", "function", "valueset", "codesystem", "code", "concept", "library", "operator"}
+
+// Complete returns the identifiers, valueset names, model properties and operators that may be
+// written at the cursor in sources[source]. line is the 1-based line and column the 0-based byte
+// column of the cursor. The sources are parsed to find the declarations in scope. If they do not
+// parse, for example because the line at the cursor is being typed, they are parsed again without
+// that line.
+func Complete(ctx context.Context, sources []string, source, line, column int) (*CompletionList, error) {
+	if source < 0 || source >= len(sources) {
+		return nil, fmt.Errorf("source %d is out of range", source)
+	}
+	lines := strings.Split(sources[source], "\n")
+	if line < 1 || line > len(lines) {
+		return nil, fmt.Errorf("line %d is out of range", line)
+	}
+	before := lines[line-1]
+	before = before[:max(0, min(column, len(before)))]
+	prefix := completionPrefix.FindString(before)
+	qualifier := ""
+	if m := completionQualifier.FindStringSubmatch(before[:len(before)-len(prefix)]); m != nil {
+		qualifier = strings.Trim(m[1], `"`)
+	}
+
+	fhirDM, err := cql.FHIRDataModel("4.0.1")
+	if err != nil {
+		return nil, err
+	}
+	fhirHelpers, err := cql.FHIRHelpersLib("4.0.1")
+	if err != nil {
+		return nil, err
+	}
+	p, err := parser.New(ctx, [][]byte{fhirDM})
+	if err != nil {
+		return nil, err
+	}
+	libs, err := p.Libraries(ctx, append(sources, fhirHelpers), parser.Config{})
+	if err != nil {
+		withoutLine := append([]string{}, sources...)
+		withoutLine[source] = strings.Join(append(append([]string{}, lines[:line-1]...), lines[line:]...), "\n")
+		libs, _ = p.Libraries(ctx, append(withoutLine, fhirHelpers), parser.Config{})
+	}
+
+	var curr *model.Library
+	for _, lib := range libs {
+		key := result.LibKeyFromModel(lib.Identifier)
+		if SourceIndex(sources, key) == source {
+			curr = lib
+			break
+		}
+	}
+
+	mi := p.DataModel()
+	if err := mi.SetUsing(modelinfo.Key{Name: "FHIR", Version: "4.0.1"}); err != nil {
+		return nil, err
+	}
+
+	var comps []Completion
+	switch {
+	case qualifier != "":
+		comps = memberCompletions(mi, libs, curr, sources[source], qualifier)
+	case curr != nil:
+		comps = declarationCompletions(curr, true)
+		for _, inc := range curr.Includes {
+			comps = append(comps, Completion{Label: inc.Identifier.Local, Kind: "library", Detail: inc.Identifier.Qualified + " " + inc.Identifier.Version})
+		}
+		comps = append(comps, operatorCompletions(p.SystemOperators())...)
+	default:
+		comps = operatorCompletions(p.SystemOperators())
+	}
+	return &CompletionList{Prefix: prefix, Completions: filterCompletions(comps, prefix)}, nil
+}
+
+// memberCompletions returns the completions after "qualifier.", which are the public declarations
+// of an included library or the properties of the type of a definition or query alias.
+func memberCompletions(mi *modelinfo.ModelInfos, libs []*model.Library, curr *model.Library, src, qualifier string) []Completion {
+	if curr == nil {
+		return nil
+	}
+	for _, inc := range curr.Includes {
+		if inc.Identifier.Local != qualifier {
+			continue
+		}
+		for _, lib := range libs {
+			if lib.Identifier != nil && lib.Identifier.Qualified == inc.Identifier.Qualified && lib.Identifier.Version == inc.Identifier.Version {
+				return declarationCompletions(lib, false)
+			}
+		}
+		return nil
+	}
+
+	var t types.IType
+	for _, p := range curr.Parameters {
+		if p.Name == qualifier {
+			t = p.GetResultType()
+		}
+	}
+	if curr.Statements != nil {
+		for _, d := range curr.Statements.Defs {
+			if ed, ok := d.(*model.ExpressionDef); ok && ed.Name == qualifier {
+				t = ed.GetResultType()
+			}
+		}
+	}
+	if t == nil {
+		t = aliasType(src, qualifier)
+	}
+	return propertyCompletions(mi, t)
+}
+
+// aliasType returns the type of a query alias over a retrieve, like O in "[Observation] O", or nil.
+func aliasType(src, alias string) types.IType {
+	re, err := regexp.Compile(`\[\s*(?:FHIR\.)?"?([A-Za-z]+)"?[^\]]*\]\s+"?` + regexp.QuoteMeta(alias) + `\b`)
+	if err != nil {
+		return nil
+	}
+	m := re.FindStringSubmatch(src)
+	if m == nil {
+		return nil
+	}
+	return &types.Named{TypeName: "FHIR." + m[1]}
+}
+
+// propertyCompletions returns the properties of t and its base types in the data model. Lists are
+// completed with the properties of their elements.
+func propertyCompletions(mi *modelinfo.ModelInfos, t types.IType) []Completion {
+	if l, ok := t.(*types.List); ok {
+		t = l.ElementType
+	}
+	n, ok := t.(*types.Named)
+	if !ok {
+		return nil
+	}
+	var comps []Completion
+	seen := map[string]bool{}
+	for n != nil {
+		info, err := mi.NamedTypeInfo(n)
+		if err != nil {
+			break
+		}
+		for name, pt := range info.Properties {
+			if !seen[name] {
+				seen[name] = true
+				comps = append(comps, Completion{Label: name, Kind: "property", Detail: TypeName(pt)})
+			}
+		}
+		n = nil
+		if info.BaseType != "" {
+			n = &types.Named{TypeName: info.BaseType}
+		}
+	}
+	return comps
+}
+
+// declarationCompletions returns the declarations of the library. Private declarations are only
+// included if includePrivate is true.
+func declarationCompletions(lib *model.Library, includePrivate bool) []Completion {
+	var comps []Completion
+	add := func(name string, access model.AccessLevel, kind, detail string) {
+		if access == model.Public || includePrivate {
+			comps = append(comps, Completion{Label: QuoteIdentifier(name), Kind: kind, Detail: detail})
+		}
+	}
+	for _, p := range lib.Parameters {
+		add(p.Name, p.AccessLevel, "parameter", TypeName(p.GetResultType()))
+	}
+	for _, cs := range lib.CodeSystems {
+		add(cs.Name, cs.AccessLevel, "codesystem", cs.ID)
+	}
+	for _, vs := range lib.Valuesets {
+		add(vs.Name, vs.AccessLevel, "valueset", vs.ID)
+	}
+	for _, c := range lib.Codes {
+		add(c.Name, c.AccessLevel, "code", c.Code)
+	}
+	for _, c := range lib.Concepts {
+		add(c.Name, c.AccessLevel, "concept", "Concept")
+	}
+	if lib.Statements == nil {
+		return comps
+	}
+	for _, d := range lib.Statements.Defs {
+		switch def := d.(type) {
+		case *model.FunctionDef:
+			operands := make([]string, 0, len(def.Operands))
+			for _, o := range def.Operands {
+				operands = append(operands, o.Name+" "+TypeName(o.GetResultType()))
+			}
+			add(def.Name, def.AccessLevel, "function", fmt.Sprintf("(%s) returns %s", strings.Join(operands, ", "), TypeName(def.GetResultType())))
+		case *model.ExpressionDef:
+			add(def.Name, def.AccessLevel, "define", TypeName(def.GetResultType()))
+		}
+	}
+	return comps
+}
+
+// operatorCompletions returns a completion for each built-in function, detailing all overloads.
+func operatorCompletions(ops map[string][][]types.IType) []Completion {
+	comps := make([]Completion, 0, len(ops))
+	for name, overloads := range ops {
+		sigs := make([]string, 0, len(overloads))
+		for _, operands := range overloads {
+			names := make([]string, 0, len(operands))
+			for _, o := range operands {
+				names = append(names, TypeName(o))
+			}
+			sigs = append(sigs, name+"("+strings.Join(names, ", ")+")")
+		}
+		sort.Strings(sigs)
+		comps = append(comps, Completion{Label: name, Kind: "operator", Detail: strings.Join(sigs, "\n")})
+	}
+	return comps
+}
+
+// filterCompletions returns the completions that start with prefix, ignoring case and quotes,
+// ordered by kind and label.
+func filterCompletions(comps []Completion, prefix string) []Completion {
+	p := strings.ToLower(strings.TrimPrefix(prefix, `"`))
+	out := []Completion{}
+	for _, c := range comps {
+		if strings.HasPrefix(strings.ToLower(strings.Trim(c.Label, `"`)), p) {
+			out = append(out, c)
+		}
+	}
+	kind := func(k string) int {
+		for i, ck := range completionKinds {
+			if ck == k {
+				return i
+			}
+		}
+		return len(completionKinds)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return kind(out[i].Kind) < kind(out[j].Kind)
+		}
+		return out[i].Label < out[j].Label
+	})
+	return out
+}
+
+// plainIdentifier matches identifiers that do not need quotes.
+var plainIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// QuoteIdentifier returns the name as a CQL identifier, which is quoted if it is not a plain
+// identifier.
+func QuoteIdentifier(name string) string {
+	if plainIdentifier.MatchString(name) {
+		return name
+	}
+	return `"` + name + `"`
+}
+
+// TypeName returns the name of the type as written in CQL, for example FHIR.Observation.
+func TypeName(t types.IType) string {
+	if t == nil {
+		return ""
+	}
+	if name, err := t.ModelInfoName(); err == nil {
+		return name
+	}
+	return t.String()
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package editing
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		name       string
+		sources    []string
+		source     int
+		line       int
+		column     int
+		wantPrefix string
+		wantLabels []string
+	}{
+		{
+			name: "Declarations while typing",
+			sources: []string{strings.Join([]string{
+				"library Explore version '1.2.3'",
+				"using FHIR version '4.0.1'",
+				"valueset \"Glucose\": 'https://example.com/vs/glucose'",
+				"context Patient",
+				"define \"Glucose Readings\": [Observation: \"Glucose\"]",
+				"define Latest: Glu",
+			}, "\n")},
+			line:       6,
+			column:     18,
+			wantPrefix: "Glu",
+			wantLabels: []string{`"Glucose Readings"`, "Glucose"},
+		},
+		{
+			name: "Properties of a query alias",
+			sources: []string{strings.Join([]string{
+				"library Explore version '1.2.3'",
+				"using FHIR version '4.0.1'",
+				"context Patient",
+				"define Final: [Observation] O where O.sta",
+			}, "\n")},
+			line:       4,
+			column:     41,
+			wantPrefix: "sta",
+			wantLabels: []string{"status"},
+		},
+		{
+			name: "Public declarations of an included library",
+			sources: []string{
+				"library Explore version '1.2.3'\ninclude Helpers version '1.0' called H\ndefine result: H.",
+				"library Helpers version '1.0'\ndefine One: 1\ndefine private Two: 2",
+			},
+			line:       3,
+			column:     17,
+			wantPrefix: "",
+			wantLabels: []string{"One"},
+		},
+		{
+			name: "Operators in a library tab",
+			sources: []string{
+				"library Explore version '1.2.3'",
+				"library Helpers version '1.0'\ndefine One: Coales",
+			},
+			source:     1,
+			line:       2,
+			column:     18,
+			wantPrefix: "Coales",
+			wantLabels: []string{"Coalesce"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Complete(context.Background(), tc.sources, tc.source, tc.line, tc.column)
+			if err != nil {
+				t.Fatalf("Complete() returned an unexpected error: %v", err)
+			}
+			if got.Prefix != tc.wantPrefix {
+				t.Errorf("Complete() returned prefix %q, want %q", got.Prefix, tc.wantPrefix)
+			}
+			var gotLabels []string
+			for _, c := range got.Completions {
+				gotLabels = append(gotLabels, c.Label)
+			}
+			if diff := cmp.Diff(tc.wantLabels, gotLabels); diff != "" {
+				t.Errorf("Complete() returned labels with a diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestComplete_OperatorSignatures(t *testing.T) {
+	got, err := Complete(context.Background(), []string{"define X: Coalesce"}, 0, 1, 18)
+	if err != nil {
+		t.Fatalf("Complete() returned an unexpected error: %v", err)
+	}
+	if len(got.Completions) != 1 || !strings.Contains(got.Completions[0].Detail, "Coalesce(List<System.Any>)") {
+		t.Errorf("Complete() = %+v, want the signatures of Coalesce", got.Completions)
+	}
+}
+
+func TestComplete_OutOfRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		source int
+		line   int
+	}{
+		{name: "Source", source: 1, line: 1},
+		{name: "Line", source: 0, line: 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Complete(context.Background(), []string{"define X: 1"}, tc.source, tc.line, 0); err == nil {
+				t.Errorf("Complete(source %d, line %d) succeeded, want an error", tc.source, tc.line)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package editing
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/google/cql/result"
+)
+
+// libraryDeclaration matches the library declaration of a CQL library, capturing the name and the
+// optional version.
+var libraryDeclaration = regexp.MustCompile(`(?m)^\s*library\s+("[^"]+"|[A-Za-z_][A-Za-z0-9_]*)(?:\s+version\s+'([^']*)')?`)
+
+// LibraryDeclaration returns the name and version declared by the library statement of the CQL
+// source, or false if the source has no library statement. Library statements inside comments are
+// ignored.
+func LibraryDeclaration(src string) (result.LibKey, bool) {
+	m := libraryDeclaration.FindStringSubmatch(stripComments(src))
+	if m == nil {
+		return result.LibKey{}, false
+	}
+	return result.LibKey{Name: strings.Trim(m[1], `"`), Version: m[2]}, true
+}
+
+// stripComments replaces the // and /* */ comments of the CQL source with spaces, keeping newlines
+// so that line anchored matches still apply. Comment markers inside strings and quoted identifiers
+// are left alone.
+func stripComments(src string) string {
+	b := []byte(src)
+	var quote byte
+	for i := 0; i < len(b); i++ {
+		switch {
+		case quote != 0:
+			if b[i] == '\\' {
+				i++
+			} else if b[i] == quote {
+				quote = 0
+			}
+		case b[i] == '\'' || b[i] == '"' || b[i] == '`':
+			quote = b[i]
+		case b[i] == '/' && i+1 < len(b) && b[i+1] == '/':
+			for ; i < len(b) && b[i] != '\n'; i++ {
+				b[i] = ' '
+			}
+		case b[i] == '/' && i+1 < len(b) && b[i+1] == '*':
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(b)
+			} else {
+				end += i + 4
+			}
+			for ; i < end; i++ {
+				if b[i] != '\n' {
+					b[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+	return string(b)
+}
+
+// SourceIndex returns the index of the source declaring the library, the source without a library
+// declaration if the library is unnamed, or -1.
+func SourceIndex(sources []string, key result.LibKey) int {
+	for i, src := range sources {
+		decl, ok := LibraryDeclaration(src)
+		if key.IsUnnamed && !ok {
+			return i
+		}
+		if ok && decl.Name == key.Name && decl.Version == key.Version {
+			return i
+		}
+	}
+	return -1
+}
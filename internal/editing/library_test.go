@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package editing
+
+import (
+	"testing"
+
+	"github.com/google/cql/result"
+)
+
+func TestLibraryDeclaration(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   result.LibKey
+		wantOK bool
+	}{
+		{
+			name:   "Versioned",
+			src:    "// A comment\nlibrary Explore version '1.2.3'\ndefine X: 1",
+			want:   result.LibKey{Name: "Explore", Version: "1.2.3"},
+			wantOK: true,
+		},
+		{
+			name:   "Quoted without version",
+			src:    `library "My Library"`,
+			want:   result.LibKey{Name: "My Library"},
+			wantOK: true,
+		},
+		{
+			name: "Unnamed",
+			src:  "define X: 1",
+		},
+		{
+			name:   "Declaration in block comment",
+			src:    "/* Replaces\nlibrary Old version '1'\n*/\nlibrary New version '2'",
+			want:   result.LibKey{Name: "New", Version: "2"},
+			wantOK: true,
+		},
+		{
+			name: "Only declaration is commented out",
+			src:  "/*\nlibrary Old version '1'\n*/\ndefine X: 1",
+		},
+		{
+			name: "Declaration in line comment",
+			src:  "// library Old version '1'\ndefine X: '/*'",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := LibraryDeclaration(tc.src)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("LibraryDeclaration(%q) = %v, %v, want %v, %v", tc.src, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestSourceIndex(t *testing.T) {
+	sources := []string{
+		"library Main version '1'\ninclude Helpers version '2'",
+		"define X: 1",
+		"library Helpers version '2'",
+	}
+	tests := []struct {
+		name string
+		key  result.LibKey
+		want int
+	}{
+		{name: "Main", key: result.LibKey{Name: "Main", Version: "1"}, want: 0},
+		{name: "Included", key: result.LibKey{Name: "Helpers", Version: "2"}, want: 2},
+		{name: "Unnamed", key: result.LibKey{Name: "Unnamed", IsUnnamed: true}, want: 1},
+		{name: "Wrong version", key: result.LibKey{Name: "Helpers", Version: "3"}, want: -1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := SourceIndex(sources, tc.key); got != tc.want {
+				t.Errorf("SourceIndex(%v) = %d, want %d", tc.key, got, tc.want)
+			}
+		})
+	}
+}
@@ -29,6 +29,9 @@ import (
 	"github.com/google/bulk_fhir_tools/gcs"
 )
 
+// MaxNDJSONLineSize is the largest resource that can be read from a line of an NDJSON file.
+const MaxNDJSONLineSize = 64 * 1024 * 1024
+
 // IOConfig contains configuration options for IO functions.
 type IOConfig struct {
 	GCSEndpoint string
@@ -36,11 +39,16 @@ type IOConfig struct {
 
 // FilesWithSuffix returns all file paths in a directory that end with a given suffix.
 func FilesWithSuffix(ctx context.Context, dir string, suffix string, cfg *IOConfig) ([]string, error) {
+	return FilesWithSuffixes(ctx, dir, []string{suffix}, cfg)
+}
+
+// FilesWithSuffixes returns all file paths in a directory that end with any of the given suffixes.
+func FilesWithSuffixes(ctx context.Context, dir string, suffixes []string, cfg *IOConfig) ([]string, error) {
 	if strings.HasPrefix(dir, "gs://") {
 		if cfg == nil {
 			return nil, fmt.Errorf("FilesWithSuffix() IOConfig cannot be nil for GCS paths, but was nil. path: %s", dir)
 		}
-		return filesWithSuffixGCS(ctx, dir, suffix, *cfg)
+		return filesWithSuffixGCS(ctx, dir, suffixes, *cfg)
 	}
 	files, err := os.ReadDir(dir)
 	if err != nil {
@@ -48,7 +56,7 @@ func FilesWithSuffix(ctx context.Context, dir string, suffix string, cfg *IOConf
 	}
 	filePaths := []string{}
 	for _, file := range files {
-		if file.IsDir() || !strings.HasSuffix(file.Name(), suffix) {
+		if file.IsDir() || !hasAnySuffix(file.Name(), suffixes) {
 			continue
 		}
 		filePaths = append(filePaths, filepath.Join(dir, file.Name()))
@@ -56,8 +64,17 @@ func FilesWithSuffix(ctx context.Context, dir string, suffix string, cfg *IOConf
 	return filePaths, nil
 }
 
-// filesWithSuffixGCS returns all file paths in a GCS bucket that end with a given suffix.
-func filesWithSuffixGCS(ctx context.Context, gcsPath, suffix string, cfg IOConfig) ([]string, error) {
+func hasAnySuffix(name string, suffixes []string) bool {
+	for _, s := range suffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filesWithSuffixGCS returns all file paths in a GCS bucket that end with any of the given suffixes.
+func filesWithSuffixGCS(ctx context.Context, gcsPath string, suffixes []string, cfg IOConfig) ([]string, error) {
 	filePaths := []string{}
 	bucket, path, err := gcs.PathComponents(gcsPath)
 	if err != nil {
@@ -83,7 +100,7 @@ func filesWithSuffixGCS(ctx context.Context, gcsPath, suffix string, cfg IOConfi
 		if err != nil {
 			return nil, err
 		}
-		if strings.HasSuffix(obj.Name, suffix) {
+		if hasAnySuffix(obj.Name, suffixes) {
 			filePaths = append(filePaths, "gs://"+bucket+"/"+obj.Name)
 		}
 	}
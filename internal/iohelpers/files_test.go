@@ -79,6 +79,24 @@ func TestFilesWithSuffix(t *testing.T) {
 	}
 }
 
+func TestFilesWithSuffixes(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"a.json", "b.json.gz", "c.zip", "d.txt", "e.json.zst"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("Hello World"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	want := []string{filepath.Join(dir, "a.json"), filepath.Join(dir, "b.json.gz"), filepath.Join(dir, "c.zip")}
+
+	got, err := FilesWithSuffixes(context.Background(), dir, []string{".json", ".json.gz", ".zip"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to get files: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("FilesWithSuffixes() returned an unexpected diff (-want +got): %v", diff)
+	}
+}
+
 func TestFilesWithSuffixGCS(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -255,6 +255,18 @@ func (r *Resolver[T, F]) DefineBuiltinFunc(name string, operands []types.IType,
 	return nil
 }
 
+// BuiltinFuncs returns the operand types of every overload of every built-in function, keyed by
+// function name.
+func (r *Resolver[T, F]) BuiltinFuncs() map[string][][]types.IType {
+	funcs := make(map[string][][]types.IType, len(r.builtinFuncs))
+	for name, overloads := range r.builtinFuncs {
+		for _, o := range overloads {
+			funcs[name] = append(funcs[name], o.Operands)
+		}
+	}
+	return funcs
+}
+
 // ResolveGlobal resolves a reference to a definition in an included CQL library.
 func (r *Resolver[T, F]) ResolveGlobal(libName string, defName string) (T, error) {
 	iKey := includeKey{localID: libName, includedBy: r.currLib}
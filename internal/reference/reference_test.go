@@ -629,6 +629,30 @@ func TestResolveIncludedLibrary(t *testing.T) {
 
 }
 
+func TestBuiltinFuncs(t *testing.T) {
+	r := NewResolver[model.IExpression, model.IExpression]()
+	if err := r.DefineBuiltinFunc("Foo", []types.IType{types.Integer}, &model.Last{}); err != nil {
+		t.Fatalf("DefineBuiltinFunc(Foo) unexpected err: %v", err)
+	}
+	if err := r.DefineBuiltinFunc("Foo", []types.IType{types.String, types.String}, &model.Last{}); err != nil {
+		t.Fatalf("DefineBuiltinFunc(Foo) unexpected err: %v", err)
+	}
+	// User defined functions are not built-in.
+	if err := r.SetCurrentLibrary(&model.LibraryIdentifier{Qualified: "lib", Version: "1.0"}); err != nil {
+		t.Fatalf("r.SetCurrentLibrary() unexpected err: %v", err)
+	}
+	if err := r.DefineFunc(&Func[model.IExpression]{Name: "Bar", Result: &model.Last{}, IsPublic: true}); err != nil {
+		t.Fatalf("r.DefineFunc(Bar) unexpected err: %v", err)
+	}
+
+	want := map[string][][]types.IType{
+		"Foo": {{types.Integer}, {types.String, types.String}},
+	}
+	if diff := cmp.Diff(want, r.BuiltinFuncs()); diff != "" {
+		t.Errorf("BuiltinFuncs() diff (-want +got):\n%s", diff)
+	}
+}
+
 func TestResolverErrors(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -17,8 +17,10 @@ package resourcewrapper
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/google/fhir/go/protopath"
+	d4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
 	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -57,6 +59,49 @@ func (m *ResourceWrapper) ResourceID() (string, error) {
 	return protopath.Get[string](msg, protopath.NewPath("id.value"))
 }
 
+// patientReferenceFields are the fields that reference the patient a resource belongs to, in the
+// order they are checked.
+var patientReferenceFields = []protoreflect.Name{"subject", "patient", "beneficiary"}
+
+// PatientID returns the id of the patient the resource belongs to: the id of a Patient, or the
+// patient referenced by the subject, patient or beneficiary of any other resource. Returns an error
+// if the resource does not reference a patient.
+func (m *ResourceWrapper) PatientID() (string, error) {
+	if m.Resource.GetPatient() != nil {
+		return m.ResourceID()
+	}
+	msg, err := m.ResourceMessageField()
+	if err != nil {
+		return "", err
+	}
+	rpb := msg.ProtoReflect()
+	for _, name := range patientReferenceFields {
+		fd := rpb.Descriptor().Fields().ByName(name)
+		if fd == nil || fd.Message() == nil || fd.IsList() || !rpb.Has(fd) {
+			continue
+		}
+		ref, ok := rpb.Get(fd).Message().Interface().(*d4pb.Reference)
+		if !ok {
+			continue
+		}
+		if id := ref.GetPatientId().GetValue(); id != "" {
+			return id, nil
+		}
+		// References that are not relative, for example absolute URLs, are kept as a uri.
+		if uri := ref.GetUri().GetValue(); strings.Contains(uri, "Patient/") {
+			id := uri[strings.LastIndex(uri, "Patient/")+len("Patient/"):]
+			if i := strings.Index(id, "/"); i >= 0 {
+				id = id[:i]
+			}
+			if id != "" {
+				return id, nil
+			}
+		}
+	}
+	rt, _ := m.ResourceType()
+	return "", fmt.Errorf("%s resource does not reference a patient", rt)
+}
+
 // ResourceMessageField returns the resource from within the ContainedResource.
 func (m *ResourceWrapper) ResourceMessageField() (proto.Message, error) {
 	if m.Resource == nil {
@@ -17,6 +17,9 @@ package resourcewrapper
 import (
 	"testing"
 
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+
 	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
 	r4patientpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
 )
@@ -59,3 +62,73 @@ func TestGetType(t *testing.T) {
 		})
 	}
 }
+
+func TestPatientID(t *testing.T) {
+	tests := []struct {
+		name      string
+		json      string
+		want      string
+		wantError bool
+	}{
+		{
+			name: "Patient",
+			json: `{"resourceType": "Patient", "id": "1"}`,
+			want: "1",
+		},
+		{
+			name: "Subject reference",
+			json: `{"resourceType": "Condition", "id": "c", "subject": {"reference": "Patient/2"}}`,
+			want: "2",
+		},
+		{
+			name: "Patient reference",
+			json: `{"resourceType": "AllergyIntolerance", "id": "a", "patient": {"reference": "Patient/3"}}`,
+			want: "3",
+		},
+		{
+			name: "Beneficiary reference",
+			json: `{"resourceType": "Coverage", "id": "c", "status": "active", "payor": [{"reference": "Organization/o"}], "beneficiary": {"reference": "Patient/4"}}`,
+			want: "4",
+		},
+		{
+			name: "Absolute reference",
+			json: `{"resourceType": "Condition", "id": "c", "subject": {"reference": "https://example.com/fhir/Patient/5/_history/1"}}`,
+			want: "5",
+		},
+		{
+			name:      "Subject is not a patient",
+			json:      `{"resourceType": "Condition", "id": "c", "subject": {"reference": "Group/6"}}`,
+			wantError: true,
+		},
+		{
+			name:      "No patient reference",
+			json:      `{"resourceType": "Organization", "id": "o"}`,
+			wantError: true,
+		},
+	}
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		t.Fatalf("jsonformat.NewUnmarshallerWithoutValidation() failed: %v", err)
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := unmarshaller.UnmarshalR4([]byte(tc.json))
+			if err != nil {
+				t.Fatalf("UnmarshalR4() returned unexpected error: %v", err)
+			}
+			got, err := New(r).PatientID()
+			if tc.wantError {
+				if err == nil {
+					t.Errorf("PatientID() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PatientID() returned unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("PatientID() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resultcolumns converts CQL results into the column values shared by the columnar result
+// writers, such as the Parquet and BigQuery writers.
+package resultcolumns
+
+import (
+	"encoding/json"
+
+	"github.com/google/cql/result"
+)
+
+// Quantity returns the value and unit columns of a Quantity. An empty unit is nil, so it is written
+// as null.
+func Quantity(q result.Quantity) map[string]any {
+	return map[string]any{"value": q.Value, "unit": OptionalString(string(q.Unit))}
+}
+
+// Code returns the system, version, code and display columns of a Code. Empty fields other than
+// the code are nil, so they are written as null.
+func Code(c result.Code) map[string]any {
+	return map[string]any{
+		"system":  OptionalString(c.System),
+		"version": OptionalString(c.Version),
+		"code":    c.Code,
+		"display": OptionalString(c.Display),
+	}
+}
+
+// JSON returns the JSON encoding of v, which is used for values that have no columnar
+// representation.
+func JSON(v result.Value) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// OptionalString returns nil for an empty string, so it is written as null.
+func OptionalString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
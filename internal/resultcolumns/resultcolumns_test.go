@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resultcolumns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQuantity(t *testing.T) {
+	tests := []struct {
+		name string
+		q    result.Quantity
+		want map[string]any
+	}{
+		{
+			name: "With unit",
+			q:    result.Quantity{Value: 70.5, Unit: "kg"},
+			want: map[string]any{"value": 70.5, "unit": "kg"},
+		},
+		{
+			name: "Without unit",
+			q:    result.Quantity{Value: 3},
+			want: map[string]any{"value": 3.0, "unit": nil},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, Quantity(tc.q)); diff != "" {
+				t.Errorf("Quantity(%v) diff (-want +got):\n%s", tc.q, diff)
+			}
+		})
+	}
+}
+
+func TestCode(t *testing.T) {
+	c := result.Code{System: "http://loinc.org", Code: "1234-5"}
+	want := map[string]any{"system": "http://loinc.org", "version": nil, "code": "1234-5", "display": nil}
+	if diff := cmp.Diff(want, Code(c)); diff != "" {
+		t.Errorf("Code(%v) diff (-want +got):\n%s", c, diff)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	v, err := result.New(result.Date{Date: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY})
+	if err != nil {
+		t.Fatalf("result.New() returned unexpected error: %v", err)
+	}
+	got, err := JSON(v)
+	if err != nil {
+		t.Fatalf("JSON() returned unexpected error: %v", err)
+	}
+	if want := `{"@type":"System.Date","value":"@2024-03-01"}`; got != want {
+		t.Errorf("JSON() = %s, want %s", got, want)
+	}
+}
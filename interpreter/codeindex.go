@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interpreter
+
+import (
+	"fmt"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/terminology"
+	"github.com/google/cql/types"
+)
+
+// codeIndexKey uniquely identifies a code within a codeIndex. Code.Display is ignored for
+// membership.
+type codeIndexKey struct {
+	system string
+	code   string
+}
+
+// codeIndex is a hash set of codes. It allows membership checks against large lists of codes to be
+// O(1) per code, instead of a linear scan per code. ValueSet membership is checked by the
+// terminology provider, which already indexes the codes of its ValueSets.
+type codeIndex map[codeIndexKey]struct{}
+
+func newCodeIndex(codes []terminology.Code) codeIndex {
+	idx := make(codeIndex, len(codes))
+	for _, c := range codes {
+		idx[codeIndexKey{system: c.System, code: c.Code}] = struct{}{}
+	}
+	return idx
+}
+
+// containsAny returns true if any of the codes is in the index.
+func (idx codeIndex) containsAny(codes []terminology.Code) bool {
+	for _, c := range codes {
+		if _, ok := idx[codeIndexKey{system: c.System, code: c.Code}]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// retrieveCodeFilter filters retrieved resources on the codes of the Retrieve's terminology, which
+// is evaluated and indexed once per Retrieve rather than once per resource.
+type retrieveCodeFilter struct {
+	// valueSet is set if the terminology is a ValueSet.
+	valueSet *result.ValueSet
+	// codes is set if the terminology is a Code, Concept, or list of them.
+	codes codeIndex
+}
+
+func (i *interpreter) newRetrieveCodeFilter(codesExpr model.IExpression) (*retrieveCodeFilter, error) {
+	codesObj, err := i.evalExpression(codesExpr)
+	if err != nil {
+		return nil, err
+	}
+	if result.IsNull(codesObj) {
+		return &retrieveCodeFilter{codes: codeIndex{}}, nil
+	}
+	if codesObj.RuntimeType().Equal(types.ValueSet) {
+		vs, err := result.ToValueSet(codesObj)
+		if err != nil {
+			return nil, err
+		}
+		return &retrieveCodeFilter{valueSet: &vs}, nil
+	}
+	codes, err := valueToCodes(codesObj)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve terminology must be a ValueSet, Code, Concept or list of Codes or Concepts: %w", err)
+	}
+	return &retrieveCodeFilter{codes: newCodeIndex(codes)}, nil
+}
+
+// retrieveCodeFilterMatches returns, for each set of codes, whether any of its codes is in the
+// filter's terminology.
+func (i *interpreter) retrieveCodeFilterMatches(f *retrieveCodeFilter, codeSets [][]terminology.Code) ([]bool, error) {
+	if f.valueSet != nil {
+		// All resources of the Retrieve are checked in a single terminology provider call.
+		return i.terminologyProvider.AnyInValueSetBatch(codeSets, f.valueSet.ID, f.valueSet.Version)
+	}
+	in := make([]bool, len(codeSets))
+	for j, codes := range codeSets {
+		in[j] = f.codes.containsAny(codes)
+	}
+	return in, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interpreter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/cql/result"
+	"github.com/google/cql/terminology"
+	"github.com/google/go-cmp/cmp"
+)
+
+// countingProvider is a terminology.Provider that counts the calls made to it.
+type countingProvider struct {
+	terminology.Provider
+	expandCalls  int
+	anyInVSCalls int
+	batchCalls   int
+}
+
+func (p *countingProvider) ExpandValueSet(url, version string) ([]*terminology.Code, error) {
+	p.expandCalls++
+	return p.Provider.ExpandValueSet(url, version)
+}
+
+func (p *countingProvider) AnyInValueSet(codes []terminology.Code, url, version string) (bool, error) {
+	p.anyInVSCalls++
+	return p.Provider.AnyInValueSet(codes, url, version)
+}
+
+func (p *countingProvider) AnyInValueSetBatch(codeSets [][]terminology.Code, url, version string) ([]bool, error) {
+	p.batchCalls++
+	return p.Provider.AnyInValueSetBatch(codeSets, url, version)
+}
+
+func TestRetrieveCodeFilterMatches(t *testing.T) {
+	codeSets := [][]terminology.Code{
+		{{System: "http://example.com", Code: "15074-8"}},
+		{{System: "http://example.com", Code: "other"}},
+		nil,
+		{{System: "https://example.com/other", Code: "1"}, {System: "http://example.com", Code: "15074-8"}},
+	}
+	want := []bool{true, false, false, true}
+
+	t.Run("ValueSet", func(t *testing.T) {
+		p := &countingProvider{Provider: getTerminologyProvider(t)}
+		i := &interpreter{terminologyProvider: p}
+		got, err := i.retrieveCodeFilterMatches(&retrieveCodeFilter{valueSet: &result.ValueSet{ID: "https://example.com/glucose"}}, codeSets)
+		if err != nil {
+			t.Fatalf("retrieveCodeFilterMatches() returned unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("retrieveCodeFilterMatches() diff (-want +got):\n%s", diff)
+		}
+		// The ValueSet is not expanded, and all resources are checked in a single provider call.
+		if p.expandCalls != 0 || p.anyInVSCalls != 0 || p.batchCalls != 1 {
+			t.Errorf("retrieveCodeFilterMatches() made %d ExpandValueSet, %d AnyInValueSet and %d AnyInValueSetBatch calls, want 0, 0 and 1", p.expandCalls, p.anyInVSCalls, p.batchCalls)
+		}
+	})
+
+	t.Run("Codes", func(t *testing.T) {
+		i := &interpreter{}
+		f := &retrieveCodeFilter{codes: newCodeIndex([]terminology.Code{{System: "http://example.com", Code: "15074-8", Display: "ignored"}})}
+		got, err := i.retrieveCodeFilterMatches(f, codeSets)
+		if err != nil {
+			t.Fatalf("retrieveCodeFilterMatches() returned unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("retrieveCodeFilterMatches() diff (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestRetrieveCodeFilterMatches_MissingValueSet(t *testing.T) {
+	i := &interpreter{terminologyProvider: getTerminologyProvider(t)}
+	f := &retrieveCodeFilter{valueSet: &result.ValueSet{ID: "https://example.com/vs/missing"}}
+	_, err := i.retrieveCodeFilterMatches(f, [][]terminology.Code{{{System: "s", Code: "c"}}})
+	if !errors.Is(err, terminology.ErrResourceNotLoaded) {
+		t.Errorf("retrieveCodeFilterMatches() for a missing ValueSet returned error %v, want %v", err, terminology.ErrResourceNotLoaded)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interpreter
+
+import (
+	"context"
+
+	"github.com/google/cql/internal/convert"
+	"github.com/google/cql/internal/modelinfo"
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+)
+
+// Program is CQL compiled for repeated evaluation, like evaluating the same measure for every
+// patient of a population. Eval interprets the model by switching on the type of every expression
+// it evaluates and by matching the overload of every operator against its operand types, each time
+// the expression is evaluated. Compile does that work once and binds each expression to a Go
+// closure, so Program.Eval only runs the closures.
+//
+// A Program must not be used by multiple goroutines at the same time.
+type Program struct {
+	libs       []*model.Library
+	dataModels *modelinfo.ModelInfos
+	// i is the interpreter the closures are bound to. It is reset for every evaluation.
+	i        *interpreter
+	compiled map[model.IExpression]compiledExpr
+}
+
+// compiledExpr evaluates a compiled expression with the interpreter of its Program.
+type compiledExpr func() (result.Value, error)
+
+// Compile compiles the parsed libraries for evaluation with Program.Eval. libs must be sorted so
+// that every library comes after the libraries it includes, as returned by the parser.
+func Compile(libs []*model.Library, dataModels *modelinfo.ModelInfos) (*Program, error) {
+	p := &Program{
+		libs:       libs,
+		dataModels: dataModels,
+		i:          newInterpreter(libs, Config{DataModels: dataModels}),
+		compiled:   make(map[model.IExpression]compiledExpr),
+	}
+	for _, lib := range libs {
+		// Overloads are matched against the data model of the library, like in evalLibrary.
+		for _, using := range lib.Usings {
+			if err := dataModels.SetUsing(modelinfo.Key{Name: using.LocalIdentifier, Version: using.Version}); err != nil {
+				return nil, err
+			}
+		}
+		model.Walk(lib, func(e model.IExpression) bool {
+			p.compile(e)
+			return true
+		})
+	}
+	return p, nil
+}
+
+// Eval evaluates the compiled libraries like Eval. config.DataModels is ignored in favour of the
+// data models the Program was compiled with. In debug mode, when config.DebugLocators is set, the
+// libraries are interpreted since every evaluated expression must be traced.
+func (p *Program) Eval(ctx context.Context, config Config) (result.Libraries, error) {
+	config.DataModels = p.dataModels
+	if config.DebugLocators != nil {
+		return Eval(ctx, p.libs, config)
+	}
+	*p.i = *newInterpreter(p.libs, config)
+	p.i.compiled = p.compiled
+	// Do not hold on to the data of this evaluation once it is done.
+	defer func() { *p.i = interpreter{modelInfo: p.dataModels} }()
+	return p.i.evalLibraries(p.libs, config)
+}
+
+// compile returns the closure of e, compiling it if it has not been compiled yet. Expressions
+// shared by several parents are only compiled once.
+func (p *Program) compile(e model.IExpression) compiledExpr {
+	if c, ok := p.compiled[e]; ok {
+		return c
+	}
+	c := p.compileNode(e)
+	p.compiled[e] = c
+	return c
+}
+
+// compileNode mirrors evalExpressionNode, so the type switch only runs at compile time.
+func (p *Program) compileNode(e model.IExpression) compiledExpr {
+	i := p.i
+	switch e := e.(type) {
+	case *model.Literal:
+		return p.compileLiteral(e)
+	case *model.Quantity:
+		return func() (result.Value, error) { return i.evalQuantity(e) }
+	case *model.Ratio:
+		return func() (result.Value, error) { return i.evalRatio(e) }
+	case *model.List:
+		return func() (result.Value, error) { return i.evalList(e) }
+	case *model.Code:
+		return func() (result.Value, error) { return i.evalCode(e) }
+	case model.IUnaryExpression:
+		return p.compileUnaryExpression(e)
+	case model.IBinaryExpression:
+		return p.compileBinaryExpression(e)
+	case model.INaryExpression:
+		return p.compileNaryExpression(e)
+	case *model.Retrieve:
+		return func() (result.Value, error) { return i.evalRetrieve(e) }
+	case *model.Property:
+		return func() (result.Value, error) { return i.evalProperty(e) }
+	case *model.Query:
+		return func() (result.Value, error) { return i.evalQuery(e) }
+	case *model.QueryLetRef:
+		return func() (result.Value, error) { return i.evalQueryLetRef(e) }
+	case *model.AliasRef:
+		return func() (result.Value, error) { return i.evalAliasRef(e) }
+	case *model.IdentifierRef:
+		return func() (result.Value, error) { return i.evalIdentifierRef(e) }
+	case *model.CodeSystemRef:
+		return func() (result.Value, error) { return i.evalCodeSystemRef(e) }
+	case *model.ValuesetRef:
+		return func() (result.Value, error) { return i.evalValuesetRef(e) }
+	case *model.ParameterRef:
+		return func() (result.Value, error) { return i.evalParameterRef(e) }
+	case *model.CodeRef:
+		return func() (result.Value, error) { return i.evalCodeRef(e) }
+	case *model.ConceptRef:
+		return func() (result.Value, error) { return i.evalConceptRef(e) }
+	case *model.ExpressionRef:
+		return func() (result.Value, error) { return i.evalExpressionRef(e) }
+	case *model.Interval:
+		return func() (result.Value, error) { return i.evalInterval(e) }
+	case *model.FunctionRef:
+		return func() (result.Value, error) { return i.evalFunctionRef(e) }
+	case *model.OperandRef:
+		return func() (result.Value, error) { return i.evalOperandRef(e) }
+	case *model.Tuple:
+		return func() (result.Value, error) { return i.evalTuple(e) }
+	case *model.Instance:
+		return func() (result.Value, error) { return i.evalInstance(e) }
+	case *model.IfThenElse:
+		return func() (result.Value, error) { return i.evalIfThenElse(e) }
+	case *model.Case:
+		return func() (result.Value, error) { return i.evalCase(e) }
+	case *model.MaxValue:
+		return func() (result.Value, error) { return i.evalMaxValue(e) }
+	case *model.MinValue:
+		return func() (result.Value, error) { return i.evalMinValue(e) }
+	case *model.Message:
+		return func() (result.Value, error) { return i.evalMessage(e) }
+	}
+	return p.interpret(e)
+}
+
+// interpret returns a closure that interprets e, for expressions that cannot be compiled. Errors
+// like an unsupported expression or an unresolved overload are reported when e is evaluated, as
+// they would be without compilation.
+func (p *Program) interpret(e model.IExpression) compiledExpr {
+	i := p.i
+	return func() (result.Value, error) { return i.evalExpressionNode(e) }
+}
+
+// compileLiteral parses the literal once. Date and time literals are parsed in the location of the
+// evaluation timestamp, so they are parsed on every evaluation.
+func (p *Program) compileLiteral(l *model.Literal) compiledExpr {
+	switch l.GetResultType() {
+	case types.Integer, types.Long, types.Decimal, types.Boolean, types.String, types.Any:
+		v, err := p.i.evalLiteral(l)
+		if err != nil {
+			return p.interpret(l)
+		}
+		return func() (result.Value, error) { return v, nil }
+	}
+	return p.interpret(l)
+}
+
+// compileUnaryExpression matches the overload of m once, instead of on every evaluation like
+// evalUnaryExpression. Expressions without a matching overload are interpreted.
+func (p *Program) compileUnaryExpression(m model.IUnaryExpression) compiledExpr {
+	if m.GetOperand() == nil {
+		return p.interpret(m)
+	}
+	overloads, err := p.i.unaryOverloads(m)
+	if err != nil {
+		return p.interpret(m)
+	}
+	evalFunc, err := convert.ExactOverloadMatch[evalUnarySignature]([]types.IType{m.GetOperand().GetResultType()}, overloads, p.dataModels, m.GetName())
+	if err != nil {
+		return p.interpret(m)
+	}
+	operand := p.compile(m.GetOperand())
+	return func() (result.Value, error) {
+		o, err := operand()
+		if err != nil {
+			return result.Value{}, err
+		}
+		res, err := evalFunc(m, o)
+		if err != nil {
+			return result.Value{}, err
+		}
+		return res.WithSources(m, o), nil
+	}
+}
+
+func (p *Program) compileBinaryExpression(m model.IBinaryExpression) compiledExpr {
+	if m.Left() == nil || m.Right() == nil {
+		return p.interpret(m)
+	}
+	overloads, err := p.i.binaryOverloads(m)
+	if err != nil {
+		return p.interpret(m)
+	}
+	evalFunc, err := convert.ExactOverloadMatch[evalBinarySignature]([]types.IType{m.Left().GetResultType(), m.Right().GetResultType()}, overloads, p.dataModels, m.GetName())
+	if err != nil {
+		return p.interpret(m)
+	}
+	left, right := p.compile(m.Left()), p.compile(m.Right())
+	return func() (result.Value, error) {
+		l, err := left()
+		if err != nil {
+			return result.Value{}, err
+		}
+		r, err := right()
+		if err != nil {
+			return result.Value{}, err
+		}
+		res, err := evalFunc(m, l, r)
+		if err != nil {
+			return result.Value{}, err
+		}
+		return res.WithSources(m, l, r), nil
+	}
+}
+
+func (p *Program) compileNaryExpression(m model.INaryExpression) compiledExpr {
+	for _, operand := range m.GetOperands() {
+		if operand == nil {
+			return p.interpret(m)
+		}
+	}
+	overloads, err := p.i.naryOverloads(m)
+	if err != nil {
+		return p.interpret(m)
+	}
+	evalFunc, err := convert.ExactOverloadMatch(convert.OperandsToTypes(m.GetOperands()), overloads, p.dataModels, m.GetName())
+	if err != nil {
+		return p.interpret(m)
+	}
+	operands := make([]compiledExpr, len(m.GetOperands()))
+	for idx, operand := range m.GetOperands() {
+		operands[idx] = p.compile(operand)
+	}
+	return func() (result.Value, error) {
+		evalOps := make([]result.Value, len(operands))
+		for idx, operand := range operands {
+			o, err := operand()
+			if err != nil {
+				return result.Value{}, err
+			}
+			evalOps[idx] = o
+		}
+		res, err := evalFunc(m, evalOps)
+		if err != nil {
+			return result.Value{}, err
+		}
+		return res.WithSources(m, evalOps...), nil
+	}
+}
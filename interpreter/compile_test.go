@@ -0,0 +1,186 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interpreter
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProgram_Eval(t *testing.T) {
+	integer := func(v string) *model.Literal {
+		return &model.Literal{Value: v, Expression: model.ResultType(types.Integer)}
+	}
+	str := func(v string) *model.Literal {
+		return &model.Literal{Value: v, Expression: model.ResultType(types.String)}
+	}
+	tests := []struct {
+		name string
+		expr model.IExpression
+	}{
+		{
+			name: "Literal",
+			expr: integer("4"),
+		},
+		{
+			name: "Null literal",
+			expr: &model.Literal{Value: "null", Expression: model.ResultType(types.Any)},
+		},
+		{
+			name: "DateTime literal",
+			expr: &model.Literal{Value: "@2024-02-03T04:05:06", Expression: model.ResultType(types.DateTime)},
+		},
+		{
+			name: "Unary and binary operators",
+			expr: &model.Add{BinaryExpression: &model.BinaryExpression{
+				Operands: []model.IExpression{
+					integer("1"),
+					&model.Negate{UnaryExpression: &model.UnaryExpression{Operand: integer("2"), Expression: model.ResultType(types.Integer)}},
+				},
+				Expression: model.ResultType(types.Integer),
+			}},
+		},
+		{
+			name: "Nary operator",
+			expr: &model.Concatenate{NaryExpression: &model.NaryExpression{
+				Operands:   []model.IExpression{str("a"), str("b")},
+				Expression: model.ResultType(types.String),
+			}},
+		},
+		{
+			name: "Operator of an interpreter method",
+			expr: &model.Count{UnaryExpression: &model.UnaryExpression{
+				Operand: &model.List{
+					List:       []model.IExpression{integer("1"), integer("2")},
+					Expression: model.ResultType(&types.List{ElementType: types.Integer}),
+				},
+				Expression: model.ResultType(types.Integer),
+			}},
+		},
+		{
+			name: "Retrieve",
+			expr: &model.Retrieve{
+				DataType:   "{http://hl7.org/fhir}Observation",
+				TemplateID: "http://hl7.org/fhir/StructureDefinition/Observation",
+				Expression: model.ResultType(&types.List{ElementType: &types.Named{TypeName: "FHIR.Observation"}}),
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			libs := []*model.Library{wrapInLib(t, tc.expr)}
+			config := defaultInterpreterConfig(t)
+			want, err := Eval(context.Background(), libs, config)
+			if err != nil {
+				t.Fatalf("Eval() returned unexpected error: %v", err)
+			}
+
+			p, err := Compile(libs, config.DataModels)
+			if err != nil {
+				t.Fatalf("Compile() returned unexpected error: %v", err)
+			}
+			// A Program is evaluated many times, so check that no evaluation affects the next.
+			for n := 0; n < 2; n++ {
+				got, err := p.Eval(context.Background(), config)
+				if err != nil {
+					t.Fatalf("Program.Eval() returned unexpected error: %v", err)
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("Program.Eval() returned diff (-want +got):\n%s", diff)
+				}
+				gotResult := got[result.LibKey{Name: "TESTLIB", Version: "1.0.0"}]["TESTRESULT"]
+				if gotResult.SourceExpression() != tc.expr {
+					t.Errorf("Program.Eval() SourceExpression() = %v, want %v", gotResult.SourceExpression(), tc.expr)
+				}
+			}
+		})
+	}
+}
+
+func TestProgram_EvalError(t *testing.T) {
+	// There is no Add(String, Integer) overload. Compile leaves the expression to the interpreter so
+	// the error is returned by Eval, as without compilation.
+	expr := &model.Add{BinaryExpression: &model.BinaryExpression{
+		Operands: []model.IExpression{
+			&model.Literal{Value: "a", Expression: model.ResultType(types.String)},
+			&model.Literal{Value: "1", Expression: model.ResultType(types.Integer)},
+		},
+		Expression: model.ResultType(types.Integer),
+	}}
+	libs := []*model.Library{wrapInLib(t, expr)}
+	config := defaultInterpreterConfig(t)
+	p, err := Compile(libs, config.DataModels)
+	if err != nil {
+		t.Fatalf("Compile() returned unexpected error: %v", err)
+	}
+	_, err = p.Eval(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "could not resolve Add(System.String, System.Integer)") {
+		t.Errorf("Program.Eval() returned error %v, want could not resolve Add(System.String, System.Integer)", err)
+	}
+}
+
+func TestProgram_EvalTimestampLocation(t *testing.T) {
+	// Date and time literals without an offset are in the location of the evaluation timestamp, which
+	// can change between evaluations of the same Program.
+	libs := []*model.Library{wrapInLib(t, &model.Literal{Value: "@2024-02-03T04:05:06", Expression: model.ResultType(types.DateTime)})}
+	config := defaultInterpreterConfig(t)
+	p, err := Compile(libs, config.DataModels)
+	if err != nil {
+		t.Fatalf("Compile() returned unexpected error: %v", err)
+	}
+	for _, loc := range []*time.Location{time.UTC, time.FixedZone("Fixed", -5*60*60)} {
+		config.EvaluationTimestamp = time.Date(2024, 1, 1, 0, 0, 0, 0, loc)
+		got, err := p.Eval(context.Background(), config)
+		if err != nil {
+			t.Fatalf("Program.Eval() returned unexpected error: %v", err)
+		}
+		dt, err := result.ToDateTime(got[result.LibKey{Name: "TESTLIB", Version: "1.0.0"}]["TESTRESULT"])
+		if err != nil {
+			t.Fatalf("ToDateTime() returned unexpected error: %v", err)
+		}
+		if dt.Date.Location() != loc {
+			t.Errorf("Program.Eval() returned a DateTime in %v, want %v", dt.Date.Location(), loc)
+		}
+	}
+}
+
+func TestProgram_EvalDebug(t *testing.T) {
+	lit := &model.Literal{Value: "1", Expression: model.ResultType(types.Integer)}
+	libs := []*model.Library{wrapInLib(t, lit)}
+	config := defaultInterpreterConfig(t)
+	p, err := Compile(libs, config.DataModels)
+	if err != nil {
+		t.Fatalf("Compile() returned unexpected error: %v", err)
+	}
+	loc := result.Locator{Library: result.LibKey{Name: "TESTLIB", Version: "1.0.0"}, StartLine: 1, StartCol: 1, EndLine: 1, EndCol: 1}
+	config.DebugLocators = map[model.IExpression]result.Locator{lit: loc}
+	got, err := p.Eval(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Program.Eval() returned unexpected error: %v", err)
+	}
+
+	// In debug mode the Program is interpreted, which traces every evaluated expression.
+	trace, ok := got[result.LibKey{Name: "TESTLIB", Version: "1.0.0"}]["TESTRESULT"].DebugTrace()
+	if !ok || len(trace) != 1 || trace[0].Locator != loc {
+		t.Errorf("Program.Eval() DebugTrace() = %v, %v, want a single step at %v", trace, ok, loc)
+	}
+}
@@ -18,11 +18,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/google/cql/model"
 	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
 	"github.com/google/cql/terminology"
 	"github.com/google/cql/types"
 	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
@@ -32,6 +35,23 @@ import (
 )
 
 func (i *interpreter) evalExpression(elem model.IExpression) (result.Value, error) {
+	if i.debugLocators == nil {
+		if c, ok := i.compiled[elem]; ok {
+			return c()
+		}
+		return i.evalExpressionNode(elem)
+	}
+	res, err := i.evalExpressionNode(elem)
+	if err != nil {
+		return result.Value{}, err
+	}
+	if loc, ok := i.debugLocators[elem]; ok {
+		i.trace = append(i.trace, result.DebugStep{Locator: loc, Value: res})
+	}
+	return res, nil
+}
+
+func (i *interpreter) evalExpressionNode(elem model.IExpression) (result.Value, error) {
 	switch elem := elem.(type) {
 	case *model.Literal:
 		return i.evalLiteral(elem)
@@ -154,8 +174,10 @@ func (i *interpreter) evalMessage(m *model.Message) (result.Value, error) {
 
 	// TODO b/301606416: Add support for model.TRACE.
 
+	// Messages are logged to stderr, so that they do not mix with the output of programs that write
+	// results or protocols to stdout.
 	outString := fmt.Sprintf("%s %s: %s", severity, codeVal, messageVal)
-	fmt.Println(outString)
+	fmt.Fprintln(os.Stderr, outString)
 	if severity == model.ERROR {
 		errMsg := fmt.Sprintf("log error - Message with severity of type `Error` was called with message: %s", outString)
 		return source, errors.New(errMsg)
@@ -175,10 +197,6 @@ func (i *interpreter) evalRetrieve(expr *model.Retrieve) (result.Value, error) {
 	if len(name) != 2 {
 		return result.Value{}, fmt.Errorf("Resource datatype (%s) did not contain the library uri (%s)", expr.DataType, url)
 	}
-	got, err := i.retriever.Retrieve(context.Background(), name[1])
-	if err != nil {
-		return result.Value{}, err
-	}
 
 	// Assume the retrieve result type should be a list:
 	listResultType, ok := expr.ResultType.(*types.List)
@@ -190,7 +208,48 @@ func (i *interpreter) evalRetrieve(expr *model.Retrieve) (result.Value, error) {
 		return result.Value{}, fmt.Errorf("internal error - retrieve result type should be a list of named types, got %v", listResultType)
 	}
 
+	var codeFilter *retrieveCodeFilter
+	if expr.Codes != nil {
+		// We must try to filter on the codes provided.
+		if expr.CodeProperty == "" {
+			return result.Value{}, fmt.Errorf("code property must be populated when filtering on codes")
+		}
+		codeFilter, err = i.newRetrieveCodeFilter(expr.Codes)
+		if err != nil {
+			return result.Value{}, err
+		}
+	}
+
+	var filter retriever.Filter
+	fr, filtered := i.retriever.(retriever.FilteredRetriever)
+	if filtered {
+		filter = i.retrieveFilter(expr, codeFilter)
+	}
+
+	// Identical retrieves share the resources of the first one, so the retriever and terminology
+	// provider are only called once for them.
+	key, cacheable := retrieveKey(expr, codeFilter, filter.DateFilter)
+	if cacheable {
+		if l, ok := i.retrieveCache[key]; ok {
+			return result.NewWithSources(result.List{Value: l, StaticType: listResultType}, expr, l...)
+		}
+	}
+
+	i.retrieves++
+	var got []*r4pb.ContainedResource
+	if filtered {
+		got, err = fr.RetrieveFiltered(context.Background(), name[1], filter)
+	} else {
+		got, err = i.retriever.Retrieve(context.Background(), name[1])
+	}
+	if err != nil {
+		return result.Value{}, err
+	}
+
 	l := []result.Value{}
+	// candidates and candidateCodes are the resources with codes to filter, and their codes.
+	var candidates []result.Value
+	var candidateCodes [][]terminology.Code
 	for _, c := range got {
 		r, err := unwrapContained(c)
 		if err != nil {
@@ -201,79 +260,158 @@ func (i *interpreter) evalRetrieve(expr *model.Retrieve) (result.Value, error) {
 			return result.Value{}, err
 		}
 
-		if expr.Codes != nil {
-			// We must try to filter on the codes provided.
-			if expr.CodeProperty == "" {
-				return result.Value{}, fmt.Errorf("code property must be populated when filtering on codes")
-			}
-			propertyType, err := i.modelInfo.PropertyTypeSpecifier(msg.RuntimeType(), expr.CodeProperty)
-			if err != nil {
-				return result.Value{}, err
-			}
-			cc, err := i.valueProperty(msg, expr.CodeProperty, propertyType)
-			if err != nil {
-				return result.Value{}, err
-			}
-			// If this isn't a codeableConcept, this will result in an error.
-			in, err := i.inValueSet(cc, expr.Codes)
-			if err != nil {
-				return result.Value{}, err
-			}
-			if in {
-				l = append(l, msg)
-			}
-		} else {
+		if codeFilter == nil {
 			// If no code filtering, always add to the result set.
 			l = append(l, msg)
+			continue
 		}
+		propertyType, err := i.modelInfo.PropertyTypeSpecifier(msg.RuntimeType(), expr.CodeProperty)
+		if err != nil {
+			return result.Value{}, err
+		}
+		cc, err := i.valueProperty(msg, expr.CodeProperty, propertyType)
+		if err != nil {
+			return result.Value{}, err
+		}
+		// If this isn't a codeableConcept, this will result in an error.
+		codes, err := codeableConceptCodes(cc)
+		if err != nil {
+			return result.Value{}, err
+		}
+		if len(codes) > 0 {
+			candidates = append(candidates, msg)
+			candidateCodes = append(candidateCodes, codes)
+		}
+	}
 
+	if len(candidates) > 0 {
+		// All candidates are checked together, so a remote terminology provider is called at most once.
+		in, err := i.retrieveCodeFilterMatches(codeFilter, candidateCodes)
+		if err != nil {
+			return result.Value{}, err
+		}
+		for j, msg := range candidates {
+			if in[j] {
+				l = append(l, msg)
+			}
+		}
+	}
+	if cacheable {
+		i.retrieveCache[key] = l
 	}
 	// TODO(b/311222838): Currently only adding matched items as support,
 	// but should confirm this meets use case needs.
 	return result.NewWithSources(result.List{Value: l, StaticType: listResultType}, expr, l...)
 }
 
-func (i *interpreter) inValueSet(codeableConcept result.Value, codes model.IExpression) (bool, error) {
-	if result.IsNull(codeableConcept) {
-		return false, nil
+// retrieveKey returns the key under which the resources of the Retrieve are cached for the
+// duration of the evaluation. Only retrieves without terminology or filtered on a ValueSet are
+// cached; retrieves filtered on codes or concepts return false.
+func retrieveKey(expr *model.Retrieve, f *retrieveCodeFilter, df *retriever.DateFilter) (string, bool) {
+	key := strings.Join([]string{expr.DataType, expr.TemplateID, expr.CodeProperty}, "|")
+	if df != nil {
+		key += "|" + df.Property + "|" + df.Start.String() + "|" + df.End.String()
 	}
-
-	vr, ok := codes.(*model.ValuesetRef)
-	if !ok {
-		return false, fmt.Errorf("only ValueSet references are currently supported for valueset filtering")
+	if f == nil {
+		return key, true
 	}
-
-	protoVal, ok := codeableConcept.GolangValue().(result.Named)
-	if !ok {
-		return false, fmt.Errorf("internal error -- inValueSet: the input Value must be a result.Named. got: %s", reflect.ValueOf(codeableConcept).Type())
+	if f.valueSet == nil {
+		return "", false
 	}
-	ccPB, ok := protoVal.Value.(*dtpb.CodeableConcept)
-	if !ok {
-		return false, fmt.Errorf("internal error -- the input proto Value must be a *dtpb.CodeableConcept type. got: %s", reflect.ValueOf(codeableConcept).Type())
+	key += "|" + f.valueSet.ID + "|" + f.valueSet.Version
+	for _, cs := range f.valueSet.CodeSystems {
+		key += "|" + cs.ID + "|" + cs.Version
 	}
+	return key, true
+}
 
-	vs, err := i.evalValuesetRef(vr)
+// retrieveFilter returns the filter passed to a retriever.FilteredRetriever for the Retrieve. The
+// filter is only a hint, so a DateRange that fails to evaluate, is null or is not an interval of
+// dates is left out rather than failing the evaluation. The where clause the DateRange was pushed
+// down from still applies, and reports the error if it is evaluated.
+func (i *interpreter) retrieveFilter(expr *model.Retrieve, f *retrieveCodeFilter) retriever.Filter {
+	var filter retriever.Filter
+	if f != nil && f.valueSet != nil {
+		filter.CodeFilter = &retriever.CodeFilter{Property: expr.CodeProperty, ValueSetURL: f.valueSet.ID, ValueSetVersion: f.valueSet.Version}
+	}
+	if expr.DateProperty == "" || expr.DateRange == nil {
+		return filter
+	}
+	rng, err := i.evalExpression(expr.DateRange)
 	if err != nil {
-		return false, err
+		return filter
 	}
-
-	vsv, ok := vs.GolangValue().(result.ValueSet)
-	if !ok {
-		return false, fmt.Errorf("internal error - expected a ValueSetValue instead got %v", reflect.ValueOf(vs.GolangValue()).Type())
+	if result.IsNull(rng) {
+		return filter
 	}
-
-	for _, coding := range ccPB.GetCoding() {
-		// TODO: b/331447080 - Convert to using system operators for evaluating valueset membership.
-		in, err := i.terminologyProvider.AnyInValueSet([]terminology.Code{{System: coding.GetSystem().Value, Code: coding.GetCode().Value}}, vsv.ID, vsv.Version)
+	iv, err := result.ToInterval(rng)
+	if err != nil {
+		return filter
+	}
+	df := &retriever.DateFilter{Property: expr.DateProperty}
+	if !result.IsNull(iv.Low) {
+		low, err := result.ToDateTime(iv.Low)
 		if err != nil {
-			return false, err
+			return filter
 		}
-		if in {
-			return true, nil
+		df.Start = low.Date
+	}
+	if !result.IsNull(iv.High) {
+		high, err := result.ToDateTime(iv.High)
+		if err != nil {
+			return filter
 		}
+		// The filter must not leave out matching resources, so the range ends after the last instant
+		// the high bound covers at its precision.
+		df.End = endOfPrecision(high)
+	}
+	if !df.Start.IsZero() || !df.End.IsZero() {
+		filter.DateFilter = df
+	}
+	return filter
+}
+
+// endOfPrecision returns the instant just after the period of time covered by d at its precision,
+// for example the start of 2025 for the DateTime @2024.
+func endOfPrecision(d result.DateTime) time.Time {
+	switch d.Precision {
+	case model.YEAR:
+		return d.Date.AddDate(1, 0, 0)
+	case model.MONTH:
+		return d.Date.AddDate(0, 1, 0)
+	case model.DAY:
+		return d.Date.AddDate(0, 0, 1)
+	case model.HOUR:
+		return d.Date.Add(time.Hour)
+	case model.MINUTE:
+		return d.Date.Add(time.Minute)
+	case model.SECOND:
+		return d.Date.Add(time.Second)
+	default:
+		return d.Date.Add(time.Millisecond)
+	}
+}
+
+// codeableConceptCodes returns the codes of the FHIR CodeableConcept, or nil if it is null.
+func codeableConceptCodes(codeableConcept result.Value) ([]terminology.Code, error) {
+	if result.IsNull(codeableConcept) {
+		return nil, nil
 	}
 
-	return false, nil
+	protoVal, ok := codeableConcept.GolangValue().(result.Named)
+	if !ok {
+		return nil, fmt.Errorf("internal error -- codeableConceptCodes: the input Value must be a result.Named. got: %s", reflect.ValueOf(codeableConcept).Type())
+	}
+	ccPB, ok := protoVal.Value.(*dtpb.CodeableConcept)
+	if !ok {
+		return nil, fmt.Errorf("internal error -- the input proto Value must be a *dtpb.CodeableConcept type. got: %s", reflect.ValueOf(codeableConcept).Type())
+	}
+
+	codes := make([]terminology.Code, 0, len(ccPB.GetCoding()))
+	for _, coding := range ccPB.GetCoding() {
+		codes = append(codes, terminology.Code{System: coding.GetSystem().GetValue(), Code: coding.GetCode().GetValue()})
+	}
+	return codes, nil
 }
 
 // unwrapContained returns the FHIR resource from within the ContainedResource.
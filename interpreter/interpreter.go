@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/google/cql/internal/datarequirements"
 	"github.com/google/cql/internal/modelinfo"
 	"github.com/google/cql/internal/reference"
 	"github.com/google/cql/model"
@@ -38,18 +39,43 @@ type Config struct {
 	Terminology         terminology.Provider
 	EvaluationTimestamp time.Time
 	ReturnPrivateDefs   bool
+	// DefinitionStats if true records result.EvalStats on the result of each expression definition.
+	DefinitionStats bool
+	// DebugLocators if set records a result.DebugStep on the result of each expression definition for
+	// every evaluated sub-expression that has a locator.
+	DebugLocators map[model.IExpression]result.Locator
+	// KeepDefinition if set restricts evaluation to the expression definitions for which it returns
+	// true, and the definitions they depend on. Other expression definitions are skipped and are
+	// not in the returned result.Libraries.
+	KeepDefinition func(lib result.LibKey, name string) bool
 }
 
 // Eval evaluates the intermediate ELM like data structure from our parser.
 func Eval(ctx context.Context, libs []*model.Library, config Config) (result.Libraries, error) {
+	return newInterpreter(libs, config).evalLibraries(libs, config)
+}
+
+// newInterpreter returns an interpreter ready to evaluate libs.
+func newInterpreter(libs []*model.Library, config Config) *interpreter {
 	i := &interpreter{
 		refs:                reference.NewResolver[result.Value, *model.FunctionDef](),
 		terminologyProvider: config.Terminology,
 		retriever:           config.Retriever,
 		modelInfo:           config.DataModels,
 		evaluationTimestamp: config.EvaluationTimestamp,
+		retrieveCache:       make(map[string][]result.Value),
+		definitionStats:     config.DefinitionStats,
+		debugLocators:       config.DebugLocators,
+	}
+	if config.KeepDefinition != nil {
+		i.definitions = datarequirements.RequiredDefinitions(libs, config.KeepDefinition)
 	}
+	return i
+}
 
+// evalLibraries evaluates libs, which must be sorted so that every library comes after the
+// libraries it includes, and returns their expression definitions.
+func (i *interpreter) evalLibraries(libs []*model.Library, config Config) (result.Libraries, error) {
 	for _, lib := range libs {
 		if err := i.evalLibrary(lib, config.Parameters); err != nil {
 			return nil, result.NewEngineError(result.LibKeyFromModel(lib.Identifier).String(), result.ErrEvaluationError, err)
@@ -69,6 +95,22 @@ type interpreter struct {
 	terminologyProvider terminology.Provider
 	modelInfo           *modelinfo.ModelInfos
 	evaluationTimestamp time.Time
+	// retrieveCache holds the resources of each evaluated Retrieve, keyed by retrieveKey, so that
+	// identical retrieves across expression definitions are only executed once per evaluation.
+	retrieveCache map[string][]result.Value
+	// definitionStats is true if result.EvalStats should be recorded for expression definitions.
+	definitionStats bool
+	// retrieves counts the calls made to the retriever, for computing result.EvalStats.
+	retrieves int
+	// debugLocators is set in debug mode, and trace holds the debug trace of the expression
+	// definition being evaluated.
+	debugLocators map[model.IExpression]result.Locator
+	trace         []result.DebugStep
+	// definitions if set holds the expression definitions to evaluate, all others are skipped.
+	definitions map[result.DefKey]bool
+	// compiled if set holds the closures of a Program, which evalExpression runs instead of
+	// interpreting the expressions they were compiled from.
+	compiled map[model.IExpression]compiledExpr
 }
 
 // evalLibrary takes a library and evaluates all the expressions that it contains.
@@ -103,7 +145,7 @@ func (i *interpreter) evalLibrary(lib *model.Library, passedParams map[result.De
 		}
 		d := &reference.Def[result.Value]{
 			Name:             cs.Name,
-			Result:           csObj,
+			Result:           csObj.WithDefMetadata(defMetadata(lib.Identifier, result.CodeSystemDefinition, cs.AccessLevel, types.CodeSystem)),
 			IsPublic:         cs.AccessLevel == model.Public,
 			ValidateIsUnique: false,
 		}
@@ -131,7 +173,7 @@ func (i *interpreter) evalLibrary(lib *model.Library, passedParams map[result.De
 		}
 		d := &reference.Def[result.Value]{
 			Name:             vs.Name,
-			Result:           vObj,
+			Result:           vObj.WithDefMetadata(defMetadata(lib.Identifier, result.ValueSetDefinition, vs.AccessLevel, types.ValueSet)),
 			IsPublic:         vs.AccessLevel == model.Public,
 			ValidateIsUnique: false,
 		}
@@ -165,7 +207,7 @@ func (i *interpreter) evalLibrary(lib *model.Library, passedParams map[result.De
 		}
 		d := &reference.Def[result.Value]{
 			Name:             c.Name,
-			Result:           cObj,
+			Result:           cObj.WithDefMetadata(defMetadata(lib.Identifier, result.CodeDefinition, c.AccessLevel, types.Code)),
 			IsPublic:         c.AccessLevel == model.Public,
 			ValidateIsUnique: false,
 		}
@@ -199,7 +241,7 @@ func (i *interpreter) evalLibrary(lib *model.Library, passedParams map[result.De
 		}
 		d := &reference.Def[result.Value]{
 			Name:             c.Name,
-			Result:           cObj,
+			Result:           cObj.WithDefMetadata(defMetadata(lib.Identifier, result.ConceptDefinition, c.AccessLevel, types.Concept)),
 			IsPublic:         c.AccessLevel == model.Public,
 			ValidateIsUnique: false,
 		}
@@ -214,14 +256,29 @@ func (i *interpreter) evalLibrary(lib *model.Library, passedParams map[result.De
 		}
 	}
 
+	// Expression definitions are evaluated once, in order, and their results stored in refs.
+	// ExpressionRefs resolve the stored result, so a definition referenced by several others, or
+	// from other libraries, is never recomputed during the evaluation.
 	if lib.Statements != nil {
 		for _, s := range lib.Statements.Defs {
 			switch t := s.(type) {
 			case *model.ExpressionDef:
+				if i.definitions != nil && !i.definitions[result.DefKey{Name: s.GetName(), Library: result.LibKeyFromModel(lib.Identifier)}] {
+					continue
+				}
+				start, retrieves := time.Now(), i.retrieves
+				i.trace = nil
 				res, err := i.evalExpression(s.GetExpression())
 				if err != nil {
 					return err
 				}
+				if i.debugLocators != nil {
+					res = res.WithDebugTrace(i.trace)
+				}
+				res = res.WithDefMetadata(defMetadata(lib.Identifier, result.ExpressionDefinition, s.GetAccessLevel(), s.GetResultType()))
+				if i.definitionStats {
+					res = res.WithEvalStats(result.EvalStats{WallTime: time.Since(start), Retrieves: i.retrieves - retrieves})
+				}
 				d := &reference.Def[result.Value]{
 					Name:             s.GetName(),
 					Result:           res,
@@ -256,6 +313,16 @@ func (i *interpreter) evalLibrary(lib *model.Library, passedParams map[result.De
 	return nil
 }
 
+// defMetadata returns the result.DefMetadata of a definition in the library with the given
+// identifier.
+func defMetadata(id *model.LibraryIdentifier, kind result.DefKind, access model.AccessLevel, declared types.IType) result.DefMetadata {
+	m := result.DefMetadata{Kind: kind, AccessLevel: access, DeclaredType: declared}
+	if id != nil {
+		m.Library = result.LibKeyFromModel(id)
+	}
+	return m
+}
+
 func (i *interpreter) evalParameters(paramDefs []*model.ParameterDef, id *model.LibraryIdentifier, passedParams map[result.DefKey]model.IExpression) error {
 	if id == nil && len(paramDefs) > 0 {
 		return fmt.Errorf("unnamed libraries cannot have parameters, got %v", paramDefs[0].Name)
@@ -291,7 +358,7 @@ func (i *interpreter) evalParameters(paramDefs []*model.ParameterDef, id *model.
 		}
 		d := &reference.Def[result.Value]{
 			Name:             param.Name,
-			Result:           pObj,
+			Result:           pObj.WithDefMetadata(defMetadata(id, result.ParameterDefinition, param.AccessLevel, param.GetResultType())),
 			IsPublic:         param.AccessLevel == model.Public,
 			ValidateIsUnique: false,
 		}
@@ -17,6 +17,8 @@ package interpreter
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"strings"
 	"testing"
 
@@ -361,7 +363,7 @@ func TestFailingEvalSingleLibrary(t *testing.T) {
 			errContains: "internal error - unsupported expression",
 		},
 		{
-			name: "Retrieve Observations without ValuesetRef",
+			name: "Retrieve Observations filtered on a non terminology value",
 			tree: &model.Library{
 				Usings:    []*model.Using{&model.Using{URI: "http://hl7.org/fhir", Version: "4.0.1", LocalIdentifier: "FHIR"}},
 				Valuesets: []*model.ValuesetDef{&model.ValuesetDef{Name: "Test Glucose", ID: "https://example.com/glucose", Version: "1.0.0"}},
@@ -372,7 +374,7 @@ func TestFailingEvalSingleLibrary(t *testing.T) {
 							Context: "Patient",
 							Expression: &model.Retrieve{
 								CodeProperty: "code",
-								Codes:        &model.UnaryExpression{}, // something that's not a ValuesetRef.
+								Codes:        model.NewLiteral("4", types.Integer), // something that's not a terminology.
 								DataType:     "{http://hl7.org/fhir}Observation",
 								TemplateID:   "http://hl7.org/fhir/StructureDefinition/Observation",
 								Expression:   model.ResultType(&types.List{ElementType: &types.Named{TypeName: "FHIR.Observation"}}),
@@ -381,7 +383,7 @@ func TestFailingEvalSingleLibrary(t *testing.T) {
 					},
 				},
 			},
-			errContains: "only ValueSet references are currently supported for valueset filtering",
+			errContains: "retrieve terminology must be a ValueSet, Code, Concept or list of Codes or Concepts",
 		},
 		{
 			name: "Retrieve Observations with incorrect CodeProperty",
@@ -727,6 +729,85 @@ func TestInvalidContainedResource(t *testing.T) {
 	}
 }
 
+// countingRetriever counts the calls made to the wrapped retriever per resource type.
+type countingRetriever struct {
+	*local.Retriever
+	calls map[string]int
+}
+
+func (c *countingRetriever) Retrieve(ctx context.Context, resourceType string) ([]*r4pb.ContainedResource, error) {
+	c.calls[resourceType]++
+	return c.Retriever.Retrieve(ctx, resourceType)
+}
+
+func TestRetrieveDeduplication(t *testing.T) {
+	observations := func(codes model.IExpression) *model.Retrieve {
+		r := &model.Retrieve{
+			DataType:   "{http://hl7.org/fhir}Observation",
+			TemplateID: "http://hl7.org/fhir/StructureDefinition/Observation",
+			Expression: model.ResultType(&types.List{ElementType: &types.Named{TypeName: "FHIR.Observation"}}),
+		}
+		if codes != nil {
+			r.CodeProperty = "code"
+			r.Codes = codes
+		}
+		return r
+	}
+	glucose := func() model.IExpression {
+		return &model.ValuesetRef{Name: "Test Glucose", Expression: model.ResultType(types.ValueSet)}
+	}
+	defs := map[string]*model.Retrieve{
+		"Glucose":      observations(glucose()),
+		"GlucoseAgain": observations(glucose()),
+		"All":          observations(nil),
+		"AllAgain":     observations(nil),
+		"ByCode":       observations(&model.CodeRef{Name: "Glucose Code", Expression: model.ResultType(types.Code)}),
+	}
+	tree := &model.Library{
+		Identifier:  &model.LibraryIdentifier{Qualified: "TESTLIB", Version: "1.0.0"},
+		Usings:      []*model.Using{&model.Using{URI: "http://hl7.org/fhir", Version: "4.0.1", LocalIdentifier: "FHIR"}},
+		CodeSystems: []*model.CodeSystemDef{&model.CodeSystemDef{Name: "Example", ID: "http://example.com"}},
+		Codes: []*model.CodeDef{&model.CodeDef{
+			Name:       "Glucose Code",
+			Code:       "15074-8",
+			CodeSystem: &model.CodeSystemRef{Name: "Example", Expression: model.ResultType(types.CodeSystem)},
+		}},
+		Valuesets:  []*model.ValuesetDef{&model.ValuesetDef{Name: "Test Glucose", ID: "https://example.com/glucose", Version: "1.0.0"}},
+		Statements: &model.Statements{},
+	}
+	for _, name := range []string{"Glucose", "GlucoseAgain", "All", "AllAgain", "ByCode"} {
+		tree.Statements.Defs = append(tree.Statements.Defs, &model.ExpressionDef{Name: name, Context: "Patient", Expression: defs[name]})
+	}
+
+	config := defaultInterpreterConfig(t)
+	retriever := &countingRetriever{Retriever: buildRetriever(t), calls: make(map[string]int)}
+	config.Retriever = retriever
+	results, err := Eval(context.Background(), []*model.Library{tree}, config)
+	if err != nil {
+		t.Fatalf("Eval() returned unexpected error: %v", err)
+	}
+
+	// Retrieves filtered on the same ValueSet, and unfiltered retrieves, are executed once.
+	// Retrieves filtered on codes are always executed.
+	if got := retriever.calls["Observation"]; got != 3 {
+		t.Errorf("Retrieve(Observation) called %d times, want 3", got)
+	}
+	wantLens := map[string]int{"Glucose": 1, "GlucoseAgain": 1, "All": 2, "AllAgain": 2, "ByCode": 1}
+	for name, wantLen := range wantLens {
+		got := results[result.LibKey{Name: "TESTLIB", Version: "1.0.0"}][name]
+		l, err := result.ToSlice(got)
+		if err != nil {
+			t.Fatalf("ToSlice(%s) returned unexpected error: %v", name, err)
+		}
+		if len(l) != wantLen {
+			t.Errorf("%s has %d resources, want %d", name, len(l), wantLen)
+		}
+		if got.SourceExpression() != defs[name] {
+			t.Errorf("%s SourceExpression() = %v, want its own Retrieve", name, got.SourceExpression())
+		}
+	}
+}
+
 func TestConvertValuesWith(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -773,3 +854,80 @@ func TestConvertValuesWith(t *testing.T) {
 		})
 	}
 }
+
+// captureOutput returns what f writes to stdout and stderr.
+func captureOutput(t *testing.T, f func()) (stdout, stderr string) {
+	t.Helper()
+	read := func(file **os.File) (restore func() string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("os.Pipe() returned unexpected error: %v", err)
+		}
+		orig := *file
+		*file = w
+		out := make(chan string)
+		go func() {
+			b, _ := io.ReadAll(r)
+			out <- string(b)
+		}()
+		return func() string {
+			w.Close()
+			*file = orig
+			return <-out
+		}
+	}
+	restoreStdout := read(&os.Stdout)
+	restoreStderr := read(&os.Stderr)
+	f()
+	return restoreStdout(), restoreStderr()
+}
+
+func TestEvalOutput(t *testing.T) {
+	// Messages are written to stderr, and nothing is written to stdout, which programs using the
+	// engine may use for results.
+	tree := &model.Library{
+		Statements: &model.Statements{
+			Defs: []model.IExpressionDef{
+				&model.ExpressionDef{
+					Name:        "Message",
+					Context:     "Patient",
+					AccessLevel: "PUBLIC",
+					Expression: &model.Message{
+						Source:     model.NewLiteral("1.2", types.Decimal),
+						Condition:  model.NewLiteral("true", types.Boolean),
+						Code:       model.NewLiteral("100", types.String),
+						Severity:   model.NewLiteral("Warning", types.String),
+						Message:    model.NewLiteral("Test Message", types.String),
+						Expression: model.ResultType(types.Decimal),
+					},
+				},
+				&model.ExpressionDef{
+					Name:        "Is",
+					Context:     "Patient",
+					AccessLevel: "PUBLIC",
+					Expression: &model.Is{
+						UnaryExpression: &model.UnaryExpression{
+							Operand:    model.NewLiteral("1", types.Integer),
+							Expression: model.ResultType(types.Boolean),
+						},
+						IsTypeSpecifier: types.Integer,
+					},
+				},
+			},
+		},
+	}
+
+	var err error
+	stdout, stderr := captureOutput(t, func() {
+		_, err = Eval(context.Background(), []*model.Library{tree}, defaultInterpreterConfig(t))
+	})
+	if err != nil {
+		t.Fatalf("Eval() returned unexpected error: %v", err)
+	}
+	if stdout != "" {
+		t.Errorf("Eval() wrote %q to stdout, want nothing", stdout)
+	}
+	if !strings.Contains(stderr, "100: Test Message") {
+		t.Errorf("Eval() wrote %q to stderr, want the message", stderr)
+	}
+}
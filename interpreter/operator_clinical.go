@@ -16,6 +16,7 @@ package interpreter
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/google/cql/model"
 	"github.com/google/cql/result"
@@ -101,6 +102,50 @@ func calculateAgeAt(birth, asOf result.DateTime, p model.DateTimePrecision) (res
 	return result.Value{}, fmt.Errorf("Unsupported CalculateAgeAt precision %v", p)
 }
 
+// Translate(code Code, conceptMap String) List<Code>
+// Translate(code Code, conceptMap String, targetSystem String) List<Code>
+// Translate is not a CQL operator. It maps the code to codes in other CodeSystems using the
+// ConceptMap, given as a canonical url optionally followed by |version. If the targetSystem is set
+// only codes from that CodeSystem are returned.
+func (i *interpreter) evalTranslate(m model.INaryExpression, operands []result.Value) (result.Value, error) {
+	if result.IsNull(operands[0]) || result.IsNull(operands[1]) {
+		return result.New(nil)
+	}
+	code, err := result.ToCode(operands[0])
+	if err != nil {
+		return result.Value{}, err
+	}
+	conceptMap, err := result.ToString(operands[1])
+	if err != nil {
+		return result.Value{}, err
+	}
+	var targetSystem string
+	if len(operands) == 3 && !result.IsNull(operands[2]) {
+		targetSystem, err = result.ToString(operands[2])
+		if err != nil {
+			return result.Value{}, err
+		}
+	}
+	if i.terminologyProvider == nil {
+		return result.Value{}, fmt.Errorf("Translate requires a terminology provider")
+	}
+
+	url, version, _ := strings.Cut(conceptMap, "|")
+	translations, err := i.terminologyProvider.Translate(url, version, terminology.Code{System: code.System, Code: code.Code}, targetSystem)
+	if err != nil {
+		return result.Value{}, err
+	}
+	codes := make([]result.Value, 0, len(translations))
+	for _, t := range translations {
+		c, err := result.New(result.Code{System: t.Code.System, Code: t.Code.Code, Display: t.Code.Display})
+		if err != nil {
+			return result.Value{}, err
+		}
+		codes = append(codes, c)
+	}
+	return result.New(result.List{Value: codes, StaticType: &types.List{ElementType: types.Code}})
+}
+
 // in(code Code, codesystem CodeSystemRef) Boolean
 // in(codes List<Code>, codesystem CodeSystemRef) Boolean
 // in(concept Concept, codesystem CodeSystemRef) Boolean
@@ -165,6 +210,47 @@ func (i *interpreter) evalInValueSet(b model.IBinaryExpression, lObj, rObj resul
 	return result.New(in)
 }
 
+// Subsumes(left Code, right Code) Boolean
+// Subsumes(left Concept, right Concept) Boolean
+// SubsumedBy(left Code, right Code) Boolean
+// SubsumedBy(left Concept, right Concept) Boolean
+// https://cql.hl7.org/04-logicalspecification.html#subsumes
+// https://cql.hl7.org/04-logicalspecification.html#subsumedby
+// For Concepts the result is true if any code of the ancestor subsumes any code of the descendant
+// from the same CodeSystem.
+func (i *interpreter) evalSubsumes(b model.IBinaryExpression, lObj, rObj result.Value) (result.Value, error) {
+	if result.IsNull(lObj) || result.IsNull(rObj) {
+		return result.New(nil)
+	}
+	ancestors, err := valueToCodes(lObj)
+	if err != nil {
+		return result.Value{}, err
+	}
+	descendants, err := valueToCodes(rObj)
+	if err != nil {
+		return result.Value{}, err
+	}
+	if _, ok := b.(*model.SubsumedBy); ok {
+		ancestors, descendants = descendants, ancestors
+	}
+
+	for _, a := range ancestors {
+		for _, d := range descendants {
+			if a.System != d.System {
+				continue
+			}
+			subsumes, err := i.terminologyProvider.Subsumes(a.System, a.Code, d.Code)
+			if err != nil {
+				return result.Value{}, err
+			}
+			if subsumes {
+				return result.New(true)
+			}
+		}
+	}
+	return result.New(false)
+}
+
 // valueToCodes is the helper to convert a value to a list of terminology.Code. Returns an error for
 // value types that are not valid clinical values. Currently only supports Code, Concept,
 // List<Code>, List<Concept>.
@@ -914,6 +914,17 @@ func (i *interpreter) binaryOverloads(m model.IBinaryExpression) ([]convert.Over
 				Result:   i.evalInValueSet,
 			},
 		}, nil
+	case *model.Subsumes, *model.SubsumedBy:
+		return []convert.Overload[evalBinarySignature]{
+			{
+				Operands: []types.IType{types.Code, types.Code},
+				Result:   i.evalSubsumes,
+			},
+			{
+				Operands: []types.IType{types.Concept, types.Concept},
+				Result:   i.evalSubsumes,
+			},
+		}, nil
 	case *model.CalculateAgeAt:
 		return []convert.Overload[evalBinarySignature]{
 			{
@@ -1088,6 +1099,17 @@ func (i *interpreter) naryOverloads(m model.INaryExpression) ([]convert.Overload
 				Result:   i.evalCombine,
 			},
 		}, nil
+	case *model.Translate:
+		return []convert.Overload[evalNarySignature]{
+			{
+				Operands: []types.IType{types.Code, types.String},
+				Result:   i.evalTranslate,
+			},
+			{
+				Operands: []types.IType{types.Code, types.String, types.String},
+				Result:   i.evalTranslate,
+			},
+		}, nil
 	case *model.Round:
 		return []convert.Overload[evalNarySignature]{
 			{
@@ -107,7 +107,6 @@ func (i *interpreter) evalIs(m model.IUnaryExpression, obj result.Value) (result
 	if err != nil {
 		return result.Value{}, err
 	}
-	fmt.Println(isSub)
 
 	return result.New(isSub)
 }
@@ -0,0 +1,199 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package measure generates FHIR MeasureReport resources from CQL evaluation results. The
+// populations and stratifiers of a FHIR Measure resource reference expression definitions in the
+// Measure's primary library, whose results for each subject are mapped into individual
+// MeasureReports. Individual MeasureReports can then be aggregated into a summary MeasureReport.
+package measure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Population codes from http://terminology.hl7.org/CodeSystem/measure-population.
+const (
+	InitialPopulation          = "initial-population"
+	Denominator                = "denominator"
+	DenominatorExclusion       = "denominator-exclusion"
+	DenominatorException       = "denominator-exception"
+	Numerator                  = "numerator"
+	NumeratorExclusion         = "numerator-exclusion"
+	MeasurePopulation          = "measure-population"
+	MeasurePopulationExclusion = "measure-population-exclusion"
+)
+
+// Scoring codes from http://terminology.hl7.org/CodeSystem/measure-scoring.
+const (
+	Proportion         = "proportion"
+	Ratio              = "ratio"
+	ContinuousVariable = "continuous-variable"
+	Cohort             = "cohort"
+)
+
+// PopulationSystem is the code system of the measure population codes.
+const PopulationSystem = "http://terminology.hl7.org/CodeSystem/measure-population"
+
+// ErrInvalidMeasure is returned when a Measure resource can not be used to generate reports.
+var ErrInvalidMeasure = errors.New("invalid Measure")
+
+// parentPopulation maps each population to the population its members must also belong to.
+var parentPopulation = map[string]string{
+	Denominator:                InitialPopulation,
+	DenominatorExclusion:       Denominator,
+	DenominatorException:       Denominator,
+	Numerator:                  Denominator,
+	NumeratorExclusion:         Numerator,
+	MeasurePopulation:          InitialPopulation,
+	MeasurePopulationExclusion: MeasurePopulation,
+}
+
+// Coding is a FHIR Coding.
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// CodeableConcept is a FHIR CodeableConcept.
+type CodeableConcept struct {
+	Coding []*Coding `json:"coding,omitempty"`
+	Text   string    `json:"text,omitempty"`
+}
+
+// code returns the first code of the CodeableConcept, or an empty string if it has none.
+func (c *CodeableConcept) code() string {
+	if c == nil || len(c.Coding) == 0 {
+		return ""
+	}
+	return c.Coding[0].Code
+}
+
+// Expression is a FHIR Expression. For CQL based Measures Expression is the name of an expression
+// definition in the Measure's primary library.
+type Expression struct {
+	Language   string `json:"language,omitempty"`
+	Expression string `json:"expression,omitempty"`
+}
+
+// Measure is the subset of a FHIR Measure resource used to generate MeasureReports.
+type Measure struct {
+	ResourceType string           `json:"resourceType"`
+	ID           string           `json:"id,omitempty"`
+	URL          string           `json:"url,omitempty"`
+	Version      string           `json:"version,omitempty"`
+	Library      []string         `json:"library,omitempty"`
+	Scoring      *CodeableConcept `json:"scoring,omitempty"`
+	Group        []*Group         `json:"group,omitempty"`
+}
+
+// Group is a group of populations and stratifiers within a Measure.
+type Group struct {
+	ID         string           `json:"id,omitempty"`
+	Code       *CodeableConcept `json:"code,omitempty"`
+	Population []*Population    `json:"population,omitempty"`
+	Stratifier []*Stratifier    `json:"stratifier,omitempty"`
+}
+
+// Population is a population criteria of a Measure group.
+type Population struct {
+	ID       string           `json:"id,omitempty"`
+	Code     *CodeableConcept `json:"code,omitempty"`
+	Criteria *Expression      `json:"criteria,omitempty"`
+}
+
+// Stratifier is a stratifier criteria of a Measure group.
+type Stratifier struct {
+	ID       string           `json:"id,omitempty"`
+	Code     *CodeableConcept `json:"code,omitempty"`
+	Criteria *Expression      `json:"criteria,omitempty"`
+}
+
+// ParseMeasure parses a FHIR Measure resource from JSON.
+func ParseMeasure(b []byte) (*Measure, error) {
+	m := &Measure{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("failed to parse Measure: %w", err)
+	}
+	if m.ResourceType != "Measure" {
+		return nil, fmt.Errorf("resourceType %q is not Measure %w", m.ResourceType, ErrInvalidMeasure)
+	}
+	for i, g := range m.Group {
+		for _, p := range g.Population {
+			if p.Code.code() == "" {
+				return nil, fmt.Errorf("population in group %d has no code %w", i, ErrInvalidMeasure)
+			}
+			if p.Criteria == nil || p.Criteria.Expression == "" {
+				return nil, fmt.Errorf("population %s in group %d has no criteria expression %w", p.Code.code(), i, ErrInvalidMeasure)
+			}
+		}
+		for _, s := range g.Stratifier {
+			if s.Criteria == nil || s.Criteria.Expression == "" {
+				return nil, fmt.Errorf("stratifier in group %d has no criteria expression %w", i, ErrInvalidMeasure)
+			}
+		}
+	}
+	return m, nil
+}
+
+// CriteriaExpressions returns the sorted, deduplicated names of the expression definitions
+// referenced by the population and stratifier criteria of the Measure. Only these definitions, and
+// the definitions they depend on, need to be evaluated to generate MeasureReports.
+func (m *Measure) CriteriaExpressions() []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(e *Expression) {
+		if e != nil && e.Expression != "" && !seen[e.Expression] {
+			seen[e.Expression] = true
+			names = append(names, e.Expression)
+		}
+	}
+	for _, g := range m.Group {
+		for _, p := range g.Population {
+			add(p.Criteria)
+		}
+		for _, s := range g.Stratifier {
+			add(s.Criteria)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scoring returns the scoring code of the Measure.
+func (m *Measure) scoring() string {
+	return m.Scoring.code()
+}
+
+// canonical returns the canonical URL of the Measure, including the version if set.
+func (m *Measure) canonical() string {
+	if m.Version == "" {
+		return m.URL
+	}
+	return m.URL + "|" + m.Version
+}
+
+// libraryName returns the name of the Measure's primary library, taken from the last path segment
+// of its first library canonical.
+func (m *Measure) libraryName() (name, version string) {
+	if len(m.Library) == 0 {
+		return "", ""
+	}
+	canonical, version, _ := strings.Cut(m.Library[0], "|")
+	return canonical[strings.LastIndex(canonical, "/")+1:], version
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package measure_test
+
+import (
+	"testing"
+
+	"github.com/google/cql/measure"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCriteriaExpressions(t *testing.T) {
+	m, err := measure.ParseMeasure([]byte(`{
+		"resourceType": "Measure",
+		"group": [
+			{
+				"population": [
+					{"code": {"coding": [{"code": "initial-population"}]}, "criteria": {"expression": "Initial Population"}},
+					{"code": {"coding": [{"code": "numerator"}]}, "criteria": {"expression": "Numerator"}}
+				],
+				"stratifier": [{"criteria": {"expression": "Gender"}}]
+			},
+			{
+				"population": [
+					{"code": {"coding": [{"code": "initial-population"}]}, "criteria": {"expression": "Initial Population"}},
+					{"code": {"coding": [{"code": "numerator"}]}, "criteria": {"expression": "Numerator 2"}}
+				]
+			}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseMeasure() returned unexpected error: %v", err)
+	}
+	want := []string{"Gender", "Initial Population", "Numerator", "Numerator 2"}
+	if diff := cmp.Diff(want, m.CriteriaExpressions()); diff != "" {
+		t.Errorf("CriteriaExpressions() unexpected diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package measure
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/cql/result"
+)
+
+// MeasureReport is a FHIR MeasureReport resource. Its JSON encoding is the FHIR JSON
+// representation of the resource.
+type MeasureReport struct {
+	ResourceType string         `json:"resourceType"`
+	Status       string         `json:"status"`
+	Type         string         `json:"type"`
+	Measure      string         `json:"measure"`
+	Subject      *Reference     `json:"subject,omitempty"`
+	Date         string         `json:"date,omitempty"`
+	Period       *Period        `json:"period"`
+	Group        []*ReportGroup `json:"group,omitempty"`
+}
+
+// Reference is a FHIR Reference.
+type Reference struct {
+	Reference string `json:"reference"`
+}
+
+// Period is a FHIR Period.
+type Period struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// Quantity is a FHIR Quantity without units.
+type Quantity struct {
+	Value float64 `json:"value"`
+}
+
+// ReportGroup is the result of a Measure group.
+type ReportGroup struct {
+	ID           string              `json:"id,omitempty"`
+	Code         *CodeableConcept    `json:"code,omitempty"`
+	Population   []*ReportPopulation `json:"population,omitempty"`
+	MeasureScore *Quantity           `json:"measureScore,omitempty"`
+	Stratifier   []*ReportStratifier `json:"stratifier,omitempty"`
+}
+
+// ReportPopulation is the count of a population of a Measure group.
+type ReportPopulation struct {
+	ID    string           `json:"id,omitempty"`
+	Code  *CodeableConcept `json:"code,omitempty"`
+	Count int              `json:"count"`
+}
+
+// ReportStratifier is the result of a stratifier of a Measure group.
+type ReportStratifier struct {
+	ID      string             `json:"id,omitempty"`
+	Code    []*CodeableConcept `json:"code,omitempty"`
+	Stratum []*Stratum         `json:"stratum,omitempty"`
+}
+
+// Stratum holds the population counts for one value of a stratifier.
+type Stratum struct {
+	Value        *CodeableConcept    `json:"value"`
+	Population   []*ReportPopulation `json:"population,omitempty"`
+	MeasureScore *Quantity           `json:"measureScore,omitempty"`
+}
+
+// Config configures MeasureReport generation.
+type Config struct {
+	// Library is the library holding the population and stratifier definitions. If unset, the
+	// library named by the Measure's first library canonical is used, or the only library in the
+	// results if there is just one.
+	Library result.LibKey
+	// PeriodStart and PeriodEnd are the FHIR dates of the measurement period.
+	PeriodStart string
+	PeriodEnd   string
+	// Date is the date the report was generated. It is omitted from the report if zero.
+	Date time.Time
+}
+
+// IndividualReport returns the individual MeasureReport for the subject, whose evaluation results
+// are res. subject is a FHIR reference such as Patient/123.
+//
+// Population definitions must evaluate to a Boolean for subject based measures, or a List for
+// episode based measures. Population membership follows the Measure population hierarchy, for
+// example a subject is only counted in the Numerator if they are also in the Denominator.
+func IndividualReport(m *Measure, subject string, res result.Libraries, cfg Config) (*MeasureReport, error) {
+	defs, err := m.definitions(res, cfg.Library)
+	if err != nil {
+		return nil, err
+	}
+	r := newReport(m, "individual", cfg)
+	r.Subject = &Reference{Reference: subject}
+	for i, g := range m.Group {
+		members := make(map[string][]result.Value)
+		rg := &ReportGroup{ID: g.ID, Code: g.Code}
+		for _, p := range g.Population {
+			code := p.Code.code()
+			v, err := definition(defs, p.Criteria.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("group %d population %s: %w", i, code, err)
+			}
+			ms, err := populationMembers(v)
+			if err != nil {
+				return nil, fmt.Errorf("group %d population %s: %w", i, code, err)
+			}
+			if parent, ok := parentPopulation[code]; ok && g.hasPopulation(parent) {
+				ms = intersect(ms, members[parent])
+			}
+			members[code] = ms
+			rg.Population = append(rg.Population, &ReportPopulation{ID: p.ID, Code: p.Code, Count: len(ms)})
+		}
+		rg.MeasureScore = score(m.scoring(), rg.Population)
+
+		for _, s := range g.Stratifier {
+			v, err := definition(defs, s.Criteria.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("group %d stratifier %s: %w", i, s.Criteria.Expression, err)
+			}
+			text, err := stratumText(v)
+			if err != nil {
+				return nil, fmt.Errorf("group %d stratifier %s: %w", i, s.Criteria.Expression, err)
+			}
+			rg.Stratifier = append(rg.Stratifier, &ReportStratifier{
+				ID:   s.ID,
+				Code: stratifierCode(s),
+				Stratum: []*Stratum{{
+					Value:        &CodeableConcept{Text: text},
+					Population:   copyPopulations(rg.Population),
+					MeasureScore: rg.MeasureScore,
+				}},
+			})
+		}
+		r.Group = append(r.Group, rg)
+	}
+	return r, nil
+}
+
+// SummaryReport aggregates individual MeasureReports generated by IndividualReport for the Measure
+// into a summary MeasureReport. Summary MeasureReports of the Measure may be aggregated as well, so
+// that the summaries of subsets of the subjects can be combined.
+func SummaryReport(m *Measure, individual []*MeasureReport, cfg Config) (*MeasureReport, error) {
+	r := newReport(m, "summary", cfg)
+	for i, g := range m.Group {
+		rg := &ReportGroup{ID: g.ID, Code: g.Code}
+		for _, p := range g.Population {
+			rg.Population = append(rg.Population, &ReportPopulation{ID: p.ID, Code: p.Code})
+		}
+		for _, s := range g.Stratifier {
+			rg.Stratifier = append(rg.Stratifier, &ReportStratifier{ID: s.ID, Code: stratifierCode(s)})
+		}
+		r.Group = append(r.Group, rg)
+
+		for _, ir := range individual {
+			if (ir.Type != "individual" && ir.Type != "summary") || ir.Measure != m.canonical() {
+				return nil, fmt.Errorf("MeasureReport for %s of type %s can not be summarized for Measure %s", ir.Measure, ir.Type, m.canonical())
+			}
+			if len(ir.Group) != len(m.Group) {
+				return nil, fmt.Errorf("MeasureReport has %d groups, want %d %w", len(ir.Group), len(m.Group), ErrInvalidMeasure)
+			}
+			ig := ir.Group[i]
+			if err := addPopulations(rg.Population, ig.Population); err != nil {
+				return nil, err
+			}
+			if len(ig.Stratifier) != len(rg.Stratifier) {
+				return nil, fmt.Errorf("MeasureReport group %d has %d stratifiers, want %d %w", i, len(ig.Stratifier), len(rg.Stratifier), ErrInvalidMeasure)
+			}
+			for j, is := range ig.Stratifier {
+				for _, st := range is.Stratum {
+					if err := addStratum(rg.Stratifier[j], st); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		rg.MeasureScore = score(m.scoring(), rg.Population)
+		for _, s := range rg.Stratifier {
+			for _, st := range s.Stratum {
+				st.MeasureScore = score(m.scoring(), st.Population)
+			}
+		}
+	}
+	return r, nil
+}
+
+func newReport(m *Measure, reportType string, cfg Config) *MeasureReport {
+	r := &MeasureReport{
+		ResourceType: "MeasureReport",
+		Status:       "complete",
+		Type:         reportType,
+		Measure:      m.canonical(),
+		Period:       &Period{Start: cfg.PeriodStart, End: cfg.PeriodEnd},
+	}
+	if !cfg.Date.IsZero() {
+		r.Date = cfg.Date.Format(time.RFC3339)
+	}
+	return r
+}
+
+// definitions returns the expression definition results of the Measure's primary library.
+func (m *Measure) definitions(res result.Libraries, lib result.LibKey) (map[string]result.Value, error) {
+	if lib.Name != "" {
+		defs, ok := res[lib]
+		if !ok {
+			return nil, fmt.Errorf("results do not contain library %v", lib)
+		}
+		return defs, nil
+	}
+	name, version := m.libraryName()
+	for k, defs := range res {
+		if name != "" && k.Name == name && (version == "" || k.Version == version) {
+			return defs, nil
+		}
+	}
+	if len(res) == 1 {
+		for _, defs := range res {
+			return defs, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find the primary library %s of Measure %s in the results %w", name, m.canonical(), ErrInvalidMeasure)
+}
+
+func definition(defs map[string]result.Value, name string) (result.Value, error) {
+	v, ok := defs[name]
+	if !ok {
+		return result.Value{}, fmt.Errorf("expression definition %q not found in the results", name)
+	}
+	return v, nil
+}
+
+// populationMembers returns the members of a population. A true Boolean has a single member.
+func populationMembers(v result.Value) ([]result.Value, error) {
+	switch g := v.GolangValue().(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if g {
+			return []result.Value{v}, nil
+		}
+		return nil, nil
+	case result.List:
+		ms := make([]result.Value, 0, len(g.Value))
+		for _, e := range g.Value {
+			if !result.IsNull(e) {
+				ms = append(ms, e)
+			}
+		}
+		return ms, nil
+	default:
+		return nil, fmt.Errorf("population criteria must evaluate to a Boolean or List, got %v", v.RuntimeType())
+	}
+}
+
+// intersect returns the members of ms that are also in parent.
+func intersect(ms, parent []result.Value) []result.Value {
+	var out []result.Value
+	for _, m := range ms {
+		for _, p := range parent {
+			if m.Equal(p) {
+				out = append(out, m)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (g *Group) hasPopulation(code string) bool {
+	for _, p := range g.Population {
+		if p.Code.code() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// score returns the measure score for proportion and ratio measures, or nil if the measure has no
+// score or the denominator is empty.
+func score(scoring string, pops []*ReportPopulation) *Quantity {
+	counts := make(map[string]int)
+	for _, p := range pops {
+		counts[p.Code.code()] += p.Count
+	}
+	num := counts[Numerator] - counts[NumeratorExclusion]
+	var den int
+	switch scoring {
+	case Proportion:
+		den = counts[Denominator] - counts[DenominatorExclusion] - counts[DenominatorException]
+	case Ratio:
+		den = counts[Denominator] - counts[DenominatorExclusion]
+	default:
+		return nil
+	}
+	if den <= 0 {
+		return nil
+	}
+	return &Quantity{Value: float64(num) / float64(den)}
+}
+
+// stratumText returns the text used to identify the stratum of a stratifier value.
+func stratumText(v result.Value) (string, error) {
+	switch g := v.GolangValue().(type) {
+	case nil:
+		return "null", nil
+	case string:
+		return g, nil
+	case bool, int32, int64, float64:
+		return fmt.Sprint(g), nil
+	case result.Code:
+		return g.Code, nil
+	case result.Concept:
+		if len(g.Codes) == 0 {
+			return "null", nil
+		}
+		return g.Codes[0].Code, nil
+	default:
+		return "", fmt.Errorf("unsupported stratifier value type %v", v.RuntimeType())
+	}
+}
+
+func stratifierCode(s *Stratifier) []*CodeableConcept {
+	if s.Code == nil {
+		return nil
+	}
+	return []*CodeableConcept{s.Code}
+}
+
+func copyPopulations(pops []*ReportPopulation) []*ReportPopulation {
+	out := make([]*ReportPopulation, 0, len(pops))
+	for _, p := range pops {
+		c := *p
+		out = append(out, &c)
+	}
+	return out
+}
+
+func addPopulations(sum, pops []*ReportPopulation) error {
+	if len(pops) != len(sum) {
+		return fmt.Errorf("MeasureReport has %d populations, want %d %w", len(pops), len(sum), ErrInvalidMeasure)
+	}
+	for i, p := range pops {
+		sum[i].Count += p.Count
+	}
+	return nil
+}
+
+func addStratum(s *ReportStratifier, st *Stratum) error {
+	for _, existing := range s.Stratum {
+		if existing.Value.Text == st.Value.Text {
+			return addPopulations(existing.Population, st.Population)
+		}
+	}
+	pops := copyPopulations(st.Population)
+	s.Stratum = append(s.Stratum, &Stratum{Value: st.Value, Population: pops})
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package measure_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/cql/measure"
+	"github.com/google/cql/result"
+	"github.com/google/go-cmp/cmp"
+)
+
+const proportionMeasure = `{
+	"resourceType": "Measure",
+	"url": "https://example.com/Measure/Screening",
+	"version": "1.0.0",
+	"library": ["https://example.com/Library/Screening|1.0.0"],
+	"scoring": {"coding": [{"system": "http://terminology.hl7.org/CodeSystem/measure-scoring", "code": "proportion"}]},
+	"group": [{
+		"id": "group-1",
+		"population": [
+			{"code": {"coding": [{"code": "initial-population"}]}, "criteria": {"language": "text/cql-identifier", "expression": "Initial Population"}},
+			{"code": {"coding": [{"code": "denominator"}]}, "criteria": {"language": "text/cql-identifier", "expression": "Denominator"}},
+			{"code": {"coding": [{"code": "numerator"}]}, "criteria": {"language": "text/cql-identifier", "expression": "Numerator"}}
+		],
+		"stratifier": [{"code": {"text": "Gender"}, "criteria": {"language": "text/cql-identifier", "expression": "Gender"}}]
+	}]
+}`
+
+var screeningLib = result.LibKey{Name: "Screening", Version: "1.0.0"}
+
+func newValue(t *testing.T, v any) result.Value {
+	t.Helper()
+	r, err := result.New(v)
+	if err != nil {
+		t.Fatalf("result.New(%v) returned unexpected error: %v", v, err)
+	}
+	return r
+}
+
+func screeningResults(t *testing.T, ip, den, num bool, gender string) result.Libraries {
+	t.Helper()
+	return result.Libraries{
+		screeningLib: map[string]result.Value{
+			"Initial Population": newValue(t, ip),
+			"Denominator":        newValue(t, den),
+			"Numerator":          newValue(t, num),
+			"Gender":             newValue(t, gender),
+		},
+		result.LibKey{Name: "FHIRHelpers", Version: "4.0.1"}: map[string]result.Value{},
+	}
+}
+
+func populations(ip, den, num int) []*measure.ReportPopulation {
+	return []*measure.ReportPopulation{
+		{Code: &measure.CodeableConcept{Coding: []*measure.Coding{{Code: "initial-population"}}}, Count: ip},
+		{Code: &measure.CodeableConcept{Coding: []*measure.Coding{{Code: "denominator"}}}, Count: den},
+		{Code: &measure.CodeableConcept{Coding: []*measure.Coding{{Code: "numerator"}}}, Count: num},
+	}
+}
+
+func TestIndividualAndSummaryReports(t *testing.T) {
+	m, err := measure.ParseMeasure([]byte(proportionMeasure))
+	if err != nil {
+		t.Fatalf("ParseMeasure() returned unexpected error: %v", err)
+	}
+	cfg := measure.Config{PeriodStart: "2024-01-01", PeriodEnd: "2024-12-31"}
+
+	var individual []*measure.MeasureReport
+	for _, p := range []struct {
+		subject       string
+		ip, den, num  bool
+		gender        string
+		wantPopCounts []int
+	}{
+		{subject: "Patient/1", ip: true, den: true, num: true, gender: "female", wantPopCounts: []int{1, 1, 1}},
+		{subject: "Patient/2", ip: true, den: true, num: false, gender: "female", wantPopCounts: []int{1, 1, 0}},
+		// The Numerator is only counted for members of the Denominator.
+		{subject: "Patient/3", ip: true, den: false, num: true, gender: "male", wantPopCounts: []int{1, 0, 0}},
+		{subject: "Patient/4", ip: false, den: false, num: false, gender: "male", wantPopCounts: []int{0, 0, 0}},
+	} {
+		r, err := measure.IndividualReport(m, p.subject, screeningResults(t, p.ip, p.den, p.num, p.gender), cfg)
+		if err != nil {
+			t.Fatalf("IndividualReport(%s) returned unexpected error: %v", p.subject, err)
+		}
+		got := r.Group[0].Population
+		want := populations(p.wantPopCounts[0], p.wantPopCounts[1], p.wantPopCounts[2])
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("IndividualReport(%s) populations diff (-want +got):\n%s", p.subject, diff)
+		}
+		if r.Subject.Reference != p.subject {
+			t.Errorf("IndividualReport(%s) subject = %s", p.subject, r.Subject.Reference)
+		}
+		individual = append(individual, r)
+	}
+
+	got, err := measure.SummaryReport(m, individual, cfg)
+	if err != nil {
+		t.Fatalf("SummaryReport() returned unexpected error: %v", err)
+	}
+	want := &measure.MeasureReport{
+		ResourceType: "MeasureReport",
+		Status:       "complete",
+		Type:         "summary",
+		Measure:      "https://example.com/Measure/Screening|1.0.0",
+		Period:       &measure.Period{Start: "2024-01-01", End: "2024-12-31"},
+		Group: []*measure.ReportGroup{{
+			ID:           "group-1",
+			Population:   populations(3, 2, 1),
+			MeasureScore: &measure.Quantity{Value: 0.5},
+			Stratifier: []*measure.ReportStratifier{{
+				Code: []*measure.CodeableConcept{{Text: "Gender"}},
+				Stratum: []*measure.Stratum{
+					{Value: &measure.CodeableConcept{Text: "female"}, Population: populations(2, 2, 1), MeasureScore: &measure.Quantity{Value: 0.5}},
+					{Value: &measure.CodeableConcept{Text: "male"}, Population: populations(1, 0, 0)},
+				},
+			}},
+		}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SummaryReport() diff (-want +got):\n%s", diff)
+	}
+
+	// Summaries of subsets of the subjects combine into the same summary.
+	first, err := measure.SummaryReport(m, individual[:1], cfg)
+	if err != nil {
+		t.Fatalf("SummaryReport() returned unexpected error: %v", err)
+	}
+	rest, err := measure.SummaryReport(m, individual[1:], cfg)
+	if err != nil {
+		t.Fatalf("SummaryReport() returned unexpected error: %v", err)
+	}
+	combined, err := measure.SummaryReport(m, []*measure.MeasureReport{first, rest}, cfg)
+	if err != nil {
+		t.Fatalf("SummaryReport() of summaries returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, combined); diff != "" {
+		t.Errorf("SummaryReport() of summaries diff (-want +got):\n%s", diff)
+	}
+
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("json.Marshal() returned unexpected error: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() returned unexpected error: %v", err)
+	}
+	if decoded["resourceType"] != "MeasureReport" || decoded["type"] != "summary" {
+		t.Errorf("json.Marshal() = %s, want a summary MeasureReport", b)
+	}
+}
+
+func TestIndividualReport_EpisodeBased(t *testing.T) {
+	m, err := measure.ParseMeasure([]byte(`{
+		"resourceType": "Measure",
+		"url": "https://example.com/Measure/Encounters",
+		"scoring": {"coding": [{"code": "proportion"}]},
+		"group": [{"population": [
+			{"code": {"coding": [{"code": "initial-population"}]}, "criteria": {"expression": "Initial Population"}},
+			{"code": {"coding": [{"code": "denominator"}]}, "criteria": {"expression": "Denominator"}},
+			{"code": {"coding": [{"code": "numerator"}]}, "criteria": {"expression": "Numerator"}}
+		]}]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseMeasure() returned unexpected error: %v", err)
+	}
+	list := func(vals ...int) result.Value {
+		var l []result.Value
+		for _, v := range vals {
+			l = append(l, newValue(t, v))
+		}
+		return newValue(t, result.List{Value: l})
+	}
+	res := result.Libraries{
+		result.LibKey{Name: "Encounters"}: map[string]result.Value{
+			"Initial Population": list(1, 2, 3),
+			"Denominator":        list(1, 2, 3),
+			// 4 is not in the Denominator so it is not counted.
+			"Numerator": list(1, 4),
+		},
+	}
+	r, err := measure.IndividualReport(m, "Patient/1", res, measure.Config{})
+	if err != nil {
+		t.Fatalf("IndividualReport() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(populations(3, 3, 1), r.Group[0].Population); diff != "" {
+		t.Errorf("IndividualReport() populations diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(&measure.Quantity{Value: 1.0 / 3}, r.Group[0].MeasureScore); diff != "" {
+		t.Errorf("IndividualReport() measure score diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestIndividualReport_Errors(t *testing.T) {
+	m, err := measure.ParseMeasure([]byte(proportionMeasure))
+	if err != nil {
+		t.Fatalf("ParseMeasure() returned unexpected error: %v", err)
+	}
+	tests := []struct {
+		name string
+		res  result.Libraries
+	}{
+		{
+			name: "Missing library",
+			res: result.Libraries{
+				result.LibKey{Name: "Other"}:   map[string]result.Value{},
+				result.LibKey{Name: "Another"}: map[string]result.Value{},
+			},
+		},
+		{
+			name: "Missing definition",
+			res:  result.Libraries{screeningLib: map[string]result.Value{}},
+		},
+		{
+			name: "Population is not a Boolean or List",
+			res: result.Libraries{screeningLib: map[string]result.Value{
+				"Initial Population": newValue(t, 1),
+			}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := measure.IndividualReport(m, "Patient/1", tc.res, measure.Config{}); err == nil {
+				t.Errorf("IndividualReport() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestParseMeasure_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{name: "Not a Measure", json: `{"resourceType": "Library"}`},
+		{name: "Population without code", json: `{"resourceType": "Measure", "group": [{"population": [{"criteria": {"expression": "IP"}}]}]}`},
+		{name: "Population without criteria", json: `{"resourceType": "Measure", "group": [{"population": [{"code": {"coding": [{"code": "numerator"}]}}]}]}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := measure.ParseMeasure([]byte(tc.json))
+			if !errors.Is(err, measure.ErrInvalidMeasure) {
+				t.Errorf("ParseMeasure() returned error %v, want %v", err, measure.ErrInvalidMeasure)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics defines the interface through which the CQL engine reports operational metrics,
+// such as retriever and terminology latencies. Operators can implement Recorder to export metrics
+// to their monitoring system of choice, or use the included InMemory recorder.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Labels are key value pairs that further identify a metric, for example
+// {"resource_type": "Observation"}.
+type Labels map[string]string
+
+// Recorder records metrics. Implementations must be safe for concurrent use.
+type Recorder interface {
+	// Count increments the counter with the given name and labels by delta.
+	Count(name string, labels Labels, delta int64)
+	// Observe records a single value in the distribution with the given name and labels.
+	Observe(name string, labels Labels, value float64)
+}
+
+// Nop is a Recorder that discards all metrics.
+type Nop struct{}
+
+// Count does nothing.
+func (Nop) Count(string, Labels, int64) {}
+
+// Observe does nothing.
+func (Nop) Observe(string, Labels, float64) {}
+
+// Distribution summarizes the values observed for a single metric.
+type Distribution struct {
+	Count int64
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// Mean returns the mean of all observed values, or zero if there are none.
+func (d Distribution) Mean() float64 {
+	if d.Count == 0 {
+		return 0
+	}
+	return d.Sum / float64(d.Count)
+}
+
+// Metric identifies a single metric by name and labels.
+type Metric struct {
+	Name   string
+	Labels Labels
+}
+
+// String returns a printable representation of the metric, for example
+// retrieve_count{resource_type=Observation}.
+func (m Metric) String() string {
+	if len(m.Labels) == 0 {
+		return m.Name
+	}
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+m.Labels[k])
+	}
+	return m.Name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// InMemory is a Recorder that keeps all metrics in memory. It is useful for tests and for tools
+// like the CLI that report metrics at the end of a run.
+type InMemory struct {
+	mu            sync.Mutex
+	counters      map[string]int64
+	distributions map[string]Distribution
+}
+
+// NewInMemory returns a new, empty InMemory recorder.
+func NewInMemory() *InMemory {
+	return &InMemory{
+		counters:      make(map[string]int64),
+		distributions: make(map[string]Distribution),
+	}
+}
+
+// Count increments the counter with the given name and labels by delta.
+func (r *InMemory) Count(name string, labels Labels, delta int64) {
+	k := r.key(name, labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[k] += delta
+}
+
+// Observe records a single value in the distribution with the given name and labels.
+func (r *InMemory) Observe(name string, labels Labels, value float64) {
+	k := r.key(name, labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.distributions[k]
+	if !ok {
+		d = Distribution{Min: math.Inf(1), Max: math.Inf(-1)}
+	}
+	d.Count++
+	d.Sum += value
+	d.Min = math.Min(d.Min, value)
+	d.Max = math.Max(d.Max, value)
+	r.distributions[k] = d
+}
+
+// Counter returns the current value of a counter, or zero if it was never incremented.
+func (r *InMemory) Counter(name string, labels Labels) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[r.key(name, labels)]
+}
+
+// Distribution returns the current summary of a distribution, or the zero Distribution if nothing
+// was observed.
+func (r *InMemory) Distribution(name string, labels Labels) Distribution {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.distributions[r.key(name, labels)]
+}
+
+// Counters returns a copy of all counters keyed by Metric.String().
+func (r *InMemory) Counters() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := make(map[string]int64, len(r.counters))
+	for k, v := range r.counters {
+		c[k] = v
+	}
+	return c
+}
+
+// Distributions returns a copy of all distributions keyed by Metric.String().
+func (r *InMemory) Distributions() map[string]Distribution {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := make(map[string]Distribution, len(r.distributions))
+	for k, v := range r.distributions {
+		d[k] = v
+	}
+	return d
+}
+
+func (r *InMemory) key(name string, labels Labels) string {
+	return Metric{Name: name, Labels: labels}.String()
+}
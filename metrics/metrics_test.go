@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInMemory(t *testing.T) {
+	r := NewInMemory()
+	var wg sync.WaitGroup
+	for i := 1; i <= 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.Count("calls", Labels{"type": "a"}, 1)
+			r.Observe("latency", Labels{"type": "a"}, float64(i))
+		}(i)
+	}
+	wg.Wait()
+	r.Count("calls", Labels{"type": "b"}, 2)
+
+	if got := r.Counter("calls", Labels{"type": "a"}); got != 4 {
+		t.Errorf("Counter(calls, a) = %d, want 4", got)
+	}
+	wantDist := Distribution{Count: 4, Sum: 10, Min: 1, Max: 4}
+	if diff := cmp.Diff(wantDist, r.Distribution("latency", Labels{"type": "a"})); diff != "" {
+		t.Errorf("Distribution(latency, a) diff (-want +got):\n%s", diff)
+	}
+	if got := wantDist.Mean(); got != 2.5 {
+		t.Errorf("Mean() = %v, want 2.5", got)
+	}
+	wantCounters := map[string]int64{"calls{type=a}": 4, "calls{type=b}": 2}
+	if diff := cmp.Diff(wantCounters, r.Counters()); diff != "" {
+		t.Errorf("Counters() diff (-want +got):\n%s", diff)
+	}
+	if got := r.Counter("missing", nil); got != 0 {
+		t.Errorf("Counter(missing) = %d, want 0", got)
+	}
+}
+
+func TestMetricString(t *testing.T) {
+	tests := []struct {
+		metric Metric
+		want   string
+	}{
+		{metric: Metric{Name: "foo"}, want: "foo"},
+		{metric: Metric{Name: "foo", Labels: Labels{"b": "2", "a": "1"}}, want: "foo{a=1,b=2}"},
+	}
+	for _, tc := range tests {
+		if got := tc.metric.String(); got != tc.want {
+			t.Errorf("String() = %q, want %q", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"unicode"
+
+	"github.com/google/cql/types"
+)
+
+// MarshalLibraryJSON encodes the library as ELM styled JSON, for inspection or for tools that
+// consume compiled CQL. Like ELM JSON the library is wrapped in a "library" object, every
+// expression and definition has a "type" field holding its node name, field names are lowerCamelCase
+// and result types are given by their model info name. Since this model is only ELM-like the output
+// is not guaranteed to validate against the ELM schema. Empty fields are omitted.
+func MarshalLibraryJSON(lib *Library) ([]byte, error) {
+	if lib == nil {
+		return nil, fmt.Errorf("cannot marshal a nil library")
+	}
+	v, err := jsonValue(reflect.ValueOf(lib))
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(map[string]any{"library": v}, "", "  ")
+}
+
+// jsonValue converts a node of the model into a value that encoding/json marshals as ELM styled
+// JSON. A nil return means the value is empty and should be omitted.
+func jsonValue(v reflect.Value) (any, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Type() == typesIType || v.Type().Implements(typesIType) {
+		return resultTypeName(v)
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return jsonValue(v.Elem())
+	case reflect.Struct:
+		obj := make(map[string]any)
+		if err := addFields(obj, v); err != nil {
+			return nil, err
+		}
+		if isNode(v) {
+			obj["type"] = v.Type().Name()
+		}
+		if len(obj) == 0 {
+			return nil, nil
+		}
+		return obj, nil
+	case reflect.Slice, reflect.Array:
+		var items []any
+		for i := 0; i < v.Len(); i++ {
+			item, err := jsonValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			if item == nil {
+				item = map[string]any{}
+			}
+			items = append(items, item)
+		}
+		if len(items) == 0 {
+			return nil, nil
+		}
+		return items, nil
+	case reflect.String:
+		if v.String() == "" {
+			return nil, nil
+		}
+		return v.String(), nil
+	case reflect.Bool:
+		if !v.Bool() {
+			return nil, nil
+		}
+		return true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		return v.Interface(), nil
+	default:
+		return nil, fmt.Errorf("internal error - unsupported field of kind %v in the model", v.Kind())
+	}
+}
+
+// addFields adds the non-empty fields of the struct to obj. The fields of embedded structs, such as
+// *Expression or *UnaryExpression, are added as if they were fields of the struct itself.
+func addFields(obj map[string]any, v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		if f.Anonymous {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				if err := addFields(obj, fv); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		val, err := jsonValue(fv)
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			obj[jsonFieldName(f.Name)] = val
+		}
+	}
+	return nil
+}
+
+// isNode returns true for the expressions, definitions, relationship clauses and sort items of the
+// model, whose ELM JSON includes a "type" field.
+func isNode(v reflect.Value) bool {
+	if !v.CanAddr() {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p.Elem()
+	}
+	switch v.Addr().Interface().(type) {
+	case IExpression, IExpressionDef, IRelationshipClause, ISortByItem:
+		return true
+	}
+	return false
+}
+
+// resultTypeName returns the model info name of the type, or nil if the type is not set.
+func resultTypeName(v reflect.Value) (any, error) {
+	if (v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer) && v.IsNil() {
+		return nil, nil
+	}
+	t, ok := v.Interface().(types.IType)
+	if !ok || t == nil {
+		return nil, nil
+	}
+	name, err := t.ModelInfoName()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, nil
+	}
+	return name, nil
+}
+
+// jsonFieldName converts a Go field name to lowerCamelCase, for example ResultType to resultType,
+// ID to id and URIValue to uriValue.
+func jsonFieldName(name string) string {
+	r := []rune(name)
+	for i := 0; i < len(r) && unicode.IsUpper(r[i]); i++ {
+		// The last capital of a leading initialism starts the next word.
+		if i > 0 && i+1 < len(r) && unicode.IsLower(r[i+1]) {
+			break
+		}
+		r[i] = unicode.ToLower(r[i])
+	}
+	return string(r)
+}
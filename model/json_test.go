@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMarshalLibraryJSON(t *testing.T) {
+	lib := &Library{
+		Identifier: &LibraryIdentifier{Qualified: "TESTLIB", Version: "1.0.0"},
+		Usings:     []*Using{{LocalIdentifier: "FHIR", URI: "http://hl7.org/fhir", Version: "4.0.1"}},
+		Valuesets:  []*ValuesetDef{{Name: "VS", ID: "https://example.com/vs", AccessLevel: Public}},
+		Statements: &Statements{
+			Defs: []IExpressionDef{
+				&ExpressionDef{
+					Element:     &Element{ResultType: types.Boolean},
+					Name:        "Greater",
+					Context:     "Patient",
+					AccessLevel: Public,
+					Expression: &Greater{
+						BinaryExpression: &BinaryExpression{
+							Expression: ResultType(types.Boolean),
+							Operands: []IExpression{
+								&Literal{Expression: ResultType(types.Integer), Value: "2"},
+								&Literal{Expression: ResultType(types.Integer), Value: "1"},
+							},
+						},
+					},
+				},
+				&ExpressionDef{
+					Element:     &Element{ResultType: &types.List{ElementType: &types.Named{TypeName: "FHIR.Encounter"}}},
+					Name:        "Encounters",
+					Context:     "Patient",
+					AccessLevel: Private,
+					Expression: &Retrieve{
+						Expression:   ResultType(&types.List{ElementType: &types.Named{TypeName: "FHIR.Encounter"}}),
+						DataType:     "{http://hl7.org/fhir}Encounter",
+						TemplateID:   "http://hl7.org/fhir/StructureDefinition/Encounter",
+						CodeProperty: "type",
+					},
+				},
+			},
+		},
+	}
+	b, err := MarshalLibraryJSON(lib)
+	if err != nil {
+		t.Fatalf("MarshalLibraryJSON() returned unexpected error: %v", err)
+	}
+	var got any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("MarshalLibraryJSON() returned invalid JSON %s: %v", b, err)
+	}
+	var want any
+	wantJSON := `{
+		"library": {
+			"identifier": {"qualified": "TESTLIB", "version": "1.0.0"},
+			"usings": [{"localIdentifier": "FHIR", "uri": "http://hl7.org/fhir", "version": "4.0.1"}],
+			"valuesets": [{"name": "VS", "id": "https://example.com/vs", "accessLevel": "PUBLIC"}],
+			"statements": {
+				"defs": [
+					{
+						"type": "ExpressionDef",
+						"name": "Greater",
+						"context": "Patient",
+						"accessLevel": "PUBLIC",
+						"resultType": "System.Boolean",
+						"expression": {
+							"type": "Greater",
+							"resultType": "System.Boolean",
+							"operands": [
+								{"type": "Literal", "resultType": "System.Integer", "value": "2"},
+								{"type": "Literal", "resultType": "System.Integer", "value": "1"}
+							]
+						}
+					},
+					{
+						"type": "ExpressionDef",
+						"name": "Encounters",
+						"context": "Patient",
+						"accessLevel": "PRIVATE",
+						"resultType": "List<FHIR.Encounter>",
+						"expression": {
+							"type": "Retrieve",
+							"resultType": "List<FHIR.Encounter>",
+							"dataType": "{http://hl7.org/fhir}Encounter",
+							"templateID": "http://hl7.org/fhir/StructureDefinition/Encounter",
+							"codeProperty": "type"
+						}
+					}
+				]
+			}
+		}
+	}`
+	if err := json.Unmarshal([]byte(wantJSON), &want); err != nil {
+		t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", wantJSON, err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("MarshalLibraryJSON() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestMarshalLibraryJSON_Clauses(t *testing.T) {
+	lib := &Library{
+		Statements: &Statements{
+			Defs: []IExpressionDef{
+				&ExpressionDef{
+					Name: "Query",
+					Expression: &Query{
+						Source: []*AliasedSource{{Alias: "A", Source: &List{}}},
+						Relationship: []IRelationshipClause{
+							&Without{RelationshipClause: &RelationshipClause{Alias: "B", Expression: &List{}}},
+						},
+						Sort: &SortClause{ByItems: []ISortByItem{
+							&SortByColumn{SortByItem: &SortByItem{Direction: DESCENDING}, Path: "value"},
+						}},
+					},
+				},
+			},
+		},
+	}
+	b, err := MarshalLibraryJSON(lib)
+	if err != nil {
+		t.Fatalf("MarshalLibraryJSON() returned unexpected error: %v", err)
+	}
+	var got any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("MarshalLibraryJSON() returned invalid JSON %s: %v", b, err)
+	}
+	var want any
+	wantJSON := `{
+		"library": {
+			"statements": {
+				"defs": [
+					{
+						"type": "ExpressionDef",
+						"name": "Query",
+						"expression": {
+							"type": "Query",
+							"source": [{"type": "AliasedSource", "alias": "A", "source": {"type": "List"}}],
+							"relationship": [{"type": "Without", "alias": "B", "expression": {"type": "List"}}],
+							"sort": {"byItems": [{"type": "SortByColumn", "direction": "DESCENDING", "path": "value"}]}
+						}
+					}
+				]
+			}
+		}
+	}`
+	if err := json.Unmarshal([]byte(wantJSON), &want); err != nil {
+		t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", wantJSON, err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("MarshalLibraryJSON() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestMarshalLibraryJSON_Nil(t *testing.T) {
+	if _, err := MarshalLibraryJSON(nil); err == nil {
+		t.Errorf("MarshalLibraryJSON(nil) succeeded, want error")
+	}
+}
+
+func TestJSONFieldName(t *testing.T) {
+	for name, want := range map[string]string{
+		"ResultType":      "resultType",
+		"ID":              "id",
+		"URI":             "uri",
+		"LocalIdentifier": "localIdentifier",
+		"URIValue":        "uriValue",
+	} {
+		if got := jsonFieldName(name); got != want {
+			t.Errorf("jsonFieldName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
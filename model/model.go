@@ -536,6 +536,11 @@ type Retrieve struct {
 	CodeProperty string
 	// Codes is an expression that returns a list of code values.
 	Codes IExpression
+	// DateProperty and DateRange, if set, describe that only resources whose DateProperty falls
+	// within the DateRange interval are needed. They are a hint that a retriever may use to return
+	// fewer resources; the query the retrieve is a source of still filters on the date itself.
+	DateProperty string
+	DateRange    IExpression
 }
 
 // Case is a conditional case expression https://cql.hl7.org/04-logicalspecification.html#case.
@@ -1026,6 +1031,14 @@ type InCodeSystem struct{ *BinaryExpression }
 // treating this as a binary expression.
 type InValueSet struct{ *BinaryExpression }
 
+// Subsumes ELM expression from https://cql.hl7.org/04-logicalspecification.html#subsumes.
+// Returns true if the first Code or Concept subsumes the second in the CodeSystem hierarchy.
+type Subsumes struct{ *BinaryExpression }
+
+// SubsumedBy ELM expression from https://cql.hl7.org/04-logicalspecification.html#subsumedby.
+// Returns true if the first Code or Concept is subsumed by the second in the CodeSystem hierarchy.
+type SubsumedBy struct{ *BinaryExpression }
+
 // Contains ELM expression from https://cql.hl7.org/04-logicalspecification.html#contains.
 type Contains BinaryExpressionWithPrecision
 
@@ -1090,6 +1103,10 @@ type Now struct{ *NaryExpression }
 // Round ELM Expression https://cql.hl7.org/04-logicalspecification.html#round
 type Round struct{ *NaryExpression }
 
+// Translate maps a Code to Codes in other CodeSystems using a ConceptMap, optionally restricted to
+// a target CodeSystem. It is not part of ELM, and is evaluated by the terminology provider.
+type Translate struct{ *NaryExpression }
+
 // TimeOfDay is https://cql.hl7.org/04-logicalspecification.html#timeofday
 // Note: in the future we may implement the OperatorExpression, and should convert this to
 // one of those at that point.
@@ -1357,6 +1374,9 @@ func (a *Power) GetName() string { return "Power" }
 // GetName returns the name of the system operator.
 func (a *Round) GetName() string { return "Round" }
 
+// GetName returns the name of the system operator.
+func (a *Translate) GetName() string { return "Translate" }
+
 // GetName returns the name of the system operator.
 func (a *TruncatedDivide) GetName() string { return "TruncatedDivide" }
 
@@ -1387,6 +1407,12 @@ func (a *InCodeSystem) GetName() string { return "InCodeSystem" }
 // GetName returns the name of the system operator.
 func (a *InValueSet) GetName() string { return "InValueSet" }
 
+// GetName returns the name of the system operator.
+func (a *Subsumes) GetName() string { return "Subsumes" }
+
+// GetName returns the name of the system operator.
+func (a *SubsumedBy) GetName() string { return "SubsumedBy" }
+
 // GetName returns the name of the system operator.
 func (a *Contains) GetName() string { return "Contains" }
 
@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"reflect"
+
+	"github.com/google/cql/types"
+)
+
+var (
+	typesIType  = reflect.TypeOf((*types.IType)(nil)).Elem()
+	iExpression = reflect.TypeOf((*IExpression)(nil)).Elem()
+)
+
+// Walk traverses the model in depth-first order starting at node, which may be a *Library, an
+// IExpressionDef or an IExpression. visit is called for every IExpression found. If visit returns
+// false the children of that expression are not traversed. Walk does not follow references
+// (ExpressionRef, FunctionRef...) to their definitions.
+func Walk(node any, visit func(IExpression) bool) {
+	walk(reflect.ValueOf(node), visit)
+}
+
+func walk(v reflect.Value, visit func(IExpression) bool) {
+	if !v.IsValid() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() || v.Type() == typesIType {
+			return
+		}
+		walk(v.Elem(), visit)
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		if e, ok := v.Interface().(IExpression); ok && !isEmbeddedBase(v) {
+			if !visit(e) {
+				return
+			}
+		}
+		walk(v.Elem(), visit)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			walk(v.Field(i), visit)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walk(v.Index(i), visit)
+		}
+	}
+}
+
+// Rewrite traverses the model starting at node like Walk, but in post-order, and replaces every
+// expression held in a field or slice of type IExpression with the result of rewrite. The children of
+// an expression are rewritten before the expression itself, and rewrite may return the expression
+// unchanged. Expressions held in fields of a concrete type, like the *AliasedSource of a Query, are
+// traversed but not replaced, and neither is node itself.
+func Rewrite(node any, rewrite func(IExpression) IExpression) {
+	rewriteValue(reflect.ValueOf(node), rewrite)
+}
+
+func rewriteValue(v reflect.Value, rewrite func(IExpression) IExpression) {
+	if !v.IsValid() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() || v.Type() == typesIType {
+			return
+		}
+		rewriteValue(v.Elem(), rewrite)
+		if v.Type() == iExpression && v.CanSet() {
+			if r := rewrite(v.Interface().(IExpression)); r != nil {
+				v.Set(reflect.ValueOf(r))
+			}
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		rewriteValue(v.Elem(), rewrite)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			rewriteValue(v.Field(i), rewrite)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			rewriteValue(v.Index(i), rewrite)
+		}
+	}
+}
+
+// isEmbeddedBase returns true for the base structs that are embedded in every expression, which
+// should not be reported as expressions themselves.
+func isEmbeddedBase(v reflect.Value) bool {
+	switch v.Interface().(type) {
+	case *Expression, *UnaryExpression, *BinaryExpression, *NaryExpression:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWalk(t *testing.T) {
+	lib := &Library{
+		Statements: &Statements{
+			Defs: []IExpressionDef{
+				&ExpressionDef{
+					Name: "Def",
+					Expression: &Query{
+						Source: []*AliasedSource{{Alias: "E", Source: &Retrieve{DataType: "{http://hl7.org/fhir}Encounter"}}},
+						Where: &Equal{BinaryExpression: &BinaryExpression{
+							Operands: []IExpression{&AliasRef{Name: "E"}, &Literal{Value: "1"}},
+						}},
+					},
+				},
+				&FunctionDef{
+					ExpressionDef: &ExpressionDef{
+						Name:       "Func",
+						Expression: &Not{UnaryExpression: &UnaryExpression{Operand: &OperandRef{Name: "A"}}},
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		visit func(got *[]string) func(IExpression) bool
+		want  []string
+	}{
+		{
+			name: "Visits all expressions",
+			visit: func(got *[]string) func(IExpression) bool {
+				return func(e IExpression) bool {
+					*got = append(*got, fmt.Sprintf("%T", e))
+					return true
+				}
+			},
+			want: []string{"*model.Query", "*model.AliasedSource", "*model.Retrieve", "*model.Equal", "*model.AliasRef", "*model.Literal", "*model.Not", "*model.OperandRef"},
+		},
+		{
+			name: "Skips children when visit returns false",
+			visit: func(got *[]string) func(IExpression) bool {
+				return func(e IExpression) bool {
+					*got = append(*got, fmt.Sprintf("%T", e))
+					_, isQuery := e.(*Query)
+					return !isQuery
+				}
+			},
+			want: []string{"*model.Query", "*model.Not", "*model.OperandRef"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			Walk(lib, tc.visit(&got))
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Walk() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	def := &ExpressionDef{
+		Name: "Def",
+		Expression: &Query{
+			Source: []*AliasedSource{{Alias: "E", Source: &Retrieve{DataType: "{http://hl7.org/fhir}Encounter"}}},
+			Where: &Equal{BinaryExpression: &BinaryExpression{
+				Operands: []IExpression{&AliasRef{Name: "E"}, &Literal{Value: "1"}},
+			}},
+		},
+	}
+
+	var order []string
+	Rewrite(def, func(e IExpression) IExpression {
+		order = append(order, fmt.Sprintf("%T", e))
+		if l, ok := e.(*Literal); ok {
+			return &Literal{Value: l.Value + "0"}
+		}
+		if _, ok := e.(*Retrieve); ok {
+			return &Retrieve{DataType: "{http://hl7.org/fhir}Observation"}
+		}
+		return e
+	})
+
+	// The AliasedSource is held in a []*AliasedSource so it is not passed to rewrite, but its source
+	// is.
+	wantOrder := []string{"*model.Retrieve", "*model.AliasRef", "*model.Literal", "*model.Equal", "*model.Query"}
+	if diff := cmp.Diff(wantOrder, order); diff != "" {
+		t.Errorf("Rewrite() order diff (-want +got):\n%s", diff)
+	}
+	q := def.Expression.(*Query)
+	if got := q.Source[0].Source.(*Retrieve).DataType; got != "{http://hl7.org/fhir}Observation" {
+		t.Errorf("Rewrite() left source data type %v, want {http://hl7.org/fhir}Observation", got)
+	}
+	if got := q.Where.(*Equal).Operands[1].(*Literal).Value; got != "10" {
+		t.Errorf("Rewrite() left literal %v, want 10", got)
+	}
+}
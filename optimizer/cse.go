@@ -0,0 +1,307 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimizer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/types"
+)
+
+// CommonSubexpressionExtraction finds sub-expressions that occur more than once in the expression
+// definitions of a library, and extracts each into a new private expression definition that the
+// occurrences reference. Since each expression definition is evaluated once, the sub-expression is
+// then only evaluated once. Only sub-expressions that do not depend on the query, let clause or
+// function they occur in are extracted, and only between expression definitions of the same
+// context. Sub-expressions that are not always evaluated along with their expression definition,
+// like the branches of an if, are not extracted, since the extracted definition would raise their
+// errors. The new definitions are named $cse1, $cse2 and so on.
+var CommonSubexpressionExtraction Pass = commonSubexpressionExtraction{}
+
+type commonSubexpressionExtraction struct{}
+
+func (commonSubexpressionExtraction) Name() string { return "common_subexpression_extraction" }
+
+func (commonSubexpressionExtraction) Run(ctx context.Context, libs []*model.Library, _ Config) error {
+	for _, lib := range libs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if lib.Statements != nil {
+			extractCommonSubexpressions(lib.Statements)
+		}
+	}
+	return nil
+}
+
+// minExtractedSize is the number of expressions a sub-expression must have to be extracted, unless
+// it retrieves data or calls a function.
+const minExtractedSize = 3
+
+type occurrence struct {
+	def  int
+	expr model.IExpression
+	size int
+}
+
+func extractCommonSubexpressions(s *model.Statements) {
+	names := make(map[string]bool, len(s.Defs))
+	for _, d := range s.Defs {
+		names[d.GetName()] = true
+	}
+	next := 1
+
+	for {
+		// Sub-expressions are found again after each extraction, since extracting one removes the
+		// occurrences of the sub-expressions it contains.
+		occurrences := make(map[string][]occurrence)
+		var keys []string
+		// A node can be reachable twice, for example a date range pushed into a retrieve, but is
+		// only one occurrence.
+		seen := make(map[model.IExpression]bool)
+		for i, d := range s.Defs {
+			def, ok := d.(*model.ExpressionDef)
+			if !ok {
+				continue
+			}
+			walkUnconditional(def.Expression, func(e model.IExpression) bool {
+				if seen[e] {
+					return true
+				}
+				seen[e] = true
+				size, ok := extractable(e)
+				if !ok {
+					return true
+				}
+				k := def.Context + "\x00" + structuralKey(e)
+				if _, ok := occurrences[k]; !ok {
+					keys = append(keys, k)
+				}
+				occurrences[k] = append(occurrences[k], occurrence{def: i, expr: e, size: size})
+				return true
+			})
+		}
+
+		// The largest repeated sub-expression is extracted first, so that the sub-expressions it
+		// contains are extracted with it.
+		var best []occurrence
+		for _, k := range keys {
+			if occ := occurrences[k]; len(occ) > 1 && (best == nil || occ[0].size > best[0].size) {
+				best = occ
+			}
+		}
+		if best == nil {
+			return
+		}
+
+		name := fmt.Sprintf("$cse%d", next)
+		for ; names[name]; name = fmt.Sprintf("$cse%d", next) {
+			next++
+		}
+		names[name] = true
+		first := best[0]
+		replace := make(map[model.IExpression]bool, len(best))
+		for _, o := range best {
+			replace[o.expr] = true
+		}
+		for _, d := range s.Defs {
+			if _, ok := d.(*model.ExpressionDef); !ok {
+				continue
+			}
+			model.Rewrite(d, func(e model.IExpression) model.IExpression {
+				if replace[e] {
+					return &model.ExpressionRef{Expression: model.ResultType(e.GetResultType()), Name: name}
+				}
+				return e
+			})
+		}
+		// Definitions are evaluated in order, so the extracted definition goes before the first
+		// definition that references it. Everything it references was referenced by that definition
+		// too, so is defined before it.
+		extracted := &model.ExpressionDef{
+			Element:     &model.Element{ResultType: first.expr.GetResultType()},
+			Name:        name,
+			Context:     s.Defs[first.def].GetContext(),
+			AccessLevel: model.Private,
+			Expression:  first.expr,
+		}
+		s.Defs = append(s.Defs[:first.def], append([]model.IExpressionDef{extracted}, s.Defs[first.def:]...)...)
+	}
+}
+
+// walkUnconditional calls visit for e and each of its sub-expressions that is evaluated whenever e
+// is, like model.Walk. The branches of if and case, the operands of and, or and implies after the
+// first, which may be short-circuited, and the clauses of a query that are evaluated for each of its
+// rows are skipped.
+func walkUnconditional(e model.IExpression, visit func(model.IExpression) bool) {
+	model.Walk(e, func(c model.IExpression) bool {
+		if !visit(c) {
+			return false
+		}
+		switch c := c.(type) {
+		case *model.IfThenElse:
+			walkUnconditional(c.Condition, visit)
+			return false
+		case *model.Case:
+			if c.Comparand != nil {
+				walkUnconditional(c.Comparand, visit)
+			} else if len(c.CaseItem) > 0 {
+				walkUnconditional(c.CaseItem[0].When, visit)
+			}
+			return false
+		case *model.And:
+			walkUnconditional(c.Left(), visit)
+			return false
+		case *model.Or:
+			walkUnconditional(c.Left(), visit)
+			return false
+		case *model.Implies:
+			walkUnconditional(c.Left(), visit)
+			return false
+		case *model.Query:
+			for _, s := range c.Source {
+				walkUnconditional(s.Source, visit)
+			}
+			for _, l := range c.Let {
+				walkUnconditional(l.Expression, visit)
+			}
+			return false
+		}
+		return true
+	})
+}
+
+// extractable returns the number of expressions in e, and true if e can be extracted into its own
+// expression definition.
+func extractable(e model.IExpression) (int, bool) {
+	if _, ok := e.(*model.AliasedSource); ok {
+		return 0, false
+	}
+	size, costly := 0, false
+	model.Walk(e, func(c model.IExpression) bool {
+		size++
+		switch c.(type) {
+		case *model.Retrieve, *model.FunctionRef, *model.Query:
+			costly = true
+		}
+		return true
+	})
+	if size < minExtractedSize && !costly {
+		return size, false
+	}
+	return size, closed(e)
+}
+
+// closed returns true if e does not depend on the query, let clause, sort or function it occurs
+// in, so it evaluates to the same value anywhere in its expression definition.
+func closed(e model.IExpression) bool {
+	// Names bound by queries within e, and names e references.
+	bound, referenced := make(map[string]bool), make(map[string]bool)
+	open := false
+	model.Walk(e, func(c model.IExpression) bool {
+		switch c := c.(type) {
+		case *model.Query:
+			for _, s := range c.Source {
+				bound[s.Alias] = true
+			}
+			for _, r := range c.Relationship {
+				switch r := r.(type) {
+				case *model.With:
+					bound[r.Alias] = true
+				case *model.Without:
+					bound[r.Alias] = true
+				}
+			}
+			for _, l := range c.Let {
+				bound[l.Identifier] = true
+			}
+			if c.Aggregate != nil {
+				bound[c.Aggregate.Identifier] = true
+			}
+		case *model.AliasRef:
+			referenced[c.Name] = true
+		case *model.QueryLetRef:
+			referenced[c.Name] = true
+		case *model.OperandRef, *model.IdentifierRef, *model.Message:
+			open = true
+		case *model.Property:
+			// A property without a source refers to the scope of a sort.
+			open = open || c.Source == nil
+		}
+		return true
+	})
+	for name := range referenced {
+		if !bound[name] {
+			open = true
+		}
+	}
+	return !open
+}
+
+var iType = reflect.TypeOf((*types.IType)(nil)).Elem()
+
+// structuralKey returns a string that is equal for structurally equal expressions.
+func structuralKey(e model.IExpression) string {
+	var b strings.Builder
+	writeKey(&b, reflect.ValueOf(e))
+	return b.String()
+}
+
+func writeKey(b *strings.Builder, v reflect.Value) {
+	if !v.IsValid() {
+		b.WriteString("nil")
+		return
+	}
+	if v.Type().Implements(iType) && v.Kind() != reflect.Struct {
+		if v.IsNil() {
+			b.WriteString("nil")
+			return
+		}
+		b.WriteString(v.Interface().(types.IType).String())
+		return
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			b.WriteString("nil")
+			return
+		}
+		writeKey(b, v.Elem())
+	case reflect.Struct:
+		b.WriteString(v.Type().Name())
+		b.WriteString("{")
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			writeKey(b, v.Field(i))
+			b.WriteString(",")
+		}
+		b.WriteString("}")
+	case reflect.Slice, reflect.Array:
+		b.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			writeKey(b, v.Index(i))
+			b.WriteString(",")
+		}
+		b.WriteString("]")
+	default:
+		fmt.Fprintf(b, "%q", fmt.Sprint(v.Interface()))
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimizer
+
+import (
+	"context"
+
+	"github.com/google/cql/internal/datarequirements"
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+)
+
+// DeadDefineElimination removes the expression and function definitions that the outputs of
+// Config do not depend on, directly or through other definitions, so that they are not evaluated.
+// Only the outputs and their dependencies are in the results of evaluating the optimized
+// libraries. If the outputs are not set nothing is removed.
+var DeadDefineElimination Pass = deadDefineElimination{}
+
+type deadDefineElimination struct{}
+
+func (deadDefineElimination) Name() string { return "dead_define_elimination" }
+
+func (deadDefineElimination) Run(_ context.Context, libs []*model.Library, cfg Config) error {
+	if cfg.Outputs.IsZero() {
+		return nil
+	}
+	// The definition of each context, such as Patient, is used implicitly.
+	contexts := make(map[string]bool)
+	for _, lib := range libs {
+		if lib.Statements == nil {
+			continue
+		}
+		for _, d := range lib.Statements.Defs {
+			if d.GetName() == d.GetContext() {
+				contexts[d.GetName()] = true
+			}
+		}
+	}
+	// The keys of unnamed libraries are unique on every call of result.LibKeyFromModel, so their
+	// definitions are all kept.
+	required := datarequirements.RequiredDefinitions(libs, func(lib result.LibKey, name string) bool {
+		return lib.IsUnnamed || contexts[name] || cfg.Outputs.Keep(lib, name)
+	})
+
+	for _, lib := range libs {
+		if lib.Statements == nil || lib.Identifier == nil {
+			continue
+		}
+		key := result.LibKeyFromModel(lib.Identifier)
+		var kept []model.IExpressionDef
+		for _, d := range lib.Statements.Defs {
+			if required[result.DefKey{Name: d.GetName(), Library: key}] {
+				kept = append(kept, d)
+			}
+		}
+		lib.Statements.Defs = kept
+	}
+	return nil
+}
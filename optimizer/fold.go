@@ -0,0 +1,207 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimizer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/cql/internal/modelinfo"
+	"github.com/google/cql/interpreter"
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+)
+
+// ConstantFolding evaluates system operators whose operands are all literals once, while
+// optimizing, and replaces them with their result. Only operators that return a Boolean, Integer,
+// Long, Decimal or String are folded, since the meaning of date and time values can depend on the
+// evaluation timestamp. Operators that fail, like an Integer overflow, are left to fail during
+// evaluation.
+var ConstantFolding Pass = constantFolding{}
+
+type constantFolding struct{}
+
+func (constantFolding) Name() string { return "constant_folding" }
+
+func (constantFolding) Run(ctx context.Context, libs []*model.Library, _ Config) error {
+	// Only system types are folded, so the system model is enough to evaluate them.
+	systemModel, err := modelinfo.New(nil)
+	if err != nil {
+		return err
+	}
+	for _, lib := range libs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var foldErr error
+		model.Rewrite(lib, func(e model.IExpression) model.IExpression {
+			if foldErr != nil || !foldable(e) {
+				return e
+			}
+			folded, ok, err := fold(ctx, e, systemModel)
+			if err != nil {
+				foldErr = err
+				return e
+			}
+			if ok {
+				return folded
+			}
+			return e
+		})
+		if foldErr != nil {
+			return foldErr
+		}
+	}
+	return nil
+}
+
+// foldable returns true if e is a deterministic system operator with a primitive result type
+// whose operands are all constants. Since libraries are rewritten bottom up, the operands have
+// already been folded where possible.
+func foldable(e model.IExpression) bool {
+	switch e.(type) {
+	case *model.Message, *model.Now, *model.Today, *model.TimeOfDay:
+		return false
+	case model.IUnaryExpression, model.IBinaryExpression, model.INaryExpression, *model.IfThenElse:
+	default:
+		return false
+	}
+	if !isPrimitive(e.GetResultType()) {
+		return false
+	}
+	for _, c := range children(e) {
+		if !constant(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// constant returns true for literals of primitive types, nulls, and lists and intervals of them.
+func constant(e model.IExpression) bool {
+	switch e := e.(type) {
+	case *model.Literal:
+		return isNull(e) || isPrimitive(e.GetResultType())
+	case *model.As:
+		l, ok := e.Operand.(*model.Literal)
+		return ok && isNull(l)
+	case *model.List, *model.Interval:
+		for _, c := range children(e) {
+			if !constant(c) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func isPrimitive(t types.IType) bool {
+	switch t {
+	case types.Boolean, types.Integer, types.Long, types.Decimal, types.String:
+		return true
+	}
+	return false
+}
+
+func isNull(l *model.Literal) bool {
+	return l.GetResultType() == types.Any && l.Value == "null"
+}
+
+// children returns the expressions directly held by e.
+func children(e model.IExpression) []model.IExpression {
+	var c []model.IExpression
+	model.Walk(e, func(child model.IExpression) bool {
+		if child == e {
+			return true
+		}
+		c = append(c, child)
+		return false
+	})
+	return c
+}
+
+// foldLibrary is the name of the library in which constant expressions are evaluated.
+const foldLibrary = "ConstantFolding"
+
+// fold evaluates e and returns its result as a literal. It returns false if e fails to evaluate,
+// since the expression may be in a branch that is never evaluated, and an error if folding was
+// cancelled or the evaluation did not return the result of e.
+func fold(ctx context.Context, e model.IExpression, systemModel *modelinfo.ModelInfos) (model.IExpression, bool, error) {
+	lib := &model.Library{
+		Identifier: &model.LibraryIdentifier{Local: foldLibrary, Qualified: foldLibrary},
+		Statements: &model.Statements{Defs: []model.IExpressionDef{
+			&model.ExpressionDef{
+				Element:     &model.Element{ResultType: e.GetResultType()},
+				Name:        "Value",
+				Expression:  e,
+				AccessLevel: model.Public,
+			},
+		}},
+	}
+	// The evaluation timestamp does not matter, since no date or time values are folded.
+	res, err := interpreter.Eval(ctx, []*model.Library{lib}, interpreter.Config{DataModels: systemModel, EvaluationTimestamp: time.Unix(0, 0)})
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, false, ctxErr
+		}
+		return nil, false, nil
+	}
+	v, ok := res[result.LibKey{Name: foldLibrary}]["Value"]
+	if !ok {
+		return nil, false, fmt.Errorf("internal error - constant folding did not return the result of %T", e)
+	}
+	folded, ok := literal(v.GolangValue(), e.GetResultType())
+	return folded, ok, nil
+}
+
+// literal returns the literal expression of a primitive value of type t.
+func literal(v any, t types.IType) (model.IExpression, bool) {
+	// Some operators return a runtime value whose type differs from their
+	// declared result type (e.g. Power(Integer, Integer) with a negative
+	// exponent yields a Decimal); such results are left unfolded.
+	var s string
+	var want types.System
+	switch v := v.(type) {
+	case nil:
+		null := &model.Literal{Expression: model.ResultType(types.Any), Value: "null"}
+		if t == types.Any {
+			return null, true
+		}
+		return &model.As{
+			UnaryExpression: &model.UnaryExpression{Expression: model.ResultType(t), Operand: null},
+			AsTypeSpecifier: t,
+		}, true
+	case bool:
+		s, want = strconv.FormatBool(v), types.Boolean
+	case int32:
+		s, want = strconv.FormatInt(int64(v), 10), types.Integer
+	case int64:
+		s, want = strconv.FormatInt(v, 10)+"L", types.Long
+	case float64:
+		s, want = strconv.FormatFloat(v, 'f', -1, 64), types.Decimal
+	case string:
+		s, want = v, types.String
+	default:
+		return nil, false
+	}
+	if t != want {
+		return nil, false
+	}
+	return &model.Literal{Expression: model.ResultType(t), Value: s}, true
+}
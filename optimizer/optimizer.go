@@ -0,0 +1,102 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package optimizer rewrites parsed CQL libraries between parsing and evaluation, so that they
+// evaluate faster without changing their results. The optimizer runs a sequence of passes, each of
+// which rewrites the libraries in place. It is enabled through cql.ParseConfig.
+package optimizer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+)
+
+// Pass is a single optimization, which rewrites the libraries in place.
+type Pass interface {
+	// Name identifies the pass in errors.
+	Name() string
+	// Run rewrites the libraries. The libraries are all the libraries that will be evaluated
+	// together, so that a pass can follow references between them.
+	Run(ctx context.Context, libs []*model.Library, cfg Config) error
+}
+
+// DefaultPasses are the passes run if Config.Passes is nil, in order. PredicatePushdown runs before
+// CommonSubexpressionExtraction, which could otherwise extract the retrieves out of their queries.
+var DefaultPasses = []Pass{ConstantFolding, PredicatePushdown, DeadDefineElimination, CommonSubexpressionExtraction}
+
+// Config configures Optimize.
+type Config struct {
+	// Passes are run in order. If nil DefaultPasses are run.
+	Passes []Pass
+
+	// Outputs selects the expression definitions whose results are needed, by name or regular
+	// expression. DeadDefineElimination removes every expression and function definition that the
+	// outputs do not depend on. If zero no definitions are removed.
+	Outputs result.DefineFilter
+
+	// DumpDir if set is a directory to which the ELM JSON of every library is written before and
+	// after optimizing, in files named after the library and its version with a .before.json or
+	// .after.json extension, to inspect what the passes changed.
+	DumpDir string
+}
+
+// Optimize runs the passes of the config on the libraries, rewriting them in place.
+func Optimize(ctx context.Context, libs []*model.Library, cfg Config) error {
+	passes := cfg.Passes
+	if passes == nil {
+		passes = DefaultPasses
+	}
+	if err := dump(libs, cfg.DumpDir, "before"); err != nil {
+		return err
+	}
+	for _, p := range passes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.Run(ctx, libs, cfg); err != nil {
+			return fmt.Errorf("optimizer pass %s failed: %w", p.Name(), err)
+		}
+	}
+	return dump(libs, cfg.DumpDir, "after")
+}
+
+// dump writes the ELM JSON of each library to dir, if dir is set.
+func dump(libs []*model.Library, dir, stage string) error {
+	if dir == "" {
+		return nil
+	}
+	for i, lib := range libs {
+		b, err := model.MarshalLibraryJSON(lib)
+		if err != nil {
+			return err
+		}
+		name := "unnamed-" + strconv.Itoa(i)
+		if lib.Identifier != nil {
+			name = lib.Identifier.Qualified
+			if lib.Identifier.Version != "" {
+				name += "-" + lib.Identifier.Version
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+"."+stage+".json"), b, 0644); err != nil {
+			return fmt.Errorf("failed to dump the optimized ELM: %w", err)
+		}
+	}
+	return nil
+}
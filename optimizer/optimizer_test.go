@@ -0,0 +1,452 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimizer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/google/cql/internal/embeddata"
+	"github.com/google/cql/internal/modelinfo"
+	"github.com/google/cql/interpreter"
+	"github.com/google/cql/model"
+	"github.com/google/cql/parser"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestConstantFolding(t *testing.T) {
+	tests := []struct {
+		name string
+		cql  string
+		want model.IExpression
+	}{
+		{
+			name: "Integer arithmetic",
+			cql:  "1 + 2 * 3",
+			want: &model.Literal{Expression: model.ResultType(types.Integer), Value: "7"},
+		},
+		{
+			name: "Implicit conversion to Decimal",
+			cql:  "1.5 + 2",
+			want: &model.Literal{Expression: model.ResultType(types.Decimal), Value: "3.5"},
+		},
+		{
+			name: "Long",
+			cql:  "1L + 2L",
+			want: &model.Literal{Expression: model.ResultType(types.Long), Value: "3L"},
+		},
+		{
+			name: "String",
+			cql:  "'a' + 'b'",
+			want: &model.Literal{Expression: model.ResultType(types.String), Value: "ab"},
+		},
+		{
+			name: "Boolean",
+			cql:  "true and not false",
+			want: &model.Literal{Expression: model.ResultType(types.Boolean), Value: "true"},
+		},
+		{
+			name: "List operand",
+			cql:  "Count({1, 2, 3})",
+			want: &model.Literal{Expression: model.ResultType(types.Integer), Value: "3"},
+		},
+		{
+			name: "Null result",
+			cql:  "1 / 0",
+			want: &model.As{
+				UnaryExpression: &model.UnaryExpression{
+					Expression: model.ResultType(types.Decimal),
+					Operand:    &model.Literal{Expression: model.ResultType(types.Any), Value: "null"},
+				},
+				AsTypeSpecifier: types.Decimal,
+			},
+		},
+		{
+			name: "Parameters are not folded",
+			cql:  "P + (1 + 1)",
+			want: &model.Add{BinaryExpression: &model.BinaryExpression{
+				Expression: model.ResultType(types.Integer),
+				Operands: []model.IExpression{
+					&model.ParameterRef{Expression: model.ResultType(types.Integer), Name: "P"},
+					&model.Literal{Expression: model.ResultType(types.Integer), Value: "2"},
+				},
+			}},
+		},
+		{
+			name: "Results not matching the result type are not folded",
+			cql:  "Power(2, -2)",
+			want: &model.Power{BinaryExpression: &model.BinaryExpression{
+				Expression: model.ResultType(types.Integer),
+				Operands: []model.IExpression{
+					&model.Literal{Expression: model.ResultType(types.Integer), Value: "2"},
+					&model.Literal{Expression: model.ResultType(types.Integer), Value: "-2"},
+				},
+			}},
+		},
+		{
+			name: "Dates are not folded",
+			cql:  "@2024-01-01 = @2024-01-01",
+			want: &model.Equal{BinaryExpression: &model.BinaryExpression{
+				Expression: model.ResultType(types.Boolean),
+				Operands: []model.IExpression{
+					&model.Literal{Expression: model.ResultType(types.Date), Value: "@2024-01-01"},
+					&model.Literal{Expression: model.ResultType(types.Date), Value: "@2024-01-01"},
+				},
+			}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			libs := parseLibs(t, dedent.Dedent(`
+			library TESTLIB version '1.0.0'
+			parameter P Integer default 1
+			define Expr: `+tc.cql))
+			if err := Optimize(context.Background(), libs, Config{Passes: []Pass{ConstantFolding}}); err != nil {
+				t.Fatalf("Optimize() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, def(t, libs[0], "Expr").GetExpression()); diff != "" {
+				t.Errorf("Optimize() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeadDefineElimination(t *testing.T) {
+	cql := []string{
+		dedent.Dedent(`
+		library Helpers version '1.0.0'
+		define Offset: 10
+		define Unused: 1`),
+		dedent.Dedent(`
+		library TESTLIB version '1.0.0'
+		include Helpers version '1.0.0' called H
+		define private Base: 1
+		define function AddBase(x Integer): x + Base
+		define function Unused(x Integer): x
+		define Numerator: AddBase(H.Offset)
+		define Denominator: 2`),
+	}
+	tests := []struct {
+		name    string
+		outputs result.DefineFilter
+		want    map[string][]string
+	}{
+		{
+			name:    "Removes definitions outputs do not depend on",
+			outputs: result.DefineFilter{IncludeNames: []string{"TESTLIB.Numerator"}},
+			want: map[string][]string{
+				"Helpers": {"Offset"},
+				"TESTLIB": {"Base", "AddBase", "Numerator"},
+			},
+		},
+		{
+			name:    "No outputs",
+			outputs: result.DefineFilter{},
+			want: map[string][]string{
+				"Helpers": {"Offset", "Unused"},
+				"TESTLIB": {"Base", "AddBase", "Unused", "Numerator", "Denominator"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			libs := parseLibs(t, cql...)
+			cfg := Config{Passes: []Pass{DeadDefineElimination}, Outputs: tc.outputs}
+			if err := Optimize(context.Background(), libs, cfg); err != nil {
+				t.Fatalf("Optimize() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, defNames(libs)); diff != "" {
+				t.Errorf("Optimize() definitions diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCommonSubexpressionExtraction(t *testing.T) {
+	libs := parseLibs(t, dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	parameter P Integer default 1
+	define A: (P + 1) * 2
+	define B: (P + 1) * 3
+	define C: Count(({1, 2, 3}) X where X > P) + 1
+	define D: Count(({1, 2, 3}) X where X > P) + 2
+	define E: (({1, 2}) X return X + 1) union (({1, 2}) X return X + 1)
+	define function F(x Integer): x + (P + 1)`))
+	if err := Optimize(context.Background(), libs, Config{Passes: []Pass{CommonSubexpressionExtraction}}); err != nil {
+		t.Fatalf("Optimize() returned unexpected error: %v", err)
+	}
+
+	want := map[string][]string{"TESTLIB": {"$cse3", "A", "B", "$cse1", "C", "D", "$cse2", "E", "F"}}
+	if diff := cmp.Diff(want, defNames(libs)); diff != "" {
+		t.Errorf("Optimize() definitions diff (-want +got):\n%s", diff)
+	}
+	ref := func(name string, t types.IType) *model.ExpressionRef {
+		return &model.ExpressionRef{Expression: model.ResultType(t), Name: name}
+	}
+	for name, want := range map[string]model.IExpression{
+		"A":     ref("$cse3", types.Integer),
+		"C":     ref("$cse1", types.Integer),
+		"E[0]":  ref("$cse2", &types.List{ElementType: types.Integer}),
+		"$cse3": nil,
+	} {
+		var got model.IExpression
+		switch name {
+		case "A":
+			got = def(t, libs[0], "A").GetExpression().(*model.Multiply).Operands[0]
+		case "C":
+			got = def(t, libs[0], "C").GetExpression().(*model.Add).Operands[0]
+		case "E[0]":
+			got = def(t, libs[0], "E").GetExpression().(*model.Union).Operands[0]
+		case "$cse3":
+			if _, ok := def(t, libs[0], "$cse3").GetExpression().(*model.Add); !ok {
+				t.Errorf("$cse3 = %v, want P + 1", def(t, libs[0], "$cse3").GetExpression())
+			}
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Optimize() %s diff (-want +got):\n%s", name, diff)
+		}
+	}
+	// Function bodies are not rewritten, since they are not evaluated once.
+	if _, ok := def(t, libs[0], "F").GetExpression().(*model.Add).Operands[1].(*model.Add); !ok {
+		t.Errorf("Optimize() rewrote the body of function F, want it unchanged")
+	}
+}
+
+func TestCommonSubexpressionExtraction_Conditional(t *testing.T) {
+	libs := parseLibs(t, dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	parameter P Boolean default true
+	define A: if false then singleton from {1, 2} + 5 else 0
+	define B: if true then 0 else singleton from {1, 2} + 5
+	define C: case when P then 0 when singleton from {1, 2} + 5 > 0 then 1 else 2 end
+	define D: case when P then 0 when singleton from {1, 2} + 5 > 0 then 1 else 3 end
+	define E: P or singleton from {1, 2} + 5 > 0
+	define F: not P and singleton from {1, 2} + 5 > 0
+	define G: not P implies singleton from {1, 2} + 5 > 0
+	define H: ({} as List<Integer>) X where X > singleton from {1, 2} + 5
+	define I: ({} as List<Integer>) X where X < singleton from {1, 2} + 5`))
+	if err := Optimize(context.Background(), libs, Config{Passes: []Pass{CommonSubexpressionExtraction}}); err != nil {
+		t.Fatalf("Optimize() returned unexpected error: %v", err)
+	}
+	want := map[string][]string{"TESTLIB": {"A", "B", "C", "D", "E", "F", "G", "H", "I"}}
+	if diff := cmp.Diff(want, defNames(libs)); diff != "" {
+		t.Errorf("Optimize() definitions diff (-want +got):\n%s", diff)
+	}
+
+	// The untaken branches still fail if they are evaluated, so the optimized libraries only
+	// evaluate if they are not.
+	cql := dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	define A: if false then singleton from {1, 2} + 5 else 0
+	define B: if true then 0 else singleton from {1, 2} + 5`)
+	wantValues := eval(t, parseLibs(t, cql))
+	libs = parseLibs(t, cql)
+	if err := Optimize(context.Background(), libs, Config{Passes: []Pass{CommonSubexpressionExtraction}}); err != nil {
+		t.Fatalf("Optimize() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(wantValues, eval(t, libs)); diff != "" {
+		t.Errorf("Eval() of the optimized libraries diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPredicatePushdown(t *testing.T) {
+	libs := parseFHIRLibs(t, dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1' called FH
+	valueset "VS": 'https://example.com/vs'
+	parameter "Measurement Period" Interval<DateTime>
+	context Patient
+	define CodeAndDate: [Observation] O where O.status = 'final' and O.code in "VS" and O.effective in "Measurement Period"
+	define CodeOnly: [Condition] C where C.code in "VS"
+	define During: [Encounter] E where E.period during "Measurement Period"
+	define Disjunction: [Observation] O where O.code in "VS" or O.effective in "Measurement Period"
+	define DependsOnQuery: [Observation] O where O.effective in Interval[O.issued, null]
+	define Precision: [Observation] O where O.effective in day of "Measurement Period"
+	define AlreadyFiltered: [Condition: "VS"] C where C.category in "VS"`))
+	if err := Optimize(context.Background(), libs, Config{Passes: []Pass{PredicatePushdown}}); err != nil {
+		t.Fatalf("Optimize() returned unexpected error: %v", err)
+	}
+	// Libraries are sorted so that FHIRHelpers comes first.
+	lib := libs[len(libs)-1]
+
+	tests := []struct {
+		def              string
+		wantCodeProperty string
+		wantCodes        bool
+		wantDateProperty string
+		// wantWhere is the type of the where clause left in the query, or nil if it was removed.
+		wantWhere model.IExpression
+	}{
+		{def: "CodeAndDate", wantCodeProperty: "code", wantCodes: true, wantDateProperty: "effective", wantWhere: &model.And{}},
+		{def: "CodeOnly", wantCodeProperty: "code", wantCodes: true},
+		{def: "During", wantCodeProperty: "type", wantDateProperty: "period", wantWhere: &model.IncludedIn{}},
+		{def: "Disjunction", wantCodeProperty: "code", wantWhere: &model.Or{}},
+		{def: "DependsOnQuery", wantCodeProperty: "code", wantWhere: &model.In{}},
+		{def: "Precision", wantCodeProperty: "code", wantWhere: &model.In{}},
+		{def: "AlreadyFiltered", wantCodeProperty: "code", wantCodes: true, wantWhere: &model.InValueSet{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.def, func(t *testing.T) {
+			q := def(t, lib, tc.def).GetExpression().(*model.Query)
+			r := q.Source[0].Source.(*model.Retrieve)
+			if r.CodeProperty != tc.wantCodeProperty || (r.Codes != nil) != tc.wantCodes || r.DateProperty != tc.wantDateProperty {
+				t.Errorf("Optimize() retrieve has CodeProperty %q, Codes %v and DateProperty %q, want %q, codes %v and %q", r.CodeProperty, r.Codes, r.DateProperty, tc.wantCodeProperty, tc.wantCodes, tc.wantDateProperty)
+			}
+			if (r.DateRange != nil) != (tc.wantDateProperty != "") {
+				t.Errorf("Optimize() retrieve DateRange = %v, want set %v", r.DateRange, tc.wantDateProperty != "")
+			}
+			if reflect.TypeOf(q.Where) != reflect.TypeOf(tc.wantWhere) {
+				t.Errorf("Optimize() where clause = %T, want %T", q.Where, tc.wantWhere)
+			}
+		})
+	}
+
+	// The remaining where clause of CodeAndDate keeps the status and date constraints.
+	where := def(t, lib, "CodeAndDate").GetExpression().(*model.Query).Where.(*model.And)
+	if _, ok := where.Operands[1].(*model.In); !ok {
+		t.Errorf("Optimize() CodeAndDate where clause = %v, want the date constraint kept", where)
+	}
+}
+
+func TestOptimize_SameResults(t *testing.T) {
+	cql := dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	parameter P Integer default 1
+	define A: (P + 1) * (2 + 3)
+	define B: (P + 1) * 3
+	define C: Count(({1, 2, 3}) X where X > P + 0) + 1
+	define D: Count(({1, 2, 3}) X where X > P + 0) + 2
+	define E: Count(({1, 2}) X let Y: P + 1 return X * Y) + Count(({1, 2}) X let Y: P + 1 return X * Y)
+	define F: (({1, 2, 3}) X aggregate R starting 0: R + X) = (({1, 2, 3}) X aggregate R starting 0: R + X)
+	define function G(x Integer): x + (P + 1)
+	define H: G(1) + G(1)
+	define I: 'x' + ToString(1 + 1) + 'y'
+	define J: if 1 > 2 then 'a' else 'b'`)
+	want := eval(t, parseLibs(t, cql))
+
+	libs := parseLibs(t, cql)
+	dumpDir := t.TempDir()
+	if err := Optimize(context.Background(), libs, Config{DumpDir: dumpDir}); err != nil {
+		t.Fatalf("Optimize() returned unexpected error: %v", err)
+	}
+	if !slices.Contains(defNames(libs)["TESTLIB"], "$cse1") {
+		t.Errorf("Optimize() definitions = %v, want the extracted $cse1", defNames(libs))
+	}
+	got := eval(t, libs)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Eval() of the optimized libraries diff (-want +got):\n%s", diff)
+	}
+	for _, f := range []string{"TESTLIB-1.0.0.before.json", "TESTLIB-1.0.0.after.json"} {
+		if _, err := os.Stat(filepath.Join(dumpDir, f)); err != nil {
+			t.Errorf("Optimize() did not dump %s: %v", f, err)
+		}
+	}
+}
+
+func TestOptimize_Error(t *testing.T) {
+	libs := parseLibs(t, "library TESTLIB version '1.0.0' define A: 1")
+	if err := Optimize(context.Background(), libs, Config{DumpDir: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Errorf("Optimize() with a missing dump directory succeeded, want error")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Optimize(ctx, libs, Config{}); err == nil {
+		t.Errorf("Optimize() with a cancelled context succeeded, want error")
+	}
+}
+
+func parseLibs(t *testing.T, cql ...string) []*model.Library {
+	t.Helper()
+	p, err := parser.New(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("parser.New() returned unexpected error: %v", err)
+	}
+	libs, err := p.Libraries(context.Background(), cql, parser.Config{})
+	if err != nil {
+		t.Fatalf("Libraries() returned unexpected error: %v", err)
+	}
+	return libs
+}
+
+func parseFHIRLibs(t *testing.T, cql string) []*model.Library {
+	t.Helper()
+	fhirMI, err := embeddata.ModelInfos.ReadFile("third_party/cqframework/fhir-modelinfo-4.0.1.xml")
+	if err != nil {
+		t.Fatalf("Reading the FHIR model info returned unexpected error: %v", err)
+	}
+	helpers, err := embeddata.FHIRHelpers.ReadFile("third_party/cqframework/FHIRHelpers-4.0.1.cql")
+	if err != nil {
+		t.Fatalf("Reading FHIRHelpers returned unexpected error: %v", err)
+	}
+	p, err := parser.New(context.Background(), [][]byte{fhirMI})
+	if err != nil {
+		t.Fatalf("parser.New() returned unexpected error: %v", err)
+	}
+	libs, err := p.Libraries(context.Background(), []string{cql, string(helpers)}, parser.Config{})
+	if err != nil {
+		t.Fatalf("Libraries() returned unexpected error: %v", err)
+	}
+	return libs
+}
+
+func def(t *testing.T, lib *model.Library, name string) model.IExpressionDef {
+	t.Helper()
+	for _, d := range lib.Statements.Defs {
+		if d.GetName() == name {
+			return d
+		}
+	}
+	t.Fatalf("library %v has no definition %s", lib.Identifier, name)
+	return nil
+}
+
+func defNames(libs []*model.Library) map[string][]string {
+	names := make(map[string][]string)
+	for _, lib := range libs {
+		for _, d := range lib.Statements.Defs {
+			names[lib.Identifier.Qualified] = append(names[lib.Identifier.Qualified], d.GetName())
+		}
+	}
+	return names
+}
+
+// eval returns the value of every public definition of the libraries.
+func eval(t *testing.T, libs []*model.Library) map[string]any {
+	t.Helper()
+	mi, err := modelinfo.New(nil)
+	if err != nil {
+		t.Fatalf("modelinfo.New() returned unexpected error: %v", err)
+	}
+	res, err := interpreter.Eval(context.Background(), libs, interpreter.Config{DataModels: mi})
+	if err != nil {
+		t.Fatalf("interpreter.Eval() returned unexpected error: %v", err)
+	}
+	values := make(map[string]any)
+	for lib, defs := range res {
+		for name, v := range defs {
+			values[lib.Name+"."+name] = v.GolangValue()
+		}
+	}
+	return values
+}
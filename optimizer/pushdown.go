@@ -0,0 +1,206 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimizer
+
+import (
+	"context"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/types"
+)
+
+// PredicatePushdown pushes the code and date constraints of query where clauses into the retrieve
+// the query is over, for queries with a single retrieve source. A constraint that a code property
+// of the source alias is in a ValueSet becomes the retrieve's code filter and is removed from the
+// where clause, so fewer rows reach the query loop. A constraint that a date property of the source
+// alias is in a date range becomes the retrieve's date filter, which lets a
+// retriever.FilteredRetriever return fewer resources; it stays in the where clause, which
+// implements the exact CQL semantics. Only constraints written with FHIRHelpers conversions, as
+// the parser produces for FHIR data, are recognized.
+var PredicatePushdown Pass = predicatePushdown{}
+
+type predicatePushdown struct{}
+
+func (predicatePushdown) Name() string { return "predicate_pushdown" }
+
+func (predicatePushdown) Run(ctx context.Context, libs []*model.Library, _ Config) error {
+	for _, lib := range libs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		helpers := fhirHelpersName(lib)
+		if helpers == "" {
+			continue
+		}
+		model.Walk(lib, func(e model.IExpression) bool {
+			if q, ok := e.(*model.Query); ok {
+				pushDown(q, helpers)
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+// fhirHelpersName returns the local name of the FHIRHelpers library in lib, or "" if lib does not
+// include it.
+func fhirHelpersName(lib *model.Library) string {
+	for _, inc := range lib.Includes {
+		if inc.Identifier != nil && inc.Identifier.Qualified == "FHIRHelpers" {
+			return inc.Identifier.Local
+		}
+	}
+	return ""
+}
+
+func pushDown(q *model.Query, helpers string) {
+	if len(q.Source) != 1 || q.Where == nil {
+		return
+	}
+	r, ok := q.Source[0].Source.(*model.Retrieve)
+	if !ok {
+		return
+	}
+	alias := q.Source[0].Alias
+	for _, c := range conjuncts(q.Where) {
+		if r.Codes == nil {
+			if property, vs, ok := codeConstraint(c, alias, helpers); ok {
+				r.CodeProperty, r.Codes = property, vs
+				q.Where = removeConjunct(q.Where, c)
+				continue
+			}
+		}
+		if r.DateRange == nil {
+			if property, rng, ok := dateConstraint(c, alias, helpers); ok {
+				r.DateProperty, r.DateRange = property, rng
+			}
+		}
+	}
+}
+
+// conjuncts returns the operands of the tree of Ands e, or e itself if it is not an And.
+func conjuncts(e model.IExpression) []model.IExpression {
+	and, ok := e.(*model.And)
+	if !ok {
+		return []model.IExpression{e}
+	}
+	return append(conjuncts(and.Operands[0]), conjuncts(and.Operands[1])...)
+}
+
+// removeConjunct returns the tree of Ands e without the operand c, or nil if e is c. The remaining
+// nodes are kept, so they keep their locators.
+func removeConjunct(e, c model.IExpression) model.IExpression {
+	if e == c {
+		return nil
+	}
+	and, ok := e.(*model.And)
+	if !ok {
+		return e
+	}
+	l, r := removeConjunct(and.Operands[0], c), removeConjunct(and.Operands[1], c)
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	and.Operands[0], and.Operands[1] = l, r
+	return and
+}
+
+// codeConstraint matches `alias.property in ValueSet`, where property is a CodeableConcept, and
+// returns the property and the ValueSet.
+func codeConstraint(c model.IExpression, alias, helpers string) (string, model.IExpression, bool) {
+	in, ok := c.(*model.InValueSet)
+	if !ok {
+		return "", nil, false
+	}
+	vs, ok := in.Operands[1].(*model.ValuesetRef)
+	if !ok {
+		return "", nil, false
+	}
+	arg, ok := helperCall(in.Operands[0], helpers, "ToConcept")
+	if !ok {
+		return "", nil, false
+	}
+	p, ok := arg.(*model.Property)
+	if !ok || !isAliasProperty(p, alias) {
+		return "", nil, false
+	}
+	return p.Path, vs, true
+}
+
+// dateConstraint matches `alias.property in range` and `alias.property during range`, where
+// property is a date, dateTime, instant or Period and range is an interval of dates that does not
+// depend on the query, and returns the property and the range.
+func dateConstraint(c model.IExpression, alias, helpers string) (string, model.IExpression, bool) {
+	var operands []model.IExpression
+	var conversions []string
+	switch c := c.(type) {
+	case *model.In:
+		if c.Precision != model.UNSETDATETIMEPRECISION {
+			return "", nil, false
+		}
+		operands, conversions = c.Operands, []string{"ToDateTime", "ToDate"}
+	case *model.IncludedIn:
+		if c.Precision != model.UNSETDATETIMEPRECISION {
+			return "", nil, false
+		}
+		operands, conversions = c.Operands, []string{"ToInterval"}
+	default:
+		return "", nil, false
+	}
+
+	rng := operands[1]
+	t, ok := rng.GetResultType().(*types.Interval)
+	if !ok || (t.PointType != types.DateTime && t.PointType != types.Date) || !closed(rng) {
+		return "", nil, false
+	}
+	arg, ok := helperCall(operands[0], helpers, conversions...)
+	if !ok {
+		return "", nil, false
+	}
+	// Choice typed properties are cast to one of their types first.
+	if as, ok := arg.(*model.As); ok {
+		arg = as.Operand
+	}
+	p, ok := arg.(*model.Property)
+	if !ok || !isAliasProperty(p, alias) {
+		return "", nil, false
+	}
+	return p.Path, rng, true
+}
+
+// helperCall returns the operand of e if e calls one of the named single operand FHIRHelpers
+// functions. Implicit conversions inserted by the parser reference FHIRHelpers by its qualified
+// name, explicit calls by its local name.
+func helperCall(e model.IExpression, helpers string, names ...string) (model.IExpression, bool) {
+	f, ok := e.(*model.FunctionRef)
+	if !ok || (f.LibraryName != helpers && f.LibraryName != "FHIRHelpers") || len(f.Operands) != 1 {
+		return nil, false
+	}
+	for _, n := range names {
+		if f.Name == n {
+			return f.Operands[0], true
+		}
+	}
+	return nil, false
+}
+
+// isAliasProperty returns true if p is a top level property of the query alias.
+func isAliasProperty(p *model.Property, alias string) bool {
+	ref, ok := p.Source.(*model.AliasRef)
+	return ok && ref.Name == alias && p.Path != ""
+}
@@ -16,6 +16,7 @@ package parser
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -24,6 +25,7 @@ import (
 	"github.com/google/cql/internal/datehelpers"
 	"github.com/google/cql/internal/embeddata/third_party/cqframework/cql"
 	"github.com/google/cql/model"
+	"github.com/google/cql/result"
 	"github.com/google/cql/types"
 	"github.com/antlr4-go/antlr/v4"
 )
@@ -153,9 +155,34 @@ func (v *visitor) VisitExpression(tree antlr.Tree) model.IExpression {
 		return invalidExpression{ParsingError: pe, Expression: model.ResultType(types.Any)}
 	}
 
+	v.recordLocator(m, tree)
 	return m
 }
 
+// recordLocator records the source location of the expression m parsed from tree. Expressions that
+// wrap a single child, like parentheses, return the model of their child, in which case the
+// innermost location is kept.
+func (v *visitor) recordLocator(m model.IExpression, tree antlr.Tree) {
+	ctx, ok := tree.(antlr.ParserRuleContext)
+	if v.locators == nil || !ok || reflect.ValueOf(m).Kind() != reflect.Pointer {
+		return
+	}
+	if _, ok := v.locators[m]; ok {
+		return
+	}
+	start, stop := ctx.GetStart(), ctx.GetStop()
+	if start == nil || stop == nil {
+		return
+	}
+	v.locators[m] = result.Locator{
+		Library:   v.libKey,
+		StartLine: start.GetLine(),
+		StartCol:  start.GetColumn() + 1,
+		EndLine:   stop.GetLine(),
+		EndCol:    stop.GetColumn() + len(stop.GetText()),
+	}
+}
+
 // parseSTRING removes surrounding quotes from a STRING node that was produced using
 // a call to `STRING()`. Grammar defined at https://cql.hl7.org/19-l-cqlsyntaxdiagrams.html#STRING.
 func parseSTRING(n antlr.TerminalNode) string {
@@ -401,7 +428,7 @@ func (v *visitor) VisitQuantityContext(ctx cql.IQuantityContext) (model.Quantity
 		}
 		return model.Quantity{Value: d, Unit: u, Expression: model.ResultType(types.Quantity)}, nil
 	}
-	fmt.Printf("Warning, parser found a quantity literal declaration with a UCUM unit value, these are not currently validated. got unit: %q", unitContext.STRING())
+	// UCUM units are not currently validated.
 	return model.Quantity{Value: d, Unit: model.Unit(parseSTRING(unitContext.STRING())), Expression: model.ResultType(types.Quantity)}, nil
 }
 
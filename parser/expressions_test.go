@@ -18,6 +18,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"strings"
 	"testing"
 
@@ -855,6 +857,30 @@ func TestParserExpressions(t *testing.T) {
 	}
 }
 
+func TestParserExpressions_NoStdout(t *testing.T) {
+	// The parser must not write to stdout, which programs using it may use for results.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe() returned unexpected error: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	_, err = newFHIRParser(t).Libraries(context.Background(), wrapInLib(t, "5 'mg'"), Config{})
+	w.Close()
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	if got := <-out; len(got) != 0 {
+		t.Errorf("Parse wrote %q to stdout, want nothing", got)
+	}
+}
+
 func TestParserExpressions_SingleLibrary(t *testing.T) {
 	tests := []struct {
 		name string
@@ -563,4 +563,9 @@ type visitor struct {
 
 	// Accumulated parsing errors to be returned to the caller.
 	errors parsingErrors
+
+	// libKey is the library being parsed, and locators collects the source location of each parsed
+	// expression. If locators is nil locations are not collected.
+	libKey   result.LibKey
+	locators map[model.IExpression]result.Locator
 }
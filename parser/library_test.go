@@ -1939,6 +1939,16 @@ func TestParameters(t *testing.T) {
 					Name:    "lit",
 					Library: result.LibKey{Name: "Highly.Qualified", Version: "1.0"}}: model.NewLiteral("Hello", types.String)},
 		},
+		{
+			name: "Literal String with whitespace",
+			passedParams: map[result.DefKey]string{
+				result.DefKey{Name: "lit", Library: result.LibKey{Name: "Highly.Qualified", Version: "1.0"}}: "'Hello  World'",
+			},
+			want: map[result.DefKey]model.IExpression{
+				result.DefKey{
+					Name:    "lit",
+					Library: result.LibKey{Name: "Highly.Qualified", Version: "1.0"}}: model.NewLiteral("Hello  World", types.String)},
+		},
 		{
 			name: "List",
 			passedParams: map[result.DefKey]string{
@@ -2621,3 +2631,44 @@ func TestRealisticCQL(t *testing.T) {
 		})
 	}
 }
+
+func TestLocators(t *testing.T) {
+	cql := "library TESTLIB version '1.0.0'\ndefine TESTRESULT: (1 + 20) * 3"
+	p := newFHIRParser(t)
+	parsedLibs, err := p.Libraries(context.Background(), []string{cql}, Config{})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	multiply, ok := getTESTRESULTModel(t, parsedLibs).(*model.Multiply)
+	if !ok {
+		t.Fatalf("TESTRESULT = %T, want *model.Multiply", getTESTRESULTModel(t, parsedLibs))
+	}
+	add := multiply.Operands[0].(*model.Add)
+
+	lib := result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	loc := func(startCol, endCol int) result.Locator {
+		return result.Locator{Library: lib, StartLine: 2, StartCol: startCol, EndLine: 2, EndCol: endCol}
+	}
+	tests := []struct {
+		name string
+		expr model.IExpression
+		want result.Locator
+	}{
+		{name: "Multiply", expr: multiply, want: loc(20, 31)},
+		{name: "Parenthesized Add", expr: add, want: loc(21, 26)},
+		{name: "Left of Add", expr: add.Operands[0], want: loc(21, 21)},
+		{name: "Right of Add", expr: add.Operands[1], want: loc(25, 26)},
+		{name: "Right of Multiply", expr: multiply.Operands[1], want: loc(31, 31)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := p.Locators()[tc.expr]
+			if !ok {
+				t.Fatalf("Locators() has no locator for %v", tc.expr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Locators() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -1963,6 +1963,48 @@ func (p *Parser) loadSystemOperators() error {
 				}
 			},
 		},
+		{
+			name: "Subsumes",
+			operands: [][]types.IType{
+				{types.Code, types.Code},
+				{types.Concept, types.Concept},
+			},
+			model: func() model.IExpression {
+				return &model.Subsumes{
+					BinaryExpression: &model.BinaryExpression{
+						Expression: model.ResultType(types.Boolean),
+					},
+				}
+			},
+		},
+		{
+			name: "Translate",
+			operands: [][]types.IType{
+				{types.Code, types.String},
+				{types.Code, types.String, types.String},
+			},
+			model: func() model.IExpression {
+				return &model.Translate{
+					NaryExpression: &model.NaryExpression{
+						Expression: model.ResultType(&types.List{ElementType: types.Code}),
+					},
+				}
+			},
+		},
+		{
+			name: "SubsumedBy",
+			operands: [][]types.IType{
+				{types.Code, types.Code},
+				{types.Concept, types.Concept},
+			},
+			model: func() model.IExpression {
+				return &model.SubsumedBy{
+					BinaryExpression: &model.BinaryExpression{
+						Expression: model.ResultType(types.Boolean),
+					},
+				}
+			},
+		},
 		{
 			// ERRORS AND MESSAGING - https://cql.hl7.org/09-b-cqlreference.html#errors-and-messaging
 			// The ELM for `Message` is states that all arguments besides the Source are optional.
@@ -1630,3 +1630,14 @@ func TestBuiltInFunctions(t *testing.T) {
 		})
 	}
 }
+
+func TestSystemOperators(t *testing.T) {
+	ops := newFHIRParser(t).SystemOperators()
+	want := [][]types.IType{{types.Boolean, types.Boolean}}
+	if diff := cmp.Diff(want, ops["And"]); diff != "" {
+		t.Errorf("SystemOperators()[And] diff (-want +got):\n%s", diff)
+	}
+	if _, ok := ops["CalculateAgeInYearsAt"]; !ok {
+		t.Errorf("SystemOperators() = %v, want an entry for CalculateAgeInYearsAt", ops)
+	}
+}
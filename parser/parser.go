@@ -26,6 +26,7 @@ import (
 	"github.com/google/cql/internal/reference"
 	"github.com/google/cql/model"
 	"github.com/google/cql/result"
+	"github.com/google/cql/types"
 	"github.com/antlr4-go/antlr/v4"
 	"gopkg.in/gyuho/goraph.v2"
 )
@@ -58,6 +59,8 @@ func New(ctx context.Context, dataModels [][]byte) (*Parser, error) {
 type Parser struct {
 	modelInfo *modelinfo.ModelInfos
 	refs      *reference.Resolver[func() model.IExpression, func() model.IExpression]
+	// locators holds the source location of the expressions parsed by the last call to Libraries.
+	locators map[model.IExpression]result.Locator
 }
 
 // DataModel returns the parsed model info.
@@ -66,6 +69,12 @@ func (p *Parser) DataModel() *modelinfo.ModelInfos {
 	return p.modelInfo
 }
 
+// SystemOperators returns the operand types of every overload of the built-in CQL functions and
+// operators, keyed by name. This is useful for tooling such as editor completion.
+func (p *Parser) SystemOperators() map[string][][]types.IType {
+	return p.refs.BuiltinFuncs()
+}
+
 // Libraries parses the CQL libraries into a list of model.Library or an error.
 // Underlying parsing issues will return a ParsingErrors struct that users can check for and
 // report to the user accordingly.
@@ -76,6 +85,7 @@ func (p *Parser) Libraries(ctx context.Context, cqlLibs []string, config Config)
 	}
 
 	p.refs.ClearDefs()
+	p.locators = make(map[model.IExpression]result.Locator)
 	sortedLibraries, err := p.topologicalSortLibraries(cqlLibs)
 	if err != nil {
 		// TODO: b/301606416 Return errors with library name from topological sort.
@@ -89,6 +99,8 @@ func (p *Parser) Libraries(ctx context.Context, cqlLibs []string, config Config)
 			errors:         &LibraryErrors{LibKey: lexedLib.key},
 			modelInfo:      p.modelInfo,
 			refs:           p.refs,
+			libKey:         lexedLib.key,
+			locators:       p.locators,
 		}
 		lib := vis.VisitLibrary(lexedLib.ctx)
 		if len(vis.errors.Unwrap()) > 0 {
@@ -99,6 +111,13 @@ func (p *Parser) Libraries(ctx context.Context, cqlLibs []string, config Config)
 	return libs, nil
 }
 
+// Locators returns the location in the CQL source of the expressions parsed by the last call to
+// Libraries, keyed by the model of the expression. Expressions that are implied by the CQL, such as
+// implicit conversions, do not have a location.
+func (p *Parser) Locators() map[model.IExpression]result.Locator {
+	return p.locators
+}
+
 type lexedLib struct {
 	key result.LibKey
 	ctx cql.ILibraryContext
@@ -225,8 +244,9 @@ func (p *Parser) parameter(key result.DefKey, input string) (model.IExpression,
 	}
 
 	// Remove whitespace and check if the input string is equal to to the parsed string. This ensures
-	// there is no extraneous input that the parser did not match.
-	if strings.Join(strings.Fields(input), "") != t.GetText() {
+	// there is no extraneous input that the parser did not match. Whitespace is removed from both,
+	// since the text of string literals keeps theirs.
+	if strings.Join(strings.Fields(input), "") != strings.Join(strings.Fields(t.GetText()), "") {
 		return nil, &ParameterErrors{
 			DefKey: key,
 			Errors: []*ParsingError{{Message: "must be a single literal"}},
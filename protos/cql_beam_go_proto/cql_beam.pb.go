@@ -22,6 +22,66 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// The phase of CQL processing in which an error occurred.
+type BeamError_Stage int32
+
+const (
+	BeamError_STAGE_UNSPECIFIED BeamError_Stage = 0
+	// Reading the input, such as a file or a FHIR store.
+	BeamError_LOAD BeamError_Stage = 1
+	// Parsing the input into FHIR resources and bundles.
+	BeamError_PARSE BeamError_Stage = 2
+	// Evaluating the CQL.
+	BeamError_EVAL BeamError_Stage = 3
+	// Converting and writing the results.
+	BeamError_WRITE BeamError_Stage = 4
+)
+
+// Enum value maps for BeamError_Stage.
+var (
+	BeamError_Stage_name = map[int32]string{
+		0: "STAGE_UNSPECIFIED",
+		1: "LOAD",
+		2: "PARSE",
+		3: "EVAL",
+		4: "WRITE",
+	}
+	BeamError_Stage_value = map[string]int32{
+		"STAGE_UNSPECIFIED": 0,
+		"LOAD":              1,
+		"PARSE":             2,
+		"EVAL":              3,
+		"WRITE":             4,
+	}
+)
+
+func (x BeamError_Stage) Enum() *BeamError_Stage {
+	p := new(BeamError_Stage)
+	*p = x
+	return p
+}
+
+func (x BeamError_Stage) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (BeamError_Stage) Descriptor() protoreflect.EnumDescriptor {
+	return file_protos_cql_beam_proto_enumTypes[0].Descriptor()
+}
+
+func (BeamError_Stage) Type() protoreflect.EnumType {
+	return &file_protos_cql_beam_proto_enumTypes[0]
+}
+
+func (x BeamError_Stage) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use BeamError_Stage.Descriptor instead.
+func (BeamError_Stage) EnumDescriptor() ([]byte, []int) {
+	return file_protos_cql_beam_proto_rawDescGZIP(), []int{1, 0}
+}
+
 // The results of the evaluated CQL for a particular id and timestamp.
 type BeamResult struct {
 	state         protoimpl.MessageState
@@ -34,6 +94,9 @@ type BeamResult struct {
 	EvaluationTimestamp *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=evaluation_timestamp,json=evaluationTimestamp,proto3,oneof" json:"evaluation_timestamp,omitempty"`
 	// The result of the CQL evaluation.
 	Result *cql_result_go_proto.Libraries `protobuf:"bytes,3,opt,name=result,proto3,oneof" json:"result,omitempty"`
+	// The name of the set of CQL libraries evaluated, when a pipeline evaluates
+	// several independent sets such as one for each measure.
+	LibrarySet *string `protobuf:"bytes,4,opt,name=library_set,json=librarySet,proto3,oneof" json:"library_set,omitempty"`
 }
 
 func (x *BeamResult) Reset() {
@@ -89,6 +152,13 @@ func (x *BeamResult) GetResult() *cql_result_go_proto.Libraries {
 	return nil
 }
 
+func (x *BeamResult) GetLibrarySet() string {
+	if x != nil && x.LibrarySet != nil {
+		return *x.LibrarySet
+	}
+	return ""
+}
+
 // Indicates an error that occured at some phase of CQL processing.
 type BeamError struct {
 	state         protoimpl.MessageState
@@ -100,6 +170,17 @@ type BeamError struct {
 	// A URI referencing the error's source. This could be a file path to a
 	// malformed input, resource ID, or other item.
 	SourceUri *string `protobuf:"bytes,2,opt,name=source_uri,json=sourceUri,proto3,oneof" json:"source_uri,omitempty"`
+	// The phase of CQL processing in which the error occurred.
+	Stage *BeamError_Stage `protobuf:"varint,3,opt,name=stage,proto3,enum=google.cql.proto.BeamError_Stage,oneof" json:"stage,omitempty"`
+	// The 1-based line within source_uri of the input that failed, for line
+	// based inputs such as NDJSON files. Unset if the whole source failed.
+	SourceLine *int64 `protobuf:"varint,4,opt,name=source_line,json=sourceLine,proto3,oneof" json:"source_line,omitempty"`
+	// The id of the patient whose input failed, if known. Together with
+	// source_uri this identifies the input to replay.
+	PatientId *string `protobuf:"bytes,5,opt,name=patient_id,json=patientId,proto3,oneof" json:"patient_id,omitempty"`
+	// The name of the set of CQL libraries whose evaluation failed, when a
+	// pipeline evaluates several independent sets.
+	LibrarySet *string `protobuf:"bytes,6,opt,name=library_set,json=librarySet,proto3,oneof" json:"library_set,omitempty"`
 }
 
 func (x *BeamError) Reset() {
@@ -148,6 +229,34 @@ func (x *BeamError) GetSourceUri() string {
 	return ""
 }
 
+func (x *BeamError) GetStage() BeamError_Stage {
+	if x != nil && x.Stage != nil {
+		return *x.Stage
+	}
+	return BeamError_STAGE_UNSPECIFIED
+}
+
+func (x *BeamError) GetSourceLine() int64 {
+	if x != nil && x.SourceLine != nil {
+		return *x.SourceLine
+	}
+	return 0
+}
+
+func (x *BeamError) GetPatientId() string {
+	if x != nil && x.PatientId != nil {
+		return *x.PatientId
+	}
+	return ""
+}
+
+func (x *BeamError) GetLibrarySet() string {
+	if x != nil && x.LibrarySet != nil {
+		return *x.LibrarySet
+	}
+	return ""
+}
+
 var File_protos_cql_beam_proto protoreflect.FileDescriptor
 
 var file_protos_cql_beam_proto_rawDesc = []byte{
@@ -157,7 +266,7 @@ var file_protos_cql_beam_proto_rawDesc = []byte{
 	0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73,
 	0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x17, 0x70, 0x72, 0x6f, 0x74,
 	0x6f, 0x73, 0x2f, 0x63, 0x71, 0x6c, 0x5f, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x2e, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x22, 0xda, 0x01, 0x0a, 0x0a, 0x42, 0x65, 0x61, 0x6d, 0x52, 0x65, 0x73, 0x75,
+	0x6f, 0x74, 0x6f, 0x22, 0x90, 0x02, 0x0a, 0x0a, 0x42, 0x65, 0x61, 0x6d, 0x52, 0x65, 0x73, 0x75,
 	0x6c, 0x74, 0x12, 0x13, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x48, 0x00,
 	0x52, 0x02, 0x69, 0x64, 0x88, 0x01, 0x01, 0x12, 0x52, 0x0a, 0x14, 0x65, 0x76, 0x61, 0x6c, 0x75,
 	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18,
@@ -168,21 +277,43 @@ var file_protos_cql_beam_proto_rawDesc = []byte{
 	0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x67, 0x6f,
 	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x63, 0x71, 0x6c, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x4c,
 	0x69, 0x62, 0x72, 0x61, 0x72, 0x69, 0x65, 0x73, 0x48, 0x02, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75,
-	0x6c, 0x74, 0x88, 0x01, 0x01, 0x42, 0x05, 0x0a, 0x03, 0x5f, 0x69, 0x64, 0x42, 0x17, 0x0a, 0x15,
-	0x5f, 0x65, 0x76, 0x61, 0x6c, 0x75, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x74, 0x69, 0x6d, 0x65,
-	0x73, 0x74, 0x61, 0x6d, 0x70, 0x42, 0x09, 0x0a, 0x07, 0x5f, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74,
-	0x22, 0x7a, 0x0a, 0x09, 0x42, 0x65, 0x61, 0x6d, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x28, 0x0a,
-	0x0d, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x09, 0x48, 0x00, 0x52, 0x0c, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x4d, 0x65, 0x73,
-	0x73, 0x61, 0x67, 0x65, 0x88, 0x01, 0x01, 0x12, 0x22, 0x0a, 0x0a, 0x73, 0x6f, 0x75, 0x72, 0x63,
-	0x65, 0x5f, 0x75, 0x72, 0x69, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x48, 0x01, 0x52, 0x09, 0x73,
-	0x6f, 0x75, 0x72, 0x63, 0x65, 0x55, 0x72, 0x69, 0x88, 0x01, 0x01, 0x42, 0x10, 0x0a, 0x0e, 0x5f,
-	0x65, 0x72, 0x72, 0x6f, 0x72, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x42, 0x0d, 0x0a,
-	0x0b, 0x5f, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x5f, 0x75, 0x72, 0x69, 0x42, 0x32, 0x50, 0x01,
-	0x5a, 0x2e, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x67, 0x6f, 0x6f,
-	0x67, 0x6c, 0x65, 0x2f, 0x63, 0x71, 0x6c, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2f, 0x63,
-	0x71, 0x6c, 0x5f, 0x62, 0x65, 0x61, 0x6d, 0x5f, 0x67, 0x6f, 0x5f, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6c, 0x74, 0x88, 0x01, 0x01, 0x12, 0x24, 0x0a, 0x0b, 0x6c, 0x69, 0x62, 0x72, 0x61, 0x72, 0x79,
+	0x5f, 0x73, 0x65, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x48, 0x03, 0x52, 0x0a, 0x6c, 0x69,
+	0x62, 0x72, 0x61, 0x72, 0x79, 0x53, 0x65, 0x74, 0x88, 0x01, 0x01, 0x42, 0x05, 0x0a, 0x03, 0x5f,
+	0x69, 0x64, 0x42, 0x17, 0x0a, 0x15, 0x5f, 0x65, 0x76, 0x61, 0x6c, 0x75, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x42, 0x09, 0x0a, 0x07, 0x5f,
+	0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x42, 0x0e, 0x0a, 0x0c, 0x5f, 0x6c, 0x69, 0x62, 0x72, 0x61,
+	0x72, 0x79, 0x5f, 0x73, 0x65, 0x74, 0x22, 0xab, 0x03, 0x0a, 0x09, 0x42, 0x65, 0x61, 0x6d, 0x45,
+	0x72, 0x72, 0x6f, 0x72, 0x12, 0x28, 0x0a, 0x0d, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x5f, 0x6d, 0x65,
+	0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x48, 0x00, 0x52, 0x0c, 0x65,
+	0x72, 0x72, 0x6f, 0x72, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x88, 0x01, 0x01, 0x12, 0x22,
+	0x0a, 0x0a, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x5f, 0x75, 0x72, 0x69, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x48, 0x01, 0x52, 0x09, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x55, 0x72, 0x69, 0x88,
+	0x01, 0x01, 0x12, 0x3c, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x67, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0e, 0x32, 0x21, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x63, 0x71, 0x6c, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x2e, 0x42, 0x65, 0x61, 0x6d, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x53,
+	0x74, 0x61, 0x67, 0x65, 0x48, 0x02, 0x52, 0x05, 0x73, 0x74, 0x61, 0x67, 0x65, 0x88, 0x01, 0x01,
+	0x12, 0x24, 0x0a, 0x0b, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x5f, 0x6c, 0x69, 0x6e, 0x65, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x03, 0x48, 0x03, 0x52, 0x0a, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x4c,
+	0x69, 0x6e, 0x65, 0x88, 0x01, 0x01, 0x12, 0x22, 0x0a, 0x0a, 0x70, 0x61, 0x74, 0x69, 0x65, 0x6e,
+	0x74, 0x5f, 0x69, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x48, 0x04, 0x52, 0x09, 0x70, 0x61,
+	0x74, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x88, 0x01, 0x01, 0x12, 0x24, 0x0a, 0x0b, 0x6c, 0x69,
+	0x62, 0x72, 0x61, 0x72, 0x79, 0x5f, 0x73, 0x65, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x48,
+	0x05, 0x52, 0x0a, 0x6c, 0x69, 0x62, 0x72, 0x61, 0x72, 0x79, 0x53, 0x65, 0x74, 0x88, 0x01, 0x01,
+	0x22, 0x48, 0x0a, 0x05, 0x53, 0x74, 0x61, 0x67, 0x65, 0x12, 0x15, 0x0a, 0x11, 0x53, 0x54, 0x41,
+	0x47, 0x45, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00,
+	0x12, 0x08, 0x0a, 0x04, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x01, 0x12, 0x09, 0x0a, 0x05, 0x50, 0x41,
+	0x52, 0x53, 0x45, 0x10, 0x02, 0x12, 0x08, 0x0a, 0x04, 0x45, 0x56, 0x41, 0x4c, 0x10, 0x03, 0x12,
+	0x09, 0x0a, 0x05, 0x57, 0x52, 0x49, 0x54, 0x45, 0x10, 0x04, 0x42, 0x10, 0x0a, 0x0e, 0x5f, 0x65,
+	0x72, 0x72, 0x6f, 0x72, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x42, 0x0d, 0x0a, 0x0b,
+	0x5f, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x5f, 0x75, 0x72, 0x69, 0x42, 0x08, 0x0a, 0x06, 0x5f,
+	0x73, 0x74, 0x61, 0x67, 0x65, 0x42, 0x0e, 0x0a, 0x0c, 0x5f, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65,
+	0x5f, 0x6c, 0x69, 0x6e, 0x65, 0x42, 0x0d, 0x0a, 0x0b, 0x5f, 0x70, 0x61, 0x74, 0x69, 0x65, 0x6e,
+	0x74, 0x5f, 0x69, 0x64, 0x42, 0x0e, 0x0a, 0x0c, 0x5f, 0x6c, 0x69, 0x62, 0x72, 0x61, 0x72, 0x79,
+	0x5f, 0x73, 0x65, 0x74, 0x42, 0x32, 0x50, 0x01, 0x5a, 0x2e, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62,
+	0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x63, 0x71, 0x6c, 0x2f,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2f, 0x63, 0x71, 0x6c, 0x5f, 0x62, 0x65, 0x61, 0x6d, 0x5f,
+	0x67, 0x6f, 0x5f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -197,21 +328,24 @@ func file_protos_cql_beam_proto_rawDescGZIP() []byte {
 	return file_protos_cql_beam_proto_rawDescData
 }
 
+var file_protos_cql_beam_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
 var file_protos_cql_beam_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
 var file_protos_cql_beam_proto_goTypes = []interface{}{
-	(*BeamResult)(nil),                    // 0: google.cql.proto.BeamResult
-	(*BeamError)(nil),                     // 1: google.cql.proto.BeamError
-	(*timestamppb.Timestamp)(nil),         // 2: google.protobuf.Timestamp
-	(*cql_result_go_proto.Libraries)(nil), // 3: google.cql.proto.Libraries
+	(BeamError_Stage)(0),                  // 0: google.cql.proto.BeamError.Stage
+	(*BeamResult)(nil),                    // 1: google.cql.proto.BeamResult
+	(*BeamError)(nil),                     // 2: google.cql.proto.BeamError
+	(*timestamppb.Timestamp)(nil),         // 3: google.protobuf.Timestamp
+	(*cql_result_go_proto.Libraries)(nil), // 4: google.cql.proto.Libraries
 }
 var file_protos_cql_beam_proto_depIdxs = []int32{
-	2, // 0: google.cql.proto.BeamResult.evaluation_timestamp:type_name -> google.protobuf.Timestamp
-	3, // 1: google.cql.proto.BeamResult.result:type_name -> google.cql.proto.Libraries
-	2, // [2:2] is the sub-list for method output_type
-	2, // [2:2] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	3, // 0: google.cql.proto.BeamResult.evaluation_timestamp:type_name -> google.protobuf.Timestamp
+	4, // 1: google.cql.proto.BeamResult.result:type_name -> google.cql.proto.Libraries
+	0, // 2: google.cql.proto.BeamError.stage:type_name -> google.cql.proto.BeamError.Stage
+	3, // [3:3] is the sub-list for method output_type
+	3, // [3:3] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_protos_cql_beam_proto_init() }
@@ -252,13 +386,14 @@ func file_protos_cql_beam_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_protos_cql_beam_proto_rawDesc,
-			NumEnums:      0,
+			NumEnums:      1,
 			NumMessages:   2,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_protos_cql_beam_proto_goTypes,
 		DependencyIndexes: file_protos_cql_beam_proto_depIdxs,
+		EnumInfos:         file_protos_cql_beam_proto_enumTypes,
 		MessageInfos:      file_protos_cql_beam_proto_msgTypes,
 	}.Build()
 	File_protos_cql_beam_proto = out.File
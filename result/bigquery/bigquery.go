@@ -0,0 +1,440 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bigquery writes CQL evaluation results to BigQuery. The table schema is derived from the
+// static result types of the parsed libraries' definitions, so tables can be created before any
+// results exist. Each evaluated subject becomes one row, with one column per definition.
+//
+// Mapping converts results into rows implementing bigquery.ValueSaver, so it can be used with any
+// BigQuery inserter, for example from within a Beam DoFn. Writer streams rows into a table.
+package bigquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	bq "cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/google/cql/internal/resultcolumns"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+	"google.golang.org/api/googleapi"
+)
+
+// IDColumn is the name of the column holding the ID of the evaluated subject.
+const IDColumn = "id"
+
+// Mapping maps the results of a set of CQL libraries to rows of a BigQuery table.
+//
+// Booleans, Integers, Longs, Decimals, Strings, Dates, DateTimes and Times map to the matching
+// BigQuery type. Quantities, Ratios, Codes, Concepts, Intervals and Tuples map to RECORDs of their
+// fields, and Lists to REPEATED fields with null elements omitted. ValueSets and CodeSystems map
+// to their canonical URL. All other types, such as FHIR resources, choice types and Lists of Lists,
+// map to a STRING holding their result JSON.
+//
+// Column names are the definition names with characters BigQuery does not allow replaced by
+// underscores. If several libraries have a definition with the same column name the columns are
+// prefixed with the library name.
+type Mapping struct {
+	schema  bq.Schema
+	columns []column
+}
+
+type column struct {
+	name    string
+	library result.LibKey
+	def     string
+	typ     types.IType
+}
+
+// NewMapping returns the Mapping for the definitions in resultTypes, as returned by
+// cql.ELM.ResultTypes.
+func NewMapping(resultTypes map[result.LibKey]map[string]types.IType) (*Mapping, error) {
+	counts := make(map[string]int)
+	var columns []column
+	for lib, defs := range resultTypes {
+		for def, t := range defs {
+			name := columnName(def)
+			counts[name]++
+			columns = append(columns, column{name: name, library: lib, def: def, typ: t})
+		}
+	}
+	seen := map[string]bool{IDColumn: true}
+	for i, c := range columns {
+		if counts[c.name] > 1 || c.name == IDColumn {
+			columns[i].name = columnName(c.library.Name) + "_" + c.name
+		}
+		if seen[columns[i].name] {
+			return nil, fmt.Errorf("duplicate BigQuery column %s", columns[i].name)
+		}
+		seen[columns[i].name] = true
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+
+	schema := bq.Schema{{Name: IDColumn, Type: bq.StringFieldType, Required: true}}
+	for _, c := range columns {
+		f := field(c.name, c.typ)
+		f.Description = fmt.Sprintf("%s.%s (%v)", c.library, c.def, c.typ)
+		schema = append(schema, f)
+	}
+	return &Mapping{schema: schema, columns: columns}, nil
+}
+
+// Schema returns the BigQuery table schema.
+func (m *Mapping) Schema() bq.Schema {
+	return m.schema
+}
+
+// Row converts the results of the subject with the given ID into a row. Definitions missing from
+// the results are null. The subject ID is used as the insert ID, so that BigQuery can deduplicate
+// retried inserts.
+func (m *Mapping) Row(id string, libs result.Libraries) (*Row, error) {
+	values := map[string]bq.Value{IDColumn: id}
+	for _, c := range m.columns {
+		v, ok := libs[c.library][c.def]
+		if !ok {
+			continue
+		}
+		bv, err := value(c.typ, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", c.library, c.def, err)
+		}
+		if bv != nil {
+			values[c.name] = bv
+		}
+	}
+	return &Row{InsertID: id, Values: values}, nil
+}
+
+// Row is a row of results. It implements bigquery.ValueSaver.
+type Row struct {
+	InsertID string
+	Values   map[string]bq.Value
+}
+
+// Save implements bigquery.ValueSaver.
+func (r *Row) Save() (map[string]bq.Value, string, error) {
+	return r.Values, r.InsertID, nil
+}
+
+// WriterConfig configures a Writer.
+type WriterConfig struct {
+	// CreateTable creates the table with the Mapping's schema if it does not exist.
+	CreateTable bool
+	// BatchSize is the number of rows buffered before they are inserted. If zero
+	// DefaultBatchSize is used.
+	BatchSize int
+}
+
+// DefaultBatchSize is the default number of rows inserted per request.
+const DefaultBatchSize = 500
+
+// Writer streams evaluation results into a BigQuery table.
+type Writer struct {
+	mapping   *Mapping
+	inserter  *bq.Inserter
+	batchSize int
+	pending   []*Row
+}
+
+// NewWriter returns a Writer streaming rows into table.
+func NewWriter(ctx context.Context, table *bq.Table, m *Mapping, cfg WriterConfig) (*Writer, error) {
+	if cfg.CreateTable {
+		err := table.Create(ctx, &bq.TableMetadata{Schema: m.Schema()})
+		var apiErr *googleapi.Error
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict) {
+			return nil, fmt.Errorf("failed to create BigQuery table %s: %w", table.FullyQualifiedName(), err)
+		}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	return &Writer{mapping: m, inserter: table.Inserter(), batchSize: cfg.BatchSize}, nil
+}
+
+// Write buffers the row of the subject with the given ID, inserting the buffered rows once the
+// batch is full.
+func (w *Writer) Write(ctx context.Context, id string, libs result.Libraries) error {
+	r, err := w.mapping.Row(id, libs)
+	if err != nil {
+		return err
+	}
+	return w.WriteRow(ctx, r)
+}
+
+// WriteRow buffers a row returned by the Writer's Mapping, inserting the buffered rows once the
+// batch is full. Unlike Write, the only errors it returns are failed inserts.
+func (w *Writer) WriteRow(ctx context.Context, r *Row) error {
+	w.pending = append(w.pending, r)
+	if len(w.pending) >= w.batchSize {
+		return w.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush inserts all buffered rows.
+func (w *Writer) Flush(ctx context.Context) error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	rows := w.pending
+	w.pending = nil
+	if err := w.inserter.Put(ctx, rows); err != nil {
+		return fmt.Errorf("failed to insert %d rows into BigQuery: %w", len(rows), err)
+	}
+	return nil
+}
+
+// columnName replaces the characters of name that are not allowed in BigQuery column names.
+func columnName(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || r == '_'):
+			sb.WriteRune(r)
+		case r < unicode.MaxASCII && unicode.IsDigit(r):
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+var (
+	quantityFields = bq.Schema{
+		{Name: "value", Type: bq.FloatFieldType},
+		{Name: "unit", Type: bq.StringFieldType},
+	}
+	codeFields = bq.Schema{
+		{Name: "system", Type: bq.StringFieldType},
+		{Name: "version", Type: bq.StringFieldType},
+		{Name: "code", Type: bq.StringFieldType},
+		{Name: "display", Type: bq.StringFieldType},
+	}
+)
+
+// field returns the nullable BigQuery field of a CQL type.
+func field(name string, t types.IType) *bq.FieldSchema {
+	switch t := t.(type) {
+	case types.System:
+		switch t {
+		case types.Boolean:
+			return &bq.FieldSchema{Name: name, Type: bq.BooleanFieldType}
+		case types.Integer, types.Long:
+			return &bq.FieldSchema{Name: name, Type: bq.IntegerFieldType}
+		case types.Decimal:
+			return &bq.FieldSchema{Name: name, Type: bq.FloatFieldType}
+		case types.Date:
+			return &bq.FieldSchema{Name: name, Type: bq.DateFieldType}
+		case types.DateTime:
+			return &bq.FieldSchema{Name: name, Type: bq.TimestampFieldType}
+		case types.Time:
+			return &bq.FieldSchema{Name: name, Type: bq.TimeFieldType}
+		case types.Quantity:
+			return &bq.FieldSchema{Name: name, Type: bq.RecordFieldType, Schema: quantityFields}
+		case types.Ratio:
+			return &bq.FieldSchema{Name: name, Type: bq.RecordFieldType, Schema: bq.Schema{
+				{Name: "numerator", Type: bq.RecordFieldType, Schema: quantityFields},
+				{Name: "denominator", Type: bq.RecordFieldType, Schema: quantityFields},
+			}}
+		case types.Code:
+			return &bq.FieldSchema{Name: name, Type: bq.RecordFieldType, Schema: codeFields}
+		case types.Concept:
+			return &bq.FieldSchema{Name: name, Type: bq.RecordFieldType, Schema: bq.Schema{
+				{Name: "codes", Type: bq.RecordFieldType, Repeated: true, Schema: codeFields},
+				{Name: "display", Type: bq.StringFieldType},
+			}}
+		}
+		return &bq.FieldSchema{Name: name, Type: bq.StringFieldType}
+	case *types.Interval:
+		return &bq.FieldSchema{Name: name, Type: bq.RecordFieldType, Schema: bq.Schema{
+			field("low", t.PointType),
+			field("high", t.PointType),
+			{Name: "low_closed", Type: bq.BooleanFieldType},
+			{Name: "high_closed", Type: bq.BooleanFieldType},
+		}}
+	case *types.List:
+		if repeatable(t.ElementType) {
+			f := field(name, t.ElementType)
+			f.Repeated = true
+			return f
+		}
+		return &bq.FieldSchema{Name: name, Type: bq.StringFieldType}
+	case *types.Tuple:
+		names := make([]string, 0, len(t.ElementTypes))
+		for n := range t.ElementTypes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		var fields bq.Schema
+		for _, n := range names {
+			fields = append(fields, field(columnName(n), t.ElementTypes[n]))
+		}
+		return &bq.FieldSchema{Name: name, Type: bq.RecordFieldType, Schema: fields}
+	default:
+		return &bq.FieldSchema{Name: name, Type: bq.StringFieldType}
+	}
+}
+
+// repeatable returns whether elements of type t can be stored in a REPEATED field. BigQuery does
+// not support arrays of arrays.
+func repeatable(t types.IType) bool {
+	_, isList := t.(*types.List)
+	return !isList
+}
+
+// value converts a result to the value of its BigQuery field. Null results return nil.
+func value(t types.IType, v result.Value) (bq.Value, error) {
+	if result.IsNull(v) {
+		return nil, nil
+	}
+	switch t := t.(type) {
+	case types.System:
+		switch t {
+		case types.Boolean, types.Integer, types.Long, types.Decimal:
+			return v.GolangValue(), nil
+		case types.String:
+			return result.ToString(v)
+		case types.Date:
+			d, err := result.ToDateTime(v)
+			if err != nil {
+				return nil, err
+			}
+			return civil.DateOf(d.Date), nil
+		case types.DateTime:
+			d, err := result.ToDateTime(v)
+			if err != nil {
+				return nil, err
+			}
+			return d.Date, nil
+		case types.Time:
+			d, err := result.ToDateTime(v)
+			if err != nil {
+				return nil, err
+			}
+			return civil.TimeOf(d.Date), nil
+		case types.Quantity:
+			q, err := result.ToQuantity(v)
+			if err != nil {
+				return nil, err
+			}
+			return resultcolumns.Quantity(q), nil
+		case types.Ratio:
+			r, err := result.ToRatio(v)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]bq.Value{"numerator": resultcolumns.Quantity(r.Numerator), "denominator": resultcolumns.Quantity(r.Denominator)}, nil
+		case types.Code:
+			c, err := result.ToCode(v)
+			if err != nil {
+				return nil, err
+			}
+			return resultcolumns.Code(c), nil
+		case types.Concept:
+			c, err := result.ToConcept(v)
+			if err != nil {
+				return nil, err
+			}
+			codes := []bq.Value{}
+			for _, code := range c.NonNullCodeValues() {
+				codes = append(codes, resultcolumns.Code(code))
+			}
+			m := map[string]bq.Value{"codes": codes}
+			if c.Display != "" {
+				m["display"] = c.Display
+			}
+			return m, nil
+		case types.ValueSet:
+			vs, err := result.ToValueSet(v)
+			if err != nil {
+				return nil, err
+			}
+			return vs.Canonical(), nil
+		case types.CodeSystem:
+			cs, err := result.ToCodeSystem(v)
+			if err != nil {
+				return nil, err
+			}
+			return cs.Canonical(), nil
+		}
+		return resultcolumns.JSON(v)
+	case *types.Interval:
+		i, err := result.ToInterval(v)
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]bq.Value{"low_closed": i.LowInclusive, "high_closed": i.HighInclusive}
+		for name, p := range map[string]result.Value{"low": i.Low, "high": i.High} {
+			bv, err := value(t.PointType, p)
+			if err != nil {
+				return nil, err
+			}
+			if bv != nil {
+				m[name] = bv
+			}
+		}
+		return m, nil
+	case *types.List:
+		if !repeatable(t.ElementType) {
+			return resultcolumns.JSON(v)
+		}
+		l, err := result.ToSlice(v)
+		if err != nil {
+			return nil, err
+		}
+		elems := []bq.Value{}
+		for _, e := range l {
+			bv, err := value(t.ElementType, e)
+			if err != nil {
+				return nil, err
+			}
+			if bv != nil {
+				elems = append(elems, bv)
+			}
+		}
+		return elems, nil
+	case *types.Tuple:
+		tup, err := result.ToTuple(v)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]bq.Value, len(t.ElementTypes))
+		for name, et := range t.ElementTypes {
+			ev, ok := tup[name]
+			if !ok {
+				continue
+			}
+			bv, err := value(et, ev)
+			if err != nil {
+				return nil, err
+			}
+			if bv != nil {
+				m[columnName(name)] = bv
+			}
+		}
+		return m, nil
+	default:
+		return resultcolumns.JSON(v)
+	}
+}
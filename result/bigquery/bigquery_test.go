@@ -0,0 +1,212 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigquery_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/result/bigquery"
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/option"
+)
+
+var (
+	measureLib = result.LibKey{Name: "Measure", Version: "1.0.0"}
+	helpersLib = result.LibKey{Name: "Helpers"}
+)
+
+func newValue(t *testing.T, v any) result.Value {
+	t.Helper()
+	r, err := result.New(v)
+	if err != nil {
+		t.Fatalf("result.New(%v) returned unexpected error: %v", v, err)
+	}
+	return r
+}
+
+func testResultTypes() map[result.LibKey]map[string]types.IType {
+	return map[result.LibKey]map[string]types.IType{
+		measureLib: {
+			"In Population": types.Boolean,
+			"Birth Date":    types.Date,
+			"Weight":        types.Quantity,
+			"Scores":        &types.List{ElementType: types.Integer},
+			"Nested":        &types.List{ElementType: &types.List{ElementType: types.Integer}},
+			"Name":          types.String,
+		},
+		helpersLib: {
+			"Name": types.String,
+		},
+	}
+}
+
+func TestNewMapping_Schema(t *testing.T) {
+	m, err := bigquery.NewMapping(testResultTypes())
+	if err != nil {
+		t.Fatalf("NewMapping() returned unexpected error: %v", err)
+	}
+	want := bq.Schema{
+		{Name: "id", Type: bq.StringFieldType, Required: true},
+		{Name: "Birth_Date", Type: bq.DateFieldType, Description: "Measure 1.0.0.Birth Date (System.Date)"},
+		{Name: "Helpers_Name", Type: bq.StringFieldType, Description: "Helpers.Name (System.String)"},
+		{Name: "In_Population", Type: bq.BooleanFieldType, Description: "Measure 1.0.0.In Population (System.Boolean)"},
+		{Name: "Measure_Name", Type: bq.StringFieldType, Description: "Measure 1.0.0.Name (System.String)"},
+		{Name: "Nested", Type: bq.StringFieldType, Description: "Measure 1.0.0.Nested (List<List<System.Integer>>)"},
+		{Name: "Scores", Type: bq.IntegerFieldType, Repeated: true, Description: "Measure 1.0.0.Scores (List<System.Integer>)"},
+		{Name: "Weight", Type: bq.RecordFieldType, Description: "Measure 1.0.0.Weight (System.Quantity)", Schema: bq.Schema{
+			{Name: "value", Type: bq.FloatFieldType},
+			{Name: "unit", Type: bq.StringFieldType},
+		}},
+	}
+	if diff := cmp.Diff(want, m.Schema()); diff != "" {
+		t.Errorf("Schema() diff (-want +got):\n%s", diff)
+	}
+}
+
+func testResults(t *testing.T) result.Libraries {
+	t.Helper()
+	return result.Libraries{
+		measureLib: {
+			"In Population": newValue(t, true),
+			"Birth Date":    newValue(t, result.Date{Date: time.Date(1990, time.May, 4, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+			"Weight":        newValue(t, result.Quantity{Value: 70.5, Unit: "kg"}),
+			"Scores":        newValue(t, result.List{Value: []result.Value{newValue(t, 1), newValue(t, nil), newValue(t, 3)}}),
+			"Nested":        newValue(t, result.List{Value: []result.Value{newValue(t, result.List{Value: []result.Value{newValue(t, 1)}})}}),
+			"Name":          newValue(t, nil),
+		},
+		helpersLib: {"Name": newValue(t, "helper")},
+	}
+}
+
+func TestMapping_Row(t *testing.T) {
+	m, err := bigquery.NewMapping(testResultTypes())
+	if err != nil {
+		t.Fatalf("NewMapping() returned unexpected error: %v", err)
+	}
+	row, err := m.Row("patient-1", testResults(t))
+	if err != nil {
+		t.Fatalf("Row() returned unexpected error: %v", err)
+	}
+	values, insertID, err := row.Save()
+	if err != nil {
+		t.Fatalf("Save() returned unexpected error: %v", err)
+	}
+	if insertID != "patient-1" {
+		t.Errorf("Save() insert ID = %s, want patient-1", insertID)
+	}
+	want := map[string]bq.Value{
+		"id":            "patient-1",
+		"In_Population": true,
+		"Birth_Date":    civil.Date{Year: 1990, Month: time.May, Day: 4},
+		"Weight":        map[string]any{"value": 70.5, "unit": "kg"},
+		"Scores":        []bq.Value{int32(1), int32(3)},
+		"Nested":        `[[{"@type":"System.Integer","value":1}]]`,
+		"Helpers_Name":  "helper",
+	}
+	if diff := cmp.Diff(want, values); diff != "" {
+		t.Errorf("Save() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var mu sync.Mutex
+	var created bool
+	var inserted []map[string]any
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/datasets/results/tables"):
+			created = true
+			w.Write(body)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/tables/cql/insertAll"):
+			var req struct {
+				Rows []struct {
+					InsertID string         `json:"insertId"`
+					JSON     map[string]any `json:"json"`
+				} `json:"rows"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				t.Errorf("failed to parse insertAll request: %v", err)
+			}
+			for _, row := range req.Rows {
+				inserted = append(inserted, row.JSON)
+			}
+			w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	client, err := bq.NewClient(ctx, "project", option.WithEndpoint(s.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("bigquery.NewClient() returned unexpected error: %v", err)
+	}
+	defer client.Close()
+	m, err := bigquery.NewMapping(testResultTypes())
+	if err != nil {
+		t.Fatalf("NewMapping() returned unexpected error: %v", err)
+	}
+	w, err := bigquery.NewWriter(ctx, client.Dataset("results").Table("cql"), m, bigquery.WriterConfig{CreateTable: true, BatchSize: 2})
+	if err != nil {
+		t.Fatalf("NewWriter() returned unexpected error: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if err := w.Write(ctx, id, testResults(t)); err != nil {
+			t.Fatalf("Write(%s) returned unexpected error: %v", id, err)
+		}
+	}
+	mu.Lock()
+	if len(inserted) != 2 {
+		t.Errorf("%d rows were inserted before Flush, want 2", len(inserted))
+	}
+	mu.Unlock()
+	if err := w.Flush(ctx); err != nil {
+		t.Fatalf("Flush() returned unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !created {
+		t.Errorf("NewWriter() did not create the table")
+	}
+	var ids []string
+	for _, row := range inserted {
+		ids = append(ids, row["id"].(string))
+	}
+	if diff := cmp.Diff([]string{"1", "2", "3"}, ids); diff != "" {
+		t.Errorf("inserted ids diff (-want +got):\n%s", diff)
+	}
+	if got := inserted[0]["Birth_Date"]; got != "1990-05-04" {
+		t.Errorf("inserted Birth_Date = %v, want 1990-05-04", got)
+	}
+}
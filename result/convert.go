@@ -17,6 +17,7 @@ package result
 import (
 	"errors"
 	"fmt"
+	"reflect"
 
 	"google.golang.org/protobuf/proto"
 )
@@ -24,6 +25,10 @@ import (
 // ErrCannotConvert is an error that is returned when a conversion cannot be performed.
 var ErrCannotConvert = errors.New("internal error - cannot convert")
 
+// ErrNull is returned along with ErrCannotConvert by the As helpers when a null is converted to a
+// type that cannot represent null.
+var ErrNull = errors.New("value is null")
+
 // IsNull returns true if the provided Value is a null.
 func IsNull(v Value) bool {
 	return v.GolangValue() == nil
@@ -181,3 +186,144 @@ func ToCode(v Value) (Code, error) {
 	}
 	return i, nil
 }
+
+// As converts a Value to the Go type T with a single type assertion, replacing a switch over
+// GolangValue(). T can be any of the Go types listed in GolangValue(), the proto type of a Named
+// value such as *r4patientpb.Patient, proto.Message for any Named value, []Value for a List,
+// map[string]Value for a Tuple or Value itself. For example:
+//
+//	count, err := result.As[int32](v)
+//	patient, err := result.As[*r4patientpb.Patient](v)
+//
+// Converting a null returns an error wrapping both ErrCannotConvert and ErrNull, unless T is Value.
+func As[T any](v Value) (T, error) {
+	var zero T
+	if t, ok := any(v).(T); ok {
+		return t, nil
+	}
+	switch gv := v.GolangValue().(type) {
+	case nil:
+		return zero, fmt.Errorf("%w %v to %v, %w", ErrCannotConvert, v.RuntimeType(), typeName[T](), ErrNull)
+	case T:
+		return gv, nil
+	case Named:
+		if t, ok := gv.Value.(T); ok {
+			return t, nil
+		}
+	case List:
+		if t, ok := any(gv.Value).(T); ok {
+			return t, nil
+		}
+	case Tuple:
+		if t, ok := any(gv.Value).(T); ok {
+			return t, nil
+		}
+	}
+	return zero, fmt.Errorf("%w %v to %v", ErrCannotConvert, v.RuntimeType(), typeName[T]())
+}
+
+// AsSlice converts a CQL List to a slice of T, converting each element with As. For example
+// result.AsSlice[string](v) for a List<System.String>. A null List returns a nil slice.
+func AsSlice[T any](v Value) ([]T, error) {
+	if IsNull(v) {
+		return nil, nil
+	}
+	l, err := As[List](v)
+	if err != nil {
+		return nil, err
+	}
+	s := make([]T, 0, len(l.Value))
+	for i, elem := range l.Value {
+		t, err := As[T](elem)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		s = append(s, t)
+	}
+	return s, nil
+}
+
+// TypedInterval is an Interval whose bounds were converted to the Go type T. A nil bound is null,
+// meaning the interval is unbounded on that side if it is inclusive, or unknown otherwise.
+type TypedInterval[T any] struct {
+	Low           *T
+	High          *T
+	LowInclusive  bool
+	HighInclusive bool
+}
+
+// AsInterval converts a CQL Interval to a TypedInterval, converting each bound with As. For example
+// result.AsInterval[result.DateTime](v) for an Interval<System.DateTime>.
+func AsInterval[T any](v Value) (TypedInterval[T], error) {
+	i, err := As[Interval](v)
+	if err != nil {
+		return TypedInterval[T]{}, err
+	}
+	ti := TypedInterval[T]{LowInclusive: i.LowInclusive, HighInclusive: i.HighInclusive}
+	if !IsNull(i.Low) {
+		low, err := As[T](i.Low)
+		if err != nil {
+			return TypedInterval[T]{}, fmt.Errorf("interval low: %w", err)
+		}
+		ti.Low = &low
+	}
+	if !IsNull(i.High) {
+		high, err := As[T](i.High)
+		if err != nil {
+			return TypedInterval[T]{}, fmt.Errorf("interval high: %w", err)
+		}
+		ti.High = &high
+	}
+	return ti, nil
+}
+
+// AsQuantity converts a CQL Quantity to a Quantity. Following the CQL implicit conversions, an
+// Integer, Long or Decimal is converted to a Quantity with the default unit '1'.
+func AsQuantity(v Value) (Quantity, error) {
+	switch gv := v.GolangValue().(type) {
+	case int32:
+		return Quantity{Value: float64(gv), Unit: "1"}, nil
+	case int64:
+		return Quantity{Value: float64(gv), Unit: "1"}, nil
+	case float64:
+		return Quantity{Value: gv, Unit: "1"}, nil
+	}
+	return As[Quantity](v)
+}
+
+// AsResources converts the result of a retrieve or query, a List of resources or a single
+// resource, to a slice of FHIR protos of type T. For example
+// result.AsResources[*r4conditionpb.Condition](v) for a List<FHIR.Condition>. Null elements are
+// skipped and a null value returns a nil slice.
+func AsResources[T proto.Message](v Value) ([]T, error) {
+	if IsNull(v) {
+		return nil, nil
+	}
+	if _, ok := v.GolangValue().(List); !ok {
+		t, err := As[T](v)
+		if err != nil {
+			return nil, err
+		}
+		return []T{t}, nil
+	}
+	l, err := As[List](v)
+	if err != nil {
+		return nil, err
+	}
+	s := make([]T, 0, len(l.Value))
+	for i, elem := range l.Value {
+		if IsNull(elem) {
+			continue
+		}
+		t, err := As[T](elem)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		s = append(s, t)
+	}
+	return s, nil
+}
+
+func typeName[T any]() string {
+	return reflect.TypeFor[T]().String()
+}
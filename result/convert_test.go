@@ -22,6 +22,7 @@ import (
 	"github.com/google/cql/model"
 	"github.com/google/cql/types"
 	c4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	d4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
 	r4patientpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/protobuf/proto"
@@ -520,3 +521,250 @@ func TestToValueSetError(t *testing.T) {
 		t.Errorf("ToValueSet() got error %v want %v", err, want)
 	}
 }
+
+func TestAs(t *testing.T) {
+	patient := &r4patientpb.Patient{Id: &d4pb.Id{Value: "1"}}
+	patientValue := newOrFatal(t, Named{Value: patient, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}})
+	list := newOrFatal(t, List{Value: []Value{newOrFatal(t, 1)}, StaticType: &types.List{ElementType: types.Integer}})
+	tuple := newOrFatal(t, Tuple{Value: map[string]Value{"a": newOrFatal(t, 1)}, RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"a": types.Integer}}})
+
+	check := func(t *testing.T, want, got any, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("As() returned unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+			t.Errorf("As() returned diff (-want +got):\n%s", diff)
+		}
+	}
+	t.Run("Boolean", func(t *testing.T) {
+		got, err := As[bool](newOrFatal(t, true))
+		check(t, true, got, err)
+	})
+	t.Run("Integer", func(t *testing.T) {
+		got, err := As[int32](newOrFatal(t, 4))
+		check(t, int32(4), got, err)
+	})
+	t.Run("String", func(t *testing.T) {
+		got, err := As[string](newOrFatal(t, "hi"))
+		check(t, "hi", got, err)
+	})
+	t.Run("Quantity", func(t *testing.T) {
+		got, err := As[Quantity](newOrFatal(t, Quantity{Value: 1, Unit: "mg"}))
+		check(t, Quantity{Value: 1, Unit: "mg"}, got, err)
+	})
+	t.Run("Specific proto", func(t *testing.T) {
+		got, err := As[*r4patientpb.Patient](patientValue)
+		check(t, patient, got, err)
+	})
+	t.Run("Any proto", func(t *testing.T) {
+		got, err := As[proto.Message](patientValue)
+		check(t, proto.Message(patient), got, err)
+	})
+	t.Run("List as slice", func(t *testing.T) {
+		got, err := As[[]Value](list)
+		check(t, []Value{newOrFatal(t, 1)}, got, err)
+	})
+	t.Run("Tuple as map", func(t *testing.T) {
+		got, err := As[map[string]Value](tuple)
+		check(t, map[string]Value{"a": newOrFatal(t, 1)}, got, err)
+	})
+	t.Run("Null as Value", func(t *testing.T) {
+		got, err := As[Value](newOrFatal(t, nil))
+		check(t, newOrFatal(t, nil), got, err)
+	})
+}
+
+func TestAsError(t *testing.T) {
+	tests := []struct {
+		name     string
+		convert  func() error
+		wantNull bool
+	}{
+		{
+			name:    "Wrong type",
+			convert: func() error { _, err := As[int32](newOrFatal(t, 4.0)); return err },
+		},
+		{
+			name:     "Null",
+			convert:  func() error { _, err := As[int32](newOrFatal(t, nil)); return err },
+			wantNull: true,
+		},
+		{
+			name: "Wrong proto",
+			convert: func() error {
+				_, err := As[*r4patientpb.Patient](newOrFatal(t, Named{Value: &r4patientpb.Patient_GenderCode{}, RuntimeType: &types.Named{TypeName: "FHIR.AdministrativeGender"}}))
+				return err
+			},
+		},
+		{
+			name: "Wrong slice element",
+			convert: func() error {
+				_, err := AsSlice[string](newOrFatal(t, List{Value: []Value{newOrFatal(t, "a"), newOrFatal(t, 1)}, StaticType: &types.List{ElementType: types.Any}}))
+				return err
+			},
+		},
+		{
+			name: "Null slice element",
+			convert: func() error {
+				_, err := AsSlice[string](newOrFatal(t, List{Value: []Value{newOrFatal(t, nil)}, StaticType: &types.List{ElementType: types.String}}))
+				return err
+			},
+			wantNull: true,
+		},
+		{
+			name: "Wrong interval point type",
+			convert: func() error {
+				_, err := AsInterval[string](newOrFatal(t, Interval{Low: newOrFatal(t, 1), High: newOrFatal(t, 2), StaticType: &types.Interval{PointType: types.Integer}}))
+				return err
+			},
+		},
+		{
+			name:    "String as Quantity",
+			convert: func() error { _, err := AsQuantity(newOrFatal(t, "1")); return err },
+		},
+		{
+			name: "Wrong resource type",
+			convert: func() error {
+				_, err := AsResources[*r4patientpb.Patient](newOrFatal(t, List{Value: []Value{newOrFatal(t, 1)}, StaticType: &types.List{ElementType: types.Integer}}))
+				return err
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.convert()
+			if err == nil {
+				t.Fatalf("conversion succeeded, want error")
+			}
+			if !errors.Is(err, ErrCannotConvert) {
+				t.Errorf("conversion returned error %v, want %v", err, ErrCannotConvert)
+			}
+			if got := errors.Is(err, ErrNull); got != tc.wantNull {
+				t.Errorf("errors.Is(%v, ErrNull) = %v, want %v", err, got, tc.wantNull)
+			}
+		})
+	}
+}
+
+func TestAsSlice(t *testing.T) {
+	got, err := AsSlice[string](newOrFatal(t, List{Value: []Value{newOrFatal(t, "a"), newOrFatal(t, "b")}, StaticType: &types.List{ElementType: types.String}}))
+	if err != nil {
+		t.Fatalf("AsSlice() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"a", "b"}, got); diff != "" {
+		t.Errorf("AsSlice() returned diff (-want +got):\n%s", diff)
+	}
+
+	got, err = AsSlice[string](newOrFatal(t, nil))
+	if err != nil {
+		t.Fatalf("AsSlice(null) returned unexpected error: %v", err)
+	}
+	if got != nil {
+		t.Errorf("AsSlice(null) = %v, want nil", got)
+	}
+}
+
+func TestAsInterval(t *testing.T) {
+	low := DateTime{Date: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY}
+	got, err := AsInterval[DateTime](newOrFatal(t, Interval{
+		Low:           newOrFatal(t, low),
+		High:          newOrFatal(t, nil),
+		LowInclusive:  true,
+		HighInclusive: true,
+		StaticType:    &types.Interval{PointType: types.DateTime},
+	}))
+	if err != nil {
+		t.Fatalf("AsInterval() returned unexpected error: %v", err)
+	}
+	want := TypedInterval[DateTime]{Low: &low, LowInclusive: true, HighInclusive: true}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("AsInterval() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAsQuantity(t *testing.T) {
+	tests := []struct {
+		name  string
+		input Value
+		want  Quantity
+	}{
+		{
+			name:  "Quantity",
+			input: newOrFatal(t, Quantity{Value: 5, Unit: "mg"}),
+			want:  Quantity{Value: 5, Unit: "mg"},
+		},
+		{
+			name:  "Integer",
+			input: newOrFatal(t, 5),
+			want:  Quantity{Value: 5, Unit: "1"},
+		},
+		{
+			name:  "Long",
+			input: newOrFatal(t, int64(5)),
+			want:  Quantity{Value: 5, Unit: "1"},
+		},
+		{
+			name:  "Decimal",
+			input: newOrFatal(t, 5.5),
+			want:  Quantity{Value: 5.5, Unit: "1"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := AsQuantity(tc.input)
+			if err != nil {
+				t.Fatalf("AsQuantity(%v) returned unexpected error: %v", tc.input, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("AsQuantity(%v) returned diff (-want +got):\n%s", tc.input, diff)
+			}
+		})
+	}
+}
+
+func TestAsResources(t *testing.T) {
+	p1 := &r4patientpb.Patient{Id: &d4pb.Id{Value: "1"}}
+	p2 := &r4patientpb.Patient{Id: &d4pb.Id{Value: "2"}}
+	named := func(p *r4patientpb.Patient) Value {
+		return newOrFatal(t, Named{Value: p, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}})
+	}
+	listType := &types.List{ElementType: &types.Named{TypeName: "FHIR.Patient"}}
+	tests := []struct {
+		name  string
+		input Value
+		want  []*r4patientpb.Patient
+	}{
+		{
+			name:  "List",
+			input: newOrFatal(t, List{Value: []Value{named(p1), newOrFatal(t, nil), named(p2)}, StaticType: listType}),
+			want:  []*r4patientpb.Patient{p1, p2},
+		},
+		{
+			name:  "Empty list",
+			input: newOrFatal(t, List{Value: []Value{}, StaticType: listType}),
+			want:  []*r4patientpb.Patient{},
+		},
+		{
+			name:  "Single resource",
+			input: named(p1),
+			want:  []*r4patientpb.Patient{p1},
+		},
+		{
+			name:  "Null",
+			input: newOrFatal(t, nil),
+			want:  nil,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := AsResources[*r4patientpb.Patient](tc.input)
+			if err != nil {
+				t.Fatalf("AsResources() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("AsResources() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"cmp"
+	"fmt"
+)
+
+// Locator is the location of an expression in the CQL source of a library. Lines and columns are
+// 1-based and the end column is inclusive, matching the locator of ELM elements.
+type Locator struct {
+	Library   LibKey
+	StartLine int
+	StartCol  int
+	EndLine   int
+	EndCol    int
+}
+
+// String returns the locator in the ELM format "startLine:startCol-endLine:endCol". The library is
+// not included.
+func (l Locator) String() string {
+	return fmt.Sprintf("%d:%d-%d:%d", l.StartLine, l.StartCol, l.EndLine, l.EndCol)
+}
+
+// MarshalText implements encoding.TextMarshaler so locators can key JSON objects.
+func (l Locator) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Contains returns true if the expression located by o lies within the expression located by l,
+// including when both are the same.
+func (l Locator) Contains(o Locator) bool {
+	if l.Library != o.Library {
+		return false
+	}
+	startsAfter := o.StartLine > l.StartLine || (o.StartLine == l.StartLine && o.StartCol >= l.StartCol)
+	endsBefore := o.EndLine < l.EndLine || (o.EndLine == l.EndLine && o.EndCol <= l.EndCol)
+	return startsAfter && endsBefore
+}
+
+// Compare orders locators by library, and then by start and end position, returning -1, 0 or +1
+// like cmp.Compare. Enclosing expressions sort before the expressions they contain.
+func (l Locator) Compare(o Locator) int {
+	return cmp.Or(
+		cmp.Compare(l.Library.String(), o.Library.String()),
+		cmp.Compare(l.StartLine, o.StartLine),
+		cmp.Compare(l.StartCol, o.StartCol),
+		cmp.Compare(o.EndLine, l.EndLine),
+		cmp.Compare(o.EndCol, l.EndCol),
+	)
+}
+
+// DebugStep is the value of a single evaluation of a sub-expression, captured in debug mode.
+type DebugStep struct {
+	// Locator is the location of the sub-expression. Sub-expressions in functions are located in the
+	// library that defines the function, which may not be the library of the expression definition.
+	Locator Locator
+	Value   Value
+}
+
+// DebugTrace returns the value of every sub-expression evaluated while computing an expression
+// definition, in the order in which the evaluations completed. A sub-expression may appear more
+// than once, for example once per row of a query or once per call of a function. The second return
+// value is false if no trace was recorded for this value.
+func (v Value) DebugTrace() ([]DebugStep, bool) {
+	if v.trace == nil {
+		return nil, false
+	}
+	return v.trace, true
+}
+
+// WithDebugTrace returns a copy of the value with the given debug trace.
+func (v Value) WithDebugTrace(steps []DebugStep) Value {
+	if steps == nil {
+		steps = []DebugStep{}
+	}
+	v.trace = steps
+	return v
+}
+
+// DebugTraces returns the debug trace of every expression definition in the results that has one,
+// keyed by library and expression definition name.
+func (l Libraries) DebugTraces() map[LibKey]map[string][]DebugStep {
+	traces := make(map[LibKey]map[string][]DebugStep, len(l))
+	for k, defs := range l {
+		for name, v := range defs {
+			t, ok := v.DebugTrace()
+			if !ok {
+				continue
+			}
+			if traces[k] == nil {
+				traces[k] = make(map[string][]DebugStep)
+			}
+			traces[k][name] = t
+		}
+	}
+	return traces
+}
+
+// ByLocator groups the values of a debug trace by the location of their sub-expression, keeping
+// the order of evaluation within each location.
+func ByLocator(steps []DebugStep) map[Locator][]Value {
+	m := make(map[Locator][]Value)
+	for _, s := range steps {
+		m[s.Locator] = append(m[s.Locator], s.Value)
+	}
+	return m
+}
+
+// ExpressionCoverage is how many times an expression of the CQL was evaluated.
+type ExpressionCoverage struct {
+	Locator Locator
+	// Evaluations is zero if the expression was never reached.
+	Evaluations int
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLocator_String(t *testing.T) {
+	l := Locator{Library: LibKey{Name: "TESTLIB"}, StartLine: 3, StartCol: 12, EndLine: 4, EndCol: 7}
+	if got, want := l.String(), "3:12-4:7"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestLocator_ContainsAndCompare(t *testing.T) {
+	lib := LibKey{Name: "TESTLIB"}
+	outer := Locator{Library: lib, StartLine: 2, StartCol: 5, EndLine: 4, EndCol: 10}
+	tests := []struct {
+		name         string
+		other        Locator
+		wantContains bool
+		wantCompare  int
+	}{
+		{
+			name:         "Same",
+			other:        outer,
+			wantContains: true,
+			wantCompare:  0,
+		},
+		{
+			name:         "Inner",
+			other:        Locator{Library: lib, StartLine: 2, StartCol: 5, EndLine: 2, EndCol: 9},
+			wantContains: true,
+			wantCompare:  -1,
+		},
+		{
+			name:         "Overlapping",
+			other:        Locator{Library: lib, StartLine: 3, StartCol: 1, EndLine: 5, EndCol: 1},
+			wantContains: false,
+			wantCompare:  -1,
+		},
+		{
+			name:         "Before",
+			other:        Locator{Library: lib, StartLine: 1, StartCol: 1, EndLine: 2, EndCol: 4},
+			wantContains: false,
+			wantCompare:  1,
+		},
+		{
+			name:         "Other library",
+			other:        Locator{Library: LibKey{Name: "OTHER"}, StartLine: 3, StartCol: 1, EndLine: 3, EndCol: 2},
+			wantContains: false,
+			wantCompare:  1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := outer.Contains(tc.other); got != tc.wantContains {
+				t.Errorf("%v.Contains(%v) = %v, want %v", outer, tc.other, got, tc.wantContains)
+			}
+			if got := outer.Compare(tc.other); got != tc.wantCompare {
+				t.Errorf("%v.Compare(%v) = %v, want %v", outer, tc.other, got, tc.wantCompare)
+			}
+		})
+	}
+}
+
+func TestDebugTrace(t *testing.T) {
+	plain := newOrFatal(t, 1)
+	if _, ok := plain.DebugTrace(); ok {
+		t.Errorf("DebugTrace() on a value without a trace returned ok, want !ok")
+	}
+	empty := plain.WithDebugTrace(nil)
+	if got, ok := empty.DebugTrace(); !ok || len(got) != 0 {
+		t.Errorf("DebugTrace() of an empty trace = %v, %v, want [], true", got, ok)
+	}
+
+	a := Locator{StartLine: 1, StartCol: 1, EndLine: 1, EndCol: 1}
+	b := Locator{StartLine: 1, StartCol: 5, EndLine: 1, EndCol: 5}
+	steps := []DebugStep{
+		{Locator: a, Value: newOrFatal(t, 1)},
+		{Locator: b, Value: newOrFatal(t, 2)},
+		{Locator: a, Value: newOrFatal(t, 3)},
+	}
+	withTrace := plain.WithDebugTrace(steps)
+	got, ok := withTrace.DebugTrace()
+	if !ok {
+		t.Fatalf("DebugTrace() returned !ok, want ok")
+	}
+	if diff := cmp.Diff(steps, got); diff != "" {
+		t.Errorf("DebugTrace() diff (-want +got):\n%s", diff)
+	}
+	if !withTrace.Equal(plain) {
+		t.Errorf("Equal() = false for values only differing in trace, want true")
+	}
+
+	wantByLocator := map[Locator][]Value{
+		a: {newOrFatal(t, 1), newOrFatal(t, 3)},
+		b: {newOrFatal(t, 2)},
+	}
+	if diff := cmp.Diff(wantByLocator, ByLocator(got)); diff != "" {
+		t.Errorf("ByLocator() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLibraries_DebugTraces(t *testing.T) {
+	step := DebugStep{Locator: Locator{StartLine: 2, StartCol: 1, EndLine: 2, EndCol: 1}, Value: newOrFatal(t, 1)}
+	libs := Libraries{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]Value{
+			"Def":       newOrFatal(t, 1).WithDebugTrace([]DebugStep{step}),
+			"Parameter": newOrFatal(t, 2),
+		},
+		LibKey{Name: "NOTRACE"}: map[string]Value{
+			"Parameter": newOrFatal(t, 3),
+		},
+	}
+	want := map[LibKey]map[string][]DebugStep{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: {"Def": {step}},
+	}
+	if diff := cmp.Diff(want, libs.DebugTraces()); diff != "" {
+		t.Errorf("DebugTraces() diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package diff compares two sets of CQL results, for example the results of two engine versions or
+// two versions of a measure, and reports the differences in a human readable form. Comparison is
+// type aware: Quantities are compared after normalizing common UCUM units, Decimals can be compared
+// with a tolerance and Lists can be compared ignoring order.
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/cql/internal/datehelpers"
+	"github.com/google/cql/result"
+)
+
+// Kind is the kind of a Difference.
+type Kind int
+
+const (
+	// Added means the value only exists in the new results.
+	Added Kind = iota
+	// Removed means the value only exists in the old results.
+	Removed
+	// Changed means the value exists in both results but is different.
+	Changed
+)
+
+// String returns the symbol used for the kind in reports.
+func (k Kind) String() string {
+	switch k {
+	case Added:
+		return "+"
+	case Removed:
+		return "-"
+	default:
+		return "~"
+	}
+}
+
+// Options configure how results are compared.
+type Options struct {
+	// UnorderedLists if true compares Lists as multisets, so the same elements in a different order
+	// are not a difference.
+	UnorderedLists bool
+	// DecimalTolerance is the largest absolute difference between two Decimals, or two Quantities
+	// after unit normalization, that is still considered equal.
+	DecimalTolerance float64
+	// IgnoreLibraryVersions if true matches libraries by name only, so the results of two versions
+	// of a library can be compared.
+	IgnoreLibraryVersions bool
+}
+
+// Difference is a single difference between two sets of results.
+type Difference struct {
+	// Library is the library of the difference. If libraries are matched ignoring versions this is
+	// the library of the new results, unless the library was removed.
+	Library result.LibKey
+	// Define is the name of the expression definition.
+	Define string
+	// Path locates the difference within the value of the expression definition, for example
+	// [2].status for the status element of the third element of a List. Path is empty if the
+	// difference is the value of the expression definition itself.
+	Path string
+	Kind Kind
+	// Old is the value in the old results. It is nil if Kind is Added.
+	Old *result.Value
+	// New is the value in the new results. It is nil if Kind is Removed.
+	New *result.Value
+}
+
+// String returns a single line description of the difference, for example
+// "~ HasDiabetes: false -> true".
+func (d Difference) String() string {
+	name := d.Define + d.Path
+	switch d.Kind {
+	case Added:
+		return fmt.Sprintf("%s %s: %s", d.Kind, name, formatValue(*d.New))
+	case Removed:
+		return fmt.Sprintf("%s %s: %s", d.Kind, name, formatValue(*d.Old))
+	default:
+		return fmt.Sprintf("%s %s: %s -> %s", d.Kind, name, formatValue(*d.Old), formatValue(*d.New))
+	}
+}
+
+// Compare returns the differences between the old and new results, sorted by library and
+// expression definition. Differences within an expression definition are in the order they are
+// found in the value. If there are no differences the returned slice is empty.
+func Compare(old, new result.Libraries, opts Options) []Difference {
+	c := comparer{opts: opts}
+	oldLibs, newLibs := c.libraries(old), c.libraries(new)
+	for k, newLib := range newLibs {
+		oldLib, ok := oldLibs[k]
+		if !ok {
+			for name, v := range newLib.defs {
+				c.add(Difference{Library: newLib.key, Define: name, Kind: Added, New: ptr(v)})
+			}
+			continue
+		}
+		for name, newV := range newLib.defs {
+			oldV, ok := oldLib.defs[name]
+			if !ok {
+				c.add(Difference{Library: newLib.key, Define: name, Kind: Added, New: ptr(newV)})
+				continue
+			}
+			c.value(newLib.key, name, "", oldV, newV)
+		}
+		for name, oldV := range oldLib.defs {
+			if _, ok := newLib.defs[name]; !ok {
+				c.add(Difference{Library: newLib.key, Define: name, Kind: Removed, Old: ptr(oldV)})
+			}
+		}
+	}
+	for k, oldLib := range oldLibs {
+		if _, ok := newLibs[k]; ok {
+			continue
+		}
+		for name, v := range oldLib.defs {
+			c.add(Difference{Library: oldLib.key, Define: name, Kind: Removed, Old: ptr(v)})
+		}
+	}
+
+	sort.SliceStable(c.diffs, func(i, j int) bool {
+		a, b := c.diffs[i], c.diffs[j]
+		if a.Library.Key() != b.Library.Key() {
+			return a.Library.Key() < b.Library.Key()
+		}
+		return a.Define < b.Define
+	})
+	return c.diffs
+}
+
+// Equal returns true if there are no differences between the old and new results.
+func Equal(old, new result.Libraries, opts Options) bool {
+	return len(Compare(old, new, opts)) == 0
+}
+
+// Report returns a human readable report of the differences, grouped by library. For example:
+//
+//	TESTLIB 1.0.0
+//	  ~ Denominator: true -> false
+//	  + Numerator: true
+//	  - Stratifier[1]: 'male'
+func Report(diffs []Difference) string {
+	if len(diffs) == 0 {
+		return "No differences.\n"
+	}
+	var sb strings.Builder
+	var lib *result.LibKey
+	for _, d := range diffs {
+		if lib == nil || *lib != d.Library {
+			lib = &d.Library
+			fmt.Fprintln(&sb, libName(d.Library))
+		}
+		fmt.Fprintf(&sb, "  %s\n", d)
+	}
+	fmt.Fprintf(&sb, "%d difference(s).\n", len(diffs))
+	return sb.String()
+}
+
+func libName(k result.LibKey) string {
+	if k.IsUnnamed {
+		return "Unnamed Library"
+	}
+	if k.Version == "" {
+		return k.Name
+	}
+	return k.Name + " " + k.Version
+}
+
+type library struct {
+	key  result.LibKey
+	defs map[string]result.Value
+}
+
+type comparer struct {
+	opts  Options
+	diffs []Difference
+}
+
+func (c *comparer) add(d Difference) { c.diffs = append(c.diffs, d) }
+
+// libraries keys the libraries by the key they are matched on.
+func (c *comparer) libraries(libs result.Libraries) map[result.LibKey]library {
+	m := make(map[result.LibKey]library, len(libs))
+	for k, defs := range libs {
+		matchKey := k
+		if c.opts.IgnoreLibraryVersions {
+			matchKey.Version = ""
+		}
+		m[matchKey] = library{key: k, defs: defs}
+	}
+	return m
+}
+
+// value appends the differences between two values.
+func (c *comparer) value(lib result.LibKey, define, path string, old, new result.Value) {
+	changed := func() {
+		c.add(Difference{Library: lib, Define: define, Path: path, Kind: Changed, Old: ptr(old), New: ptr(new)})
+	}
+	switch o := old.GolangValue().(type) {
+	case result.List:
+		n, ok := new.GolangValue().(result.List)
+		if !ok {
+			changed()
+			return
+		}
+		if c.opts.UnorderedLists {
+			c.unorderedList(lib, define, path, o.Value, n.Value)
+			return
+		}
+		for i := 0; i < len(o.Value) || i < len(n.Value); i++ {
+			elemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(n.Value):
+				c.add(Difference{Library: lib, Define: define, Path: elemPath, Kind: Removed, Old: ptr(o.Value[i])})
+			case i >= len(o.Value):
+				c.add(Difference{Library: lib, Define: define, Path: elemPath, Kind: Added, New: ptr(n.Value[i])})
+			default:
+				c.value(lib, define, elemPath, o.Value[i], n.Value[i])
+			}
+		}
+	case result.Tuple:
+		n, ok := new.GolangValue().(result.Tuple)
+		if !ok {
+			changed()
+			return
+		}
+		for _, name := range sortedKeys(o.Value, n.Value) {
+			elemPath := path + "." + name
+			oe, inOld := o.Value[name]
+			ne, inNew := n.Value[name]
+			switch {
+			case !inNew:
+				c.add(Difference{Library: lib, Define: define, Path: elemPath, Kind: Removed, Old: ptr(oe)})
+			case !inOld:
+				c.add(Difference{Library: lib, Define: define, Path: elemPath, Kind: Added, New: ptr(ne)})
+			default:
+				c.value(lib, define, elemPath, oe, ne)
+			}
+		}
+	default:
+		if !c.equal(old, new) {
+			changed()
+		}
+	}
+}
+
+// unorderedList appends the elements of old and new that could not be paired with an equal element.
+func (c *comparer) unorderedList(lib result.LibKey, define, path string, old, new []result.Value) {
+	matched := make([]bool, len(new))
+	for i, o := range old {
+		found := false
+		for j, n := range new {
+			if !matched[j] && c.equal(o, n) {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			c.add(Difference{Library: lib, Define: define, Path: fmt.Sprintf("%s[%d]", path, i), Kind: Removed, Old: ptr(o)})
+		}
+	}
+	for j, n := range new {
+		if !matched[j] {
+			c.add(Difference{Library: lib, Define: define, Path: fmt.Sprintf("%s[%d]", path, j), Kind: Added, New: ptr(n)})
+		}
+	}
+}
+
+// equal returns true if the two values are equal under the options.
+func (c *comparer) equal(old, new result.Value) bool {
+	switch o := old.GolangValue().(type) {
+	case float64:
+		n, ok := new.GolangValue().(float64)
+		return ok && c.closeEnough(o, n)
+	case result.Quantity:
+		n, ok := new.GolangValue().(result.Quantity)
+		return ok && c.quantitiesEqual(o, n)
+	case result.Ratio:
+		n, ok := new.GolangValue().(result.Ratio)
+		return ok && c.quantitiesEqual(o.Numerator, n.Numerator) && c.quantitiesEqual(o.Denominator, n.Denominator)
+	case result.Interval:
+		n, ok := new.GolangValue().(result.Interval)
+		return ok && o.LowInclusive == n.LowInclusive && o.HighInclusive == n.HighInclusive &&
+			c.equal(o.Low, n.Low) && c.equal(o.High, n.High)
+	case result.List, result.Tuple:
+		// Collect the nested differences in a separate comparer to find out whether there are any.
+		nested := comparer{opts: c.opts}
+		nested.value(result.LibKey{}, "", "", old, new)
+		return len(nested.diffs) == 0
+	default:
+		return old.Equal(new)
+	}
+}
+
+// relativeEpsilon absorbs the floating point error introduced by unit normalization.
+const relativeEpsilon = 1e-12
+
+func (c *comparer) closeEnough(a, b float64) bool {
+	d := math.Abs(a - b)
+	return d <= c.opts.DecimalTolerance || d <= relativeEpsilon*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func (c *comparer) quantitiesEqual(a, b result.Quantity) bool {
+	av, au := normalizeUnit(a.Value, string(a.Unit))
+	bv, bu := normalizeUnit(b.Value, string(b.Unit))
+	return au == bu && c.closeEnough(av, bv)
+}
+
+func sortedKeys(a, b map[string]result.Value) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatValue formats a value for a report, similar to a CQL literal. Values without a literal
+// form, such as Codes and FHIR resources, are formatted as their result JSON.
+func formatValue(v result.Value) string {
+	var s string
+	var err error
+	switch gv := v.GolangValue().(type) {
+	case nil:
+		return "null"
+	case string:
+		return "'" + gv + "'"
+	case bool, int32:
+		return fmt.Sprint(gv)
+	case int64:
+		return fmt.Sprintf("%dL", gv)
+	case float64:
+		// Decimals always have a decimal point, so they can be told apart from Integers.
+		d := strconv.FormatFloat(gv, 'f', -1, 64)
+		if !strings.ContainsAny(d, ".NI") {
+			d += ".0"
+		}
+		return d
+	case result.Quantity:
+		return fmt.Sprintf("%v '%s'", gv.Value, gv.Unit)
+	case result.Interval:
+		low, high := "(", ")"
+		if gv.LowInclusive {
+			low = "["
+		}
+		if gv.HighInclusive {
+			high = "]"
+		}
+		return "Interval" + low + formatValue(gv.Low) + ", " + formatValue(gv.High) + high
+	case result.List:
+		elems := make([]string, 0, len(gv.Value))
+		for _, e := range gv.Value {
+			elems = append(elems, formatValue(e))
+		}
+		return "{" + strings.Join(elems, ", ") + "}"
+	case result.Date:
+		s, err = datehelpers.DateString(gv.Date, gv.Precision)
+	case result.DateTime:
+		s, err = datehelpers.DateTimeString(gv.Date, gv.Precision)
+	case result.Time:
+		s, err = datehelpers.TimeString(gv.Date, gv.Precision)
+	default:
+		var b []byte
+		b, err = json.Marshal(v)
+		s = string(b)
+	}
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return s
+}
+
+func ptr(v result.Value) *result.Value { return &v }
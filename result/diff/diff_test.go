@@ -0,0 +1,270 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+var lib = result.LibKey{Name: "TESTLIB", Version: "1.0.0"}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		old  map[string]result.Value
+		new  map[string]result.Value
+		opts Options
+		want []string
+	}{
+		{
+			name: "Equal",
+			old:  map[string]result.Value{"A": newOrFatal(t, 1), "B": newOrFatal(t, "b"), "C": newOrFatal(t, nil)},
+			new:  map[string]result.Value{"A": newOrFatal(t, 1), "B": newOrFatal(t, "b"), "C": newOrFatal(t, nil)},
+			want: []string{},
+		},
+		{
+			name: "Added, removed and changed defines",
+			old:  map[string]result.Value{"Same": newOrFatal(t, true), "Changed": newOrFatal(t, false), "Removed": newOrFatal(t, 1)},
+			new:  map[string]result.Value{"Same": newOrFatal(t, true), "Changed": newOrFatal(t, true), "Added": newOrFatal(t, "a")},
+			want: []string{"+ Added: 'a'", "~ Changed: false -> true", "- Removed: 1"},
+		},
+		{
+			name: "Null to value",
+			old:  map[string]result.Value{"A": newOrFatal(t, nil)},
+			new:  map[string]result.Value{"A": newOrFatal(t, 1)},
+			want: []string{"~ A: null -> 1"},
+		},
+		{
+			name: "Type change",
+			old:  map[string]result.Value{"A": newOrFatal(t, 1), "B": newOrFatal(t, 1)},
+			new:  map[string]result.Value{"A": newOrFatal(t, 1.0), "B": newOrFatal(t, int64(1))},
+			want: []string{"~ A: 1 -> 1.0", "~ B: 1 -> 1L"},
+		},
+		{
+			name: "Decimal within tolerance",
+			old:  map[string]result.Value{"A": newOrFatal(t, 0.333333)},
+			new:  map[string]result.Value{"A": newOrFatal(t, 0.3333333)},
+			opts: Options{DecimalTolerance: 1e-6},
+			want: []string{},
+		},
+		{
+			name: "Decimal outside tolerance",
+			old:  map[string]result.Value{"A": newOrFatal(t, 0.3)},
+			new:  map[string]result.Value{"A": newOrFatal(t, 0.4)},
+			opts: Options{DecimalTolerance: 1e-6},
+			want: []string{"~ A: 0.3 -> 0.4"},
+		},
+		{
+			name: "Quantities with equivalent units",
+			old: map[string]result.Value{
+				"Mass":     newOrFatal(t, result.Quantity{Value: 1, Unit: "mg"}),
+				"Duration": newOrFatal(t, result.Quantity{Value: 2, Unit: "days"}),
+				"Ratio":    newOrFatal(t, result.Ratio{Numerator: result.Quantity{Value: 1, Unit: "g"}, Denominator: result.Quantity{Value: 1, Unit: "dL"}}),
+			},
+			new: map[string]result.Value{
+				"Mass":     newOrFatal(t, result.Quantity{Value: 1000, Unit: "ug"}),
+				"Duration": newOrFatal(t, result.Quantity{Value: 48, Unit: "h"}),
+				"Ratio":    newOrFatal(t, result.Ratio{Numerator: result.Quantity{Value: 1000, Unit: "mg"}, Denominator: result.Quantity{Value: 100, Unit: "mL"}}),
+			},
+			want: []string{},
+		},
+		{
+			name: "Quantities with different dimensions",
+			old: map[string]result.Value{
+				"Known":   newOrFatal(t, result.Quantity{Value: 1, Unit: "g"}),
+				"Unknown": newOrFatal(t, result.Quantity{Value: 1, Unit: "mm[Hg]"}),
+				"Month":   newOrFatal(t, result.Quantity{Value: 1, Unit: "month"}),
+			},
+			new: map[string]result.Value{
+				"Known":   newOrFatal(t, result.Quantity{Value: 1, Unit: "mL"}),
+				"Unknown": newOrFatal(t, result.Quantity{Value: 1, Unit: "kPa"}),
+				"Month":   newOrFatal(t, result.Quantity{Value: 30, Unit: "days"}),
+			},
+			want: []string{"~ Known: 1 'g' -> 1 'mL'", "~ Month: 1 'month' -> 30 'days'", "~ Unknown: 1 'mm[Hg]' -> 1 'kPa'"},
+		},
+		{
+			name: "List to null",
+			old:  map[string]result.Value{"L": newListOrFatal(t, 1, 2)},
+			new:  map[string]result.Value{"L": newOrFatal(t, nil)},
+			want: []string{"~ L: {1, 2} -> null"},
+		},
+		{
+			name: "Ordered list",
+			old:  map[string]result.Value{"L": newListOrFatal(t, 1, 2, 3)},
+			new:  map[string]result.Value{"L": newListOrFatal(t, 1, 3)},
+			want: []string{"~ L[1]: 2 -> 3", "- L[2]: 3"},
+		},
+		{
+			name: "Unordered list with the same elements",
+			old:  map[string]result.Value{"L": newListOrFatal(t, 1, 2, 2, 3)},
+			new:  map[string]result.Value{"L": newListOrFatal(t, 2, 3, 1, 2)},
+			opts: Options{UnorderedLists: true},
+			want: []string{},
+		},
+		{
+			name: "Unordered list with different elements",
+			old:  map[string]result.Value{"L": newListOrFatal(t, 1, 2, 2)},
+			new:  map[string]result.Value{"L": newListOrFatal(t, 2, 4)},
+			opts: Options{UnorderedLists: true},
+			want: []string{"- L[0]: 1", "- L[2]: 2", "+ L[1]: 4"},
+		},
+		{
+			name: "Tuple",
+			old: map[string]result.Value{"T": newOrFatal(t, result.Tuple{
+				Value:       map[string]result.Value{"a": newOrFatal(t, 1), "b": newOrFatal(t, "x")},
+				RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"a": types.Integer, "b": types.String}},
+			})},
+			new: map[string]result.Value{"T": newOrFatal(t, result.Tuple{
+				Value:       map[string]result.Value{"a": newOrFatal(t, 2), "c": newOrFatal(t, true)},
+				RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"a": types.Integer, "c": types.Boolean}},
+			})},
+			want: []string{"~ T.a: 1 -> 2", "- T.b: 'x'", "+ T.c: true"},
+		},
+		{
+			name: "Interval",
+			old: map[string]result.Value{"I": newOrFatal(t, result.Interval{
+				Low:           newOrFatal(t, result.Date{Date: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+				High:          newOrFatal(t, result.Date{Date: time.Date(2024, time.December, 31, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+				LowInclusive:  true,
+				HighInclusive: true,
+				StaticType:    &types.Interval{PointType: types.Date},
+			})},
+			new: map[string]result.Value{"I": newOrFatal(t, result.Interval{
+				Low:           newOrFatal(t, result.Date{Date: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+				High:          newOrFatal(t, result.Date{Date: time.Date(2024, time.December, 31, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+				LowInclusive:  true,
+				HighInclusive: false,
+				StaticType:    &types.Interval{PointType: types.Date},
+			})},
+			want: []string{"~ I: Interval[@2024-01-01, @2024-12-31] -> Interval[@2024-01-01, @2024-12-31)"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			diffs := Compare(result.Libraries{lib: tc.old}, result.Libraries{lib: tc.new}, tc.opts)
+			got := make([]string, 0, len(diffs))
+			for _, d := range diffs {
+				got = append(got, d.String())
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Compare() diff (-want +got):\n%s", diff)
+			}
+			if gotEqual, wantEqual := Equal(result.Libraries{lib: tc.old}, result.Libraries{lib: tc.new}, tc.opts), len(tc.want) == 0; gotEqual != wantEqual {
+				t.Errorf("Equal() = %v, want %v", gotEqual, wantEqual)
+			}
+		})
+	}
+}
+
+func TestCompare_Libraries(t *testing.T) {
+	v1 := result.LibKey{Name: "Measure", Version: "1.0.0"}
+	v2 := result.LibKey{Name: "Measure", Version: "2.0.0"}
+	other := result.LibKey{Name: "Other"}
+	old := result.Libraries{
+		v1:    {"A": newOrFatal(t, 1)},
+		other: {"B": newOrFatal(t, 1)},
+	}
+	new := result.Libraries{v2: {"A": newOrFatal(t, 2)}}
+
+	tests := []struct {
+		name string
+		opts Options
+		want []Difference
+	}{
+		{
+			name: "Versions must match",
+			want: []Difference{
+				{Library: v1, Define: "A", Kind: Removed, Old: ptrOrFatal(t, 1)},
+				{Library: v2, Define: "A", Kind: Added, New: ptrOrFatal(t, 2)},
+				{Library: other, Define: "B", Kind: Removed, Old: ptrOrFatal(t, 1)},
+			},
+		},
+		{
+			name: "Ignore library versions",
+			opts: Options{IgnoreLibraryVersions: true},
+			want: []Difference{
+				{Library: v2, Define: "A", Kind: Changed, Old: ptrOrFatal(t, 1), New: ptrOrFatal(t, 2)},
+				{Library: other, Define: "B", Kind: Removed, Old: ptrOrFatal(t, 1)},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, Compare(old, new, tc.opts)); diff != "" {
+				t.Errorf("Compare() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	old := result.Libraries{
+		lib:                              {"Denominator": newOrFatal(t, true), "Stratifier": newListOrFatal(t, "female", "male")},
+		result.LibKey{Name: "Helpers"}:   {"Age": newOrFatal(t, result.Quantity{Value: 40, Unit: "years"})},
+		result.LibKey{Name: "Unchanged"}: {"A": newOrFatal(t, 1)},
+	}
+	new := result.Libraries{
+		lib:                              {"Denominator": newOrFatal(t, false), "Numerator": newOrFatal(t, true), "Stratifier": newListOrFatal(t, "female")},
+		result.LibKey{Name: "Helpers"}:   {"Age": newOrFatal(t, result.Quantity{Value: 41, Unit: "years"})},
+		result.LibKey{Name: "Unchanged"}: {"A": newOrFatal(t, 1)},
+	}
+	want := `Helpers
+  ~ Age: 40 'years' -> 41 'years'
+TESTLIB 1.0.0
+  ~ Denominator: true -> false
+  + Numerator: true
+  - Stratifier[1]: 'male'
+4 difference(s).
+`
+	if diff := cmp.Diff(want, Report(Compare(old, new, Options{}))); diff != "" {
+		t.Errorf("Report() diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("No differences.\n", Report(nil)); diff != "" {
+		t.Errorf("Report(nil) diff (-want +got):\n%s", diff)
+	}
+}
+
+func newOrFatal(t *testing.T, a any) result.Value {
+	t.Helper()
+	v, err := result.New(a)
+	if err != nil {
+		t.Fatalf("New(%v) returned unexpected error: %v", a, err)
+	}
+	return v
+}
+
+func newListOrFatal(t *testing.T, elems ...any) result.Value {
+	t.Helper()
+	var vals []result.Value
+	var elemType types.IType = types.Any
+	for _, e := range elems {
+		v := newOrFatal(t, e)
+		elemType = v.RuntimeType()
+		vals = append(vals, v)
+	}
+	return newOrFatal(t, result.List{Value: vals, StaticType: &types.List{ElementType: elemType}})
+}
+
+func ptrOrFatal(t *testing.T, a any) *result.Value {
+	t.Helper()
+	v := newOrFatal(t, a)
+	return &v
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+// unitScale is a unit expressed as a multiple of a base unit of the same dimension.
+type unitScale struct {
+	base   string
+	factor float64
+}
+
+// units holds the common UCUM units, and the CQL calendar duration keywords, that are normalized
+// before Quantities are compared. Units that are not listed are only equal to themselves. Calendar
+// durations of years and months are kept apart from days, because their length varies.
+var units = map[string]unitScale{
+	// Mass.
+	"kg": {"g", 1e3},
+	"g":  {"g", 1},
+	"mg": {"g", 1e-3},
+	"ug": {"g", 1e-6},
+	"ng": {"g", 1e-9},
+	// Length.
+	"km": {"m", 1e3},
+	"m":  {"m", 1},
+	"cm": {"m", 1e-2},
+	"mm": {"m", 1e-3},
+	// Volume.
+	"L":  {"L", 1},
+	"l":  {"L", 1},
+	"dL": {"L", 1e-1},
+	"mL": {"L", 1e-3},
+	"uL": {"L", 1e-6},
+	// Time.
+	"a":            {"a", 1},
+	"year":         {"a", 1},
+	"years":        {"a", 1},
+	"mo":           {"mo", 1},
+	"month":        {"mo", 1},
+	"months":       {"mo", 1},
+	"wk":           {"s", 7 * 24 * 60 * 60},
+	"week":         {"s", 7 * 24 * 60 * 60},
+	"weeks":        {"s", 7 * 24 * 60 * 60},
+	"d":            {"s", 24 * 60 * 60},
+	"day":          {"s", 24 * 60 * 60},
+	"days":         {"s", 24 * 60 * 60},
+	"h":            {"s", 60 * 60},
+	"hour":         {"s", 60 * 60},
+	"hours":        {"s", 60 * 60},
+	"min":          {"s", 60},
+	"minute":       {"s", 60},
+	"minutes":      {"s", 60},
+	"s":            {"s", 1},
+	"second":       {"s", 1},
+	"seconds":      {"s", 1},
+	"ms":           {"s", 1e-3},
+	"millisecond":  {"s", 1e-3},
+	"milliseconds": {"s", 1e-3},
+	// Dimensionless.
+	"":  {"1", 1},
+	"1": {"1", 1},
+	"%": {"1", 1e-2},
+}
+
+// normalizeUnit converts the value to the base unit of its dimension, if the unit is known.
+func normalizeUnit(value float64, unit string) (float64, string) {
+	s, ok := units[unit]
+	if !ok {
+		return value, unit
+	}
+	return value * s.factor, s.base
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DefineFilter selects which expression definitions are kept in results, in addition to the
+// public/private selection made during evaluation. Names and regular expressions are matched
+// against both the name of the definition and the name qualified by its library, for example
+// "Numerator" and "MyMeasure.Numerator". The zero DefineFilter keeps every definition.
+type DefineFilter struct {
+	// IncludeNames and IncludeRegex if either is set keep only the definitions that are named in
+	// IncludeNames or match IncludeRegex.
+	IncludeNames []string
+	IncludeRegex *regexp.Regexp
+	// ExcludeNames and ExcludeRegex drop the definitions that are named in ExcludeNames or match
+	// ExcludeRegex, even if they are included.
+	ExcludeNames []string
+	ExcludeRegex *regexp.Regexp
+}
+
+// ParseDefineFilter returns a DefineFilter from the string form used by command line flags.
+// includeNames and excludeNames are comma separated lists of names, and includeRegex and
+// excludeRegex are regular expressions. Empty strings leave the respective filter unset.
+func ParseDefineFilter(includeNames, includeRegex, excludeNames, excludeRegex string) (DefineFilter, error) {
+	f := DefineFilter{IncludeNames: splitNames(includeNames), ExcludeNames: splitNames(excludeNames)}
+	var err error
+	if includeRegex != "" {
+		if f.IncludeRegex, err = regexp.Compile(includeRegex); err != nil {
+			return DefineFilter{}, fmt.Errorf("invalid include regex %q: %w", includeRegex, err)
+		}
+	}
+	if excludeRegex != "" {
+		if f.ExcludeRegex, err = regexp.Compile(excludeRegex); err != nil {
+			return DefineFilter{}, fmt.Errorf("invalid exclude regex %q: %w", excludeRegex, err)
+		}
+	}
+	return f, nil
+}
+
+func splitNames(names string) []string {
+	var out []string
+	for _, n := range strings.Split(names, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// IsZero returns true if the filter keeps every definition.
+func (f DefineFilter) IsZero() bool {
+	return len(f.IncludeNames) == 0 && f.IncludeRegex == nil && len(f.ExcludeNames) == 0 && f.ExcludeRegex == nil
+}
+
+// Keep returns true if the definition with the given name in the given library passes the filter.
+func (f DefineFilter) Keep(lib LibKey, name string) bool {
+	qualified := lib.Name + "." + name
+	matches := func(names []string, re *regexp.Regexp) bool {
+		if slices.Contains(names, name) || slices.Contains(names, qualified) {
+			return true
+		}
+		return re != nil && (re.MatchString(name) || re.MatchString(qualified))
+	}
+	if (len(f.IncludeNames) > 0 || f.IncludeRegex != nil) && !matches(f.IncludeNames, f.IncludeRegex) {
+		return false
+	}
+	return !matches(f.ExcludeNames, f.ExcludeRegex)
+}
+
+// Filter returns the results with only the definitions kept by the filter. Libraries left without
+// any definitions are dropped. The receiver is not modified.
+func (l Libraries) Filter(f DefineFilter) Libraries {
+	if f.IsZero() {
+		return l
+	}
+	out := make(Libraries, len(l))
+	for k, defs := range l {
+		kept := make(map[string]Value)
+		for name, v := range defs {
+			if f.Keep(k, name) {
+				kept[name] = v
+			}
+		}
+		if len(kept) > 0 {
+			out[k] = kept
+		}
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDefineFilter_Keep(t *testing.T) {
+	lib := LibKey{Name: "Measure", Version: "1.0.0"}
+	tests := []struct {
+		name   string
+		filter DefineFilter
+		def    string
+		want   bool
+	}{
+		{name: "Zero filter keeps everything", filter: DefineFilter{}, def: "Numerator", want: true},
+		{name: "Included by name", filter: DefineFilter{IncludeNames: []string{"Numerator"}}, def: "Numerator", want: true},
+		{name: "Included by qualified name", filter: DefineFilter{IncludeNames: []string{"Measure.Numerator"}}, def: "Numerator", want: true},
+		{name: "Qualified name of another library", filter: DefineFilter{IncludeNames: []string{"Other.Numerator"}}, def: "Numerator", want: false},
+		{name: "Not included", filter: DefineFilter{IncludeNames: []string{"Numerator"}}, def: "Denominator", want: false},
+		{name: "Included by regex", filter: DefineFilter{IncludeRegex: regexp.MustCompile("^Stratum")}, def: "Stratum 1", want: true},
+		{name: "Included by regex on qualified name", filter: DefineFilter{IncludeRegex: regexp.MustCompile(`^Measure\.`)}, def: "Numerator", want: true},
+		{name: "Included by name or regex", filter: DefineFilter{IncludeNames: []string{"Numerator"}, IncludeRegex: regexp.MustCompile("^Stratum")}, def: "Numerator", want: true},
+		{name: "Excluded by name", filter: DefineFilter{ExcludeNames: []string{"Numerator"}}, def: "Numerator", want: false},
+		{name: "Excluded by regex", filter: DefineFilter{ExcludeRegex: regexp.MustCompile("(?i)debug")}, def: "Debug Values", want: false},
+		{name: "Exclude takes precedence", filter: DefineFilter{IncludeNames: []string{"Numerator"}, ExcludeRegex: regexp.MustCompile("Num")}, def: "Numerator", want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.filter.Keep(lib, tc.def); got != tc.want {
+				t.Errorf("Keep(%v, %q) = %v, want %v", lib, tc.def, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseDefineFilter(t *testing.T) {
+	f, err := ParseDefineFilter(" Numerator, ,Measure.Denominator ", "^Stratum", "Denominator", "")
+	if err != nil {
+		t.Fatalf("ParseDefineFilter() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Numerator", "Measure.Denominator"}, f.IncludeNames); diff != "" {
+		t.Errorf("ParseDefineFilter() IncludeNames diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"Denominator"}, f.ExcludeNames); diff != "" {
+		t.Errorf("ParseDefineFilter() ExcludeNames diff (-want +got):\n%s", diff)
+	}
+	if f.IncludeRegex == nil || f.IncludeRegex.String() != "^Stratum" {
+		t.Errorf("ParseDefineFilter() IncludeRegex = %v, want ^Stratum", f.IncludeRegex)
+	}
+	if f.ExcludeRegex != nil {
+		t.Errorf("ParseDefineFilter() ExcludeRegex = %v, want nil", f.ExcludeRegex)
+	}
+
+	empty, err := ParseDefineFilter("", "", "", "")
+	if err != nil {
+		t.Fatalf("ParseDefineFilter() returned unexpected error: %v", err)
+	}
+	if !empty.IsZero() {
+		t.Errorf("ParseDefineFilter() of empty strings = %+v, want zero filter", empty)
+	}
+
+	if _, err := ParseDefineFilter("", "", "", "("); err == nil {
+		t.Errorf("ParseDefineFilter() with an invalid regex succeeded, want error")
+	}
+}
+
+func TestLibraries_Filter(t *testing.T) {
+	measure := LibKey{Name: "Measure", Version: "1.0.0"}
+	helpers := LibKey{Name: "Helpers"}
+	libs := Libraries{
+		measure: map[string]Value{
+			"Numerator":   newOrFatal(t, true),
+			"Denominator": newOrFatal(t, true),
+		},
+		helpers: map[string]Value{
+			"Helper": newOrFatal(t, 1),
+		},
+	}
+
+	got := libs.Filter(DefineFilter{IncludeNames: []string{"Numerator"}})
+	want := Libraries{measure: map[string]Value{"Numerator": newOrFatal(t, true)}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Filter() diff (-want +got):\n%s", diff)
+	}
+	if len(libs[measure]) != 2 || len(libs[helpers]) != 1 {
+		t.Errorf("Filter() modified the receiver: %v", libs)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/cql/types"
+)
+
+// JSONOptions configures the JSON encoding of results by Libraries.MarshalJSONWithOptions.
+type JSONOptions struct {
+	// Compact selects an encoding that is several times smaller than the default encoding, for
+	// storing results at population scale:
+	//   - Expression definitions and tuple elements that are null are omitted, as are null interval
+	//     bounds. Null list elements are encoded as JSON null to keep the position of the others.
+	//   - Type tags of System types drop the namespace, for example "Integer" instead of
+	//     "System.Integer" and "List<Date>" instead of "List<System.Date>".
+	//
+	// Libraries in the compact encoding have an "encoding" of "compact". Unlike the default encoding,
+	// the compact encoding is not described by JSONSchema.
+	Compact bool
+
+	// Resources selects how FHIR resources are rendered. FHIR elements that are not resources, such
+	// as a FHIR.CodeableConcept, are always rendered as proto JSON.
+	Resources ResourceRendering
+}
+
+// ResourceRendering selects how FHIR resources returned by expression definitions are rendered in
+// the JSON results.
+type ResourceRendering int
+
+const (
+	// ResourceProtoJSON renders FHIR resources as the proto JSON of the underlying FHIR proto. This
+	// is the default and what MarshalJSON returns.
+	ResourceProtoJSON ResourceRendering = iota
+	// ResourceFHIRJSON renders FHIR resources as FHIR JSON, the format of the bundles the resources
+	// were read from.
+	ResourceFHIRJSON
+	// ResourceReference renders only the type and id of FHIR resources, for example
+	// {"resourceType": "Patient", "id": "123"}. This keeps results small when definitions return
+	// many resources that are already stored elsewhere.
+	ResourceReference
+)
+
+var resourceRenderingNames = map[ResourceRendering]string{
+	ResourceProtoJSON: "proto",
+	ResourceFHIRJSON:  "fhir",
+	ResourceReference: "reference",
+}
+
+// String returns the name of the rendering, as accepted by ParseResourceRendering.
+func (r ResourceRendering) String() string {
+	if n, ok := resourceRenderingNames[r]; ok {
+		return n
+	}
+	return fmt.Sprintf("ResourceRendering(%d)", int(r))
+}
+
+// ParseResourceRendering returns the ResourceRendering named proto, fhir or reference.
+func ParseResourceRendering(name string) (ResourceRendering, error) {
+	for r, n := range resourceRenderingNames {
+		if n == name {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown resource rendering %q, want one of proto, fhir or reference", name)
+}
+
+// CompactJSONEncoding is the encoding of libraries marshaled with JSONOptions.Compact.
+const CompactJSONEncoding = "compact"
+
+type optionsLibJSON struct {
+	FormatVersion string                     `json:"formatVersion"`
+	Encoding      string                     `json:"encoding,omitempty"`
+	Name          string                     `json:"libName"`
+	Version       string                     `json:"libVersion"`
+	ExpDefs       map[string]json.RawMessage `json:"expressionDefinitions"`
+	DefMetadata   map[string]defMetadataJSON `json:"defineMetadata,omitempty"`
+}
+
+// MarshalJSONWithOptions returns the results as JSON in the encoding selected by opts. With the
+// zero JSONOptions the output is the same as MarshalJSON. Like MarshalJSON, the output is not
+// indented and is deterministic.
+func (l Libraries) MarshalJSONWithOptions(opts JSONOptions) ([]byte, error) {
+	if opts == (JSONOptions{}) {
+		return l.MarshalJSON()
+	}
+	var encoding string
+	if opts.Compact {
+		encoding = CompactJSONEncoding
+	}
+	r := make([]optionsLibJSON, 0, len(l))
+	for _, k := range sortedLibKeys(l) {
+		defs := make(map[string]json.RawMessage, len(l[k]))
+		for name, v := range l[k] {
+			if opts.Compact && IsNull(v) {
+				continue
+			}
+			b, err := v.marshalJSONWithOptions(opts)
+			if err != nil {
+				return nil, err
+			}
+			defs[name] = b
+		}
+		meta, err := metadataJSON(l[k], opts.Compact)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, optionsLibJSON{
+			FormatVersion: JSONFormatVersion,
+			Encoding:      encoding,
+			Name:          k.Name,
+			Version:       k.Version,
+			ExpDefs:       defs,
+			DefMetadata:   meta,
+		})
+	}
+	return json.Marshal(r)
+}
+
+// marshalJSONWithOptions returns the JSON encoding of the value selected by opts.
+func (v Value) marshalJSONWithOptions(opts JSONOptions) ([]byte, error) {
+	switch gv := v.goValue.(type) {
+	case nil:
+		if opts.Compact {
+			return []byte("null"), nil
+		}
+	case List:
+		elems := make([]json.RawMessage, 0, len(gv.Value))
+		for _, e := range gv.Value {
+			b, err := e.marshalJSONWithOptions(opts)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, b)
+		}
+		return json.Marshal(elems)
+	case Tuple:
+		elems := make(map[string]json.RawMessage, len(gv.Value))
+		for name, e := range gv.Value {
+			if opts.Compact && IsNull(e) {
+				continue
+			}
+			b, err := e.marshalJSONWithOptions(opts)
+			if err != nil {
+				return nil, err
+			}
+			elems[name] = b
+		}
+		return json.Marshal(elems)
+	case Named:
+		if opts.Resources != ResourceProtoJSON && isFHIRResource(gv.Value) {
+			return gv.resourceJSON(opts)
+		}
+	case Interval:
+		if opts.Compact {
+			return gv.compactJSON(v.RuntimeType())
+		}
+	case Ratio:
+		if opts.Compact {
+			return gv.compactJSON()
+		}
+	case Concept:
+		if opts.Compact {
+			return gv.compactJSON()
+		}
+	}
+	if !opts.Compact {
+		return v.MarshalJSON()
+	}
+	rt, err := typeJSON(v.RuntimeType(), true)
+	if err != nil {
+		return nil, err
+	}
+	return v.marshalJSONWithType(rt)
+}
+
+// resourceJSON returns the JSON of a Named FHIR resource rendered as selected by opts.Resources.
+func (n Named) resourceJSON(opts JSONOptions) ([]byte, error) {
+	rt, err := typeJSON(n.RuntimeType, opts.Compact)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	switch opts.Resources {
+	case ResourceFHIRJSON:
+		m, err := r4Marshaller()
+		if err != nil {
+			return nil, err
+		}
+		if value, err = m.MarshalResource(n.Value); err != nil {
+			return nil, err
+		}
+	case ResourceReference:
+		ref := struct {
+			ResourceType string `json:"resourceType"`
+			ID           string `json:"id,omitempty"`
+		}{ResourceType: string(n.Value.ProtoReflect().Descriptor().Name())}
+		if r, ok := resourceRef(n.Value); ok {
+			ref.ID = r.ID
+		}
+		if value, err = json.Marshal(ref); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported resource rendering %v", opts.Resources)
+	}
+	return json.Marshal(struct {
+		Type  json.RawMessage `json:"@type"`
+		Value json.RawMessage `json:"value"`
+	}{
+		Type:  rt,
+		Value: value,
+	})
+}
+
+func (i Interval) compactJSON(t types.IType) ([]byte, error) {
+	rt, err := typeJSON(t, true)
+	if err != nil {
+		return nil, err
+	}
+	var low, high json.RawMessage
+	if !IsNull(i.Low) {
+		if low, err = i.Low.marshalJSONWithOptions(JSONOptions{Compact: true}); err != nil {
+			return nil, err
+		}
+	}
+	if !IsNull(i.High) {
+		if high, err = i.High.marshalJSONWithOptions(JSONOptions{Compact: true}); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(struct {
+		Type          json.RawMessage `json:"@type"`
+		Low           json.RawMessage `json:"low,omitempty"`
+		High          json.RawMessage `json:"high,omitempty"`
+		LowInclusive  bool            `json:"lowClosed"`
+		HighInclusive bool            `json:"highClosed"`
+	}{
+		Type:          rt,
+		Low:           low,
+		High:          high,
+		LowInclusive:  i.LowInclusive,
+		HighInclusive: i.HighInclusive,
+	})
+}
+
+func (r Ratio) compactJSON() ([]byte, error) {
+	quantityType, err := typeJSON(types.Quantity, true)
+	if err != nil {
+		return nil, err
+	}
+	numerator, err := r.Numerator.marshalJSON(quantityType)
+	if err != nil {
+		return nil, err
+	}
+	denominator, err := r.Denominator.marshalJSON(quantityType)
+	if err != nil {
+		return nil, err
+	}
+	ratioType, err := typeJSON(types.Ratio, true)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Type        json.RawMessage `json:"@type"`
+		Numerator   json.RawMessage `json:"numerator"`
+		Denominator json.RawMessage `json:"denominator"`
+	}{
+		Type:        ratioType,
+		Numerator:   numerator,
+		Denominator: denominator,
+	})
+}
+
+func (c Concept) compactJSON() ([]byte, error) {
+	codeType, err := typeJSON(types.Code, true)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]json.RawMessage, 0, len(c.Codes))
+	for _, code := range c.Codes {
+		if code == nil {
+			codes = append(codes, json.RawMessage("null"))
+			continue
+		}
+		b, err := code.marshalJSON(codeType)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, b)
+	}
+	conceptType, err := typeJSON(types.Concept, true)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Type    json.RawMessage   `json:"@type"`
+		Codes   []json.RawMessage `json:"codes"`
+		Display string            `json:"display,omitempty"`
+	}{
+		Type:    conceptType,
+		Codes:   codes,
+		Display: c.Display,
+	})
+}
+
+// typeJSON returns the JSON type tag of t. If short is true the System namespace is dropped.
+func typeJSON(t types.IType, short bool) (json.RawMessage, error) {
+	b, err := t.MarshalJSON()
+	if err != nil || !short {
+		return b, err
+	}
+	return bytes.ReplaceAll(b, []byte("System."), nil), nil
+}
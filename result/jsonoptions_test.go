@@ -0,0 +1,232 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"testing"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+
+	c4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	d4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4patientpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
+)
+
+func TestLibraries_MarshalJSONWithOptions(t *testing.T) {
+	lib := LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	tests := []struct {
+		name string
+		defs map[string]Value
+		want string
+	}{
+		{
+			name: "Short type tags and empty list",
+			defs: map[string]Value{
+				"Int":  newOrFatal(t, 1),
+				"Date": newOrFatal(t, List{Value: []Value{}, StaticType: &types.List{ElementType: types.Date}}),
+			},
+			want: `[{"formatVersion":"1.1","encoding":"compact","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Date":[],"Int":{"@type":"Integer","value":1}}}]`,
+		},
+		{
+			name: "Null defines omitted",
+			defs: map[string]Value{
+				"Null": newOrFatal(t, nil),
+				"Bool": newOrFatal(t, true),
+			},
+			want: `[{"formatVersion":"1.1","encoding":"compact","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Bool":{"@type":"Boolean","value":true}}}]`,
+		},
+		{
+			name: "Null list elements kept",
+			defs: map[string]Value{
+				"List": newOrFatal(t, List{Value: []Value{newOrFatal(t, 1), newOrFatal(t, nil)}, StaticType: &types.List{ElementType: types.Integer}}),
+			},
+			want: `[{"formatVersion":"1.1","encoding":"compact","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"List":[{"@type":"Integer","value":1},null]}}]`,
+		},
+		{
+			name: "Null tuple elements omitted",
+			defs: map[string]Value{
+				"Tuple": newOrFatal(t, Tuple{
+					Value:       map[string]Value{"Apple": newOrFatal(t, 1), "Banana": newOrFatal(t, nil)},
+					RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"Apple": types.Integer, "Banana": types.Integer}},
+				}),
+			},
+			want: `[{"formatVersion":"1.1","encoding":"compact","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Tuple":{"Apple":{"@type":"Integer","value":1}}}}]`,
+		},
+		{
+			name: "Null interval bound omitted",
+			defs: map[string]Value{
+				"Interval": newOrFatal(t, Interval{
+					Low:           newOrFatal(t, 1),
+					High:          newOrFatal(t, nil),
+					LowInclusive:  true,
+					HighInclusive: false,
+					StaticType:    &types.Interval{PointType: types.Integer},
+				}),
+			},
+			want: `[{"formatVersion":"1.1","encoding":"compact","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Interval":{"@type":"Interval\u003cInteger\u003e","low":{"@type":"Integer","value":1},"lowClosed":true,"highClosed":false}}}]`,
+		},
+		{
+			name: "Ratio and Concept",
+			defs: map[string]Value{
+				"Ratio": newOrFatal(t, Ratio{
+					Numerator:   Quantity{Value: 1, Unit: "mg"},
+					Denominator: Quantity{Value: 2, Unit: "mL"},
+				}),
+				"Concept": newOrFatal(t, Concept{
+					Codes:   []*Code{{Code: "1", System: "sys"}},
+					Display: "concept",
+				}),
+			},
+			want: `[{"formatVersion":"1.1","encoding":"compact","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Concept":{"@type":"Concept","codes":[{"@type":"Code","code":"1","system":"sys"}],"display":"concept"},"Ratio":{"@type":"Ratio","numerator":{"@type":"Quantity","value":1,"unit":"mg"},"denominator":{"@type":"Quantity","value":2,"unit":"mL"}}}}]`,
+		},
+		{
+			name: "Metadata uses short type tags",
+			defs: map[string]Value{
+				"Def": newOrFatal(t, 1).WithDefMetadata(DefMetadata{
+					Kind:         ExpressionDefinition,
+					AccessLevel:  model.Public,
+					DeclaredType: types.Integer,
+					Library:      lib,
+				}),
+			},
+			want: `[{"formatVersion":"1.1","encoding":"compact","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Def":{"@type":"Integer","value":1}},"defineMetadata":{"Def":{"kind":"expressionDefinition","accessLevel":"PUBLIC","declaredType":"Integer","libVersion":"1.0.0"}}}]`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Libraries{lib: tc.defs}.MarshalJSONWithOptions(JSONOptions{Compact: true})
+			if err != nil {
+				t.Fatalf("MarshalJSONWithOptions() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MarshalJSONWithOptions() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLibraries_MarshalJSONWithOptions_DefaultMatchesMarshalJSON(t *testing.T) {
+	libs := Libraries{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]Value{
+			"Null": newOrFatal(t, nil),
+			"Int":  newOrFatal(t, 1),
+		},
+	}
+	want, err := libs.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON() returned unexpected error: %v", err)
+	}
+	got, err := libs.MarshalJSONWithOptions(JSONOptions{})
+	if err != nil {
+		t.Fatalf("MarshalJSONWithOptions() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(string(want), string(got)); diff != "" {
+		t.Errorf("MarshalJSONWithOptions() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLibraries_MarshalJSONWithOptions_CompactIsSmaller(t *testing.T) {
+	var elems []Value
+	for i := 0; i < 10; i++ {
+		elems = append(elems, newOrFatal(t, i), newOrFatal(t, nil))
+	}
+	libs := Libraries{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]Value{
+			"List": newOrFatal(t, List{Value: elems, StaticType: &types.List{ElementType: types.Integer}}),
+			"Null": newOrFatal(t, nil),
+		},
+	}
+	verbose, err := libs.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON() returned unexpected error: %v", err)
+	}
+	compact, err := libs.MarshalJSONWithOptions(JSONOptions{Compact: true})
+	if err != nil {
+		t.Fatalf("MarshalJSONWithOptions() returned unexpected error: %v", err)
+	}
+	if len(compact) >= len(verbose) {
+		t.Errorf("compact encoding is %d bytes, want less than the default encoding's %d bytes", len(compact), len(verbose))
+	}
+}
+
+func TestLibraries_MarshalJSONWithOptions_Resources(t *testing.T) {
+	lib := LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	patientType := &types.Named{TypeName: "FHIR.Patient"}
+	patient := newOrFatal(t, Named{
+		Value: &r4patientpb.Patient{
+			Id:     &d4pb.Id{Value: "123"},
+			Active: &d4pb.Boolean{Value: true},
+		},
+		RuntimeType: patientType,
+	})
+	gender := newOrFatal(t, Named{
+		Value:       &r4patientpb.Patient_GenderCode{Value: c4pb.AdministrativeGenderCode_MALE},
+		RuntimeType: &types.Named{TypeName: "FHIR.AdministrativeGender"},
+	})
+	defs := map[string]Value{
+		"Patient":  patient,
+		"Patients": newOrFatal(t, List{Value: []Value{patient}, StaticType: &types.List{ElementType: patientType}}),
+		"Gender":   gender,
+	}
+	tests := []struct {
+		name string
+		opts JSONOptions
+		want string
+	}{
+		{
+			name: "FHIR JSON",
+			opts: JSONOptions{Resources: ResourceFHIRJSON},
+			want: `[{"formatVersion":"1.1","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Gender":{"@type":"FHIR.AdministrativeGender","value":{"value":"MALE"}},"Patient":{"@type":"FHIR.Patient","value":{"active":true,"id":"123","resourceType":"Patient"}},"Patients":[{"@type":"FHIR.Patient","value":{"active":true,"id":"123","resourceType":"Patient"}}]}}]`,
+		},
+		{
+			name: "Reference",
+			opts: JSONOptions{Resources: ResourceReference},
+			want: `[{"formatVersion":"1.1","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Gender":{"@type":"FHIR.AdministrativeGender","value":{"value":"MALE"}},"Patient":{"@type":"FHIR.Patient","value":{"resourceType":"Patient","id":"123"}},"Patients":[{"@type":"FHIR.Patient","value":{"resourceType":"Patient","id":"123"}}]}}]`,
+		},
+		{
+			name: "Compact reference",
+			opts: JSONOptions{Compact: true, Resources: ResourceReference},
+			want: `[{"formatVersion":"1.1","encoding":"compact","libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"Gender":{"@type":"FHIR.AdministrativeGender","value":{"value":"MALE"}},"Patient":{"@type":"FHIR.Patient","value":{"resourceType":"Patient","id":"123"}},"Patients":[{"@type":"FHIR.Patient","value":{"resourceType":"Patient","id":"123"}}]}}]`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Libraries{lib: defs}.MarshalJSONWithOptions(tc.opts)
+			if err != nil {
+				t.Fatalf("MarshalJSONWithOptions() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MarshalJSONWithOptions() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseResourceRendering(t *testing.T) {
+	for _, r := range []ResourceRendering{ResourceProtoJSON, ResourceFHIRJSON, ResourceReference} {
+		got, err := ParseResourceRendering(r.String())
+		if err != nil {
+			t.Fatalf("ParseResourceRendering(%q) returned unexpected error: %v", r.String(), err)
+		}
+		if got != r {
+			t.Errorf("ParseResourceRendering(%q) = %v, want %v", r.String(), got, r)
+		}
+	}
+	if _, err := ParseResourceRendering("xml"); err == nil {
+		t.Errorf("ParseResourceRendering(%q) returned nil error, want error", "xml")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"encoding/json"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/types"
+)
+
+// DefKind is the kind of CQL definition that produced a result.
+type DefKind string
+
+const (
+	// ExpressionDefinition is a result produced by a `define` statement.
+	ExpressionDefinition DefKind = "expressionDefinition"
+	// ParameterDefinition is a result produced by a `parameter` statement.
+	ParameterDefinition DefKind = "parameter"
+	// CodeSystemDefinition is a result produced by a `codesystem` statement.
+	CodeSystemDefinition DefKind = "codeSystem"
+	// ValueSetDefinition is a result produced by a `valueset` statement.
+	ValueSetDefinition DefKind = "valueSet"
+	// CodeDefinition is a result produced by a `code` statement.
+	CodeDefinition DefKind = "code"
+	// ConceptDefinition is a result produced by a `concept` statement.
+	ConceptDefinition DefKind = "concept"
+)
+
+// DefMetadata describes the definition that produced a result. The interpreter records it on the
+// result of every definition it evaluates.
+type DefMetadata struct {
+	Kind DefKind
+	// AccessLevel is the access modifier of the definition. Private definitions are only returned
+	// if requested in the cql.EvalConfig.
+	AccessLevel model.AccessLevel
+	// DeclaredType is the static type of the definition computed by the parser, which may be more
+	// general than the runtime type of the result. It is nil if the type is unknown.
+	DeclaredType types.IType
+	// Library is the library, including its version, that contains the definition.
+	Library LibKey
+}
+
+// DefMetadata returns the metadata of the definition that produced this result. The second return
+// value is false if the value is not the result of a definition, for example an element of a list.
+func (v Value) DefMetadata() (DefMetadata, bool) {
+	if v.meta == nil {
+		return DefMetadata{}, false
+	}
+	return *v.meta, true
+}
+
+// WithDefMetadata returns a copy of the value with the given definition metadata.
+func (v Value) WithDefMetadata(m DefMetadata) Value {
+	v.meta = &m
+	return v
+}
+
+type defMetadataJSON struct {
+	Kind         DefKind           `json:"kind"`
+	AccessLevel  model.AccessLevel `json:"accessLevel"`
+	DeclaredType json.RawMessage   `json:"declaredType,omitempty"`
+	LibVersion   string            `json:"libVersion"`
+}
+
+// metadataJSON returns the JSON representation of the metadata of each definition that has it, or
+// nil if none do. If compact is true declared types use the short type tags of the compact
+// encoding.
+func metadataJSON(defs map[string]Value, compact bool) (map[string]defMetadataJSON, error) {
+	var out map[string]defMetadataJSON
+	for name, v := range defs {
+		m, ok := v.DefMetadata()
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]defMetadataJSON, len(defs))
+		}
+		j := defMetadataJSON{Kind: m.Kind, AccessLevel: m.AccessLevel, LibVersion: m.Library.Version}
+		if m.DeclaredType != nil && m.DeclaredType != types.Unset {
+			var err error
+			if j.DeclaredType, err = typeJSON(m.DeclaredType, compact); err != nil {
+				return nil, err
+			}
+		}
+		out[name] = j
+	}
+	return out, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDefMetadata(t *testing.T) {
+	plain := newOrFatal(t, 1)
+	if _, ok := plain.DefMetadata(); ok {
+		t.Errorf("DefMetadata() on a value without metadata returned ok, want !ok")
+	}
+
+	want := DefMetadata{
+		Kind:         ExpressionDefinition,
+		AccessLevel:  model.Private,
+		DeclaredType: types.Integer,
+		Library:      LibKey{Name: "TESTLIB", Version: "1.0.0"},
+	}
+	withMeta := plain.WithDefMetadata(want)
+	got, ok := withMeta.DefMetadata()
+	if !ok {
+		t.Fatalf("DefMetadata() returned !ok, want ok")
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("DefMetadata() diff (-want +got):\n%s", diff)
+	}
+	if !withMeta.Equal(plain) {
+		t.Errorf("Equal() = false for values only differing in metadata, want true")
+	}
+	if _, ok := plain.DefMetadata(); ok {
+		t.Errorf("WithDefMetadata() modified the original value")
+	}
+}
+
+func TestLibraries_MarshalJSONDefMetadata(t *testing.T) {
+	lib := LibKey{Name: "TESTLIB", Version: "1.0.0"}
+	libs := Libraries{
+		lib: map[string]Value{
+			"Def": newOrFatal(t, List{Value: []Value{}, StaticType: &types.List{ElementType: types.Integer}}).WithDefMetadata(DefMetadata{
+				Kind:         ExpressionDefinition,
+				AccessLevel:  model.Public,
+				DeclaredType: &types.List{ElementType: types.Integer},
+				Library:      lib,
+			}),
+			"Param": newOrFatal(t, nil).WithDefMetadata(DefMetadata{
+				Kind:         ParameterDefinition,
+				AccessLevel:  model.Private,
+				DeclaredType: types.Unset,
+				Library:      lib,
+			}),
+		},
+		LibKey{Name: "NOMETADATA"}: map[string]Value{"Def": newOrFatal(t, 1)},
+	}
+	b, err := json.Marshal(libs)
+	if err != nil {
+		t.Fatalf("json.Marshal() returned unexpected error: %v", err)
+	}
+	var got []struct {
+		Name        string                     `json:"libName"`
+		DefMetadata map[string]json.RawMessage `json:"defineMetadata"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("json.Unmarshal() returned unexpected error: %v", err)
+	}
+	gotMeta := make(map[string]map[string]string)
+	for _, l := range got {
+		if l.DefMetadata == nil {
+			continue
+		}
+		gotMeta[l.Name] = make(map[string]string)
+		for name, m := range l.DefMetadata {
+			gotMeta[l.Name][name] = string(m)
+		}
+	}
+	want := map[string]map[string]string{
+		"TESTLIB": {
+			"Def":   `{"kind":"expressionDefinition","accessLevel":"PUBLIC","declaredType":"List\u003cSystem.Integer\u003e","libVersion":"1.0.0"}`,
+			"Param": `{"kind":"parameter","accessLevel":"PRIVATE","libVersion":"1.0.0"}`,
+		},
+	}
+	if diff := cmp.Diff(want, gotMeta); diff != "" {
+		t.Errorf("MarshalJSON() defineMetadata diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cql/internal/datehelpers"
+	"github.com/google/cql/model"
+	"github.com/google/cql/types"
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// dataAbsentReasonURL is the extension marking a parameter whose CQL result was null.
+	dataAbsentReasonURL = "http://hl7.org/fhir/StructureDefinition/data-absent-reason"
+	// isEmptyListURL is the extension marking a parameter whose CQL result was an empty list.
+	isEmptyListURL = "http://hl7.org/fhir/StructureDefinition/cqf-isEmptyList"
+	// ucumSystem is the code system of Quantity units.
+	ucumSystem = "http://unitsofmeasure.org"
+)
+
+// ParametersJSON returns the expression definition results of a library as a FHIR Parameters
+// resource, following the $cql operation conventions from Using CQL with FHIR:
+// https://hl7.org/fhir/uv/cql/OperationDefinition-cql-cql.html
+//
+// Each expression definition becomes a parameter named after the definition, with the result in
+// the value[x] matching its type. FHIR resources are returned in the resource element, Tuples as
+// parts, and Lists as one parameter per element. Null results carry the data-absent-reason
+// extension and empty Lists the cqf-isEmptyList extension. Parameters are sorted by name.
+func ParametersJSON(defs map[string]Value) ([]byte, error) {
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []json.RawMessage
+	for _, name := range names {
+		p, err := fhirParameters(name, defs[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %s to a FHIR parameter: %w", name, err)
+		}
+		params = append(params, p...)
+	}
+	return json.Marshal(struct {
+		ResourceType string            `json:"resourceType"`
+		Parameter    []json.RawMessage `json:"parameter,omitempty"`
+	}{
+		ResourceType: "Parameters",
+		Parameter:    params,
+	})
+}
+
+// fhirParameters returns the FHIR parameters for a single named value. Lists produce one parameter
+// per element, all other values a single parameter.
+func fhirParameters(name string, v Value) ([]json.RawMessage, error) {
+	l, ok := v.goValue.(List)
+	if !ok {
+		p, err := fhirParameter(name, v)
+		if err != nil {
+			return nil, err
+		}
+		return []json.RawMessage{p}, nil
+	}
+	if len(l.Value) == 0 {
+		p, err := json.Marshal(struct {
+			Name      string       `json:"name"`
+			Extension []fhirObject `json:"extension"`
+		}{
+			Name:      name,
+			Extension: []fhirObject{{"url": isEmptyListURL, "valueBoolean": true}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []json.RawMessage{p}, nil
+	}
+	var params []json.RawMessage
+	for _, e := range l.Value {
+		ps, err := fhirParameters(name, e)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, ps...)
+	}
+	return params, nil
+}
+
+// fhirObject is a JSON object whose keys are written in insertion order, so that the name of a
+// parameter precedes its value.
+type fhirObject map[string]any
+
+func (o fhirObject) MarshalJSON() ([]byte, error) {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == "name") != (keys[j] == "name") {
+			return keys[i] == "name"
+		}
+		return keys[i] < keys[j]
+	})
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		vb, err := json.Marshal(o[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func fhirParameter(name string, v Value) (json.RawMessage, error) {
+	p := fhirObject{"name": name}
+	switch gv := v.goValue.(type) {
+	case nil:
+		p["extension"] = []fhirObject{{"url": dataAbsentReasonURL, "valueCode": "unknown"}}
+	case bool:
+		p["valueBoolean"] = gv
+	case int32:
+		p["valueInteger"] = gv
+	case int64:
+		// FHIR R4 has no 64 bit integer type.
+		p["valueDecimal"] = gv
+	case float64:
+		p["valueDecimal"] = gv
+	case string:
+		p["valueString"] = gv
+	case Date:
+		s, err := fhirDate(gv.Date, gv.Precision)
+		if err != nil {
+			return nil, err
+		}
+		p["valueDate"] = s
+	case DateTime:
+		s, err := fhirDateTime(gv)
+		if err != nil {
+			return nil, err
+		}
+		p["valueDateTime"] = s
+	case Time:
+		s, err := datehelpers.TimeString(gv.Date, gv.Precision)
+		if err != nil {
+			return nil, err
+		}
+		p["valueTime"] = s
+	case Quantity:
+		p["valueQuantity"] = fhirQuantity(gv)
+	case Ratio:
+		p["valueRatio"] = fhirObject{"numerator": fhirQuantity(gv.Numerator), "denominator": fhirQuantity(gv.Denominator)}
+	case Code:
+		p["valueCoding"] = fhirCoding(gv)
+	case Concept:
+		cc := fhirObject{}
+		var codings []fhirObject
+		for _, c := range gv.Codes {
+			if c != nil {
+				codings = append(codings, fhirCoding(*c))
+			}
+		}
+		if len(codings) > 0 {
+			cc["coding"] = codings
+		}
+		if gv.Display != "" {
+			cc["text"] = gv.Display
+		}
+		p["valueCodeableConcept"] = cc
+	case ValueSet:
+		p["valueCanonical"] = gv.Canonical()
+	case CodeSystem:
+		p["valueCanonical"] = gv.Canonical()
+	case Interval:
+		if err := setFHIRInterval(p, gv); err != nil {
+			return nil, err
+		}
+	case Tuple:
+		keys := make([]string, 0, len(gv.Value))
+		for k := range gv.Value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var parts []json.RawMessage
+		for _, k := range keys {
+			ps, err := fhirParameters(k, gv.Value[k])
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, ps...)
+		}
+		p["part"] = parts
+	case Named:
+		if err := setFHIRNamed(p, gv); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%T can not be converted to a FHIR parameter %w", gv, errUnsupportedType)
+	}
+	return json.Marshal(p)
+}
+
+func fhirQuantity(q Quantity) fhirObject {
+	o := fhirObject{"value": q.Value}
+	if q.Unit != "" && q.Unit != model.ONEUNIT {
+		o["unit"] = string(q.Unit)
+		o["system"] = ucumSystem
+		o["code"] = string(q.Unit)
+	}
+	return o
+}
+
+func fhirCoding(c Code) fhirObject {
+	o := fhirObject{"code": c.Code}
+	if c.System != "" {
+		o["system"] = c.System
+	}
+	if c.Version != "" {
+		o["version"] = c.Version
+	}
+	if c.Display != "" {
+		o["display"] = c.Display
+	}
+	return o
+}
+
+// fhirDate returns the FHIR date representation of a CQL Date, which unlike the CQL representation
+// has no leading @.
+func fhirDate(d time.Time, precision model.DateTimePrecision) (string, error) {
+	s, err := datehelpers.DateString(d, precision)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(s, "@"), nil
+}
+
+// fhirDateTime returns the FHIR dateTime representation of a CQL DateTime. FHIR dateTimes with a
+// time component must include seconds, and those with only a date must not have a timezone.
+func fhirDateTime(dt DateTime) (string, error) {
+	switch dt.Precision {
+	case model.YEAR, model.MONTH, model.DAY:
+		return fhirDate(dt.Date, dt.Precision)
+	case model.HOUR, model.MINUTE, model.SECOND:
+		return dt.Date.Format("2006-01-02T15:04:05Z07:00"), nil
+	case model.MILLISECOND:
+		return dt.Date.Format("2006-01-02T15:04:05.000Z07:00"), nil
+	}
+	return "", fmt.Errorf("unsupported precision in DateTime with value %v %w", dt.Precision, datehelpers.ErrUnsupportedPrecision)
+}
+
+// setFHIRInterval sets a Date or DateTime Interval as a Period and a numeric or Quantity Interval
+// as a Range. Other Intervals are returned as parts.
+func setFHIRInterval(p fhirObject, i Interval) error {
+	var pointType types.IType
+	if it, ok := inferIntervalType(i).(*types.Interval); ok {
+		pointType = it.PointType
+	}
+	switch pointType {
+	case types.Date, types.DateTime:
+		period := fhirObject{}
+		for key, v := range map[string]Value{"start": i.Low, "end": i.High} {
+			var s string
+			var err error
+			switch gv := v.goValue.(type) {
+			case nil:
+				continue
+			case Date:
+				s, err = fhirDate(gv.Date, gv.Precision)
+			case DateTime:
+				s, err = fhirDateTime(gv)
+			}
+			if err != nil {
+				return err
+			}
+			period[key] = s
+		}
+		p["valuePeriod"] = period
+	case types.Integer, types.Long, types.Decimal, types.Quantity:
+		rng := fhirObject{}
+		for key, v := range map[string]Value{"low": i.Low, "high": i.High} {
+			switch gv := v.goValue.(type) {
+			case Quantity:
+				rng[key] = fhirQuantity(gv)
+			case int32, int64, float64:
+				rng[key] = fhirObject{"value": gv}
+			}
+		}
+		p["valueRange"] = rng
+	default:
+		var parts []json.RawMessage
+		for _, part := range []struct {
+			name string
+			v    Value
+		}{{"low", i.Low}, {"high", i.High}} {
+			b, err := fhirParameter(part.name, part.v)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, b)
+		}
+		for _, part := range []struct {
+			name string
+			v    bool
+		}{{"lowClosed", i.LowInclusive}, {"highClosed", i.HighInclusive}} {
+			b, err := json.Marshal(fhirObject{"name": part.name, "valueBoolean": part.v})
+			if err != nil {
+				return err
+			}
+			parts = append(parts, b)
+		}
+		p["part"] = parts
+	}
+	return nil
+}
+
+// r4Marshaller returns a shared FHIR R4 JSON marshaller.
+var r4Marshaller = sync.OnceValues(func() (*jsonformat.Marshaller, error) {
+	return jsonformat.NewMarshaller(false, "", "", fhirversion.R4)
+})
+
+// fhirResourceTypes holds the proto names of all FHIR R4 resources, which are the message fields of
+// ContainedResource.
+var fhirResourceTypes = sync.OnceValue(func() map[protoreflect.FullName]bool {
+	rt := make(map[protoreflect.FullName]bool)
+	fields := (&r4pb.ContainedResource{}).ProtoReflect().Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if m := fields.Get(i).Message(); m != nil {
+			rt[m.FullName()] = true
+		}
+	}
+	return rt
+})
+
+// isFHIRResource returns true if the message is a FHIR R4 resource, as opposed to a FHIR element
+// such as a Coding.
+func isFHIRResource(m proto.Message) bool {
+	return m != nil && fhirResourceTypes()[m.ProtoReflect().Descriptor().FullName()]
+}
+
+// setFHIRNamed sets a FHIR resource as the resource of the parameter and any other FHIR element as
+// its value[x], for example valueCoding for a FHIR.Coding.
+func setFHIRNamed(p fhirObject, n Named) error {
+	fhirMarshaller, err := r4Marshaller()
+	if err != nil {
+		return err
+	}
+	if n.Value == nil {
+		p["extension"] = []fhirObject{{"url": dataAbsentReasonURL, "valueCode": "unknown"}}
+		return nil
+	}
+	if isFHIRResource(n.Value) {
+		b, err := fhirMarshaller.MarshalResource(n.Value)
+		if err != nil {
+			return err
+		}
+		p["resource"] = json.RawMessage(b)
+		return nil
+	}
+	b, err := fhirMarshaller.MarshalElement(n.Value)
+	if err != nil {
+		return err
+	}
+	typeName := ""
+	if n.RuntimeType != nil {
+		typeName = strings.TrimPrefix(n.RuntimeType.TypeName, "FHIR.")
+	}
+	if typeName == "" {
+		return fmt.Errorf("FHIR element %v has no type name %w", n.Value.ProtoReflect().Descriptor().FullName(), errUnsupportedType)
+	}
+	p["value"+strings.ToUpper(typeName[:1])+typeName[1:]] = json.RawMessage(b)
+	return nil
+}
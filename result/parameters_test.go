@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/types"
+	d4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4patientpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParametersJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		val  Value
+		want string
+	}{
+		{
+			name: "Null",
+			val:  newOrFatal(t, nil),
+			want: `[{"name": "Def", "extension": [{"url": "http://hl7.org/fhir/StructureDefinition/data-absent-reason", "valueCode": "unknown"}]}]`,
+		},
+		{
+			name: "Boolean",
+			val:  newOrFatal(t, true),
+			want: `[{"name": "Def", "valueBoolean": true}]`,
+		},
+		{
+			name: "Integer",
+			val:  newOrFatal(t, 4),
+			want: `[{"name": "Def", "valueInteger": 4}]`,
+		},
+		{
+			name: "Decimal",
+			val:  newOrFatal(t, 1.5),
+			want: `[{"name": "Def", "valueDecimal": 1.5}]`,
+		},
+		{
+			name: "String",
+			val:  newOrFatal(t, "hello"),
+			want: `[{"name": "Def", "valueString": "hello"}]`,
+		},
+		{
+			name: "Date",
+			val:  newOrFatal(t, Date{Date: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+			want: `[{"name": "Def", "valueDate": "2024-03-01"}]`,
+		},
+		{
+			name: "DateTime",
+			val:  newOrFatal(t, DateTime{Date: time.Date(2024, time.March, 1, 10, 30, 0, 0, time.UTC), Precision: model.MINUTE}),
+			want: `[{"name": "Def", "valueDateTime": "2024-03-01T10:30:00Z"}]`,
+		},
+		{
+			name: "Quantity",
+			val:  newOrFatal(t, Quantity{Value: 5, Unit: "mg"}),
+			want: `[{"name": "Def", "valueQuantity": {"value": 5, "unit": "mg", "system": "http://unitsofmeasure.org", "code": "mg"}}]`,
+		},
+		{
+			name: "Code",
+			val:  newOrFatal(t, Code{System: "http://loinc.org", Code: "1234-5", Display: "Glucose"}),
+			want: `[{"name": "Def", "valueCoding": {"system": "http://loinc.org", "code": "1234-5", "display": "Glucose"}}]`,
+		},
+		{
+			name: "Concept",
+			val:  newOrFatal(t, Concept{Codes: []*Code{{System: "http://loinc.org", Code: "1234-5"}}, Display: "Glucose"}),
+			want: `[{"name": "Def", "valueCodeableConcept": {"coding": [{"system": "http://loinc.org", "code": "1234-5"}], "text": "Glucose"}}]`,
+		},
+		{
+			name: "Date Interval",
+			val: newOrFatal(t, Interval{
+				Low:          newOrFatal(t, Date{Date: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+				High:         newOrFatal(t, Date{Date: time.Date(2024, time.December, 31, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+				LowInclusive: true, HighInclusive: true,
+			}),
+			want: `[{"name": "Def", "valuePeriod": {"start": "2024-01-01", "end": "2024-12-31"}}]`,
+		},
+		{
+			name: "Integer Interval",
+			val:  newOrFatal(t, Interval{Low: newOrFatal(t, 1), High: newOrFatal(t, 5), LowInclusive: true, HighInclusive: true}),
+			want: `[{"name": "Def", "valueRange": {"low": {"value": 1}, "high": {"value": 5}}}]`,
+		},
+		{
+			name: "List",
+			val:  newOrFatal(t, List{Value: []Value{newOrFatal(t, 1), newOrFatal(t, 2)}}),
+			want: `[{"name": "Def", "valueInteger": 1}, {"name": "Def", "valueInteger": 2}]`,
+		},
+		{
+			name: "Empty List",
+			val:  newOrFatal(t, List{Value: []Value{}, StaticType: &types.List{ElementType: types.Integer}}),
+			want: `[{"name": "Def", "extension": [{"url": "http://hl7.org/fhir/StructureDefinition/cqf-isEmptyList", "valueBoolean": true}]}]`,
+		},
+		{
+			name: "Tuple",
+			val:  newOrFatal(t, Tuple{Value: map[string]Value{"b": newOrFatal(t, "x"), "a": newOrFatal(t, 1)}}),
+			want: `[{"name": "Def", "part": [{"name": "a", "valueInteger": 1}, {"name": "b", "valueString": "x"}]}]`,
+		},
+		{
+			name: "FHIR resource",
+			val:  newOrFatal(t, Named{Value: &r4patientpb.Patient{Id: &d4pb.Id{Value: "1"}}, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}}),
+			want: `[{"name": "Def", "resource": {"resourceType": "Patient", "id": "1"}}]`,
+		},
+		{
+			name: "FHIR element",
+			val:  newOrFatal(t, Named{Value: &d4pb.Coding{Code: &d4pb.Code{Value: "1234-5"}}, RuntimeType: &types.Named{TypeName: "FHIR.Coding"}}),
+			want: `[{"name": "Def", "valueCoding": {"code": "1234-5"}}]`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := ParametersJSON(map[string]Value{"Def": tc.val})
+			if err != nil {
+				t.Fatalf("ParametersJSON() returned unexpected error: %v", err)
+			}
+			var got struct {
+				ResourceType string `json:"resourceType"`
+				Parameter    []any  `json:"parameter"`
+			}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", b, err)
+			}
+			if got.ResourceType != "Parameters" {
+				t.Errorf("ParametersJSON() resourceType = %s, want Parameters", got.ResourceType)
+			}
+			var want []any
+			if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+				t.Fatalf("json.Unmarshal(%s) returned unexpected error: %v", tc.want, err)
+			}
+			if diff := cmp.Diff(want, got.Parameter); diff != "" {
+				t.Errorf("ParametersJSON() parameters diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParametersJSON_SortedAndNamedFirst(t *testing.T) {
+	b, err := ParametersJSON(map[string]Value{"B": newOrFatal(t, 2), "A": newOrFatal(t, 1)})
+	if err != nil {
+		t.Fatalf("ParametersJSON() returned unexpected error: %v", err)
+	}
+	want := `{"resourceType":"Parameters","parameter":[{"name":"A","valueInteger":1},{"name":"B","valueInteger":2}]}`
+	if string(b) != want {
+		t.Errorf("ParametersJSON() = %s, want %s", b, want)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/google/cql/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// ResourceRef identifies a FHIR resource by its type and logical id.
+type ResourceRef struct {
+	ResourceType string
+	ID           string
+}
+
+// String returns the reference in FHIR relative reference form, for example Patient/123.
+func (r ResourceRef) String() string {
+	return r.ResourceType + "/" + r.ID
+}
+
+// MarshalText marshals the reference in FHIR relative reference form.
+func (r ResourceRef) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// SupportingResources returns the FHIR resources that flowed into this value, sorted by resource
+// type and id. It is derived from the source values recorded during evaluation, so it covers the
+// resources returned by retrieves and carried through queries, operators and properties. For
+// example, the supporting resources of exists([Condition] C where C.code in "Diabetes") are the
+// Conditions in the Diabetes ValueSet, not every Condition of the patient.
+//
+// Resources without an id are omitted.
+func (v Value) SupportingResources() []ResourceRef {
+	c := provenanceCollector{refs: make(map[ResourceRef]bool), visited: make(map[sliceKey]bool)}
+	c.collect(v)
+	refs := make([]ResourceRef, 0, len(c.refs))
+	for r := range c.refs {
+		refs = append(refs, r)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].ResourceType != refs[j].ResourceType {
+			return refs[i].ResourceType < refs[j].ResourceType
+		}
+		return refs[i].ID < refs[j].ID
+	})
+	return refs
+}
+
+// ResourceRef returns a reference to the value if it is a FHIR resource with an id.
+func (v Value) ResourceRef() (ResourceRef, bool) {
+	n, ok := v.goValue.(Named)
+	if !ok {
+		return ResourceRef{}, false
+	}
+	return resourceRef(n.Value)
+}
+
+// Provenance holds the supporting resources of each expression definition. The outer map is keyed
+// by library, and the inner map by expression definition name.
+type Provenance map[LibKey]map[string][]ResourceRef
+
+// Provenance returns the supporting resources of every expression definition in the results. See
+// Value.SupportingResources.
+func (l Libraries) Provenance() Provenance {
+	p := make(Provenance, len(l))
+	for k, defs := range l {
+		p[k] = make(map[string][]ResourceRef, len(defs))
+		for name, v := range defs {
+			p[k][name] = v.SupportingResources()
+		}
+	}
+	return p
+}
+
+type provenanceLibJSON struct {
+	Name    string                   `json:"libName"`
+	Version string                   `json:"libVersion"`
+	ExpDefs map[string][]ResourceRef `json:"expressionDefinitions"`
+}
+
+// MarshalJSON returns the Provenance as a JSON list of libraries, in the same shape as Libraries:
+//
+//	[{
+//		'libName': 'TESTLIB',
+//		'libVersion': '1.0.0',
+//		'expressionDefinitions': {'HasDiabetes': ['Condition/1', 'Condition/2']},
+//	}, ...],
+func (p Provenance) MarshalJSON() ([]byte, error) {
+	r := make([]provenanceLibJSON, 0, len(p))
+	for _, k := range sortedLibKeys(p) {
+		r = append(r, provenanceLibJSON{Name: k.Name, Version: k.Version, ExpDefs: p[k]})
+	}
+	return json.Marshal(r)
+}
+
+// sliceKey identifies the backing array of a slice of values. Values are never mutated after they
+// are created, so values sharing a slice of source values (for example the result of an expression
+// definition referenced many times) only need to be visited once.
+type sliceKey struct {
+	first *Value
+	len   int
+}
+
+type provenanceCollector struct {
+	refs    map[ResourceRef]bool
+	visited map[sliceKey]bool
+}
+
+func (c *provenanceCollector) collect(v Value) {
+	switch gv := v.goValue.(type) {
+	case Named:
+		if ref, ok := resourceRef(gv.Value); ok {
+			c.refs[ref] = true
+		}
+	case List:
+		c.collectAll(gv.Value)
+	case Tuple:
+		for _, elem := range gv.Value {
+			c.collect(elem)
+		}
+	case Interval:
+		c.collect(gv.Low)
+		c.collect(gv.High)
+	}
+
+	// The sources of a query include every value of its source clauses, including the ones removed
+	// by the where clause. When the query returns a list the returned elements carry their own
+	// sources, so the query sources are skipped.
+	if _, ok := v.sourceExpr.(*model.Query); ok {
+		if _, ok := v.goValue.(List); ok {
+			return
+		}
+	}
+	c.collectAll(v.sourceVals)
+}
+
+func (c *provenanceCollector) collectAll(vals []Value) {
+	if len(vals) == 0 {
+		return
+	}
+	k := sliceKey{first: &vals[0], len: len(vals)}
+	if c.visited[k] {
+		return
+	}
+	c.visited[k] = true
+	for _, v := range vals {
+		c.collect(v)
+	}
+}
+
+// resourceRef returns a reference to the message if it is a FHIR resource with an id.
+func resourceRef(m proto.Message) (ResourceRef, bool) {
+	if !isFHIRResource(m) {
+		return ResourceRef{}, false
+	}
+	r := m.ProtoReflect()
+	idField := r.Descriptor().Fields().ByName("id")
+	if idField == nil || idField.Message() == nil || !r.Has(idField) {
+		return ResourceRef{}, false
+	}
+	id := r.Get(idField).Message()
+	valueField := id.Descriptor().Fields().ByName("value")
+	if valueField == nil || id.Get(valueField).String() == "" {
+		return ResourceRef{}, false
+	}
+	return ResourceRef{ResourceType: string(r.Descriptor().Name()), ID: id.Get(valueField).String()}, true
+}
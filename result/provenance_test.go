@@ -0,0 +1,140 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/types"
+	d4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4conditionpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/condition_go_proto"
+	r4patientpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResourceRef(t *testing.T) {
+	patient := newOrFatal(t, Named{Value: &r4patientpb.Patient{Id: &d4pb.Id{Value: "p1"}}, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}})
+	if got, ok := patient.ResourceRef(); !ok || got != (ResourceRef{ResourceType: "Patient", ID: "p1"}) {
+		t.Errorf("ResourceRef() = %v, %v, want Patient/p1, true", got, ok)
+	}
+	noID := newOrFatal(t, Named{Value: &r4patientpb.Patient{}, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}})
+	if got, ok := noID.ResourceRef(); ok {
+		t.Errorf("ResourceRef() of a Patient without an id = %v, want false", got)
+	}
+	if got, ok := newOrFatal(t, "p1").ResourceRef(); ok {
+		t.Errorf("ResourceRef() of a String = %v, want false", got)
+	}
+}
+
+func TestSupportingResources(t *testing.T) {
+	patient := newOrFatal(t, Named{Value: &r4patientpb.Patient{Id: &d4pb.Id{Value: "p1"}}, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}})
+	cond := func(id string) Value {
+		return newOrFatal(t, Named{Value: &r4conditionpb.Condition{Id: &d4pb.Id{Value: id}}, RuntimeType: &types.Named{TypeName: "FHIR.Condition"}})
+	}
+	conditionsType := &types.List{ElementType: &types.Named{TypeName: "FHIR.Condition"}}
+	allConditions := newOrFatal(t, List{Value: []Value{cond("c1"), cond("c2"), cond("c3")}, StaticType: conditionsType})
+	filtered := newWithSourcesOrFatal(t, List{Value: []Value{cond("c2")}, StaticType: conditionsType}, &model.Query{}, allConditions)
+
+	tests := []struct {
+		name  string
+		value Value
+		want  []ResourceRef
+	}{
+		{
+			name:  "Literal",
+			value: newWithSourcesOrFatal(t, 1, &model.Literal{}),
+			want:  []ResourceRef{},
+		},
+		{
+			name:  "Resource",
+			value: patient,
+			want:  []ResourceRef{{ResourceType: "Patient", ID: "p1"}},
+		},
+		{
+			name:  "Property of resource",
+			value: newWithSourcesOrFatal(t, "1950-01-01", &model.Property{}, patient),
+			want:  []ResourceRef{{ResourceType: "Patient", ID: "p1"}},
+		},
+		{
+			name:  "Query returning list only includes returned elements",
+			value: filtered,
+			want:  []ResourceRef{{ResourceType: "Condition", ID: "c2"}},
+		},
+		{
+			name:  "Operator over query",
+			value: newWithSourcesOrFatal(t, true, &model.Exists{}, filtered),
+			want:  []ResourceRef{{ResourceType: "Condition", ID: "c2"}},
+		},
+		{
+			name:  "Query returning a single value includes its sources",
+			value: newWithSourcesOrFatal(t, nil, &model.Query{}, patient),
+			want:  []ResourceRef{{ResourceType: "Patient", ID: "p1"}},
+		},
+		{
+			name: "Tuple and shared sources are deduplicated",
+			value: newWithSourcesOrFatal(t, Tuple{
+				Value:       map[string]Value{"P": patient, "C": filtered},
+				RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"P": types.Any, "C": conditionsType}},
+			}, &model.Tuple{}, patient, filtered, filtered),
+			want: []ResourceRef{{ResourceType: "Condition", ID: "c2"}, {ResourceType: "Patient", ID: "p1"}},
+		},
+		{
+			name:  "Resource without id",
+			value: newOrFatal(t, Named{Value: &r4patientpb.Patient{}, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}}),
+			want:  []ResourceRef{},
+		},
+		{
+			name:  "FHIR element is not a resource",
+			value: newOrFatal(t, Named{Value: &d4pb.Coding{Id: &d4pb.String{Value: "x"}}, RuntimeType: &types.Named{TypeName: "FHIR.Coding"}}),
+			want:  []ResourceRef{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, tc.value.SupportingResources()); diff != "" {
+				t.Errorf("SupportingResources() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProvenance_MarshalJSON(t *testing.T) {
+	patient := newOrFatal(t, Named{Value: &r4patientpb.Patient{Id: &d4pb.Id{Value: "p1"}}, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}})
+	libs := Libraries{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]Value{
+			"BirthDate": newWithSourcesOrFatal(t, "1950-01-01", &model.Property{}, patient),
+			"Literal":   newOrFatal(t, 1),
+		},
+	}
+	got, err := json.Marshal(libs.Provenance())
+	if err != nil {
+		t.Fatalf("json.Marshal() returned unexpected error: %v", err)
+	}
+	want := `[{"libName":"TESTLIB","libVersion":"1.0.0","expressionDefinitions":{"BirthDate":["Patient/p1"],"Literal":[]}}]`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("json.Marshal() diff (-want +got):\n%s", diff)
+	}
+}
+
+func newWithSourcesOrFatal(t *testing.T, a any, expr model.IExpression, sources ...Value) Value {
+	t.Helper()
+	v, err := NewWithSources(a, expr, sources...)
+	if err != nil {
+		t.Fatalf("NewWithSources(%v) returned unexpected error: %v", a, err)
+	}
+	return v
+}
@@ -16,9 +16,11 @@
 package result
 
 import (
+	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/google/cql/model"
 	crpb "github.com/google/cql/protos/cql_result_go_proto"
@@ -31,40 +33,92 @@ import (
 // The outer map[LibKey] maps CQL Libraries to the Expression Definitions within the library.
 type Libraries map[LibKey]map[string]Value
 
+// JSONFormatVersion is the version of the JSON format produced by Libraries.MarshalJSON. It is
+// emitted as the formatVersion of every library. The major version is incremented on breaking
+// changes to the format, and the minor version on backwards compatible additions.
+const JSONFormatVersion = "1.1"
+
+//go:embed schema.json
+var jsonSchema []byte
+
+// JSONSchema returns the JSON Schema (draft 2020-12) describing the JSON produced by
+// Libraries.MarshalJSON at JSONFormatVersion.
+func JSONSchema() []byte {
+	return append([]byte(nil), jsonSchema...)
+}
+
 type cqlLibJSON struct {
-	Name    string           `json:"libName"`
-	Version string           `json:"libVersion"`
-	ExpDefs map[string]Value `json:"expressionDefinitions"`
+	FormatVersion string           `json:"formatVersion"`
+	Name          string           `json:"libName"`
+	Version       string           `json:"libVersion"`
+	ExpDefs       map[string]Value `json:"expressionDefinitions"`
+	// DefMetadata is omitted if none of the results have DefMetadata, for example results that were
+	// not produced by the interpreter.
+	DefMetadata map[string]defMetadataJSON `json:"defineMetadata,omitempty"`
 }
 
 // MarshalJSON returns the CQL Results as a JSON. The JSON will be a list of CQL libraries
 // formatted like the following:
 //
 //	[{
+//		'formatVersion': '1.1',
 //		'libName': 'TESTLIB',
 //		'libVersion': '1.0.0',
 //		'expressionDefinitions': {'ExpDef': 3, 'ExpDef2': 4},
+//		'defineMetadata': {
+//			'ExpDef': {'kind': 'expressionDefinition', 'accessLevel': 'PUBLIC', 'declaredType': 'System.Integer', 'libVersion': '1.0.0'},
+//			...
+//		},
 //	}, ...],
+//
+// The format is described by JSONSchema. The output is deterministic so result files can be diffed
+// across runs and architectures: libraries are ordered by name and then version, object keys are
+// sorted, Decimals are rounded to the 8 decimal places of the CQL Decimal type and never use
+// exponents, and lists keep the order of the CQL List.
 func (l Libraries) MarshalJSON() ([]byte, error) {
 	r := []cqlLibJSON{}
-	for k, v := range l {
+	for _, k := range sortedLibKeys(l) {
+		v := l[k]
+		meta, err := metadataJSON(v, false)
+		if err != nil {
+			return nil, err
+		}
 		r = append(r, cqlLibJSON{
-			Name:    k.Name,
-			Version: k.Version,
-			ExpDefs: v,
+			FormatVersion: JSONFormatVersion,
+			Name:          k.Name,
+			Version:       k.Version,
+			ExpDefs:       v,
+			DefMetadata:   meta,
 		})
 	}
 
 	return json.Marshal(r)
 }
 
-// Proto converts Libraries to a proto.
+// sortedLibKeys returns the libraries of m ordered by name and then version, so that serialized
+// results are stable across runs.
+func sortedLibKeys[V any](m map[LibKey]V) []LibKey {
+	keys := make([]LibKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].Version < keys[j].Version
+	})
+	return keys
+}
+
+// Proto converts Libraries to a proto. Libraries are ordered by name and version.
 func (l Libraries) Proto() (*crpb.Libraries, error) {
 	pbLibraries := &crpb.Libraries{
 		Libraries: make([]*crpb.Library, 0, len(l)),
 	}
 
-	for libKey, lib := range l {
+	for _, libKey := range sortedLibKeys(l) {
+		lib := l[libKey]
 		pbLib := crpb.Library{
 			Name:     proto.String(libKey.Name),
 			Version:  proto.String(libKey.Version),
@@ -82,6 +136,28 @@ func (l Libraries) Proto() (*crpb.Libraries, error) {
 	return pbLibraries, nil
 }
 
+// MarshalProto returns the binary encoding of the Libraries as a cql.result.Libraries proto, defined
+// in protos/cql_result.proto. This is the stable binary contract for consumers of results outside
+// of Go. The encoding is deterministic, so equal results always produce the same bytes. FHIR
+// resources are encoded as google.protobuf.Any holding the FHIR R4 proto of the resource.
+func (l Libraries) MarshalProto() ([]byte, error) {
+	pb, err := l.Proto()
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(pb)
+}
+
+// UnmarshalProto decodes Libraries from the binary encoding of a cql.result.Libraries proto, as
+// returned by MarshalProto.
+func UnmarshalProto(b []byte) (Libraries, error) {
+	pb := &crpb.Libraries{}
+	if err := proto.Unmarshal(b, pb); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal results proto: %w", err)
+	}
+	return LibrariesFromProto(pb)
+}
+
 // LibrariesFromProto converts a proto to Libraries.
 func LibrariesFromProto(pb *crpb.Libraries) (Libraries, error) {
 	libraries := Libraries{}
@@ -15,10 +15,19 @@
 package result
 
 import (
+	"bytes"
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/cql/model"
 	crpb "github.com/google/cql/protos/cql_result_go_proto"
+	"github.com/google/cql/types"
+	d4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4patientpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
 	"github.com/google/go-cmp/cmp"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
 )
@@ -32,7 +41,26 @@ func TestLibraries_MarshalJSON(t *testing.T) {
 		{
 			name:         "Libraries",
 			unmarshalled: Libraries{LibKey{Name: "Highly.Qualified", Version: "1.0"}: map[string]Value{"DefName": newOrFatal(t, 1)}},
-			want:         `[{"libName":"Highly.Qualified","libVersion":"1.0","expressionDefinitions":{"DefName":{"@type":"System.Integer","value":1}}}]`,
+			want:         `[{"formatVersion":"1.1","libName":"Highly.Qualified","libVersion":"1.0","expressionDefinitions":{"DefName":{"@type":"System.Integer","value":1}}}]`,
+		},
+		{
+			name: "Libraries ordered by name and version",
+			unmarshalled: Libraries{
+				LibKey{Name: "B"}:                 map[string]Value{"Def": newOrFatal(t, 1)},
+				LibKey{Name: "A", Version: "2.0"}: map[string]Value{"Def": newOrFatal(t, 2)},
+				LibKey{Name: "A", Version: "1.0"}: map[string]Value{"Def": newOrFatal(t, 3)},
+			},
+			want: `[{"formatVersion":"1.1","libName":"A","libVersion":"1.0","expressionDefinitions":{"Def":{"@type":"System.Integer","value":3}}},` +
+				`{"formatVersion":"1.1","libName":"A","libVersion":"2.0","expressionDefinitions":{"Def":{"@type":"System.Integer","value":2}}},` +
+				`{"formatVersion":"1.1","libName":"B","libVersion":"","expressionDefinitions":{"Def":{"@type":"System.Integer","value":1}}}]`,
+		},
+		{
+			name: "Definitions and tuple elements ordered by name",
+			unmarshalled: Libraries{LibKey{Name: "A"}: map[string]Value{
+				"Second": newOrFatal(t, Tuple{Value: map[string]Value{"b": newOrFatal(t, 1), "a": newOrFatal(t, 2)}, RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"a": types.Integer, "b": types.Integer}}}),
+				"First":  newOrFatal(t, 1),
+			}},
+			want: `[{"formatVersion":"1.1","libName":"A","libVersion":"","expressionDefinitions":{"First":{"@type":"System.Integer","value":1},"Second":{"a":{"@type":"System.Integer","value":2},"b":{"@type":"System.Integer","value":1}}}}]`,
 		},
 	}
 
@@ -49,6 +77,102 @@ func TestLibraries_MarshalJSON(t *testing.T) {
 	}
 }
 
+func TestLibraries_MarshalJSONMatchesSchema(t *testing.T) {
+	dt := func(m time.Month) Value {
+		return newOrFatal(t, DateTime{Date: time.Date(2024, m, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY})
+	}
+	code := Code{System: "http://loinc.org", Code: "1234-5", Display: "Glucose"}
+	libs := Libraries{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]Value{
+			"Null":     newOrFatal(t, nil),
+			"Boolean":  newOrFatal(t, true),
+			"Integer":  newOrFatal(t, int32(1)),
+			"Long":     newOrFatal(t, int64(1)),
+			"Decimal":  newOrFatal(t, 1.5),
+			"String":   newOrFatal(t, "hello"),
+			"Date":     newOrFatal(t, Date{Date: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+			"DateTime": dt(time.March),
+			"Time":     newOrFatal(t, Time{Date: time.Date(0, time.January, 1, 10, 30, 0, 0, time.UTC), Precision: model.MINUTE}),
+			"Quantity": newOrFatal(t, Quantity{Value: 5, Unit: "mg"}),
+			"Ratio":    newOrFatal(t, Ratio{Numerator: Quantity{Value: 1, Unit: "mg"}, Denominator: Quantity{Value: 2, Unit: "mL"}}),
+			"Interval": newOrFatal(t, Interval{
+				Low:           dt(time.January),
+				High:          dt(time.December),
+				LowInclusive:  true,
+				HighInclusive: false,
+				StaticType:    &types.Interval{PointType: types.DateTime},
+			}),
+			"List":       newOrFatal(t, List{Value: []Value{newOrFatal(t, "a"), newOrFatal(t, nil)}, StaticType: &types.List{ElementType: types.String}}),
+			"EmptyList":  newOrFatal(t, List{Value: []Value{}, StaticType: &types.List{ElementType: types.String}}),
+			"Tuple":      newOrFatal(t, Tuple{Value: map[string]Value{"Apple": newOrFatal(t, 1)}, RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"Apple": types.Integer}}}),
+			"Code":       newOrFatal(t, code),
+			"Concept":    newOrFatal(t, Concept{Codes: []*Code{&code}, Display: "Glucose"}),
+			"ValueSet":   newOrFatal(t, ValueSet{ID: "https://example.com/vs", Version: "1.0", CodeSystems: []CodeSystem{{ID: "http://loinc.org"}}}),
+			"CodeSystem": newOrFatal(t, CodeSystem{ID: "http://loinc.org", Version: "2.74"}),
+			"Patient":    newOrFatal(t, Named{Value: &r4patientpb.Patient{Id: &d4pb.Id{Value: "1"}}, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}}),
+		},
+		LibKey{Name: "OTHERLIB"}: map[string]Value{
+			"Integer": newOrFatal(t, 2).WithDefMetadata(DefMetadata{Kind: ExpressionDefinition, AccessLevel: model.Public, DeclaredType: types.Integer}),
+		},
+	}
+	b, err := json.Marshal(libs)
+	if err != nil {
+		t.Fatalf("json.Marshal() returned unexpected error: %v", err)
+	}
+	var doc any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("json.Unmarshal() returned unexpected error: %v", err)
+	}
+
+	schema := compileSchemaOrFatal(t)
+	if err := schema.Validate(doc); err != nil {
+		t.Errorf("MarshalJSON() output does not match JSONSchema(): %#v\n%s", err, b)
+	}
+}
+
+func TestJSONSchema_RejectsUnversionedResults(t *testing.T) {
+	var doc any
+	if err := json.Unmarshal([]byte(`[{"libName":"TESTLIB","libVersion":"1.0","expressionDefinitions":{}}]`), &doc); err != nil {
+		t.Fatalf("json.Unmarshal() returned unexpected error: %v", err)
+	}
+	if err := compileSchemaOrFatal(t).Validate(doc); err == nil {
+		t.Errorf("Validate() succeeded for results without a formatVersion, want error")
+	}
+}
+
+func TestJSONSchema_FormatVersion(t *testing.T) {
+	var schema struct {
+		Defs struct {
+			Library struct {
+				Properties struct {
+					FormatVersion struct {
+						Const string `json:"const"`
+					} `json:"formatVersion"`
+				} `json:"properties"`
+			} `json:"library"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(JSONSchema(), &schema); err != nil {
+		t.Fatalf("json.Unmarshal(JSONSchema()) returned unexpected error: %v", err)
+	}
+	if got := schema.Defs.Library.Properties.FormatVersion.Const; got != JSONFormatVersion {
+		t.Errorf("JSONSchema() formatVersion = %q, want %q", got, JSONFormatVersion)
+	}
+}
+
+func compileSchemaOrFatal(t *testing.T) *jsonschema.Schema {
+	t.Helper()
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource("schema.json", strings.NewReader(string(JSONSchema()))); err != nil {
+		t.Fatalf("AddResource() returned unexpected error: %v", err)
+	}
+	s, err := c.Compile("schema.json")
+	if err != nil {
+		t.Fatalf("Compile() returned unexpected error: %v", err)
+	}
+	return s
+}
+
 func TestLibraries_ProtoAndBack(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -135,3 +259,53 @@ func TestLibraries_ProtoAndBack(t *testing.T) {
 		})
 	}
 }
+
+func TestLibraries_MarshalProtoAndBack(t *testing.T) {
+	libs := Libraries{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]Value{
+			"Integer":  newOrFatal(t, 1),
+			"Null":     newOrFatal(t, nil),
+			"Quantity": newOrFatal(t, Quantity{Value: 5, Unit: "mg"}),
+			"Code":     newOrFatal(t, Code{System: "http://loinc.org", Code: "1234-5", Display: "Glucose"}),
+			"Interval": newOrFatal(t, Interval{
+				Low:           newOrFatal(t, DateTime{Date: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+				High:          newOrFatal(t, DateTime{Date: time.Date(2024, time.December, 31, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+				LowInclusive:  true,
+				HighInclusive: false,
+				StaticType:    &types.Interval{PointType: types.DateTime},
+			}),
+			"Patient": newOrFatal(t, Named{Value: &r4patientpb.Patient{Id: &d4pb.Id{Value: "1"}}, RuntimeType: &types.Named{TypeName: "FHIR.Patient"}}),
+		},
+		LibKey{Name: "OTHERLIB"}: map[string]Value{
+			"List": newOrFatal(t, List{Value: []Value{newOrFatal(t, "a"), newOrFatal(t, "b")}, StaticType: &types.List{ElementType: types.String}}),
+		},
+	}
+
+	b, err := libs.MarshalProto()
+	if err != nil {
+		t.Fatalf("MarshalProto() returned unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		again, err := libs.MarshalProto()
+		if err != nil {
+			t.Fatalf("MarshalProto() returned unexpected error: %v", err)
+		}
+		if !bytes.Equal(b, again) {
+			t.Fatalf("MarshalProto() is not deterministic")
+		}
+	}
+
+	got, err := UnmarshalProto(b)
+	if err != nil {
+		t.Fatalf("UnmarshalProto() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(libs, got, protocmp.Transform()); diff != "" {
+		t.Errorf("UnmarshalProto() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestUnmarshalProto_Error(t *testing.T) {
+	if _, err := UnmarshalProto([]byte("not a proto")); err == nil {
+		t.Errorf("UnmarshalProto() succeeded, want error")
+	}
+}
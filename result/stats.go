@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import "time"
+
+// EvalStats describes the cost of evaluating a single expression definition. Stats are only
+// recorded if requested in the cql.EvalConfig.
+type EvalStats struct {
+	// WallTime is the time spent evaluating the expression definition. Referenced expression
+	// definitions are evaluated once ahead of time, so their cost is not included.
+	WallTime time.Duration
+	// Retrieves is the number of calls made to the retriever while evaluating the expression
+	// definition, including calls made by any functions it invoked.
+	Retrieves int
+}
+
+// EvalStats returns the evaluation stats of an expression definition result. The second return
+// value is false if no stats were recorded for this value.
+func (v Value) EvalStats() (EvalStats, bool) {
+	if v.stats == nil {
+		return EvalStats{}, false
+	}
+	return *v.stats, true
+}
+
+// WithEvalStats returns a copy of the value with the given evaluation stats.
+func (v Value) WithEvalStats(s EvalStats) Value {
+	v.stats = &s
+	return v
+}
+
+// EvalStats returns the evaluation stats of every expression definition in the results that has
+// them, keyed by library and expression definition name. Parameters and terminology definitions do
+// not have stats.
+func (l Libraries) EvalStats() map[LibKey]map[string]EvalStats {
+	stats := make(map[LibKey]map[string]EvalStats, len(l))
+	for k, defs := range l {
+		for name, v := range defs {
+			s, ok := v.EvalStats()
+			if !ok {
+				continue
+			}
+			if stats[k] == nil {
+				stats[k] = make(map[string]EvalStats)
+			}
+			stats[k][name] = s
+		}
+	}
+	return stats
+}
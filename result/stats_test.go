@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEvalStats(t *testing.T) {
+	plain := newOrFatal(t, 1)
+	if _, ok := plain.EvalStats(); ok {
+		t.Errorf("EvalStats() on a value without stats returned ok, want !ok")
+	}
+
+	want := EvalStats{WallTime: 3 * time.Millisecond, Retrieves: 2}
+	withStats := plain.WithEvalStats(want)
+	got, ok := withStats.EvalStats()
+	if !ok {
+		t.Fatalf("EvalStats() returned !ok, want ok")
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("EvalStats() diff (-want +got):\n%s", diff)
+	}
+	if !withStats.Equal(plain) {
+		t.Errorf("Equal() = false for values only differing in stats, want true")
+	}
+	if _, ok := plain.EvalStats(); ok {
+		t.Errorf("WithEvalStats() modified the original value")
+	}
+}
+
+func TestLibraries_EvalStats(t *testing.T) {
+	libs := Libraries{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: map[string]Value{
+			"Def":       newOrFatal(t, 1).WithEvalStats(EvalStats{WallTime: time.Second, Retrieves: 1}),
+			"Parameter": newOrFatal(t, 2),
+		},
+		LibKey{Name: "NOSTATS"}: map[string]Value{
+			"Parameter": newOrFatal(t, 3),
+		},
+	}
+	want := map[LibKey]map[string]EvalStats{
+		LibKey{Name: "TESTLIB", Version: "1.0.0"}: {"Def": {WallTime: time.Second, Retrieves: 1}},
+	}
+	if diff := cmp.Diff(want, libs.EvalStats()); diff != "" {
+		t.Errorf("EvalStats() diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tabular
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+)
+
+// FieldType is the type of the fields of a cohort Table column.
+type FieldType int
+
+const (
+	// FieldString fields are Go strings.
+	FieldString FieldType = iota
+	// FieldBoolean fields are Go bools.
+	FieldBoolean
+	// FieldInteger fields are Go int64s.
+	FieldInteger
+	// FieldDecimal fields are Go float64s.
+	FieldDecimal
+	// FieldDate fields are dates formatted as YYYY-MM-DD.
+	FieldDate
+	// FieldDateTime fields are timestamps formatted as RFC 3339 with milliseconds.
+	FieldDateTime
+)
+
+// String returns the name of the column type, which matches the BigQuery standard SQL type.
+func (t FieldType) String() string {
+	switch t {
+	case FieldBoolean:
+		return "BOOL"
+	case FieldInteger:
+		return "INT64"
+	case FieldDecimal:
+		return "FLOAT64"
+	case FieldDate:
+		return "DATE"
+	case FieldDateTime:
+		return "TIMESTAMP"
+	default:
+		return "STRING"
+	}
+}
+
+// ListCoercion is how Lists are coerced into a single cohort Table field.
+type ListCoercion int
+
+const (
+	// ListCount coerces a List into the number of its non null elements. This suits the common
+	// cohort definitions returning the resources that qualify a patient, such as [Encounter] E
+	// where ...
+	ListCount ListCoercion = iota
+	// ListJSON coerces a List into its result JSON.
+	ListJSON
+)
+
+// CohortConfig configures a Cohort.
+type CohortConfig struct {
+	// Lists is how List results are coerced. The default is ListCount.
+	Lists ListCoercion
+}
+
+// Cohort pivots the results of many subjects into a Table with one row per subject and one column
+// per definition. Add the results of each subject, then call Table. Unlike ParquetWriter, which
+// derives its schema from the static result types, a Cohort infers the type of each column from the
+// results it holds, following these coercion rules:
+//
+//   - Booleans, Strings and Decimals map to the matching column type, Integers and Longs map to
+//     FieldInteger.
+//   - Dates and DateTimes with at least day precision map to FieldDate and FieldDateTime.
+//   - Quantities map to FieldDecimal holding their value, if all Quantities of the column have the
+//     same unit. The unit is reported in TableColumn.Unit.
+//   - Lists are coerced following CohortConfig.Lists.
+//   - A column holding both Integers and Decimals is a FieldDecimal column.
+//   - All other columns, such as ones holding Codes, FHIR resources, Times, Dates with less than day
+//     precision or values of several types, are FieldString columns. Values are formatted by
+//     FormatValue.
+//
+// Nulls and definitions missing from the results of a subject are nil.
+type Cohort struct {
+	cfg  CohortConfig
+	ids  []string
+	rows []map[cohortKey]result.Value
+	defs map[cohortKey]bool
+}
+
+type cohortKey struct {
+	library result.LibKey
+	def     string
+}
+
+// NewCohort returns an empty Cohort.
+func NewCohort(cfg CohortConfig) *Cohort {
+	return &Cohort{cfg: cfg, defs: make(map[cohortKey]bool)}
+}
+
+// Add adds the results of the subject with the given ID as a row. The Cohort has a column for every
+// definition found in the results of any subject.
+func (c *Cohort) Add(id string, libs result.Libraries) {
+	row := make(map[cohortKey]result.Value)
+	for lib, defs := range libs {
+		for def, v := range defs {
+			k := cohortKey{library: lib, def: def}
+			c.defs[k] = true
+			row[k] = v
+		}
+	}
+	c.ids = append(c.ids, id)
+	c.rows = append(c.rows, row)
+}
+
+// Table is a cohort table, ready to export to CSV or BigQuery.
+type Table struct {
+	// Columns are the columns of the definitions, sorted by name. The subject ID column is not
+	// included.
+	Columns []TableColumn
+	// Rows are in the order the subjects were added.
+	Rows []TableRow
+}
+
+// TableColumn is a column of a Table.
+type TableColumn struct {
+	// Name is the definition name, or Library.Definition if several libraries have a definition of
+	// the same name.
+	Name    string
+	Library result.LibKey
+	Define  string
+	Type    FieldType
+	// Unit is the unit of a column of Quantities.
+	Unit string
+}
+
+// TableRow is the row of a single subject.
+type TableRow struct {
+	ID string
+	// Values holds a value for each column of the Table, either nil or the Go type of the
+	// FieldType.
+	Values []any
+}
+
+// Table infers the column types and returns the cohort table.
+func (c *Cohort) Table() (*Table, error) {
+	keys := make([]cohortKey, 0, len(c.defs))
+	names := newColumnNamer()
+	for k := range c.defs {
+		keys = append(keys, k)
+		names.add(k.def)
+	}
+	t := &Table{}
+	for _, k := range keys {
+		t.Columns = append(t.Columns, TableColumn{Name: names.name(k.library, k.def), Library: k.library, Define: k.def})
+	}
+	sort.Slice(t.Columns, func(i, j int) bool { return t.Columns[i].Name < t.Columns[j].Name })
+
+	// Coerce Lists first, so the type of the column is inferred from the coerced values.
+	rows := make([][]result.Value, len(c.rows))
+	for r, row := range c.rows {
+		rows[r] = make([]result.Value, len(t.Columns))
+		for i, col := range t.Columns {
+			v, ok := row[cohortKey{library: col.Library, def: col.Define}]
+			if !ok {
+				continue
+			}
+			v, err := c.coerceList(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", col.Library, col.Define, err)
+			}
+			rows[r][i] = v
+		}
+	}
+
+	for i := range t.Columns {
+		var k cellKind
+		for _, row := range rows {
+			k = k.merge(kindOf(row[i]))
+		}
+		t.Columns[i].Type = k.columnType()
+		t.Columns[i].Unit = k.unit
+	}
+
+	for r, row := range rows {
+		tr := TableRow{ID: c.ids[r], Values: make([]any, len(t.Columns))}
+		for i, col := range t.Columns {
+			v, err := coerce(col.Type, row[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", col.Library, col.Define, err)
+			}
+			tr.Values[i] = v
+		}
+		t.Rows = append(t.Rows, tr)
+	}
+	return t, nil
+}
+
+// WriteCSV writes the table as CSV, with a header row. The first column is the subject ID. Use a
+// delimiter of '\t' for TSV, or zero for a comma.
+func (t *Table) WriteCSV(w io.Writer, delimiter rune) error {
+	cw := csv.NewWriter(w)
+	if delimiter != 0 {
+		cw.Comma = delimiter
+	}
+	header := []string{idColumn}
+	for _, c := range t.Columns {
+		header = append(header, c.Name)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range t.Rows {
+		record := []string{r.ID}
+		for _, v := range r.Values {
+			switch v := v.(type) {
+			case nil:
+				record = append(record, "")
+			case float64:
+				record = append(record, strconv.FormatFloat(v, 'f', -1, 64))
+			default:
+				record = append(record, fmt.Sprint(v))
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (c *Cohort) coerceList(v result.Value) (result.Value, error) {
+	l, ok := v.GolangValue().(result.List)
+	if !ok || c.cfg.Lists != ListCount {
+		return v, nil
+	}
+	n := int64(0)
+	for _, e := range l.Value {
+		if !result.IsNull(e) {
+			n++
+		}
+	}
+	return result.New(n)
+}
+
+// cellKind is the inferred kind of the values of a column.
+type cellKind struct {
+	// kind is kindNone if there are only nulls.
+	kind int
+	unit string
+}
+
+const (
+	kindNone = iota
+	kindString
+	kindBoolean
+	kindInteger
+	kindDecimal
+	kindQuantity
+	kindDate
+	kindDateTime
+)
+
+func kindOf(v result.Value) cellKind {
+	switch gv := v.GolangValue().(type) {
+	case nil:
+		return cellKind{kind: kindNone}
+	case bool:
+		return cellKind{kind: kindBoolean}
+	case int32, int64:
+		return cellKind{kind: kindInteger}
+	case float64:
+		return cellKind{kind: kindDecimal}
+	case result.Quantity:
+		return cellKind{kind: kindQuantity, unit: string(gv.Unit)}
+	case result.Date:
+		if gv.Precision == model.DAY {
+			return cellKind{kind: kindDate}
+		}
+	case result.DateTime:
+		if gv.Precision != model.YEAR && gv.Precision != model.MONTH {
+			return cellKind{kind: kindDateTime}
+		}
+	}
+	return cellKind{kind: kindString}
+}
+
+func (k cellKind) merge(o cellKind) cellKind {
+	switch {
+	case k.kind == kindNone:
+		return o
+	case o.kind == kindNone || k == o:
+		return k
+	case (k.kind == kindInteger || k.kind == kindDecimal) && (o.kind == kindInteger || o.kind == kindDecimal):
+		return cellKind{kind: kindDecimal}
+	default:
+		return cellKind{kind: kindString}
+	}
+}
+
+func (k cellKind) columnType() FieldType {
+	switch k.kind {
+	case kindBoolean:
+		return FieldBoolean
+	case kindInteger:
+		return FieldInteger
+	case kindDecimal, kindQuantity:
+		return FieldDecimal
+	case kindDate:
+		return FieldDate
+	case kindDateTime:
+		return FieldDateTime
+	default:
+		return FieldString
+	}
+}
+
+// coerce converts a value to the Go type of the column type.
+func coerce(t FieldType, v result.Value) (any, error) {
+	if result.IsNull(v) {
+		return nil, nil
+	}
+	switch t {
+	case FieldBoolean:
+		return result.ToBool(v)
+	case FieldInteger:
+		switch gv := v.GolangValue().(type) {
+		case int32:
+			return int64(gv), nil
+		case int64:
+			return gv, nil
+		}
+	case FieldDecimal:
+		switch gv := v.GolangValue().(type) {
+		case int32:
+			return float64(gv), nil
+		case int64:
+			return float64(gv), nil
+		case float64:
+			return gv, nil
+		case result.Quantity:
+			return gv.Value, nil
+		}
+	case FieldDate:
+		d, err := result.ToDateTime(v)
+		if err != nil {
+			return nil, err
+		}
+		return d.Date.Format(time.DateOnly), nil
+	case FieldDateTime:
+		d, err := result.ToDateTime(v)
+		if err != nil {
+			return nil, err
+		}
+		return d.Date.Format("2006-01-02T15:04:05.000Z07:00"), nil
+	case FieldString:
+		return FormatValue(v)
+	}
+	return nil, fmt.Errorf("%w %v to a %v column", result.ErrCannotConvert, v.RuntimeType(), t)
+}
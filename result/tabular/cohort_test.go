@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tabular_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/result/tabular"
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCohort(t *testing.T) {
+	measure := result.LibKey{Name: "Measure", Version: "1.0.0"}
+	helpers := result.LibKey{Name: "Helpers"}
+	date := func(y int, m time.Month, d int, p model.DateTimePrecision) result.Value {
+		return newValue(t, result.Date{Date: time.Date(y, m, d, 0, 0, 0, 0, time.UTC), Precision: p})
+	}
+	encounters := func(n int) result.Value {
+		var l []result.Value
+		for i := 0; i < n; i++ {
+			l = append(l, newValue(t, "encounter"))
+		}
+		return newValue(t, result.List{Value: l, StaticType: &types.List{ElementType: types.String}})
+	}
+
+	c := tabular.NewCohort(tabular.CohortConfig{})
+	c.Add("1", result.Libraries{
+		measure: {
+			"In Population": newValue(t, true),
+			"Score":         newValue(t, 1),
+			"Birth Date":    date(1950, time.January, 1, model.DAY),
+			"Onset":         date(2020, time.March, 1, model.DAY),
+			"Weight":        newValue(t, result.Quantity{Value: 70.5, Unit: "kg"}),
+			"Height":        newValue(t, result.Quantity{Value: 180, Unit: "cm"}),
+			"Encounters":    encounters(2),
+			"Name":          newValue(t, "Alice"),
+			"Value":         newValue(t, 1),
+		},
+		helpers: {"Value": newValue(t, "a")},
+	})
+	c.Add("2", result.Libraries{
+		measure: {
+			"In Population": newValue(t, false),
+			"Score":         newValue(t, 2.5),
+			"Birth Date":    newValue(t, nil),
+			"Onset":         date(2021, time.January, 1, model.MONTH),
+			"Weight":        newValue(t, result.Quantity{Value: 80, Unit: "kg"}),
+			"Height":        newValue(t, result.Quantity{Value: 6, Unit: "[ft_i]"}),
+			"Encounters":    encounters(0),
+			"Name":          newValue(t, "Bob"),
+			"Value":         newValue(t, true),
+		},
+	})
+
+	got, err := c.Table()
+	if err != nil {
+		t.Fatalf("Table() returned unexpected error: %v", err)
+	}
+	want := &tabular.Table{
+		Columns: []tabular.TableColumn{
+			{Name: "Birth Date", Library: measure, Define: "Birth Date", Type: tabular.FieldDate},
+			{Name: "Encounters", Library: measure, Define: "Encounters", Type: tabular.FieldInteger},
+			{Name: "Height", Library: measure, Define: "Height", Type: tabular.FieldString},
+			{Name: "Helpers.Value", Library: helpers, Define: "Value", Type: tabular.FieldString},
+			{Name: "In Population", Library: measure, Define: "In Population", Type: tabular.FieldBoolean},
+			{Name: "Measure.Value", Library: measure, Define: "Value", Type: tabular.FieldString},
+			{Name: "Name", Library: measure, Define: "Name", Type: tabular.FieldString},
+			{Name: "Onset", Library: measure, Define: "Onset", Type: tabular.FieldString},
+			{Name: "Score", Library: measure, Define: "Score", Type: tabular.FieldDecimal},
+			{Name: "Weight", Library: measure, Define: "Weight", Type: tabular.FieldDecimal, Unit: "kg"},
+		},
+		Rows: []tabular.TableRow{
+			{ID: "1", Values: []any{"1950-01-01", int64(2), "180 'cm'", "a", true, "1", "Alice", "2020-03-01", 1.0, 70.5}},
+			{ID: "2", Values: []any{nil, int64(0), "6 '[ft_i]'", nil, false, "true", "Bob", "2021-01", 2.5, 80.0}},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Table() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	var sb strings.Builder
+	if err := got.WriteCSV(&sb, 0); err != nil {
+		t.Fatalf("WriteCSV() returned unexpected error: %v", err)
+	}
+	wantCSV := `id,Birth Date,Encounters,Height,Helpers.Value,In Population,Measure.Value,Name,Onset,Score,Weight
+1,1950-01-01,2,180 'cm',a,true,1,Alice,2020-03-01,1,70.5
+2,,0,6 '[ft_i]',,false,true,Bob,2021-01,2.5,80
+`
+	if diff := cmp.Diff(wantCSV, sb.String()); diff != "" {
+		t.Errorf("WriteCSV() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCohort_DateTimesAndListJSON(t *testing.T) {
+	lib := result.LibKey{Name: "Measure"}
+	dt := newValue(t, result.DateTime{Date: time.Date(2024, time.March, 1, 10, 30, 0, 0, time.UTC), Precision: model.SECOND})
+	list := newValue(t, result.List{Value: []result.Value{newValue(t, 1), newValue(t, 2)}, StaticType: &types.List{ElementType: types.Integer}})
+
+	c := tabular.NewCohort(tabular.CohortConfig{Lists: tabular.ListJSON})
+	c.Add("1", result.Libraries{lib: {"Admitted": dt, "Scores": list}})
+	c.Add("2", result.Libraries{lib: {"Admitted": newValue(t, nil)}})
+	got, err := c.Table()
+	if err != nil {
+		t.Fatalf("Table() returned unexpected error: %v", err)
+	}
+	want := &tabular.Table{
+		Columns: []tabular.TableColumn{
+			{Name: "Admitted", Library: lib, Define: "Admitted", Type: tabular.FieldDateTime},
+			{Name: "Scores", Library: lib, Define: "Scores", Type: tabular.FieldString},
+		},
+		Rows: []tabular.TableRow{
+			{ID: "1", Values: []any{"2024-03-01T10:30:00.000Z", `[{"@type":"System.Integer","value":1},{"@type":"System.Integer","value":2}]`}},
+			{ID: "2", Values: []any{nil, nil}},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Table() returned unexpected diff (-want +got):\n%s", diff)
+	}
+	if got.Columns[0].Type.String() != "TIMESTAMP" {
+		t.Errorf("FieldDateTime.String() = %s, want TIMESTAMP", got.Columns[0].Type)
+	}
+}
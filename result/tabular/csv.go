@@ -0,0 +1,194 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tabular flattens CQL evaluation results into rows, for analysts who work with
+// spreadsheets and other tabular tools.
+package tabular
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/cql/internal/datehelpers"
+	"github.com/google/cql/result"
+)
+
+// Column is a column of the rows written by a Writer.
+type Column string
+
+const (
+	// ColumnID is the ID of the evaluated subject, usually the patient ID.
+	ColumnID Column = "id"
+	// ColumnLibrary is the name of the CQL library.
+	ColumnLibrary Column = "library"
+	// ColumnLibraryVersion is the version of the CQL library.
+	ColumnLibraryVersion Column = "library_version"
+	// ColumnDefine is the name of the expression definition.
+	ColumnDefine Column = "define"
+	// ColumnValue is the result of the expression definition, formatted by FormatValue.
+	ColumnValue Column = "value"
+	// ColumnType is the CQL runtime type of the result, for example System.Integer.
+	ColumnType Column = "type"
+)
+
+// DefaultColumns is the column layout used if Config.Columns is empty.
+var DefaultColumns = []Column{ColumnID, ColumnLibrary, ColumnDefine, ColumnValue, ColumnType}
+
+// ErrUnknownColumn is returned when a Config holds a column that is not supported.
+var ErrUnknownColumn = errors.New("unknown column")
+
+// Config configures a Writer.
+type Config struct {
+	// Columns is the layout of each row. If empty DefaultColumns is used.
+	Columns []Column
+	// Delimiter separates the fields of a row. If zero a comma is used, use '\t' for TSV.
+	Delimiter rune
+	// OmitHeader skips the header row holding the column names.
+	OmitHeader bool
+}
+
+// Writer writes evaluation results as CSV or TSV, one row per expression definition per subject.
+type Writer struct {
+	w       *csv.Writer
+	columns []Column
+}
+
+// NewWriter returns a Writer writing to w. Unless disabled in the Config the header row is written
+// immediately.
+func NewWriter(w io.Writer, cfg Config) (*Writer, error) {
+	columns := cfg.Columns
+	if len(columns) == 0 {
+		columns = DefaultColumns
+	}
+	for _, c := range columns {
+		switch c {
+		case ColumnID, ColumnLibrary, ColumnLibraryVersion, ColumnDefine, ColumnValue, ColumnType:
+		default:
+			return nil, fmt.Errorf("%q %w", c, ErrUnknownColumn)
+		}
+	}
+	cw := csv.NewWriter(w)
+	if cfg.Delimiter != 0 {
+		cw.Comma = cfg.Delimiter
+	}
+	tw := &Writer{w: cw, columns: columns}
+	if !cfg.OmitHeader {
+		header := make([]string, len(columns))
+		for i, c := range columns {
+			header[i] = string(c)
+		}
+		if err := cw.Write(header); err != nil {
+			return nil, err
+		}
+	}
+	return tw, nil
+}
+
+// Write writes a row for each expression definition in the results of the subject with the given
+// ID. Rows are ordered by library and then expression definition name.
+func (w *Writer) Write(id string, libs result.Libraries) error {
+	keys := make([]result.LibKey, 0, len(libs))
+	for k := range libs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key() < keys[j].Key() })
+
+	for _, lib := range keys {
+		defs := libs[lib]
+		names := make([]string, 0, len(defs))
+		for name := range defs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			row, err := w.row(id, lib, name, defs[name])
+			if err != nil {
+				return fmt.Errorf("failed to flatten %s.%s: %w", lib, name, err)
+			}
+			if err := w.w.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered rows to the underlying io.Writer.
+func (w *Writer) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *Writer) row(id string, lib result.LibKey, name string, v result.Value) ([]string, error) {
+	row := make([]string, len(w.columns))
+	for i, c := range w.columns {
+		switch c {
+		case ColumnID:
+			row[i] = id
+		case ColumnLibrary:
+			row[i] = lib.Name
+		case ColumnLibraryVersion:
+			row[i] = lib.Version
+		case ColumnDefine:
+			row[i] = name
+		case ColumnValue:
+			s, err := FormatValue(v)
+			if err != nil {
+				return nil, err
+			}
+			row[i] = s
+		case ColumnType:
+			if rt := v.RuntimeType(); rt != nil {
+				row[i] = rt.String()
+			}
+		}
+	}
+	return row, nil
+}
+
+// FormatValue formats a result as a single field. Null is the empty string, Booleans, numbers and
+// Strings are formatted as is, Dates, DateTimes and Times as their ISO 8601 representation without
+// the leading @, and Quantities as the value followed by the quoted unit. All other values, such as
+// Lists, Tuples, Intervals, Codes and FHIR resources are formatted as their result JSON.
+func FormatValue(v result.Value) (string, error) {
+	switch gv := v.GolangValue().(type) {
+	case nil:
+		return "", nil
+	case string:
+		return gv, nil
+	case bool, int32, int64, float64:
+		return fmt.Sprint(gv), nil
+	case result.Date:
+		s, err := datehelpers.DateString(gv.Date, gv.Precision)
+		return strings.TrimPrefix(s, "@"), err
+	case result.DateTime:
+		s, err := datehelpers.DateTimeString(gv.Date, gv.Precision)
+		return strings.TrimPrefix(s, "@"), err
+	case result.Time:
+		return datehelpers.TimeString(gv.Date, gv.Precision)
+	case result.Quantity:
+		return fmt.Sprintf("%v '%s'", gv.Value, gv.Unit), nil
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tabular_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/result/tabular"
+	"github.com/google/go-cmp/cmp"
+)
+
+func newValue(t *testing.T, v any) result.Value {
+	t.Helper()
+	r, err := result.New(v)
+	if err != nil {
+		t.Fatalf("result.New(%v) returned unexpected error: %v", v, err)
+	}
+	return r
+}
+
+func testResults(t *testing.T) result.Libraries {
+	t.Helper()
+	return result.Libraries{
+		result.LibKey{Name: "Measure", Version: "1.0.0"}: map[string]result.Value{
+			"In Population": newValue(t, true),
+			"Name":          newValue(t, "Smith, \"Jo\""),
+			"Weight":        newValue(t, result.Quantity{Value: 70.5, Unit: "kg"}),
+			"Missing":       newValue(t, nil),
+		},
+		result.LibKey{Name: "Helpers"}: map[string]result.Value{
+			"Visits": newValue(t, result.List{Value: []result.Value{newValue(t, 1), newValue(t, 2)}}),
+			"Birth":  newValue(t, result.Date{Date: time.Date(1990, time.May, 4, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+		},
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  tabular.Config
+		want string
+	}{
+		{
+			name: "CSV with default columns",
+			want: `id,library,define,value,type
+1,Helpers,Birth,1990-05-04,System.Date
+1,Helpers,Visits,"[{""@type"":""System.Integer"",""value"":1},{""@type"":""System.Integer"",""value"":2}]",List<System.Integer>
+1,Measure,In Population,true,System.Boolean
+1,Measure,Missing,,System.Any
+1,Measure,Name,"Smith, ""Jo""",System.String
+1,Measure,Weight,70.5 'kg',System.Quantity
+`,
+		},
+		{
+			name: "TSV with custom columns and no header",
+			cfg: tabular.Config{
+				Columns:    []tabular.Column{tabular.ColumnDefine, tabular.ColumnLibraryVersion, tabular.ColumnValue},
+				Delimiter:  '\t',
+				OmitHeader: true,
+			},
+			want: "Birth\t\t1990-05-04\n" +
+				"Visits\t\t\"[{\"\"@type\"\":\"\"System.Integer\"\",\"\"value\"\":1},{\"\"@type\"\":\"\"System.Integer\"\",\"\"value\"\":2}]\"\n" +
+				"In Population\t1.0.0\ttrue\n" +
+				"Missing\t1.0.0\t\n" +
+				"Name\t1.0.0\t\"Smith, \"\"Jo\"\"\"\n" +
+				"Weight\t1.0.0\t70.5 'kg'\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var sb strings.Builder
+			w, err := tabular.NewWriter(&sb, tc.cfg)
+			if err != nil {
+				t.Fatalf("NewWriter() returned unexpected error: %v", err)
+			}
+			if err := w.Write("1", testResults(t)); err != nil {
+				t.Fatalf("Write() returned unexpected error: %v", err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, sb.String()); diff != "" {
+				t.Errorf("Writer output diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriter_MultiplePatients(t *testing.T) {
+	var sb strings.Builder
+	w, err := tabular.NewWriter(&sb, tabular.Config{Columns: []tabular.Column{tabular.ColumnID, tabular.ColumnValue}})
+	if err != nil {
+		t.Fatalf("NewWriter() returned unexpected error: %v", err)
+	}
+	for _, id := range []string{"1", "2"} {
+		libs := result.Libraries{result.LibKey{Name: "L"}: map[string]result.Value{"ID": newValue(t, id)}}
+		if err := w.Write(id, libs); err != nil {
+			t.Fatalf("Write(%s) returned unexpected error: %v", id, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() returned unexpected error: %v", err)
+	}
+	want := "id,value\n1,1\n2,2\n"
+	if got := sb.String(); got != want {
+		t.Errorf("Writer output = %q, want %q", got, want)
+	}
+}
+
+func TestNewWriter_UnknownColumn(t *testing.T) {
+	_, err := tabular.NewWriter(&strings.Builder{}, tabular.Config{Columns: []tabular.Column{"patient"}})
+	if !errors.Is(err, tabular.ErrUnknownColumn) {
+		t.Errorf("NewWriter() returned error %v, want %v", err, tabular.ErrUnknownColumn)
+	}
+}
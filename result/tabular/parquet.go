@@ -0,0 +1,332 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tabular
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/google/cql/internal/resultcolumns"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+	"github.com/parquet-go/parquet-go"
+)
+
+// idColumn is the name of the Parquet column holding the subject ID.
+const idColumn = "id"
+
+// ParquetWriter writes evaluation results as a Parquet file, with one row per subject and one
+// typed column per definition. The schema is derived from the static result types of the
+// definitions, as returned by cql.ELM.ResultTypes, so it is known before any results exist:
+//
+//   - Booleans, Integers, Longs, Decimals and Strings map to the matching Parquet primitive.
+//   - Dates, DateTimes and Times map to the DATE, TIMESTAMP(MILLIS) and TIME(MILLIS) types.
+//   - Quantities, Ratios, Codes, Concepts, Intervals and Tuples map to groups of their fields.
+//   - Lists map to Parquet LISTs. Null elements of Lists are omitted.
+//   - ValueSets and CodeSystems map to their canonical URL.
+//   - All other types, such as FHIR resources and choice types, map to their result JSON.
+//
+// Columns are named after their definition. If several libraries have a definition with the same
+// name the columns are named Library.Definition instead.
+type ParquetWriter struct {
+	w       *parquet.Writer
+	columns []parquetColumn
+}
+
+type parquetColumn struct {
+	name    string
+	library result.LibKey
+	def     string
+	typ     types.IType
+}
+
+// NewParquetWriter returns a ParquetWriter writing to w, with a column for each definition in
+// resultTypes. The file is not complete until Close is called.
+func NewParquetWriter(w io.Writer, resultTypes map[result.LibKey]map[string]types.IType) (*ParquetWriter, error) {
+	var columns []parquetColumn
+	for lib, defs := range resultTypes {
+		for def, t := range defs {
+			columns = append(columns, parquetColumn{library: lib, def: def, typ: t})
+		}
+	}
+	names := newColumnNamer()
+	for _, c := range columns {
+		names.add(c.def)
+	}
+	group := parquet.Group{idColumn: parquet.String()}
+	for i, c := range columns {
+		c.name = names.name(c.library, c.def)
+		if _, ok := group[c.name]; ok {
+			return nil, fmt.Errorf("duplicate Parquet column %s", c.name)
+		}
+		node, err := parquetNode(c.typ)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", c.library, c.def, err)
+		}
+		group[c.name] = parquet.Optional(node)
+		columns[i] = c
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return &ParquetWriter{w: parquet.NewWriter(w, parquet.NewSchema("results", group)), columns: columns}, nil
+}
+
+// Write writes the row of the subject with the given ID. Definitions missing from the results are
+// written as null.
+func (p *ParquetWriter) Write(id string, libs result.Libraries) error {
+	row := map[string]any{idColumn: id}
+	for _, c := range p.columns {
+		v, ok := libs[c.library][c.def]
+		if !ok {
+			row[c.name] = nil
+			continue
+		}
+		pv, err := parquetValue(c.typ, v)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", c.library, c.def, err)
+		}
+		row[c.name] = pv
+	}
+	return p.w.Write(row)
+}
+
+// Close flushes the buffered rows and writes the Parquet footer. It does not close the underlying
+// io.Writer.
+func (p *ParquetWriter) Close() error {
+	return p.w.Close()
+}
+
+var (
+	quantityNode = parquet.Group{
+		"value": parquet.Optional(parquet.Leaf(parquet.DoubleType)),
+		"unit":  parquet.Optional(parquet.String()),
+	}
+	codeNode = parquet.Group{
+		"system":  parquet.Optional(parquet.String()),
+		"version": parquet.Optional(parquet.String()),
+		"code":    parquet.Optional(parquet.String()),
+		"display": parquet.Optional(parquet.String()),
+	}
+)
+
+// columnNamer names the column of each definition after the definition, or Library.Definition if
+// several libraries have a definition with the same name or the definition is named id.
+type columnNamer map[string]int
+
+func newColumnNamer() columnNamer { return make(columnNamer) }
+
+// add registers a definition that gets a column.
+func (n columnNamer) add(def string) { n[def]++ }
+
+// name returns the column name of a registered definition.
+func (n columnNamer) name(lib result.LibKey, def string) string {
+	if n[def] > 1 || def == idColumn {
+		return lib.Name + "." + def
+	}
+	return def
+}
+
+// parquetNode returns the Parquet node of a CQL type. The node is required, callers wrap it in
+// parquet.Optional where nulls are allowed.
+func parquetNode(t types.IType) (parquet.Node, error) {
+	switch t := t.(type) {
+	case types.System:
+		switch t {
+		case types.Boolean:
+			return parquet.Leaf(parquet.BooleanType), nil
+		case types.Integer:
+			return parquet.Int(32), nil
+		case types.Long:
+			return parquet.Int(64), nil
+		case types.Decimal:
+			return parquet.Leaf(parquet.DoubleType), nil
+		case types.Date:
+			return parquet.Date(), nil
+		case types.DateTime:
+			return parquet.Timestamp(parquet.Millisecond), nil
+		case types.Time:
+			return parquet.Time(parquet.Millisecond), nil
+		case types.Quantity:
+			return quantityNode, nil
+		case types.Ratio:
+			return parquet.Group{"numerator": parquet.Optional(quantityNode), "denominator": parquet.Optional(quantityNode)}, nil
+		case types.Code:
+			return codeNode, nil
+		case types.Concept:
+			return parquet.Group{"codes": parquet.Optional(parquet.List(codeNode)), "display": parquet.Optional(parquet.String())}, nil
+		}
+		// Strings, ValueSets, CodeSystems and types without a dedicated representation are strings.
+		return parquet.String(), nil
+	case *types.Interval:
+		point, err := parquetNode(t.PointType)
+		if err != nil {
+			return nil, err
+		}
+		return parquet.Group{
+			"low":         parquet.Optional(point),
+			"high":        parquet.Optional(point),
+			"low_closed":  parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+			"high_closed": parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+		}, nil
+	case *types.List:
+		elem, err := parquetNode(t.ElementType)
+		if err != nil {
+			return nil, err
+		}
+		return parquet.List(elem), nil
+	case *types.Tuple:
+		g := parquet.Group{}
+		for name, et := range t.ElementTypes {
+			n, err := parquetNode(et)
+			if err != nil {
+				return nil, err
+			}
+			g[name] = parquet.Optional(n)
+		}
+		return g, nil
+	default:
+		return parquet.String(), nil
+	}
+}
+
+// parquetValue converts a result to the physical representation of its Parquet node.
+func parquetValue(t types.IType, v result.Value) (any, error) {
+	if result.IsNull(v) {
+		return nil, nil
+	}
+	switch t := t.(type) {
+	case types.System:
+		switch t {
+		case types.Boolean, types.Integer, types.Long, types.Decimal:
+			return v.GolangValue(), nil
+		case types.String:
+			return result.ToString(v)
+		case types.Date:
+			d, err := result.ToDateTime(v)
+			if err != nil {
+				return nil, err
+			}
+			y, m, day := d.Date.Date()
+			return int32(time.Date(y, m, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60)), nil
+		case types.DateTime:
+			d, err := result.ToDateTime(v)
+			if err != nil {
+				return nil, err
+			}
+			return d.Date.UnixMilli(), nil
+		case types.Time:
+			tm, ok := v.GolangValue().(result.Time)
+			if !ok {
+				return nil, fmt.Errorf("got %v, want a Time", v.RuntimeType())
+			}
+			h, m, s := tm.Date.Clock()
+			return int32((h*60*60+m*60+s)*1000 + tm.Date.Nanosecond()/int(time.Millisecond)), nil
+		case types.Quantity:
+			q, err := result.ToQuantity(v)
+			if err != nil {
+				return nil, err
+			}
+			return resultcolumns.Quantity(q), nil
+		case types.Ratio:
+			r, err := result.ToRatio(v)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{"numerator": resultcolumns.Quantity(r.Numerator), "denominator": resultcolumns.Quantity(r.Denominator)}, nil
+		case types.Code:
+			c, err := result.ToCode(v)
+			if err != nil {
+				return nil, err
+			}
+			return resultcolumns.Code(c), nil
+		case types.Concept:
+			c, err := result.ToConcept(v)
+			if err != nil {
+				return nil, err
+			}
+			codes := []any{}
+			for _, code := range c.NonNullCodeValues() {
+				codes = append(codes, resultcolumns.Code(code))
+			}
+			return map[string]any{"codes": codes, "display": resultcolumns.OptionalString(c.Display)}, nil
+		case types.ValueSet:
+			vs, err := result.ToValueSet(v)
+			if err != nil {
+				return nil, err
+			}
+			return vs.Canonical(), nil
+		case types.CodeSystem:
+			cs, err := result.ToCodeSystem(v)
+			if err != nil {
+				return nil, err
+			}
+			return cs.Canonical(), nil
+		}
+		return resultcolumns.JSON(v)
+	case *types.Interval:
+		i, err := result.ToInterval(v)
+		if err != nil {
+			return nil, err
+		}
+		low, err := parquetValue(t.PointType, i.Low)
+		if err != nil {
+			return nil, err
+		}
+		high, err := parquetValue(t.PointType, i.High)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"low": low, "high": high, "low_closed": i.LowInclusive, "high_closed": i.HighInclusive}, nil
+	case *types.List:
+		l, err := result.ToSlice(v)
+		if err != nil {
+			return nil, err
+		}
+		elems := []any{}
+		for _, e := range l {
+			if result.IsNull(e) {
+				continue
+			}
+			pe, err := parquetValue(t.ElementType, e)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, pe)
+		}
+		return elems, nil
+	case *types.Tuple:
+		tup, err := result.ToTuple(v)
+		if err != nil {
+			return nil, err
+		}
+		g := make(map[string]any, len(t.ElementTypes))
+		for name, et := range t.ElementTypes {
+			ev, ok := tup[name]
+			if !ok {
+				g[name] = nil
+				continue
+			}
+			pv, err := parquetValue(et, ev)
+			if err != nil {
+				return nil, err
+			}
+			g[name] = pv
+		}
+		return g, nil
+	default:
+		return resultcolumns.JSON(v)
+	}
+}
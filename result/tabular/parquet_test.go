@@ -0,0 +1,185 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tabular_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/result/tabular"
+	"github.com/google/cql/types"
+	"github.com/google/go-cmp/cmp"
+	"github.com/parquet-go/parquet-go"
+)
+
+func readParquet(t *testing.T, b []byte) (*parquet.Schema, []map[string]any) {
+	t.Helper()
+	r := parquet.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	var rows []map[string]any
+	for {
+		row := map[string]any{}
+		if err := r.Read(&row); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			t.Fatalf("Read() returned unexpected error: %v", err)
+		}
+		rows = append(rows, row)
+	}
+	return r.Schema(), rows
+}
+
+func TestParquetWriter(t *testing.T) {
+	measure := result.LibKey{Name: "Measure", Version: "1.0.0"}
+	helpers := result.LibKey{Name: "Helpers"}
+	resultTypes := map[result.LibKey]map[string]types.IType{
+		measure: {
+			"In Population": types.Boolean,
+			"Count":         types.Integer,
+			"Birth Date":    types.Date,
+			"Weight":        types.Quantity,
+			"Code":          types.Code,
+			"Scores":        &types.List{ElementType: types.Decimal},
+			"Period":        &types.Interval{PointType: types.DateTime},
+			"Name":          types.String,
+			"Patient":       &types.Named{TypeName: "FHIR.Patient"},
+		},
+		helpers: {
+			"Name": types.String,
+		},
+	}
+	var buf bytes.Buffer
+	w, err := tabular.NewParquetWriter(&buf, resultTypes)
+	if err != nil {
+		t.Fatalf("NewParquetWriter() returned unexpected error: %v", err)
+	}
+	start := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	libs := result.Libraries{
+		measure: {
+			"In Population": newValue(t, true),
+			"Count":         newValue(t, 3),
+			"Birth Date":    newValue(t, result.Date{Date: time.Date(1970, time.January, 11, 0, 0, 0, 0, time.UTC), Precision: model.DAY}),
+			"Weight":        newValue(t, result.Quantity{Value: 70.5, Unit: "kg"}),
+			"Code":          newValue(t, result.Code{System: "http://loinc.org", Code: "1234-5"}),
+			"Scores":        newValue(t, result.List{Value: []result.Value{newValue(t, 1.5), newValue(t, nil), newValue(t, 2.5)}}),
+			"Period": newValue(t, result.Interval{
+				Low:          newValue(t, result.DateTime{Date: start, Precision: model.SECOND}),
+				High:         newValue(t, nil),
+				LowInclusive: true,
+				StaticType:   &types.Interval{PointType: types.DateTime},
+			}),
+			"Name": newValue(t, "measure name"),
+		},
+		helpers: {"Name": newValue(t, "helpers name")},
+	}
+	if err := w.Write("1", libs); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	// Missing results are written as null.
+	if err := w.Write("2", result.Libraries{}); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	schema, rows := readParquet(t, buf.Bytes())
+	wantColumns := [][]string{
+		{"Birth Date"},
+		{"Code", "code"},
+		{"Code", "display"},
+		{"Code", "system"},
+		{"Code", "version"},
+		{"Count"},
+		{"Helpers.Name"},
+		{"In Population"},
+		{"Measure.Name"},
+		{"Patient"},
+		{"Period", "high"},
+		{"Period", "high_closed"},
+		{"Period", "low"},
+		{"Period", "low_closed"},
+		{"Scores", "list", "element"},
+		{"Weight", "unit"},
+		{"Weight", "value"},
+		{"id"},
+	}
+	if diff := cmp.Diff(wantColumns, schema.Columns()); diff != "" {
+		t.Errorf("Parquet columns diff (-want +got):\n%s", diff)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Parquet file has %d rows, want 2", len(rows))
+	}
+	got := rows[0]
+	want := map[string]any{
+		"id":            "1",
+		"In Population": true,
+		"Count":         int32(3),
+		"Birth Date":    int32(10),
+		"Weight":        map[string]any{"value": 70.5, "unit": "kg"},
+		"Code":          map[string]any{"system": "http://loinc.org", "code": "1234-5", "display": nil, "version": nil},
+		"Period":        map[string]any{"low": start.UnixMilli(), "high": nil, "low_closed": true, "high_closed": false},
+		"Measure.Name":  "measure name",
+		"Helpers.Name":  "helpers name",
+		"Patient":       nil,
+	}
+	for col, w := range want {
+		if diff := cmp.Diff(w, got[col]); diff != "" {
+			t.Errorf("row 1 column %s diff (-want +got):\n%s", col, diff)
+		}
+	}
+	if got := rows[1]["Count"]; got != nil {
+		t.Errorf("row 2 column Count = %v, want nil", got)
+	}
+}
+
+func TestParquetWriter_ListValues(t *testing.T) {
+	lib := result.LibKey{Name: "L"}
+	var buf bytes.Buffer
+	w, err := tabular.NewParquetWriter(&buf, map[result.LibKey]map[string]types.IType{lib: {"Scores": &types.List{ElementType: types.Integer}}})
+	if err != nil {
+		t.Fatalf("NewParquetWriter() returned unexpected error: %v", err)
+	}
+	scores := newValue(t, result.List{Value: []result.Value{newValue(t, 1), newValue(t, nil), newValue(t, 3)}})
+	if err := w.Write("1", result.Libraries{lib: {"Scores": scores}}); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	r := parquet.NewReader(bytes.NewReader(buf.Bytes()))
+	defer r.Close()
+	rows := make([]parquet.Row, 1)
+	if n, err := r.ReadRows(rows); n != 1 {
+		t.Fatalf("ReadRows() read %d rows with error %v, want 1 row", n, err)
+	}
+	var got []int32
+	// Column 0 is Scores.list.element, null elements are omitted.
+	for _, v := range rows[0] {
+		if v.Column() == 0 {
+			got = append(got, v.Int32())
+		}
+	}
+	if diff := cmp.Diff([]int32{1, 3}, got); diff != "" {
+		t.Errorf("Scores diff (-want +got):\n%s", diff)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -41,6 +42,9 @@ type Value struct {
 	runtimeType types.IType
 	sourceExpr  model.IExpression
 	sourceVals  []Value
+	stats       *EvalStats
+	meta        *DefMetadata
+	trace       []DebugStep
 }
 
 // GolangValue returns the underlying Golang value representing the CQL value. Specifically:
@@ -106,6 +110,18 @@ type simpleJSONMessage struct {
 	Value any             `json:"value"`
 }
 
+// canonicalDecimal formats a CQL Decimal as a JSON number. CQL Decimals have a scale of 8, so the
+// value is rounded to 8 decimal places, which also hides floating point differences between
+// architectures. Trailing zeros and exponents are never used, and negative zero is formatted as 0.
+func canonicalDecimal(f float64) json.Number {
+	s := strconv.FormatFloat(f, 'f', 8, 64)
+	s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return json.Number(s)
+}
+
 // customJSONMarshaler is an interface for types that need to marshal their own JSON representation.
 // I.E. types that are not simple types.
 type customJSONMarshaler interface {
@@ -121,12 +137,22 @@ func (v Value) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return v.marshalJSONWithType(rt)
+}
 
+// marshalJSONWithType returns the JSON representation of the value, tagged with the JSON of its
+// runtime type rt.
+func (v Value) marshalJSONWithType(rt json.RawMessage) ([]byte, error) {
 	// TODO: b/301606416 - Vocabulary support.
 	switch gv := v.goValue.(type) {
 	case customJSONMarshaler:
 		return gv.marshalJSON(rt)
-	case bool, float64, int32, int64, string, nil:
+	case float64:
+		return json.Marshal(simpleJSONMessage{
+			Value: canonicalDecimal(gv),
+			Type:  rt,
+		})
+	case bool, int32, int64, string, nil:
 		return json.Marshal(simpleJSONMessage{
 			Value: gv,
 			Type:  rt,
@@ -554,11 +580,11 @@ func QuantityFromProto(pb *crpb.Quantity) Quantity {
 func (q Quantity) marshalJSON(t json.RawMessage) ([]byte, error) {
 	return json.Marshal(struct {
 		Type  json.RawMessage `json:"@type"`
-		Value float64         `json:"value"`
+		Value json.Number     `json:"value"`
 		Unit  string          `json:"unit"`
 	}{
 		Type:  t,
-		Value: q.Value,
+		Value: canonicalDecimal(q.Value),
 		Unit:  string(q.Unit),
 	})
 }
@@ -994,9 +1020,22 @@ func (n Named) Proto() (*crpb.Named, error) {
 	}, nil
 }
 
-// NamedFromProto converts a proto to a Named.
+// NamedFromProto converts a proto to a Named. The message type held in the Any must be linked into
+// the binary (for example the FHIR R4 resource protos) so it can be resolved from the global proto
+// registry.
 func NamedFromProto(pb *crpb.Named) (Named, error) {
-	return Named{}, errors.New("currently do not support converting a proto named type back into a golang value")
+	if pb.GetValue() == nil {
+		return Named{}, errors.New("named value proto is missing its value")
+	}
+	m, err := pb.GetValue().UnmarshalNew()
+	if err != nil {
+		return Named{}, fmt.Errorf("failed to unpack named value %s: %w", pb.GetValue().GetTypeUrl(), err)
+	}
+	t, err := types.NamedFromProto(pb.GetRuntimeType())
+	if err != nil {
+		return Named{}, err
+	}
+	return Named{Value: m, RuntimeType: t}, nil
 }
 
 // Named types aren't called out in the spec yet so we are defining our own representation
@@ -1138,6 +1177,11 @@ func (v ValueSet) Equal(a ValueSet) bool {
 	return true
 }
 
+// Canonical returns the FHIR canonical URL of the ValueSet, url|version if it has a version.
+func (v ValueSet) Canonical() string {
+	return canonical(v.ID, v.Version)
+}
+
 // Proto converts ValueSet to a proto.
 func (v ValueSet) Proto() *crpb.ValueSet {
 	pbValueSet := &crpb.ValueSet{
@@ -1190,6 +1234,18 @@ type CodeSystem struct {
 	// Unlike the CQL reference we are not including the local name as it is not considered useful.
 }
 
+// Canonical returns the FHIR canonical URL of the CodeSystem, url|version if it has a version.
+func (c CodeSystem) Canonical() string {
+	return canonical(c.ID, c.Version)
+}
+
+func canonical(url, version string) string {
+	if version == "" {
+		return url
+	}
+	return url + "|" + version
+}
+
 // TODO: b/301606416 - Need to be able to output CodeSystem name.
 func (c CodeSystem) marshalJSON(runtimeType json.RawMessage) ([]byte, error) {
 	return json.Marshal(struct {
@@ -1361,3 +1417,50 @@ func (c Code) Proto() *crpb.Code {
 func CodeFromProto(pb *crpb.Code) Code {
 	return Code{Code: pb.GetCode(), Display: pb.GetDisplay(), System: pb.GetSystem(), Version: pb.GetVersion()}
 }
+
+// MapCodes returns a copy of v with f applied to every Code, including the Codes within Concepts,
+// Lists and Tuples. Other values, including Named FHIR resources, are returned unchanged.
+func MapCodes(v Value, f func(Code) (Code, error)) (Value, error) {
+	switch gv := v.goValue.(type) {
+	case Code:
+		c, err := f(gv)
+		if err != nil {
+			return Value{}, err
+		}
+		v.goValue = c
+	case Concept:
+		concept := Concept{Display: gv.Display, Codes: make([]*Code, len(gv.Codes))}
+		for i, c := range gv.Codes {
+			if c == nil {
+				continue
+			}
+			mapped, err := f(*c)
+			if err != nil {
+				return Value{}, err
+			}
+			concept.Codes[i] = &mapped
+		}
+		v.goValue = concept
+	case List:
+		l := List{StaticType: gv.StaticType, Value: make([]Value, len(gv.Value))}
+		for i, elem := range gv.Value {
+			mapped, err := MapCodes(elem, f)
+			if err != nil {
+				return Value{}, err
+			}
+			l.Value[i] = mapped
+		}
+		v.goValue = l
+	case Tuple:
+		t := Tuple{RuntimeType: gv.RuntimeType, Value: make(map[string]Value, len(gv.Value))}
+		for k, elem := range gv.Value {
+			mapped, err := MapCodes(elem, f)
+			if err != nil {
+				return Value{}, err
+			}
+			t.Value[k] = mapped
+		}
+		v.goValue = t
+	}
+	return v, nil
+}
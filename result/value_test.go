@@ -1075,6 +1075,26 @@ func TestMarshalJSON(t *testing.T) {
 			unmarshalled: newOrFatal(t, 4.5),
 			want:         `{"@type":"System.Decimal","value":4.5}`,
 		},
+		{
+			name:         "Decimal rounded to 8 decimal places",
+			unmarshalled: newOrFatal(t, 0.1+0.2),
+			want:         `{"@type":"System.Decimal","value":0.3}`,
+		},
+		{
+			name:         "Large Decimal without exponent",
+			unmarshalled: newOrFatal(t, 1e21),
+			want:         `{"@type":"System.Decimal","value":1000000000000000000000}`,
+		},
+		{
+			name:         "Small Decimal without exponent",
+			unmarshalled: newOrFatal(t, 1.5e-7),
+			want:         `{"@type":"System.Decimal","value":0.00000015}`,
+		},
+		{
+			name:         "Negative zero Decimal",
+			unmarshalled: newOrFatal(t, -1e-12),
+			want:         `{"@type":"System.Decimal","value":0}`,
+		},
 		{
 			name:         "String",
 			unmarshalled: newOrFatal(t, "hello"),
@@ -1090,6 +1110,11 @@ func TestMarshalJSON(t *testing.T) {
 			unmarshalled: newOrFatal(t, Quantity{Value: 1, Unit: model.YEARUNIT}),
 			want:         `{"@type":"System.Quantity","value":1,"unit":"year"}`,
 		},
+		{
+			name:         "Quantity with canonical Decimal",
+			unmarshalled: newOrFatal(t, Quantity{Value: 2.0 / 3, Unit: "mg"}),
+			want:         `{"@type":"System.Quantity","value":0.66666667,"unit":"mg"}`,
+		},
 		{
 			name: "Ratio",
 			unmarshalled: newOrFatal(t,
@@ -1569,9 +1594,22 @@ func TestProtoAndBack_Named(t *testing.T) {
 		t.Errorf("Proto() returned unexpected diff (-want +got):\n%s", diff)
 	}
 
-	_, err = NewFromProto(gotProto)
+	gotValue, err := NewFromProto(gotProto)
+	if err != nil {
+		t.Fatalf("NewFromProto() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(value, gotValue, protocmp.Transform()); diff != "" {
+		t.Errorf("NewFromProto() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestNamedFromProto_Error(t *testing.T) {
+	_, err := NamedFromProto(&crpb.Named{
+		Value:       &anypb.Any{TypeUrl: "type.googleapis.com/not.a.RealMessage"},
+		RuntimeType: &ctpb.NamedType{TypeName: proto.String("FHIR.Patient")},
+	})
 	if err == nil {
-		t.Errorf("NewFromProto() succeeded, want error")
+		t.Errorf("NamedFromProto() succeeded, want error")
 	}
 }
 
@@ -1592,3 +1630,63 @@ func anyProtoOrFatal(t *testing.T, a proto.Message) *anypb.Any {
 	}
 	return o
 }
+
+func TestMapCodes(t *testing.T) {
+	addDisplay := func(c Code) (Code, error) {
+		c.Display = "display " + c.Code
+		return c, nil
+	}
+	code := Code{Code: "1", System: "s"}
+	tests := []struct {
+		name  string
+		input Value
+		want  Value
+	}{
+		{
+			name:  "Code",
+			input: newOrFatal(t, code),
+			want:  newOrFatal(t, Code{Code: "1", System: "s", Display: "display 1"}),
+		},
+		{
+			name:  "Concept with null code",
+			input: newOrFatal(t, Concept{Codes: []*Code{&code, nil}, Display: "concept"}),
+			want:  newOrFatal(t, Concept{Codes: []*Code{{Code: "1", System: "s", Display: "display 1"}, nil}, Display: "concept"}),
+		},
+		{
+			name: "List of Tuples",
+			input: newOrFatal(t, List{
+				Value:      []Value{newOrFatal(t, Tuple{Value: map[string]Value{"c": newOrFatal(t, code), "i": newOrFatal(t, 4)}, RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"c": types.Code, "i": types.Integer}}})},
+				StaticType: &types.List{ElementType: &types.Tuple{ElementTypes: map[string]types.IType{"c": types.Code, "i": types.Integer}}},
+			}),
+			want: newOrFatal(t, List{
+				Value:      []Value{newOrFatal(t, Tuple{Value: map[string]Value{"c": newOrFatal(t, Code{Code: "1", System: "s", Display: "display 1"}), "i": newOrFatal(t, 4)}, RuntimeType: &types.Tuple{ElementTypes: map[string]types.IType{"c": types.Code, "i": types.Integer}}})},
+				StaticType: &types.List{ElementType: &types.Tuple{ElementTypes: map[string]types.IType{"c": types.Code, "i": types.Integer}}},
+			}),
+		},
+		{
+			name:  "Other values are unchanged",
+			input: newOrFatal(t, "string"),
+			want:  newOrFatal(t, "string"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MapCodes(tc.input, addDisplay)
+			if err != nil {
+				t.Fatalf("MapCodes() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("MapCodes() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// The input is not modified.
+	in := newOrFatal(t, Concept{Codes: []*Code{&code}})
+	if _, err := MapCodes(in, addDisplay); err != nil {
+		t.Fatalf("MapCodes() returned unexpected error: %v", err)
+	}
+	if code.Display != "" {
+		t.Errorf("MapCodes() modified its input")
+	}
+}
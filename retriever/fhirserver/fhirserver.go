@@ -0,0 +1,184 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fhirserver is an implementation of the Retriever Interface for the CQL engine, which
+// fetches the resources of a single patient from a FHIR R4 server over its REST API.
+package fhirserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// Config configures the connection to a FHIR server.
+type Config struct {
+	// BaseURL is the FHIR base URL of the server, for example https://hapi.fhir.org/baseR4.
+	BaseURL string
+	// Client is used for requests to the server. If nil http.DefaultClient is used. Clients
+	// handling authentication themselves, such as those with OAuth2 credentials, can be set here.
+	Client *http.Client
+	// BearerToken if set is sent as the Authorization header of every request.
+	BearerToken string
+	// SearchFilters if true passes the filters of RetrieveFiltered to the server as search
+	// parameters, see RetrieveFiltered. The server must support the :in modifier of token search
+	// parameters. If false RetrieveFiltered is the same as Retrieve.
+	SearchFilters bool
+}
+
+// Retriever implements the Retriever and FilteredRetriever Interfaces for the CQL engine. Resources
+// are fetched on the first Retrieve of their type, with a compartment search Patient/{id}/{type},
+// and then cached. Retriever is safe for concurrent use.
+type Retriever struct {
+	cfg          Config
+	patientID    string
+	unmarshaller *jsonformat.Unmarshaller
+
+	mu sync.Mutex
+	// resources are keyed by the resource type, followed by the search parameters of filtered
+	// retrieves.
+	resources map[string][]*r4pb.ContainedResource
+}
+
+// New returns a Retriever for the resources of the patient with the given id on the FHIR server.
+// No requests are made until the first Retrieve.
+func New(cfg Config, patientID string) (*Retriever, error) {
+	if cfg.BaseURL == "" {
+		return nil, fmt.Errorf("a FHIR server base URL is required")
+	}
+	if patientID == "" {
+		return nil, fmt.Errorf("a patient id is required")
+	}
+	if _, err := url.Parse(cfg.BaseURL); err != nil {
+		return nil, fmt.Errorf("invalid FHIR server base URL %q: %w", cfg.BaseURL, err)
+	}
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	return &Retriever{
+		cfg:          cfg,
+		patientID:    patientID,
+		unmarshaller: unmarshaller,
+		resources:    make(map[string][]*r4pb.ContainedResource),
+	}, nil
+}
+
+// Retrieve returns all FHIR resources of type fhirResourceType for the patient. The Patient itself
+// is read with Patient/{id}, all other types are searched for in the patient's compartment.
+func (r *Retriever) Retrieve(ctx context.Context, fhirResourceType string) ([]*r4pb.ContainedResource, error) {
+	return r.retrieve(ctx, fhirResourceType, nil)
+}
+
+// retrieve returns the FHIR resources of type fhirResourceType for the patient matching the search
+// parameters, which are not used for the Patient.
+func (r *Retriever) retrieve(ctx context.Context, fhirResourceType string, params url.Values) ([]*r4pb.ContainedResource, error) {
+	key := fhirResourceType
+	if len(params) > 0 {
+		key += "?" + params.Encode()
+	}
+	r.mu.Lock()
+	cached, ok := r.resources[key]
+	r.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	id := url.PathEscape(r.patientID)
+	path := "Patient/" + id + "/" + url.PathEscape(fhirResourceType)
+	if fhirResourceType == "Patient" {
+		path = "Patient/" + id
+	} else if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	resources := []*r4pb.ContainedResource{}
+	err := r.search(ctx, path, func(res *r4pb.ContainedResource) {
+		// Searches may include other resources, such as OperationOutcomes.
+		if res.GetOperationOutcome() == nil {
+			resources = append(resources, res)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resources[key] = resources
+	return resources, nil
+}
+
+// search requests path, relative to the FHIR base URL, and calls emit for the resource of every
+// entry of the returned resource. Searchset bundles are paged through by following their next
+// links, while any other resource is emitted as is.
+func (r *Retriever) search(ctx context.Context, path string, emit func(*r4pb.ContainedResource)) error {
+	next := strings.TrimSuffix(r.cfg.BaseURL, "/") + "/" + path
+	for next != "" {
+		res, err := r.get(ctx, next)
+		if err != nil {
+			return err
+		}
+		b := res.GetBundle()
+		if b == nil {
+			emit(res)
+			return nil
+		}
+		for _, e := range b.GetEntry() {
+			emit(e.GetResource())
+		}
+		next = ""
+		for _, l := range b.GetLink() {
+			if l.GetRelation().GetValue() == "next" {
+				next = l.GetUrl().GetValue()
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Retriever) get(ctx context.Context, url string) (*r4pb.ContainedResource, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/fhir+json")
+	if r.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.cfg.BearerToken)
+	}
+	client := r.cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("FHIR server request %s failed with status %s: %s", url, resp.Status, body)
+	}
+	return r.unmarshaller.UnmarshalR4(body)
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhirserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/cql/internal/resourcewrapper"
+	"github.com/google/cql/retriever"
+	"github.com/google/go-cmp/cmp"
+)
+
+// newTestServer returns a FHIR server for the patient p1, which has a Patient and two pages of
+// Encounters, and counts the requests made to it.
+func newTestServer(t *testing.T, wantToken string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if got := req.Header.Get("Authorization"); got != wantToken {
+			http.Error(w, `{"resourceType": "OperationOutcome"}`, http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.RequestURI() {
+		case "/fhir/Patient/p1":
+			fmt.Fprint(w, `{"resourceType": "Patient", "id": "p1"}`)
+		case "/fhir/Patient/p1/Encounter":
+			fmt.Fprintf(w, `{"resourceType": "Bundle", "type": "searchset",
+				"link": [{"relation": "next", "url": "%s/fhir/Patient/p1/Encounter?page=2"}],
+				"entry": [{"resource": {"resourceType": "Encounter", "id": "e1"}}]}`, server.URL)
+		case "/fhir/Patient/p1/Encounter?page=2":
+			fmt.Fprint(w, `{"resourceType": "Bundle", "type": "searchset", "entry": [
+				{"resource": {"resourceType": "Encounter", "id": "e2"}},
+				{"resource": {"resourceType": "OperationOutcome", "issue": [{"severity": "information", "code": "informational"}]}, "search": {"mode": "outcome"}}
+			]}`)
+		case "/fhir/Patient/p1/Observation":
+			fmt.Fprint(w, `{"resourceType": "Bundle", "type": "searchset"}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func resourceIDs(t *testing.T, r *Retriever, resourceType string) []string {
+	t.Helper()
+	resources, err := r.Retrieve(context.Background(), resourceType)
+	if err != nil {
+		t.Fatalf("Retrieve(%s) returned unexpected error: %v", resourceType, err)
+	}
+	ids := []string{}
+	for _, res := range resources {
+		id, err := resourcewrapper.New(res).ResourceID()
+		if err != nil {
+			t.Fatalf("ResourceID() returned unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestRetrieve(t *testing.T) {
+	server, requests := newTestServer(t, "Bearer secret")
+	r, err := New(Config{BaseURL: server.URL + "/fhir/", BearerToken: "secret"}, "p1")
+	if err != nil {
+		t.Fatalf("New() returned unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		resourceType string
+		want         []string
+	}{
+		{resourceType: "Patient", want: []string{"p1"}},
+		{resourceType: "Encounter", want: []string{"e1", "e2"}},
+		{resourceType: "Observation", want: []string{}},
+	}
+	for _, tc := range tests {
+		if diff := cmp.Diff(tc.want, resourceIDs(t, r, tc.resourceType)); diff != "" {
+			t.Errorf("Retrieve(%s) diff (-want +got):\n%s", tc.resourceType, diff)
+		}
+	}
+
+	// Resources are cached after the first Retrieve.
+	before := requests.Load()
+	resourceIDs(t, r, "Encounter")
+	if got := requests.Load(); got != before {
+		t.Errorf("Retrieve(Encounter) made %d requests, want it to be cached", got-before)
+	}
+}
+
+func TestRetrieveFiltered(t *testing.T) {
+	filter := retriever.Filter{
+		CodeFilter: &retriever.CodeFilter{Property: "code", ValueSetURL: "https://test/vs", ValueSetVersion: "1.0"},
+		DateFilter: &retriever.DateFilter{
+			Property: "effective",
+			Start:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			End:      time.Date(2025, 1, 1, 0, 0, 0, 500, time.UTC),
+		},
+	}
+	tests := []struct {
+		name         string
+		cfg          Config
+		resourceType string
+		filter       retriever.Filter
+		want         url.Values
+	}{
+		{
+			name:         "Code and date",
+			cfg:          Config{SearchFilters: true},
+			resourceType: "Observation",
+			filter:       filter,
+			want: url.Values{
+				"code:in": {"https://test/vs|1.0"},
+				"date":    {"ge2024-01-01T00:00:00Z", "lt2025-01-01T00:00:01Z"},
+			},
+		},
+		{
+			name:         "Unknown properties",
+			cfg:          Config{SearchFilters: true},
+			resourceType: "Observation",
+			filter: retriever.Filter{
+				CodeFilter: &retriever.CodeFilter{Property: "category", ValueSetURL: "https://test/vs"},
+				DateFilter: &retriever.DateFilter{Property: "issued", Start: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+			},
+			want: url.Values{},
+		},
+		{
+			name:         "Search filters not enabled",
+			resourceType: "Observation",
+			filter:       filter,
+			want:         url.Values{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got url.Values
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/fhir/Patient/p1/Observation" {
+					http.NotFound(w, req)
+					return
+				}
+				got = req.URL.Query()
+				fmt.Fprint(w, `{"resourceType": "Bundle", "type": "searchset", "entry": [{"resource": {"resourceType": "Observation", "id": "o1"}}]}`)
+			}))
+			defer server.Close()
+			tc.cfg.BaseURL = server.URL + "/fhir"
+			r, err := New(tc.cfg, "p1")
+			if err != nil {
+				t.Fatalf("New() returned unexpected error: %v", err)
+			}
+
+			resources, err := r.RetrieveFiltered(context.Background(), tc.resourceType, tc.filter)
+			if err != nil {
+				t.Fatalf("RetrieveFiltered() returned unexpected error: %v", err)
+			}
+			if len(resources) != 1 {
+				t.Errorf("RetrieveFiltered() returned %d resources, want 1", len(resources))
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("RetrieveFiltered() searched with unexpected query (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRetrieveErrors(t *testing.T) {
+	server, _ := newTestServer(t, "Bearer secret")
+	tests := []struct {
+		name         string
+		cfg          Config
+		patientID    string
+		resourceType string
+	}{
+		{
+			name:         "Unauthorized",
+			cfg:          Config{BaseURL: server.URL + "/fhir"},
+			patientID:    "p1",
+			resourceType: "Patient",
+		},
+		{
+			name:         "Not found",
+			cfg:          Config{BaseURL: server.URL + "/fhir", BearerToken: "secret"},
+			patientID:    "p2",
+			resourceType: "Patient",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := New(tc.cfg, tc.patientID)
+			if err != nil {
+				t.Fatalf("New() returned unexpected error: %v", err)
+			}
+			if _, err := r.Retrieve(context.Background(), tc.resourceType); err == nil {
+				t.Errorf("Retrieve(%s) succeeded, want error", tc.resourceType)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(Config{}, "p1"); err == nil {
+		t.Errorf("New() without a base URL succeeded, want error")
+	}
+	if _, err := New(Config{BaseURL: "https://example.com/fhir"}, ""); err == nil {
+		t.Errorf("New() without a patient id succeeded, want error")
+	}
+}
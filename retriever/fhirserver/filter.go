@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhirserver
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/google/cql/retriever"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// codeSearchParams are the token search parameters of the code properties of FHIR R4 resources,
+// keyed by resource type and property.
+var codeSearchParams = map[string]string{
+	"AllergyIntolerance.code":             "code",
+	"Condition.code":                      "code",
+	"Coverage.type":                       "type",
+	"DiagnosticReport.code":               "code",
+	"Encounter.type":                      "type",
+	"Immunization.vaccineCode":            "vaccine-code",
+	"MedicationAdministration.medication": "code",
+	"MedicationDispense.medication":       "code",
+	"MedicationRequest.medication":        "code",
+	"MedicationStatement.medication":      "code",
+	"Observation.code":                    "code",
+	"Procedure.code":                      "code",
+	"ServiceRequest.code":                 "code",
+}
+
+// dateSearchParams are the date search parameters of the date properties of FHIR R4 resources,
+// keyed by resource type and property.
+var dateSearchParams = map[string]string{
+	"AllergyIntolerance.recordedDate":    "date",
+	"Condition.onset":                    "onset-date",
+	"Condition.recordedDate":             "recorded-date",
+	"DiagnosticReport.effective":         "date",
+	"Encounter.period":                   "date",
+	"Immunization.occurrence":            "date",
+	"MedicationAdministration.effective": "effective-time",
+	"MedicationRequest.authoredOn":       "authoredon",
+	"MedicationStatement.effective":      "effective",
+	"Observation.effective":              "date",
+	"Procedure.performed":                "date",
+	"ServiceRequest.authoredOn":          "authored",
+}
+
+// RetrieveFiltered returns the FHIR resources of type fhirResourceType for the patient that match
+// the filter. If Config.SearchFilters is set, the CodeFilter is searched for with the :in modifier
+// of the token search parameter of the code property, for example code:in={ValueSet url}, and the
+// DateFilter with the ge and lt prefixes of the date search parameter of the date property, for
+// example date=ge{start}&date=lt{end}. Filters on properties without a known search parameter are
+// left out, and the results of each distinct search are cached.
+func (r *Retriever) RetrieveFiltered(ctx context.Context, fhirResourceType string, filter retriever.Filter) ([]*r4pb.ContainedResource, error) {
+	if !r.cfg.SearchFilters {
+		return r.retrieve(ctx, fhirResourceType, nil)
+	}
+	return r.retrieve(ctx, fhirResourceType, searchParams(fhirResourceType, filter))
+}
+
+// searchParams returns the search parameters of the filter of a retrieve of fhirResourceType.
+func searchParams(fhirResourceType string, filter retriever.Filter) url.Values {
+	params := url.Values{}
+	if f := filter.CodeFilter; f != nil && f.ValueSetURL != "" {
+		if p, ok := codeSearchParams[fhirResourceType+"."+f.Property]; ok {
+			vs := f.ValueSetURL
+			if f.ValueSetVersion != "" {
+				vs += "|" + f.ValueSetVersion
+			}
+			params.Set(p+":in", vs)
+		}
+	}
+	if f := filter.DateFilter; f != nil {
+		if p, ok := dateSearchParams[fhirResourceType+"."+f.Property]; ok {
+			// FHIR date searches match resources whose period overlaps the range, so resources
+			// overlapping the start or end of the filter are still returned.
+			if !f.Start.IsZero() {
+				params.Add(p, "ge"+f.Start.UTC().Truncate(time.Second).Format(time.RFC3339))
+			}
+			if !f.End.IsZero() {
+				end := f.End.UTC()
+				if t := end.Truncate(time.Second); !t.Equal(end) {
+					// Searches are to the second, so a fractional end is rounded up to not leave out
+					// resources.
+					end = t.Add(time.Second)
+				}
+				params.Add(p, "lt"+end.Format(time.RFC3339))
+			}
+		}
+	}
+	return params
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package instrumented is an implementation of the Retriever Interface for the CQL engine that
+// wraps another retriever and reports per resource type retrieve counts, payload sizes and
+// latencies to a metrics.Recorder.
+package instrumented
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/cql/metrics"
+	"github.com/google/cql/retriever"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Names of the metrics reported by the Retriever. All metrics are labeled with the
+// ResourceTypeLabel.
+const (
+	// RetrieveCount counts the calls to Retrieve.
+	RetrieveCount = "cql_retriever_retrieve_count"
+	// RetrieveErrorCount counts the calls to Retrieve that returned an error.
+	RetrieveErrorCount = "cql_retriever_retrieve_error_count"
+	// RetrieveResourceCount counts the resources returned by Retrieve.
+	RetrieveResourceCount = "cql_retriever_retrieve_resource_count"
+	// RetrieveBytes is the distribution of the serialized proto size of the resources returned by
+	// each call to Retrieve.
+	RetrieveBytes = "cql_retriever_retrieve_bytes"
+	// RetrieveLatencyMillis is the distribution of the latency of each call to Retrieve.
+	RetrieveLatencyMillis = "cql_retriever_retrieve_latency_ms"
+
+	// ResourceTypeLabel is the label holding the FHIR resource type that was retrieved.
+	ResourceTypeLabel = "resource_type"
+)
+
+// Retriever implements the Retriever Interface for the CQL engine.
+type Retriever struct {
+	retriever retriever.Retriever
+	recorder  metrics.Recorder
+}
+
+// New returns a Retriever that reports metrics for every call to r to the recorder.
+func New(r retriever.Retriever, recorder metrics.Recorder) *Retriever {
+	if recorder == nil {
+		recorder = metrics.Nop{}
+	}
+	return &Retriever{retriever: r, recorder: recorder}
+}
+
+// Retrieve returns all FHIR resources of type fhirResourceType for the patient.
+func (i *Retriever) Retrieve(ctx context.Context, fhirResourceType string) ([]*r4pb.ContainedResource, error) {
+	return i.observe(fhirResourceType, func() ([]*r4pb.ContainedResource, error) {
+		return i.retriever.Retrieve(ctx, fhirResourceType)
+	})
+}
+
+// RetrieveFiltered returns the FHIR resources of type fhirResourceType for the patient that match
+// the filter. If the wrapped retriever is not a retriever.FilteredRetriever the filter is ignored.
+func (i *Retriever) RetrieveFiltered(ctx context.Context, fhirResourceType string, filter retriever.Filter) ([]*r4pb.ContainedResource, error) {
+	fr, ok := i.retriever.(retriever.FilteredRetriever)
+	if !ok {
+		return i.Retrieve(ctx, fhirResourceType)
+	}
+	return i.observe(fhirResourceType, func() ([]*r4pb.ContainedResource, error) {
+		return fr.RetrieveFiltered(ctx, fhirResourceType, filter)
+	})
+}
+
+// observe calls retrieve and reports its metrics.
+func (i *Retriever) observe(fhirResourceType string, retrieve func() ([]*r4pb.ContainedResource, error)) ([]*r4pb.ContainedResource, error) {
+	labels := metrics.Labels{ResourceTypeLabel: fhirResourceType}
+	start := time.Now()
+	resources, err := retrieve()
+	i.recorder.Observe(RetrieveLatencyMillis, labels, float64(time.Since(start).Microseconds())/1000)
+	i.recorder.Count(RetrieveCount, labels, 1)
+	if err != nil {
+		i.recorder.Count(RetrieveErrorCount, labels, 1)
+		return nil, err
+	}
+
+	size := 0
+	for _, r := range resources {
+		size += proto.Size(r)
+	}
+	i.recorder.Count(RetrieveResourceCount, labels, int64(len(resources)))
+	i.recorder.Observe(RetrieveBytes, labels, float64(size))
+	return resources, nil
+}
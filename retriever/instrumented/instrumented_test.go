@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package instrumented
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/cql/metrics"
+	"github.com/google/cql/retriever"
+	r4datapb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	r4patientpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+type fakeRetriever struct{}
+
+func (fakeRetriever) Retrieve(_ context.Context, resourceType string) ([]*r4pb.ContainedResource, error) {
+	if resourceType == "Patient" {
+		return []*r4pb.ContainedResource{patient("1"), patient("2")}, nil
+	}
+	return nil, errors.New("retrieve failed")
+}
+
+func TestRetriever(t *testing.T) {
+	ctx := context.Background()
+	rec := metrics.NewInMemory()
+	r := New(fakeRetriever{}, rec)
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Retrieve(ctx, "Patient"); err != nil {
+			t.Fatalf("Retrieve(Patient) returned unexpected error: %v", err)
+		}
+	}
+	if _, err := r.Retrieve(ctx, "Observation"); err == nil {
+		t.Fatalf("Retrieve(Observation) succeeded, want error")
+	}
+
+	patientLabels := metrics.Labels{ResourceTypeLabel: "Patient"}
+	obsLabels := metrics.Labels{ResourceTypeLabel: "Observation"}
+	counters := []struct {
+		name   string
+		labels metrics.Labels
+		want   int64
+	}{
+		{RetrieveCount, patientLabels, 2},
+		{RetrieveResourceCount, patientLabels, 4},
+		{RetrieveErrorCount, patientLabels, 0},
+		{RetrieveCount, obsLabels, 1},
+		{RetrieveErrorCount, obsLabels, 1},
+	}
+	for _, c := range counters {
+		if got := rec.Counter(c.name, c.labels); got != c.want {
+			t.Errorf("Counter(%s, %v) = %d, want %d", c.name, c.labels, got, c.want)
+		}
+	}
+
+	wantBytes := float64(2 * proto.Size(patient("1")))
+	if got := rec.Distribution(RetrieveBytes, patientLabels); got.Count != 2 || got.Max != wantBytes {
+		t.Errorf("Distribution(%s) = %+v, want Count 2 and Max %v", RetrieveBytes, got, wantBytes)
+	}
+	if got := rec.Distribution(RetrieveLatencyMillis, obsLabels); got.Count != 1 {
+		t.Errorf("Distribution(%s) = %+v, want Count 1", RetrieveLatencyMillis, got)
+	}
+}
+
+type filteredRetriever struct {
+	fakeRetriever
+	filters []retriever.Filter
+}
+
+func (f *filteredRetriever) RetrieveFiltered(ctx context.Context, resourceType string, filter retriever.Filter) ([]*r4pb.ContainedResource, error) {
+	f.filters = append(f.filters, filter)
+	return f.Retrieve(ctx, resourceType)
+}
+
+func TestRetriever_Filtered(t *testing.T) {
+	ctx := context.Background()
+	filter := retriever.Filter{CodeFilter: &retriever.CodeFilter{Property: "code", ValueSetURL: "https://example.com/vs"}}
+
+	rec := metrics.NewInMemory()
+	inner := &filteredRetriever{}
+	if _, err := New(inner, rec).RetrieveFiltered(ctx, "Patient", filter); err != nil {
+		t.Fatalf("RetrieveFiltered(Patient) returned unexpected error: %v", err)
+	}
+	if len(inner.filters) != 1 || inner.filters[0].CodeFilter != filter.CodeFilter {
+		t.Errorf("RetrieveFiltered() passed filters %v, want [%v]", inner.filters, filter)
+	}
+	labels := metrics.Labels{ResourceTypeLabel: "Patient"}
+	if got := rec.Counter(RetrieveCount, labels); got != 1 {
+		t.Errorf("Counter(%s) = %d, want 1", RetrieveCount, got)
+	}
+
+	// A retriever that does not support filters is called without one.
+	rec = metrics.NewInMemory()
+	got, err := New(fakeRetriever{}, rec).RetrieveFiltered(ctx, "Patient", filter)
+	if err != nil {
+		t.Fatalf("RetrieveFiltered(Patient) returned unexpected error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("RetrieveFiltered(Patient) returned %d resources, want 2", len(got))
+	}
+	if got := rec.Counter(RetrieveCount, labels); got != 1 {
+		t.Errorf("Counter(%s) = %d, want 1", RetrieveCount, got)
+	}
+}
+
+func patient(id string) *r4pb.ContainedResource {
+	return &r4pb.ContainedResource{
+		OneofResource: &r4pb.ContainedResource_Patient{
+			Patient: &r4patientpb.Patient{Id: &r4datapb.Id{Value: id}},
+		},
+	}
+}
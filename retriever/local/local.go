@@ -19,6 +19,7 @@ package local
 import (
 	"context"
 
+	"github.com/google/cql/internal/compression"
 	"github.com/google/cql/internal/resourcewrapper"
 	"github.com/google/fhir/go/fhirversion"
 	"github.com/google/fhir/go/jsonformat"
@@ -48,17 +49,25 @@ func NewRetrieverFromR4BundleProto(bundle *r4pb.Bundle) (*Retriever, error) {
 }
 
 // NewRetrieverFromR4Bundle initializes a local Retriever from a json R4 FHIR bundle of all the
-// patient's FHIR Resources.
+// patient's FHIR Resources. The bundle may be gzip or zstd compressed. It may also be a zip archive
+// of json bundles, in which case the resources of all bundles in the archive are loaded.
 func NewRetrieverFromR4Bundle(jsonBundle []byte) (*Retriever, error) {
 	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
 	if err != nil {
 		return nil, err
 	}
-	containedResource, err := unmarshaller.UnmarshalR4(jsonBundle)
+	files, err := compression.Decompress("bundle", jsonBundle)
 	if err != nil {
 		return nil, err
 	}
-	bundle := containedResource.GetBundle()
+	bundle := &r4pb.Bundle{}
+	for _, f := range files {
+		containedResource, err := unmarshaller.UnmarshalR4(f.Data)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Entry = append(bundle.Entry, containedResource.GetBundle().GetEntry()...)
+	}
 	return NewRetrieverFromR4BundleProto(bundle)
 }
 
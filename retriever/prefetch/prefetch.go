@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prefetch is an implementation of the Retriever Interface for the CQL engine that wraps
+// another retriever. All resource types named by a set of data requirements are fetched in parallel
+// up front, instead of one at a time as the interpreter reaches each retrieve.
+package prefetch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/cql/retriever"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// Retriever implements the Retriever Interface for the CQL engine.
+type Retriever struct {
+	retriever retriever.Retriever
+	resources map[string][]*r4pb.ContainedResource
+}
+
+// New fetches all resourceTypes from r in parallel and returns a Retriever that serves them from
+// memory. Retrieves for resource types that were not prefetched are passed through to r.
+func New(ctx context.Context, r retriever.Retriever, resourceTypes []string) (*Retriever, error) {
+	if r == nil {
+		return nil, fmt.Errorf("prefetch retriever requires a non-nil retriever")
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]*r4pb.ContainedResource, len(resourceTypes))
+	errs := make([]error, len(resourceTypes))
+	for i, rt := range resourceTypes {
+		wg.Add(1)
+		go func(i int, rt string) {
+			defer wg.Done()
+			results[i], errs[i] = r.Retrieve(ctx, rt)
+		}(i, rt)
+	}
+	wg.Wait()
+
+	p := &Retriever{retriever: r, resources: make(map[string][]*r4pb.ContainedResource, len(resourceTypes))}
+	for i, rt := range resourceTypes {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("failed to prefetch %s: %w", rt, errs[i])
+		}
+		p.resources[rt] = results[i]
+	}
+	return p, nil
+}
+
+// Retrieve returns all FHIR resources of type fhirResourceType for the patient.
+func (p *Retriever) Retrieve(ctx context.Context, fhirResourceType string) ([]*r4pb.ContainedResource, error) {
+	if resources, ok := p.resources[fhirResourceType]; ok {
+		return resources, nil
+	}
+	return p.retriever.Retrieve(ctx, fhirResourceType)
+}
+
+// RetrieveFiltered returns the FHIR resources of type fhirResourceType for the patient that match
+// the filter. Prefetched resource types are served from memory unfiltered, others are passed through
+// to the wrapped retriever, with the filter if it is a retriever.FilteredRetriever.
+func (p *Retriever) RetrieveFiltered(ctx context.Context, fhirResourceType string, filter retriever.Filter) ([]*r4pb.ContainedResource, error) {
+	if resources, ok := p.resources[fhirResourceType]; ok {
+		return resources, nil
+	}
+	if fr, ok := p.retriever.(retriever.FilteredRetriever); ok {
+		return fr.RetrieveFiltered(ctx, fhirResourceType, filter)
+	}
+	return p.retriever.Retrieve(ctx, fhirResourceType)
+}
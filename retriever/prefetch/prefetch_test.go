@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefetch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/google/cql/retriever"
+	r4datapb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	r4patientpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/patient_go_proto"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+type countingRetriever struct {
+	mu     sync.Mutex
+	calls  map[string]int
+	errFor string
+}
+
+func (c *countingRetriever) Retrieve(_ context.Context, resourceType string) ([]*r4pb.ContainedResource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[resourceType]++
+	if resourceType == c.errFor {
+		return nil, errors.New("retrieve failed")
+	}
+	if resourceType == "Patient" {
+		return []*r4pb.ContainedResource{patient("1")}, nil
+	}
+	return []*r4pb.ContainedResource{}, nil
+}
+
+func TestRetriever(t *testing.T) {
+	ctx := context.Background()
+	c := &countingRetriever{calls: map[string]int{}}
+	r, err := New(ctx, c, []string{"Patient", "Encounter"})
+	if err != nil {
+		t.Fatalf("New() returned unexpected error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		got, err := r.Retrieve(ctx, "Patient")
+		if err != nil {
+			t.Fatalf("Retrieve(Patient) returned unexpected error: %v", err)
+		}
+		if diff := cmp.Diff([]*r4pb.ContainedResource{patient("1")}, got, protocmp.Transform()); diff != "" {
+			t.Errorf("Retrieve(Patient) diff (-want +got):\n%s", diff)
+		}
+	}
+	if _, err := r.Retrieve(ctx, "Observation"); err != nil {
+		t.Fatalf("Retrieve(Observation) returned unexpected error: %v", err)
+	}
+
+	wantCalls := map[string]int{"Patient": 1, "Encounter": 1, "Observation": 1}
+	if diff := cmp.Diff(wantCalls, c.calls); diff != "" {
+		t.Errorf("underlying Retrieve calls diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRetriever_Error(t *testing.T) {
+	c := &countingRetriever{calls: map[string]int{}, errFor: "Encounter"}
+	if _, err := New(context.Background(), c, []string{"Patient", "Encounter"}); err == nil {
+		t.Errorf("New() succeeded, want error")
+	}
+}
+
+type filteredRetriever struct {
+	*countingRetriever
+	filters []retriever.Filter
+}
+
+func (f *filteredRetriever) RetrieveFiltered(ctx context.Context, resourceType string, filter retriever.Filter) ([]*r4pb.ContainedResource, error) {
+	f.filters = append(f.filters, filter)
+	return f.Retrieve(ctx, resourceType)
+}
+
+func TestRetriever_Filtered(t *testing.T) {
+	ctx := context.Background()
+	c := &filteredRetriever{countingRetriever: &countingRetriever{calls: map[string]int{}}}
+	r, err := New(ctx, c, []string{"Patient"})
+	if err != nil {
+		t.Fatalf("New() returned unexpected error: %v", err)
+	}
+	filter := retriever.Filter{DateFilter: &retriever.DateFilter{Property: "effective"}}
+
+	// Prefetched resource types are served from memory, the others are passed the filter.
+	if _, err := r.RetrieveFiltered(ctx, "Patient", filter); err != nil {
+		t.Fatalf("RetrieveFiltered(Patient) returned unexpected error: %v", err)
+	}
+	if _, err := r.RetrieveFiltered(ctx, "Observation", filter); err != nil {
+		t.Fatalf("RetrieveFiltered(Observation) returned unexpected error: %v", err)
+	}
+	wantCalls := map[string]int{"Patient": 1, "Observation": 1}
+	if diff := cmp.Diff(wantCalls, c.calls); diff != "" {
+		t.Errorf("underlying Retrieve calls diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]retriever.Filter{filter}, c.filters); diff != "" {
+		t.Errorf("underlying RetrieveFiltered filters diff (-want +got):\n%s", diff)
+	}
+}
+
+func patient(id string) *r4pb.ContainedResource {
+	return &r4pb.ContainedResource{
+		OneofResource: &r4pb.ContainedResource_Patient{
+			Patient: &r4patientpb.Patient{Id: &r4datapb.Id{Value: id}},
+		},
+	}
+}
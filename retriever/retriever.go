@@ -19,6 +19,7 @@ package retriever
 
 import (
 	"context"
+	"time"
 
 	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
 )
@@ -29,3 +30,57 @@ type Retriever interface {
 	// Retrieve returns all FHIR resources of type fhirResourceType for the patient.
 	Retrieve(ctx context.Context, fhirResourceType string) ([]*r4pb.ContainedResource, error)
 }
+
+// FilteredRetriever is a Retriever that can narrow the FHIR resources it returns, for example by
+// passing the filter to a remote FHIR server as search parameters. Implementations may ignore all
+// or part of the filter and return extra resources, but must not leave out any resource that
+// matches it. The CQL engine re-applies the CodeFilter to the returned resources, since it is the
+// code filter of the retrieve, including when the optimizer moved it there out of a where clause.
+// The DateFilter is not re-applied to the returned resources; the optimizer only sets it for date
+// constraints that it also leaves in the where clause of the query, which rechecks them.
+type FilteredRetriever interface {
+	Retriever
+	// RetrieveFiltered returns the FHIR resources of type fhirResourceType for the patient that match
+	// the filter.
+	RetrieveFiltered(ctx context.Context, fhirResourceType string, filter Filter) ([]*r4pb.ContainedResource, error)
+}
+
+// Filter describes the FHIR resources a retrieve needs. Fields that are nil do not filter.
+type Filter struct {
+	// CodeFilter is set if only resources with a code in a ValueSet are needed.
+	CodeFilter *CodeFilter
+	// DateFilter is set if only resources with a date in a range are needed.
+	DateFilter *DateFilter
+}
+
+// DataRequirement describes a set of FHIR resources that the CQL engine may request from a
+// Retriever while evaluating a set of CQL libraries. It is loosely modeled after the FHIR
+// DataRequirement type https://hl7.org/fhir/R4/metadatatypes.html#DataRequirement.
+type DataRequirement struct {
+	// ResourceType is the FHIR resource type that is retrieved, for example "Observation".
+	ResourceType string
+	// CodeFilter is set if the retrieve filters the resources by a code property, otherwise nil.
+	CodeFilter *CodeFilter
+	// DateFilter is set if the retrieve filters the resources by a date property, otherwise nil. Only
+	// the Property is set, since the date range is only known during evaluation.
+	DateFilter *DateFilter
+}
+
+// CodeFilter describes a code based filter applied to a retrieve.
+type CodeFilter struct {
+	// Property is the name of the code property on the FHIR resource, for example "code".
+	Property string
+	// ValueSetURL and ValueSetVersion identify the ValueSet used for filtering. They are empty if the
+	// filter does not reference a ValueSet.
+	ValueSetURL     string
+	ValueSetVersion string
+}
+
+// DateFilter describes a date based filter applied to a retrieve.
+type DateFilter struct {
+	// Property is the name of the date property on the FHIR resource, for example "effective".
+	Property string
+	// Start and End bound the range of dates; resources dated at or after Start and before End are
+	// needed. A zero Start or End leaves the range unbounded on that side.
+	Start, End time.Time
+}
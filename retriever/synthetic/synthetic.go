@@ -0,0 +1,180 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package synthetic generates synthetic FHIR patient bundles from the data requirements of CQL
+// libraries. The bundles contain no PHI, so they can be used to exercise CQL in tests and demos.
+package synthetic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/local"
+	"github.com/google/cql/terminology"
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// Generator produces a synthetic patient bundle that satisfies a set of data requirements. Users
+// can implement Generator to plug in their own synthetic data source, such as Synthea.
+type Generator interface {
+	// Generate returns a FHIR bundle for a single synthetic patient.
+	Generate(ctx context.Context, reqs []retriever.DataRequirement) (*r4pb.Bundle, error)
+}
+
+// Config configures the BasicGenerator.
+type Config struct {
+	// Terminology is used to expand the ValueSets referenced by code filters, so that generated
+	// resources contain a code from the ValueSet. It is required if any data requirement filters on
+	// a ValueSet.
+	Terminology terminology.Provider
+	// ResourcesPerRequirement is the number of resources generated for each data requirement. If
+	// zero, one resource is generated.
+	ResourcesPerRequirement int
+	// Seed seeds the random choices made by the generator. Generators with the same seed and inputs
+	// produce the same bundles.
+	Seed int64
+}
+
+// BasicGenerator is a small built-in Generator. It produces a Patient resource along with
+// ResourcesPerRequirement resources for each data requirement. When a requirement filters on a
+// ValueSet, the generated resource's code property is set to a randomly chosen code from the
+// ValueSet's expansion. No other fields are populated.
+type BasicGenerator struct {
+	cfg          Config
+	rand         *rand.Rand
+	unmarshaller *jsonformat.Unmarshaller
+	patients     int
+}
+
+// NewBasicGenerator returns a new BasicGenerator.
+func NewBasicGenerator(cfg Config) (*BasicGenerator, error) {
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ResourcesPerRequirement == 0 {
+		cfg.ResourcesPerRequirement = 1
+	}
+	return &BasicGenerator{
+		cfg:          cfg,
+		rand:         rand.New(rand.NewSource(cfg.Seed)),
+		unmarshaller: unmarshaller,
+	}, nil
+}
+
+// Generate returns a FHIR bundle for a single synthetic patient. Each call generates a new patient
+// with a unique id.
+func (g *BasicGenerator) Generate(ctx context.Context, reqs []retriever.DataRequirement) (*r4pb.Bundle, error) {
+	g.patients++
+	patientID := fmt.Sprintf("synthetic-%d", g.patients)
+
+	bundle := &r4pb.Bundle{}
+	patient, err := g.resource(map[string]any{
+		"resourceType": "Patient",
+		"id":           patientID,
+		"gender":       []string{"male", "female"}[g.rand.Intn(2)],
+		"birthDate":    g.birthDate().Format("2006-01-02"),
+	}, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Entry = append(bundle.Entry, &r4pb.Bundle_Entry{Resource: patient})
+
+	for i, req := range reqs {
+		if req.ResourceType == "Patient" {
+			continue
+		}
+		var codes []*terminology.Code
+		if req.CodeFilter != nil && req.CodeFilter.ValueSetURL != "" {
+			if g.cfg.Terminology == nil {
+				return nil, fmt.Errorf("a terminology provider is required to generate codes for ValueSet %s", req.CodeFilter.ValueSetURL)
+			}
+			codes, err = g.cfg.Terminology.ExpandValueSet(req.CodeFilter.ValueSetURL, req.CodeFilter.ValueSetVersion)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for j := 0; j < g.cfg.ResourcesPerRequirement; j++ {
+			fields := map[string]any{
+				"resourceType": req.ResourceType,
+				"id":           fmt.Sprintf("%s-%s-%d-%d", patientID, strings.ToLower(req.ResourceType), i, j),
+			}
+			var codeProperty string
+			var code *terminology.Code
+			if len(codes) > 0 {
+				codeProperty = req.CodeFilter.Property
+				code = codes[g.rand.Intn(len(codes))]
+			}
+			r, err := g.resource(fields, codeProperty, code)
+			if err != nil {
+				return nil, err
+			}
+			bundle.Entry = append(bundle.Entry, &r4pb.Bundle_Entry{Resource: r})
+		}
+	}
+	return bundle, nil
+}
+
+// resource builds a FHIR resource from the JSON fields. If codeProperty is set it is populated with
+// a CodeableConcept holding code. Since the cardinality of the code property is not known, a single
+// CodeableConcept is attempted first followed by a list of CodeableConcepts.
+func (g *BasicGenerator) resource(fields map[string]any, codeProperty string, code *terminology.Code) (*r4pb.ContainedResource, error) {
+	if codeProperty == "" {
+		return g.unmarshal(fields)
+	}
+	cc := map[string]any{
+		"coding": []map[string]string{{"system": code.System, "code": code.Code, "display": code.Display}},
+	}
+	fields[codeProperty] = cc
+	r, err := g.unmarshal(fields)
+	if err == nil {
+		return r, nil
+	}
+	fields[codeProperty] = []any{cc}
+	return g.unmarshal(fields)
+}
+
+func (g *BasicGenerator) unmarshal(fields map[string]any) (*r4pb.ContainedResource, error) {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.unmarshaller.UnmarshalR4(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate synthetic %v resource: %w", fields["resourceType"], err)
+	}
+	return r, nil
+}
+
+// birthDate returns a random birth date between 1940 and 2020.
+func (g *BasicGenerator) birthDate() time.Time {
+	start := time.Date(1940, 1, 1, 0, 0, 0, 0, time.UTC)
+	return start.AddDate(0, 0, g.rand.Intn(80*365))
+}
+
+// NewRetriever generates a synthetic patient with g and returns a local retriever for it.
+func NewRetriever(ctx context.Context, g Generator, reqs []retriever.DataRequirement) (*local.Retriever, error) {
+	bundle, err := g.Generate(ctx, reqs)
+	if err != nil {
+		return nil, err
+	}
+	return local.NewRetrieverFromR4BundleProto(bundle)
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package synthetic_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/cql"
+	"github.com/google/cql/result"
+	"github.com/google/cql/retriever"
+	"github.com/google/cql/retriever/synthetic"
+	"github.com/google/cql/terminology"
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+const glucoseValueSet = `{
+  "resourceType": "ValueSet",
+  "url": "https://example.com/vs/glucose",
+  "version": "1.0.0",
+  "expansion": {
+    "contains": [
+      {"system": "https://example.com/cs/diagnosis", "code": "gluc", "display": "Glucose In Blood"},
+      {"system": "https://example.com/cs/diagnosis", "code": "gluc2", "display": "Glucose In Serum"}
+    ]
+  }
+}`
+
+func TestBasicGenerator_SatisfiesLibrary(t *testing.T) {
+	ctx := context.Background()
+	fhirDM, fhirHelpers, err := cql.FHIRDataModelAndHelpersLib("4.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib := dedent.Dedent(`
+	library TESTLIB version '1.0.0'
+	using FHIR version '4.0.1'
+	include FHIRHelpers version '4.0.1'
+	valueset "Glucose": 'https://example.com/vs/glucose' version '1.0.0'
+	context Patient
+	define Observations: [Observation: "Glucose"]
+	define Conditions: [Condition: "Glucose"]
+	define PatientID: Patient.id`)
+	elm, err := cql.Parse(ctx, []string{lib, fhirHelpers}, cql.ParseConfig{DataModels: [][]byte{fhirDM}})
+	if err != nil {
+		t.Fatalf("Parse returned unexpected error: %v", err)
+	}
+	reqs, err := elm.DataRequirements()
+	if err != nil {
+		t.Fatalf("DataRequirements returned unexpected error: %v", err)
+	}
+	tp, err := terminology.NewInMemoryFHIRProvider([]string{glucoseValueSet})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider returned unexpected error: %v", err)
+	}
+	g, err := synthetic.NewBasicGenerator(synthetic.Config{Terminology: tp, ResourcesPerRequirement: 2})
+	if err != nil {
+		t.Fatalf("NewBasicGenerator returned unexpected error: %v", err)
+	}
+	r, err := synthetic.NewRetriever(ctx, g, reqs)
+	if err != nil {
+		t.Fatalf("NewRetriever returned unexpected error: %v", err)
+	}
+
+	res, err := elm.Eval(ctx, r, cql.EvalConfig{Terminology: tp})
+	if err != nil {
+		t.Fatalf("Eval returned unexpected error: %v", err)
+	}
+	defs := res[result.LibKey{Name: "TESTLIB", Version: "1.0.0"}]
+	for _, name := range []string{"Observations", "Conditions"} {
+		l, err := result.ToSlice(defs[name])
+		if err != nil {
+			t.Fatalf("ToSlice(%s) returned unexpected error: %v", name, err)
+		}
+		if len(l) != 2 {
+			t.Errorf("%s returned %d resources, want 2", name, len(l))
+		}
+	}
+	if result.IsNull(defs["PatientID"]) {
+		t.Errorf("PatientID is null, want a synthetic patient")
+	}
+}
+
+func TestBasicGenerator_Deterministic(t *testing.T) {
+	ctx := context.Background()
+	tp, err := terminology.NewInMemoryFHIRProvider([]string{glucoseValueSet})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider returned unexpected error: %v", err)
+	}
+	reqs := []retriever.DataRequirement{
+		{ResourceType: "Condition", CodeFilter: &retriever.CodeFilter{Property: "code", ValueSetURL: "https://example.com/vs/glucose"}},
+	}
+	cfg := synthetic.Config{Terminology: tp, ResourcesPerRequirement: 5, Seed: 7}
+	g1, err := synthetic.NewBasicGenerator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := synthetic.NewBasicGenerator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, err := g1.Generate(ctx, reqs)
+	if err != nil {
+		t.Fatalf("Generate returned unexpected error: %v", err)
+	}
+	b2, err := g2.Generate(ctx, reqs)
+	if err != nil {
+		t.Fatalf("Generate returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(b1, b2, protocmp.Transform()); diff != "" {
+		t.Errorf("Generate with the same seed diff (-first +second):\n%s", diff)
+	}
+	if len(b1.GetEntry()) != 6 {
+		t.Errorf("Generate returned %d entries, want 6", len(b1.GetEntry()))
+	}
+}
+
+func TestBasicGenerator_Errors(t *testing.T) {
+	reqs := []retriever.DataRequirement{
+		{ResourceType: "Condition", CodeFilter: &retriever.CodeFilter{Property: "code", ValueSetURL: "https://example.com/vs/glucose"}},
+	}
+	g, err := synthetic.NewBasicGenerator(synthetic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.Generate(context.Background(), reqs)
+	if err == nil || !strings.Contains(err.Error(), "a terminology provider is required") {
+		t.Errorf("Generate() returned error %v, want error containing %q", err, "a terminology provider is required")
+	}
+}
+
+func TestBasicGenerator_ListCodeProperty(t *testing.T) {
+	tp, err := terminology.NewInMemoryFHIRProvider([]string{glucoseValueSet})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider returned unexpected error: %v", err)
+	}
+	g, err := synthetic.NewBasicGenerator(synthetic.Config{Terminology: tp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Encounter.type is a list of CodeableConcepts.
+	reqs := []retriever.DataRequirement{
+		{ResourceType: "Encounter", CodeFilter: &retriever.CodeFilter{Property: "type", ValueSetURL: "https://example.com/vs/glucose"}},
+	}
+	b, err := g.Generate(context.Background(), reqs)
+	if err != nil {
+		t.Fatalf("Generate returned unexpected error: %v", err)
+	}
+	if got := len(b.GetEntry()[1].GetResource().GetEncounter().GetType()); got != 1 {
+		t.Errorf("Generate returned an Encounter with %d types, want 1", got)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cql
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/google/cql/internal/modelinfo"
+	"github.com/google/cql/model"
+	"github.com/google/cql/result"
+	"github.com/google/cql/types"
+)
+
+func init() {
+	// The parsed ELM holds model and types structs in interface fields, so every concrete type must
+	// be registered with gob.
+	for _, v := range []any{
+		&model.Library{},
+		&model.Element{},
+		&model.ValuesetDef{},
+		&model.CodeSystemDef{},
+		&model.ConceptDef{},
+		&model.CodeDef{},
+		&model.ParameterDef{},
+		&model.LibraryIdentifier{},
+		&model.Using{},
+		&model.Include{},
+		&model.Statements{},
+		&model.ExpressionDef{},
+		&model.FunctionDef{},
+		&model.OperandDef{},
+		&model.Expression{},
+		&model.Literal{},
+		&model.Interval{},
+		&model.Quantity{},
+		&model.Ratio{},
+		&model.List{},
+		&model.Code{},
+		&model.Tuple{},
+		&model.TupleElement{},
+		&model.Instance{},
+		&model.InstanceElement{},
+		&model.Message{},
+		&model.Query{},
+		&model.LetClause{},
+		&model.RelationshipClause{},
+		&model.With{},
+		&model.Without{},
+		&model.SortClause{},
+		&model.AggregateClause{},
+		&model.ReturnClause{},
+		&model.SortByItem{},
+		&model.SortByDirection{},
+		&model.SortByColumn{},
+		&model.SortByExpression{},
+		&model.AliasedSource{},
+		&model.Property{},
+		&model.Retrieve{},
+		&model.Case{},
+		&model.CaseItem{},
+		&model.IfThenElse{},
+		&model.MaxValue{},
+		&model.MinValue{},
+		&model.UnaryExpression{},
+		&model.As{},
+		&model.Is{},
+		&model.Exp{},
+		&model.Negate{},
+		&model.Truncate{},
+		&model.Exists{},
+		&model.Not{},
+		&model.First{},
+		&model.Last{},
+		&model.Distinct{},
+		&model.Abs{},
+		&model.Ceiling{},
+		&model.Floor{},
+		&model.Ln{},
+		&model.Precision{},
+		&model.SingletonFrom{},
+		&model.Start{},
+		&model.End{},
+		&model.Predecessor{},
+		&model.Successor{},
+		&model.IsNull{},
+		&model.IsFalse{},
+		&model.IsTrue{},
+		&model.ToBoolean{},
+		&model.ToDateTime{},
+		&model.ToDate{},
+		&model.ToDecimal{},
+		&model.ToLong{},
+		&model.ToInteger{},
+		&model.ToQuantity{},
+		&model.ToConcept{},
+		&model.ToString{},
+		&model.ToTime{},
+		&model.AllTrue{},
+		&model.AnyTrue{},
+		&model.Avg{},
+		&model.Count{},
+		&model.Length{},
+		&model.Max{},
+		&model.Min{},
+		&model.Sum{},
+		&model.Median{},
+		&model.PopulationStdDev{},
+		&model.CalculateAge{},
+		&model.BinaryExpression{},
+		&model.CanConvertQuantity{},
+		&model.Equal{},
+		&model.Equivalent{},
+		&model.Less{},
+		&model.Greater{},
+		&model.LessOrEqual{},
+		&model.GreaterOrEqual{},
+		&model.And{},
+		&model.Or{},
+		&model.XOr{},
+		&model.Implies{},
+		&model.Add{},
+		&model.Subtract{},
+		&model.Multiply{},
+		&model.Divide{},
+		&model.Modulo{},
+		&model.Power{},
+		&model.Log{},
+		&model.TruncatedDivide{},
+		&model.Except{},
+		&model.Intersect{},
+		&model.Union{},
+		&model.Split{},
+		&model.Indexer{},
+		&model.IndexOf{},
+		&model.BinaryExpressionWithPrecision{},
+		&model.Before{},
+		&model.After{},
+		&model.SameOrBefore{},
+		&model.SameOrAfter{},
+		&model.DifferenceBetween{},
+		&model.In{},
+		&model.IncludedIn{},
+		&model.Contains{},
+		&model.CalculateAgeAt{},
+		&model.Overlaps{},
+		&model.InCodeSystem{},
+		&model.InValueSet{},
+		&model.Subsumes{},
+		&model.SubsumedBy{},
+		&model.NaryExpression{},
+		&model.Coalesce{},
+		&model.Concatenate{},
+		&model.Combine{},
+		&model.Date{},
+		&model.DateTime{},
+		&model.Now{},
+		&model.Round{},
+		&model.Translate{},
+		&model.TimeOfDay{},
+		&model.Time{},
+		&model.Today{},
+		&model.ParameterRef{},
+		&model.ValuesetRef{},
+		&model.CodeSystemRef{},
+		&model.ConceptRef{},
+		&model.CodeRef{},
+		&model.ExpressionRef{},
+		&model.AliasRef{},
+		&model.QueryLetRef{},
+		&model.FunctionRef{},
+		&model.OperandRef{},
+		&model.IdentifierRef{},
+	} {
+		gob.Register(v)
+	}
+	for _, v := range []any{
+		types.System(""),
+		&types.Named{},
+		&types.Interval{},
+		&types.List{},
+		&types.Choice{},
+		&types.Tuple{},
+	} {
+		gob.Register(v)
+	}
+}
+
+// encodedELM is the gob encoding of ELM. The data model info is kept as the original xml, which is
+// cheap to parse compared to CQL.
+type encodedELM struct {
+	DataModels [][]byte
+	Params     map[result.DefKey]model.IExpression
+	Libs       []*model.Library
+}
+
+// MarshalBinary encodes the parsed CQL, so that it can be parsed once and then shipped to other
+// processes, such as the workers of a distributed pipeline, which decode it with UnmarshalBinary.
+// The source locations used by EvalConfig.Debug are not encoded, so debug traces of decoded ELM
+// are not keyed by location.
+func (e *ELM) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := encodedELM{DataModels: e.dataModelXML, Params: e.parsedParams, Libs: e.parsedLibs}
+	if err := gob.NewEncoder(&buf).Encode(enc); err != nil {
+		return nil, fmt.Errorf("failed to encode ELM: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes parsed CQL encoded by MarshalBinary, replacing the contents of e.
+func (e *ELM) UnmarshalBinary(data []byte) error {
+	var enc encodedELM
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&enc); err != nil {
+		return fmt.Errorf("failed to decode ELM: %w", err)
+	}
+	mi, err := modelinfo.New(enc.DataModels)
+	if err != nil {
+		return err
+	}
+	*e = ELM{
+		dataModels:   mi,
+		dataModelXML: enc.DataModels,
+		parsedParams: enc.Params,
+		parsedLibs:   enc.Libs,
+	}
+	return nil
+}
+
+// LibrariesJSON returns the ELM styled JSON of each parsed CQL library, keyed by library. Unnamed
+// libraries are keyed by result.UnnamedLibKey. See model.MarshalLibraryJSON for the format.
+func (e *ELM) LibrariesJSON() (map[result.LibKey][]byte, error) {
+	libs := make(map[result.LibKey][]byte, len(e.parsedLibs))
+	for _, lib := range e.parsedLibs {
+		key := result.UnnamedLibKey()
+		if lib.Identifier != nil {
+			key = result.LibKeyFromModel(lib.Identifier)
+		}
+		b, err := model.MarshalLibraryJSON(lib)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode library %s as JSON: %w", key, err)
+		}
+		libs[key] = b
+	}
+	return libs, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DiskCache is a persistent cache of terminology resources shared by remote terminology providers
+// such as the VSACProvider. Entries are stored as files in a directory, content-addressed by the
+// resource URL and version, so repeated runs of a pipeline do not need to contact the remote
+// service and can run offline once the cache is populated. DiskCache is safe for concurrent use,
+// including by multiple processes sharing the same directory.
+type DiskCache struct {
+	dir string
+	ttl time.Duration
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// cacheFileSuffix is the suffix of all files written by the DiskCache.
+const cacheFileSuffix = ".cache.json"
+
+// NewDiskCache returns a DiskCache storing entries in dir, which is created if it does not exist.
+// Entries older than ttl are considered expired. A ttl of zero means entries never expire.
+func NewDiskCache(dir string, ttl time.Duration) (*DiskCache, error) {
+	if dir == "" {
+		return nil, errors.New("a terminology cache directory is required")
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("terminology cache TTL must not be negative, got %v", ttl)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create terminology cache directory %s: %w", dir, err)
+	}
+	return &DiskCache{dir: dir, ttl: ttl, now: time.Now}, nil
+}
+
+// Get returns the cached data for the resource url and version. The second return value is false
+// if there is no entry or the entry has expired.
+func (c *DiskCache) Get(url, version string) ([]byte, bool) {
+	b, modTime, ok := c.read(url, version)
+	if !ok || c.expired(modTime) {
+		return nil, false
+	}
+	return b, true
+}
+
+// GetStale returns the cached data for the resource url and version even if the entry has
+// expired. Remote providers use it to keep working offline when the remote service is unreachable.
+func (c *DiskCache) GetStale(url, version string) ([]byte, bool) {
+	b, _, ok := c.read(url, version)
+	return b, ok
+}
+
+// Put stores data for the resource url and version, replacing any existing entry and resetting its
+// TTL.
+func (c *DiskCache) Put(url, version string, data []byte) error {
+	// Write to a temporary file and rename so concurrent readers never observe a partial entry.
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write terminology cache entry for {%s, %s}: %w", url, version, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write terminology cache entry for {%s, %s}: %w", url, version, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write terminology cache entry for {%s, %s}: %w", url, version, err)
+	}
+	if err := os.Rename(tmp.Name(), c.path(url, version)); err != nil {
+		return fmt.Errorf("failed to write terminology cache entry for {%s, %s}: %w", url, version, err)
+	}
+	return nil
+}
+
+// Invalidate removes the entry for the resource url and version. It is not an error if there is no
+// such entry.
+func (c *DiskCache) Invalidate(url, version string) error {
+	if err := os.Remove(c.path(url, version)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to invalidate terminology cache entry for {%s, %s}: %w", url, version, err)
+	}
+	return nil
+}
+
+// Clear removes all entries from the cache.
+func (c *DiskCache) Clear() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to clear terminology cache %s: %w", c.dir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), cacheFileSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to clear terminology cache %s: %w", c.dir, err)
+		}
+	}
+	return nil
+}
+
+func (c *DiskCache) read(url, version string) ([]byte, time.Time, bool) {
+	p := c.path(url, version)
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return b, info.ModTime(), true
+}
+
+func (c *DiskCache) expired(modTime time.Time) bool {
+	return c.ttl != 0 && c.now().Sub(modTime) > c.ttl
+}
+
+// path returns the file path of the entry for the resource url and version.
+func (c *DiskCache) path(url, version string) string {
+	h := sha256.Sum256([]byte(url + "|" + version))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:])+cacheFileSuffix)
+}
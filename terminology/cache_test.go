@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewDiskCache() returned unexpected error: %v", err)
+	}
+
+	if _, ok := c.Get("https://example.com/vs", "1.0.0"); ok {
+		t.Errorf("Get() on an empty cache returned an entry")
+	}
+	if err := c.Put("https://example.com/vs", "1.0.0", []byte("v1")); err != nil {
+		t.Fatalf("Put() returned unexpected error: %v", err)
+	}
+	if err := c.Put("https://example.com/vs", "2.0.0", []byte("v2")); err != nil {
+		t.Fatalf("Put() returned unexpected error: %v", err)
+	}
+	if got, ok := c.Get("https://example.com/vs", "1.0.0"); !ok || string(got) != "v1" {
+		t.Errorf("Get(1.0.0) = %q, %v want %q, true", got, ok, "v1")
+	}
+	if got, ok := c.Get("https://example.com/vs", "2.0.0"); !ok || string(got) != "v2" {
+		t.Errorf("Get(2.0.0) = %q, %v want %q, true", got, ok, "v2")
+	}
+
+	// The cache is persistent, so a new cache on the same directory sees the entries.
+	c2, err := NewDiskCache(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewDiskCache() returned unexpected error: %v", err)
+	}
+	if _, ok := c2.Get("https://example.com/vs", "1.0.0"); !ok {
+		t.Errorf("Get() on a new cache for the same directory did not return the entry")
+	}
+
+	if err := c.Invalidate("https://example.com/vs", "1.0.0"); err != nil {
+		t.Fatalf("Invalidate() returned unexpected error: %v", err)
+	}
+	if _, ok := c.Get("https://example.com/vs", "1.0.0"); ok {
+		t.Errorf("Get() after Invalidate() returned an entry")
+	}
+	if err := c.Invalidate("https://example.com/vs", "1.0.0"); err != nil {
+		t.Errorf("Invalidate() of a missing entry returned unexpected error: %v", err)
+	}
+
+	if err := c.Clear(); err != nil {
+		t.Fatalf("Clear() returned unexpected error: %v", err)
+	}
+	if _, ok := c.GetStale("https://example.com/vs", "2.0.0"); ok {
+		t.Errorf("GetStale() after Clear() returned an entry")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("os.ReadDir() returned unexpected error: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("cache directory has %d entries after Clear(), want 0", len(entries))
+	}
+}
+
+func TestDiskCache_TTL(t *testing.T) {
+	c, err := NewDiskCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("NewDiskCache() returned unexpected error: %v", err)
+	}
+	if err := c.Put("https://example.com/vs", "", []byte("v")); err != nil {
+		t.Fatalf("Put() returned unexpected error: %v", err)
+	}
+
+	c.now = func() time.Time { return time.Now().Add(30 * time.Minute) }
+	if _, ok := c.Get("https://example.com/vs", ""); !ok {
+		t.Errorf("Get() before the TTL did not return the entry")
+	}
+
+	c.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, ok := c.Get("https://example.com/vs", ""); ok {
+		t.Errorf("Get() after the TTL returned an expired entry")
+	}
+	if got, ok := c.GetStale("https://example.com/vs", ""); !ok || string(got) != "v" {
+		t.Errorf("GetStale() after the TTL = %q, %v want %q, true", got, ok, "v")
+	}
+
+	c.ttl = 0
+	if _, ok := c.Get("https://example.com/vs", ""); !ok {
+		t.Errorf("Get() with no TTL did not return the entry")
+	}
+}
+
+func TestNewDiskCache_Errors(t *testing.T) {
+	if _, err := NewDiskCache("", time.Hour); err == nil {
+		t.Errorf("NewDiskCache() with no directory succeeded, want error")
+	}
+	if _, err := NewDiskCache(t.TempDir(), -time.Hour); err == nil {
+		t.Errorf("NewDiskCache() with a negative TTL succeeded, want error")
+	}
+}
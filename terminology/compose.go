@@ -0,0 +1,240 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"fmt"
+	"strings"
+)
+
+// compose is the FHIR ValueSet.compose element, which defines an intensional ValueSet.
+// https://hl7.org/fhir/R4/valueset-definitions.html#ValueSet.compose
+type compose struct {
+	Include []*composeRule `json:"include"`
+	Exclude []*composeRule `json:"exclude"`
+}
+
+// composeRule is a single include or exclude rule. Within a rule the codes selected by the system,
+// concepts and filters are intersected with the codes of every referenced ValueSet.
+type composeRule struct {
+	System   string           `json:"system"`
+	Version  string           `json:"version"`
+	Concept  []*Code          `json:"concept"`
+	Filter   []*composeFilter `json:"filter"`
+	ValueSet []string         `json:"valueSet"`
+}
+
+type composeFilter struct {
+	Property string `json:"property"`
+	Op       string `json:"op"`
+	Value    string `json:"value"`
+}
+
+// expandComposedValueSets expands all loaded ValueSets that were defined by compose rules instead
+// of an expansion. ValueSets that can not be expanded, for example because a CodeSystem is not
+// loaded, return the error when they are used.
+func (l *LocalFHIRProvider) expandComposedValueSets() {
+	for k, vs := range l.valueSets {
+		if vs.Compose == nil {
+			continue
+		}
+		codes, err := l.expandCompose(vs, map[resourceKey]bool{})
+		if err != nil {
+			vs.expansionErr = fmt.Errorf("could not expand ValueSet{%s, %s}: %w", vs.URL, vs.Version, err)
+		} else {
+			vs.Expansion = expansion{Codes: codes}
+			for _, c := range codes {
+				vs.CodeMap[c.key()] = c
+			}
+		}
+		l.valueSets[k] = vs
+		if latest, ok := l.latestValuesets[k.URL]; ok && latest.Version == k.Version {
+			l.latestValuesets[k.URL] = vs
+		}
+	}
+}
+
+// expandCompose returns the codes selected by the ValueSet's compose rules. visiting holds the
+// ValueSets currently being expanded, to detect cycles between ValueSets that include each other.
+func (l *LocalFHIRProvider) expandCompose(vs fhirValueSet, visiting map[resourceKey]bool) ([]*Code, error) {
+	if visiting[vs.key()] {
+		return nil, fmt.Errorf("ValueSet{%s, %s} includes itself", vs.URL, vs.Version)
+	}
+	visiting[vs.key()] = true
+	defer delete(visiting, vs.key())
+
+	var codes []*Code
+	seen := make(map[codeKey]bool)
+	for _, rule := range vs.Compose.Include {
+		ruleCodes, err := l.ruleCodes(rule, visiting)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range ruleCodes {
+			if !seen[c.key()] {
+				seen[c.key()] = true
+				codes = append(codes, c)
+			}
+		}
+	}
+
+	excluded := make(map[codeKey]bool)
+	for _, rule := range vs.Compose.Exclude {
+		ruleCodes, err := l.ruleCodes(rule, visiting)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range ruleCodes {
+			excluded[c.key()] = true
+		}
+	}
+	if len(excluded) == 0 {
+		return codes, nil
+	}
+	var included []*Code
+	for _, c := range codes {
+		if !excluded[c.key()] {
+			included = append(included, c)
+		}
+	}
+	return included, nil
+}
+
+// ruleCodes returns the codes selected by a single include or exclude rule.
+func (l *LocalFHIRProvider) ruleCodes(rule *composeRule, visiting map[resourceKey]bool) ([]*Code, error) {
+	if rule.System == "" && len(rule.ValueSet) == 0 {
+		return nil, fmt.Errorf("compose rule must have a system or a valueSet")
+	}
+
+	var codes []*Code
+	if rule.System != "" {
+		var err error
+		codes, err = l.systemCodes(rule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, canonical := range rule.ValueSet {
+		url, version, _ := strings.Cut(canonical, "|")
+		vs, ok := l.valueSets[resourceKey{url, version}]
+		if version == "" {
+			vs, ok = l.latestValuesets[url]
+		}
+		if !ok {
+			return nil, fmt.Errorf("could not find included ValueSet{%s, %s} %w", url, version, ErrResourceNotLoaded)
+		}
+		vsCodes := vs.codes()
+		if vs.Compose != nil {
+			var err error
+			if vsCodes, err = l.expandCompose(vs, visiting); err != nil {
+				return nil, err
+			}
+		}
+		if rule.System == "" && i == 0 {
+			codes = vsCodes
+			continue
+		}
+		codes = intersectCodes(codes, vsCodes)
+	}
+	return codes, nil
+}
+
+// systemCodes returns the codes of the rule's CodeSystem selected by the rule's concepts and
+// filters. Listed concepts do not require the CodeSystem to be loaded, all other rules do.
+func (l *LocalFHIRProvider) systemCodes(rule *composeRule) ([]*Code, error) {
+	if len(rule.Concept) > 0 && len(rule.Filter) == 0 {
+		cs, csErr := l.findCodeSystem(rule.System, rule.Version)
+		codes := make([]*Code, 0, len(rule.Concept))
+		for _, c := range rule.Concept {
+			code := &Code{System: rule.System, Code: c.Code, Display: c.Display}
+			if csErr == nil && code.Display == "" {
+				if csCode := cs.code(code.key()); csCode != nil {
+					code.Display = csCode.Display
+				}
+			}
+			codes = append(codes, code)
+		}
+		return codes, nil
+	}
+
+	cs, err := l.findCodeSystem(rule.System, rule.Version)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool, len(rule.Concept))
+	for _, c := range rule.Concept {
+		listed[c.Code] = true
+	}
+	var codes []*Code
+	for _, c := range cs.codes() {
+		if len(listed) > 0 && !listed[c.Code] {
+			continue
+		}
+		match := true
+		for _, f := range rule.Filter {
+			ok, err := cs.matches(c.Code, f)
+			if err != nil {
+				return nil, err
+			}
+			match = match && ok
+		}
+		if match {
+			codes = append(codes, &Code{System: rule.System, Code: c.Code, Display: c.Display})
+		}
+	}
+	return codes, nil
+}
+
+// matches returns true if the code satisfies the compose filter. Only hierarchy filters on the
+// concept property are supported.
+func (f *fhirCodeSystem) matches(code string, filter *composeFilter) (bool, error) {
+	if filter.Property != "concept" {
+		return false, fmt.Errorf("compose filter on property %q: %w", filter.Property, ErrUnsupported)
+	}
+	switch filter.Op {
+	case "is-a":
+		return f.subsumes(filter.Value, code), nil
+	case "descendent-of":
+		return code != filter.Value && f.subsumes(filter.Value, code), nil
+	case "is-not-a":
+		return !f.subsumes(filter.Value, code), nil
+	case "=":
+		return code == filter.Value, nil
+	case "in":
+		for _, v := range strings.Split(filter.Value, ",") {
+			if strings.TrimSpace(v) == code {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("compose filter op %q: %w", filter.Op, ErrUnsupported)
+}
+
+// intersectCodes returns the codes in a that are also in b, in the order of a.
+func intersectCodes(a, b []*Code) []*Code {
+	inB := make(map[codeKey]bool, len(b))
+	for _, c := range b {
+		inB[c.key()] = true
+	}
+	var codes []*Code
+	for _, c := range a {
+		if inB[c.key()] {
+			codes = append(codes, c)
+		}
+	}
+	return codes
+}
@@ -0,0 +1,268 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/cql/terminology"
+	"github.com/google/go-cmp/cmp"
+)
+
+var composeJSONResources = []string{`
+			{
+				"resourceType": "CodeSystem",
+				"url": "https://test/conditions",
+				"version": "1.0.0",
+				"concept": [
+					{
+						"code": "disease",
+						"display": "Disease",
+						"concept": [
+							{
+								"code": "infection",
+								"display": "Infection",
+								"concept": [
+									{ "code": "flu", "display": "Flu" },
+									{ "code": "cold", "display": "Cold" }
+								]
+							},
+							{ "code": "diabetes", "display": "Diabetes" }
+						]
+					}
+				]
+			}
+	`,
+	`
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs/explicit",
+				"version": "1.0.0",
+				"compose": {
+					"include": [
+						{
+							"system": "https://test/conditions",
+							"concept": [{ "code": "flu" }, { "code": "diabetes", "display": "Sugar" }]
+						},
+						{
+							"system": "https://test/unloaded",
+							"concept": [{ "code": "abc", "display": "ABC" }]
+						}
+					]
+				}
+			}
+	`,
+	`
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs/infections",
+				"version": "1.0.0",
+				"compose": {
+					"include": [
+						{
+							"system": "https://test/conditions",
+							"filter": [{ "property": "concept", "op": "is-a", "value": "infection" }]
+						}
+					]
+				}
+			}
+	`,
+	`
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs/infections-no-cold",
+				"version": "1.0.0",
+				"compose": {
+					"include": [{ "valueSet": ["https://test/vs/infections|1.0.0"] }],
+					"exclude": [{ "system": "https://test/conditions", "concept": [{ "code": "cold" }] }]
+				}
+			}
+	`,
+	`
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs/descendants",
+				"version": "1.0.0",
+				"compose": {
+					"include": [
+						{
+							"system": "https://test/conditions",
+							"filter": [{ "property": "concept", "op": "descendent-of", "value": "disease" }]
+						}
+					],
+					"exclude": [{ "valueSet": ["https://test/vs/infections"] }]
+				}
+			}
+	`,
+	`
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs/intersection",
+				"version": "1.0.0",
+				"compose": {
+					"include": [
+						{
+							"system": "https://test/conditions",
+							"concept": [{ "code": "flu" }, { "code": "diabetes" }],
+							"valueSet": ["https://test/vs/infections"]
+						}
+					]
+				}
+			}
+	`,
+	`
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs/missing-codesystem",
+				"version": "1.0.0",
+				"compose": {
+					"include": [
+						{
+							"system": "https://test/unloaded",
+							"filter": [{ "property": "concept", "op": "is-a", "value": "abc" }]
+						}
+					]
+				}
+			}
+	`,
+	`
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs/cycle",
+				"version": "1.0.0",
+				"compose": {
+					"include": [{ "valueSet": ["https://test/vs/cycle"] }]
+				}
+			}
+	`,
+	`
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs/unsupported-filter",
+				"version": "1.0.0",
+				"compose": {
+					"include": [
+						{
+							"system": "https://test/conditions",
+							"filter": [{ "property": "status", "op": "=", "value": "active" }]
+						}
+					]
+				}
+			}
+	`,
+}
+
+func TestInMemoryFHIR_ExpandComposedValueSet(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider(composeJSONResources)
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	cases := []struct {
+		name string
+		URL  string
+		want []*terminology.Code
+	}{
+		{
+			name: "Explicit concepts",
+			URL:  "https://test/vs/explicit",
+			want: []*terminology.Code{
+				{System: "https://test/conditions", Code: "flu", Display: "Flu"},
+				{System: "https://test/conditions", Code: "diabetes", Display: "Sugar"},
+				{System: "https://test/unloaded", Code: "abc", Display: "ABC"},
+			},
+		},
+		{
+			name: "is-a filter",
+			URL:  "https://test/vs/infections",
+			want: []*terminology.Code{
+				{System: "https://test/conditions", Code: "infection", Display: "Infection"},
+				{System: "https://test/conditions", Code: "flu", Display: "Flu"},
+				{System: "https://test/conditions", Code: "cold", Display: "Cold"},
+			},
+		},
+		{
+			name: "Included ValueSet with excluded concept",
+			URL:  "https://test/vs/infections-no-cold",
+			want: []*terminology.Code{
+				{System: "https://test/conditions", Code: "infection", Display: "Infection"},
+				{System: "https://test/conditions", Code: "flu", Display: "Flu"},
+			},
+		},
+		{
+			name: "descendent-of filter with excluded ValueSet",
+			URL:  "https://test/vs/descendants",
+			want: []*terminology.Code{
+				{System: "https://test/conditions", Code: "diabetes", Display: "Diabetes"},
+			},
+		},
+		{
+			name: "Concepts intersected with ValueSet",
+			URL:  "https://test/vs/intersection",
+			want: []*terminology.Code{
+				{System: "https://test/conditions", Code: "flu", Display: "Flu"},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := imf.ExpandValueSet(tc.URL, "")
+			if err != nil {
+				t.Fatalf("ExpandValueSet(%v) unexpected error: %v", tc.URL, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ExpandValueSet(%v) diff (-want +got):\n%s", tc.URL, diff)
+			}
+		})
+	}
+
+	in, err := imf.AnyInValueSet([]terminology.Code{{System: "https://test/conditions", Code: "cold"}}, "https://test/vs/infections", "1.0.0")
+	if err != nil {
+		t.Fatalf("AnyInValueSet() unexpected error: %v", err)
+	}
+	if !in {
+		t.Errorf("AnyInValueSet() for a composed ValueSet = false, want true")
+	}
+}
+
+func TestInMemoryFHIR_ExpandComposedValueSetError(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider(composeJSONResources)
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	cases := []struct {
+		name    string
+		URL     string
+		wantErr error
+	}{
+		{name: "Missing CodeSystem", URL: "https://test/vs/missing-codesystem", wantErr: terminology.ErrResourceNotLoaded},
+		{name: "Unsupported filter", URL: "https://test/vs/unsupported-filter", wantErr: terminology.ErrUnsupported},
+		{name: "Cycle", URL: "https://test/vs/cycle"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := imf.ExpandValueSet(tc.URL, "")
+			if err == nil {
+				t.Fatalf("ExpandValueSet(%v) succeeded, want error", tc.URL)
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("ExpandValueSet(%v) unexpected error. got: %v, want: %v", tc.URL, err, tc.wantErr)
+			}
+			if _, err := imf.AnyInValueSet(nil, tc.URL, ""); err == nil {
+				t.Errorf("AnyInValueSet(%v) succeeded, want error", tc.URL)
+			}
+		})
+	}
+}
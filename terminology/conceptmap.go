@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import "fmt"
+
+// conceptMapGroup is a group of mappings from a source CodeSystem to a target CodeSystem.
+type conceptMapGroup struct {
+	Source  string               `json:"source"`
+	Target  string               `json:"target"`
+	Element []*conceptMapElement `json:"element"`
+}
+
+type conceptMapElement struct {
+	Code    string              `json:"code"`
+	Display string              `json:"display"`
+	Target  []*conceptMapTarget `json:"target"`
+}
+
+type conceptMapTarget struct {
+	Code        string `json:"code"`
+	Display     string `json:"display"`
+	Equivalence string `json:"equivalence"`
+}
+
+type fhirConceptMap struct {
+	URL     string
+	Version string
+	// translations maps each source code to the codes it translates to.
+	translations map[codeKey][]*Translation
+}
+
+func buildFHIRConceptMap(fr fhirResource) fhirConceptMap {
+	cm := fhirConceptMap{
+		URL:          fr.URL,
+		Version:      fr.Version,
+		translations: make(map[codeKey][]*Translation),
+	}
+	for _, g := range fr.Group {
+		for _, e := range g.Element {
+			k := codeKey{Value: e.Code, System: g.Source}
+			for _, t := range e.Target {
+				// Unmatched and disjoint targets record that there is no mapping.
+				if t.Equivalence == "unmatched" || t.Equivalence == "disjoint" {
+					continue
+				}
+				cm.translations[k] = append(cm.translations[k], &Translation{
+					Code:        &Code{System: g.Target, Code: t.Code, Display: t.Display},
+					Equivalence: t.Equivalence,
+				})
+			}
+		}
+	}
+	return cm
+}
+
+func (l *LocalFHIRProvider) addConceptMap(fr *fhirResource) {
+	cm := buildFHIRConceptMap(*fr)
+	l.conceptMaps[fr.key()] = cm
+
+	latest, ok := l.latestConceptMaps[fr.URL]
+	if !ok || fr.Version > latest.Version {
+		l.latestConceptMaps[fr.URL] = cm
+	}
+}
+
+// Translate maps the code to codes in other CodeSystems using the specified ConceptMap. If the
+// conceptMapVersion is an empty string, this will use the 'latest' ConceptMap version based on a
+// simple version string comparison. If targetSystem is not empty only translations into that
+// CodeSystem are returned. A code with no mappings returns no translations.
+func (l *LocalFHIRProvider) Translate(conceptMapURL, conceptMapVersion string, code Code, targetSystem string) ([]*Translation, error) {
+	if l == nil {
+		return nil, ErrNotInitialized
+	}
+	var cm fhirConceptMap
+	var ok bool
+	if conceptMapVersion == "" {
+		cm, ok = l.latestConceptMaps[conceptMapURL]
+	} else {
+		cm, ok = l.conceptMaps[resourceKey{conceptMapURL, conceptMapVersion}]
+	}
+	if !ok {
+		return nil, fmt.Errorf("could not find ConceptMap{%s, %s} %w", conceptMapURL, conceptMapVersion, ErrResourceNotLoaded)
+	}
+
+	var translations []*Translation
+	for _, t := range cm.translations[code.key()] {
+		if targetSystem != "" && t.Code.System != targetSystem {
+			continue
+		}
+		translations = append(translations, t)
+	}
+	return translations, nil
+}
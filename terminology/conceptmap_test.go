@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/cql/terminology"
+	"github.com/google/go-cmp/cmp"
+)
+
+var conceptMapJSONResources = []string{`
+			{
+				"resourceType": "ConceptMap",
+				"url": "https://test/cm",
+				"version": "1.0.0",
+				"group": [
+					{
+						"source": "https://test/local",
+						"target": "http://loinc.org",
+						"element": [
+							{ "code": "glu", "target": [{ "code": "2345-7", "display": "Glucose", "equivalence": "equivalent" }] },
+							{ "code": "hba1c", "target": [{ "code": "4548-4", "equivalence": "wider" }, { "code": "x", "equivalence": "disjoint" }] },
+							{ "code": "none", "target": [{ "equivalence": "unmatched" }] }
+						]
+					},
+					{
+						"source": "https://test/local",
+						"target": "http://snomed.info/sct",
+						"element": [
+							{ "code": "glu", "target": [{ "code": "33747003", "equivalence": "equivalent" }] }
+						]
+					}
+				]
+			}
+	`, `
+			{
+				"resourceType": "ConceptMap",
+				"url": "https://test/cm",
+				"version": "0.9.0",
+				"group": [
+					{
+						"source": "https://test/local",
+						"target": "http://loinc.org",
+						"element": [{ "code": "glu", "target": [{ "code": "old", "equivalence": "equivalent" }] }]
+					}
+				]
+			}
+	`,
+}
+
+func TestInMemoryFHIR_Translate(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider(conceptMapJSONResources)
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	cases := []struct {
+		name         string
+		version      string
+		code         terminology.Code
+		targetSystem string
+		want         []*terminology.Translation
+	}{
+		{
+			name: "All targets of latest version",
+			code: terminology.Code{System: "https://test/local", Code: "glu"},
+			want: []*terminology.Translation{
+				{Code: &terminology.Code{System: "http://loinc.org", Code: "2345-7", Display: "Glucose"}, Equivalence: "equivalent"},
+				{Code: &terminology.Code{System: "http://snomed.info/sct", Code: "33747003"}, Equivalence: "equivalent"},
+			},
+		},
+		{
+			name:         "Target system",
+			code:         terminology.Code{System: "https://test/local", Code: "glu"},
+			targetSystem: "http://snomed.info/sct",
+			want: []*terminology.Translation{
+				{Code: &terminology.Code{System: "http://snomed.info/sct", Code: "33747003"}, Equivalence: "equivalent"},
+			},
+		},
+		{
+			name:    "Specific version",
+			version: "0.9.0",
+			code:    terminology.Code{System: "https://test/local", Code: "glu"},
+			want: []*terminology.Translation{
+				{Code: &terminology.Code{System: "http://loinc.org", Code: "old"}, Equivalence: "equivalent"},
+			},
+		},
+		{
+			name: "Disjoint targets are skipped",
+			code: terminology.Code{System: "https://test/local", Code: "hba1c"},
+			want: []*terminology.Translation{
+				{Code: &terminology.Code{System: "http://loinc.org", Code: "4548-4"}, Equivalence: "wider"},
+			},
+		},
+		{
+			name: "Unmatched code",
+			code: terminology.Code{System: "https://test/local", Code: "none"},
+		},
+		{
+			name: "Code from another system",
+			code: terminology.Code{System: "https://test/other", Code: "glu"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := imf.Translate("https://test/cm", tc.version, tc.code, tc.targetSystem)
+			if err != nil {
+				t.Fatalf("Translate() unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Translate() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := imf.Translate("https://test/missing", "", terminology.Code{}, ""); !errors.Is(err, terminology.ErrResourceNotLoaded) {
+		t.Errorf("Translate() for a missing ConceptMap got unexpected error. got: %v, want: %v", err, terminology.ErrResourceNotLoaded)
+	}
+	var nilProvider *terminology.LocalFHIRProvider
+	if _, err := nilProvider.Translate("https://test/cm", "", terminology.Code{}, ""); !errors.Is(err, terminology.ErrNotInitialized) {
+		t.Errorf("Translate() on nil provider got unexpected error. got: %v, want: %v", err, terminology.ErrNotInitialized)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ExpandConfig configures FetchExpandedValueSet.
+type ExpandConfig struct {
+	// BaseURL is the base URL of the FHIR terminology server.
+	BaseURL string
+	// HTTPClient is used to make requests to the terminology server. If nil http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+	// PageSize is the number of codes requested per $expand call. If zero DefaultVSACPageSize is
+	// used.
+	PageSize int
+	// MaxResponseBytes limits the size of each response read from the server. If zero responses are
+	// not limited.
+	MaxResponseBytes int64
+}
+
+// FetchExpandedValueSet returns the JSON of the ValueSet expanded by the ValueSet/$expand operation
+// of a FHIR terminology server, paging through large expansions. The url and version of the
+// returned ValueSet are set to valueSetURL and valueSetVersion, so that the JSON can be loaded by a
+// LocalFHIRProvider and matched against the ValueSet declarations in CQL.
+func FetchExpandedValueSet(ctx context.Context, cfg ExpandConfig, valueSetURL, valueSetVersion string) ([]byte, error) {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.PageSize <= 0 {
+		cfg.PageSize = DefaultVSACPageSize
+	}
+	p := expansionPager{
+		server:   "the terminology server",
+		pageSize: cfg.PageSize,
+		pageURL: func(offset int) string {
+			params := url.Values{}
+			params.Set("url", valueSetURL)
+			if valueSetVersion != "" {
+				params.Set("valueSetVersion", valueSetVersion)
+			}
+			params.Set("offset", strconv.Itoa(offset))
+			params.Set("count", strconv.Itoa(cfg.PageSize))
+			return strings.TrimSuffix(cfg.BaseURL, "/") + "/ValueSet/$expand?" + params.Encode()
+		},
+		get: func(reqURL string) ([]byte, int, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+			req.Header.Set("Accept", "application/fhir+json")
+			resp, err := cfg.HTTPClient.Do(req)
+			if err != nil {
+				return nil, 0, err
+			}
+			defer resp.Body.Close()
+			var body io.Reader = resp.Body
+			if cfg.MaxResponseBytes > 0 {
+				body = io.LimitReader(resp.Body, cfg.MaxResponseBytes)
+			}
+			b, err := io.ReadAll(body)
+			if err != nil {
+				return nil, 0, err
+			}
+			return b, resp.StatusCode, nil
+		},
+	}
+
+	var vs map[string]any
+	var codes []*Code
+	err := p.expand(valueSetURL, valueSetVersion, func(first map[string]any, page []*Code) {
+		if vs == nil {
+			vs = first
+		}
+		codes = append(codes, page...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	combineExpansion(vs, codes)
+	vs["url"] = valueSetURL
+	if valueSetVersion != "" {
+		vs["version"] = valueSetVersion
+	}
+	return json.Marshal(vs)
+}
+
+// expansionPage is a page of a $expand response.
+type expansionPage struct {
+	ResourceType string `json:"resourceType"`
+	Expansion    struct {
+		Total    *int    `json:"total"`
+		Contains []*Code `json:"contains"`
+	} `json:"expansion"`
+}
+
+// expansionPager pages through the $expand operation of a terminology server.
+type expansionPager struct {
+	// server names the terminology server in errors.
+	server   string
+	pageSize int
+	// pageURL returns the URL of the page of the expansion starting at offset.
+	pageURL func(offset int) string
+	// get makes a GET request and returns the response body and status code.
+	get func(reqURL string) ([]byte, int, error)
+}
+
+// expand pages through the expansion of the ValueSet, calling page with the codes of each page as
+// they arrive. The first argument to page is the decoded first page of the expansion, which holds
+// the ValueSet metadata. Paging stops once expansion.total codes have been returned, or if total is
+// not set, once a page is not full. It also stops if a page starts with the same code as the
+// previous one, since the server then ignores the offset and would return the same page forever.
+func (p expansionPager) expand(valueSetURL, valueSetVersion string, page func(first map[string]any, codes []*Code)) error {
+	var first map[string]any
+	var prevFirstCode *Code
+	for offset := 0; ; {
+		body, status, err := p.get(p.pageURL(offset))
+		if err != nil {
+			return fmt.Errorf("%s request for ValueSet{%s, %s} failed: %w", p.server, valueSetURL, valueSetVersion, err)
+		}
+		switch {
+		case status == http.StatusNotFound:
+			return fmt.Errorf("could not find ValueSet{%s, %s} in %s %w", valueSetURL, valueSetVersion, p.server, ErrResourceNotLoaded)
+		case status != http.StatusOK:
+			return fmt.Errorf("%s returned status %d %s for ValueSet{%s, %s}: %s", p.server, status, http.StatusText(status), valueSetURL, valueSetVersion, body)
+		}
+
+		var ep expansionPage
+		if err := json.Unmarshal(body, &ep); err != nil {
+			return fmt.Errorf("failed to parse %s response for ValueSet{%s, %s}: %w", p.server, valueSetURL, valueSetVersion, err)
+		}
+		if ep.ResourceType != valueSet {
+			return fmt.Errorf("%s response for ValueSet{%s, %s} has resourceType %v %w", p.server, valueSetURL, valueSetVersion, ep.ResourceType, ErrIncorrectResourceType)
+		}
+		if first == nil {
+			if err := json.Unmarshal(body, &first); err != nil {
+				return fmt.Errorf("failed to parse %s response for ValueSet{%s, %s}: %w", p.server, valueSetURL, valueSetVersion, err)
+			}
+		}
+		codes := ep.Expansion.Contains
+		if len(codes) > 0 && prevFirstCode != nil && *codes[0] == *prevFirstCode {
+			return nil
+		}
+		page(first, codes)
+
+		n := len(codes)
+		offset += n
+		switch {
+		case n == 0:
+			return nil
+		case ep.Expansion.Total != nil && offset >= *ep.Expansion.Total:
+			return nil
+		case ep.Expansion.Total == nil && n != p.pageSize:
+			// Without a total a short page is the last one. A page larger than requested means the
+			// server does not support paging and returned the whole expansion.
+			return nil
+		}
+		prevFirstCode = codes[0]
+	}
+}
+
+// combineExpansion replaces the expansion of the first page of a ValueSet expansion with all of the
+// codes of its pages.
+func combineExpansion(vs map[string]any, codes []*Code) {
+	exp, ok := vs["expansion"].(map[string]any)
+	if !ok {
+		exp = make(map[string]any)
+		vs["expansion"] = exp
+	}
+	delete(exp, "offset")
+	delete(exp, "parameter")
+	exp["total"] = len(codes)
+	exp["contains"] = codes
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFetchExpandedValueSet(t *testing.T) {
+	codes := []string{"1", "2", "3"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if req.URL.Path != "/ValueSet/$expand" || q.Get("url") != "urn:oid:1.2.3" || q.Get("valueSetVersion") != "v1" {
+			http.NotFound(w, req)
+			return
+		}
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		count, _ := strconv.Atoi(q.Get("count"))
+		end := min(offset+count, len(codes))
+		var contains []map[string]string
+		for _, c := range codes[offset:end] {
+			contains = append(contains, map[string]string{"system": "https://test/cs", "code": c})
+		}
+		b, _ := json.Marshal(contains)
+		fmt.Fprintf(w, `{"resourceType": "ValueSet", "url": "https://test/vs", "expansion": {"total": %d, "offset": %d, "contains": %s}}`, len(codes), offset, b)
+	}))
+	defer server.Close()
+
+	b, err := FetchExpandedValueSet(context.Background(), ExpandConfig{BaseURL: server.URL + "/", PageSize: 2}, "urn:oid:1.2.3", "v1")
+	if err != nil {
+		t.Fatalf("FetchExpandedValueSet() returned unexpected error: %v", err)
+	}
+	p, err := NewInMemoryFHIRProvider([]string{string(b)})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() returned unexpected error: %v", err)
+	}
+	got, err := p.ExpandValueSet("urn:oid:1.2.3", "v1")
+	if err != nil {
+		t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+	}
+	want := []*Code{{System: "https://test/cs", Code: "1"}, {System: "https://test/cs", Code: "2"}, {System: "https://test/cs", Code: "3"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ExpandValueSet() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFetchExpandedValueSet_NotFound(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := FetchExpandedValueSet(context.Background(), ExpandConfig{BaseURL: server.URL}, "urn:oid:1.2.3", "")
+	if !errors.Is(err, ErrResourceNotLoaded) {
+		t.Errorf("FetchExpandedValueSet() returned error %v, want ErrResourceNotLoaded", err)
+	}
+}
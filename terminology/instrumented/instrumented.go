@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package instrumented is an implementation of the terminology Provider interface that wraps
+// another provider and reports per operation call counts and latencies to a metrics.Recorder. It
+// can also log terminology calls that exceed a latency threshold, to help diagnose CQL that is slow
+// because of terminology.
+package instrumented
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/cql/metrics"
+	"github.com/google/cql/terminology"
+)
+
+// Names of the metrics reported by the Provider. All metrics are labeled with the OperationLabel
+// and URLLabel.
+const (
+	// CallCount counts the calls to the terminology provider.
+	CallCount = "cql_terminology_call_count"
+	// CallErrorCount counts the calls to the terminology provider that returned an error.
+	CallErrorCount = "cql_terminology_call_error_count"
+	// CallLatencyMillis is the distribution of the latency of each call to the terminology provider.
+	CallLatencyMillis = "cql_terminology_call_latency_ms"
+	// ExpandedCodes is the distribution of the number of codes returned by each ValueSet expansion.
+	ExpandedCodes = "cql_terminology_expanded_codes"
+
+	// OperationLabel is the label holding the terminology operation, for example ExpandValueSet.
+	OperationLabel = "operation"
+	// URLLabel is the label holding the url of the ValueSet, CodeSystem or ConceptMap the operation
+	// was performed on.
+	URLLabel = "url"
+)
+
+// Config configures the instrumented Provider.
+type Config struct {
+	// SlowCallThreshold if set causes calls that take at least this long to be logged.
+	SlowCallThreshold time.Duration
+	// Logf logs slow calls. If nil, log.Printf is used.
+	Logf func(format string, args ...any)
+}
+
+// Provider implements the terminology Provider interface.
+type Provider struct {
+	provider terminology.Provider
+	recorder metrics.Recorder
+	cfg      Config
+}
+
+// New returns a Provider that reports metrics for every call to p to the recorder. The recorder can
+// be nil if only slow call logging is needed.
+func New(p terminology.Provider, recorder metrics.Recorder, cfg Config) *Provider {
+	if recorder == nil {
+		recorder = metrics.Nop{}
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = log.Printf
+	}
+	return &Provider{provider: p, recorder: recorder, cfg: cfg}
+}
+
+// AnyInCodeSystem returns true if any code is contained within the specified CodeSystem.
+func (p *Provider) AnyInCodeSystem(codes []terminology.Code, codeSystemURL, codeSystemVersion string) (bool, error) {
+	start := time.Now()
+	in, err := p.provider.AnyInCodeSystem(codes, codeSystemURL, codeSystemVersion)
+	p.record("AnyInCodeSystem", codeSystemURL, codeSystemVersion, start, err)
+	return in, err
+}
+
+// AnyInValueSet returns true if any code is contained within the specified ValueSet.
+func (p *Provider) AnyInValueSet(codes []terminology.Code, valueSetURL, valueSetVersion string) (bool, error) {
+	start := time.Now()
+	in, err := p.provider.AnyInValueSet(codes, valueSetURL, valueSetVersion)
+	p.record("AnyInValueSet", valueSetURL, valueSetVersion, start, err)
+	return in, err
+}
+
+// AnyInValueSetBatch returns, for each list of codes, whether any of its codes is contained within
+// the specified ValueSet.
+func (p *Provider) AnyInValueSetBatch(codeSets [][]terminology.Code, valueSetURL, valueSetVersion string) ([]bool, error) {
+	start := time.Now()
+	in, err := p.provider.AnyInValueSetBatch(codeSets, valueSetURL, valueSetVersion)
+	p.record("AnyInValueSetBatch", valueSetURL, valueSetVersion, start, err)
+	return in, err
+}
+
+// ExpandValueSet returns the expanded codes for the provided ValueSet.
+func (p *Provider) ExpandValueSet(valueSetURL, valueSetVersion string) ([]*terminology.Code, error) {
+	start := time.Now()
+	codes, err := p.provider.ExpandValueSet(valueSetURL, valueSetVersion)
+	p.record("ExpandValueSet", valueSetURL, valueSetVersion, start, err)
+	if err == nil {
+		p.recorder.Observe(ExpandedCodes, labels("ExpandValueSet", valueSetURL), float64(len(codes)))
+	}
+	return codes, err
+}
+
+// Subsumes returns true if the ancestorCode subsumes the descendantCode.
+func (p *Provider) Subsumes(codeSystemURL, ancestorCode, descendantCode string) (bool, error) {
+	start := time.Now()
+	subsumes, err := p.provider.Subsumes(codeSystemURL, ancestorCode, descendantCode)
+	p.record("Subsumes", codeSystemURL, "", start, err)
+	return subsumes, err
+}
+
+// Lookup returns the display and designations of the code.
+func (p *Provider) Lookup(codeSystemURL, code string) (*terminology.CodeDetails, error) {
+	start := time.Now()
+	details, err := p.provider.Lookup(codeSystemURL, code)
+	p.record("Lookup", codeSystemURL, "", start, err)
+	return details, err
+}
+
+// Translate maps the code using the ConceptMap.
+func (p *Provider) Translate(conceptMapURL, conceptMapVersion string, code terminology.Code, targetSystem string) ([]*terminology.Translation, error) {
+	start := time.Now()
+	translations, err := p.provider.Translate(conceptMapURL, conceptMapVersion, code, targetSystem)
+	p.record("Translate", conceptMapURL, conceptMapVersion, start, err)
+	return translations, err
+}
+
+func (p *Provider) record(operation, url, version string, start time.Time, err error) {
+	latency := time.Since(start)
+	l := labels(operation, url)
+	p.recorder.Count(CallCount, l, 1)
+	p.recorder.Observe(CallLatencyMillis, l, float64(latency.Microseconds())/1000)
+	if err != nil {
+		p.recorder.Count(CallErrorCount, l, 1)
+	}
+	if p.cfg.SlowCallThreshold > 0 && latency >= p.cfg.SlowCallThreshold {
+		p.cfg.Logf("slow terminology call: %s{%s, %s} took %v", operation, url, version, latency)
+	}
+}
+
+func labels(operation, url string) metrics.Labels {
+	return metrics.Labels{OperationLabel: operation, URLLabel: url}
+}
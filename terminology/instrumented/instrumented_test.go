@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package instrumented
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/cql/metrics"
+	"github.com/google/cql/terminology"
+)
+
+// fakeProvider expands every ValueSet to two codes after delay, and fails for every CodeSystem.
+type fakeProvider struct {
+	terminology.Provider
+	delay time.Duration
+}
+
+func (p fakeProvider) ExpandValueSet(string, string) ([]*terminology.Code, error) {
+	time.Sleep(p.delay)
+	return []*terminology.Code{{System: "s", Code: "1"}, {System: "s", Code: "2"}}, nil
+}
+
+func (p fakeProvider) AnyInValueSet([]terminology.Code, string, string) (bool, error) {
+	return true, nil
+}
+
+func (p fakeProvider) AnyInCodeSystem([]terminology.Code, string, string) (bool, error) {
+	return false, errors.New("lookup failed")
+}
+
+func TestProvider(t *testing.T) {
+	rec := metrics.NewInMemory()
+	p := New(fakeProvider{}, rec, Config{})
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.ExpandValueSet("https://test/vs", ""); err != nil {
+			t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+		}
+	}
+	if _, err := p.AnyInValueSet(nil, "https://test/vs", ""); err != nil {
+		t.Fatalf("AnyInValueSet() returned unexpected error: %v", err)
+	}
+	if _, err := p.AnyInCodeSystem(nil, "https://test/cs", ""); err == nil {
+		t.Fatalf("AnyInCodeSystem() succeeded, want error")
+	}
+
+	expandLabels := metrics.Labels{OperationLabel: "ExpandValueSet", URLLabel: "https://test/vs"}
+	inVSLabels := metrics.Labels{OperationLabel: "AnyInValueSet", URLLabel: "https://test/vs"}
+	inCSLabels := metrics.Labels{OperationLabel: "AnyInCodeSystem", URLLabel: "https://test/cs"}
+	counters := []struct {
+		name   string
+		labels metrics.Labels
+		want   int64
+	}{
+		{CallCount, expandLabels, 2},
+		{CallErrorCount, expandLabels, 0},
+		{CallCount, inVSLabels, 1},
+		{CallCount, inCSLabels, 1},
+		{CallErrorCount, inCSLabels, 1},
+	}
+	for _, c := range counters {
+		if got := rec.Counter(c.name, c.labels); got != c.want {
+			t.Errorf("Counter(%s, %v) = %d, want %d", c.name, c.labels, got, c.want)
+		}
+	}
+	if got := rec.Distribution(ExpandedCodes, expandLabels); got.Count != 2 || got.Max != 2 {
+		t.Errorf("Distribution(%s) = %+v, want Count 2 and Max 2", ExpandedCodes, got)
+	}
+	if got := rec.Distribution(CallLatencyMillis, inCSLabels); got.Count != 1 {
+		t.Errorf("Distribution(%s) = %+v, want Count 1", CallLatencyMillis, got)
+	}
+}
+
+func TestProvider_SlowCallLogging(t *testing.T) {
+	var logged []string
+	logf := func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) }
+	p := New(fakeProvider{delay: 5 * time.Millisecond}, nil, Config{SlowCallThreshold: time.Millisecond, Logf: logf})
+
+	if _, err := p.ExpandValueSet("https://test/vs", "1.0.0"); err != nil {
+		t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+	}
+	if _, err := p.AnyInValueSet(nil, "https://test/vs", "1.0.0"); err != nil {
+		t.Fatalf("AnyInValueSet() returned unexpected error: %v", err)
+	}
+	if len(logged) != 1 {
+		t.Fatalf("got %d slow call logs %v, want 1", len(logged), logged)
+	}
+	if want := "slow terminology call: ExpandValueSet{https://test/vs, 1.0.0} took"; !strings.HasPrefix(logged[0], want) {
+		t.Errorf("slow call log = %q, want prefix %q", logged[0], want)
+	}
+}
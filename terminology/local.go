@@ -16,6 +16,7 @@
 package terminology
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,6 +24,7 @@ import (
 	"os"
 
 	"path/filepath"
+	"sort"
 	"strings"
 
 )
@@ -34,6 +36,10 @@ var (
 	ErrIncorrectResourceType = errors.New("incorrect resource type")
 	// ErrNotInitialized indicates the terminology provider was not initialized.
 	ErrNotInitialized = errors.New("terminology provider not initialized, so no terminology operations can be performed")
+	// ErrCodeNotFound indicates the code was not found in the terminology.
+	ErrCodeNotFound = errors.New("code not found")
+	// ErrUnsupported indicates the terminology operation is not supported by the provider.
+	ErrUnsupported = errors.New("operation not supported by this terminology provider")
 )
 
 const (
@@ -41,11 +47,16 @@ const (
 	codeSystem string = "CodeSystem"
 	// valueSet is the fhir string resourceType for a ValueSet
 	valueSet string = "ValueSet"
+	// conceptMap is the fhir string resourceType for a ConceptMap.
+	conceptMap string = "ConceptMap"
+	// bundle is the fhir string resourceType for a Bundle.
+	bundle string = "Bundle"
 )
 
 // NewLocalFHIRProvider returns a new Local FHIR terminology provider initialized with the input
-// directory. If multiple ValueSets in the directory have the same ID and Version, the last one seen
-// by the LocalFHIR provider will be the one loaded for use.
+// directory. The directory may hold CodeSystem and ValueSet JSON files, FHIR Bundles of them, and
+// FHIR IG packages (.tgz). If multiple ValueSets in the directory have the same ID and Version, the
+// last one seen by the LocalFHIR provider will be the one loaded for use.
 // TODO(b/297090333): support loading only certain ValueSets into memory, and FHIR versions if needed.
 func NewLocalFHIRProvider(dir string) (*LocalFHIRProvider, error) {
 	files, err := os.ReadDir(dir)
@@ -53,66 +64,93 @@ func NewLocalFHIRProvider(dir string) (*LocalFHIRProvider, error) {
 		return nil, err
 	}
 
-	lf := &LocalFHIRProvider{
-		codeSystems:       make(map[resourceKey]fhirCodeSystem),
-		valueSets:         make(map[resourceKey]fhirValueSet),
-		latestCodeSystems: make(map[string]fhirCodeSystem),
-		latestValuesets:   make(map[string]fhirValueSet),
-	}
-
+	lf := newLocalFHIRProvider()
 	for _, file := range files {
-		// Skip non-JSON files, such as BUILD files, READMEs, or sub directories.
-		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+		// Skip files that are not JSON or packages, such as BUILD files, READMEs, or sub directories.
+		if file.IsDir() || (!strings.HasSuffix(file.Name(), ".json") && !IsFHIRPackage(file.Name())) {
 			continue
 		}
 
-		f, err := os.Open(filepath.Join(dir, file.Name()))
+		b, err := os.ReadFile(filepath.Join(dir, file.Name()))
 		if err != nil {
 			return nil, err
 		}
-		defer f.Close() // Possible returned error on read is ignored, since it'll be superseeded by the decodeFHIRResource error.
-		fr, err := decodeFHIRResource(f)
-		if err != nil {
-			return nil, err
+		if IsFHIRPackage(file.Name()) {
+			jsons, err := ReadFHIRPackage(bytes.NewReader(b))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read FHIR package %s: %w", file.Name(), err)
+			}
+			for _, j := range jsons {
+				if err := lf.addResources([]byte(j)); err != nil {
+					return nil, fmt.Errorf("failed to load FHIR package %s: %w", file.Name(), err)
+				}
+			}
+			continue
 		}
-
-		switch fr.ResourceType {
-		case codeSystem:
-			lf.addCodeSystem(fr)
-		case valueSet:
-			lf.addValueSet(fr)
+		if err := lf.addResources(b); err != nil {
+			return nil, err
 		}
 	}
 
+	lf.expandComposedValueSets()
+	lf.indexDisplays()
 	return lf, nil
 }
 
 // NewInMemoryFHIRProvider returns a new Local FHIR terminology provider initialized with the JSON
-// resources. If multiple ValueSets in the directory have the same ID and Version, the last one seen
-// by the LocalFHIR provider will be the one loaded for use.
+// resources, which may be CodeSystems, ValueSets or FHIR Bundles of them. If multiple ValueSets in
+// the directory have the same ID and Version, the last one seen by the LocalFHIR provider will be
+// the one loaded for use.
 func NewInMemoryFHIRProvider(jsons []string) (*LocalFHIRProvider, error) {
-	lf := &LocalFHIRProvider{
+	lf := newLocalFHIRProvider()
+	for _, json := range jsons {
+		if err := lf.addResources([]byte(json)); err != nil {
+			return nil, err
+		}
+	}
+
+	lf.expandComposedValueSets()
+	lf.indexDisplays()
+	return lf, nil
+}
+
+func newLocalFHIRProvider() *LocalFHIRProvider {
+	return &LocalFHIRProvider{
 		codeSystems:       make(map[resourceKey]fhirCodeSystem),
 		valueSets:         make(map[resourceKey]fhirValueSet),
+		conceptMaps:       make(map[resourceKey]fhirConceptMap),
 		latestCodeSystems: make(map[string]fhirCodeSystem),
 		latestValuesets:   make(map[string]fhirValueSet),
+		latestConceptMaps: make(map[string]fhirConceptMap),
 	}
+}
 
-	for _, json := range jsons {
-		fr, err := decodeFHIRResource(strings.NewReader(json))
-		if err != nil {
-			return nil, err
-		}
+// addResources adds the CodeSystem or ValueSet in the JSON. If the JSON is a Bundle, every
+// CodeSystem and ValueSet in the Bundle is added. All other resources are ignored.
+func (l *LocalFHIRProvider) addResources(b []byte) error {
+	fr, err := decodeFHIRResource(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
 
-		switch fr.ResourceType {
-		case codeSystem:
-			lf.addCodeSystem(fr)
-		case valueSet:
-			lf.addValueSet(fr)
+	switch fr.ResourceType {
+	case codeSystem:
+		l.addCodeSystem(fr)
+	case valueSet:
+		l.addValueSet(fr)
+	case conceptMap:
+		l.addConceptMap(fr)
+	case bundle:
+		for _, e := range fr.Entry {
+			if len(e.Resource) == 0 {
+				continue
+			}
+			if err := l.addResources(e.Resource); err != nil {
+				return err
+			}
 		}
 	}
-
-	return lf, nil
+	return nil
 }
 
 func (l *LocalFHIRProvider) addCodeSystem(fr *fhirResource) {
@@ -143,8 +181,13 @@ func (l *LocalFHIRProvider) addValueSet(fr *fhirResource) {
 type LocalFHIRProvider struct {
 	codeSystems       map[resourceKey]fhirCodeSystem
 	valueSets         map[resourceKey]fhirValueSet
+	conceptMaps       map[resourceKey]fhirConceptMap
 	latestCodeSystems map[string]fhirCodeSystem
 	latestValuesets   map[string]fhirValueSet
+	latestConceptMaps map[string]fhirConceptMap
+	// displays holds the displays of codes in ValueSet expansions, used by Lookup for codes whose
+	// CodeSystem is not loaded.
+	displays map[codeKey]string
 }
 
 type resourceKey struct {
@@ -179,6 +222,9 @@ func (l *LocalFHIRProvider) findValueSet(valueSetURL, valueSetVersion string) (f
 	if !ok {
 		return fhirValueSet{}, fmt.Errorf("could not find ValueSet{%s, %s} %w", valueSetURL, valueSetVersion, ErrResourceNotLoaded)
 	}
+	if vs.expansionErr != nil {
+		return fhirValueSet{}, vs.expansionErr
+	}
 	return vs, nil
 }
 
@@ -201,14 +247,23 @@ func (l *LocalFHIRProvider) AnyInValueSet(codes []Code, valuesetURL, valuesetVer
 		return false, err
 	}
 
-	for _, c := range codes {
-		foundCode := r.code(c.key())
-		if foundCode != nil {
-			return true, nil
+	return r.containsAny(codes), nil
+}
+
+// AnyInValueSetBatch returns, for each list of codes, whether any of its codes is contained within
+// the specified ValueSet. The ValueSet is resolved as in AnyInValueSet.
+func (l *LocalFHIRProvider) AnyInValueSetBatch(codeSets [][]Code, valuesetURL, valuesetVersion string) ([]bool, error) {
+	if l == nil {
+		return nil, ErrNotInitialized
+	}
+	r, err := l.findValueSet(valuesetURL, valuesetVersion)
+	if err != nil {
+		if _, err := l.findCodeSystem(valuesetURL, valuesetVersion); err == nil {
+			return nil, fmt.Errorf("could not find ValueSet{%s, %s} found CodeSystem instead. %w", valuesetURL, valuesetVersion, ErrIncorrectResourceType)
 		}
+		return nil, err
 	}
-
-	return false, nil
+	return r.containsAnyBatch(codeSets), nil
 }
 
 // AnyInCodeSystem returns true if any code is contained within the specified CodeSystem, otherwise
@@ -256,6 +311,71 @@ func (l *LocalFHIRProvider) ExpandValueSet(valueSetURL, valueSetVersion string)
 	return r.codes(), nil
 }
 
+// Subsumes returns true if the ancestorCode subsumes the descendantCode in the is-a hierarchy of
+// the latest loaded version of the CodeSystem, which is the case if the codes are equal or the
+// ancestorCode is a transitive parent of the descendantCode. Returns false if either code is not in
+// the CodeSystem.
+// https://hl7.org/fhir/R4/codesystem-operation-subsumes.html
+func (l *LocalFHIRProvider) Subsumes(codeSystemURL, ancestorCode, descendantCode string) (bool, error) {
+	if l == nil {
+		return false, ErrNotInitialized
+	}
+
+	cs, err := l.findCodeSystem(codeSystemURL, "")
+	if err != nil {
+		return false, err
+	}
+	if cs.code(codeKey{Value: ancestorCode, System: codeSystemURL}) == nil ||
+		cs.code(codeKey{Value: descendantCode, System: codeSystemURL}) == nil {
+		return false, nil
+	}
+	return cs.subsumes(ancestorCode, descendantCode), nil
+}
+
+// Lookup returns the display and designations of the code from the latest loaded version of the
+// CodeSystem. If the CodeSystem is not loaded, the display is taken from any loaded ValueSet
+// expansion containing the code.
+func (l *LocalFHIRProvider) Lookup(codeSystemURL, code string) (*CodeDetails, error) {
+	if l == nil {
+		return nil, ErrNotInitialized
+	}
+
+	key := codeKey{Value: code, System: codeSystemURL}
+	if cs, err := l.findCodeSystem(codeSystemURL, ""); err == nil {
+		if c := cs.code(key); c != nil {
+			return &CodeDetails{Code: code, System: codeSystemURL, Display: c.Display, Designations: cs.designations[code]}, nil
+		}
+	}
+	if display, ok := l.displays[key]; ok {
+		return &CodeDetails{Code: code, System: codeSystemURL, Display: display}, nil
+	}
+	return nil, fmt.Errorf("could not find code %s in CodeSystem %s %w", code, codeSystemURL, ErrCodeNotFound)
+}
+
+// indexDisplays indexes the displays of all codes in ValueSet expansions. ValueSets are visited in
+// order so that the display chosen for a code is deterministic.
+func (l *LocalFHIRProvider) indexDisplays() {
+	keys := make([]resourceKey, 0, len(l.valueSets))
+	for k := range l.valueSets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].URL != keys[j].URL {
+			return keys[i].URL < keys[j].URL
+		}
+		return keys[i].Version < keys[j].Version
+	})
+	l.displays = make(map[codeKey]string)
+	for _, k := range keys {
+		vs := l.valueSets[k]
+		for _, c := range vs.codes() {
+			if _, ok := l.displays[c.key()]; !ok && c.Display != "" {
+				l.displays[c.key()] = c.Display
+			}
+		}
+	}
+}
+
 // A base fhirResource that is used to store top level data from parsed json resources. This struct
 // exists to perform initial parsing of json resources so we can figure out the type of the resource
 // (CodeSystem or ValueSet).
@@ -263,9 +383,36 @@ type fhirResource struct {
 	ResourceType string `json:"resourceType"`
 	URL          string `json:"url"`
 	Version      string `json:"version"`
+	// HierarchyMeaning is only set for CodeSystems.
+	HierarchyMeaning string `json:"hierarchyMeaning"`
 	// Only one of the following two fields should be populated
-	Concept   []*Code    `json:"concept"`
-	Expansion *expansion `json:"expansion"`
+	Concept   []*fhirConcept `json:"concept"`
+	Expansion *expansion     `json:"expansion"`
+	// Compose is only used for ValueSets that are not already expanded.
+	Compose *compose `json:"compose"`
+	// Group is only set for ConceptMaps.
+	Group []*conceptMapGroup `json:"group"`
+	// Entry is only set for Bundles.
+	Entry []*bundleEntry `json:"entry"`
+}
+
+type bundleEntry struct {
+	Resource json.RawMessage `json:"resource"`
+}
+
+// fhirConcept is a CodeSystem concept. Concepts may nest child concepts, or declare their parents
+// with the parent property, to form the CodeSystem hierarchy.
+type fhirConcept struct {
+	Code        string             `json:"code"`
+	Display     string             `json:"display"`
+	Designation []*Designation     `json:"designation"`
+	Concept     []*fhirConcept     `json:"concept"`
+	Property    []*conceptProperty `json:"property"`
+}
+
+type conceptProperty struct {
+	Code      string `json:"code"`
+	ValueCode string `json:"valueCode"`
 }
 
 func (f *fhirResource) key() resourceKey {
@@ -286,12 +433,35 @@ type fhirValueSet struct {
 	Version      string `json:"version"`
 	CodeMap      map[codeKey]*Code
 	Expansion    expansion `json:"expansion"`
+	// Compose holds the rules defining the ValueSet if it was not loaded with an expansion.
+	Compose *compose
+	// expansionErr is set if the Compose rules could not be expanded locally.
+	expansionErr error
 }
 
 func (f *fhirValueSet) code(key codeKey) *Code {
 	return f.CodeMap[key]
 }
 
+// containsAny returns true if any of the codes is in the ValueSet.
+func (f *fhirValueSet) containsAny(codes []Code) bool {
+	for _, c := range codes {
+		if f.code(c.key()) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAnyBatch returns, for each list of codes, whether any of its codes is in the ValueSet.
+func (f *fhirValueSet) containsAnyBatch(codeSets [][]Code) []bool {
+	in := make([]bool, len(codeSets))
+	for i, codes := range codeSets {
+		in[i] = f.containsAny(codes)
+	}
+	return in
+}
+
 func (f *fhirValueSet) key() resourceKey {
 	return resourceKey{f.URL, f.Version}
 }
@@ -309,7 +479,12 @@ type fhirCodeSystem struct {
 	URL          string `json:"url"`
 	Version      string `json:"version"`
 	CodeMap      map[codeKey]*Code
-	Concept      []*Code `json:"concept"`
+	// Concept holds all concepts in the CodeSystem, including nested ones.
+	Concept []*Code `json:"concept"`
+	// parents maps each code to the codes of its direct parents in the is-a hierarchy.
+	parents map[string][]string
+	// designations maps each code to its designations.
+	designations map[string][]*Designation
 }
 
 func (f *fhirCodeSystem) key() resourceKey {
@@ -339,6 +514,8 @@ func buildFHIRValueSet(fr fhirResource) fhirValueSet {
 	}
 	if fr.Expansion != nil {
 		vs.Expansion = *fr.Expansion
+	} else {
+		vs.Compose = fr.Compose
 	}
 
 	for _, c := range vs.Expansion.Codes {
@@ -352,12 +529,57 @@ func buildFHIRCodeSystem(fr fhirResource) fhirCodeSystem {
 		ResourceType: fr.ResourceType,
 		URL:          fr.URL,
 		Version:      fr.Version,
-		Concept:      fr.Concept,
 		CodeMap:      make(map[codeKey]*Code),
+		parents:      make(map[string][]string),
+		designations: make(map[string][]*Designation),
 	}
+	// Only is-a hierarchies imply subsumption. If hierarchyMeaning is not set the hierarchy is
+	// assumed to be is-a.
+	isA := fr.HierarchyMeaning == "" || fr.HierarchyMeaning == "is-a"
+	cs.addConcepts(fr.Concept, "", isA)
 
 	for _, c := range cs.Concept {
 		cs.CodeMap[c.key()] = c
 	}
 	return cs
 }
+
+// addConcepts flattens the nested concepts into the CodeSystem, recording the hierarchy if isA.
+func (f *fhirCodeSystem) addConcepts(concepts []*fhirConcept, parent string, isA bool) {
+	for _, c := range concepts {
+		f.Concept = append(f.Concept, &Code{Code: c.Code, Display: c.Display})
+		if len(c.Designation) > 0 {
+			f.designations[c.Code] = c.Designation
+		}
+		if isA {
+			if parent != "" {
+				f.parents[c.Code] = append(f.parents[c.Code], parent)
+			}
+			for _, p := range c.Property {
+				if p.Code == "parent" && p.ValueCode != "" {
+					f.parents[c.Code] = append(f.parents[c.Code], p.ValueCode)
+				}
+			}
+		}
+		f.addConcepts(c.Concept, c.Code, isA)
+	}
+}
+
+// subsumes returns true if ancestor is descendant or one of its transitive parents.
+func (f *fhirCodeSystem) subsumes(ancestor, descendant string) bool {
+	visited := make(map[string]bool)
+	queue := []string{descendant}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if c == ancestor {
+			return true
+		}
+		if visited[c] {
+			continue
+		}
+		visited[c] = true
+		queue = append(queue, f.parents[c]...)
+	}
+	return false
+}
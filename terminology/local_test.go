@@ -496,4 +496,206 @@ func TestLocalFHIR_NotInitialized(t *testing.T) {
 	if _, err := tp.ExpandValueSet("", ""); !errors.Is(err, terminology.ErrNotInitialized) {
 		t.Errorf("Expand() on nil provider got unexpected error. got: %v, want: %v", err, terminology.ErrNotInitialized)
 	}
+	if _, err := tp.Subsumes("", "", ""); !errors.Is(err, terminology.ErrNotInitialized) {
+		t.Errorf("Subsumes() on nil provider got unexpected error. got: %v, want: %v", err, terminology.ErrNotInitialized)
+	}
+}
+
+var hierarchyJSONResources = []string{`
+			{
+				"resourceType": "CodeSystem",
+				"url": "https://test/conditions",
+				"version": "1.0.0",
+				"concept": [
+					{
+						"code": "disease",
+						"concept": [
+							{
+								"code": "infection",
+								"concept": [
+									{ "code": "flu" },
+									{ "code": "cold" }
+								]
+							},
+							{ "code": "diabetes" }
+						]
+					},
+					{
+						"code": "type-2-diabetes",
+						"property": [{ "code": "parent", "valueCode": "diabetes" }]
+					}
+				]
+			}
+	`,
+	`
+			{
+				"resourceType": "CodeSystem",
+				"url": "https://test/grouped",
+				"version": "1.0.0",
+				"hierarchyMeaning": "grouped-by",
+				"concept": [
+					{
+						"code": "group",
+						"concept": [{ "code": "member" }]
+					}
+				]
+			}
+	`,
+}
+
+func TestInMemoryFHIR_Subsumes(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider(hierarchyJSONResources)
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	cases := []struct {
+		name       string
+		URL        string
+		ancestor   string
+		descendant string
+		want       bool
+	}{
+		{name: "Same code", URL: "https://test/conditions", ancestor: "flu", descendant: "flu", want: true},
+		{name: "Direct parent", URL: "https://test/conditions", ancestor: "infection", descendant: "flu", want: true},
+		{name: "Transitive ancestor", URL: "https://test/conditions", ancestor: "disease", descendant: "cold", want: true},
+		{name: "Parent property", URL: "https://test/conditions", ancestor: "disease", descendant: "type-2-diabetes", want: true},
+		{name: "Descendant does not subsume ancestor", URL: "https://test/conditions", ancestor: "flu", descendant: "infection", want: false},
+		{name: "Siblings", URL: "https://test/conditions", ancestor: "flu", descendant: "cold", want: false},
+		{name: "Code not in CodeSystem", URL: "https://test/conditions", ancestor: "disease", descendant: "unknown", want: false},
+		{name: "Not an is-a hierarchy", URL: "https://test/grouped", ancestor: "group", descendant: "member", want: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := imf.Subsumes(tc.URL, tc.ancestor, tc.descendant)
+			if err != nil {
+				t.Fatalf("Subsumes(%v, %v, %v) unexpected error: %v", tc.URL, tc.ancestor, tc.descendant, err)
+			}
+			if got != tc.want {
+				t.Errorf("Subsumes(%v, %v, %v) = %v, want %v", tc.URL, tc.ancestor, tc.descendant, got, tc.want)
+			}
+		})
+	}
+
+	// Nested concepts are part of the CodeSystem.
+	in, err := imf.AnyInCodeSystem([]terminology.Code{{System: "https://test/conditions", Code: "cold"}}, "https://test/conditions", "")
+	if err != nil {
+		t.Fatalf("AnyInCodeSystem() unexpected error: %v", err)
+	}
+	if !in {
+		t.Errorf("AnyInCodeSystem() for a nested concept = false, want true")
+	}
+
+	if _, err := imf.Subsumes("https://test/missing", "a", "b"); !errors.Is(err, terminology.ErrResourceNotLoaded) {
+		t.Errorf("Subsumes() for a missing CodeSystem got unexpected error. got: %v, want: %v", err, terminology.ErrResourceNotLoaded)
+	}
+}
+
+func TestInMemoryFHIR_Lookup(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider([]string{`
+			{
+				"resourceType": "CodeSystem",
+				"url": "https://test/cs",
+				"version": "1.0.0",
+				"concept": [
+					{
+						"code": "flu",
+						"display": "Influenza",
+						"designation": [
+							{
+								"language": "fr",
+								"use": { "system": "http://snomed.info/sct", "code": "900000000000013009" },
+								"value": "Grippe"
+							}
+						]
+					}
+				]
+			}
+	`, `
+			{
+				"resourceType": "ValueSet",
+				"url": "https://test/vs",
+				"version": "1.0.0",
+				"expansion": {
+					"contains": [
+						{ "system": "https://test/other", "code": "cold", "display": "Common cold" }
+					]
+				}
+			}
+	`})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	cases := []struct {
+		name string
+		URL  string
+		code string
+		want *terminology.CodeDetails
+	}{
+		{
+			name: "CodeSystem concept with designations",
+			URL:  "https://test/cs",
+			code: "flu",
+			want: &terminology.CodeDetails{
+				Code:    "flu",
+				System:  "https://test/cs",
+				Display: "Influenza",
+				Designations: []*terminology.Designation{
+					{Language: "fr", Use: &terminology.Code{System: "http://snomed.info/sct", Code: "900000000000013009"}, Value: "Grippe"},
+				},
+			},
+		},
+		{
+			name: "ValueSet expansion display",
+			URL:  "https://test/other",
+			code: "cold",
+			want: &terminology.CodeDetails{Code: "cold", System: "https://test/other", Display: "Common cold"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := imf.Lookup(tc.URL, tc.code)
+			if err != nil {
+				t.Fatalf("Lookup(%v, %v) unexpected error: %v", tc.URL, tc.code, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Lookup(%v, %v) diff (-want +got):\n%s", tc.URL, tc.code, diff)
+			}
+		})
+	}
+
+	if _, err := imf.Lookup("https://test/cs", "unknown"); !errors.Is(err, terminology.ErrCodeNotFound) {
+		t.Errorf("Lookup() for an unknown code got unexpected error. got: %v, want: %v", err, terminology.ErrCodeNotFound)
+	}
+	var nilProvider *terminology.LocalFHIRProvider
+	if _, err := nilProvider.Lookup("https://test/cs", "flu"); !errors.Is(err, terminology.ErrNotInitialized) {
+		t.Errorf("Lookup() on nil provider got unexpected error. got: %v, want: %v", err, terminology.ErrNotInitialized)
+	}
+}
+
+func TestInMemoryFHIR_AnyInValueSetBatch(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider(testJSONResources)
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	codeSets := [][]terminology.Code{
+		{{System: "system1", Code: "1"}},
+		{{System: "system1", Code: "4"}},
+		nil,
+		{{System: "system9", Code: "1"}, {System: "system2", Code: "3"}},
+	}
+	got, err := imf.AnyInValueSetBatch(codeSets, "https://test/file1", "1.0.0")
+	if err != nil {
+		t.Fatalf("AnyInValueSetBatch() unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]bool{true, false, false, true}, got); diff != "" {
+		t.Errorf("AnyInValueSetBatch() diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := imf.AnyInValueSetBatch(codeSets, "https://test/missing", ""); !errors.Is(err, terminology.ErrResourceNotLoaded) {
+		t.Errorf("AnyInValueSetBatch() for a missing ValueSet got unexpected error. got: %v, want: %v", err, terminology.ErrResourceNotLoaded)
+	}
+	var nilProvider *terminology.LocalFHIRProvider
+	if _, err := nilProvider.AnyInValueSetBatch(codeSets, "https://test/file1", ""); !errors.Is(err, terminology.ErrNotInitialized) {
+		t.Errorf("AnyInValueSetBatch() on nil provider got unexpected error. got: %v, want: %v", err, terminology.ErrNotInitialized)
+	}
 }
@@ -0,0 +1,229 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrVersionNotPinned indicates a ValueSet referenced without a version is not pinned by the
+// Manifest.
+var ErrVersionNotPinned = errors.New("valueset version not pinned by the terminology manifest")
+
+// Manifest pins the versions of ValueSets and CodeSystems used for a run, so that results are
+// reproducible across terminology updates. Manifests are loaded from FHIR expansion parameters with
+// ParseManifest.
+type Manifest struct {
+	// ValueSets maps ValueSet URLs to their pinned version.
+	ValueSets map[string]string
+	// CodeSystems maps CodeSystem URLs to their pinned version.
+	CodeSystems map[string]string
+}
+
+// ParseManifest parses a terminology manifest from either a FHIR Parameters resource holding
+// expansion parameters, or a manifest Library whose relatedArtifacts list versioned canonicals and
+// which may contain a Parameters resource. The supported parameters are:
+//
+//   - valueset-version or canonicalVersion: a canonical of the form url|version pinning a ValueSet.
+//   - system-version or force-system-version: a canonical of the form url|version pinning a
+//     CodeSystem.
+//
+// Library relatedArtifacts of type depends-on pin CodeSystems if the canonical contains
+// /CodeSystem/, and ValueSets otherwise.
+func ParseManifest(b []byte) (*Manifest, error) {
+	var r manifestResource
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("failed to parse terminology manifest: %w", err)
+	}
+	m := &Manifest{ValueSets: make(map[string]string), CodeSystems: make(map[string]string)}
+	switch r.ResourceType {
+	case "Parameters":
+		if err := m.addParameters(r.Parameter); err != nil {
+			return nil, err
+		}
+	case "Library":
+		for _, a := range r.RelatedArtifact {
+			if a.Type != "depends-on" || a.Resource == "" {
+				continue
+			}
+			url, version, err := splitCanonical(a.Resource)
+			if err != nil {
+				return nil, err
+			}
+			if strings.Contains(url, "/CodeSystem/") {
+				m.CodeSystems[url] = version
+			} else {
+				m.ValueSets[url] = version
+			}
+		}
+		for _, c := range r.Contained {
+			if c.ResourceType != "Parameters" {
+				continue
+			}
+			if err := m.addParameters(c.Parameter); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("terminology manifest must be a Parameters or Library resource, got %q %w", r.ResourceType, ErrIncorrectResourceType)
+	}
+	return m, nil
+}
+
+type manifestResource struct {
+	ResourceType    string               `json:"resourceType"`
+	Parameter       []*manifestParameter `json:"parameter"`
+	RelatedArtifact []*struct {
+		Type     string `json:"type"`
+		Resource string `json:"resource"`
+	} `json:"relatedArtifact"`
+	Contained []*manifestResource `json:"contained"`
+}
+
+type manifestParameter struct {
+	Name           string `json:"name"`
+	ValueCanonical string `json:"valueCanonical"`
+	ValueURI       string `json:"valueUri"`
+	ValueString    string `json:"valueString"`
+}
+
+func (m *Manifest) addParameters(params []*manifestParameter) error {
+	for _, p := range params {
+		var pins map[string]string
+		switch p.Name {
+		case "valueset-version", "canonicalVersion":
+			pins = m.ValueSets
+		case "system-version", "force-system-version":
+			pins = m.CodeSystems
+		default:
+			continue
+		}
+		canonical := p.ValueCanonical
+		if canonical == "" {
+			canonical = p.ValueURI
+		}
+		if canonical == "" {
+			canonical = p.ValueString
+		}
+		url, version, err := splitCanonical(canonical)
+		if err != nil {
+			return err
+		}
+		pins[url] = version
+	}
+	return nil
+}
+
+func splitCanonical(canonical string) (string, string, error) {
+	url, version, ok := strings.Cut(canonical, "|")
+	if !ok || url == "" || version == "" {
+		return "", "", fmt.Errorf("terminology manifest canonical %q must be of the form url|version", canonical)
+	}
+	return url, version, nil
+}
+
+// ValueSetRef is a reference to a ValueSet from CQL. Version is empty if CQL does not specify one.
+type ValueSetRef struct {
+	URL     string
+	Version string
+}
+
+// Validate checks that every referenced ValueSet is available from the provider in the version the
+// run will use, so that a run fails fast instead of part way through evaluation. If requirePinned
+// is true, ValueSets referenced without a version must be pinned by the Manifest.
+func (m *Manifest) Validate(p Provider, refs []ValueSetRef, requirePinned bool) error {
+	var errs []error
+	for _, ref := range refs {
+		version := m.valueSetVersion(ref.URL, ref.Version)
+		if version == "" && requirePinned {
+			errs = append(errs, fmt.Errorf("ValueSet %s: %w", ref.URL, ErrVersionNotPinned))
+			continue
+		}
+		if _, err := p.ExpandValueSet(ref.URL, version); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// valueSetVersion returns the version CQL specified, falling back to the pinned version.
+func (m *Manifest) valueSetVersion(url, version string) string {
+	if version != "" || m == nil {
+		return version
+	}
+	return m.ValueSets[url]
+}
+
+func (m *Manifest) codeSystemVersion(url, version string) string {
+	if version != "" || m == nil {
+		return version
+	}
+	return m.CodeSystems[url]
+}
+
+// PinnedProvider is a terminology provider that resolves ValueSets and CodeSystems referenced
+// without a version to the version pinned in a Manifest. Versions specified in CQL take
+// precedence over the Manifest.
+type PinnedProvider struct {
+	provider Provider
+	manifest *Manifest
+}
+
+// NewPinnedProvider returns a PinnedProvider wrapping p.
+func NewPinnedProvider(p Provider, m *Manifest) *PinnedProvider {
+	return &PinnedProvider{provider: p, manifest: m}
+}
+
+// AnyInCodeSystem returns true if any code is contained within the specified CodeSystem, using the
+// pinned version if codeSystemVersion is empty.
+func (p *PinnedProvider) AnyInCodeSystem(codes []Code, codeSystemURL, codeSystemVersion string) (bool, error) {
+	return p.provider.AnyInCodeSystem(codes, codeSystemURL, p.manifest.codeSystemVersion(codeSystemURL, codeSystemVersion))
+}
+
+// AnyInValueSet returns true if any code is contained within the specified ValueSet, using the
+// pinned version if valueSetVersion is empty.
+func (p *PinnedProvider) AnyInValueSet(codes []Code, valueSetURL, valueSetVersion string) (bool, error) {
+	return p.provider.AnyInValueSet(codes, valueSetURL, p.manifest.valueSetVersion(valueSetURL, valueSetVersion))
+}
+
+// AnyInValueSetBatch returns, for each list of codes, whether any of its codes is contained within
+// the specified ValueSet, using the pinned version if valueSetVersion is empty.
+func (p *PinnedProvider) AnyInValueSetBatch(codeSets [][]Code, valueSetURL, valueSetVersion string) ([]bool, error) {
+	return p.provider.AnyInValueSetBatch(codeSets, valueSetURL, p.manifest.valueSetVersion(valueSetURL, valueSetVersion))
+}
+
+// ExpandValueSet returns the expanded codes for the ValueSet, using the pinned version if
+// valueSetVersion is empty.
+func (p *PinnedProvider) ExpandValueSet(valueSetURL, valueSetVersion string) ([]*Code, error) {
+	return p.provider.ExpandValueSet(valueSetURL, p.manifest.valueSetVersion(valueSetURL, valueSetVersion))
+}
+
+// Subsumes returns true if the ancestorCode subsumes the descendantCode.
+func (p *PinnedProvider) Subsumes(codeSystemURL, ancestorCode, descendantCode string) (bool, error) {
+	return p.provider.Subsumes(codeSystemURL, ancestorCode, descendantCode)
+}
+
+// Lookup returns the display and designations of the code.
+func (p *PinnedProvider) Lookup(codeSystemURL, code string) (*CodeDetails, error) {
+	return p.provider.Lookup(codeSystemURL, code)
+}
+
+// Translate maps the code using the ConceptMap. ConceptMap versions are not pinned by the Manifest.
+func (p *PinnedProvider) Translate(conceptMapURL, conceptMapVersion string, code Code, targetSystem string) ([]*Translation, error) {
+	return p.provider.Translate(conceptMapURL, conceptMapVersion, code, targetSystem)
+}
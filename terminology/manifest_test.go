@@ -0,0 +1,162 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/cql/terminology"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want *terminology.Manifest
+	}{
+		{
+			name: "Parameters",
+			json: `{
+				"resourceType": "Parameters",
+				"parameter": [
+					{ "name": "valueset-version", "valueCanonical": "https://test/file1|1.0.0" },
+					{ "name": "canonicalVersion", "valueUri": "https://test/file2|2.0.0" },
+					{ "name": "system-version", "valueUri": "http://loinc.org|2.74" },
+					{ "name": "includeDesignations", "valueBoolean": true }
+				]
+			}`,
+			want: &terminology.Manifest{
+				ValueSets:   map[string]string{"https://test/file1": "1.0.0", "https://test/file2": "2.0.0"},
+				CodeSystems: map[string]string{"http://loinc.org": "2.74"},
+			},
+		},
+		{
+			name: "Library",
+			json: `{
+				"resourceType": "Library",
+				"relatedArtifact": [
+					{ "type": "depends-on", "resource": "http://cts.nlm.nih.gov/fhir/ValueSet/1.2.3|20240101" },
+					{ "type": "depends-on", "resource": "http://example.com/CodeSystem/abc|1" },
+					{ "type": "documentation", "resource": "http://example.com/doc" }
+				],
+				"contained": [
+					{
+						"resourceType": "Parameters",
+						"parameter": [{ "name": "valueset-version", "valueCanonical": "https://test/file1|1.0.0" }]
+					}
+				]
+			}`,
+			want: &terminology.Manifest{
+				ValueSets:   map[string]string{"http://cts.nlm.nih.gov/fhir/ValueSet/1.2.3": "20240101", "https://test/file1": "1.0.0"},
+				CodeSystems: map[string]string{"http://example.com/CodeSystem/abc": "1"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := terminology.ParseManifest([]byte(tc.json))
+			if err != nil {
+				t.Fatalf("ParseManifest() unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseManifest() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseManifestError(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{name: "Invalid JSON", json: `{`},
+		{name: "Wrong resource type", json: `{"resourceType": "ValueSet"}`},
+		{name: "Missing version", json: `{"resourceType": "Parameters", "parameter": [{ "name": "valueset-version", "valueCanonical": "https://test/file1" }]}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := terminology.ParseManifest([]byte(tc.json)); err == nil {
+				t.Errorf("ParseManifest() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestPinnedProvider(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider(testJSONResources)
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	m := &terminology.Manifest{
+		ValueSets:   map[string]string{"https://test/file1": "1.0.0"},
+		CodeSystems: map[string]string{"https://test/file3": "1.0.0"},
+	}
+	p := terminology.NewPinnedProvider(imf, m)
+
+	// Without the manifest the latest version 2.0.0 would be used.
+	in, err := p.AnyInValueSet([]terminology.Code{{System: "system1", Code: "1"}}, "https://test/file1", "")
+	if err != nil {
+		t.Fatalf("AnyInValueSet() unexpected error: %v", err)
+	}
+	if !in {
+		t.Errorf("AnyInValueSet() with pinned version = false, want true")
+	}
+	// Versions in CQL take precedence over the manifest.
+	in, err = p.AnyInValueSet([]terminology.Code{{System: "system1", Code: "1"}}, "https://test/file1", "2.0.0")
+	if err != nil {
+		t.Fatalf("AnyInValueSet() unexpected error: %v", err)
+	}
+	if in {
+		t.Errorf("AnyInValueSet() with explicit version = true, want false")
+	}
+	codes, err := p.ExpandValueSet("https://test/file1", "")
+	if err != nil {
+		t.Fatalf("ExpandValueSet() unexpected error: %v", err)
+	}
+	if len(codes) != 3 || codes[0].Code != "1" {
+		t.Errorf("ExpandValueSet() with pinned version = %v, want codes of version 1.0.0", codes)
+	}
+	in, err = p.AnyInCodeSystem([]terminology.Code{{System: "https://test/file3", Code: "sn"}}, "https://test/file3", "")
+	if err != nil {
+		t.Fatalf("AnyInCodeSystem() unexpected error: %v", err)
+	}
+	if !in {
+		t.Errorf("AnyInCodeSystem() with pinned version = false, want true")
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider(testJSONResources)
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	m := &terminology.Manifest{ValueSets: map[string]string{"https://test/file1": "1.0.0", "https://test/file2": "9.9.9"}}
+
+	if err := m.Validate(imf, []terminology.ValueSetRef{{URL: "https://test/file1"}}, true); err != nil {
+		t.Errorf("Validate() of a pinned ValueSet unexpected error: %v", err)
+	}
+	if err := m.Validate(imf, []terminology.ValueSetRef{{URL: "https://test/file2"}}, false); !errors.Is(err, terminology.ErrResourceNotLoaded) {
+		t.Errorf("Validate() of a missing pinned version got: %v, want: %v", err, terminology.ErrResourceNotLoaded)
+	}
+	if err := m.Validate(imf, []terminology.ValueSetRef{{URL: "https://test/file4"}}, true); !errors.Is(err, terminology.ErrVersionNotPinned) {
+		t.Errorf("Validate() of an unpinned ValueSet got: %v, want: %v", err, terminology.ErrVersionNotPinned)
+	}
+	if err := m.Validate(imf, []terminology.ValueSetRef{{URL: "https://test/file4"}}, false); err != nil {
+		t.Errorf("Validate() of an unpinned ValueSet without requirePinned unexpected error: %v", err)
+	}
+}
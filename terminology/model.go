@@ -36,3 +36,34 @@ type codeKey struct {
 	// System is the coding system id.
 	System string
 }
+
+// CodeDetails are the details of a code returned by a terminology lookup.
+type CodeDetails struct {
+	Code   string `json:"code"`
+	System string `json:"system"`
+	// Display is the preferred display of the code.
+	Display string `json:"display,omitempty"`
+	// Designations are additional representations of the code, such as displays in other languages.
+	Designations []*Designation `json:"designation,omitempty"`
+}
+
+// Designation is an additional representation of a code, equivalent to a FHIR CodeSystem concept
+// designation.
+type Designation struct {
+	// Language is the BCP-47 language code of the designation, if any.
+	Language string `json:"language,omitempty"`
+	// Use is what kind of designation this is, for example a SNOMED fully specified name.
+	Use *Code `json:"use,omitempty"`
+	// Value is the text of the designation.
+	Value string `json:"value"`
+}
+
+// Translation is a target code that a source code maps to in a ConceptMap.
+type Translation struct {
+	// Code is the target code.
+	Code *Code `json:"code"`
+	// Equivalence is the FHIR ConceptMap equivalence of the target code to the source code, for
+	// example equivalent, wider or narrower. See
+	// https://hl7.org/fhir/R4/valueset-concept-map-equivalence.html.
+	Equivalence string `json:"equivalence,omitempty"`
+}
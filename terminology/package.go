@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// fhirPackageSuffixes are the file suffixes of FHIR IG packages.
+var fhirPackageSuffixes = []string{".tgz", ".tar.gz"}
+
+// IsFHIRPackage returns true if the file name is that of a FHIR IG package.
+func IsFHIRPackage(name string) bool {
+	for _, s := range fhirPackageSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFHIRPackage returns the JSON resources in a FHIR IG package, which is a gzipped tarball of
+// resources as published to FHIR package registries (https://registry.fhir.org). The package
+// manifest (package.json) and index (.index.json) are skipped, as are non-JSON files. The returned
+// resources can be passed to NewInMemoryFHIRProvider.
+func ReadFHIRPackage(r io.Reader) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var jsons []string
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg || !strings.HasSuffix(h.Name, ".json") {
+			continue
+		}
+		if base := path.Base(h.Name); base == "package.json" || base == ".index.json" {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", h.Name, err)
+		}
+		jsons = append(jsons, string(b))
+	}
+	return jsons, nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/cql/terminology"
+	"github.com/google/go-cmp/cmp"
+)
+
+const packageValueSet = `{
+	"resourceType": "ValueSet",
+	"url": "https://test/package-vs",
+	"version": "1.0.0",
+	"expansion": {"contains": [{"system": "https://test/package-cs", "code": "1"}]}
+}`
+
+const packageCodeSystem = `{
+	"resourceType": "CodeSystem",
+	"url": "https://test/package-cs",
+	"version": "1.0.0",
+	"concept": [{"code": "1", "display": "One"}]
+}`
+
+const bundleJSON = `{
+	"resourceType": "Bundle",
+	"type": "collection",
+	"entry": [
+		{"resource": {"resourceType": "Patient", "id": "ignored"}},
+		{"resource": {
+			"resourceType": "ValueSet",
+			"url": "https://test/bundle-vs",
+			"version": "1.0.0",
+			"expansion": {"contains": [{"system": "https://test/bundle-cs", "code": "a"}]}
+		}},
+		{"resource": {
+			"resourceType": "Bundle",
+			"entry": [{"resource": {
+				"resourceType": "ValueSet",
+				"url": "https://test/nested-bundle-vs",
+				"version": "1.0.0",
+				"expansion": {"contains": [{"system": "https://test/bundle-cs", "code": "b"}]}
+			}}]
+		}}
+	]
+}`
+
+// writeTestPackage returns a gzipped tarball holding the files, laid out like a FHIR IG package.
+func writeTestPackage(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("tar.WriteHeader(%s) unexpected error: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("tar.Write(%s) unexpected error: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar.Close() unexpected error: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip.Close() unexpected error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func testPackage(t *testing.T) []byte {
+	return writeTestPackage(t, map[string]string{
+		"package/package.json":               `{"name": "test.package", "version": "1.0.0"}`,
+		"package/.index.json":                `{"index-version": 1, "files": []}`,
+		"package/ValueSet-package-vs.json":   packageValueSet,
+		"package/CodeSystem-package-cs.json": packageCodeSystem,
+		"package/other/readme.txt":           "not a resource",
+	})
+}
+
+func TestReadFHIRPackage(t *testing.T) {
+	jsons, err := terminology.ReadFHIRPackage(bytes.NewReader(testPackage(t)))
+	if err != nil {
+		t.Fatalf("ReadFHIRPackage() unexpected error: %v", err)
+	}
+	// Tar entries are written in map order, so compare as a set.
+	got := map[string]bool{}
+	for _, j := range jsons {
+		got[j] = true
+	}
+	want := map[string]bool{packageValueSet: true, packageCodeSystem: true}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadFHIRPackage() diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := terminology.ReadFHIRPackage(bytes.NewReader([]byte("not a package"))); err == nil {
+		t.Errorf("ReadFHIRPackage() for an invalid package succeeded, want error")
+	}
+}
+
+func TestIsFHIRPackage(t *testing.T) {
+	for name, want := range map[string]bool{
+		"hl7.fhir.us.core.tgz":    true,
+		"hl7.fhir.us.core.tar.gz": true,
+		"valueset.json":           false,
+		"bundle.json.gz":          false,
+	} {
+		if got := terminology.IsFHIRPackage(name); got != want {
+			t.Errorf("IsFHIRPackage(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func testBundleAndPackageResources(t *testing.T, tp *terminology.LocalFHIRProvider) {
+	t.Helper()
+	cases := []struct {
+		url  string
+		want []*terminology.Code
+	}{
+		{url: "https://test/bundle-vs", want: []*terminology.Code{{System: "https://test/bundle-cs", Code: "a"}}},
+		{url: "https://test/nested-bundle-vs", want: []*terminology.Code{{System: "https://test/bundle-cs", Code: "b"}}},
+		{url: "https://test/package-vs", want: []*terminology.Code{{System: "https://test/package-cs", Code: "1"}}},
+	}
+	for _, tc := range cases {
+		got, err := tp.ExpandValueSet(tc.url, "")
+		if err != nil {
+			t.Fatalf("ExpandValueSet(%s) unexpected error: %v", tc.url, err)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("ExpandValueSet(%s) diff (-want +got):\n%s", tc.url, diff)
+		}
+	}
+	in, err := tp.AnyInCodeSystem([]terminology.Code{{System: "https://test/package-cs", Code: "1"}}, "https://test/package-cs", "")
+	if err != nil {
+		t.Fatalf("AnyInCodeSystem() unexpected error: %v", err)
+	}
+	if !in {
+		t.Errorf("AnyInCodeSystem() for a CodeSystem from a package = false, want true")
+	}
+}
+
+func TestLocalFHIR_BundlesAndPackages(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bundle.json"), []byte(bundleJSON), 0644); err != nil {
+		t.Fatalf("os.WriteFile() unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "test.package.tgz"), testPackage(t), 0644); err != nil {
+		t.Fatalf("os.WriteFile() unexpected error: %v", err)
+	}
+
+	lf, err := terminology.NewLocalFHIRProvider(dir)
+	if err != nil {
+		t.Fatalf("NewLocalFHIRProvider(%v) unexpected error: %v", dir, err)
+	}
+	testBundleAndPackageResources(t, lf)
+}
+
+func TestInMemoryFHIR_BundlesAndPackages(t *testing.T) {
+	jsons, err := terminology.ReadFHIRPackage(bytes.NewReader(testPackage(t)))
+	if err != nil {
+		t.Fatalf("ReadFHIRPackage() unexpected error: %v", err)
+	}
+	imf, err := terminology.NewInMemoryFHIRProvider(append(jsons, bundleJSON))
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	testBundleAndPackageResources(t, imf)
+}
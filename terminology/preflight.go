@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// IssueKind classifies a problem found by Preflight.
+type IssueKind string
+
+const (
+	// IssueMissing means the resource is not available from the provider in any version.
+	IssueMissing IssueKind = "missing"
+	// IssueVersionMismatch means the resource is available, but not in the requested version.
+	IssueVersionMismatch IssueKind = "version-mismatch"
+	// IssueEmpty means the ValueSet is available but its expansion contains no codes.
+	IssueEmpty IssueKind = "empty"
+	// IssueError means the provider returned an unexpected error for the resource.
+	IssueError IssueKind = "error"
+)
+
+// CodeSystemRef is a reference to a CodeSystem from CQL. Version is empty if CQL does not specify
+// one.
+type CodeSystemRef struct {
+	URL     string
+	Version string
+}
+
+// PreflightIssue is a single problem with a terminology resource referenced by CQL.
+type PreflightIssue struct {
+	Kind IssueKind `json:"kind"`
+	// ResourceType is either ValueSet or CodeSystem.
+	ResourceType string `json:"resourceType"`
+	URL          string `json:"url"`
+	Version      string `json:"version,omitempty"`
+	// Detail holds the underlying error, if any.
+	Detail string `json:"detail,omitempty"`
+}
+
+func (i PreflightIssue) String() string {
+	s := fmt.Sprintf("%s %s{%s, %s}", i.Kind, i.ResourceType, i.URL, i.Version)
+	if i.Detail != "" {
+		s += ": " + i.Detail
+	}
+	return s
+}
+
+// PreflightReport is the result of cross-referencing the terminology referenced by CQL against a
+// terminology provider.
+type PreflightReport struct {
+	// ValueSetsChecked and CodeSystemsChecked are the number of distinct references checked.
+	ValueSetsChecked   int              `json:"valueSetsChecked"`
+	CodeSystemsChecked int              `json:"codeSystemsChecked"`
+	Issues             []PreflightIssue `json:"issues,omitempty"`
+}
+
+// OK returns true if no issues were found.
+func (r *PreflightReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// Err returns an error summarizing all issues, or nil if there are none.
+func (r *PreflightReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	msgs := make([]string, 0, len(r.Issues))
+	for _, i := range r.Issues {
+		msgs = append(msgs, i.String())
+	}
+	return fmt.Errorf("terminology preflight found %d issue(s):\n%s", len(r.Issues), strings.Join(msgs, "\n"))
+}
+
+// Preflight checks that every referenced ValueSet and CodeSystem is available from the provider, so
+// that problems are found before evaluation instead of part way through it. ValueSets are expanded
+// to check they are not empty. CodeSystems can only be checked for presence, and are skipped if the
+// provider does not support CodeSystem operations.
+func Preflight(p Provider, valueSets []ValueSetRef, codeSystems []CodeSystemRef) *PreflightReport {
+	r := &PreflightReport{ValueSetsChecked: len(valueSets), CodeSystemsChecked: len(codeSystems)}
+	for _, vs := range valueSets {
+		codes, err := p.ExpandValueSet(vs.URL, vs.Version)
+		if err != nil {
+			r.addIssue(valueSet, vs.URL, vs.Version, err, func() error {
+				_, err := p.ExpandValueSet(vs.URL, "")
+				return err
+			})
+			continue
+		}
+		if len(codes) == 0 {
+			r.Issues = append(r.Issues, PreflightIssue{Kind: IssueEmpty, ResourceType: valueSet, URL: vs.URL, Version: vs.Version})
+		}
+	}
+	for _, cs := range codeSystems {
+		_, err := p.AnyInCodeSystem(nil, cs.URL, cs.Version)
+		if errors.Is(err, ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			r.addIssue(codeSystem, cs.URL, cs.Version, err, func() error {
+				_, err := p.AnyInCodeSystem(nil, cs.URL, "")
+				return err
+			})
+		}
+	}
+	return r
+}
+
+// addIssue classifies the error returned for a resource. latest retries the lookup without a
+// version, to distinguish a version mismatch from a missing resource.
+func (r *PreflightReport) addIssue(resourceType, url, version string, err error, latest func() error) {
+	issue := PreflightIssue{ResourceType: resourceType, URL: url, Version: version, Detail: err.Error()}
+	switch {
+	case !errors.Is(err, ErrResourceNotLoaded):
+		issue.Kind = IssueError
+	case version != "" && latest() == nil:
+		issue.Kind = IssueVersionMismatch
+	default:
+		issue.Kind = IssueMissing
+	}
+	r.Issues = append(r.Issues, issue)
+}
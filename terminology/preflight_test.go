@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/cql/terminology"
+	"github.com/google/go-cmp/cmp"
+)
+
+// errProvider returns err for every ValueSet and ErrUnsupported for every CodeSystem.
+type errProvider struct {
+	terminology.Provider
+	err error
+}
+
+func (p errProvider) ExpandValueSet(string, string) ([]*terminology.Code, error) {
+	return nil, p.err
+}
+
+func (p errProvider) AnyInCodeSystem([]terminology.Code, string, string) (bool, error) {
+	return false, terminology.ErrUnsupported
+}
+
+func TestPreflight(t *testing.T) {
+	imf, err := terminology.NewInMemoryFHIRProvider(testJSONResources)
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() unexpected error: %v", err)
+	}
+	got := terminology.Preflight(imf,
+		[]terminology.ValueSetRef{{URL: "https://test/file1", Version: "1.0.0"}, {URL: "https://test/file2", Version: "1.0.0"}, {URL: "https://test/missing"}},
+		[]terminology.CodeSystemRef{{URL: "https://test/file3"}, {URL: "https://test/file3", Version: "2.0.0"}},
+	)
+	want := &terminology.PreflightReport{
+		ValueSetsChecked:   3,
+		CodeSystemsChecked: 2,
+		Issues: []terminology.PreflightIssue{
+			{Kind: terminology.IssueVersionMismatch, ResourceType: "ValueSet", URL: "https://test/file2", Version: "1.0.0"},
+			{Kind: terminology.IssueMissing, ResourceType: "ValueSet", URL: "https://test/missing"},
+			{Kind: terminology.IssueVersionMismatch, ResourceType: "CodeSystem", URL: "https://test/file3", Version: "2.0.0"},
+		},
+	}
+	if diff := cmp.Diff(want, got, cmp.FilterPath(func(p cmp.Path) bool { return p.Last().String() == ".Detail" }, cmp.Ignore())); diff != "" {
+		t.Errorf("Preflight() diff (-want +got):\n%s", diff)
+	}
+	if err := got.Err(); err == nil || !strings.Contains(err.Error(), "3 issue(s)") {
+		t.Errorf("Preflight().Err() = %v, want error with 3 issues", err)
+	}
+}
+
+func TestPreflight_ProviderErrors(t *testing.T) {
+	p := errProvider{err: errors.New("connection refused")}
+	got := terminology.Preflight(p, []terminology.ValueSetRef{{URL: "https://test/vs"}}, []terminology.CodeSystemRef{{URL: "https://test/cs"}})
+	want := &terminology.PreflightReport{
+		ValueSetsChecked:   1,
+		CodeSystemsChecked: 1,
+		Issues: []terminology.PreflightIssue{
+			{Kind: terminology.IssueError, ResourceType: "ValueSet", URL: "https://test/vs", Detail: "connection refused"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Preflight() diff (-want +got):\n%s", diff)
+	}
+
+	if ok := terminology.Preflight(p, nil, nil); !ok.OK() || ok.Err() != nil {
+		t.Errorf("Preflight() with no references = %v, want OK", ok)
+	}
+}
@@ -21,6 +21,22 @@ type Provider interface {
 	// Code.Display should be ignored when making this determination.
 	AnyInCodeSystem(c []Code, codeSystemURL, codeSystemVersion string) (bool, error)
 	AnyInValueSet(c []Code, valueSetURL, valueSetVersion string) (bool, error)
+	// AnyInValueSetBatch returns, for each list of codes, whether any code in the list is contained
+	// within the ValueSet. It allows many CodeableConcepts, such as those of every resource in a
+	// retrieve, to be checked in a single call, saving round trips to remote providers.
+	AnyInValueSetBatch(codeSets [][]Code, valueSetURL, valueSetVersion string) ([]bool, error)
 	// ExpandValueSet expands a ValueSet and returns all codes in that resource.
 	ExpandValueSet(valueSetURL, valueSetVersion string) ([]*Code, error)
+	// Subsumes returns true if the ancestorCode subsumes the descendantCode in the CodeSystem's is-a
+	// hierarchy. A code subsumes itself.
+	Subsumes(codeSystemURL, ancestorCode, descendantCode string) (bool, error)
+	// Lookup returns the preferred display and designations of a code, so that results can be
+	// rendered with human readable names. Returns an error wrapping ErrCodeNotFound if the code is
+	// not known to the provider.
+	Lookup(codeSystemURL, code string) (*CodeDetails, error)
+	// Translate maps a code to codes in other CodeSystems using the specified ConceptMap, for
+	// example to map local codes to standard terminologies. If targetSystem is not empty only
+	// translations into that CodeSystem are returned. Unmatched and disjoint mappings are never
+	// returned.
+	Translate(conceptMapURL, conceptMapVersion string, code Code, targetSystem string) ([]*Translation, error)
 }
@@ -0,0 +1,203 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ReloadableProvider is a Provider whose underlying Provider can be atomically replaced at runtime,
+// so that long running services can pick up terminology updates without restarting. Calls that are
+// in flight during a reload complete against the Provider they started with.
+//
+// Each call uses the Provider current at the time of the call, so a CQL evaluation that is running
+// during a reload may see the old terminology for some calls and the new terminology for others.
+// To evaluate against a consistent terminology, pass Current() rather than the ReloadableProvider
+// as the Terminology of each evaluation.
+type ReloadableProvider struct {
+	load func() (Provider, error)
+
+	mu       sync.RWMutex
+	provider Provider
+}
+
+// NewReloadableProvider returns a ReloadableProvider that uses load to build the underlying
+// Provider. load is called once immediately, and again on every Reload.
+func NewReloadableProvider(load func() (Provider, error)) (*ReloadableProvider, error) {
+	if load == nil {
+		return nil, fmt.Errorf("reloadable terminology provider requires a load function: %w", ErrNotInitialized)
+	}
+	p, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadableProvider{load: load, provider: p}, nil
+}
+
+// NewReloadableLocalFHIRProvider returns a ReloadableProvider that loads a LocalFHIRProvider from
+// the FHIR terminology resources in dir.
+func NewReloadableLocalFHIRProvider(dir string) (*ReloadableProvider, error) {
+	return NewReloadableProvider(func() (Provider, error) { return NewLocalFHIRProvider(dir) })
+}
+
+// Reload builds a new underlying Provider and swaps it in. If loading fails the current Provider
+// is kept and the error is returned.
+func (r *ReloadableProvider) Reload() error {
+	p, err := r.load()
+	if err != nil {
+		return fmt.Errorf("failed to reload terminology: %w", err)
+	}
+	r.Swap(p)
+	return nil
+}
+
+// Swap replaces the underlying Provider with p.
+func (r *ReloadableProvider) Swap(p Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.provider = p
+}
+
+// Current returns the Provider currently in use. The returned Provider is not affected by later
+// reloads, so it is a consistent snapshot of the terminology.
+func (r *ReloadableProvider) Current() Provider {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.provider
+}
+
+// Watch polls the files under dir every interval and reloads the Provider when a file is added,
+// removed or modified. Watch blocks until ctx is done. Reload errors are passed to onError if it is
+// not nil, and the previous Provider stays in use.
+func (r *ReloadableProvider) Watch(ctx context.Context, dir string, interval time.Duration, onError func(error)) {
+	last, err := dirSnapshot(dir)
+	if err != nil && onError != nil {
+		onError(err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		snap, err := dirSnapshot(dir)
+		if err != nil {
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+		if snap.equal(last) {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+		last = snap
+	}
+}
+
+// AnyInCodeSystem returns true if any of the codes are in the CodeSystem.
+func (r *ReloadableProvider) AnyInCodeSystem(codes []Code, codeSystemURL, codeSystemVersion string) (bool, error) {
+	return r.Current().AnyInCodeSystem(codes, codeSystemURL, codeSystemVersion)
+}
+
+// AnyInValueSet returns true if any of the codes are in the ValueSet.
+func (r *ReloadableProvider) AnyInValueSet(codes []Code, valueSetURL, valueSetVersion string) (bool, error) {
+	return r.Current().AnyInValueSet(codes, valueSetURL, valueSetVersion)
+}
+
+// AnyInValueSetBatch returns for each set of codes whether any of them are in the ValueSet.
+func (r *ReloadableProvider) AnyInValueSetBatch(codeSets [][]Code, valueSetURL, valueSetVersion string) ([]bool, error) {
+	return r.Current().AnyInValueSetBatch(codeSets, valueSetURL, valueSetVersion)
+}
+
+// ExpandValueSet returns the codes in the ValueSet.
+func (r *ReloadableProvider) ExpandValueSet(valueSetURL, valueSetVersion string) ([]*Code, error) {
+	return r.Current().ExpandValueSet(valueSetURL, valueSetVersion)
+}
+
+// Subsumes returns true if ancestorCode subsumes descendantCode in the CodeSystem.
+func (r *ReloadableProvider) Subsumes(codeSystemURL, ancestorCode, descendantCode string) (bool, error) {
+	return r.Current().Subsumes(codeSystemURL, ancestorCode, descendantCode)
+}
+
+// Lookup returns the display and designations of a code.
+func (r *ReloadableProvider) Lookup(codeSystemURL, code string) (*CodeDetails, error) {
+	return r.Current().Lookup(codeSystemURL, code)
+}
+
+// Translate returns the translations of code in the ConceptMap.
+func (r *ReloadableProvider) Translate(conceptMapURL, conceptMapVersion string, code Code, targetSystem string) ([]*Translation, error) {
+	return r.Current().Translate(conceptMapURL, conceptMapVersion, code, targetSystem)
+}
+
+// fileState is the modification time and size of a file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshot maps file paths to their state.
+type snapshot map[string]fileState
+
+func dirSnapshot(dir string) (snapshot, error) {
+	s := make(snapshot)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		s[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch terminology directory %s: %w", dir, err)
+	}
+	return s, nil
+}
+
+func (s snapshot) equal(o snapshot) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for path, st := range s {
+		ost, ok := o[path]
+		if !ok || !st.modTime.Equal(ost.modTime) || st.size != ost.size {
+			return false
+		}
+	}
+	return true
+}
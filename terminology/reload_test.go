@@ -0,0 +1,167 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/cql/terminology"
+)
+
+func writeReloadValueSet(t *testing.T, dir, code string) {
+	t.Helper()
+	vs := fmt.Sprintf(`{
+		"resourceType": "ValueSet",
+		"url": "https://example.com/vs/reload",
+		"version": "1.0.0",
+		"expansion": {"contains": [{"system": "https://example.com/cs", "code": %q}]}
+	}`, code)
+	if err := os.WriteFile(filepath.Join(dir, "vs.json"), []byte(vs), 0644); err != nil {
+		t.Fatalf("os.WriteFile() returned unexpected error: %v", err)
+	}
+}
+
+func reloadValueSetContains(t *testing.T, p terminology.Provider, code string) bool {
+	t.Helper()
+	in, err := p.AnyInValueSet([]terminology.Code{{System: "https://example.com/cs", Code: code}}, "https://example.com/vs/reload", "")
+	if err != nil {
+		t.Fatalf("AnyInValueSet(%s) returned unexpected error: %v", code, err)
+	}
+	return in
+}
+
+func TestReloadableProvider_Reload(t *testing.T) {
+	dir := t.TempDir()
+	writeReloadValueSet(t, dir, "a")
+	p, err := terminology.NewReloadableLocalFHIRProvider(dir)
+	if err != nil {
+		t.Fatalf("NewReloadableLocalFHIRProvider() returned unexpected error: %v", err)
+	}
+	if !reloadValueSetContains(t, p, "a") {
+		t.Errorf("AnyInValueSet(a) = false before reload, want true")
+	}
+
+	writeReloadValueSet(t, dir, "b")
+	if !reloadValueSetContains(t, p, "a") {
+		t.Errorf("AnyInValueSet(a) = false before Reload was called, want true")
+	}
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Reload() returned unexpected error: %v", err)
+	}
+	if reloadValueSetContains(t, p, "a") || !reloadValueSetContains(t, p, "b") {
+		t.Errorf("Reload() did not pick up the updated ValueSet")
+	}
+
+	// A failed reload keeps the current provider.
+	if err := os.WriteFile(filepath.Join(dir, "bad.json"), []byte("{"), 0644); err != nil {
+		t.Fatalf("os.WriteFile() returned unexpected error: %v", err)
+	}
+	if err := p.Reload(); err == nil {
+		t.Errorf("Reload() with an invalid resource succeeded, want error")
+	}
+	if !reloadValueSetContains(t, p, "b") {
+		t.Errorf("AnyInValueSet(b) = false after a failed reload, want true")
+	}
+}
+
+func TestReloadableProvider_CurrentIsSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	writeReloadValueSet(t, dir, "a")
+	p, err := terminology.NewReloadableLocalFHIRProvider(dir)
+	if err != nil {
+		t.Fatalf("NewReloadableLocalFHIRProvider() returned unexpected error: %v", err)
+	}
+	snapshot := p.Current()
+
+	writeReloadValueSet(t, dir, "b")
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Reload() returned unexpected error: %v", err)
+	}
+	if !reloadValueSetContains(t, snapshot, "a") || reloadValueSetContains(t, snapshot, "b") {
+		t.Errorf("Current() taken before Reload() picked up the updated ValueSet, want the old ValueSet")
+	}
+	if !reloadValueSetContains(t, p, "b") {
+		t.Errorf("AnyInValueSet(b) = false after Reload, want true")
+	}
+}
+
+func TestReloadableProvider_NilLoad(t *testing.T) {
+	_, err := terminology.NewReloadableProvider(nil)
+	if !errors.Is(err, terminology.ErrNotInitialized) {
+		t.Errorf("NewReloadableProvider(nil) returned error %v, want %v", err, terminology.ErrNotInitialized)
+	}
+	if want := "requires a load function: "; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("NewReloadableProvider(nil) returned error %v, want it to contain %q", err, want)
+	}
+}
+
+func TestReloadableProvider_LoadError(t *testing.T) {
+	wantErr := errors.New("load failed")
+	_, err := terminology.NewReloadableProvider(func() (terminology.Provider, error) { return nil, wantErr })
+	if !errors.Is(err, wantErr) {
+		t.Errorf("NewReloadableProvider() returned error %v, want %v", err, wantErr)
+	}
+}
+
+func TestReloadableProvider_Watch(t *testing.T) {
+	dir := t.TempDir()
+	writeReloadValueSet(t, dir, "a")
+	var mu sync.Mutex
+	loads := 0
+	p, err := terminology.NewReloadableProvider(func() (terminology.Provider, error) {
+		mu.Lock()
+		loads++
+		mu.Unlock()
+		return terminology.NewLocalFHIRProvider(dir)
+	})
+	if err != nil {
+		t.Fatalf("NewReloadableProvider() returned unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Watch(ctx, dir, 10*time.Millisecond, func(err error) { t.Errorf("Watch() reported unexpected error: %v", err) })
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Give the watcher time to take its initial snapshot before changing the directory.
+	time.Sleep(50 * time.Millisecond)
+	writeReloadValueSet(t, dir, "bb")
+	deadline := time.Now().Add(5 * time.Second)
+	for !reloadValueSetContains(t, p, "bb") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Watch() did not reload the updated ValueSet")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if loads != 2 {
+		t.Errorf("provider was loaded %d times, want 2", loads)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultVSACBaseURL is the base URL of the VSAC FHIR terminology service.
+const DefaultVSACBaseURL = "https://cts.nlm.nih.gov/fhir"
+
+// DefaultVSACPageSize is the default number of codes requested per page of a ValueSet expansion.
+const DefaultVSACPageSize = 1000
+
+// VSACConfig configures a VSACProvider.
+type VSACConfig struct {
+	// APIKey is the UMLS API key used to authenticate with VSAC. API keys can be found in the UMLS
+	// user profile https://uts.nlm.nih.gov/uts/profile.
+	APIKey string
+	// BaseURL is the base URL of the VSAC FHIR service. If empty DefaultVSACBaseURL is used.
+	BaseURL string
+	// HTTPClient is used to make requests to VSAC. If nil a client with a one minute timeout is used.
+	HTTPClient *http.Client
+	// Cache optionally persists expanded ValueSets across runs. Fresh cache entries are used
+	// without contacting VSAC, and expired entries are used if VSAC can not be reached.
+	Cache *DiskCache
+	// PageSize is the number of codes requested per $expand call. Large ValueSets are paged through
+	// with the offset and count parameters. If zero DefaultVSACPageSize is used.
+	PageSize int
+}
+
+// VSACProvider is a terminology provider backed by the Value Set Authority Center (VSAC)
+// https://vsac.nlm.nih.gov. ValueSets are expanded through the VSAC FHIR $expand operation the
+// first time they are used, and then cached in memory for the lifetime of the provider and, if
+// configured, in the VSACConfig.Cache.
+// VSACProvider is safe for concurrent use.
+type VSACProvider struct {
+	cfg VSACConfig
+
+	mu        sync.Mutex
+	valueSets map[resourceKey]fhirValueSet
+}
+
+// NewVSACProvider returns a new VSACProvider.
+func NewVSACProvider(cfg VSACConfig) (*VSACProvider, error) {
+	if cfg.APIKey == "" {
+		return nil, fmt.Errorf("a UMLS API key is required to connect to VSAC")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultVSACBaseURL
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: time.Minute}
+	}
+	if cfg.PageSize <= 0 {
+		cfg.PageSize = DefaultVSACPageSize
+	}
+	return &VSACProvider{cfg: cfg, valueSets: make(map[resourceKey]fhirValueSet)}, nil
+}
+
+// AnyInValueSet returns true if any code is contained within the specified ValueSet, otherwise
+// false. Code.Display is ignored when making this determination.
+// https://cql.hl7.org/09-b-cqlreference.html#in-valueset
+func (v *VSACProvider) AnyInValueSet(codes []Code, valueSetURL, valueSetVersion string) (bool, error) {
+	vs, err := v.valueSet(valueSetURL, valueSetVersion)
+	if err != nil {
+		return false, err
+	}
+	return vs.containsAny(codes), nil
+}
+
+// AnyInValueSetBatch returns, for each list of codes, whether any of its codes is contained within
+// the specified ValueSet. The ValueSet is downloaded from VSAC at most once.
+func (v *VSACProvider) AnyInValueSetBatch(codeSets [][]Code, valueSetURL, valueSetVersion string) ([]bool, error) {
+	vs, err := v.valueSet(valueSetURL, valueSetVersion)
+	if err != nil {
+		return nil, err
+	}
+	return vs.containsAnyBatch(codeSets), nil
+}
+
+// AnyInCodeSystem is not supported by VSAC and always returns ErrUnsupported.
+func (v *VSACProvider) AnyInCodeSystem(codes []Code, codeSystemURL, codeSystemVersion string) (bool, error) {
+	return false, fmt.Errorf("VSAC CodeSystem{%s, %s}: %w", codeSystemURL, codeSystemVersion, ErrUnsupported)
+}
+
+// Subsumes is not supported by VSAC and always returns ErrUnsupported.
+func (v *VSACProvider) Subsumes(codeSystemURL, ancestorCode, descendantCode string) (bool, error) {
+	return false, fmt.Errorf("VSAC CodeSystem{%s} subsumes: %w", codeSystemURL, ErrUnsupported)
+}
+
+// Translate is not supported since VSAC does not publish ConceptMaps, and always returns
+// ErrUnsupported.
+func (v *VSACProvider) Translate(conceptMapURL, conceptMapVersion string, code Code, targetSystem string) ([]*Translation, error) {
+	return nil, fmt.Errorf("VSAC ConceptMap{%s, %s}: %w", conceptMapURL, conceptMapVersion, ErrUnsupported)
+}
+
+// ExpandValueSet returns the expanded codes for the provided ValueSet url and version. If the
+// valueSetVersion is an empty string VSAC returns the latest version.
+func (v *VSACProvider) ExpandValueSet(valueSetURL, valueSetVersion string) ([]*Code, error) {
+	vs, err := v.valueSet(valueSetURL, valueSetVersion)
+	if err != nil {
+		return nil, err
+	}
+	return vs.codes(), nil
+}
+
+// FetchValueSet returns the JSON of the expanded FHIR ValueSet from VSAC. The url of the returned
+// ValueSet is set to valueSetURL so that the JSON can be loaded by the LocalFHIRProvider and matched
+// against the ValueSet declarations in CQL, which often use urn:oid: URLs.
+func (v *VSACProvider) FetchValueSet(valueSetURL, valueSetVersion string) ([]byte, error) {
+	var vs map[string]any
+	var codes []*Code
+	err := v.expand(valueSetURL, valueSetVersion, func(first map[string]any, page []*Code) {
+		if vs == nil {
+			vs = first
+		}
+		codes = append(codes, page...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	combineExpansion(vs, codes)
+	vs["url"] = valueSetURL
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(vs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// expand pages through the VSAC expansion of the ValueSet, calling page with the codes of each
+// page as they arrive. See expansionPager.expand.
+func (v *VSACProvider) expand(valueSetURL, valueSetVersion string, page func(first map[string]any, codes []*Code)) error {
+	oid, err := vsacOID(valueSetURL)
+	if err != nil {
+		return err
+	}
+	p := expansionPager{
+		server:   "VSAC",
+		pageSize: v.cfg.PageSize,
+		pageURL: func(offset int) string {
+			params := url.Values{}
+			if valueSetVersion != "" {
+				params.Set("valueSetVersion", valueSetVersion)
+			}
+			params.Set("offset", strconv.Itoa(offset))
+			params.Set("count", strconv.Itoa(v.cfg.PageSize))
+			return fmt.Sprintf("%s/ValueSet/%s/$expand?%s", v.cfg.BaseURL, url.PathEscape(oid), params.Encode())
+		},
+		get: v.get,
+	}
+	return p.expand(valueSetURL, valueSetVersion, page)
+}
+
+// Lookup returns the display and designations of a code. Codes in ValueSets already expanded by
+// the provider are answered from memory, otherwise the VSAC CodeSystem $lookup operation is used.
+func (v *VSACProvider) Lookup(codeSystemURL, code string) (*CodeDetails, error) {
+	if v == nil {
+		return nil, ErrNotInitialized
+	}
+	key := codeKey{Value: code, System: codeSystemURL}
+	v.mu.Lock()
+	for _, vs := range v.valueSets {
+		if c := vs.code(key); c != nil && c.Display != "" {
+			v.mu.Unlock()
+			return &CodeDetails{Code: code, System: codeSystemURL, Display: c.Display}, nil
+		}
+	}
+	v.mu.Unlock()
+
+	reqURL := fmt.Sprintf("%s/CodeSystem/$lookup?system=%s&code=%s", v.cfg.BaseURL, url.QueryEscape(codeSystemURL), url.QueryEscape(code))
+	body, status, err := v.get(reqURL)
+	if err != nil {
+		return nil, fmt.Errorf("VSAC lookup of code %s in CodeSystem %s failed: %w", code, codeSystemURL, err)
+	}
+	switch {
+	case status == http.StatusNotFound || status == http.StatusBadRequest:
+		return nil, fmt.Errorf("could not find code %s in CodeSystem %s in VSAC %w", code, codeSystemURL, ErrCodeNotFound)
+	case status != http.StatusOK:
+		return nil, fmt.Errorf("VSAC returned status %d %s for lookup of code %s in CodeSystem %s: %s", status, http.StatusText(status), code, codeSystemURL, body)
+	}
+
+	var params lookupParameters
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse VSAC lookup of code %s in CodeSystem %s: %w", code, codeSystemURL, err)
+	}
+	details := &CodeDetails{Code: code, System: codeSystemURL}
+	for _, p := range params.Parameter {
+		switch p.Name {
+		case "display":
+			details.Display = p.ValueString
+		case "designation":
+			d := &Designation{}
+			for _, part := range p.Part {
+				switch part.Name {
+				case "language":
+					d.Language = part.ValueCode
+				case "use":
+					d.Use = part.ValueCoding
+				case "value":
+					d.Value = part.ValueString
+				}
+			}
+			details.Designations = append(details.Designations, d)
+		}
+	}
+	return details, nil
+}
+
+// lookupParameters is the FHIR Parameters resource returned by CodeSystem/$lookup.
+type lookupParameters struct {
+	Parameter []*struct {
+		Name        string `json:"name"`
+		ValueString string `json:"valueString"`
+		Part        []*struct {
+			Name        string `json:"name"`
+			ValueCode   string `json:"valueCode"`
+			ValueString string `json:"valueString"`
+			ValueCoding *Code  `json:"valueCoding"`
+		} `json:"part"`
+	} `json:"parameter"`
+}
+
+// get makes an authenticated GET request to VSAC and returns the response body and status code.
+func (v *VSACProvider) get(reqURL string) ([]byte, int, error) {
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	// VSAC uses basic auth with the literal username "apikey".
+	req.SetBasicAuth("apikey", v.cfg.APIKey)
+	req.Header.Set("Accept", "application/fhir+json")
+
+	resp, err := v.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, resp.StatusCode, nil
+}
+
+// valueSet returns the ValueSet from the cache, fetching it from VSAC if needed.
+func (v *VSACProvider) valueSet(valueSetURL, valueSetVersion string) (fhirValueSet, error) {
+	if v == nil {
+		return fhirValueSet{}, ErrNotInitialized
+	}
+	key := resourceKey{URL: valueSetURL, Version: valueSetVersion}
+	v.mu.Lock()
+	vs, ok := v.valueSets[key]
+	v.mu.Unlock()
+	if ok {
+		return vs, nil
+	}
+
+	if v.cfg.Cache != nil {
+		b, err := v.FetchCachedValueSet(valueSetURL, valueSetVersion)
+		if err != nil {
+			return fhirValueSet{}, err
+		}
+		fr, err := decodeFHIRResource(bytes.NewReader(b))
+		if err != nil {
+			return fhirValueSet{}, err
+		}
+		vs = buildFHIRValueSet(*fr)
+	} else {
+		// Without a cache the pages of the expansion are indexed as they arrive, without building the
+		// full ValueSet JSON.
+		vs = fhirValueSet{ResourceType: valueSet, URL: valueSetURL, Version: valueSetVersion, CodeMap: make(map[codeKey]*Code)}
+		err := v.expand(valueSetURL, valueSetVersion, func(first map[string]any, codes []*Code) {
+			if version, ok := first["version"].(string); ok {
+				vs.Version = version
+			}
+			for _, c := range codes {
+				vs.Expansion.Codes = append(vs.Expansion.Codes, c)
+				vs.CodeMap[c.key()] = c
+			}
+		})
+		if err != nil {
+			return fhirValueSet{}, err
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.valueSets[key] = vs
+	return vs, nil
+}
+
+// FetchCachedValueSet is like FetchValueSet, but returns the ValueSet JSON from the
+// VSACConfig.Cache if there is a fresh entry, otherwise fetches it from VSAC and updates the cache.
+// If VSAC can not be reached an expired cache entry is returned instead.
+func (v *VSACProvider) FetchCachedValueSet(valueSetURL, valueSetVersion string) ([]byte, error) {
+	if v.cfg.Cache == nil {
+		return v.FetchValueSet(valueSetURL, valueSetVersion)
+	}
+	if b, ok := v.cfg.Cache.Get(valueSetURL, valueSetVersion); ok {
+		return b, nil
+	}
+	b, err := v.FetchValueSet(valueSetURL, valueSetVersion)
+	if err != nil {
+		var urlErr *url.Error
+		if stale, ok := v.cfg.Cache.GetStale(valueSetURL, valueSetVersion); ok && errors.As(err, &urlErr) {
+			return stale, nil
+		}
+		return nil, err
+	}
+	if err := v.cfg.Cache.Put(valueSetURL, valueSetVersion, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// vsacOID extracts the VSAC OID from a ValueSet URL. VSAC ValueSets are referenced either by their
+// canonical URL, for example http://cts.nlm.nih.gov/fhir/ValueSet/2.16.840.1.113883.3.464.1003.101.12.1001,
+// or by an OID URN, for example urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001.
+func vsacOID(valueSetURL string) (string, error) {
+	oid := valueSetURL
+	if strings.HasPrefix(oid, "urn:oid:") {
+		oid = strings.TrimPrefix(oid, "urn:oid:")
+	} else if i := strings.LastIndex(oid, "/ValueSet/"); i >= 0 {
+		oid = oid[i+len("/ValueSet/"):]
+	}
+	oid = strings.TrimSuffix(oid, "/")
+	if oid == "" || strings.ContainsAny(oid, "/:") {
+		return "", fmt.Errorf("could not determine the VSAC OID of ValueSet %s", valueSetURL)
+	}
+	return oid, nil
+}
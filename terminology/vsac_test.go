@@ -0,0 +1,415 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package terminology
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const vsacValueSet = `{
+	"resourceType": "ValueSet",
+	"id": "2.16.840.1.113883.3.464.1003.101.12.1001",
+	"url": "http://cts.nlm.nih.gov/fhir/ValueSet/2.16.840.1.113883.3.464.1003.101.12.1001",
+	"version": "20240101",
+	"expansion": {
+		"contains": [
+			{"system": "http://www.ama-assn.org/go/cpt", "code": "99201", "display": "Office Visit"},
+			{"system": "http://www.ama-assn.org/go/cpt", "code": "99202"}
+		]
+	}
+}`
+
+const vsacLookup = `{
+	"resourceType": "Parameters",
+	"parameter": [
+		{"name": "name", "valueString": "CPT"},
+		{"name": "display", "valueString": "Office Visit, New Patient"},
+		{"name": "designation", "part": [
+			{"name": "language", "valueCode": "en"},
+			{"name": "use", "valueCoding": {"system": "http://snomed.info/sct", "code": "900000000000003001"}},
+			{"name": "value", "valueString": "Office or other outpatient visit for a new patient"}
+		]}
+	]
+}`
+
+// newFakeVSAC returns a fake VSAC server and a counter of the requests it served.
+func newFakeVSAC(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if user, pass, ok := r.BasicAuth(); !ok || user != "apikey" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/CodeSystem/$lookup" {
+			q := r.URL.Query()
+			if q.Get("system") != "http://www.ama-assn.org/go/cpt" || q.Get("code") != "99202" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(vsacLookup))
+			return
+		}
+		if r.URL.Path != "/ValueSet/2.16.840.1.113883.3.464.1003.101.12.1001/$expand" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if v := r.URL.Query().Get("valueSetVersion"); v != "" && v != "20240101" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(vsacValueSet))
+	}))
+	t.Cleanup(s.Close)
+	return s, &requests
+}
+
+func TestVSACProvider(t *testing.T) {
+	s, requests := newFakeVSAC(t)
+	p, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL + "/"})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+
+	for _, url := range []string{"urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001", "http://cts.nlm.nih.gov/fhir/ValueSet/2.16.840.1.113883.3.464.1003.101.12.1001"} {
+		got, err := p.ExpandValueSet(url, "")
+		if err != nil {
+			t.Fatalf("ExpandValueSet(%s) returned unexpected error: %v", url, err)
+		}
+		want := []*Code{
+			{System: "http://www.ama-assn.org/go/cpt", Code: "99201", Display: "Office Visit"},
+			{System: "http://www.ama-assn.org/go/cpt", Code: "99202"},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("ExpandValueSet(%s) diff (-want +got):\n%s", url, diff)
+		}
+
+		in, err := p.AnyInValueSet([]Code{{System: "http://www.ama-assn.org/go/cpt", Code: "99202"}}, url, "20240101")
+		if err != nil {
+			t.Fatalf("AnyInValueSet(%s) returned unexpected error: %v", url, err)
+		}
+		if !in {
+			t.Errorf("AnyInValueSet(%s) = false, want true", url)
+		}
+	}
+
+	// Repeated lookups are served from the cache.
+	if _, err := p.ExpandValueSet("urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001", ""); err != nil {
+		t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+	}
+	if got := requests.Load(); got != 4 {
+		t.Errorf("VSAC served %d requests, want 4", got)
+	}
+}
+
+func TestVSACProvider_FetchValueSetRewritesURL(t *testing.T) {
+	s, _ := newFakeVSAC(t)
+	p, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+	b, err := p.FetchValueSet("urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001", "")
+	if err != nil {
+		t.Fatalf("FetchValueSet() returned unexpected error: %v", err)
+	}
+	local, err := NewInMemoryFHIRProvider([]string{string(b)})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() returned unexpected error: %v", err)
+	}
+	codes, err := local.ExpandValueSet("urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001", "20240101")
+	if err != nil {
+		t.Fatalf("ExpandValueSet() on the snapshot returned unexpected error: %v", err)
+	}
+	if len(codes) != 2 {
+		t.Errorf("ExpandValueSet() on the snapshot returned %d codes, want 2", len(codes))
+	}
+}
+
+func TestVSACProvider_Errors(t *testing.T) {
+	s, _ := newFakeVSAC(t)
+	tests := []struct {
+		name        string
+		apiKey      string
+		url         string
+		version     string
+		wantErr     error
+		wantErrText string
+	}{
+		{
+			name:    "Unknown ValueSet",
+			apiKey:  "secret",
+			url:     "urn:oid:1.2.3",
+			wantErr: ErrResourceNotLoaded,
+		},
+		{
+			name:    "Unknown version",
+			apiKey:  "secret",
+			url:     "urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001",
+			version: "19990101",
+			wantErr: ErrResourceNotLoaded,
+		},
+		{
+			name:        "Bad API key",
+			apiKey:      "wrong",
+			url:         "urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001",
+			wantErrText: "401 Unauthorized",
+		},
+		{
+			name:        "Not a VSAC URL",
+			apiKey:      "secret",
+			url:         "http://example.com/fhir/CodeSystem/abc",
+			wantErrText: "could not determine the VSAC OID",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewVSACProvider(VSACConfig{APIKey: tc.apiKey, BaseURL: s.URL})
+			if err != nil {
+				t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+			}
+			_, err = p.ExpandValueSet(tc.url, tc.version)
+			if err == nil {
+				t.Fatalf("ExpandValueSet() succeeded, want error")
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("ExpandValueSet() returned error %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErrText != "" && !strings.Contains(err.Error(), tc.wantErrText) {
+				t.Errorf("ExpandValueSet() returned error %v, want error containing %q", err, tc.wantErrText)
+			}
+		})
+	}
+
+	if _, err := NewVSACProvider(VSACConfig{}); err == nil {
+		t.Errorf("NewVSACProvider() with no API key succeeded, want error")
+	}
+	p, _ := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL})
+	if _, err := p.AnyInCodeSystem(nil, "http://loinc.org", ""); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("AnyInCodeSystem() returned error %v, want %v", err, ErrUnsupported)
+	}
+}
+
+func TestVSACProvider_DiskCache(t *testing.T) {
+	s, requests := newFakeVSAC(t)
+	cache, err := NewDiskCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("NewDiskCache() returned unexpected error: %v", err)
+	}
+	const url = "urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001"
+
+	p, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL, Cache: cache})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+	if _, err := p.ExpandValueSet(url, ""); err != nil {
+		t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+	}
+
+	// A second provider, as in a later pipeline run, is served from the disk cache.
+	p2, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL, Cache: cache})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+	if _, err := p2.ExpandValueSet(url, ""); err != nil {
+		t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("VSAC served %d requests, want 1", got)
+	}
+
+	// Once expired, entries are still used if VSAC can not be reached.
+	cache.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	s.Close()
+	p3, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL, Cache: cache})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+	codes, err := p3.ExpandValueSet(url, "")
+	if err != nil {
+		t.Fatalf("ExpandValueSet() with VSAC offline returned unexpected error: %v", err)
+	}
+	if len(codes) != 2 {
+		t.Errorf("ExpandValueSet() with VSAC offline returned %d codes, want 2", len(codes))
+	}
+}
+
+func TestVSACProvider_Lookup(t *testing.T) {
+	s, requests := newFakeVSAC(t)
+	p, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+
+	got, err := p.Lookup("http://www.ama-assn.org/go/cpt", "99202")
+	if err != nil {
+		t.Fatalf("Lookup() returned unexpected error: %v", err)
+	}
+	want := &CodeDetails{
+		Code:    "99202",
+		System:  "http://www.ama-assn.org/go/cpt",
+		Display: "Office Visit, New Patient",
+		Designations: []*Designation{
+			{
+				Language: "en",
+				Use:      &Code{System: "http://snomed.info/sct", Code: "900000000000003001"},
+				Value:    "Office or other outpatient visit for a new patient",
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Lookup() diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := p.Lookup("http://www.ama-assn.org/go/cpt", "00000"); !errors.Is(err, ErrCodeNotFound) {
+		t.Errorf("Lookup() for an unknown code returned error %v, want %v", err, ErrCodeNotFound)
+	}
+
+	// Displays from already downloaded ValueSets are used without another request.
+	if _, err := p.ExpandValueSet("urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001", ""); err != nil {
+		t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+	}
+	before := requests.Load()
+	got, err = p.Lookup("http://www.ama-assn.org/go/cpt", "99201")
+	if err != nil {
+		t.Fatalf("Lookup() returned unexpected error: %v", err)
+	}
+	if got.Display != "Office Visit" {
+		t.Errorf("Lookup() display = %q, want %q", got.Display, "Office Visit")
+	}
+	if requests.Load() != before {
+		t.Errorf("Lookup() of a code in a downloaded ValueSet made %d requests, want 0", requests.Load()-before)
+	}
+}
+
+func TestVSACProvider_AnyInValueSetBatch(t *testing.T) {
+	s, requests := newFakeVSAC(t)
+	p, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+	codeSets := [][]Code{
+		{{System: "http://www.ama-assn.org/go/cpt", Code: "99202"}},
+		{{System: "http://www.ama-assn.org/go/cpt", Code: "00000"}},
+		{{System: "http://snomed.info/sct", Code: "1"}, {System: "http://www.ama-assn.org/go/cpt", Code: "99201"}},
+	}
+	got, err := p.AnyInValueSetBatch(codeSets, "urn:oid:2.16.840.1.113883.3.464.1003.101.12.1001", "")
+	if err != nil {
+		t.Fatalf("AnyInValueSetBatch() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]bool{true, false, true}, got); diff != "" {
+		t.Errorf("AnyInValueSetBatch() diff (-want +got):\n%s", diff)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("AnyInValueSetBatch() made %d requests to VSAC, want 1", got)
+	}
+}
+
+func TestVSACProvider_PagedExpansion(t *testing.T) {
+	const total = 5
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			t.Errorf("invalid offset %q", r.URL.Query().Get("offset"))
+		}
+		count, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil {
+			t.Errorf("invalid count %q", r.URL.Query().Get("count"))
+		}
+		var contains []string
+		for i := offset; i < total && i < offset+count; i++ {
+			contains = append(contains, fmt.Sprintf(`{"system": "http://loinc.org", "code": "%d"}`, i))
+		}
+		fmt.Fprintf(w, `{"resourceType": "ValueSet", "version": "1", "expansion": {"total": %d, "offset": %d, "contains": [%s]}}`, total, offset, strings.Join(contains, ","))
+	}))
+	t.Cleanup(s.Close)
+	p, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL, PageSize: 2})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+
+	got, err := p.ExpandValueSet("urn:oid:1.2.3", "")
+	if err != nil {
+		t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+	}
+	var want []*Code
+	for i := 0; i < total; i++ {
+		want = append(want, &Code{System: "http://loinc.org", Code: strconv.Itoa(i)})
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ExpandValueSet() diff (-want +got):\n%s", diff)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("VSAC served %d requests, want 3", got)
+	}
+
+	// FetchValueSet combines the pages into a single expansion.
+	b, err := p.FetchValueSet("urn:oid:1.2.3", "")
+	if err != nil {
+		t.Fatalf("FetchValueSet() returned unexpected error: %v", err)
+	}
+	local, err := NewInMemoryFHIRProvider([]string{string(b)})
+	if err != nil {
+		t.Fatalf("NewInMemoryFHIRProvider() returned unexpected error: %v", err)
+	}
+	codes, err := local.ExpandValueSet("urn:oid:1.2.3", "1")
+	if err != nil {
+		t.Fatalf("ExpandValueSet() on the snapshot returned unexpected error: %v", err)
+	}
+	if len(codes) != total {
+		t.Errorf("ExpandValueSet() on the snapshot returned %d codes, want %d", len(codes), total)
+	}
+}
+
+func TestVSACProvider_PagedExpansionIgnoredOffset(t *testing.T) {
+	// The server ignores offset and total, and always returns the same full page.
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 10 {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"resourceType": "ValueSet", "version": "1", "expansion": {"contains": [{"system": "http://loinc.org", "code": "0"}, {"system": "http://loinc.org", "code": "1"}]}}`)
+	}))
+	t.Cleanup(s.Close)
+	p, err := NewVSACProvider(VSACConfig{APIKey: "secret", BaseURL: s.URL, PageSize: 2})
+	if err != nil {
+		t.Fatalf("NewVSACProvider() returned unexpected error: %v", err)
+	}
+
+	got, err := p.ExpandValueSet("urn:oid:1.2.3", "")
+	if err != nil {
+		t.Fatalf("ExpandValueSet() returned unexpected error: %v", err)
+	}
+	want := []*Code{{System: "http://loinc.org", Code: "0"}, {System: "http://loinc.org", Code: "1"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ExpandValueSet() diff (-want +got):\n%s", diff)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("VSAC served %d requests, want 2", got)
+	}
+}
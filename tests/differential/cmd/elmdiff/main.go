@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Elmdiff translates CQL with this engine's parser and with the reference cql-to-elm translator,
+// and reports where the ELM of the two diverges. The reference ELM is either read from the JSON
+// output of an earlier run of cql-to-elm, or produced by running it.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/cql/tests/differential"
+)
+
+var (
+	cqlDir       = flag.String("cql_dir", "", "(Required) A directory of .cql libraries to translate with this engine's parser. The FHIR 4.0.1 data model is used, and FHIRHelpers is added if it is not in the directory.")
+	referenceDir = flag.String("reference_dir", "", "(Optional) A directory of the reference translator's ELM JSON for the libraries in --cql_dir. Exactly one of --reference_dir and --translator must be set.")
+	translator   = flag.String("translator", "", "(Optional) The command that runs the reference translator on each .cql file, in which {input} is replaced by the file and {output} by the directory to write the ELM JSON to, for example \"java -jar cql-to-elm-cli.jar --format=JSON --input {input} --output {output}\".")
+	ignoreFields = flag.String("ignore_fields", "", "(Optional) A comma separated list of ELM fields that are not compared, for example distinct.")
+	format       = flag.String("format", "text", "(Optional) The format of the report, text or json.")
+	outputPath   = flag.String("output", "", "(Optional) The file to write the report to. Defaults to stdout.")
+	failOnDiff   = flag.Bool("fail_on_diff", true, "(Optional) If true elmdiff exits with an error if the ELM of any library diverges.")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(context.Background()); err != nil {
+		log.Fatalf("elmdiff failed with an error: %v", err)
+	}
+}
+
+func run(ctx context.Context) error {
+	if *cqlDir == "" {
+		return errors.New("--cql_dir must be set")
+	}
+	if (*referenceDir == "") == (*translator == "") {
+		return errors.New("exactly one of --reference_dir and --translator must be set")
+	}
+	cqlFiles, err := filepath.Glob(filepath.Join(*cqlDir, "*.cql"))
+	if err != nil {
+		return err
+	}
+	if len(cqlFiles) == 0 {
+		return fmt.Errorf("no .cql files in %s", *cqlDir)
+	}
+	var cqlLibs []string
+	for _, f := range cqlFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		cqlLibs = append(cqlLibs, string(b))
+	}
+	engine, err := differential.Translate(ctx, cqlLibs)
+	if err != nil {
+		return err
+	}
+
+	refDir := *referenceDir
+	if *translator != "" {
+		refDir, err = os.MkdirTemp("", "elmdiff")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(refDir)
+		for _, f := range cqlFiles {
+			if err := runTranslator(ctx, *translator, f, refDir); err != nil {
+				return err
+			}
+		}
+	}
+	reference, err := differential.LoadReference(os.DirFS(refDir))
+	if err != nil {
+		return err
+	}
+
+	var opts differential.Options
+	if *ignoreFields != "" {
+		opts.IgnoreFields = strings.Split(*ignoreFields, ",")
+	}
+	report := differential.Compare(reference, engine, opts)
+
+	var w io.Writer = os.Stdout
+	if *outputPath != "" {
+		f, err := os.Create(*outputPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "text":
+		err = report.WriteText(w)
+	case "json":
+		err = report.WriteJSON(w)
+	default:
+		return fmt.Errorf("--format must be one of text or json, got %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+	if *failOnDiff && report.Diverged() {
+		return errors.New("the ELM of this engine diverges from the reference translator")
+	}
+	return nil
+}
+
+// runTranslator runs the translator command on one CQL file, writing its ELM JSON to outputDir.
+func runTranslator(ctx context.Context, command, input, outputDir string) error {
+	args := strings.Fields(command)
+	for i, a := range args {
+		a = strings.ReplaceAll(a, "{input}", input)
+		args[i] = strings.ReplaceAll(a, "{output}", outputDir)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("the translator failed on %s: %w", input, err)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package differential
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/google/cql"
+	"github.com/google/cql/internal/editing"
+	"github.com/google/cql/result"
+)
+
+// fhirVersion is the version of the FHIR data model the CQL is parsed with.
+const fhirVersion = "4.0.1"
+
+// Translate parses the CQL libraries with this engine's parser and the FHIR data model, and
+// returns the canonical ELM of each. If FHIRHelpers is not one of the libraries it is added for
+// parsing, but not returned.
+func Translate(ctx context.Context, cqlLibs []string) ([]*Library, error) {
+	dataModel, fhirHelpers, err := cql.FHIRDataModelAndHelpersLib(fhirVersion)
+	if err != nil {
+		return nil, err
+	}
+	helpers := result.LibKey{Name: "FHIRHelpers", Version: fhirVersion}
+	addedHelpers := editing.SourceIndex(cqlLibs, helpers) == -1
+	if addedHelpers {
+		cqlLibs = append(cqlLibs[:len(cqlLibs):len(cqlLibs)], fhirHelpers)
+	}
+	elm, err := cql.Parse(ctx, cqlLibs, cql.ParseConfig{DataModels: [][]byte{dataModel}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the CQL: %w", err)
+	}
+	libsJSON, err := elm.LibrariesJSON()
+	if err != nil {
+		return nil, err
+	}
+	var libs []*Library
+	for key, b := range libsJSON {
+		if key.IsUnnamed || (addedHelpers && key == helpers) {
+			continue
+		}
+		lib, err := Normalize(b)
+		if err != nil {
+			return nil, fmt.Errorf("library %s: %w", key, err)
+		}
+		libs = append(libs, lib)
+	}
+	sortLibraries(libs)
+	return libs, nil
+}
+
+// LoadReference loads the canonical ELM of the .json files in the root of fsys, which are expected
+// to be the JSON output of the reference translator. Other files are ignored.
+func LoadReference(fsys fs.FS) ([]*Library, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var libs []*Library
+	for _, e := range entries {
+		if e.IsDir() || path.Ext(e.Name()) != ".json" {
+			continue
+		}
+		b, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		lib, err := Normalize(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		libs = append(libs, lib)
+	}
+	sortLibraries(libs)
+	return libs, nil
+}
+
+func sortLibraries(libs []*Library) {
+	sort.Slice(libs, func(i, j int) bool { return libs[i].Key() < libs[j].Key() })
+}
+
+// Status is the outcome of comparing one library.
+type Status string
+
+const (
+	// Match is a library whose ELM is the same from both translators, once normalized.
+	Match Status = "match"
+	// Diverged is a library whose ELM differs between the translators.
+	Diverged Status = "diverged"
+	// MissingReference is a library that only this engine translated.
+	MissingReference Status = "missing_reference"
+	// MissingEngine is a library that only the reference translator translated.
+	MissingEngine Status = "missing_engine"
+)
+
+// LibraryResult is the result of comparing one library.
+type LibraryResult struct {
+	Library     string       `json:"library"`
+	Status      Status       `json:"status"`
+	Differences []Difference `json:"differences,omitempty"`
+}
+
+// Report is the result of comparing the libraries of the two translators.
+type Report struct {
+	Libraries []LibraryResult `json:"libraries"`
+}
+
+// Compare matches the libraries from the reference translator and from this engine by name and
+// version, and diffs each pair.
+func Compare(reference, engine []*Library, opts Options) *Report {
+	refs := make(map[string]*Library, len(reference))
+	for _, l := range reference {
+		refs[l.Key()] = l
+	}
+	engs := make(map[string]*Library, len(engine))
+	for _, l := range engine {
+		engs[l.Key()] = l
+	}
+	var keys []string
+	for k := range refs {
+		keys = append(keys, k)
+	}
+	for k := range engs {
+		if _, ok := refs[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	r := &Report{}
+	for _, k := range keys {
+		ref, eng := refs[k], engs[k]
+		res := LibraryResult{Library: k}
+		switch {
+		case ref == nil:
+			res.Status = MissingReference
+		case eng == nil:
+			res.Status = MissingEngine
+		default:
+			res.Differences = Diff(ref, eng, opts)
+			res.Status = Match
+			if len(res.Differences) > 0 {
+				res.Status = Diverged
+			}
+		}
+		r.Libraries = append(r.Libraries, res)
+	}
+	return r
+}
+
+// Diverged returns true if the ELM of any library differs between the translators.
+func (r *Report) Diverged() bool {
+	for _, l := range r.Libraries {
+		if l.Status == Diverged {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the status of each library followed by its differences, one per line.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, l := range r.Libraries {
+		fmt.Fprintf(tw, "%s\t%s\t%d differences\n", l.Library, l.Status, len(l.Differences))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, l := range r.Libraries {
+		if len(l.Differences) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", l.Library)
+		for _, d := range l.Differences {
+			fmt.Fprintf(w, "  %s\n    reference: %s\n    engine:    %s\n", d.Path, orMissing(d.Reference), orMissing(d.Engine))
+		}
+	}
+	return nil
+}
+
+func orMissing(s string) string {
+	if s == "" {
+		return "(missing)"
+	}
+	return s
+}
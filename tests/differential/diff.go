@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package differential
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Difference is a divergence between the reference translator's ELM and this engine's ELM.
+type Difference struct {
+	// Path locates the difference in the canonical ELM, for example
+	// statements/Sum/expression/operand[1]/valueType.
+	Path string `json:"path"`
+	// Reference and Engine are the canonical JSON of the two values at Path, empty if the value is
+	// missing.
+	Reference string `json:"reference,omitempty"`
+	Engine    string `json:"engine,omitempty"`
+}
+
+// Options configures Diff.
+type Options struct {
+	// IgnoreFields are canonical field names that are not compared anywhere in the ELM, for example
+	// "distinct".
+	IgnoreFields []string
+}
+
+// optionalFields are only compared if both translators set them. The reference translator omits the
+// type of a parameter with a default, which this engine always infers.
+var optionalFields = map[string]bool{
+	"parameterType": true,
+}
+
+// Diff returns the differences between the canonical ELM of a library from the reference translator
+// and from this engine, sorted by path. A definition that only one of them has is a single
+// difference.
+func Diff(reference, engine *Library, opts Options) []Difference {
+	ignore := make(map[string]bool, len(opts.IgnoreFields))
+	for _, f := range opts.IgnoreFields {
+		ignore[f] = true
+	}
+	var keys []string
+	for k := range reference.Defs {
+		keys = append(keys, k)
+	}
+	for k := range engine.Defs {
+		if _, ok := reference.Defs[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var diffs []Difference
+	for _, k := range keys {
+		diffs = diffValues(k, reference.Defs[k], engine.Defs[k], ignore, diffs)
+	}
+	return diffs
+}
+
+func diffValues(path string, ref, eng any, ignore map[string]bool, diffs []Difference) []Difference {
+	refMap, refIsMap := ref.(map[string]any)
+	engMap, engIsMap := eng.(map[string]any)
+	if refIsMap && engIsMap && refMap["type"] == engMap["type"] {
+		var fields []string
+		for f := range refMap {
+			fields = append(fields, f)
+		}
+		for f := range engMap {
+			if _, ok := refMap[f]; !ok {
+				fields = append(fields, f)
+			}
+		}
+		sort.Strings(fields)
+		for _, f := range fields {
+			if ignore[f] {
+				continue
+			}
+			r, rok := refMap[f]
+			e, eok := engMap[f]
+			if optionalFields[f] && (!rok || !eok) {
+				continue
+			}
+			diffs = diffValues(path+"/"+f, r, e, ignore, diffs)
+		}
+		return diffs
+	}
+
+	refList, refIsList := ref.([]any)
+	engList, engIsList := eng.([]any)
+	if refIsList && engIsList {
+		for i := 0; i < max(len(refList), len(engList)); i++ {
+			var r, e any
+			if i < len(refList) {
+				r = refList[i]
+			}
+			if i < len(engList) {
+				e = engList[i]
+			}
+			diffs = diffValues(fmt.Sprintf("%s[%d]", path, i), r, e, ignore, diffs)
+		}
+		return diffs
+	}
+
+	if reflect.DeepEqual(ref, eng) {
+		return diffs
+	}
+	return append(diffs, Difference{Path: path, Reference: jsonString(ref), Engine: jsonString(eng)})
+}
+
+// jsonString returns the compact JSON of a canonical value, or an empty string for nil.
+func jsonString(v any) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,231 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package differential
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNormalize(t *testing.T) {
+	// The same library as ELM from the reference translator and as this engine's JSON.
+	reference := `{"library": {
+		"identifier": {"id": "Lib", "version": "1.0"},
+		"usings": {"def": [{"localIdentifier": "System", "uri": "urn:hl7-org:elm-types:r1"}]},
+		"valueSets": {"def": [{"localId": "1", "name": "VS", "id": "https://example.com/vs", "accessLevel": "Public"}]},
+		"statements": {"def": [{
+			"localId": "2", "name": "Low", "context": "Patient", "accessLevel": "Private",
+			"expression": {
+				"type": "Query",
+				"source": [{"alias": "O", "expression": {"type": "Retrieve", "dataType": "{http://hl7.org/fhir}Observation", "templateId": "t"}}],
+				"sort": {"by": [{"type": "ByDirection", "direction": "ascending"}]},
+				"return": {"distinct": false, "expression": {
+					"type": "As", "asTypeSpecifier": {"type": "ListTypeSpecifier", "elementType": {"type": "NamedTypeSpecifier", "name": "{urn:hl7-org:elm-types:r1}Integer"}},
+					"operand": {"type": "Null"}
+				}}
+			}
+		}]}
+	}}`
+	engine := `{"library": {
+		"identifier": {"local": "Lib", "qualified": "Lib", "version": "1.0"},
+		"valuesets": [{"name": "VS", "id": "https://example.com/vs", "accessLevel": "PUBLIC", "resultType": "System.ValueSet"}],
+		"statements": {"defs": [{
+			"type": "ExpressionDef", "name": "Low", "context": "Patient", "accessLevel": "PRIVATE",
+			"expression": {
+				"type": "Query",
+				"source": [{"type": "AliasedSource", "alias": "O", "source": {"type": "Retrieve", "dataType": "{http://hl7.org/fhir}Observation", "templateID": "t", "codeProperty": "code"}}],
+				"sort": {"byItems": [{"type": "SortByDirection", "direction": "ASCENDING"}]},
+				"return": {"expression": {
+					"type": "As", "asTypeSpecifier": "List<System.Integer>",
+					"operand": {"type": "Literal", "value": "null", "resultType": "System.Any"}
+				}}
+			}
+		}]}
+	}}`
+	want := &Library{
+		Name:    "Lib",
+		Version: "1.0",
+		Defs: map[string]any{
+			"valueSets/VS": map[string]any{"name": "VS", "id": "https://example.com/vs", "accessLevel": "public"},
+			"statements/Low": map[string]any{
+				"name": "Low", "context": "Patient", "accessLevel": "private",
+				"expression": map[string]any{
+					"type": "Query",
+					"source": []any{map[string]any{
+						"alias":      "O",
+						"expression": map[string]any{"type": "Retrieve", "dataType": "FHIR.Observation", "templateId": "t"},
+					}},
+					"sort": map[string]any{"by": []any{map[string]any{"type": "ByDirection", "direction": "asc"}}},
+					"return": map[string]any{"expression": map[string]any{
+						"type":    "As",
+						"asType":  "List<System.Integer>",
+						"operand": map[string]any{"type": "Null"},
+					}},
+				},
+			},
+		},
+	}
+	for name, elm := range map[string]string{"reference": reference, "engine": engine} {
+		t.Run(name, func(t *testing.T) {
+			got, err := Normalize([]byte(elm))
+			if err != nil {
+				t.Fatalf("Normalize() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Normalize() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNormalize_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		elm     string
+		wantErr string
+	}{
+		{name: "Invalid JSON", elm: `{`, wantErr: "failed to parse"},
+		{name: "No library", elm: `{"statements": {}}`, wantErr: "no library object"},
+		{name: "Unnamed library", elm: `{"library": {"statements": {}}}`, wantErr: "no library identifier"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Normalize([]byte(tc.elm))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Normalize() returned error %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	literal := func(v string) map[string]any {
+		return map[string]any{"type": "Literal", "valueType": "System.Integer", "value": v}
+	}
+	reference := &Library{Name: "Lib", Defs: map[string]any{
+		"parameters/P": map[string]any{"name": "P", "parameterType": "System.Integer"},
+		"statements/A": map[string]any{"name": "A", "expression": map[string]any{
+			"type": "Add", "operand": []any{literal("1"), literal("2")},
+		}},
+		"statements/B": map[string]any{"name": "B", "expression": map[string]any{
+			"type": "Query", "distinct": true, "source": []any{literal("1")},
+		}},
+		"statements/C": map[string]any{"name": "C", "expression": literal("1")},
+	}}
+	engine := &Library{Name: "Lib", Defs: map[string]any{
+		"parameters/P": map[string]any{"name": "P"},
+		"statements/A": map[string]any{"name": "A", "expression": map[string]any{
+			"type": "Add", "operand": []any{literal("1"), map[string]any{"type": "ToInteger", "operand": literal("2")}},
+		}},
+		"statements/B": map[string]any{"name": "B", "expression": map[string]any{
+			"type": "Query", "source": []any{literal("1"), literal("2")},
+		}},
+		"statements/D": map[string]any{"name": "D", "expression": literal("1")},
+	}}
+	want := []Difference{
+		{
+			Path:      "statements/A/expression/operand[1]",
+			Reference: `{"type":"Literal","value":"2","valueType":"System.Integer"}`,
+			Engine:    `{"operand":{"type":"Literal","value":"2","valueType":"System.Integer"},"type":"ToInteger"}`,
+		},
+		{
+			Path:   "statements/B/expression/source[1]",
+			Engine: `{"type":"Literal","value":"2","valueType":"System.Integer"}`,
+		},
+		{
+			Path:      "statements/C",
+			Reference: `{"expression":{"type":"Literal","value":"1","valueType":"System.Integer"},"name":"C"}`,
+		},
+		{
+			Path:   "statements/D",
+			Engine: `{"expression":{"type":"Literal","value":"1","valueType":"System.Integer"},"name":"D"}`,
+		},
+	}
+	got := Diff(reference, engine, Options{IgnoreFields: []string{"distinct"}})
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Diff() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	cql, err := os.ReadFile("testdata/Sample.cql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := Translate(context.Background(), []string{string(cql)})
+	if err != nil {
+		t.Fatalf("Translate() returned unexpected error: %v", err)
+	}
+	reference, err := LoadReference(os.DirFS("testdata"))
+	if err != nil {
+		t.Fatalf("LoadReference() returned unexpected error: %v", err)
+	}
+
+	got := Compare(reference, engine, Options{})
+	want := &Report{Libraries: []LibraryResult{{Library: "Sample|1.0.0", Status: Match}}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Compare() diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranslate_Error(t *testing.T) {
+	if _, err := Translate(context.Background(), []string{"library Bad define"}); err == nil {
+		t.Errorf("Translate() succeeded, want error")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	lib := func(name, value string) *Library {
+		return &Library{Name: name, Version: "1", Defs: map[string]any{"statements/A": value}}
+	}
+	reference := []*Library{lib("Same", "1"), lib("Changed", "1"), lib("ReferenceOnly", "1")}
+	engine := []*Library{lib("Same", "1"), lib("Changed", "2"), lib("EngineOnly", "1")}
+
+	got := Compare(reference, engine, Options{})
+	want := &Report{Libraries: []LibraryResult{
+		{Library: "Changed|1", Status: Diverged, Differences: []Difference{{Path: "statements/A", Reference: `"1"`, Engine: `"2"`}}},
+		{Library: "EngineOnly|1", Status: MissingReference},
+		{Library: "ReferenceOnly|1", Status: MissingEngine},
+		{Library: "Same|1", Status: Match},
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Compare() diff (-want +got):\n%s", diff)
+	}
+	if !got.Diverged() {
+		t.Errorf("Diverged() = false, want true")
+	}
+
+	var text bytes.Buffer
+	if err := got.WriteText(&text); err != nil {
+		t.Fatalf("WriteText() returned unexpected error: %v", err)
+	}
+	for _, want := range []string{"Changed|1", "diverged", "missing_engine", "statements/A", `reference: "1"`, `engine:    "2"`} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("WriteText() = %q, want it to contain %q", text.String(), want)
+		}
+	}
+	var js bytes.Buffer
+	if err := got.WriteJSON(&js); err != nil {
+		t.Fatalf("WriteJSON() returned unexpected error: %v", err)
+	}
+	if !strings.Contains(js.String(), `"status": "missing_reference"`) {
+		t.Errorf("WriteJSON() = %q, want it to contain the missing_reference status", js.String())
+	}
+}
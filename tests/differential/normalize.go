@@ -0,0 +1,468 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package differential compares the ELM this engine's parser produces with the ELM of the HL7
+// reference translator, cql-to-elm from https://github.com/cqframework/clinical_quality_language.
+// Both are normalized into a canonical form so that only semantic divergences in the translation,
+// such as a missing implicit conversion or a different overload, are reported rather than the many
+// differences in how the two serialize ELM.
+package differential
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Library is the canonical form of a library's ELM.
+type Library struct {
+	// Name and Version are from the library's identifier.
+	Name    string
+	Version string
+	// Defs holds the canonical form of each library level definition, keyed by the section of the
+	// library and the name of the definition, for example "statements/Sum" or
+	// "valueSets/Glucose". Function definitions are keyed by their signature, for example
+	// "statements/Double(System.Integer)".
+	Defs map[string]any
+}
+
+// Key identifies the library, as name or name|version.
+func (l *Library) Key() string {
+	if l.Version == "" {
+		return l.Name
+	}
+	return l.Name + "|" + l.Version
+}
+
+// Normalize converts ELM JSON into its canonical form. It accepts both the JSON of the reference
+// translator and the ELM styled JSON of this engine, see model.MarshalLibraryJSON. In the
+// canonical form:
+//   - Fields that do not change the meaning of the ELM, like localId, annotation and result types,
+//     are dropped, as are false and empty fields.
+//   - Fields and node types are named as in ELM, for example operand rather than operands.
+//   - Type specifiers are replaced by their type name, for example asType "System.Integer", and
+//     qualified names like {urn:hl7-org:elm-types:r1}Integer by the model name System.Integer.
+//   - Enumerations are lower case, for example an accessLevel of "public".
+func Normalize(elmJSON []byte) (*Library, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(elmJSON, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse the ELM JSON: %w", err)
+	}
+	lib, ok := doc["library"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("the ELM JSON has no library object")
+	}
+
+	l := &Library{Defs: make(map[string]any)}
+	if id, ok := lib["identifier"].(map[string]any); ok {
+		l.Name = stringField(id, "id")
+		if l.Name == "" {
+			l.Name = stringField(id, "qualified")
+		}
+		l.Version = stringField(id, "version")
+	}
+	if l.Name == "" {
+		return nil, fmt.Errorf("the ELM JSON has no library identifier, only named libraries can be compared")
+	}
+
+	for section, field := range sections {
+		for _, def := range defs(lib, field.names...) {
+			if field.prepare != nil {
+				field.prepare(def)
+			}
+			c, ok := canonical("", def).(map[string]any)
+			if !ok {
+				continue
+			}
+			name := stringField(c, field.key)
+			if field.skip != nil && field.skip(c) {
+				continue
+			}
+			if section == "statements" && c["type"] == "FunctionDef" {
+				name += signature(c)
+			}
+			l.Defs[section+"/"+name] = c
+		}
+	}
+	return l, nil
+}
+
+// section describes how the definitions of one section of a library are found and keyed.
+type section struct {
+	// names are the field names of the section in ELM and in this engine's JSON.
+	names []string
+	// key is the canonical field that names each definition.
+	key string
+	// prepare renames the fields of a definition that are named differently in the two dialects,
+	// before the definition is converted to its canonical form.
+	prepare func(def map[string]any)
+	// skip returns true for definitions that are not compared.
+	skip func(def map[string]any) bool
+}
+
+var sections = map[string]section{
+	"usings": {
+		names: []string{"usings"},
+		key:   "localIdentifier",
+		// The reference translator includes the System model, which is implicit in this engine.
+		skip: func(def map[string]any) bool { return def["localIdentifier"] == "System" },
+	},
+	"includes": {
+		names: []string{"includes"},
+		key:   "localIdentifier",
+		prepare: func(def map[string]any) {
+			id, ok := def["identifier"].(map[string]any)
+			if !ok {
+				return
+			}
+			delete(def, "identifier")
+			def["localIdentifier"] = id["local"]
+			def["path"] = id["qualified"]
+			if v, ok := id["version"]; ok {
+				def["version"] = v
+			}
+		},
+	},
+	"parameters": {
+		names: []string{"parameters"},
+		key:   "name",
+		prepare: func(def map[string]any) {
+			if t, ok := def["resultType"]; ok {
+				def["parameterType"] = t
+			}
+		},
+	},
+	"codeSystems": {names: []string{"codeSystems"}, key: "name"},
+	"valueSets":   {names: []string{"valueSets", "valuesets"}, key: "name"},
+	"codes": {
+		names: []string{"codes"},
+		key:   "name",
+		prepare: func(def map[string]any) {
+			// The code of a CodeDef is its id in ELM.
+			if c, ok := def["code"]; ok {
+				delete(def, "code")
+				def["id"] = c
+			}
+		},
+	},
+	"concepts": {
+		names: []string{"concepts"},
+		key:   "name",
+		prepare: func(def map[string]any) {
+			if c, ok := def["codes"]; ok {
+				delete(def, "codes")
+				def["code"] = c
+			}
+		},
+	},
+	"statements": {
+		names: []string{"statements"},
+		key:   "name",
+		// The definition of each context, like define Patient: SingletonFrom([Patient]), is
+		// generated by the translators rather than translated from the CQL.
+		skip: func(def map[string]any) bool {
+			expr, _ := def["expression"].(map[string]any)
+			return def["name"] == def["context"] && expr["type"] == "SingletonFrom"
+		},
+	},
+}
+
+// defs returns the definitions of a section of the library. ELM wraps each section in an object
+// with a def list, while this engine's JSON uses a plain list, except for statements which are
+// wrapped in an object with a defs list.
+func defs(lib map[string]any, names ...string) []map[string]any {
+	var list []any
+	for _, name := range names {
+		switch v := lib[name].(type) {
+		case []any:
+			list = v
+		case map[string]any:
+			if d, ok := v["def"].([]any); ok {
+				list = d
+			} else if d, ok := v["defs"].([]any); ok {
+				list = d
+			}
+		}
+	}
+	var out []map[string]any
+	for _, item := range list {
+		if m, ok := item.(map[string]any); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// signature returns the operand types of a canonical FunctionDef, for example
+// "(System.Integer, System.String)".
+func signature(def map[string]any) string {
+	operands, _ := def["operand"].([]any)
+	var types []string
+	for _, op := range operands {
+		if m, ok := op.(map[string]any); ok {
+			types = append(types, stringField(m, "operandType"))
+		}
+	}
+	return "(" + strings.Join(types, ", ") + ")"
+}
+
+// droppedFields are fields that do not change the meaning of the ELM. The result types are
+// inferred differently by the two translators, and when they matter for the semantics of the ELM
+// they show up as a different conversion, overload or operator.
+var droppedFields = map[string]bool{
+	"annotation":          true,
+	"localId":             true,
+	"locator":             true,
+	"resultType":          true,
+	"resultTypeName":      true,
+	"resultTypeSpecifier": true,
+	"signature":           true,
+	"trackbacks":          true,
+	"trackerId":           true,
+}
+
+// renamedFields maps field names of this engine's JSON to their ELM names.
+var renamedFields = map[string]string{
+	"operands":      "operand",
+	"templateID":    "templateId",
+	"lowInclusive":  "lowClosed",
+	"highInclusive": "highClosed",
+	"byItems":       "by",
+	"elements":      "element",
+}
+
+// renamedTypes maps node types of this engine's JSON to their ELM names.
+var renamedTypes = map[string]string{
+	"ValuesetRef":      "ValueSetRef",
+	"SortByDirection":  "ByDirection",
+	"SortByColumn":     "ByColumn",
+	"SortByExpression": "ByExpression",
+}
+
+// implicitTypes are node types that ELM JSON omits, because they are the declared type of the
+// field, keyed by the field.
+var implicitTypes = map[string][]string{
+	"codeSystem": {"CodeSystemRef"},
+	"system":     {"CodeSystemRef"},
+	"code":       {"CodeRef", "Code"},
+	"source":     {"AliasedSource"},
+}
+
+// canonical returns the canonical form of an ELM value found in the named field, or nil if the
+// value is empty.
+func canonical(field string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		return canonicalNode(field, v)
+	case []any:
+		var out []any
+		for _, item := range v {
+			c := canonical(field, item)
+			if c == nil {
+				c = map[string]any{}
+			}
+			out = append(out, c)
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		return out
+	case string:
+		switch field {
+		case "accessLevel":
+			return strings.ToLower(v)
+		case "direction":
+			return sortDirection(v)
+		}
+		return qualifiedName(v)
+	case bool:
+		if !v {
+			return nil
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func canonicalNode(field string, node map[string]any) any {
+	typ, _ := node["type"].(string)
+	if t, ok := renamedTypes[typ]; ok {
+		typ = t
+	}
+
+	switch typ {
+	case "Literal":
+		// This engine represents null as a Literal of type Any, and gives the type of other
+		// literals as the result type rather than the value type.
+		if node["resultType"] == "System.Any" && node["value"] == "null" {
+			return map[string]any{"type": "Null"}
+		}
+		if _, ok := node["valueType"]; !ok {
+			node["valueType"] = node["resultType"]
+		}
+	case "AliasedSource":
+		if s, ok := node["source"]; ok {
+			delete(node, "source")
+			node["expression"] = s
+		}
+	case "List":
+		if l, ok := node["list"]; ok {
+			delete(node, "list")
+			node["element"] = l
+		}
+	case "Concept":
+		if c, ok := node["codes"]; ok {
+			delete(node, "codes")
+			node["code"] = c
+		}
+	case "ByExpression":
+		if e, ok := node["sortExpression"]; ok {
+			delete(node, "sortExpression")
+			node["expression"] = e
+		}
+	case "Property":
+		// ELM refers to an alias in the scope field, this engine in the source field.
+		if s, ok := node["source"].(map[string]any); ok && s["type"] == "AliasRef" {
+			delete(node, "source")
+			node["scope"] = s["name"]
+		}
+	case "Retrieve":
+		// A code property and the default code comparator only matter if there are codes.
+		if _, ok := node["codes"]; !ok {
+			delete(node, "codeProperty")
+		}
+		if node["codeComparator"] == "in" {
+			delete(node, "codeComparator")
+		}
+	case "ValueSetRef":
+		// This engine always preserves references to value sets rather than expanding them.
+		if node["preserve"] == true {
+			delete(node, "preserve")
+		}
+	case "OperandDef":
+		node["operandType"] = node["resultType"]
+	}
+
+	out := make(map[string]any)
+	for k, v := range node {
+		if droppedFields[k] {
+			continue
+		}
+		if k == "type" {
+			continue
+		}
+		if r, ok := renamedFields[k]; ok {
+			k = r
+		}
+		if name, ok := strings.CutSuffix(k, "TypeSpecifier"); ok {
+			k = name + "Type"
+			v = typeName(v)
+		}
+		if c := canonical(k, v); c != nil {
+			out[k] = c
+		}
+	}
+	if typ != "" && typ != "ExpressionDef" && typ != "OperandDef" && !slices.Contains(implicitTypes[field], typ) {
+		out["type"] = typ
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// typeName returns the name of a type specifier, in the form of model info names like
+// List<FHIR.Observation>. This engine's JSON already gives type specifiers by name.
+func typeName(v any) any {
+	spec, ok := v.(map[string]any)
+	if !ok {
+		return v
+	}
+	switch spec["type"] {
+	case "NamedTypeSpecifier":
+		return spec["name"]
+	case "ListTypeSpecifier":
+		return fmt.Sprintf("List<%v>", qualifiedName(typeName(spec["elementType"])))
+	case "IntervalTypeSpecifier":
+		return fmt.Sprintf("Interval<%v>", qualifiedName(typeName(spec["pointType"])))
+	case "ChoiceTypeSpecifier":
+		choices, _ := spec["choice"].([]any)
+		var names []string
+		for _, c := range choices {
+			names = append(names, fmt.Sprint(qualifiedName(typeName(c))))
+		}
+		sort.Strings(names)
+		return "Choice<" + strings.Join(names, ", ") + ">"
+	case "TupleTypeSpecifier":
+		elements, _ := spec["element"].([]any)
+		if len(elements) == 0 {
+			return "Tuple { }"
+		}
+		var names []string
+		for _, e := range elements {
+			if m, ok := e.(map[string]any); ok {
+				t := m["elementType"]
+				if t == nil {
+					t = m["type"]
+				}
+				names = append(names, fmt.Sprintf("%v %v", m["name"], qualifiedName(typeName(t))))
+			}
+		}
+		sort.Strings(names)
+		return "Tuple { " + strings.Join(names, ", ") + " }"
+	}
+	return v
+}
+
+// modelNames maps the URIs of the models to their names.
+var modelNames = map[string]string{
+	"urn:hl7-org:elm-types:r1": "System",
+	"http://hl7.org/fhir":      "FHIR",
+}
+
+// qualifiedName replaces a name qualified by a model URI, like {http://hl7.org/fhir}Observation,
+// with the model name, like FHIR.Observation. Other values are returned unchanged.
+func qualifiedName(v any) any {
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(s, "{") {
+		return v
+	}
+	uri, name, ok := strings.Cut(s[1:], "}")
+	if !ok {
+		return v
+	}
+	if model, ok := modelNames[uri]; ok {
+		return model + "." + name
+	}
+	return v
+}
+
+// sortDirection returns the canonical form of a sort direction, asc or desc.
+func sortDirection(d string) string {
+	switch strings.ToLower(d) {
+	case "asc", "ascending":
+		return "asc"
+	case "desc", "descending":
+		return "desc"
+	}
+	return d
+}
+
+func stringField(m map[string]any, field string) string {
+	s, _ := m[field].(string)
+	return s
+}
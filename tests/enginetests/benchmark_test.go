@@ -36,6 +36,14 @@ func BenchmarkInterpreter(b *testing.B) {
 			name: "Addition",
 			cql:  "1 + 2",
 		},
+		{
+			name: "Query",
+			cql:  "from ({1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}) A, ({1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}) B where A * B mod 3 = 0 and A + B > 5 return A * 2 + B",
+		},
+		{
+			name: "FHIRQuery",
+			cql:  "[Observation] O where O.status.value = 'final' and (O.effective as FHIR.dateTime).value before @2024-01-01",
+		},
 	}
 
 	for _, bc := range benchmarks {
@@ -63,5 +71,22 @@ func BenchmarkInterpreter(b *testing.B) {
 			forceBenchResult = force
 			b.ReportAllocs()
 		})
+
+		b.Run(bc.name+"Compiled", func(b *testing.B) {
+			prog, err := interpreter.Compile(parsedLibs, p.DataModel())
+			if err != nil {
+				b.Fatalf("Compile returned unexpected error: %v", err)
+			}
+			b.ResetTimer()
+			var force result.Libraries
+			for n := 0; n < b.N; n++ {
+				force, err = prog.Eval(context.Background(), config)
+				if err != nil {
+					b.Fatalf("Eval returned unexpected error: %v", err)
+				}
+			}
+			forceBenchResult = force
+			b.ReportAllocs()
+		})
 	}
 }
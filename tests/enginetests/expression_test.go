@@ -119,6 +119,50 @@ func TestRetrieves(t *testing.T) {
 				StaticType: &types.List{ElementType: &types.Named{TypeName: "FHIR.Observation"}},
 			}),
 		},
+		{
+			name: "Retrieve filtered by list of codes",
+			cql: dedent.Dedent(`
+			codesystem Diagnosis: 'https://example.com/cs/diagnosis'
+			codesystem Procedure: 'https://example.com/cs/procedure'
+			code Glucose: 'gluc' from Diagnosis
+			code SystolicBP: 'sys-bld-prs' from Procedure
+			code Unused: 'unused' from Diagnosis
+			define TESTRESULT: [Observation: { Glucose, SystolicBP, Unused }]`),
+			wantResult: newOrFatal(t, result.List{
+				Value: []result.Value{
+					newOrFatal(t, result.Named{Value: RetrieveFHIRResource(t, "Observation", "1"), RuntimeType: &types.Named{TypeName: "FHIR.Observation"}}),
+					newOrFatal(t, result.Named{Value: RetrieveFHIRResource(t, "Observation", "2"), RuntimeType: &types.Named{TypeName: "FHIR.Observation"}}),
+				},
+				StaticType: &types.List{ElementType: &types.Named{TypeName: "FHIR.Observation"}},
+			}),
+		},
+		{
+			name: "Retrieve filtered by code",
+			cql: dedent.Dedent(`
+			codesystem Diagnosis: 'https://example.com/cs/diagnosis'
+			code Glucose: 'gluc' from Diagnosis
+			define TESTRESULT: [Observation: Glucose]`),
+			wantResult: newOrFatal(t, result.List{
+				Value: []result.Value{
+					newOrFatal(t, result.Named{Value: RetrieveFHIRResource(t, "Observation", "2"), RuntimeType: &types.Named{TypeName: "FHIR.Observation"}}),
+				},
+				StaticType: &types.List{ElementType: &types.Named{TypeName: "FHIR.Observation"}},
+			}),
+		},
+		{
+			name: "Retrieve filtered by concept",
+			cql: dedent.Dedent(`
+			codesystem Procedure: 'https://example.com/cs/procedure'
+			code SystolicBP: 'sys-bld-prs' from Procedure
+			concept BP: { SystolicBP }
+			define TESTRESULT: [Observation: BP]`),
+			wantResult: newOrFatal(t, result.List{
+				Value: []result.Value{
+					newOrFatal(t, result.Named{Value: RetrieveFHIRResource(t, "Observation", "1"), RuntimeType: &types.Named{TypeName: "FHIR.Observation"}}),
+				},
+				StaticType: &types.List{ElementType: &types.Named{TypeName: "FHIR.Observation"}},
+			}),
+		},
 		{
 			name:       "Retrieve returns empty list",
 			cql:        "define TESTRESULT: [Binary]",
@@ -370,3 +370,202 @@ func TestInValueSetAndCodeSystem(t *testing.T) {
 		})
 	}
 }
+
+func TestSubsumes(t *testing.T) {
+	tests := []struct {
+		name       string
+		cql        string
+		wantModel  model.IExpression
+		wantResult result.Value
+	}{
+		{
+			name: "Code Subsumes descendant Code",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/diagnosis' version '1.0.0'
+			code BloodPressure: 'bld-prs' from CS
+			code Crisis: 'bld-prs-crisis' from CS
+			define TESTRESULT: Subsumes(BloodPressure, Crisis)`),
+			wantModel: &model.Subsumes{
+				BinaryExpression: &model.BinaryExpression{
+					Operands: []model.IExpression{
+						&model.CodeRef{Name: "BloodPressure", Expression: model.ResultType(types.Code)},
+						&model.CodeRef{Name: "Crisis", Expression: model.ResultType(types.Code)},
+					},
+					Expression: model.ResultType(types.Boolean),
+				},
+			},
+			wantResult: newOrFatal(t, true),
+		},
+		{
+			name: "Code Subsumes itself",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/diagnosis' version '1.0.0'
+			code High: 'bld-prs-hi' from CS
+			define TESTRESULT: Subsumes(High, High)`),
+			wantResult: newOrFatal(t, true),
+		},
+		{
+			name: "Code does not Subsume ancestor Code",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/diagnosis' version '1.0.0'
+			code BloodPressure: 'bld-prs' from CS
+			code Crisis: 'bld-prs-crisis' from CS
+			define TESTRESULT: Subsumes(Crisis, BloodPressure)`),
+			wantResult: newOrFatal(t, false),
+		},
+		{
+			name: "Unrelated Codes",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/diagnosis' version '1.0.0'
+			code Sniffles: 'snfl' from CS
+			code Crisis: 'bld-prs-crisis' from CS
+			define TESTRESULT: Subsumes(Sniffles, Crisis)`),
+			wantResult: newOrFatal(t, false),
+		},
+		{
+			name: "Code SubsumedBy ancestor Code",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/diagnosis' version '1.0.0'
+			code BloodPressure: 'bld-prs' from CS
+			code Crisis: 'bld-prs-crisis' from CS
+			define TESTRESULT: SubsumedBy(Crisis, BloodPressure)`),
+			wantModel: &model.SubsumedBy{
+				BinaryExpression: &model.BinaryExpression{
+					Operands: []model.IExpression{
+						&model.CodeRef{Name: "Crisis", Expression: model.ResultType(types.Code)},
+						&model.CodeRef{Name: "BloodPressure", Expression: model.ResultType(types.Code)},
+					},
+					Expression: model.ResultType(types.Boolean),
+				},
+			},
+			wantResult: newOrFatal(t, true),
+		},
+		{
+			name: "Concept Subsumes Concept",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/diagnosis' version '1.0.0'
+			code Sniffles: 'snfl' from CS
+			code BloodPressure: 'bld-prs' from CS
+			code High: 'bld-prs-hi' from CS
+			concept Ancestors: { Sniffles, BloodPressure }
+			concept Descendants: { High }
+			define TESTRESULT: Subsumes(Ancestors, Descendants)`),
+			wantResult: newOrFatal(t, true),
+		},
+		{
+			name: "Null Subsumes Code",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/diagnosis' version '1.0.0'
+			code High: 'bld-prs-hi' from CS
+			define TESTRESULT: Subsumes(null as Code, High)`),
+			wantResult: newOrFatal(t, nil),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testCQL := dedent.Dedent(fmt.Sprintf(`
+				library TESTLIB version '1.0.0'
+				using FHIR version '4.0.1'
+				%v`, tc.cql))
+			p := newFHIRParser(t)
+			parsedLibs, err := p.Libraries(context.Background(), addFHIRHelpersLib(t, testCQL), parser.Config{})
+			if err != nil {
+				t.Fatalf("Parse returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantModel, getTESTRESULTModel(t, parsedLibs)); tc.wantModel != nil && diff != "" {
+				t.Errorf("Parse diff (-want +got):\n%s", diff)
+			}
+
+			results, err := interpreter.Eval(context.Background(), parsedLibs, defaultInterpreterConfig(t, p))
+			if err != nil {
+				t.Fatalf("Eval returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResult, getTESTRESULT(t, results), protocmp.Transform()); diff != "" {
+				t.Errorf("Eval diff (-want +got)\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		name       string
+		cql        string
+		wantModel  model.IExpression
+		wantResult result.Value
+	}{
+		{
+			name: "Translate to all target CodeSystems",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/procedure'
+			code SystolicBP: 'sys-bld-prs' from CS
+			define TESTRESULT: Translate(SystolicBP, 'https://example.com/cm/procedure')`),
+			wantModel: &model.Translate{
+				NaryExpression: &model.NaryExpression{
+					Operands: []model.IExpression{
+						&model.CodeRef{Name: "SystolicBP", Expression: model.ResultType(types.Code)},
+						model.NewLiteral("https://example.com/cm/procedure", types.String),
+					},
+					Expression: model.ResultType(&types.List{ElementType: types.Code}),
+				},
+			},
+			wantResult: newOrFatal(t, result.List{
+				Value: []result.Value{
+					newOrFatal(t, result.Code{System: "http://loinc.org", Code: "8480-6", Display: "Systolic blood pressure"}),
+					newOrFatal(t, result.Code{System: "http://snomed.info/sct", Code: "271649006", Display: "Systolic blood pressure"}),
+				},
+				StaticType: &types.List{ElementType: types.Code},
+			}),
+		},
+		{
+			name: "Translate to target CodeSystem with ConceptMap version",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/procedure'
+			code SystolicBP: 'sys-bld-prs' from CS
+			define TESTRESULT: Translate(SystolicBP, 'https://example.com/cm/procedure|1.0.0', 'http://loinc.org')`),
+			wantResult: newOrFatal(t, result.List{
+				Value: []result.Value{
+					newOrFatal(t, result.Code{System: "http://loinc.org", Code: "8480-6", Display: "Systolic blood pressure"}),
+				},
+				StaticType: &types.List{ElementType: types.Code},
+			}),
+		},
+		{
+			name: "Unmatched code translates to empty list",
+			cql: dedent.Dedent(`
+			codesystem CS: 'https://example.com/cs/procedure'
+			code Vitals: 'vitls' from CS
+			define TESTRESULT: Translate(Vitals, 'https://example.com/cm/procedure')`),
+			wantResult: newOrFatal(t, result.List{Value: []result.Value{}, StaticType: &types.List{ElementType: types.Code}}),
+		},
+		{
+			name:       "Null code",
+			cql:        `define TESTRESULT: Translate(null as Code, 'https://example.com/cm/procedure')`,
+			wantResult: newOrFatal(t, nil),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testCQL := dedent.Dedent(fmt.Sprintf(`
+				library TESTLIB version '1.0.0'
+				using FHIR version '4.0.1'
+				%v`, tc.cql))
+			p := newFHIRParser(t)
+			parsedLibs, err := p.Libraries(context.Background(), addFHIRHelpersLib(t, testCQL), parser.Config{})
+			if err != nil {
+				t.Fatalf("Parse returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantModel, getTESTRESULTModel(t, parsedLibs)); tc.wantModel != nil && diff != "" {
+				t.Errorf("Parse diff (-want +got):\n%s", diff)
+			}
+
+			results, err := interpreter.Eval(context.Background(), parsedLibs, defaultInterpreterConfig(t, p))
+			if err != nil {
+				t.Fatalf("Eval returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantResult, getTESTRESULT(t, results), protocmp.Transform()); diff != "" {
+				t.Errorf("Eval diff (-want +got)\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Conformance runs the HL7 CQL specification tests against the engine and writes a conformance
+// report with the pass rate of each operator. By default the tests imported into
+// third_party/cqltests are run.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/google/cql/tests/spectests/conformance"
+	"github.com/google/cql/tests/spectests/third_party/cqltests"
+)
+
+var (
+	testsDir         = flag.String("tests_dir", "", "(Optional) A directory of cql-tests .xml or .json files to run. Defaults to the tests imported into third_party/cqltests.")
+	format           = flag.String("format", "text", "(Optional) The format of the report, one of text, json or markdown.")
+	outputPath       = flag.String("output", "", "(Optional) The file to write the report to. Defaults to stdout.")
+	verbose          = flag.Bool("verbose", false, "(Optional) If true the text report lists every failing test.")
+	baselinePath     = flag.String("baseline", "", "(Optional) A JSON report of an earlier run. If any test that passed in it no longer passes, the tests are listed and conformance exits with an error.")
+	failOnUnexpected = flag.Bool("fail_on_unexpected", false, "(Optional) If true conformance exits with an error if any test fails that is not in the spectests exclusions.")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(context.Background()); err != nil {
+		log.Fatalf("CQL conformance failed with an error: %v", err)
+	}
+}
+
+func run(ctx context.Context) error {
+	fsys := cqltests.XMLTests
+	suites, err := conformance.LoadSuites(fsys)
+	if *testsDir != "" {
+		suites, err = conformance.LoadSuites(os.DirFS(*testsDir))
+	}
+	if err != nil {
+		return err
+	}
+
+	report := conformance.Run(ctx, suites, conformance.Config{})
+
+	var w io.Writer = os.Stdout
+	if *outputPath != "" {
+		f, err := os.Create(*outputPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "text":
+		err = report.WriteText(w, *verbose)
+	case "json":
+		err = report.WriteJSON(w)
+	case "markdown":
+		err = report.WriteMarkdown(w)
+	default:
+		return fmt.Errorf("--format must be one of text, json or markdown, got %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *baselinePath != "" {
+		f, err := os.Open(*baselinePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		baseline, err := conformance.ReadReport(f)
+		if err != nil {
+			return err
+		}
+		if regressions := report.Regressions(baseline); len(regressions) > 0 {
+			for _, r := range regressions {
+				fmt.Fprintf(os.Stderr, "regression: %s %s %s: %s %s\n", r.File, r.Group, r.Name, r.Status, r.Message)
+			}
+			return fmt.Errorf("%d tests that passed in %s no longer pass", len(regressions), *baselinePath)
+		}
+	}
+	if *failOnUnexpected {
+		if unexpected := report.UnexpectedFailures(); len(unexpected) > 0 {
+			for _, r := range unexpected {
+				fmt.Fprintf(os.Stderr, "unexpected failure: %s %s %s: %s %s\n", r.File, r.Group, r.Name, r.Status, r.Message)
+			}
+			return errors.New("tests failed that are not in the spectests exclusions")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/cql/tests/spectests/exclusions"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+const xmlSuite = `<?xml version="1.0" encoding="utf-8"?>
+<tests xmlns="http://hl7.org/fhirpath/tests" name="ArithmeticTest">
+	<group name="Add">
+		<test name="AddPass">
+			<expression>1 + 1</expression>
+			<output>2</output>
+		</test>
+		<test name="AddFail">
+			<expression>1 + 1</expression>
+			<output>3</output>
+		</test>
+		<test name="AddNoOutput">
+			<expression>1 + 1</expression>
+		</test>
+	</group>
+	<group name="Unsupported">
+		<test name="UnknownFunction">
+			<expression>NotAFunction(1)</expression>
+			<output>1</output>
+		</test>
+		<test name="Invalid">
+			<expression invalid="true">1 + 'a'</expression>
+		</test>
+	</group>
+</tests>`
+
+const jsonSuite = `{"name": "StringTest", "group": [{"name": "Concatenate", "test": [
+	{"name": "ConcatPass", "expression": "'a' + 'b'", "output": "'ab'"},
+	{"name": "ConcatTyped", "expression": {"text": "'a' & null"}, "output": [{"text": "'a'", "type": "string"}]},
+	{"name": "ConcatInvalid", "expression": {"text": "'a' + 'b'", "invalid": "true"}}
+]}]}`
+
+func TestLoadSuites(t *testing.T) {
+	fsys := fstest.MapFS{
+		"b.xml":     {Data: []byte(xmlSuite)},
+		"a.json":    {Data: []byte(jsonSuite)},
+		"README.md": {Data: []byte("ignored")},
+	}
+	suites, err := LoadSuites(fsys)
+	if err != nil {
+		t.Fatalf("LoadSuites() returned unexpected error: %v", err)
+	}
+	var got []string
+	for _, s := range suites {
+		for _, g := range s.Tests.Group {
+			for _, tc := range g.Test {
+				got = append(got, strings.Join([]string{s.File, g.Name, tc.Name, tc.Expression.Text, string(tc.Expression.Invalid)}, "|"))
+			}
+		}
+	}
+	want := []string{
+		"a.json|Concatenate|ConcatPass|'a' + 'b'|",
+		"a.json|Concatenate|ConcatTyped|'a' & null|",
+		"a.json|Concatenate|ConcatInvalid|'a' + 'b'|true",
+		"b.xml|Add|AddPass|1 + 1|",
+		"b.xml|Add|AddFail|1 + 1|",
+		"b.xml|Add|AddNoOutput|1 + 1|",
+		"b.xml|Unsupported|UnknownFunction|NotAFunction(1)|",
+		"b.xml|Unsupported|Invalid|1 + 'a'|true",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("LoadSuites() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadSuites_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr string
+	}{
+		{
+			name:    "no tests",
+			fsys:    fstest.MapFS{"README.md": {Data: []byte("")}},
+			wantErr: "no .xml or .json test files found",
+		},
+		{
+			name:    "invalid JSON",
+			fsys:    fstest.MapFS{"a.json": {Data: []byte("{")}},
+			wantErr: "failed to parse a.json",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadSuites(tc.fsys)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("LoadSuites() returned error %v, want it to contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func runSuites(t *testing.T) *Report {
+	t.Helper()
+	suites, err := LoadSuites(fstest.MapFS{"a.json": {Data: []byte(jsonSuite)}, "b.xml": {Data: []byte(xmlSuite)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Run(context.Background(), suites, Config{
+		Exclusions: map[string]exclusions.XMLTestFileExclusions{
+			"b.xml": {GroupExcludes: []string{"Unsupported"}, NamesExcludes: []string{"AddPass"}},
+		},
+	})
+}
+
+func TestRun(t *testing.T) {
+	r := runSuites(t)
+	want := []Result{
+		{File: "a.json", Group: "Concatenate", Name: "ConcatPass", Want: "'ab'", Status: Pass},
+		{File: "a.json", Group: "Concatenate", Name: "ConcatTyped", Want: "'a'", Status: Pass},
+		{File: "a.json", Group: "Concatenate", Name: "ConcatInvalid", Status: Fail},
+		{File: "b.xml", Group: "Add", Name: "AddPass", Want: "2", Status: Pass, Excluded: true},
+		{File: "b.xml", Group: "Add", Name: "AddFail", Want: "3", Status: Fail},
+		{File: "b.xml", Group: "Add", Name: "AddNoOutput", Status: Skip},
+		{File: "b.xml", Group: "Unsupported", Name: "UnknownFunction", Want: "1", Status: Error, Excluded: true},
+		{File: "b.xml", Group: "Unsupported", Name: "Invalid", Status: Pass, Excluded: true},
+	}
+	if diff := cmp.Diff(want, r.Results, cmpopts.IgnoreFields(Result{}, "Expression", "Got", "Message")); diff != "" {
+		t.Errorf("Run() returned unexpected diff (-want +got):\n%s", diff)
+	}
+	if got := r.Results[4].Message; got != `got {"@type":"System.Integer","value":2}, want {"@type":"System.Integer","value":3}` {
+		t.Errorf("Run() returned message %q for AddFail", got)
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := runSuites(t)
+
+	if diff := cmp.Diff(Summary{Pass: 4, Fail: 2, Error: 1, Skip: 1}, r.Summary()); diff != "" {
+		t.Errorf("Summary() returned unexpected diff (-want +got):\n%s", diff)
+	}
+	wantOps := []OperatorSummary{
+		{File: "a.json", Operator: "Concatenate", Summary: Summary{Pass: 2, Fail: 1}},
+		{File: "b.xml", Operator: "Add", Summary: Summary{Pass: 1, Fail: 1, Skip: 1}},
+		{File: "b.xml", Operator: "Unsupported", Summary: Summary{Pass: 1, Error: 1}},
+	}
+	if diff := cmp.Diff(wantOps, r.Operators()); diff != "" {
+		t.Errorf("Operators() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	names := func(rs []Result) []string {
+		var n []string
+		for _, res := range rs {
+			n = append(n, res.Name)
+		}
+		return n
+	}
+	if diff := cmp.Diff([]string{"ConcatInvalid", "AddFail"}, names(r.UnexpectedFailures())); diff != "" {
+		t.Errorf("UnexpectedFailures() returned unexpected diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"AddPass", "Invalid"}, names(r.StaleExclusions())); diff != "" {
+		t.Errorf("StaleExclusions() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// A baseline in which AddFail passed, round tripped through JSON.
+	baseline := &Report{Results: append([]Result(nil), r.Results...)}
+	baseline.Results[4].Status = Pass
+	var buf bytes.Buffer
+	if err := baseline.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := ReadReport(&buf)
+	if err != nil {
+		t.Fatalf("ReadReport() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"AddFail"}, names(r.Regressions(baseline))); diff != "" {
+		t.Errorf("Regressions() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReport_Write(t *testing.T) {
+	r := runSuites(t)
+
+	var text bytes.Buffer
+	if err := r.WriteText(&text, true); err != nil {
+		t.Fatalf("WriteText() returned unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"CQL conformance: 4/7 passed (57.1%), 2 failed, 1 errors, 1 skipped",
+		"b.xml   Add          1     1     0      1     50.0%",
+		"b.xml Add AddFail: fail: got",
+		"2 excluded tests pass, their exclusions can be removed:",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("WriteText() = %s\nwant it to contain %q", text.String(), want)
+		}
+	}
+
+	var md bytes.Buffer
+	if err := r.WriteMarkdown(&md); err != nil {
+		t.Fatalf("WriteMarkdown() returned unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"| a.json | Concatenate | 2 | 1 | 0 | 0 | 66.7% |",
+		"## Failures",
+		"| a.json | Concatenate | ConcatInvalid | fail | the expression is invalid, but evaluated without an error |",
+	} {
+		if !strings.Contains(md.String(), want) {
+			t.Errorf("WriteMarkdown() = %s\nwant it to contain %q", md.String(), want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Report holds the results of a conformance run.
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Summary counts the results of a set of tests by status.
+type Summary struct {
+	Pass  int `json:"pass"`
+	Fail  int `json:"fail"`
+	Error int `json:"error"`
+	Skip  int `json:"skip"`
+}
+
+func (s *Summary) add(st Status) {
+	switch st {
+	case Pass:
+		s.Pass++
+	case Fail:
+		s.Fail++
+	case Error:
+		s.Error++
+	case Skip:
+		s.Skip++
+	}
+}
+
+// Total returns the number of tests.
+func (s Summary) Total() int { return s.Pass + s.Fail + s.Error + s.Skip }
+
+// PassRate returns the percentage of the tests that could be checked that passed. Skipped tests
+// are not counted.
+func (s Summary) PassRate() float64 {
+	checked := s.Pass + s.Fail + s.Error
+	if checked == 0 {
+		return 0
+	}
+	return 100 * float64(s.Pass) / float64(checked)
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d/%d passed (%.1f%%), %d failed, %d errors, %d skipped", s.Pass, s.Pass+s.Fail+s.Error, s.PassRate(), s.Fail, s.Error, s.Skip)
+}
+
+// OperatorSummary is the summary of the tests of a group, which in the cql-tests each cover one
+// operator.
+type OperatorSummary struct {
+	File     string `json:"file"`
+	Operator string `json:"operator"`
+	Summary
+}
+
+// Summary returns the summary of all tests.
+func (r *Report) Summary() Summary {
+	var s Summary
+	for _, res := range r.Results {
+		s.add(res.Status)
+	}
+	return s
+}
+
+// Operators returns the summary of each operator, in the order the tests were run.
+func (r *Report) Operators() []OperatorSummary {
+	var ops []OperatorSummary
+	index := make(map[[2]string]int)
+	for _, res := range r.Results {
+		k := [2]string{res.File, res.Group}
+		i, ok := index[k]
+		if !ok {
+			i = len(ops)
+			index[k] = i
+			ops = append(ops, OperatorSummary{File: res.File, Operator: res.Group})
+		}
+		ops[i].add(res.Status)
+	}
+	return ops
+}
+
+// Failures returns the tests that failed or errored, in the order they were run.
+func (r *Report) Failures() []Result {
+	return r.filter(func(res Result) bool { return res.Status == Fail || res.Status == Error })
+}
+
+// UnexpectedFailures returns the tests that failed or errored but are not excluded, which usually
+// means a regression in the engine.
+func (r *Report) UnexpectedFailures() []Result {
+	return r.filter(func(res Result) bool { return (res.Status == Fail || res.Status == Error) && !res.Excluded })
+}
+
+// StaleExclusions returns the tests that are excluded but pass, whose exclusions can be removed.
+func (r *Report) StaleExclusions() []Result {
+	return r.filter(func(res Result) bool { return res.Status == Pass && res.Excluded })
+}
+
+// Regressions returns the tests that passed in the baseline report but no longer pass.
+func (r *Report) Regressions(baseline *Report) []Result {
+	passed := make(map[[3]string]bool)
+	for _, res := range baseline.Results {
+		if res.Status == Pass {
+			passed[[3]string{res.File, res.Group, res.Name}] = true
+		}
+	}
+	return r.filter(func(res Result) bool {
+		return res.Status != Pass && passed[[3]string{res.File, res.Group, res.Name}]
+	})
+}
+
+func (r *Report) filter(keep func(Result) bool) []Result {
+	var out []Result
+	for _, res := range r.Results {
+		if keep(res) {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// ReadReport reads a report written by WriteJSON, for example to compare against as a baseline.
+func ReadReport(rd io.Reader) (*Report, error) {
+	var r Report
+	if err := json.NewDecoder(rd).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to read conformance report: %w", err)
+	}
+	return &r, nil
+}
+
+// WriteJSON writes the report as JSON, with the overall and per operator summaries before the
+// results of every test.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Summary   Summary           `json:"summary"`
+		Operators []OperatorSummary `json:"operators"`
+		Results   []Result          `json:"results"`
+	}{r.Summary(), r.Operators(), r.Results})
+}
+
+// WriteText writes the summaries as plain text tables. If verbose, every failing test is listed.
+func (r *Report) WriteText(w io.Writer, verbose bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "CQL conformance: %s\n\n", r.Summary())
+	fmt.Fprintf(tw, "FILE\tOPERATOR\tPASS\tFAIL\tERROR\tSKIP\tPASS RATE\n")
+	for _, op := range r.Operators() {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%.1f%%\n", op.File, op.Operator, op.Pass, op.Fail, op.Error, op.Skip, op.PassRate())
+	}
+	if verbose {
+		if failures := r.Failures(); len(failures) > 0 {
+			fmt.Fprintf(tw, "\nFAILURES\n")
+			for _, res := range failures {
+				fmt.Fprintf(tw, "%s %s %s: %s: %s\n", res.File, res.Group, res.Name, res.Status, oneLine(res.Message))
+			}
+		}
+	}
+	if stale := r.StaleExclusions(); len(stale) > 0 {
+		fmt.Fprintf(tw, "\n%d excluded tests pass, their exclusions can be removed:\n", len(stale))
+		for _, res := range stale {
+			fmt.Fprintf(tw, "%s %s %s\n", res.File, res.Group, res.Name)
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteMarkdown writes the summaries as Markdown tables, with an operator's failing tests listed
+// under the table.
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# CQL Conformance\n\n%s\n\n", r.Summary())
+	fmt.Fprintf(&b, "| File | Operator | Pass | Fail | Error | Skip | Pass rate |\n")
+	fmt.Fprintf(&b, "| --- | --- | ---: | ---: | ---: | ---: | ---: |\n")
+	for _, op := range r.Operators() {
+		fmt.Fprintf(&b, "| %s | %s | %d | %d | %d | %d | %.1f%% |\n", op.File, markdownEscape(op.Operator), op.Pass, op.Fail, op.Error, op.Skip, op.PassRate())
+	}
+	if failures := r.Failures(); len(failures) > 0 {
+		fmt.Fprintf(&b, "\n## Failures\n\n")
+		fmt.Fprintf(&b, "| File | Operator | Test | Status | Message |\n")
+		fmt.Fprintf(&b, "| --- | --- | --- | --- | --- |\n")
+		for _, res := range failures {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", res.File, markdownEscape(res.Group), markdownEscape(res.Name), res.Status, markdownEscape(oneLine(res.Message)))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// oneLine joins the lines of s, so that multi-line error messages fit in a table row.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func markdownEscape(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
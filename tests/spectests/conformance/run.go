@@ -0,0 +1,194 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/cql"
+	"github.com/google/cql/result"
+	"github.com/google/cql/tests/spectests/exclusions"
+	"github.com/google/cql/tests/spectests/models"
+)
+
+// Status is the outcome of a single test.
+type Status string
+
+const (
+	// Pass is a test whose expression evaluated to its expected output, or an invalid expression
+	// that failed to parse or evaluate as expected.
+	Pass Status = "pass"
+	// Fail is a test whose expression evaluated to a different value than its expected output, or
+	// an invalid expression that evaluated without an error.
+	Fail Status = "fail"
+	// Error is a test whose expression or expected output failed to parse or evaluate.
+	Error Status = "error"
+	// Skip is a test without an expected output, so there is nothing to check.
+	Skip Status = "skip"
+)
+
+// testLibrary is the name of the library each test is evaluated in.
+const testLibrary = "CQL_Test"
+
+// Config configures Run.
+type Config struct {
+	// Exclusions are the tests expected to fail, keyed by file name. They do not change how tests
+	// are run, but are recorded in the results so that stale exclusions and unexpected failures can
+	// be reported. If nil exclusions.XMLTestFileExclusionDefinitions is used.
+	Exclusions map[string]exclusions.XMLTestFileExclusions
+	// EvaluationTimestamp is the time used by operators like Now() and Today(). If zero the
+	// timestamp used by the spectests is used.
+	EvaluationTimestamp time.Time
+	// Timeout limits how long a single test may take, so that a test that hangs the engine is
+	// reported as an error instead of stopping the run. If zero each test may take 10 seconds.
+	Timeout time.Duration
+}
+
+// Result is the result of a single test.
+type Result struct {
+	File       string `json:"file"`
+	Group      string `json:"group"`
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	// Want is the expected output of the test, empty for tests of invalid expressions.
+	Want string `json:"want,omitempty"`
+	// Got is the result of the expression if it evaluated.
+	Got    string `json:"got,omitempty"`
+	Status Status `json:"status"`
+	// Message explains a Fail or Error.
+	Message string `json:"message,omitempty"`
+	// Excluded is true if the test is in the exclusions, so it is expected not to pass.
+	Excluded bool `json:"excluded,omitempty"`
+}
+
+// Run runs the tests of the suites, in order, and returns their results in a Report.
+func Run(ctx context.Context, suites []Suite, cfg Config) *Report {
+	if cfg.Exclusions == nil {
+		cfg.Exclusions = exclusions.XMLTestFileExclusionDefinitions()
+	}
+	if cfg.EvaluationTimestamp.IsZero() {
+		cfg.EvaluationTimestamp = time.Date(2024, 1, 1, 0, 0, 0, 0, time.FixedZone("Fixed", 4*60*60))
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	r := &Report{}
+	for _, s := range suites {
+		excl := cfg.Exclusions[s.File]
+		for _, g := range s.Tests.Group {
+			for _, tc := range g.Test {
+				res := runTest(ctx, tc, cfg)
+				res.File = s.File
+				res.Group = g.Name
+				res.Excluded = slices.Contains(excl.GroupExcludes, g.Name) || slices.Contains(excl.NamesExcludes, tc.Name)
+				r.Results = append(r.Results, res)
+			}
+		}
+	}
+	return r
+}
+
+// runTest runs a single test. The expression and the expected output are evaluated as the got and
+// want definitions of a library, and their results compared with result.Value.Equal.
+func runTest(ctx context.Context, tc models.Test, cfg Config) Result {
+	res := Result{Name: tc.Name, Expression: strings.TrimSpace(tc.Expression.Text)}
+	invalid := tc.Expression.Invalid == models.InvalidTypeTrue || tc.Expression.Invalid == models.InvalidTypeSemantic
+	if !invalid && len(tc.Output) == 0 {
+		res.Status = Skip
+		res.Message = "no output defined for this test case"
+		return res
+	}
+
+	lib := fmt.Sprintf("library %s\ndefine \"got\": %s", testLibrary, tc.Expression.Text)
+	if !invalid {
+		res.Want = strings.TrimSpace(tc.Output[0].Text)
+		lib += fmt.Sprintf("\ndefine \"want\": %s", tc.Output[0].Text)
+	}
+	results, err := evaluate(ctx, lib, cfg)
+	if invalid {
+		if err != nil {
+			res.Status = Pass
+			return res
+		}
+		res.Status = Fail
+		res.Got = valueString(results["got"])
+		res.Message = "the expression is invalid, but evaluated without an error"
+		return res
+	}
+	if err != nil {
+		res.Status = Error
+		res.Message = err.Error()
+		return res
+	}
+
+	got, want := results["got"], results["want"]
+	res.Got = valueString(got)
+	if got.Equal(want) {
+		res.Status = Pass
+		return res
+	}
+	res.Status = Fail
+	res.Message = fmt.Sprintf("got %s, want %s", res.Got, valueString(want))
+	return res
+}
+
+// evaluate parses and evaluates the library, and returns the results of its definitions. The
+// evaluation is abandoned if it takes longer than the timeout.
+func evaluate(ctx context.Context, lib string, cfg Config) (map[string]result.Value, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	type evalResult struct {
+		defs map[string]result.Value
+		err  error
+	}
+	done := make(chan evalResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- evalResult{err: fmt.Errorf("the engine panicked: %v", r)}
+			}
+		}()
+		elm, err := cql.Parse(ctx, []string{lib}, cql.ParseConfig{})
+		if err != nil {
+			done <- evalResult{err: err}
+			return
+		}
+		libs, err := elm.Eval(ctx, nil, cql.EvalConfig{EvaluationTimestamp: cfg.EvaluationTimestamp})
+		if err != nil {
+			done <- evalResult{err: err}
+			return
+		}
+		done <- evalResult{defs: libs[result.LibKey{Name: testLibrary}]}
+	}()
+	select {
+	case r := <-done:
+		return r.defs, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("the test did not finish within %v", cfg.Timeout)
+	}
+}
+
+// valueString returns the JSON form of a CQL value, which is how results are shown in reports.
+func valueString(v result.Value) string {
+	b, err := v.MarshalJSON()
+	if err != nil {
+		return fmt.Sprintf("%v", v.GolangValue())
+	}
+	return string(b)
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conformance runs the HL7 CQL specification tests from
+// https://github.com/cqframework/cql-tests against the engine, and reports which tests and
+// operators pass. Unlike the spectests, which fail on any test that is not excluded, the reports
+// track the conformance of the engine as a whole, so that gaps in coverage can be followed over
+// time.
+package conformance
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/google/cql/tests/spectests/models"
+)
+
+// Suite is a file of tests, in which each group of tests covers one operator.
+type Suite struct {
+	// File is the name of the file the tests were loaded from.
+	File  string
+	Tests models.Tests
+}
+
+// LoadSuites loads the test files in the root of fsys, sorted by name. Files ending in .xml must
+// match the testSchema.xsd of cql-tests. Files ending in .json hold the same tests in JSON, with
+// each element and attribute of the XML as a field of the same name:
+//
+//	{"name": "CqlArithmeticFunctionsTest", "group": [{"name": "Abs", "test": [
+//		{"name": "AbsNull", "expression": "Abs(null as Integer)", "output": "null"}
+//	]}]}
+//
+// An expression may also be an object with text and invalid fields, and the output a list of
+// objects with text and type fields. Other files are ignored.
+func LoadSuites(fsys fs.FS) ([]Suite, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var suites []Suite
+	for _, e := range entries {
+		ext := path.Ext(e.Name())
+		if e.IsDir() || (ext != ".xml" && ext != ".json") {
+			continue
+		}
+		b, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		s := Suite{File: e.Name()}
+		if ext == ".xml" {
+			err = xml.Unmarshal(b, &s.Tests)
+		} else {
+			s.Tests, err = parseJSON(b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", e.Name(), err)
+		}
+		suites = append(suites, s)
+	}
+	if len(suites) == 0 {
+		return nil, fmt.Errorf("no .xml or .json test files found")
+	}
+	sort.Slice(suites, func(i, j int) bool { return suites[i].File < suites[j].File })
+	return suites, nil
+}
+
+// jsonTests is the JSON form of models.Tests.
+type jsonTests struct {
+	Name  string `json:"name"`
+	Group []struct {
+		Name string `json:"name"`
+		Test []struct {
+			Name       string          `json:"name"`
+			Expression jsonExpression  `json:"expression"`
+			Output     json.RawMessage `json:"output"`
+		} `json:"test"`
+	} `json:"group"`
+}
+
+// jsonExpression is an expression given as a string, or as an object with text and invalid
+// fields.
+type jsonExpression struct {
+	Text    string             `json:"text"`
+	Invalid models.InvalidType `json:"invalid"`
+}
+
+func (e *jsonExpression) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &e.Text); err == nil {
+		return nil
+	}
+	type plain jsonExpression
+	return json.Unmarshal(b, (*plain)(e))
+}
+
+// jsonOutput is an output given as a string, or as an object with text and type fields.
+type jsonOutput struct {
+	Text string            `json:"text"`
+	Type models.OutputType `json:"type"`
+}
+
+func (o *jsonOutput) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &o.Text); err == nil {
+		return nil
+	}
+	type plain jsonOutput
+	return json.Unmarshal(b, (*plain)(o))
+}
+
+func parseJSON(b []byte) (models.Tests, error) {
+	var jt jsonTests
+	if err := json.Unmarshal(b, &jt); err != nil {
+		return models.Tests{}, err
+	}
+	tests := models.Tests{Name: jt.Name}
+	for _, jg := range jt.Group {
+		g := models.Group{Name: jg.Name}
+		for _, jtc := range jg.Test {
+			tc := models.Test{
+				Name:       jtc.Name,
+				Expression: models.Expression{Text: jtc.Expression.Text, Invalid: jtc.Expression.Invalid},
+			}
+			outputs, err := parseJSONOutputs(jtc.Output)
+			if err != nil {
+				return models.Tests{}, fmt.Errorf("output of test %s: %w", jtc.Name, err)
+			}
+			for _, o := range outputs {
+				tc.Output = append(tc.Output, models.Output{Text: o.Text, Type: o.Type})
+			}
+			g.Test = append(g.Test, tc)
+		}
+		tests.Group = append(tests.Group, g)
+	}
+	return tests, nil
+}
+
+// parseJSONOutputs parses an output that is a single output or a list of them.
+func parseJSONOutputs(b json.RawMessage) ([]jsonOutput, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return nil, nil
+	}
+	var outputs []jsonOutput
+	if err := json.Unmarshal(b, &outputs); err == nil {
+		return outputs, nil
+	}
+	var o jsonOutput
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil, err
+	}
+	return []jsonOutput{o}, nil
+}